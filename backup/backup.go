@@ -0,0 +1,300 @@
+// Package backup implements the scheduled backups for the data provider content.
+// The backups have the same format as the ones generated by the dumpdata REST API,
+// they can be compressed and encrypted and they can be stored inside the local
+// backups path or on an S3/GCS bucket. Old backups are automatically removed
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const logSender = "backup"
+
+// Supported storages for the backups
+const (
+	// StorageLocal stores the backups inside the configured backups path
+	StorageLocal = iota
+	// StorageS3 stores the backups on an S3 compatible object storage
+	StorageS3
+	// StorageGCS stores the backups on Google Cloud Storage
+	StorageGCS
+)
+
+var (
+	conf        Config
+	localPath   string
+	stateMutex  sync.RWMutex
+	status      Status
+	activeSched *scheduler
+)
+
+// S3Config defines the S3 bucket to use to store the backups
+type S3Config struct {
+	Bucket string `json:"bucket" mapstructure:"bucket"`
+	// If not empty the backups are stored inside this "directory", it must end with "/"
+	KeyPrefix    string `json:"key_prefix" mapstructure:"key_prefix"`
+	Region       string `json:"region" mapstructure:"region"`
+	AccessKey    string `json:"access_key" mapstructure:"access_key"`
+	AccessSecret string `json:"access_secret" mapstructure:"access_secret"`
+	Endpoint     string `json:"endpoint" mapstructure:"endpoint"`
+	StorageClass string `json:"storage_class" mapstructure:"storage_class"`
+}
+
+// GCSConfig defines the Google Cloud Storage bucket to use to store the backups
+type GCSConfig struct {
+	Bucket string `json:"bucket" mapstructure:"bucket"`
+	// If not empty the backups are stored inside this "directory", it must end with "/"
+	KeyPrefix string `json:"key_prefix" mapstructure:"key_prefix"`
+	// Path to the credentials file. This can be an absolute path or a path relative to the config dir
+	CredentialFile string `json:"credential_file" mapstructure:"credential_file"`
+	// Set to 1 to use the Application Default Credentials strategy instead of the credentials file
+	AutomaticCredentials int    `json:"automatic_credentials" mapstructure:"automatic_credentials"`
+	StorageClass         string `json:"storage_class" mapstructure:"storage_class"`
+}
+
+// Config defines the configuration for the scheduled backups
+type Config struct {
+	// Cron-like schedule for the backups, for example "0 2 * * *" means every day at 02:00.
+	// The fields are: minute, hour, day of month, month, day of week.
+	// Empty means disabled
+	Schedule string `json:"schedule" mapstructure:"schedule"`
+	// Where to store the backups: 0 local backups path, 1 S3, 2 Google Cloud Storage
+	Storage int `json:"storage" mapstructure:"storage"`
+	// S3 configuration, used if storage is 1
+	S3 S3Config `json:"s3" mapstructure:"s3"`
+	// GCS configuration, used if storage is 2
+	GCS GCSConfig `json:"gcs" mapstructure:"gcs"`
+	// Set to true to compress the backups using gzip
+	Compress bool `json:"compress" mapstructure:"compress"`
+	// If not empty the backups are encrypted using AES-256-GCM with a key derived from this passphrase.
+	// The same passphrase is used to restore encrypted backups using the loaddata REST API
+	Passphrase string `json:"passphrase" mapstructure:"passphrase"`
+	// Maximum number of backups to keep, 0 means no limit
+	MaxBackups int `json:"max_backups" mapstructure:"max_backups"`
+	// Maximum number of days to keep the backups, 0 means no limit
+	MaxAge int `json:"max_age" mapstructure:"max_age"`
+}
+
+// Status defines the status for the scheduled backups.
+// The times are unix timestamps in milliseconds
+type Status struct {
+	Enabled  bool   `json:"enabled"`
+	Schedule string `json:"schedule,omitempty"`
+	Running  bool   `json:"running"`
+	NextRun  int64  `json:"next_run,omitempty"`
+	// start time for the last backup, successful or not
+	LastRun int64 `json:"last_run,omitempty"`
+	// last backup duration in milliseconds
+	LastDuration int64 `json:"last_duration,omitempty"`
+	// empty if the last backup succeeded
+	LastError   string `json:"last_error,omitempty"`
+	LastSuccess int64  `json:"last_success,omitempty"`
+	// name and size for the last successful backup
+	LastBackup     string `json:"last_backup,omitempty"`
+	LastBackupSize int64  `json:"last_backup_size,omitempty"`
+}
+
+// Initialize validates the configuration and starts the scheduler, if a schedule is configured.
+// backupsPath is the path for the local backups, it can be an absolute path or a path relative
+// to the config dir
+func (c Config) Initialize(configDir, backupsPath string) error {
+	Stop()
+	if c.Storage < StorageLocal || c.Storage > StorageGCS {
+		return fmt.Errorf("invalid backups storage %v", c.Storage)
+	}
+	if c.MaxBackups < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("invalid backups retention, max_backups: %v max_age: %v", c.MaxBackups, c.MaxAge)
+	}
+	if utils.IsFileInputValid(backupsPath) && !filepath.IsAbs(backupsPath) {
+		backupsPath = filepath.Join(configDir, backupsPath)
+	}
+	if c.Storage == StorageGCS && c.GCS.AutomaticCredentials == 0 && utils.IsFileInputValid(c.GCS.CredentialFile) &&
+		!filepath.IsAbs(c.GCS.CredentialFile) {
+		c.GCS.CredentialFile = filepath.Join(configDir, c.GCS.CredentialFile)
+	}
+	var sched *scheduler
+	if len(c.Schedule) > 0 {
+		s, err := parseSchedule(c.Schedule)
+		if err != nil {
+			return err
+		}
+		if _, err = getStorage(c, backupsPath); err != nil {
+			return fmt.Errorf("invalid backups storage configuration: %v", err)
+		}
+		sched = newScheduler(s)
+	}
+
+	stateMutex.Lock()
+	conf = c
+	localPath = backupsPath
+	status = Status{
+		Enabled:  sched != nil,
+		Schedule: c.Schedule,
+	}
+	activeSched = sched
+	stateMutex.Unlock()
+
+	if sched != nil {
+		logger.Info(logSender, "", "scheduled backups enabled, schedule: %#v storage: %v compress: %v encrypt: %v "+
+			"max backups: %v max age: %v", c.Schedule, c.Storage, c.Compress, len(c.Passphrase) > 0, c.MaxBackups,
+			c.MaxAge)
+		go sched.start()
+	}
+	return nil
+}
+
+// Stop stops the scheduler, if any. A backup in progress is not interrupted
+func Stop() {
+	stateMutex.Lock()
+	sched := activeSched
+	activeSched = nil
+	status.Enabled = false
+	status.NextRun = 0
+	stateMutex.Unlock()
+
+	if sched != nil {
+		sched.stop()
+	}
+}
+
+// GetStatus returns the status for the scheduled backups
+func GetStatus() Status {
+	stateMutex.RLock()
+	defer stateMutex.RUnlock()
+
+	return status
+}
+
+// NewReader returns a reader for the given backup. Compressed backups are decompressed and
+// encrypted backups are decrypted using the configured passphrase, so the returned reader
+// always contains the backup as JSON
+func NewReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(encryptionMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if isEncrypted(header) {
+		stateMutex.RLock()
+		passphrase := conf.Passphrase
+		stateMutex.RUnlock()
+		if len(passphrase) == 0 {
+			return nil, errors.New("the backup is encrypted and no backup passphrase is configured")
+		}
+		dr, err := newDecryptReader(br, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(dr)
+		if header, err = br.Peek(len(gzipMagic)); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	if isCompressed(header) {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+func isEncrypted(header []byte) bool {
+	return len(header) >= len(encryptionMagic) && string(header[:len(encryptionMagic)]) == string(encryptionMagic)
+}
+
+func isCompressed(header []byte) bool {
+	return len(header) >= len(gzipMagic) && header[0] == gzipMagic[0] && header[1] == gzipMagic[1]
+}
+
+func getConfig() (Config, string) {
+	stateMutex.RLock()
+	defer stateMutex.RUnlock()
+
+	return conf, localPath
+}
+
+func setRunning(startTime time.Time) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	status.Running = true
+	status.LastRun = utils.GetTimeAsMsSinceEpoch(startTime)
+}
+
+func setCompleted(startTime time.Time, name string, size int64, err error) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	status.Running = false
+	status.LastDuration = time.Since(startTime).Milliseconds()
+	if err != nil {
+		status.LastError = err.Error()
+		return
+	}
+	status.LastError = ""
+	status.LastSuccess = utils.GetTimeAsMsSinceEpoch(startTime)
+	status.LastBackup = name
+	status.LastBackupSize = size
+}
+
+func setNextRun(sched *scheduler, next time.Time) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	if activeSched != sched {
+		return
+	}
+	if next.IsZero() {
+		status.NextRun = 0
+		return
+	}
+	status.NextRun = utils.GetTimeAsMsSinceEpoch(next)
+}
+
+// scheduler runs the backups at the times defined by its schedule
+type scheduler struct {
+	schedule *schedule
+	done     chan bool
+	stopOnce sync.Once
+}
+
+func newScheduler(s *schedule) *scheduler {
+	return &scheduler{
+		schedule: s,
+		done:     make(chan bool),
+	}
+}
+
+func (s *scheduler) start() {
+	for {
+		next := s.schedule.next(time.Now())
+		setNextRun(s, next)
+		if next.IsZero() {
+			logger.Warn(logSender, "", "the backup schedule never matches, no backup will be executed")
+			return
+		}
+		logger.Debug(logSender, "", "next backup scheduled at %v", next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+			run() //nolint:errcheck
+		}
+	}
+}
+
+func (s *scheduler) stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
+}
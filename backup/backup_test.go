@@ -0,0 +1,313 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/kms"
+)
+
+var testBackupsPath string
+
+func TestMain(m *testing.M) {
+	var err error
+	testBackupsPath, err = ioutil.TempDir("", "scheduled_backups")
+	if err != nil {
+		fmt.Printf("unable to create temp dir: %v\n", err)
+		os.Exit(1)
+	}
+	err = kms.Config{MasterKeyPath: "master.key"}.Initialize(testBackupsPath)
+	if err != nil {
+		fmt.Printf("unable to initialize secrets encryption: %v\n", err)
+		os.Exit(1)
+	}
+	err = dataprovider.Initialize(dataprovider.Config{
+		Driver:          dataprovider.MemoryDataProviderName,
+		ManageUsers:     1,
+		CredentialsPath: "credentials",
+	}, testBackupsPath)
+	if err != nil {
+		fmt.Printf("unable to initialize data provider: %v\n", err)
+		os.Exit(1)
+	}
+	exitCode := m.Run()
+	os.RemoveAll(testBackupsPath)
+	os.Exit(exitCode)
+}
+
+func TestParseSchedule(t *testing.T) {
+	invalidSchedules := []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8",
+		"*/0 * * * *", "5-1 * * * *", "a * * * *", "1-a * * * *", "@every"}
+	for _, spec := range invalidSchedules {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("schedule %#v must be invalid", spec)
+		}
+	}
+	// Friday 16 October 2020 14:25:30
+	now := time.Date(2020, time.October, 16, 14, 25, 30, 0, time.UTC)
+	testCases := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2020, time.October, 16, 14, 26, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, time.October, 16, 14, 30, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2020, time.October, 17, 2, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2020, time.October, 17, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2020, time.October, 16, 15, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2020, time.October, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, time.October, 18, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, time.November, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 1 29 2 *", time.Date(2024, time.February, 29, 1, 30, 0, 0, time.UTC)},
+		{"10,20 9-17/4 * * 1-5", time.Date(2020, time.October, 16, 17, 10, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2020, time.October, 16, 14, 45, 0, 0, time.UTC)},
+		// day of month or day of week, as for cron
+		{"0 0 1 * 1", time.Date(2020, time.October, 19, 0, 0, 0, 0, time.UTC)},
+		// a field starting with "*" is not restricted, so the day must match both
+		{"0 0 */2 * 1", time.Date(2020, time.October, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tc := range testCases {
+		s, err := parseSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("unable to parse schedule %#v: %v", tc.spec, err)
+			continue
+		}
+		if next := s.next(now); !next.Equal(tc.next) {
+			t.Errorf("unexpected next run for schedule %#v: %v, expected: %v", tc.spec, next, tc.next)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1,
+		3*encryptionChunkSize + 100} {
+		data := bytes.Repeat([]byte("a"), size)
+		var buf bytes.Buffer
+		ew, err := newEncryptWriter(&buf, "passphrase")
+		if err != nil {
+			t.Fatalf("unable to create encrypt writer: %v", err)
+		}
+		// write the data in small pieces
+		for i := 0; i < len(data); i += 1000 {
+			end := i + 1000
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err = ew.Write(data[i:end]); err != nil {
+				t.Errorf("unable to write data: %v", err)
+			}
+		}
+		if err = ew.Close(); err != nil {
+			t.Errorf("unable to close encrypt writer: %v", err)
+		}
+		encrypted := buf.Bytes()
+		if bytes.Contains(encrypted, []byte("aaaa")) {
+			t.Errorf("the data is not encrypted, size: %v", size)
+		}
+		decrypted, err := decryptBackup(encrypted, "passphrase")
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Errorf("unable to decrypt data, size: %v, err: %v", size, err)
+		}
+		if _, err = decryptBackup(encrypted, "wrong passphrase"); err == nil {
+			t.Errorf("decrypting with a wrong passphrase must fail, size: %v", size)
+		}
+		// truncated at the chunks boundary or in the middle of a chunk
+		for _, truncatedSize := range []int{len(encrypted) - 1, len(encrypted) - encryptionChunkSize - 16,
+			len(encryptionMagic) + encryptionSaltSize + encryptionPrefixSize, len(encryptionMagic) + 1} {
+			if truncatedSize < 0 {
+				continue
+			}
+			if _, err = decryptBackup(encrypted[:truncatedSize], "passphrase"); err == nil {
+				t.Errorf("decrypting a truncated backup must fail, size: %v truncated size: %v", size, truncatedSize)
+			}
+		}
+		tampered := append([]byte{}, encrypted...)
+		tampered[len(tampered)-1] ^= 1
+		if _, err = decryptBackup(tampered, "passphrase"); err == nil {
+			t.Errorf("decrypting a tampered backup must fail, size: %v", size)
+		}
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	conf = Config{Passphrase: "secret"}
+	defer func() {
+		conf = Config{}
+	}()
+	for _, c := range []Config{{}, {Compress: true}, {Passphrase: "secret"}, {Compress: true, Passphrase: "secret"}} {
+		var buf bytes.Buffer
+		if err := writeBackupData(dataprovider.GetProvider(), &buf, nil, nil, c); err != nil {
+			t.Errorf("unable to write backup for config %+v: %v", c, err)
+			continue
+		}
+		r, err := NewReader(&buf)
+		if err != nil {
+			t.Errorf("unable to get reader for config %+v: %v", c, err)
+			continue
+		}
+		var backupData dataprovider.BackupData
+		if err = json.NewDecoder(r).Decode(&backupData); err != nil {
+			t.Errorf("unable to decode backup for config %+v: %v", c, err)
+		}
+	}
+	conf = Config{}
+	if _, err := NewReader(bytes.NewReader(append(encryptionMagic, []byte("{}")...))); err == nil {
+		t.Error("reading an encrypted backup without a passphrase must fail")
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	invalidConfigs := []Config{
+		{Schedule: "@daily", Storage: 3},
+		{Schedule: "@daily", MaxBackups: -1},
+		{Schedule: "@daily", MaxAge: -1},
+		{Schedule: "invalid"},
+		{Schedule: "@daily", Storage: StorageS3},
+		{Schedule: "@daily", Storage: StorageGCS, GCS: GCSConfig{Bucket: "bucket", CredentialFile: "missing.json"}},
+	}
+	for _, c := range invalidConfigs {
+		if err := c.Initialize(testBackupsPath, "backups"); err == nil {
+			t.Errorf("initialization must fail for config %+v", c)
+		}
+	}
+	if err := (Config{Schedule: "@daily"}).Initialize(testBackupsPath, ""); err == nil {
+		t.Error("initialization must fail for an empty backups path")
+	}
+	c := Config{Schedule: "@daily", Storage: StorageS3, S3: S3Config{Bucket: "bucket", Region: "us-east-1",
+		AccessKey: "key", AccessSecret: "secret", KeyPrefix: "backups"}}
+	if err := c.Initialize(testBackupsPath, "backups"); err != nil {
+		t.Errorf("unable to initialize S3 backups: %v", err)
+	}
+	s, err := getStorage(c, "")
+	if err != nil || s.dir != "backups/" || s.getPath("name") != "backups/name" {
+		t.Errorf("unexpected S3 storage: %+v, err: %v", s, err)
+	}
+	Stop()
+	if err = (Config{}).Initialize(testBackupsPath, "backups"); err != nil {
+		t.Errorf("unable to initialize disabled backups: %v", err)
+	}
+	if _, backupsPath := getConfig(); backupsPath != filepath.Join(testBackupsPath, "backups") {
+		t.Errorf("unexpected backups path: %#v", backupsPath)
+	}
+	if status := GetStatus(); status.Enabled {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestScheduledBackups(t *testing.T) {
+	p := dataprovider.GetProvider()
+	user := dataprovider.User{
+		Username:    "backup_user",
+		Password:    "password",
+		HomeDir:     filepath.Join(os.TempDir(), "backup_user"),
+		Status:      1,
+		Permissions: map[string][]string{"/": {dataprovider.PermAny}},
+	}
+	if err := dataprovider.AddUser(p, user); err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	backupsPath := filepath.Join(testBackupsPath, "scheduled")
+	c := Config{Schedule: "0 0 1 1 *", Compress: true, Passphrase: "secret", MaxBackups: 3, MaxAge: 30}
+	if err := c.Initialize(testBackupsPath, backupsPath); err != nil {
+		t.Fatalf("unable to initialize scheduled backups: %v", err)
+	}
+	defer Stop()
+
+	// old backups to prune, the files not generated by the scheduler are never removed
+	now := time.Now()
+	oldBackups := []string{
+		getBackupName(now.Add(-1*time.Hour), Config{}),
+		getBackupName(now.Add(-2*time.Hour), Config{Compress: true}),
+		getBackupName(now.Add(-3*time.Hour), Config{Passphrase: "secret"}),
+		getBackupName(now.AddDate(0, 0, -31), Config{}),
+	}
+	otherFiles := []string{"backup.json", backupNamePrefix + "invalid.json", getBackupName(now, Config{}) + ".tmp"}
+	if err := os.MkdirAll(backupsPath, 0700); err != nil {
+		t.Fatalf("unable to create backups dir: %v", err)
+	}
+	for _, name := range append(oldBackups, otherFiles...) {
+		if err := ioutil.WriteFile(filepath.Join(backupsPath, name), []byte("{}"), 0600); err != nil {
+			t.Errorf("unable to create file: %v", err)
+		}
+	}
+	status, err := run()
+	if err != nil {
+		t.Fatalf("unable to run backup: %v", err)
+	}
+	if _, ok := parseBackupName(status.LastBackup); !ok || status.Running || len(status.LastError) > 0 ||
+		status.LastSuccess == 0 || status.LastRun != status.LastSuccess || status.LastBackupSize == 0 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	contents, err := ioutil.ReadDir(backupsPath)
+	if err != nil {
+		t.Fatalf("unable to read backups dir: %v", err)
+	}
+	var names []string
+	for _, info := range contents {
+		names = append(names, info.Name())
+	}
+	// the new backup and the two most recent ones are kept
+	expected := map[string]bool{status.LastBackup: true, oldBackups[0]: true, oldBackups[1]: true}
+	for _, name := range otherFiles {
+		expected[name] = true
+	}
+	if len(names) != len(expected) {
+		t.Errorf("unexpected backups: %v", names)
+	}
+	for _, name := range names {
+		if !expected[name] {
+			t.Errorf("unexpected backup %#v, backups: %v", name, names)
+		}
+	}
+	f, err := os.Open(filepath.Join(backupsPath, status.LastBackup))
+	if err != nil {
+		t.Fatalf("unable to open backup: %v", err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected backup permissions: %v, err: %v", info.Mode(), err)
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatalf("unable to read backup: %v", err)
+	}
+	var backupData dataprovider.BackupData
+	if err = json.NewDecoder(r).Decode(&backupData); err != nil {
+		t.Errorf("unable to decode backup: %v", err)
+	}
+	if len(backupData.Users) != 1 || backupData.Users[0].Username != user.Username {
+		t.Errorf("unexpected backup content: %+v", backupData)
+	}
+
+	// a backup error is reported inside the status
+	stateMutex.Lock()
+	localPath = filepath.Join(backupsPath, status.LastBackup, "invalid")
+	stateMutex.Unlock()
+	status, err = run()
+	if err == nil || len(status.LastError) == 0 || status.LastRun == status.LastSuccess {
+		t.Errorf("unexpected status after a failed backup: %+v, err: %v", status, err)
+	}
+	if err = dataprovider.DeleteUser(p, user); err != nil {
+		t.Errorf("unable to delete user: %v", err)
+	}
+}
+
+func decryptBackup(data []byte, passphrase string) ([]byte, error) {
+	conf.Passphrase = passphrase
+	defer func() {
+		conf.Passphrase = ""
+	}()
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
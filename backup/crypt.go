@@ -0,0 +1,213 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The encrypted backups have the following format:
+//
+// magic | salt (16 bytes) | nonce prefix (7 bytes) | chunk 1 | ... | chunk N
+//
+// The key is derived from the passphrase using Argon2id and the given salt.
+// Each chunk contains up to encryptionChunkSize bytes of plain text sealed using
+// AES-256-GCM. The nonce for each chunk is the nonce prefix followed by the chunk
+// counter and by a byte that is 1 for the last chunk, 0 otherwise, so reordered,
+// duplicated or truncated chunks are detected
+const (
+	encryptionChunkSize   = 64 * 1024
+	encryptionSaltSize    = 16
+	encryptionPrefixSize  = 7
+	encryptionKeySize     = 32
+	encryptionArgonTime   = 1
+	encryptionArgonMemory = 64 * 1024
+	encryptionArgonThread = 4
+)
+
+var (
+	encryptionMagic = []byte("SFTPGOBACKUPENC1")
+	gzipMagic       = []byte{0x1f, 0x8b}
+
+	errBackupTruncated = errors.New("the encrypted backup is truncated")
+)
+
+func newBackupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), salt, encryptionArgonTime, encryptionArgonMemory, encryptionArgonThread,
+		encryptionKeySize)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func getChunkNonce(prefix []byte, counter uint32, isLast bool) []byte {
+	nonce := make([]byte, 0, encryptionPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = append(nonce, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], counter)
+	if isLast {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts the data written to it, Close must be called to write the last chunk.
+// Closing an encryptWriter does not close the underlying writer
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	err     error
+}
+
+func newEncryptWriter(w io.Writer, passphrase string) (*encryptWriter, error) {
+	header := make([]byte, encryptionSaltSize+encryptionPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, header); err != nil {
+		return nil, err
+	}
+	aead, err := newBackupCipher(passphrase, header[:encryptionSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(encryptionMagic); err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		prefix: header[encryptionSaltSize:],
+		buf:    make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if e.err != nil {
+			return written, e.err
+		}
+		// a full chunk is sealed only when we have more data, so we know it is not the last one
+		if len(e.buf) == encryptionChunkSize {
+			e.writeChunk(false)
+			continue
+		}
+		n := copy(e.buf[len(e.buf):encryptionChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, e.err
+}
+
+func (e *encryptWriter) writeChunk(isLast bool) {
+	if e.err != nil {
+		return
+	}
+	if e.counter == ^uint32(0) {
+		e.err = errors.New("the backup is too large to be encrypted")
+		return
+	}
+	sealed := e.aead.Seal(nil, getChunkNonce(e.prefix, e.counter, isLast), e.buf, nil)
+	_, e.err = e.w.Write(sealed)
+	e.counter++
+	e.buf = e.buf[:0]
+}
+
+// Close writes the last chunk
+func (e *encryptWriter) Close() error {
+	e.writeChunk(true)
+	return e.err
+}
+
+// decryptReader decrypts the data written by an encryptWriter
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte
+	buf     []byte
+	done    bool
+}
+
+func newDecryptReader(r *bufio.Reader, passphrase string) (*decryptReader, error) {
+	header := make([]byte, len(encryptionMagic)+encryptionSaltSize+encryptionPrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errBackupTruncated
+	}
+	if !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+		return nil, errors.New("the backup is not encrypted")
+	}
+	header = header[len(encryptionMagic):]
+	aead, err := newBackupCipher(passphrase, header[:encryptionSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:      r,
+		aead:   aead,
+		prefix: header[encryptionSaltSize:],
+		chunk:  make([]byte, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) readChunk() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	isLast := false
+	switch err {
+	case nil:
+		// a full chunk is the last one if there is no more data
+		if _, err = d.r.Peek(1); err == io.EOF {
+			isLast = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		isLast = true
+	case io.EOF:
+		return errBackupTruncated
+	default:
+		return err
+	}
+	buf, err := d.aead.Open(d.chunk[:0], getChunkNonce(d.prefix, d.counter, isLast), d.chunk[:n], nil)
+	if err != nil {
+		if isLast {
+			// we cannot distinguish a wrong passphrase from a truncated backup
+			// if the last chunk cannot be opened
+			return errors.New("unable to decrypt the backup: wrong passphrase or truncated backup")
+		}
+		return errors.New("unable to decrypt the backup: wrong passphrase or corrupted backup")
+	}
+	d.counter++
+	d.buf = buf
+	d.done = isLast
+	return nil
+}
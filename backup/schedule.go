@@ -0,0 +1,179 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the next run is searched within this number of years, a schedule such as
+// "0 0 30 2 *" never matches
+const maxScheduleYears = 5
+
+var scheduleDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// scheduleField defines the allowed range for a cron field
+type scheduleField struct {
+	name string
+	min  int
+	max  int
+}
+
+var scheduleFields = []scheduleField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12},
+	{name: "day of week", min: 0, max: 7},
+}
+
+// schedule is a parsed cron-like schedule, each field is a bit set of the allowed values
+type schedule struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// if both day of month and day of week are restricted, that is they don't start
+	// with "*", a day matches if it matches any of them, as for cron
+	domRestricted bool
+	dowRestricted bool
+}
+
+// parseSchedule parses a cron-like schedule with the following fields:
+// minute, hour, day of month, month, day of week.
+// Each field supports "*", single values, ranges ("1-5"), steps ("*/15", "0-30/10")
+// and comma separated lists of them. The predefined descriptors "@yearly", "@monthly",
+// "@weekly", "@daily" and "@hourly" are supported too
+func parseSchedule(spec string) (*schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if descriptor, ok := scheduleDescriptors[strings.ToLower(spec)]; ok {
+		spec = descriptor
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(scheduleFields) {
+		return nil, fmt.Errorf("invalid schedule %#v: expected %v fields, found %v", spec, len(scheduleFields),
+			len(fields))
+	}
+	values := make([]uint64, len(fields))
+	for idx, field := range fields {
+		bits, err := parseScheduleField(field, scheduleFields[idx])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %#v: %v", spec, err)
+		}
+		values[idx] = bits
+	}
+	s := &schedule{
+		minute:        values[0],
+		hour:          values[1],
+		dom:           values[2],
+		month:         values[3],
+		dow:           values[4],
+		domRestricted: !strings.HasPrefix(fields[2], "*"),
+		dowRestricted: !strings.HasPrefix(fields[4], "*"),
+	}
+	// 7 is an alias for Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func parseScheduleField(field string, def scheduleField) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		start, end, step := def.min, def.max, 1
+		rangeSpec := item
+		if idx := strings.Index(item, "/"); idx >= 0 {
+			var err error
+			step, err = strconv.Atoi(item[idx+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %#v for %v", item, def.name)
+			}
+			rangeSpec = item[:idx]
+		}
+		if rangeSpec != "*" {
+			bounds := strings.SplitN(rangeSpec, "-", 2)
+			var err error
+			start, err = parseScheduleValue(bounds[0], def)
+			if err != nil {
+				return 0, err
+			}
+			end = start
+			if len(bounds) == 2 {
+				end, err = parseScheduleValue(bounds[1], def)
+				if err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// "5/10" means from 5 to the max allowed value every 10
+				end = def.max
+			}
+			if start > end {
+				return 0, fmt.Errorf("invalid range %#v for %v", item, def.name)
+			}
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func parseScheduleValue(value string, def scheduleField) (int, error) {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %#v for %v", value, def.name)
+	}
+	if v < def.min || v > def.max {
+		return 0, fmt.Errorf("value %v out of range [%v-%v] for %v", v, def.min, def.max, def.name)
+	}
+	return v, nil
+}
+
+// next returns the first time matching the schedule after t, the zero time
+// is returned if the schedule never matches
+func (s *schedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(maxScheduleYears, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *schedule) matchDay(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
@@ -0,0 +1,313 @@
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	backupNamePrefix     = "sftpgo-backup-"
+	backupNameTimeFormat = "2006-01-02T15-04-05"
+	backupNameExt        = ".json"
+	compressedExt        = ".gz"
+	encryptedExt         = ".enc"
+	storageConnectionID  = "backup"
+)
+
+// backupStorage stores the backups using a vfs.Fs
+type backupStorage struct {
+	fs vfs.Fs
+	// local directory or key prefix containing the backups
+	dir string
+}
+
+func getStorage(c Config, backupsPath string) (*backupStorage, error) {
+	switch c.Storage {
+	case StorageS3:
+		s3Config := vfs.S3FsConfig{
+			Bucket:       c.S3.Bucket,
+			KeyPrefix:    c.S3.KeyPrefix,
+			Region:       c.S3.Region,
+			AccessKey:    c.S3.AccessKey,
+			AccessSecret: kms.NewPlainSecret(c.S3.AccessSecret),
+			Endpoint:     c.S3.Endpoint,
+			StorageClass: c.S3.StorageClass,
+		}
+		if err := vfs.ValidateS3FsConfig(&s3Config); err != nil {
+			return nil, err
+		}
+		fs, err := vfs.NewS3Fs(storageConnectionID, "", s3Config)
+		if err != nil {
+			return nil, err
+		}
+		return &backupStorage{fs: fs, dir: s3Config.KeyPrefix}, nil
+	case StorageGCS:
+		gcsConfig := vfs.GCSFsConfig{
+			Bucket:               c.GCS.Bucket,
+			KeyPrefix:            c.GCS.KeyPrefix,
+			CredentialFile:       c.GCS.CredentialFile,
+			AutomaticCredentials: c.GCS.AutomaticCredentials,
+			StorageClass:         c.GCS.StorageClass,
+		}
+		if err := vfs.ValidateGCSFsConfig(&gcsConfig, gcsConfig.CredentialFile); err != nil {
+			return nil, err
+		}
+		fs, err := vfs.NewGCSFs(storageConnectionID, "", gcsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &backupStorage{fs: fs, dir: gcsConfig.KeyPrefix}, nil
+	default:
+		if len(backupsPath) == 0 {
+			return nil, errors.New("invalid backups path")
+		}
+		return &backupStorage{fs: vfs.NewOsFs(storageConnectionID, backupsPath, nil), dir: backupsPath}, nil
+	}
+}
+
+func (s *backupStorage) getPath(name string) string {
+	if vfs.IsLocalOsFs(s.fs) {
+		return filepath.Join(s.dir, name)
+	}
+	return s.dir + name
+}
+
+func (s *backupStorage) getDir() string {
+	if len(s.dir) == 0 {
+		// the bucket root
+		return "."
+	}
+	return s.dir
+}
+
+// write writes a new backup and returns its size
+func (s *backupStorage) write(name string, c Config) (int64, error) {
+	p := dataprovider.GetProvider()
+	// groups and admins are read before creating the backup, so the data provider errors
+	// are detected before writing anything
+	groups, err := dataprovider.DumpGroups(p)
+	if err != nil {
+		return 0, err
+	}
+	admins, err := dataprovider.DumpAdmins(p)
+	if err != nil {
+		return 0, err
+	}
+	filePath := s.getPath(name)
+	uploadPath := filePath
+	if s.fs.IsAtomicUploadSupported() {
+		uploadPath = s.fs.GetAtomicUploadPath(filePath)
+	}
+	if vfs.IsLocalOsFs(s.fs) {
+		if err = os.MkdirAll(s.dir, 0700); err != nil {
+			return 0, err
+		}
+	}
+	file, pipeWriter, cancelFn, err := s.fs.Create(uploadPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return 0, err
+	}
+	var w io.Writer
+	if file != nil {
+		// the backups contain sensitive data
+		file.Chmod(0600) //nolint:errcheck
+		w = file
+	} else {
+		w = pipeWriter
+	}
+	cw := &countingWriter{w: w}
+	err = writeBackupData(p, cw, groups, admins, c)
+	if file != nil {
+		if errClose := file.Close(); err == nil {
+			err = errClose
+		}
+		if err == nil && uploadPath != filePath {
+			err = s.fs.Rename(uploadPath, filePath)
+		}
+		if err != nil {
+			s.fs.Remove(uploadPath, false) //nolint:errcheck
+		}
+		return cw.written, err
+	}
+	if err != nil {
+		// the upload is aborted if the reader gets an error
+		pipeWriter.CloseWithError(err) //nolint:errcheck
+		cancelFn()
+		return cw.written, err
+	}
+	pipeWriter.Close()
+	if errUpload := pipeWriter.WaitForReader(); errUpload != io.EOF {
+		err = errUpload
+	}
+	cancelFn()
+	return cw.written, err
+}
+
+// writeBackupData writes a backup using the given configuration, layers are
+// JSON -> gzip (optional) -> encryption (optional) -> w
+func writeBackupData(p dataprovider.Provider, w io.Writer, groups []dataprovider.Group, admins []dataprovider.Admin,
+	c Config) error {
+	var closers []io.Closer
+	if len(c.Passphrase) > 0 {
+		ew, err := newEncryptWriter(w, c.Passphrase)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, ew)
+		w = ew
+	}
+	if c.Compress {
+		gw := gzip.NewWriter(w)
+		closers = append(closers, gw)
+		w = gw
+	}
+	bw := bufio.NewWriter(w)
+	err := dataprovider.WriteBackup(p, bw, groups, admins, false)
+	if err == nil {
+		err = bw.Flush()
+	}
+	// the writers must be closed in reverse order, the outer one first
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err != nil {
+			break
+		}
+		err = closers[i].Close()
+	}
+	return err
+}
+
+// prune removes the backups exceeding the configured max count or max age
+func (s *backupStorage) prune(c Config, now time.Time) error {
+	if c.MaxBackups == 0 && c.MaxAge == 0 {
+		return nil
+	}
+	contents, err := s.fs.ReadDir(s.getDir())
+	if err != nil {
+		return err
+	}
+	type backupFile struct {
+		name      string
+		createdAt time.Time
+	}
+	var backups []backupFile
+	for _, info := range contents {
+		if info.IsDir() {
+			continue
+		}
+		createdAt, ok := parseBackupName(info.Name())
+		if !ok {
+			continue
+		}
+		backups = append(backups, backupFile{name: info.Name(), createdAt: createdAt})
+	}
+	// newest first
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].createdAt.After(backups[j].createdAt)
+	})
+	var lastErr error
+	for idx, b := range backups {
+		toRemove := c.MaxBackups > 0 && idx >= c.MaxBackups
+		if c.MaxAge > 0 && now.Sub(b.createdAt) > time.Duration(c.MaxAge)*24*time.Hour {
+			// the most recent backup is never removed
+			toRemove = toRemove || idx > 0
+		}
+		if !toRemove {
+			continue
+		}
+		if err := s.fs.Remove(s.getPath(b.name), false); err != nil {
+			logger.Warn(logSender, "", "unable to remove old backup %#v: %v", b.name, err)
+			lastErr = err
+			continue
+		}
+		logger.Debug(logSender, "", "old backup %#v removed", b.name)
+	}
+	return lastErr
+}
+
+func getBackupName(t time.Time, c Config) string {
+	name := backupNamePrefix + t.Format(backupNameTimeFormat) + backupNameExt
+	if c.Compress {
+		name += compressedExt
+	}
+	if len(c.Passphrase) > 0 {
+		name += encryptedExt
+	}
+	return name
+}
+
+// parseBackupName returns the creation time for a backup generated by the scheduler,
+// false is returned for any other file
+func parseBackupName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, backupNamePrefix) {
+		return time.Time{}, false
+	}
+	name = strings.TrimPrefix(name, backupNamePrefix)
+	if len(name) < len(backupNameTimeFormat) {
+		return time.Time{}, false
+	}
+	switch name[len(backupNameTimeFormat):] {
+	case backupNameExt, backupNameExt + compressedExt, backupNameExt + encryptedExt,
+		backupNameExt + compressedExt + encryptedExt:
+	default:
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(backupNameTimeFormat, name[:len(backupNameTimeFormat)], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// run executes a backup and then removes the old ones
+func run() (Status, error) {
+	c, backupsPath := getConfig()
+	startTime := time.Now()
+	name := getBackupName(startTime, c)
+	setRunning(startTime)
+	logger.Info(logSender, "", "starting backup %#v", name)
+
+	var size int64
+	s, err := getStorage(c, backupsPath)
+	if err == nil {
+		size, err = s.write(name, c)
+	}
+	if err == nil {
+		if errPrune := s.prune(c, startTime); errPrune != nil {
+			logger.Warn(logSender, "", "unable to remove old backups: %v", errPrune)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("unable to write backup %#v: %v", name, err)
+		logger.Warn(logSender, "", "%v", err)
+	} else {
+		logger.Info(logSender, "", "backup %#v completed, size: %v, elapsed: %v", name, size, time.Since(startTime))
+	}
+	setCompleted(startTime, name, size, err)
+	metrics.BackupCompleted(size, err)
+	return GetStatus(), err
+}
+
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/drakkan/sftpgo/config"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+var (
+	migrateDestConfigFile string
+	migrateBatchSize      int
+	migrateDryRun         bool
+
+	migrateProviderCmd = &cobra.Command{
+		Use:   "migrateprovider",
+		Short: "Migrates the data from the configured data provider to another one",
+		Long: `This command copies the groups, the users, the admins, the API keys, the shares and the banned IPs
+from the data provider configured in the specified configuration file to the data provider configured in the
+destination configuration file.
+
+The data is read and written in batches. Unlike "dumpdata" and "loaddata", the user IDs, the used quota, the
+last login and the shares usage are preserved. After the copy the data is read back from the destination data
+provider and its count and checksum are compared with the source ones.
+
+The destination configuration file must be stored inside the config dir too and it must define the full
+"data_provider" section. The destination data provider must be initialized, using "initprovider" if required,
+and it must be empty. The destination database structure is updated, if required, before the copy.
+A dry run does not modify the destination data provider, so its database structure must be already updated.
+
+The source data provider should not be modified while the migration is in progress, stop SFTPGo or disable
+the user management before starting the migration.
+
+To check the migration without writing anything to the destination data provider use the "dry-run" flag:
+
+sftpgo migrateprovider --destination-config-file sftpgo_pgsql --dry-run
+
+Please take a look at the usage below to customize the options.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.DisableLogger()
+			logger.EnableConsoleLogger(zerolog.DebugLevel)
+			configDir = utils.CleanDirInput(configDir)
+			// the destination configuration is loaded first so the settings not defined inside
+			// it are not inherited from the source configuration
+			if err := config.LoadConfig(configDir, migrateDestConfigFile); err != nil {
+				logger.WarnToConsole("Unable to load the destination configuration: %v", err)
+				os.Exit(1)
+			}
+			destConf := config.GetProviderConf()
+			if err := config.LoadConfig(configDir, configFile); err != nil {
+				logger.WarnToConsole("Unable to load the source configuration: %v", err)
+				os.Exit(1)
+			}
+			sourceConf := config.GetProviderConf()
+			// the secrets encryption configuration is shared by the source and the destination
+			if err := config.GetKMSConfig().Initialize(configDir); err != nil {
+				logger.WarnToConsole("Unable to initialize the secrets encryption: %v", err)
+				os.Exit(1)
+			}
+			logger.DebugToConsole("Migrating data from provider: %#v config file: %#v to provider: %#v, dry run: %v",
+				sourceConf.Driver, viper.ConfigFileUsed(), destConf.Driver, migrateDryRun)
+			result, err := dataprovider.MigrateProvider(sourceConf, destConf, configDir, dataprovider.MigrationOptions{
+				BatchSize: migrateBatchSize,
+				DryRun:    migrateDryRun,
+			})
+			if err != nil {
+				logger.WarnToConsole("Unable to migrate the data provider: %v, migrated groups: %v users: %v admins: %v "+
+					"API keys: %v shares: %v banned IPs: %v", err, result.Groups, result.Users, result.Admins, result.APIKeys,
+					result.Shares, result.BannedIPs)
+				os.Exit(1)
+			}
+			if migrateDryRun {
+				logger.DebugToConsole("Dry run completed, groups: %v users: %v admins: %v API keys: %v shares: %v "+
+					"banned IPs: %v checksum: %v", result.Groups, result.Users, result.Admins, result.APIKeys, result.Shares,
+					result.BannedIPs, result.SourceChecksum)
+				return
+			}
+			logger.DebugToConsole("Data provider successfully migrated, groups: %v users: %v admins: %v API keys: %v "+
+				"shares: %v banned IPs: %v checksum: %v", result.Groups, result.Users, result.Admins, result.APIKeys,
+				result.Shares, result.BannedIPs, result.DestinationChecksum)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(migrateProviderCmd)
+	addConfigFlags(migrateProviderCmd)
+
+	migrateProviderCmd.Flags().StringVar(&migrateDestConfigFile, "destination-config-file", "",
+		"Name for the configuration file that defines the destination data provider. As for config-file, it must be "+
+			"the name of a file stored in config-dir without extension")
+	migrateProviderCmd.MarkFlagRequired("destination-config-file") //nolint:errcheck
+	migrateProviderCmd.Flags().IntVar(&migrateBatchSize, "batch-size", 100, "Number of users, API keys, shares and banned "+
+		"IPs to read and write for each batch")
+	migrateProviderCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "Read and validate the source data without "+
+		"writing it to the destination data provider")
+}
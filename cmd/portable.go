@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/service"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/vfs"
@@ -44,6 +45,23 @@ var (
 	portableGCSAutoCredentials   int
 	portableGCSStorageClass      string
 	portableGCSKeyPrefix         string
+	portableAzContainer          string
+	portableAzAccountName        string
+	portableAzAccountKey         string
+	portableAzEndpoint           string
+	portableAzSASURL             string
+	portableAzKeyPrefix          string
+	portableAzAccessTier         string
+	portableAzULPartSize         int
+	portableAzULConcurrency      int
+	portableAzUseEmulator        bool
+	portableSFTPEndpoint         string
+	portableSFTPUsername         string
+	portableSFTPPassword         string
+	portableSFTPPrivateKeyPath   string
+	portableSFTPFingerprints     []string
+	portableSFTPPrefix           string
+	portableCryptPassphrase      string
 	portableCmd                  = &cobra.Command{
 		Use:   "portable",
 		Short: "Serve a single directory",
@@ -82,6 +100,25 @@ Please take a look at the usage below to customize the serving parameters`,
 				portableGCSCredentials = base64.StdEncoding.EncodeToString(creds)
 				portableGCSAutoCredentials = 0
 			}
+			portableSFTPPrivateKey := ""
+			if portableFsProvider == 4 && len(portableSFTPPrivateKeyPath) > 0 {
+				fi, err := os.Stat(portableSFTPPrivateKeyPath)
+				if err != nil {
+					fmt.Printf("Invalid SFTP private key file: %v\n", err)
+					return
+				}
+				if fi.Size() > 1048576 {
+					fmt.Printf("Invalid SFTP private key file: %#v is too big %v/1048576 bytes\n", portableSFTPPrivateKeyPath,
+						fi.Size())
+					return
+				}
+				privateKey, err := ioutil.ReadFile(portableSFTPPrivateKeyPath)
+				if err != nil {
+					fmt.Printf("Unable to read SFTP private key file: %v\n", err)
+					return
+				}
+				portableSFTPPrivateKey = string(privateKey)
+			}
 			service := service.Service{
 				ConfigDir:     filepath.Clean(defaultConfigDir),
 				ConfigFile:    defaultConfigName,
@@ -107,7 +144,7 @@ Please take a look at the usage below to customize the serving parameters`,
 							Bucket:            portableS3Bucket,
 							Region:            portableS3Region,
 							AccessKey:         portableS3AccessKey,
-							AccessSecret:      portableS3AccessSecret,
+							AccessSecret:      kms.NewPlainSecret(portableS3AccessSecret),
 							Endpoint:          portableS3Endpoint,
 							StorageClass:      portableS3StorageClass,
 							KeyPrefix:         portableS3KeyPrefix,
@@ -116,11 +153,34 @@ Please take a look at the usage below to customize the serving parameters`,
 						},
 						GCSConfig: vfs.GCSFsConfig{
 							Bucket:               portableGCSBucket,
-							Credentials:          portableGCSCredentials,
+							Credentials:          kms.NewPlainSecret(portableGCSCredentials),
 							AutomaticCredentials: portableGCSAutoCredentials,
 							StorageClass:         portableGCSStorageClass,
 							KeyPrefix:            portableGCSKeyPrefix,
 						},
+						AzBlobConfig: vfs.AzBlobFsConfig{
+							Container:         portableAzContainer,
+							AccountName:       portableAzAccountName,
+							AccountKey:        kms.NewPlainSecret(portableAzAccountKey),
+							Endpoint:          portableAzEndpoint,
+							SASURL:            portableAzSASURL,
+							KeyPrefix:         portableAzKeyPrefix,
+							UploadPartSize:    int64(portableAzULPartSize),
+							UploadConcurrency: portableAzULConcurrency,
+							UseEmulator:       portableAzUseEmulator,
+							AccessTier:        portableAzAccessTier,
+						},
+						SFTPConfig: vfs.SFTPFsConfig{
+							Endpoint:     portableSFTPEndpoint,
+							Username:     portableSFTPUsername,
+							Password:     kms.NewPlainSecret(portableSFTPPassword),
+							PrivateKey:   kms.NewPlainSecret(portableSFTPPrivateKey),
+							Fingerprints: portableSFTPFingerprints,
+							Prefix:       portableSFTPPrefix,
+						},
+						CryptConfig: vfs.CryptFsConfig{
+							Passphrase: kms.NewPlainSecret(portableCryptPassphrase),
+						},
 					},
 					Filters: dataprovider.UserFilters{
 						FileExtensions: parseFileExtensionsFilters(),
@@ -156,7 +216,7 @@ func init() {
 	portableCmd.Flags().BoolVarP(&portableAdvertiseCredentials, "advertise-credentials", "C", false,
 		"If the SFTP service is advertised via multicast DNS, this flag allows to put username/password inside the advertised TXT record")
 	portableCmd.Flags().IntVarP(&portableFsProvider, "fs-provider", "f", 0, "0 means local filesystem, 1 Amazon S3 compatible, "+
-		"2 Google Cloud Storage")
+		"2 Google Cloud Storage, 3 Azure Blob Storage, 4 SFTP")
 	portableCmd.Flags().StringVar(&portableS3Bucket, "s3-bucket", "", "")
 	portableCmd.Flags().StringVar(&portableS3Region, "s3-region", "", "")
 	portableCmd.Flags().StringVar(&portableS3AccessKey, "s3-access-key", "", "")
@@ -174,6 +234,29 @@ func init() {
 	portableCmd.Flags().StringVar(&portableGCSCredentialsFile, "gcs-credentials-file", "", "Google Cloud Storage JSON credentials file")
 	portableCmd.Flags().IntVar(&portableGCSAutoCredentials, "gcs-automatic-credentials", 1, "0 means explicit credentials using a JSON "+
 		"credentials file, 1 automatic")
+	portableCmd.Flags().StringVar(&portableAzContainer, "az-container", "", "")
+	portableCmd.Flags().StringVar(&portableAzAccountName, "az-account-name", "", "")
+	portableCmd.Flags().StringVar(&portableAzAccountKey, "az-account-key", "", "")
+	portableCmd.Flags().StringVar(&portableAzSASURL, "az-sas-url", "", "Shared access signature URL")
+	portableCmd.Flags().StringVar(&portableAzEndpoint, "az-endpoint", "", "Leave empty to use the default: "+
+		"\"blob.core.windows.net\"")
+	portableCmd.Flags().StringVar(&portableAzAccessTier, "az-access-tier", "", "Leave empty to use the default "+
+		"account access tier")
+	portableCmd.Flags().StringVar(&portableAzKeyPrefix, "az-key-prefix", "", "Allows to restrict access to the virtual folder "+
+		"identified by this prefix and its contents")
+	portableCmd.Flags().IntVar(&portableAzULPartSize, "az-upload-part-size", 4, "The buffer size for multipart uploads (MB)")
+	portableCmd.Flags().IntVar(&portableAzULConcurrency, "az-upload-concurrency", 2, "How many parts are uploaded in parallel")
+	portableCmd.Flags().BoolVar(&portableAzUseEmulator, "az-use-emulator", false, "")
+	portableCmd.Flags().StringVar(&portableSFTPEndpoint, "sftp-endpoint", "", "SFTP endpoint as host:port for SFTP provider")
+	portableCmd.Flags().StringVar(&portableSFTPUsername, "sftp-username", "", "SFTP user for SFTP provider")
+	portableCmd.Flags().StringVar(&portableSFTPPassword, "sftp-password", "", "SFTP password for SFTP provider")
+	portableCmd.Flags().StringVar(&portableSFTPPrivateKeyPath, "sftp-key-path", "", "SFTP private key path for SFTP provider")
+	portableCmd.Flags().StringSliceVar(&portableSFTPFingerprints, "sftp-fingerprints", []string{}, "SFTP fingerprints to verify "+
+		"remote host key for SFTP provider")
+	portableCmd.Flags().StringVar(&portableSFTPPrefix, "sftp-prefix", "", "SFTP prefix allows restrict all operations to "+
+		"a given path within the remote SFTP server")
+	portableCmd.Flags().StringVar(&portableCryptPassphrase, "crypto-passphrase", "", "Passphrase for client side "+
+		"encryption. The files are encrypted before storing them using the selected provider")
 	rootCmd.AddCommand(portableCmd)
 }
 
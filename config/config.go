@@ -9,11 +9,16 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/drakkan/sftpgo/backup"
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/ftpd"
+	"github.com/drakkan/sftpgo/httpclient"
 	"github.com/drakkan/sftpgo/httpd"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/webdavd"
 	"github.com/spf13/viper"
 )
 
@@ -28,14 +33,21 @@ const (
 )
 
 var (
-	globalConf    globalConfig
-	defaultBanner = fmt.Sprintf("SFTPGo_%v", utils.GetAppVersion().Version)
+	globalConf        globalConfig
+	defaultBanner     = fmt.Sprintf("SFTPGo_%v", utils.GetAppVersion().Version)
+	defaultFTPDBanner = fmt.Sprintf("SFTPGo %v ready", utils.GetAppVersion().Version)
 )
 
 type globalConfig struct {
-	SFTPD        sftpd.Configuration `json:"sftpd" mapstructure:"sftpd"`
-	ProviderConf dataprovider.Config `json:"data_provider" mapstructure:"data_provider"`
-	HTTPDConfig  httpd.Conf          `json:"httpd" mapstructure:"httpd"`
+	SFTPD        sftpd.Configuration   `json:"sftpd" mapstructure:"sftpd"`
+	ProviderConf dataprovider.Config   `json:"data_provider" mapstructure:"data_provider"`
+	HTTPDConfig  httpd.Conf            `json:"httpd" mapstructure:"httpd"`
+	FTPD         ftpd.Configuration    `json:"ftpd" mapstructure:"ftpd"`
+	WebDAVD      webdavd.Configuration `json:"webdavd" mapstructure:"webdavd"`
+	IPLists      utils.IPListsConfig   `json:"ip_lists" mapstructure:"ip_lists"`
+	HTTPConfig   httpclient.Config     `json:"http" mapstructure:"http"`
+	Backups      backup.Config         `json:"backups" mapstructure:"backups"`
+	KMSConfig    kms.Config            `json:"kms" mapstructure:"kms"`
 }
 
 func init() {
@@ -64,6 +76,21 @@ func init() {
 			KeyboardInteractiveProgram: "",
 			ProxyProtocol:              0,
 			ProxyAllowed:               []string{},
+			MaxTotalConnections:        0,
+			MaxPerHostConnections:      0,
+			TrustedUserCAKeys:          []string{},
+			RevokedUserCertsFile:       "",
+			Defender: sftpd.DefenderConfig{
+				Enabled:          false,
+				BanTime:          30,
+				BanTimeIncrement: 50,
+				Threshold:        15,
+				ScoreValid:       1,
+				ScoreInvalid:     2,
+				ScoreNoAuth:      2,
+				ObservationTime:  30,
+				EntriesLimit:     1000,
+			},
 		},
 		ProviderConf: dataprovider.Config{
 			Driver:           "sqlite",
@@ -88,6 +115,25 @@ func init() {
 			ExternalAuthScope:   0,
 			CredentialsPath:     "credentials",
 			PreLoginProgram:     "",
+			LDAP: dataprovider.LDAPConfig{
+				URL:                 "",
+				StartTLS:            false,
+				SkipTLSVerify:       false,
+				CACertificateFile:   "",
+				BindDNTemplate:      "",
+				SearchBindDN:        "",
+				SearchBindPassword:  "",
+				BaseDN:              "",
+				SearchFilter:        "",
+				GroupAttribute:      "memberOf",
+				GroupMappings:       []dataprovider.LDAPGroupMapping{},
+				DefaultTemplateUser: "",
+				Timeout:             10,
+			},
+			UsersCache: dataprovider.UsersCacheConfig{
+				TTL:     0,
+				MaxSize: 0,
+			},
 		},
 		HTTPDConfig: httpd.Conf{
 			BindPort:           8080,
@@ -99,6 +145,71 @@ func init() {
 			CertificateFile:    "",
 			CertificateKeyFile: "",
 		},
+		FTPD: ftpd.Configuration{
+			BindPort:       0,
+			BindAddress:    "",
+			Banner:         defaultFTPDBanner,
+			ForcePassiveIP: "",
+			PassivePortRange: ftpd.PortRange{
+				Start: 50000,
+				End:   50100,
+			},
+			ConnectionTimeout:  20,
+			CertificateFile:    "",
+			CertificateKeyFile: "",
+			TLSMode:            0,
+		},
+		WebDAVD: webdavd.Configuration{
+			BindPort:           0,
+			BindAddress:        "",
+			CertificateFile:    "",
+			CertificateKeyFile: "",
+		},
+		IPLists: utils.IPListsConfig{
+			AllowList:     []string{},
+			AllowListFile: "",
+			DenyList:      []string{},
+			DenyListFile:  "",
+		},
+		HTTPConfig: httpclient.Config{
+			Timeout:        20,
+			RetryMax:       0,
+			RetryWaitMin:   1,
+			RetryWaitMax:   10,
+			CACertificates: []string{},
+			Certificates:   []httpclient.TLSKeyPair{},
+			SkipTLSVerify:  false,
+		},
+		Backups: backup.Config{
+			Schedule: "",
+			Storage:  backup.StorageLocal,
+			S3: backup.S3Config{
+				Bucket:       "",
+				KeyPrefix:    "",
+				Region:       "",
+				AccessKey:    "",
+				AccessSecret: "",
+				Endpoint:     "",
+				StorageClass: "",
+			},
+			GCS: backup.GCSConfig{
+				Bucket:               "",
+				KeyPrefix:            "",
+				CredentialFile:       "",
+				AutomaticCredentials: 0,
+				StorageClass:         "",
+			},
+			Compress:   false,
+			Passphrase: "",
+			MaxBackups: 0,
+			MaxAge:     0,
+		},
+		KMSConfig: kms.Config{
+			Provider:          kms.LocalProviderName,
+			MasterKey:         "",
+			MasterKeyPath:     "master.key",
+			OldMasterKeyPaths: []string{},
+		},
 	}
 
 	viper.SetEnvPrefix(configEnvPrefix)
@@ -129,12 +240,72 @@ func SetHTTPDConfig(config httpd.Conf) {
 	globalConf.HTTPDConfig = config
 }
 
-//GetProviderConf returns the configuration for the data provider
+// GetFTPDConfig returns the configuration for the FTP server
+func GetFTPDConfig() ftpd.Configuration {
+	return globalConf.FTPD
+}
+
+// SetFTPDConfig sets the configuration for the FTP server
+func SetFTPDConfig(config ftpd.Configuration) {
+	globalConf.FTPD = config
+}
+
+// GetWebDAVDConfig returns the configuration for the WebDAV server
+func GetWebDAVDConfig() webdavd.Configuration {
+	return globalConf.WebDAVD
+}
+
+// SetWebDAVDConfig sets the configuration for the WebDAV server
+func SetWebDAVDConfig(config webdavd.Configuration) {
+	globalConf.WebDAVD = config
+}
+
+// GetIPListsConfig returns the configuration for the server wide IP lists
+func GetIPListsConfig() utils.IPListsConfig {
+	return globalConf.IPLists
+}
+
+// SetIPListsConfig sets the configuration for the server wide IP lists
+func SetIPListsConfig(config utils.IPListsConfig) {
+	globalConf.IPLists = config
+}
+
+// GetHTTPConfig returns the configuration for the HTTP client used for the HTTP hooks
+func GetHTTPConfig() httpclient.Config {
+	return globalConf.HTTPConfig
+}
+
+// SetHTTPConfig sets the configuration for the HTTP client used for the HTTP hooks
+func SetHTTPConfig(config httpclient.Config) {
+	globalConf.HTTPConfig = config
+}
+
+// GetBackupsConfig returns the configuration for the scheduled backups
+func GetBackupsConfig() backup.Config {
+	return globalConf.Backups
+}
+
+// SetBackupsConfig sets the configuration for the scheduled backups
+func SetBackupsConfig(config backup.Config) {
+	globalConf.Backups = config
+}
+
+// GetKMSConfig returns the configuration for the secrets encryption
+func GetKMSConfig() kms.Config {
+	return globalConf.KMSConfig
+}
+
+// SetKMSConfig sets the configuration for the secrets encryption
+func SetKMSConfig(config kms.Config) {
+	globalConf.KMSConfig = config
+}
+
+// GetProviderConf returns the configuration for the data provider
 func GetProviderConf() dataprovider.Config {
 	return globalConf.ProviderConf
 }
 
-//SetProviderConf sets the configuration for the data provider
+// SetProviderConf sets the configuration for the data provider
 func SetProviderConf(config dataprovider.Config) {
 	globalConf.ProviderConf = config
 }
@@ -142,6 +313,10 @@ func SetProviderConf(config dataprovider.Config) {
 func getRedactedGlobalConf() globalConfig {
 	conf := globalConf
 	conf.ProviderConf.Password = "[redacted]"
+	conf.ProviderConf.LDAP.SearchBindPassword = "[redacted]"
+	conf.Backups.S3.AccessSecret = "[redacted]"
+	conf.Backups.Passphrase = "[redacted]"
+	conf.KMSConfig.MasterKey = "[redacted]"
 	return conf
 }
 
@@ -172,6 +347,9 @@ func LoadConfig(configDir, configName string) error {
 	if strings.TrimSpace(globalConf.SFTPD.Banner) == "" {
 		globalConf.SFTPD.Banner = defaultBanner
 	}
+	if strings.TrimSpace(globalConf.FTPD.Banner) == "" {
+		globalConf.FTPD.Banner = defaultFTPDBanner
+	}
 	if len(globalConf.ProviderConf.UsersBaseDir) > 0 && !utils.IsFileInputValid(globalConf.ProviderConf.UsersBaseDir) {
 		err = fmt.Errorf("invalid users base dir %#v will be ignored", globalConf.ProviderConf.UsersBaseDir)
 		globalConf.ProviderConf.UsersBaseDir = ""
@@ -192,6 +370,13 @@ func LoadConfig(configDir, configName string) error {
 		logger.Warn(logSender, "", "Configuration error: %v", err)
 		logger.WarnToConsole("Configuration error: %v", err)
 	}
+	if globalConf.FTPD.TLSMode < 0 || globalConf.FTPD.TLSMode > 2 {
+		err = fmt.Errorf("invalid ftpd tls_mode 0, 1 and 2 are supported, configured: %v reset tls_mode to 0",
+			globalConf.FTPD.TLSMode)
+		globalConf.FTPD.TLSMode = 0
+		logger.Warn(logSender, "", "Configuration error: %v", err)
+		logger.WarnToConsole("Configuration error: %v", err)
+	}
 	if globalConf.ProviderConf.ExternalAuthScope < 0 || globalConf.ProviderConf.ExternalAuthScope > 7 {
 		err = fmt.Errorf("invalid external_auth_scope: %v reset to 0", globalConf.ProviderConf.ExternalAuthScope)
 		globalConf.ProviderConf.ExternalAuthScope = 0
@@ -10,6 +10,7 @@ import (
 
 	"github.com/drakkan/sftpgo/config"
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/ftpd"
 	"github.com/drakkan/sftpgo/httpd"
 	"github.com/drakkan/sftpgo/sftpd"
 )
@@ -161,6 +162,30 @@ func TestInvalidProxyProtocol(t *testing.T) {
 	os.Remove(configFilePath)
 }
 
+func TestInvalidFTPDTLSMode(t *testing.T) {
+	configDir := ".."
+	confName := tempConfigName + ".json"
+	configFilePath := filepath.Join(configDir, confName)
+	config.LoadConfig(configDir, "")
+	ftpdConf := config.GetFTPDConfig()
+	ftpdConf.TLSMode = 10
+	c := make(map[string]ftpd.Configuration)
+	c["ftpd"] = ftpdConf
+	jsonConf, _ := json.Marshal(c)
+	err := ioutil.WriteFile(configFilePath, jsonConf, 0666)
+	if err != nil {
+		t.Errorf("error saving temporary configuration")
+	}
+	err = config.LoadConfig(configDir, tempConfigName)
+	if err == nil {
+		t.Errorf("Loading configuration with invalid ftpd tls_mode must fail")
+	}
+	if config.GetFTPDConfig().TLSMode != 0 {
+		t.Errorf("invalid ftpd tls_mode must be reset to 0")
+	}
+	os.Remove(configFilePath)
+}
+
 func TestInvalidUsersBaseDir(t *testing.T) {
 	configDir := ".."
 	confName := tempConfigName + ".json"
@@ -201,4 +226,22 @@ func TestSetGetConfig(t *testing.T) {
 	if config.GetHTTPDConfig().BindAddress != httpdConf.BindAddress {
 		t.Errorf("set httpd conf failed")
 	}
+	ftpdConf := config.GetFTPDConfig()
+	ftpdConf.ForcePassiveIP = "127.0.0.1"
+	config.SetFTPDConfig(ftpdConf)
+	if config.GetFTPDConfig().ForcePassiveIP != ftpdConf.ForcePassiveIP {
+		t.Errorf("set ftpd conf failed")
+	}
+	webDavConf := config.GetWebDAVDConfig()
+	webDavConf.BindPort = 10080
+	config.SetWebDAVDConfig(webDavConf)
+	if config.GetWebDAVDConfig().BindPort != webDavConf.BindPort {
+		t.Errorf("set webdavd conf failed")
+	}
+	kmsConf := config.GetKMSConfig()
+	kmsConf.MasterKeyPath = "test.key"
+	config.SetKMSConfig(kmsConf)
+	if config.GetKMSConfig().MasterKeyPath != kmsConf.MasterKeyPath {
+		t.Errorf("set kms conf failed")
+	}
 }
@@ -0,0 +1,237 @@
+package dataprovider
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/alexedwards/argon2id"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// Available permissions for SFTPGo admins
+const (
+	// grants all the permissions
+	PermAdminAny = "*"
+	// add, update and delete users and their shares
+	PermAdminManageUsers = "manage_users"
+	// add, update and delete admins
+	PermAdminManageAdmins = "manage_admins"
+	// view the active connections
+	PermAdminViewConnections = "view_conns"
+	// close active connections
+	PermAdminCloseConnections = "close_conns"
+	// view and start quota scans
+	PermAdminQuotaScans = "quota_scans"
+	// dump and restore the data provider content
+	PermAdminManageBackups = "manage_backups"
+	// view the prometheus metrics
+	PermAdminViewMetrics = "view_metrics"
+	// view and remove the hosts banned by the defender
+	PermAdminManageDefender = "manage_defender"
+)
+
+var (
+	// ValidAdminPerms list that contains all the valid permissions for an admin
+	ValidAdminPerms = []string{PermAdminAny, PermAdminManageUsers, PermAdminManageAdmins, PermAdminViewConnections,
+		PermAdminCloseConnections, PermAdminQuotaScans, PermAdminManageBackups, PermAdminViewMetrics,
+		PermAdminManageDefender}
+	adminUsernameRegex = regexp.MustCompile("^[a-zA-Z0-9-_.@]+$")
+	// bcrypt hashes generated by htpasswd and other tools can use a different prefix
+	adminBcryptPwdPrefixes = []string{"$2a$", "$2$", "$2x$", "$2y$", "$2b$"}
+)
+
+// Admin defines an SFTPGo admin.
+// Admins can access the REST API and the web admin interface,
+// each admin can only use the features allowed by its permissions
+type Admin struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// 1 enabled, 0 disabled (login is not allowed)
+	Status int `json:"status"`
+	// Username
+	Username string `json:"username"`
+	// Password, it is stored hashed
+	Password string `json:"password,omitempty"`
+	// Optional email address
+	Email string `json:"email,omitempty"`
+	// Granted permissions
+	Permissions []string `json:"permissions"`
+	// Optional description, for example the admin's full name
+	Description string `json:"description,omitempty"`
+}
+
+// HasPermission returns true if the admin has the specified permission
+func (a *Admin) HasPermission(perm string) bool {
+	if utils.IsStringInSlice(PermAdminAny, a.Permissions) {
+		return true
+	}
+	return utils.IsStringInSlice(perm, a.Permissions)
+}
+
+// GetPermissionsAsString returns the admin permissions as comma separated string
+func (a *Admin) GetPermissionsAsString() string {
+	return strings.Join(a.Permissions, ", ")
+}
+
+// CheckPassword returns true if the given password matches the admin password
+func (a *Admin) CheckPassword(password string) (bool, error) {
+	if len(a.Password) == 0 || len(password) == 0 {
+		return false, errors.New("Credentials cannot be null or empty")
+	}
+	if strings.HasPrefix(a.Password, argonPwdPrefix) {
+		return argon2id.ComparePasswordAndHash(password, a.Password)
+	}
+	if utils.IsStringPrefixInSlice(a.Password, adminBcryptPwdPrefixes) {
+		if err := bcrypt.CompareHashAndPassword([]byte(a.Password), []byte(password)); err != nil {
+			return false, errWrongPassword
+		}
+		return true, nil
+	}
+	if utils.IsStringPrefixInSlice(a.Password, pbkdfPwdPrefixes) {
+		return comparePbkdf2PasswordAndHash(password, a.Password)
+	}
+	if utils.IsStringPrefixInSlice(a.Password, unixPwdPrefixes) {
+		return compareUnixPasswordAndHash(User{Password: a.Password}, password)
+	}
+	return false, errors.New("invalid or unsupported password hash")
+}
+
+// HideAdminSensitiveData hides admin sensitive data
+func HideAdminSensitiveData(admin *Admin) Admin {
+	admin.Password = ""
+	return *admin
+}
+
+// validateAdminPermissionsList returns the given permissions without duplicates
+// or an error if they are empty or invalid
+func validateAdminPermissionsList(perms []string) ([]string, error) {
+	if len(perms) == 0 {
+		return nil, &ValidationError{err: "please grant some permissions"}
+	}
+	var permissions []string
+	for _, p := range perms {
+		if !utils.IsStringInSlice(p, ValidAdminPerms) {
+			return nil, &ValidationError{err: fmt.Sprintf("invalid permission: %#v", p)}
+		}
+		if p == PermAdminAny {
+			return []string{PermAdminAny}, nil
+		}
+		if !utils.IsStringInSlice(p, permissions) {
+			permissions = append(permissions, p)
+		}
+	}
+	return permissions, nil
+}
+
+func validateAdminPermissions(admin *Admin) error {
+	permissions, err := validateAdminPermissionsList(admin.Permissions)
+	if err != nil {
+		return err
+	}
+	admin.Permissions = permissions
+	return nil
+}
+
+func validateAdmin(admin *Admin) error {
+	if len(admin.Username) == 0 || len(admin.Password) == 0 {
+		return &ValidationError{err: "mandatory parameters missing"}
+	}
+	if !adminUsernameRegex.MatchString(admin.Username) {
+		return &ValidationError{err: fmt.Sprintf("username %#v is not valid, the following characters are allowed: "+
+			"a-zA-Z0-9-_.@", admin.Username)}
+	}
+	if admin.Status != 0 && admin.Status != 1 {
+		return &ValidationError{err: fmt.Sprintf("invalid status: %v", admin.Status)}
+	}
+	if err := validateAdminPermissions(admin); err != nil {
+		return err
+	}
+	if !utils.IsStringPrefixInSlice(admin.Password, hashPwdPrefixes) &&
+		!utils.IsStringPrefixInSlice(admin.Password, adminBcryptPwdPrefixes) {
+		pwd, err := argon2id.CreateHash(admin.Password, argon2id.DefaultParams)
+		if err != nil {
+			return err
+		}
+		admin.Password = pwd
+	}
+	return nil
+}
+
+// CheckAdminAndPass returns the admin with the given username if the password
+// matches and the admin is enabled
+func CheckAdminAndPass(p Provider, username, password string) (Admin, error) {
+	admin, err := p.adminExists(username)
+	if err != nil {
+		return admin, err
+	}
+	if admin.Status != 1 {
+		return admin, fmt.Errorf("admin %#v is disabled", admin.Username)
+	}
+	match, err := admin.CheckPassword(password)
+	if err != nil {
+		if err != errWrongPassword {
+			providerLog(logger.LevelWarn, "error comparing password for admin %#v: %v", username, err)
+		}
+		return admin, errors.New("Invalid credentials")
+	}
+	if !match {
+		return admin, errors.New("Invalid credentials")
+	}
+	return admin, nil
+}
+
+// HasAdmins returns true if at least an admin is defined
+func HasAdmins(p Provider) (bool, error) {
+	admins, err := p.getAdmins(1, 0, "ASC")
+	if err != nil {
+		return false, err
+	}
+	return len(admins) > 0, nil
+}
+
+// AdminExists returns the admin with the given username if it exists
+func AdminExists(p Provider, username string) (Admin, error) {
+	return p.adminExists(username)
+}
+
+// AddAdmin adds a new SFTPGo admin.
+// ManageUsers configuration must be set to 1 to enable this method
+func AddAdmin(p Provider, admin Admin) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.addAdmin(admin)
+}
+
+// UpdateAdmin updates an existing SFTPGo admin.
+// ManageUsers configuration must be set to 1 to enable this method
+func UpdateAdmin(p Provider, admin Admin) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.updateAdmin(admin)
+}
+
+// DeleteAdmin deletes an existing SFTPGo admin.
+// ManageUsers configuration must be set to 1 to enable this method
+func DeleteAdmin(p Provider, admin Admin) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.deleteAdmin(admin)
+}
+
+// GetAdmins returns an array of admins respecting limit and offset
+func GetAdmins(p Provider, limit, offset int, order string) ([]Admin, error) {
+	return p.getAdmins(limit, offset, order)
+}
+
+// DumpAdmins returns an array with all admins including their hashed password
+func DumpAdmins(p Provider) ([]Admin, error) {
+	return p.dumpAdmins()
+}
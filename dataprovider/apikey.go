@@ -0,0 +1,191 @@
+package dataprovider
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const apiKeySeparator = "."
+
+// APIKey defines a named, long-lived, credential that an admin can use to access the REST API
+// without sending its password. The key is sent as Bearer token and it can be revoked at any time.
+// The permissions granted to an API key are limited by the permissions of the admin that owns it
+type APIKey struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// Random unique identifier, it is the public part of the key
+	KeyID string `json:"key_id"`
+	// Name, it is mandatory and it is useful to remember where the key is used
+	Name string `json:"name"`
+	// Hashed secret part of the key, it is never returned.
+	// The plain key is returned only when the API key is created
+	Key string `json:"key,omitempty"`
+	// The admin that owns the key
+	Admin string `json:"admin"`
+	// Granted permissions, "*" means all the permissions of the owner
+	Permissions []string `json:"permissions"`
+	// Optional description
+	Description string `json:"description,omitempty"`
+	// Expiration date as unix timestamp in milliseconds, 0 means no expiration
+	ExpiresAt int64 `json:"expires_at"`
+	// Creation time as unix timestamp in milliseconds
+	CreatedAt int64 `json:"created_at"`
+	// Last use as unix timestamp in milliseconds
+	LastUseAt int64 `json:"last_use_at"`
+}
+
+// IsExpired returns true if the API key is expired
+func (k *APIKey) IsExpired() bool {
+	return k.ExpiresAt > 0 && k.ExpiresAt < utils.GetTimeAsMsSinceEpoch(time.Now())
+}
+
+// GetPermissionsAsString returns the API key permissions as comma separated string
+func (k *APIKey) GetPermissionsAsString() string {
+	return strings.Join(k.Permissions, ", ")
+}
+
+// restrictAdmin limits the admin permissions to the ones granted to the API key
+func (k *APIKey) restrictAdmin(admin *Admin) {
+	if utils.IsStringInSlice(PermAdminAny, k.Permissions) {
+		return
+	}
+	var permissions []string
+	for _, p := range k.Permissions {
+		if admin.HasPermission(p) {
+			permissions = append(permissions, p)
+		}
+	}
+	admin.Permissions = permissions
+}
+
+// HideAPIKeySensitiveData hides API key sensitive data
+func HideAPIKeySensitiveData(key *APIKey) APIKey {
+	key.Key = ""
+	return *key
+}
+
+// the secret part of the key is random so there is no need to use a slow hash function here
+func hashAPIKeySecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func generateAPIKey() (string, string, error) {
+	b := make([]byte, 48)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(b[:16]), hex.EncodeToString(b[16:]), nil
+}
+
+func validateAPIKey(key *APIKey) error {
+	if len(key.KeyID) == 0 || len(key.Key) == 0 {
+		return &ValidationError{err: "key_id and key are mandatory"}
+	}
+	if len(key.Name) == 0 {
+		return &ValidationError{err: "name is mandatory"}
+	}
+	if len(key.Admin) == 0 {
+		return &ValidationError{err: "admin is mandatory"}
+	}
+	if key.ExpiresAt < 0 {
+		return &ValidationError{err: fmt.Sprintf("invalid expires_at: %v", key.ExpiresAt)}
+	}
+	permissions, err := validateAdminPermissionsList(key.Permissions)
+	if err != nil {
+		return err
+	}
+	key.Permissions = permissions
+	return nil
+}
+
+// AddAPIKey generates a new API key for an existing admin.
+// The key identifier and the hashed secret are set inside the given key,
+// the plain key is returned and it cannot be retrieved later.
+// ManageUsers configuration must be set to 1 to enable this method
+func AddAPIKey(p Provider, key *APIKey) (string, error) {
+	if config.ManageUsers == 0 {
+		return "", &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	if _, err := p.adminExists(key.Admin); err != nil {
+		if _, ok := err.(*RecordNotFoundError); ok {
+			return "", &ValidationError{err: fmt.Sprintf("admin %#v does not exist", key.Admin)}
+		}
+		return "", err
+	}
+	keyID, secret, err := generateAPIKey()
+	if err != nil {
+		return "", err
+	}
+	key.KeyID = keyID
+	key.Key = hashAPIKeySecret(secret)
+	key.CreatedAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+	key.LastUseAt = 0
+	err = p.addAPIKey(*key)
+	if err != nil {
+		return "", err
+	}
+	return keyID + apiKeySeparator + secret, nil
+}
+
+// DeleteAPIKey revokes an existing API key.
+// ManageUsers configuration must be set to 1 to enable this method
+func DeleteAPIKey(p Provider, key APIKey) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.deleteAPIKey(key)
+}
+
+// GetAPIKeyByID returns the API key with the given key identifier if a match is found or an error
+func GetAPIKeyByID(p Provider, keyID string) (APIKey, error) {
+	return p.apiKeyExists(keyID)
+}
+
+// GetAPIKeys returns an array of API keys respecting limit and offset and filtered by admin exact match if not empty
+func GetAPIKeys(p Provider, limit, offset int, order string, admin string) ([]APIKey, error) {
+	return p.getAPIKeys(limit, offset, order, admin)
+}
+
+// CheckAPIKey returns the admin that owns the given plain API key if the key is valid and not expired
+// and the admin is enabled. The admin permissions are restricted to the ones granted to the key
+func CheckAPIKey(p Provider, plainKey string) (Admin, APIKey, error) {
+	var admin Admin
+	parts := strings.SplitN(plainKey, apiKeySeparator, 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return admin, APIKey{}, errors.New("invalid API key")
+	}
+	key, err := p.apiKeyExists(parts[0])
+	if err != nil {
+		return admin, key, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Key), []byte(hashAPIKeySecret(parts[1]))) != 1 {
+		return admin, key, errors.New("Invalid credentials")
+	}
+	if key.IsExpired() {
+		return admin, key, fmt.Errorf("API key %#v is expired", key.KeyID)
+	}
+	admin, err = p.adminExists(key.Admin)
+	if err != nil {
+		return admin, key, err
+	}
+	if admin.Status != 1 {
+		return admin, key, fmt.Errorf("admin %#v is disabled", admin.Username)
+	}
+	key.restrictAdmin(&admin)
+	err = p.updateAPIKeyLastUse(key.KeyID)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to update last use for API key %#v: %v", key.KeyID, err)
+	}
+	return admin, key, nil
+}
@@ -0,0 +1,102 @@
+package dataprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// number of users read from the data provider for each batch while writing a backup
+const backupBatchSize = 100
+
+// WriteBackup writes a backup with the same format as BackupData to w,
+// the users are read from the data provider and written in batches
+func WriteBackup(p Provider, w io.Writer, groups []Group, admins []Admin, indent bool) error {
+	bw := &backupWriter{w: w, indent: indent}
+	bw.write("{")
+	bw.startArray("groups", true)
+	for _, group := range groups {
+		bw.writeItem(group)
+	}
+	bw.endArray()
+	if bw.err != nil {
+		return bw.err
+	}
+	bw.startArray("users", false)
+	err := ForEachUser(p, backupBatchSize, func(user User) error {
+		bw.writeItem(user)
+		return bw.err
+	})
+	if err != nil {
+		return err
+	}
+	bw.endArray()
+	bw.startArray("admins", false)
+	for _, admin := range admins {
+		bw.writeItem(admin)
+	}
+	bw.endArray()
+	if bw.indent {
+		bw.write("\n")
+	}
+	bw.write("}")
+	return bw.err
+}
+
+// backupWriter writes a JSON object containing arrays one item at a time,
+// the first error is saved and the next writes are ignored
+type backupWriter struct {
+	w        io.Writer
+	indent   bool
+	numItems int
+	err      error
+}
+
+func (b *backupWriter) write(s string) {
+	if b.err != nil {
+		return
+	}
+	_, b.err = io.WriteString(b.w, s)
+}
+
+func (b *backupWriter) startArray(name string, isFirst bool) {
+	if !isFirst {
+		b.write(",")
+	}
+	if b.indent {
+		b.write(fmt.Sprintf("\n  %#v: [", name))
+	} else {
+		b.write(fmt.Sprintf("%#v:[", name))
+	}
+	b.numItems = 0
+}
+
+func (b *backupWriter) writeItem(v interface{}) {
+	if b.err != nil {
+		return
+	}
+	var buf []byte
+	if b.indent {
+		buf, b.err = json.MarshalIndent(v, "    ", "  ")
+	} else {
+		buf, b.err = json.Marshal(v)
+	}
+	if b.err != nil {
+		return
+	}
+	if b.numItems > 0 {
+		b.write(",")
+	}
+	if b.indent {
+		b.write("\n    ")
+	}
+	b.write(string(buf))
+	b.numItems++
+}
+
+func (b *backupWriter) endArray() {
+	if b.indent && b.numItems > 0 {
+		b.write("\n  ")
+	}
+	b.write("]")
+}
@@ -0,0 +1,73 @@
+package dataprovider
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// BannedIP defines an IP address banned by the defender.
+// Bans are persisted so they survive restarts and the ban
+// count allows to escalate the ban time for repeat offenders
+type BannedIP struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// Banned IP address
+	IP string `json:"ip"`
+	// Ban expiration as unix timestamp in milliseconds
+	BannedUntil int64 `json:"banned_until"`
+	// Number of times the IP address was banned
+	BanCount int `json:"ban_count"`
+}
+
+// IsActive returns true if the ban is not expired
+func (b *BannedIP) IsActive() bool {
+	return b.BannedUntil > utils.GetTimeAsMsSinceEpoch(time.Now())
+}
+
+func validateBannedIP(ban *BannedIP) error {
+	ip := net.ParseIP(ban.IP)
+	if ip == nil {
+		return &ValidationError{err: fmt.Sprintf("invalid IP address: %#v", ban.IP)}
+	}
+	ban.IP = ip.String()
+	if ban.BannedUntil <= 0 {
+		return &ValidationError{err: fmt.Sprintf("invalid banned_until: %v", ban.BannedUntil)}
+	}
+	if ban.BanCount <= 0 {
+		return &ValidationError{err: fmt.Sprintf("invalid ban_count: %v", ban.BanCount)}
+	}
+	return nil
+}
+
+// BannedIPExists returns the ban for the given IP address if a match is found or an error
+func BannedIPExists(p Provider, ip string) (BannedIP, error) {
+	return p.bannedIPExists(ip)
+}
+
+// AddBannedIP adds a new ban
+func AddBannedIP(p Provider, ban BannedIP) error {
+	return p.addBannedIP(ban)
+}
+
+// UpdateBannedIP updates an existing ban
+func UpdateBannedIP(p Provider, ban BannedIP) error {
+	return p.updateBannedIP(ban)
+}
+
+// DeleteBannedIP deletes an existing ban
+func DeleteBannedIP(p Provider, ban BannedIP) error {
+	return p.deleteBannedIP(ban)
+}
+
+// GetBannedIPs returns an array of bans, both active and expired, respecting limit and offset
+func GetBannedIPs(p Provider, limit, offset int, order string) ([]BannedIP, error) {
+	return p.getBannedIPs(limit, offset, order)
+}
+
+// CleanupBannedIPs deletes the bans expired before the given time, as unix timestamp in milliseconds
+func CleanupBannedIPs(p Provider, before int64) error {
+	return p.cleanupBannedIPs(before)
+}
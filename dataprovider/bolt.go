@@ -20,6 +20,11 @@ const (
 var (
 	usersBucket      = []byte("users")
 	usersIDIdxBucket = []byte("users_id_idx")
+	sharesBucket     = []byte("shares")
+	adminsBucket     = []byte("admins")
+	apiKeysBucket    = []byte("api_keys")
+	groupsBucket     = []byte("groups")
+	bannedIPsBucket  = []byte("banned_ips")
 	dbVersionBucket  = []byte("db_version")
 	dbVersionKey     = []byte("version")
 )
@@ -83,6 +88,46 @@ func initializeBoltProvider(basePath string) error {
 			providerLog(logger.LevelWarn, "error creating username idx bucket: %v", err)
 			return err
 		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(sharesBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating shares bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(adminsBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating admins bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(apiKeysBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating API keys bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(groupsBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating groups bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(bannedIPsBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating banned IPs bucket: %v", err)
+			return err
+		}
 		err = dbHandle.Update(func(tx *bolt.Tx) error {
 			_, e := tx.CreateBucketIfNotExists(dbVersionBucket)
 			return e
@@ -175,6 +220,32 @@ func (p BoltProvider) updateLastLogin(username string) error {
 	})
 }
 
+func (p BoltProvider) useTOTPRecoveryCode(username, hash string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		var u []byte
+		if u = bucket.Get([]byte(username)); u == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist", username)}
+		}
+		var user User
+		err = json.Unmarshal(u, &user)
+		if err != nil {
+			return err
+		}
+		if err = user.TOTPConfig.removeRecoveryCode(hash); err != nil {
+			return err
+		}
+		buf, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(username), buf)
+	})
+}
+
 func (p BoltProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
 	return p.dbHandle.Update(func(tx *bolt.Tx) error {
 		bucket, _, err := getBuckets(tx)
@@ -215,6 +286,40 @@ func (p BoltProvider) getUsedQuota(username string) (int, int64, error) {
 	return user.UsedQuotaFiles, user.UsedQuotaSize, err
 }
 
+func (p BoltProvider) updateFolderQuota(username, virtualPath string, filesAdd int, sizeAdd int64, reset bool) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		var u []byte
+		if u = bucket.Get([]byte(username)); u == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update quota", username)}
+		}
+		var user User
+		err = json.Unmarshal(u, &user)
+		if err != nil {
+			return err
+		}
+		user.updateFolderQuota(virtualPath, filesAdd, sizeAdd, reset)
+		buf, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(username), buf)
+	})
+}
+
+func (p BoltProvider) getUsedFolderQuota(username, virtualPath string) (int, int64, error) {
+	user, err := p.userExists(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get quota for user %v, virtual folder %v error: %v", username, virtualPath, err)
+		return 0, 0, err
+	}
+	files, size := user.getUsedFolderQuota(virtualPath)
+	return files, size, nil
+}
+
 func (p BoltProvider) userExists(username string) (User, error) {
 	var user User
 	err := p.dbHandle.View(func(tx *bolt.Tx) error {
@@ -262,6 +367,40 @@ func (p BoltProvider) addUser(user User) error {
 	})
 }
 
+func (p BoltProvider) restoreUser(user User) error {
+	err := validateUser(&user)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if u := bucket.Get([]byte(user.Username)); u != nil {
+			return fmt.Errorf("username %v already exists", user.Username)
+		}
+		userIDAsBytes := itob(user.ID)
+		if u := idxBucket.Get(userIDAsBytes); u != nil {
+			return fmt.Errorf("user ID %v already exists", user.ID)
+		}
+		if uint64(user.ID) > bucket.Sequence() {
+			if err = bucket.SetSequence(uint64(user.ID)); err != nil {
+				return err
+			}
+		}
+		buf, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(user.Username), buf)
+		if err != nil {
+			return err
+		}
+		return idxBucket.Put(userIDAsBytes, []byte(user.Username))
+	})
+}
+
 func (p BoltProvider) updateUser(user User) error {
 	err := validateUser(&user)
 	if err != nil {
@@ -272,9 +411,16 @@ func (p BoltProvider) updateUser(user User) error {
 		if err != nil {
 			return err
 		}
-		if u := bucket.Get([]byte(user.Username)); u == nil {
+		var u []byte
+		if u = bucket.Get([]byte(user.Username)); u == nil {
 			return &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", user.Username)}
 		}
+		// the used folders quota is updated using the dedicated methods
+		var oldUser User
+		if err = json.Unmarshal(u, &oldUser); err != nil {
+			return err
+		}
+		user.FoldersQuota = oldUser.FoldersQuota
 		buf, err := json.Marshal(user)
 		if err != nil {
 			return err
@@ -298,6 +444,10 @@ func (p BoltProvider) deleteUser(user User) error {
 		if err != nil {
 			return err
 		}
+		err = deleteUserShares(tx, string(userName))
+		if err != nil {
+			return err
+		}
 		return idxBucket.Delete(userIDAsBytes)
 	})
 }
@@ -421,6 +571,807 @@ func (p BoltProvider) migrateDatabase() error {
 	return nil
 }
 
+func (p BoltProvider) addShare(share Share) error {
+	err := validateShare(&share)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		if s := bucket.Get([]byte(share.ShareID)); s != nil {
+			return fmt.Errorf("share %v already exists", share.ShareID)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		share.ID = int64(id)
+		buf, err := json.Marshal(share)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(share.ShareID), buf)
+	})
+}
+
+func (p BoltProvider) updateShare(share Share) error {
+	err := validateShare(&share)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		if s := bucket.Get([]byte(share.ShareID)); s == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist", share.ShareID)}
+		}
+		buf, err := json.Marshal(share)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(share.ShareID), buf)
+	})
+}
+
+func (p BoltProvider) deleteShare(share Share) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		if s := bucket.Get([]byte(share.ShareID)); s == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist", share.ShareID)}
+		}
+		return bucket.Delete([]byte(share.ShareID))
+	})
+}
+
+func (p BoltProvider) getShareByID(shareID string) (Share, error) {
+	var share Share
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		s := bucket.Get([]byte(shareID))
+		if s == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist", shareID)}
+		}
+		return json.Unmarshal(s, &share)
+	})
+	return share, err
+}
+
+func (p BoltProvider) getShares(limit int, offset int, order string, username string) ([]Share, error) {
+	shares := []Share{}
+	var err error
+	if limit <= 0 {
+		return shares, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		next := cursor.Next
+		k, v := cursor.First()
+		if order != "ASC" {
+			next = cursor.Prev
+			k, v = cursor.Last()
+		}
+		for ; k != nil; k, v = next() {
+			var share Share
+			err = json.Unmarshal(v, &share)
+			if err != nil {
+				return err
+			}
+			if len(username) > 0 && share.Username != username {
+				continue
+			}
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			shares = append(shares, HideShareSensitiveData(&share))
+			if len(shares) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return shares, err
+}
+
+func (p BoltProvider) updateShareUsage(shareID string, numTokens int) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		var s []byte
+		if s = bucket.Get([]byte(shareID)); s == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist, unable to update usage", shareID)}
+		}
+		var share Share
+		err = json.Unmarshal(s, &share)
+		if err != nil {
+			return err
+		}
+		if !share.hasTokens(numTokens) {
+			return ErrShareTokensExhausted
+		}
+		share.UsedTokens += numTokens
+		share.LastUseAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+		buf, err := json.Marshal(share)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(shareID), buf)
+	})
+}
+
+// deleteUserShares removes all the shares owned by the given user
+func deleteUserShares(tx *bolt.Tx, username string) error {
+	bucket, err := getSharesBucket(tx)
+	if err != nil {
+		return err
+	}
+	var toDelete [][]byte
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		var share Share
+		if err = json.Unmarshal(v, &share); err != nil {
+			return err
+		}
+		if share.Username == username {
+			toDelete = append(toDelete, append([]byte(nil), k...))
+		}
+	}
+	for _, k := range toDelete {
+		if err = bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p BoltProvider) adminExists(username string) (Admin, error) {
+	var admin Admin
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getAdminsBucket(tx)
+		if err != nil {
+			return err
+		}
+		a := bucket.Get([]byte(username))
+		if a == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("admin %v does not exist", username)}
+		}
+		return json.Unmarshal(a, &admin)
+	})
+	return admin, err
+}
+
+func (p BoltProvider) addAdmin(admin Admin) error {
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getAdminsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if a := bucket.Get([]byte(admin.Username)); a != nil {
+			return fmt.Errorf("admin %v already exists", admin.Username)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		admin.ID = int64(id)
+		buf, err := json.Marshal(admin)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(admin.Username), buf)
+	})
+}
+
+func (p BoltProvider) updateAdmin(admin Admin) error {
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getAdminsBucket(tx)
+		if err != nil {
+			return err
+		}
+		var a []byte
+		if a = bucket.Get([]byte(admin.Username)); a == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("admin %v does not exist", admin.Username)}
+		}
+		var oldAdmin Admin
+		err = json.Unmarshal(a, &oldAdmin)
+		if err != nil {
+			return err
+		}
+		admin.ID = oldAdmin.ID
+		buf, err := json.Marshal(admin)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(admin.Username), buf)
+	})
+}
+
+func (p BoltProvider) deleteAdmin(admin Admin) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getAdminsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if a := bucket.Get([]byte(admin.Username)); a == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("admin %v does not exist", admin.Username)}
+		}
+		err = bucket.Delete([]byte(admin.Username))
+		if err != nil {
+			return err
+		}
+		return deleteAdminAPIKeys(tx, admin.Username)
+	})
+}
+
+func (p BoltProvider) getAdmins(limit int, offset int, order string) ([]Admin, error) {
+	admins := []Admin{}
+	var err error
+	if limit <= 0 {
+		return admins, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getAdminsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		next := cursor.Next
+		k, v := cursor.First()
+		if order != "ASC" {
+			next = cursor.Prev
+			k, v = cursor.Last()
+		}
+		for ; k != nil; k, v = next() {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			var admin Admin
+			err = json.Unmarshal(v, &admin)
+			if err != nil {
+				return err
+			}
+			admins = append(admins, HideAdminSensitiveData(&admin))
+			if len(admins) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return admins, err
+}
+
+func (p BoltProvider) dumpAdmins() ([]Admin, error) {
+	admins := []Admin{}
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getAdminsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var admin Admin
+			err = json.Unmarshal(v, &admin)
+			if err != nil {
+				return err
+			}
+			admins = append(admins, admin)
+		}
+		return nil
+	})
+	return admins, err
+}
+
+func (p BoltProvider) apiKeyExists(keyID string) (APIKey, error) {
+	var key APIKey
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getAPIKeysBucket(tx)
+		if err != nil {
+			return err
+		}
+		k := bucket.Get([]byte(keyID))
+		if k == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist", keyID)}
+		}
+		return json.Unmarshal(k, &key)
+	})
+	return key, err
+}
+
+func (p BoltProvider) addAPIKey(key APIKey) error {
+	err := validateAPIKey(&key)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getAPIKeysBucket(tx)
+		if err != nil {
+			return err
+		}
+		if k := bucket.Get([]byte(key.KeyID)); k != nil {
+			return fmt.Errorf("API key %v already exists", key.KeyID)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key.ID = int64(id)
+		buf, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key.KeyID), buf)
+	})
+}
+
+func (p BoltProvider) deleteAPIKey(key APIKey) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getAPIKeysBucket(tx)
+		if err != nil {
+			return err
+		}
+		if k := bucket.Get([]byte(key.KeyID)); k == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist", key.KeyID)}
+		}
+		return bucket.Delete([]byte(key.KeyID))
+	})
+}
+
+func (p BoltProvider) getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error) {
+	keys := []APIKey{}
+	var err error
+	if limit <= 0 {
+		return keys, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getAPIKeysBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		next := cursor.Next
+		k, v := cursor.First()
+		if order != "ASC" {
+			next = cursor.Prev
+			k, v = cursor.Last()
+		}
+		for ; k != nil; k, v = next() {
+			var key APIKey
+			err = json.Unmarshal(v, &key)
+			if err != nil {
+				return err
+			}
+			if len(admin) > 0 && key.Admin != admin {
+				continue
+			}
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			keys = append(keys, HideAPIKeySensitiveData(&key))
+			if len(keys) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (p BoltProvider) updateAPIKeyLastUse(keyID string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getAPIKeysBucket(tx)
+		if err != nil {
+			return err
+		}
+		var k []byte
+		if k = bucket.Get([]byte(keyID)); k == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist, unable to update last use", keyID)}
+		}
+		var key APIKey
+		err = json.Unmarshal(k, &key)
+		if err != nil {
+			return err
+		}
+		key.LastUseAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+		buf, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(keyID), buf)
+	})
+}
+
+// deleteAdminAPIKeys removes all the API keys owned by the given admin
+func deleteAdminAPIKeys(tx *bolt.Tx, username string) error {
+	bucket, err := getAPIKeysBucket(tx)
+	if err != nil {
+		return err
+	}
+	var toDelete [][]byte
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		var key APIKey
+		if err = json.Unmarshal(v, &key); err != nil {
+			return err
+		}
+		if key.Admin == username {
+			toDelete = append(toDelete, append([]byte(nil), k...))
+		}
+	}
+	for _, k := range toDelete {
+		if err = bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p BoltProvider) groupExists(name string) (Group, error) {
+	var group Group
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		g := bucket.Get([]byte(name))
+		if g == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("group %v does not exist", name)}
+		}
+		return json.Unmarshal(g, &group)
+	})
+	return group, err
+}
+
+func (p BoltProvider) addGroup(group Group) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if g := bucket.Get([]byte(group.Name)); g != nil {
+			return fmt.Errorf("group %v already exists", group.Name)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		group.ID = int64(id)
+		buf, err := json.Marshal(group)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(group.Name), buf)
+	})
+}
+
+func (p BoltProvider) updateGroup(group Group) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		var g []byte
+		if g = bucket.Get([]byte(group.Name)); g == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("group %v does not exist", group.Name)}
+		}
+		var oldGroup Group
+		err = json.Unmarshal(g, &oldGroup)
+		if err != nil {
+			return err
+		}
+		group.ID = oldGroup.ID
+		buf, err := json.Marshal(group)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(group.Name), buf)
+	})
+}
+
+func (p BoltProvider) deleteGroup(group Group) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if g := bucket.Get([]byte(group.Name)); g == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("group %v does not exist", group.Name)}
+		}
+		return bucket.Delete([]byte(group.Name))
+	})
+}
+
+func (p BoltProvider) getGroups(limit int, offset int, order string) ([]Group, error) {
+	groups := []Group{}
+	var err error
+	if limit <= 0 {
+		return groups, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		next := cursor.Next
+		k, v := cursor.First()
+		if order != "ASC" {
+			next = cursor.Prev
+			k, v = cursor.Last()
+		}
+		for ; k != nil; k, v = next() {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			var group Group
+			err = json.Unmarshal(v, &group)
+			if err != nil {
+				return err
+			}
+			groups = append(groups, HideGroupSensitiveData(&group))
+			if len(groups) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return groups, err
+}
+
+func (p BoltProvider) dumpGroups() ([]Group, error) {
+	groups := []Group{}
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var group Group
+			err = json.Unmarshal(v, &group)
+			if err != nil {
+				return err
+			}
+			groups = append(groups, group)
+		}
+		return nil
+	})
+	return groups, err
+}
+
+func (p BoltProvider) bannedIPExists(ip string) (BannedIP, error) {
+	var ban BannedIP
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getBannedIPsBucket(tx)
+		if err != nil {
+			return err
+		}
+		b := bucket.Get([]byte(ip))
+		if b == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("banned IP %v does not exist", ip)}
+		}
+		return json.Unmarshal(b, &ban)
+	})
+	return ban, err
+}
+
+func (p BoltProvider) addBannedIP(ban BannedIP) error {
+	err := validateBannedIP(&ban)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getBannedIPsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if b := bucket.Get([]byte(ban.IP)); b != nil {
+			return fmt.Errorf("banned IP %v already exists", ban.IP)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		ban.ID = int64(id)
+		buf, err := json.Marshal(ban)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(ban.IP), buf)
+	})
+}
+
+func (p BoltProvider) updateBannedIP(ban BannedIP) error {
+	err := validateBannedIP(&ban)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getBannedIPsBucket(tx)
+		if err != nil {
+			return err
+		}
+		var b []byte
+		if b = bucket.Get([]byte(ban.IP)); b == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("banned IP %v does not exist", ban.IP)}
+		}
+		var oldBan BannedIP
+		err = json.Unmarshal(b, &oldBan)
+		if err != nil {
+			return err
+		}
+		ban.ID = oldBan.ID
+		buf, err := json.Marshal(ban)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(ban.IP), buf)
+	})
+}
+
+func (p BoltProvider) deleteBannedIP(ban BannedIP) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getBannedIPsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if b := bucket.Get([]byte(ban.IP)); b == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("banned IP %v does not exist", ban.IP)}
+		}
+		return bucket.Delete([]byte(ban.IP))
+	})
+}
+
+func (p BoltProvider) getBannedIPs(limit int, offset int, order string) ([]BannedIP, error) {
+	bans := []BannedIP{}
+	var err error
+	if limit <= 0 {
+		return bans, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getBannedIPsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		next := cursor.Next
+		k, v := cursor.First()
+		if order != "ASC" {
+			next = cursor.Prev
+			k, v = cursor.Last()
+		}
+		for ; k != nil; k, v = next() {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			var ban BannedIP
+			err = json.Unmarshal(v, &ban)
+			if err != nil {
+				return err
+			}
+			bans = append(bans, ban)
+			if len(bans) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return bans, err
+}
+
+func (p BoltProvider) cleanupBannedIPs(before int64) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getBannedIPsBucket(tx)
+		if err != nil {
+			return err
+		}
+		var expired [][]byte
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var ban BannedIP
+			err = json.Unmarshal(v, &ban)
+			if err != nil {
+				return err
+			}
+			if ban.BannedUntil < before {
+				expired = append(expired, k)
+			}
+		}
+		for _, k := range expired {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func getBannedIPsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(bannedIPsBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find banned IPs bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func getGroupsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(groupsBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find groups bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func getAPIKeysBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(apiKeysBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find API keys bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func getAdminsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(adminsBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find admins bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func getSharesBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(sharesBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find shares bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
 // itob returns an 8-byte big endian representation of v.
 func itob(v int64) []byte {
 	b := make([]byte, 8)
@@ -0,0 +1,247 @@
+package dataprovider
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+// UsersCacheConfig defines the configuration for the in-memory users cache.
+// Cached users are used for password and public key authentication so repeated
+// logins do not query the data provider. Quota is always read from and updated
+// inside the data provider
+type UsersCacheConfig struct {
+	// Time to live, in seconds, for the cached users. 0 disables the cache
+	TTL int `json:"ttl" mapstructure:"ttl"`
+	// Maximum number of cached users. 0 means no limit
+	MaxSize int `json:"max_size" mapstructure:"max_size"`
+}
+
+// IsEnabled returns true if the users cache is enabled
+func (c *UsersCacheConfig) IsEnabled() bool {
+	return c.TTL > 0
+}
+
+func (c *UsersCacheConfig) validate() error {
+	if c.TTL < 0 {
+		return fmt.Errorf("invalid users cache ttl: %v", c.TTL)
+	}
+	if c.MaxSize < 0 {
+		return fmt.Errorf("invalid users cache max size: %v", c.MaxSize)
+	}
+	return nil
+}
+
+// usersCacheNotifier is implemented by the providers able to propagate the user
+// changes to the other SFTPGo instances sharing the same database
+type usersCacheNotifier interface {
+	notifyUserChange(username string) error
+	// listenUserChanges calls onChange for each user changed by another instance.
+	// An empty username means that all the cached users must be invalidated
+	listenUserChanges(onChange func(username string)) (io.Closer, error)
+}
+
+type cachedUser struct {
+	user      User
+	expiresAt time.Time
+}
+
+type usersCache struct {
+	sync.RWMutex
+	ttl     time.Duration
+	maxSize int
+	users   map[string]cachedUser
+	// generation is incremented on each invalidation, a user read from the provider
+	// is not cached if an invalidation happened while it was being read
+	generation uint64
+}
+
+func newUsersCache(conf UsersCacheConfig) *usersCache {
+	return &usersCache{
+		ttl:     time.Duration(conf.TTL) * time.Second,
+		maxSize: conf.MaxSize,
+		users:   make(map[string]cachedUser),
+	}
+}
+
+func (c *usersCache) get(username string) (User, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	cached, ok := c.users[username]
+	if !ok || time.Now().After(cached.expiresAt) {
+		return User{}, false
+	}
+	return cached.user.getACopy(), true
+}
+
+func (c *usersCache) getGeneration() uint64 {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.generation
+}
+
+func (c *usersCache) add(user User, generation uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if c.maxSize > 0 && len(c.users) >= c.maxSize {
+		c.removeExpired()
+		// if the cache is still full remove a random user
+		for username := range c.users {
+			if len(c.users) < c.maxSize {
+				break
+			}
+			delete(c.users, username)
+		}
+	}
+	c.users[user.Username] = cachedUser{
+		user:      user.getACopy(),
+		expiresAt: time.Now().Add(c.ttl),
+	}
+}
+
+func (c *usersCache) removeExpired() {
+	now := time.Now()
+	for username, cached := range c.users {
+		if now.After(cached.expiresAt) {
+			delete(c.users, username)
+		}
+	}
+}
+
+// invalidate removes the given user from the cache, an empty username removes all the users
+func (c *usersCache) invalidate(username string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.generation++
+	if len(username) == 0 {
+		c.users = make(map[string]cachedUser)
+		return
+	}
+	delete(c.users, username)
+}
+
+// cachedProvider wraps the configured provider and caches the users used for
+// password and public key authentication
+type cachedProvider struct {
+	Provider
+	cache    *usersCache
+	listener io.Closer
+}
+
+func newCachedProvider(p Provider, conf UsersCacheConfig) (cachedProvider, error) {
+	cp := cachedProvider{
+		Provider: p,
+		cache:    newUsersCache(conf),
+	}
+	if notifier, ok := p.(usersCacheNotifier); ok {
+		listener, err := notifier.listenUserChanges(cp.cache.invalidate)
+		if err != nil {
+			return cp, err
+		}
+		cp.listener = listener
+	}
+	providerLog(logger.LevelDebug, "users cache enabled, ttl: %v, max size: %v, cluster notifications: %v",
+		cp.cache.ttl, cp.cache.maxSize, cp.listener != nil)
+	return cp, nil
+}
+
+func (p cachedProvider) getUser(username string) (User, error) {
+	if user, ok := p.cache.get(username); ok {
+		return user, nil
+	}
+	generation := p.cache.getGeneration()
+	user, err := p.Provider.userExists(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error authenticating user: %v, error: %v", username, err)
+		return user, err
+	}
+	p.cache.add(user, generation)
+	return user, nil
+}
+
+func (p cachedProvider) invalidateUser(username string) {
+	p.cache.invalidate(username)
+	if notifier, ok := p.Provider.(usersCacheNotifier); ok {
+		if err := notifier.notifyUserChange(username); err != nil {
+			providerLog(logger.LevelWarn, "unable to notify the change for user %#v: %v", username, err)
+		}
+	}
+}
+
+func (p cachedProvider) validateUserAndPass(username string, password string) (User, error) {
+	if len(password) == 0 {
+		return User{}, errors.New("Credentials cannot be null or empty")
+	}
+	user, err := p.getUser(username)
+	if err != nil {
+		return user, err
+	}
+	return checkUserAndPass(user, password)
+}
+
+func (p cachedProvider) validateUserAndPubKey(username string, pubKey string) (User, string, error) {
+	if len(pubKey) == 0 {
+		return User{}, "", errors.New("Credentials cannot be null or empty")
+	}
+	user, err := p.getUser(username)
+	if err != nil {
+		return user, "", err
+	}
+	return checkUserAndPubKey(user, pubKey)
+}
+
+func (p cachedProvider) addUser(user User) error {
+	err := p.Provider.addUser(user)
+	if err == nil {
+		p.invalidateUser(user.Username)
+	}
+	return err
+}
+
+func (p cachedProvider) restoreUser(user User) error {
+	err := p.Provider.restoreUser(user)
+	if err == nil {
+		p.invalidateUser(user.Username)
+	}
+	return err
+}
+
+func (p cachedProvider) updateUser(user User) error {
+	err := p.Provider.updateUser(user)
+	if err == nil {
+		p.invalidateUser(user.Username)
+	}
+	return err
+}
+
+func (p cachedProvider) deleteUser(user User) error {
+	err := p.Provider.deleteUser(user)
+	if err == nil {
+		p.invalidateUser(user.Username)
+	}
+	return err
+}
+
+func (p cachedProvider) reloadConfig() error {
+	err := p.Provider.reloadConfig()
+	p.cache.invalidate("")
+	return err
+}
+
+func (p cachedProvider) close() error {
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	return p.Provider.close()
+}
@@ -36,6 +36,7 @@ import (
 	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/crypto/ssh"
 
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/metrics"
 	"github.com/drakkan/sftpgo/utils"
@@ -54,6 +55,8 @@ const (
 	BoltDataProviderName = "bolt"
 	// MemoryDataProviderName name for memory provider
 	MemoryDataProviderName = "memory"
+	// RedisDataProviderName name for Redis key/value store provider
+	RedisDataProviderName = "redis"
 
 	argonPwdPrefix           = "$argon2id$"
 	bcryptPwdPrefix          = "$2a$"
@@ -73,25 +76,27 @@ const (
 var (
 	// SupportedProviders data provider configured in the sftpgo.conf file must match of these strings
 	SupportedProviders = []string{SQLiteDataProviderName, PGSQLDataProviderName, MySQLDataProviderName,
-		BoltDataProviderName, MemoryDataProviderName}
+		BoltDataProviderName, MemoryDataProviderName, RedisDataProviderName}
 	// ValidPerms list that contains all the valid permissions for an user
 	ValidPerms = []string{PermAny, PermListItems, PermDownload, PermUpload, PermOverwrite, PermRename, PermDelete,
 		PermCreateDirs, PermCreateSymlinks, PermChmod, PermChown, PermChtimes}
 	// ValidSSHLoginMethods list that contains all the valid SSH login methods
-	ValidSSHLoginMethods = []string{SSHLoginMethodPublicKey, SSHLoginMethodPassword, SSHLoginMethodKeyboardInteractive}
-	config               Config
-	provider             Provider
-	sqlPlaceholders      []string
-	hashPwdPrefixes      = []string{argonPwdPrefix, bcryptPwdPrefix, pbkdf2SHA1Prefix, pbkdf2SHA256Prefix,
+	ValidSSHLoginMethods = []string{SSHLoginMethodPublicKey, SSHLoginMethodPassword, SSHLoginMethodKeyboardInteractive,
+		SSHLoginMethodPublicKeyCert, SSHLoginMethodKeyAndPassword, SSHLoginMethodKeyAndKeyboardInt}
+	config          Config
+	provider        Provider
+	sqlPlaceholders []string
+	hashPwdPrefixes = []string{argonPwdPrefix, bcryptPwdPrefix, pbkdf2SHA1Prefix, pbkdf2SHA256Prefix,
 		pbkdf2SHA512Prefix, md5cryptPwdPrefix, md5cryptApr1PwdPrefix, sha512cryptPwdPrefix}
-	pbkdfPwdPrefixes       = []string{pbkdf2SHA1Prefix, pbkdf2SHA256Prefix, pbkdf2SHA512Prefix}
-	unixPwdPrefixes        = []string{md5cryptPwdPrefix, md5cryptApr1PwdPrefix, sha512cryptPwdPrefix}
-	logSender              = "dataProvider"
-	availabilityTicker     *time.Ticker
-	availabilityTickerDone chan bool
-	errWrongPassword       = errors.New("password does not match")
-	errNoInitRequired      = errors.New("initialization is not required for this data provider")
-	credentialsDirPath     string
+	pbkdfPwdPrefixes           = []string{pbkdf2SHA1Prefix, pbkdf2SHA256Prefix, pbkdf2SHA512Prefix}
+	unixPwdPrefixes            = []string{md5cryptPwdPrefix, md5cryptApr1PwdPrefix, sha512cryptPwdPrefix}
+	logSender                  = "dataProvider"
+	availabilityTicker         *time.Ticker
+	availabilityTickerDone     chan bool
+	errWrongPassword           = errors.New("password does not match")
+	errNoInitRequired          = errors.New("initialization is not required for this data provider")
+	errNoMatchingVirtualFolder = errors.New("no matching virtual folder found")
+	credentialsDirPath         string
 )
 
 type schemaVersion struct {
@@ -117,7 +122,7 @@ type Config struct {
 	// Driver name, must be one of the SupportedProviders
 	Driver string `json:"driver" mapstructure:"driver"`
 	// Database name. For driver sqlite this can be the database name relative to the config dir
-	// or the absolute path to the SQLite database.
+	// or the absolute path to the SQLite database. For driver redis this is the database number.
 	Name string `json:"name" mapstructure:"name"`
 	// Database host
 	Host string `json:"host" mapstructure:"host"`
@@ -127,11 +132,12 @@ type Config struct {
 	Username string `json:"username" mapstructure:"username"`
 	// Database password
 	Password string `json:"password" mapstructure:"password"`
-	// Used for drivers mysql and postgresql.
+	// Used for drivers mysql, postgresql and redis.
 	// 0 disable SSL/TLS connections.
 	// 1 require ssl.
 	// 2 set ssl mode to verify-ca for driver postgresql and skip-verify for driver mysql.
 	// 3 set ssl mode to verify-full for driver postgresql and preferred for driver mysql.
+	// For driver redis 1 enables TLS without verifying the server certificate, 2 and 3 verify it.
 	SSLMode int `json:"sslmode" mapstructure:"sslmode"`
 	// Custom database connection string.
 	// If not empty this connection string will be used instead of build one using the previous parameters
@@ -147,7 +153,7 @@ type Config struct {
 	//    With this configuration the "quota scan" REST API can still be used to periodically update space usage
 	//    for users without quota restrictions
 	TrackQuota int `json:"track_quota" mapstructure:"track_quota"`
-	// Sets the maximum number of open connections for mysql and postgresql driver.
+	// Sets the maximum number of open connections for mysql, postgresql and redis driver.
 	// Default 0 (unlimited)
 	PoolSize int `json:"pool_size" mapstructure:"pool_size"`
 	// Users default base directory.
@@ -158,18 +164,23 @@ type Config struct {
 	// Actions to execute on user add, update, delete.
 	// Update action will not be fired for internal updates such as the last login or the user quota fields.
 	Actions Actions `json:"actions" mapstructure:"actions"`
-	// Absolute path to an external program to use for users authentication. Leave empty to use builtin
-	// authentication.
+	// Absolute path to an external program or an HTTP URL to use for users authentication. Leave empty
+	// to use builtin authentication.
 	// The external program can read the following environment variables to get info about the user trying
 	// to authenticate:
 	//
 	// - SFTPGO_AUTHD_USERNAME
 	// - SFTPGO_AUTHD_PASSWORD, not empty for password authentication
 	// - SFTPGO_AUTHD_PUBLIC_KEY, not empty for public key authentication
+	// - SFTPGO_AUTHD_IP
+	// - SFTPGO_AUTHD_PROTOCOL, possible values are "SSH", "FTP", "DAV" and "HTTP"
 	//
 	// The content of these variables is _not_ quoted. They may contain special characters. They are under the
 	// control of a possibly malicious remote user.
 	//
+	// If an HTTP URL is configured, a POST request is sent with the same fields as JSON body, the
+	// response must have 200 as status code.
+	//
 	// The program must respond on the standard output with a valid SFTPGo user serialized as JSON if the
 	// authentication succeed or an user with an empty username if the authentication fails.
 	// If the authentication succeed the user will be automatically added/updated inside the defined data provider.
@@ -194,7 +205,7 @@ type Config struct {
 	// Google Cloud Storage credentials. It can be a path relative to the config dir or an
 	// absolute path
 	CredentialsPath string `json:"credentials_path" mapstructure:"credentials_path"`
-	// Absolute path to an external program to start just before the user login.
+	// Absolute path to an external program or an HTTP URL to execute just before the user login.
 	// This program will be started before an existing user try to login and allows to
 	// modify the user.
 	// It is useful if you have users with dynamic fields that need to the updated just
@@ -203,6 +214,10 @@ type Config struct {
 	//
 	// - SFTPGO_LOGIND_USER, it contains the user trying to login serialized as JSON
 	// - SFTPGO_LOGIND_METHOD, possible values are: "password", "publickey" and "keyboard-interactive"
+	// - SFTPGO_LOGIND_IP
+	// - SFTPGO_LOGIND_PROTOCOL, possible values are "SSH", "FTP", "DAV" and "HTTP"
+	//
+	// If an HTTP URL is configured, a POST request is sent with the same fields as JSON body.
 	//
 	// The program must respond on the standard output with an empty string if no user
 	// update is needed or with a valid SFTPGo user serialized as JSON.
@@ -218,11 +233,22 @@ type Config struct {
 	// PreLoginProgram and ExternalAuthProgram are mutally exclusive.
 	// Leave empty to disable.
 	PreLoginProgram string `json:"pre_login_program" mapstructure:"pre_login_program"`
-}
-
-// BackupData defines the structure for the backup/restore files
+	// LDAP/Active Directory authentication for passwords.
+	// LDAP and ExternalAuthProgram are mutally exclusive.
+	LDAP LDAPConfig `json:"ldap" mapstructure:"ldap"`
+	// In-memory cache for the users used for password and public key authentication.
+	// With PostgreSQL the cached users are invalidated on all the instances sharing the
+	// same database using LISTEN/NOTIFY, for the other providers the changes made by
+	// other instances are visible after the TTL expiration
+	UsersCache UsersCacheConfig `json:"users_cache" mapstructure:"users_cache"`
+}
+
+// BackupData defines the structure for the backup/restore files.
+// Groups come first since the users can reference them
 type BackupData struct {
-	Users []User `json:"users"`
+	Groups []Group `json:"groups"`
+	Users  []User  `json:"users"`
+	Admins []Admin `json:"admins"`
 }
 
 type keyboardAuthProgramResponse struct {
@@ -280,19 +306,53 @@ type Provider interface {
 	validateUserAndPubKey(username string, pubKey string) (User, string, error)
 	updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error
 	getUsedQuota(username string) (int, int64, error)
+	updateFolderQuota(username, virtualPath string, filesAdd int, sizeAdd int64, reset bool) error
+	getUsedFolderQuota(username, virtualPath string) (int, int64, error)
 	userExists(username string) (User, error)
 	addUser(user User) error
+	// restoreUser adds the given user preserving its ID, used quota and last login
+	restoreUser(user User) error
 	updateUser(user User) error
 	deleteUser(user User) error
 	getUsers(limit int, offset int, order string, username string) ([]User, error)
 	dumpUsers() ([]User, error)
 	getUserByID(ID int64) (User, error)
 	updateLastLogin(username string) error
+	useTOTPRecoveryCode(username, hash string) error
 	checkAvailability() error
 	close() error
 	reloadConfig() error
 	initializeDatabase() error
 	migrateDatabase() error
+	addShare(share Share) error
+	updateShare(share Share) error
+	deleteShare(share Share) error
+	getShareByID(shareID string) (Share, error)
+	getShares(limit int, offset int, order string, username string) ([]Share, error)
+	updateShareUsage(shareID string, numTokens int) error
+	adminExists(username string) (Admin, error)
+	addAdmin(admin Admin) error
+	updateAdmin(admin Admin) error
+	deleteAdmin(admin Admin) error
+	getAdmins(limit int, offset int, order string) ([]Admin, error)
+	dumpAdmins() ([]Admin, error)
+	apiKeyExists(keyID string) (APIKey, error)
+	addAPIKey(key APIKey) error
+	deleteAPIKey(key APIKey) error
+	getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error)
+	updateAPIKeyLastUse(keyID string) error
+	groupExists(name string) (Group, error)
+	addGroup(group Group) error
+	updateGroup(group Group) error
+	deleteGroup(group Group) error
+	getGroups(limit int, offset int, order string) ([]Group, error)
+	dumpGroups() ([]Group, error)
+	bannedIPExists(ip string) (BannedIP, error)
+	addBannedIP(ban BannedIP) error
+	updateBannedIP(ban BannedIP) error
+	deleteBannedIP(ban BannedIP) error
+	getBannedIPs(limit int, offset int, order string) ([]BannedIP, error)
+	cleanupBannedIPs(before int64) error
 }
 
 func init() {
@@ -306,7 +366,10 @@ func Initialize(cnf Config, basePath string) error {
 	config = cnf
 	sqlPlaceholders = getSQLPlaceholders()
 
-	if len(config.ExternalAuthProgram) > 0 {
+	if err = validateHooks(); err != nil {
+		return err
+	}
+	if len(config.ExternalAuthProgram) > 0 && !utils.IsHTTPURL(config.ExternalAuthProgram) {
 		if !filepath.IsAbs(config.ExternalAuthProgram) {
 			return fmt.Errorf("invalid external auth program: %#v must be an absolute path", config.ExternalAuthProgram)
 		}
@@ -316,7 +379,18 @@ func Initialize(cnf Config, basePath string) error {
 			return err
 		}
 	}
-	if len(config.PreLoginProgram) > 0 {
+	ldapAuth = nil
+	if config.LDAP.IsEnabled() {
+		if len(config.ExternalAuthProgram) > 0 {
+			return errors.New("LDAP authentication and external auth program are mutually exclusive")
+		}
+		ldapAuth, err = newLDAPAuthenticator(config.LDAP, basePath)
+		if err != nil {
+			providerLog(logger.LevelWarn, "invalid LDAP configuration: %v", err)
+			return err
+		}
+	}
+	if len(config.PreLoginProgram) > 0 && !utils.IsHTTPURL(config.PreLoginProgram) {
 		if !filepath.IsAbs(config.PreLoginProgram) {
 			return fmt.Errorf("invalid pre login program: %#v must be an absolute path", config.PreLoginProgram)
 		}
@@ -326,6 +400,9 @@ func Initialize(cnf Config, basePath string) error {
 			return err
 		}
 	}
+	if err = config.UsersCache.validate(); err != nil {
+		return err
+	}
 	if err = validateCredentialsDir(basePath); err != nil {
 		return err
 	}
@@ -338,16 +415,42 @@ func Initialize(cnf Config, basePath string) error {
 		providerLog(logger.LevelWarn, "database migration error: %v", err)
 		return err
 	}
+	err = reencryptSecrets(provider)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to re-encrypt the stored secrets: %v", err)
+		return err
+	}
+	if config.UsersCache.IsEnabled() {
+		provider, err = newCachedProvider(provider, config.UsersCache)
+		if err != nil {
+			providerLog(logger.LevelWarn, "unable to enable the users cache: %v", err)
+			return err
+		}
+	}
 	startAvailabilityTimer()
 	return nil
 }
 
+// validateHooks checks the external auth and pre-login hooks configured as HTTP URLs
+func validateHooks() error {
+	for _, hook := range []string{config.ExternalAuthProgram, config.PreLoginProgram} {
+		if !utils.IsHTTPURL(hook) {
+			continue
+		}
+		if _, err := url.Parse(hook); err != nil {
+			return fmt.Errorf("invalid hook URL %#v: %v", hook, err)
+		}
+	}
+	return nil
+}
+
 // InitializeDatabase creates the initial database structure
 func InitializeDatabase(cnf Config, basePath string) error {
 	config = cnf
 	sqlPlaceholders = getSQLPlaceholders()
 
-	if config.Driver == BoltDataProviderName || config.Driver == MemoryDataProviderName {
+	if config.Driver == BoltDataProviderName || config.Driver == MemoryDataProviderName ||
+		config.Driver == RedisDataProviderName {
 		return errNoInitRequired
 	}
 	err := createProvider(basePath)
@@ -357,60 +460,121 @@ func InitializeDatabase(cnf Config, basePath string) error {
 	return provider.initializeDatabase()
 }
 
-// CheckUserAndPass retrieves the SFTP user with the given username and password if a match is found or an error
-func CheckUserAndPass(p Provider, username string, password string) (User, error) {
-	if len(config.ExternalAuthProgram) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&1 != 0) {
-		user, err := doExternalAuth(username, password, "", "")
-		if err != nil {
-			return user, err
+// CheckUserAndPass retrieves the SFTP user with the given username and password if a match is found or an error.
+// The returned user includes the settings inherited from its groups.
+// The client IP address and the protocol are passed to the external authentication and pre-login hooks, if any
+func CheckUserAndPass(p Provider, username, password, ip, protocol string) (User, error) {
+	var user User
+	var err error
+	if ldapAuth != nil {
+		user, err = doLDAPAuth(p, username, password)
+		if err == nil {
+			user, err = checkUserAndPass(user, password)
 		}
-		return checkUserAndPass(user, password)
-	}
-	if len(config.PreLoginProgram) > 0 {
-		user, err := executePreLoginProgram(username, SSHLoginMethodPassword)
-		if err != nil {
-			return user, err
+	} else if len(config.ExternalAuthProgram) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&1 != 0) {
+		user, err = doExternalAuth(username, password, "", SSHLoginMethodPassword, ip, protocol)
+		if err == nil {
+			user, err = checkUserAndPass(user, password)
+		}
+	} else if len(config.PreLoginProgram) > 0 {
+		user, err = executePreLoginProgram(username, SSHLoginMethodPassword, ip, protocol)
+		if err == nil {
+			user, err = checkUserAndPass(user, password)
 		}
-		return checkUserAndPass(user, password)
+	} else {
+		user, err = p.validateUserAndPass(username, password)
+	}
+	if err != nil {
+		return user, err
 	}
-	return p.validateUserAndPass(username, password)
+	if user.TOTPConfig.Enabled {
+		return user, errTOTPRequired
+	}
+	err = applyGroupSettings(p, &user)
+	return user, err
 }
 
-// CheckUserAndPubKey retrieves the SFTP user with the given username and public key if a match is found or an error
-func CheckUserAndPubKey(p Provider, username string, pubKey string) (User, string, error) {
+// CheckUserAndPubKey retrieves the SFTP user with the given username and public key if a match is found or an error.
+// The returned user includes the settings inherited from its groups.
+// The client IP address and the protocol are passed to the external authentication and pre-login hooks, if any
+func CheckUserAndPubKey(p Provider, username, pubKey, ip, protocol string) (User, string, error) {
+	var user User
+	var keyID string
+	var err error
 	if len(config.ExternalAuthProgram) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&2 != 0) {
-		user, err := doExternalAuth(username, "", pubKey, "")
-		if err != nil {
-			return user, "", err
+		user, err = doExternalAuth(username, "", pubKey, SSHLoginMethodPublicKey, ip, protocol)
+		if err == nil {
+			user, keyID, err = checkUserAndPubKey(user, pubKey)
+		}
+	} else if len(config.PreLoginProgram) > 0 {
+		user, err = executePreLoginProgram(username, SSHLoginMethodPublicKey, ip, protocol)
+		if err == nil {
+			user, keyID, err = checkUserAndPubKey(user, pubKey)
 		}
-		return checkUserAndPubKey(user, pubKey)
+	} else {
+		user, keyID, err = p.validateUserAndPubKey(username, pubKey)
 	}
+	if err != nil {
+		return user, keyID, err
+	}
+	err = applyGroupSettings(p, &user)
+	return user, keyID, err
+}
+
+// CheckUserForCertificate retrieves the SFTP user with the given username for a login using an SSH
+// user certificate. The certificate must be already validated against the trusted certification
+// authorities, so the user public keys are not checked.
+// The returned user includes the settings inherited from its groups
+func CheckUserForCertificate(p Provider, username, ip, protocol string) (User, error) {
+	var user User
+	var err error
 	if len(config.PreLoginProgram) > 0 {
-		user, err := executePreLoginProgram(username, SSHLoginMethodPublicKey)
-		if err != nil {
-			return user, "", err
-		}
-		return checkUserAndPubKey(user, pubKey)
+		user, err = executePreLoginProgram(username, SSHLoginMethodPublicKeyCert, ip, protocol)
+	} else {
+		user, err = p.userExists(username)
+	}
+	if err != nil {
+		return user, err
+	}
+	if err = checkLoginConditions(user); err != nil {
+		return user, err
 	}
-	return p.validateUserAndPubKey(username, pubKey)
+	err = applyGroupSettings(p, &user)
+	return user, err
 }
 
 // CheckKeyboardInteractiveAuth checks the keyboard interactive authentication and returns
-// the authenticated user or an error
-func CheckKeyboardInteractiveAuth(p Provider, username, authProgram string, client ssh.KeyboardInteractiveChallenge) (User, error) {
+// the authenticated user, including the settings inherited from its groups, or an error.
+// Users with TOTP enabled are asked for their password and a passcode, the other users
+// are authenticated using the given program or HTTP hook, if any
+func CheckKeyboardInteractiveAuth(p Provider, username, authHook string, client ssh.KeyboardInteractiveChallenge,
+	ip, protocol string) (User, error) {
 	var user User
 	var err error
 	if len(config.ExternalAuthProgram) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&4 != 0) {
-		user, err = doExternalAuth(username, "", "", "1")
+		user, err = doExternalAuth(username, "", "", SSHLoginMethodKeyboardInteractive, ip, protocol)
 	} else if len(config.PreLoginProgram) > 0 {
-		user, err = executePreLoginProgram(username, SSHLoginMethodKeyboardInteractive)
+		user, err = executePreLoginProgram(username, SSHLoginMethodKeyboardInteractive, ip, protocol)
 	} else {
 		user, err = p.userExists(username)
 	}
 	if err != nil {
 		return user, err
 	}
-	return doKeyboardInteractiveAuth(user, authProgram, client)
+	if user.TOTPConfig.Enabled {
+		user, err = doTOTPKeyboardInteractiveAuth(p, user, client)
+	} else if utils.IsHTTPURL(authHook) {
+		user, err = doKeyboardInteractiveHookAuth(user, authHook, client, ip)
+	} else if len(authHook) > 0 {
+		user, err = doKeyboardInteractiveAuth(user, authHook, client, ip)
+	} else {
+		err = errors.New("keyboard interactive authentication is not available for this user")
+	}
+	if err != nil {
+		return user, err
+	}
+	err = applyGroupSettings(p, &user)
+	return user, err
 }
 
 // UpdateLastLogin updates the last login fields for the given SFTP user
@@ -444,6 +608,30 @@ func GetUsedQuota(p Provider, username string) (int, int64, error) {
 	return p.getUsedQuota(username)
 }
 
+// UpdateVirtualFolderQuota updates the quota for the given virtual folder of an SFTP user.
+// The folder quota is tracked separately from the user's one.
+// TrackQuota must be >=1 to enable this method
+func UpdateVirtualFolderQuota(p Provider, user User, folder VirtualFolder, filesAdd int, sizeAdd int64, reset bool) error {
+	if config.TrackQuota == 0 {
+		return &MethodDisabledError{err: trackQuotaDisabledError}
+	} else if config.TrackQuota == 2 && !reset && !folder.HasQuotaRestrictions() {
+		return nil
+	}
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.updateFolderQuota(user.Username, folder.VirtualPath, filesAdd, sizeAdd, reset)
+}
+
+// GetUsedVirtualFolderQuota returns the used quota for the virtual folder with the
+// given virtual path. TrackQuota must be >=1 to enable this method
+func GetUsedVirtualFolderQuota(p Provider, username, virtualPath string) (int, int64, error) {
+	if config.TrackQuota == 0 {
+		return 0, 0, &MethodDisabledError{err: trackQuotaDisabledError}
+	}
+	return p.getUsedFolderQuota(username, virtualPath)
+}
+
 // UserExists checks if the given SFTP username exists, returns an error if no match is found
 func UserExists(p Provider, username string) (User, error) {
 	return p.userExists(username)
@@ -455,6 +643,9 @@ func AddUser(p Provider, user User) error {
 	if config.ManageUsers == 0 {
 		return &MethodDisabledError{err: manageUsersDisabledError}
 	}
+	if err := validateUserGroups(p, &user); err != nil {
+		return err
+	}
 	err := p.addUser(user)
 	if err == nil {
 		go executeAction(operationAdd, user)
@@ -468,6 +659,9 @@ func UpdateUser(p Provider, user User) error {
 	if config.ManageUsers == 0 {
 		return &MethodDisabledError{err: manageUsersDisabledError}
 	}
+	if err := validateUserGroups(p, &user); err != nil {
+		return err
+	}
 	err := p.updateUser(user)
 	if err == nil {
 		go executeAction(operationUpdate, user)
@@ -493,6 +687,39 @@ func DumpUsers(p Provider) ([]User, error) {
 	return p.dumpUsers()
 }
 
+// ForEachUser calls fn for each user, including the hashed password and the credentials,
+// the users are read from the data provider in batches so they are not loaded all in memory.
+// The iteration stops on the first error
+func ForEachUser(p Provider, batchSize int, fn func(user User) error) error {
+	return forEachUser(func() Provider { return p }, batchSize, fn)
+}
+
+// forEachUser is like ForEachUser but getProvider is called before each provider
+// operation, so the provider state can be activated
+func forEachUser(getProvider func() Provider, batchSize int, fn func(user User) error) error {
+	for offset := 0; ; offset += batchSize {
+		users, err := getProvider().getUsers(batchSize, offset, "ASC", "")
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			user, err := getProvider().userExists(u.Username)
+			if err != nil {
+				return err
+			}
+			if err = addCredentialsToUser(&user); err != nil {
+				return fmt.Errorf("unable to read the credentials for user %#v: %v", user.Username, err)
+			}
+			if err = fn(user); err != nil {
+				return err
+			}
+		}
+		if len(users) < batchSize {
+			return nil
+		}
+	}
+}
+
 // ReloadConfig reloads provider configuration.
 // Currently only implemented for memory provider, allows to reload the users
 // from the configured file, if defined
@@ -536,6 +763,8 @@ func createProvider(basePath string) error {
 		err = initializeBoltProvider(basePath)
 	} else if config.Driver == MemoryDataProviderName {
 		err = initializeMemoryProvider(basePath)
+	} else if config.Driver == RedisDataProviderName {
+		err = initializeRedisProvider()
 	} else {
 		err = fmt.Errorf("unsupported data provider: %v", config.Driver)
 	}
@@ -585,63 +814,91 @@ func isMappedDirOverlapped(dir1, dir2 string) bool {
 }
 
 func validateVirtualFolders(user *User) error {
-	if len(user.VirtualFolders) == 0 || user.FsConfig.Provider != 0 {
-		user.VirtualFolders = []vfs.VirtualFolder{}
+	if len(user.VirtualFolders) == 0 {
+		user.VirtualFolders = []VirtualFolder{}
 		return nil
 	}
-	var virtualFolders []vfs.VirtualFolder
+	var virtualFolders []VirtualFolder
 	mappedPaths := make(map[string]string)
 	for _, v := range user.VirtualFolders {
 		cleanedVPath := filepath.ToSlash(path.Clean(v.VirtualPath))
 		if !path.IsAbs(cleanedVPath) || cleanedVPath == "/" {
 			return &ValidationError{err: fmt.Sprintf("invalid virtual folder %#v", v.VirtualPath)}
 		}
-		cleanedMPath := filepath.Clean(v.MappedPath)
-		if !filepath.IsAbs(cleanedMPath) {
-			return &ValidationError{err: fmt.Sprintf("invalid mapped folder %#v", v.MappedPath)}
-		}
-		if isMappedDirOverlapped(cleanedMPath, user.GetHomeDir()) {
-			return &ValidationError{err: fmt.Sprintf("invalid mapped folder %#v cannot be inside or contain the user home dir %#v",
-				v.MappedPath, user.GetHomeDir())}
-		}
-		virtualFolders = append(virtualFolders, vfs.VirtualFolder{
-			VirtualPath: cleanedVPath,
-			MappedPath:  cleanedMPath,
-		})
-		for k, virtual := range mappedPaths {
-			if isMappedDirOverlapped(k, cleanedMPath) {
-				return &ValidationError{err: fmt.Sprintf("invalid mapped folder %#v overlaps with mapped folder %#v",
-					v.MappedPath, k)}
-			}
-			if isVirtualDirOverlapped(virtual, cleanedVPath) {
+		if v.QuotaSize < 0 || v.QuotaFiles < 0 {
+			return &ValidationError{err: fmt.Sprintf("invalid quota for virtual folder %#v", v.VirtualPath)}
+		}
+		for _, folder := range virtualFolders {
+			if isVirtualDirOverlapped(folder.VirtualPath, cleanedVPath) {
 				return &ValidationError{err: fmt.Sprintf("invalid virtual folder %#v overlaps with virtual folder %#v",
-					v.VirtualPath, virtual)}
+					v.VirtualPath, folder.VirtualPath)}
 			}
 		}
-		mappedPaths[cleanedMPath] = cleanedVPath
+		folder := v
+		folder.VirtualPath = cleanedVPath
+		if folder.FsConfig.Provider == 2 && folder.FsConfig.GCSConfig.AutomaticCredentials > 0 {
+			folder.FsConfig.GCSConfig.Credentials = kms.Secret{}
+		}
+		if err := validateFsConfig(&folder.FsConfig, user.getFolderGCSCredentialsFilePath(cleanedVPath)); err != nil {
+			return &ValidationError{err: fmt.Sprintf("invalid virtual folder %#v: %v", v.VirtualPath, err)}
+		}
+		if folder.FsConfig.Provider == 0 {
+			cleanedMPath := filepath.Clean(v.MappedPath)
+			if !filepath.IsAbs(cleanedMPath) {
+				return &ValidationError{err: fmt.Sprintf("invalid mapped folder %#v", v.MappedPath)}
+			}
+			if isMappedDirOverlapped(cleanedMPath, user.GetHomeDir()) {
+				return &ValidationError{err: fmt.Sprintf("invalid mapped folder %#v cannot be inside or contain the user home dir %#v",
+					v.MappedPath, user.GetHomeDir())}
+			}
+			for k := range mappedPaths {
+				if isMappedDirOverlapped(k, cleanedMPath) {
+					return &ValidationError{err: fmt.Sprintf("invalid mapped folder %#v overlaps with mapped folder %#v",
+						v.MappedPath, k)}
+				}
+			}
+			mappedPaths[cleanedMPath] = cleanedVPath
+			folder.MappedPath = cleanedMPath
+		} else {
+			// the files are stored using the folder's storage backend
+			folder.MappedPath = ""
+		}
+		virtualFolders = append(virtualFolders, folder)
 	}
 	user.VirtualFolders = virtualFolders
 	return nil
 }
 
+// validatePermissions validates the user permissions. The permissions for the
+// root dir can be omitted only if the user belongs to some groups, they can be
+// inherited from a group
 func validatePermissions(user *User) error {
-	if len(user.Permissions) == 0 {
+	if len(user.Permissions) == 0 && len(user.Groups) == 0 {
 		return &ValidationError{err: "please grant some permissions to this user"}
 	}
-	permissions := make(map[string][]string)
-	if _, ok := user.Permissions["/"]; !ok {
+	if _, ok := user.Permissions["/"]; !ok && len(user.Groups) == 0 {
 		return &ValidationError{err: fmt.Sprintf("permissions for the root dir \"/\" must be set")}
 	}
-	for dir, perms := range user.Permissions {
+	permissions, err := cleanPermissions(user.Permissions)
+	if err != nil {
+		return err
+	}
+	user.Permissions = permissions
+	return nil
+}
+
+func cleanPermissions(userPermissions map[string][]string) (map[string][]string, error) {
+	permissions := make(map[string][]string)
+	for dir, perms := range userPermissions {
 		if len(perms) == 0 && dir == "/" {
-			return &ValidationError{err: fmt.Sprintf("no permissions granted for the directory: %#v", dir)}
+			return nil, &ValidationError{err: fmt.Sprintf("no permissions granted for the directory: %#v", dir)}
 		}
 		if len(perms) > len(ValidPerms) {
-			return &ValidationError{err: "invalid permissions"}
+			return nil, &ValidationError{err: "invalid permissions"}
 		}
 		for _, p := range perms {
 			if !utils.IsStringInSlice(p, ValidPerms) {
-				return &ValidationError{err: fmt.Sprintf("invalid permission: %#v", p)}
+				return nil, &ValidationError{err: fmt.Sprintf("invalid permission: %#v", p)}
 			}
 		}
 		cleanedDir := filepath.ToSlash(path.Clean(dir))
@@ -649,10 +906,10 @@ func validatePermissions(user *User) error {
 			cleanedDir = strings.TrimSuffix(cleanedDir, "/")
 		}
 		if !path.IsAbs(cleanedDir) {
-			return &ValidationError{err: fmt.Sprintf("cannot set permissions for non absolute path: %#v", dir)}
+			return nil, &ValidationError{err: fmt.Sprintf("cannot set permissions for non absolute path: %#v", dir)}
 		}
 		if dir != cleanedDir && cleanedDir == "/" {
-			return &ValidationError{err: fmt.Sprintf("cannot set permissions for invalid subdirectory: %#v is an alias for \"/\"", dir)}
+			return nil, &ValidationError{err: fmt.Sprintf("cannot set permissions for invalid subdirectory: %#v is an alias for \"/\"", dir)}
 		}
 		if utils.IsStringInSlice(PermAny, perms) {
 			permissions[cleanedDir] = []string{PermAny}
@@ -660,8 +917,7 @@ func validatePermissions(user *User) error {
 			permissions[cleanedDir] = perms
 		}
 	}
-	user.Permissions = permissions
-	return nil
+	return permissions, nil
 }
 
 func validatePublicKeys(user *User) error {
@@ -725,66 +981,140 @@ func validateFilters(user *User) error {
 			return &ValidationError{err: fmt.Sprintf("could not parse allowed IP/Mask %#v : %v", IPMask, err)}
 		}
 	}
-	if len(user.Filters.DeniedLoginMethods) >= len(ValidSSHLoginMethods) {
-		return &ValidationError{err: "invalid denied_login_methods"}
-	}
 	for _, loginMethod := range user.Filters.DeniedLoginMethods {
 		if !utils.IsStringInSlice(loginMethod, ValidSSHLoginMethods) {
 			return &ValidationError{err: fmt.Sprintf("invalid login method: %#v", loginMethod)}
 		}
 	}
+	for _, loginMethod := range user.Filters.RequiredLoginMethods {
+		if !utils.IsStringInSlice(loginMethod, SSHMultiStepsLoginMethods) {
+			return &ValidationError{err: fmt.Sprintf("invalid required login method: %#v", loginMethod)}
+		}
+		if utils.IsStringInSlice(loginMethod, user.Filters.DeniedLoginMethods) {
+			return &ValidationError{err: fmt.Sprintf("the required login method %#v is denied", loginMethod)}
+		}
+	}
+	if !user.hasAllowedLoginMethods() {
+		return &ValidationError{err: "invalid denied_login_methods"}
+	}
 	if err := validateFiltersFileExtensions(user); err != nil {
 		return err
 	}
 	return nil
 }
 
+// saveGCSCredentials saves the GCS credentials for the user and for the virtual folders
+// stored on GCS encrypted inside the credentials dir, each virtual folder has its own file
 func saveGCSCredentials(user *User) error {
-	if user.FsConfig.Provider != 2 {
+	if err := saveGCSCredentialsFile(&user.FsConfig, user.getGCSCredentialsFilePath()); err != nil {
+		return &ValidationError{err: err.Error()}
+	}
+	for idx := range user.VirtualFolders {
+		folder := &user.VirtualFolders[idx]
+		err := saveGCSCredentialsFile(&folder.FsConfig, user.getFolderGCSCredentialsFilePath(folder.VirtualPath))
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("invalid virtual folder %#v: %v", folder.VirtualPath, err)}
+		}
+	}
+	return nil
+}
+
+// saveGCSCredentialsFile saves the GCS credentials for the given filesystem to the given path.
+// The credentials can be plain and base64 encoded, as sent using the REST API, or already
+// encrypted, as included in the dumps. The file contains the encrypted secret as JSON
+func saveGCSCredentialsFile(fsConfig *Filesystem, filePath string) error {
+	if fsConfig.Provider != 2 {
 		return nil
 	}
-	if len(user.FsConfig.GCSConfig.Credentials) == 0 {
+	if fsConfig.GCSConfig.Credentials.IsEmpty() {
 		return nil
 	}
-	decoded, err := base64.StdEncoding.DecodeString(user.FsConfig.GCSConfig.Credentials)
+	credentials := fsConfig.GCSConfig.Credentials
+	if credentials.IsPlain() {
+		if _, err := base64.StdEncoding.DecodeString(credentials.Payload); err != nil {
+			return fmt.Errorf("could not validate GCS credentials: %v", err)
+		}
+	}
+	if err := encryptSecret(&credentials); err != nil {
+		return fmt.Errorf("could not encrypt GCS credentials: %v", err)
+	}
+	data, err := json.Marshal(credentials)
 	if err != nil {
-		return &ValidationError{err: fmt.Sprintf("could not validate GCS credentials: %v", err)}
+		return fmt.Errorf("could not marshal GCS credentials: %v", err)
 	}
-	err = ioutil.WriteFile(user.getGCSCredentialsFilePath(), decoded, 0600)
+	err = ioutil.WriteFile(filePath, data, 0600)
 	if err != nil {
-		return &ValidationError{err: fmt.Sprintf("could not save GCS credentials: %v", err)}
+		return fmt.Errorf("could not save GCS credentials: %v", err)
 	}
-	user.FsConfig.GCSConfig.Credentials = ""
+	fsConfig.GCSConfig.Credentials = kms.Secret{}
 	return nil
 }
 
 func validateFilesystemConfig(user *User) error {
-	if user.FsConfig.Provider == 1 {
-		err := vfs.ValidateS3FsConfig(&user.FsConfig.S3Config)
+	return validateFsConfig(&user.FsConfig, user.getGCSCredentialsFilePath())
+}
+
+// validateFsConfig validates the given filesystem configuration, the GCS credentials
+// file is used if the credentials are not included and not automatic
+func validateFsConfig(fsConfig *Filesystem, gcsCredentialsFile string) error {
+	if err := validateStorageConfig(fsConfig, gcsCredentialsFile); err != nil {
+		return err
+	}
+	return validateCryptConfig(fsConfig)
+}
+
+// validateCryptConfig encrypts the passphrase, if any, before saving it.
+// The client side encryption is supported for all the storage providers
+func validateCryptConfig(fsConfig *Filesystem) error {
+	if err := encryptSecret(&fsConfig.CryptConfig.Passphrase); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not encrypt the passphrase: %v", err)}
+	}
+	return nil
+}
+
+func validateStorageConfig(fsConfig *Filesystem, gcsCredentialsFile string) error {
+	if fsConfig.Provider == 1 {
+		err := vfs.ValidateS3FsConfig(&fsConfig.S3Config)
 		if err != nil {
 			return &ValidationError{err: fmt.Sprintf("could not validate s3config: %v", err)}
 		}
-		if len(user.FsConfig.S3Config.AccessSecret) > 0 {
-			vals := strings.Split(user.FsConfig.S3Config.AccessSecret, "$")
-			if !strings.HasPrefix(user.FsConfig.S3Config.AccessSecret, "$aes$") || len(vals) != 4 {
-				accessSecret, err := utils.EncryptData(user.FsConfig.S3Config.AccessSecret)
-				if err != nil {
-					return &ValidationError{err: fmt.Sprintf("could not encrypt s3 access secret: %v", err)}
-				}
-				user.FsConfig.S3Config.AccessSecret = accessSecret
-			}
+		if err := encryptSecret(&fsConfig.S3Config.AccessSecret); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt s3 access secret: %v", err)}
 		}
 		return nil
-	} else if user.FsConfig.Provider == 2 {
-		err := vfs.ValidateGCSFsConfig(&user.FsConfig.GCSConfig, user.getGCSCredentialsFilePath())
+	} else if fsConfig.Provider == 2 {
+		err := vfs.ValidateGCSFsConfig(&fsConfig.GCSConfig, gcsCredentialsFile)
 		if err != nil {
 			return &ValidationError{err: fmt.Sprintf("could not validate GCS config: %v", err)}
 		}
 		return nil
+	} else if fsConfig.Provider == 3 {
+		err := vfs.ValidateAzBlobFsConfig(&fsConfig.AzBlobConfig)
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not validate Azure Blob config: %v", err)}
+		}
+		if err := encryptSecret(&fsConfig.AzBlobConfig.AccountKey); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt Azure blob account key: %v", err)}
+		}
+		return nil
+	} else if fsConfig.Provider == 4 {
+		err := vfs.ValidateSFTPFsConfig(&fsConfig.SFTPConfig)
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not validate SFTP config: %v", err)}
+		}
+		if err := encryptSecret(&fsConfig.SFTPConfig.Password); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt SFTP password: %v", err)}
+		}
+		if err := encryptSecret(&fsConfig.SFTPConfig.PrivateKey); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt SFTP private key: %v", err)}
+		}
+		return nil
 	}
-	user.FsConfig.Provider = 0
-	user.FsConfig.S3Config = vfs.S3FsConfig{}
-	user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
+	fsConfig.Provider = 0
+	fsConfig.S3Config = vfs.S3FsConfig{}
+	fsConfig.GCSConfig = vfs.GCSFsConfig{}
+	fsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+	fsConfig.SFTPConfig = vfs.SFTPFsConfig{}
 	return nil
 }
 
@@ -815,6 +1145,9 @@ func validateUser(user *User) error {
 	if err := validateVirtualFolders(user); err != nil {
 		return err
 	}
+	if err := validateTOTPConfig(user); err != nil {
+		return err
+	}
 	if user.Status < 0 || user.Status > 1 {
 		return &ValidationError{err: fmt.Sprintf("invalid user status: %v", user.Status)}
 	}
@@ -973,26 +1306,42 @@ func comparePbkdf2PasswordAndHash(password, hashedPassword string) (bool, error)
 // HideUserSensitiveData hides user sensitive data
 func HideUserSensitiveData(user *User) User {
 	user.Password = ""
-	if user.FsConfig.Provider == 1 {
-		user.FsConfig.S3Config.AccessSecret = utils.RemoveDecryptionKey(user.FsConfig.S3Config.AccessSecret)
-	} else if user.FsConfig.Provider == 2 {
-		user.FsConfig.GCSConfig.Credentials = ""
+	user.TOTPConfig.Secret = kms.Secret{}
+	user.TOTPConfig.RecoveryCodes = nil
+	user.FsConfig.hideSensitiveData()
+	for idx := range user.VirtualFolders {
+		user.VirtualFolders[idx].FsConfig.hideSensitiveData()
 	}
 	return *user
 }
 
+// addCredentialsToUser reads the GCS credentials for the user and for the virtual folders
+// stored on GCS from the credentials dir
 func addCredentialsToUser(user *User) error {
-	if user.FsConfig.Provider != 2 {
+	if err := addGCSCredentials(&user.FsConfig, user.getGCSCredentialsFilePath()); err != nil {
+		return err
+	}
+	for idx := range user.VirtualFolders {
+		folder := &user.VirtualFolders[idx]
+		if err := addGCSCredentials(&folder.FsConfig, user.getFolderGCSCredentialsFilePath(folder.VirtualPath)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addGCSCredentials(fsConfig *Filesystem, filePath string) error {
+	if fsConfig.Provider != 2 {
 		return nil
 	}
-	if user.FsConfig.GCSConfig.AutomaticCredentials > 0 {
+	if fsConfig.GCSConfig.AutomaticCredentials > 0 {
 		return nil
 	}
-	cred, err := ioutil.ReadFile(user.getGCSCredentialsFilePath())
+	credentials, err := readGCSCredentials(filePath)
 	if err != nil {
 		return err
 	}
-	user.FsConfig.GCSConfig.Credentials = base64.StdEncoding.EncodeToString(cred)
+	fsConfig.GCSConfig.Credentials = credentials
 	return nil
 }
 
@@ -1071,28 +1420,39 @@ func terminateInteractiveAuthProgram(cmd *exec.Cmd, isFinished bool) {
 	cmd.Process.Kill()
 }
 
-func handleInteractiveQuestions(client ssh.KeyboardInteractiveChallenge, response keyboardAuthProgramResponse,
-	user User, stdin io.WriteCloser) error {
+// getInteractiveAnswers asks the given questions to the client and returns its answers.
+// If the password check is requested, the answer is replaced with "OK" after a successful check
+func getInteractiveAnswers(client ssh.KeyboardInteractiveChallenge, response keyboardAuthProgramResponse,
+	user User) ([]string, error) {
 	questions := response.Questions
 	answers, err := client(user.Username, response.Instruction, questions, response.Echos)
 	if err != nil {
 		providerLog(logger.LevelInfo, "error getting interactive auth client response: %v", err)
-		return err
+		return answers, err
 	}
 	if len(answers) != len(questions) {
 		err = fmt.Errorf("client answers does not match questions, expected: %v actual: %v", questions, answers)
 		providerLog(logger.LevelInfo, "keyboard interactive auth error: %v", err)
-		return err
+		return answers, err
 	}
 	if len(answers) == 1 && response.CheckPwd > 0 {
 		_, err = checkUserAndPass(user, answers[0])
 		providerLog(logger.LevelInfo, "interactive auth program requested password validation for user %#v, validation error: %v",
 			user.Username, err)
 		if err != nil {
-			return err
+			return answers, err
 		}
 		answers[0] = "OK"
 	}
+	return answers, nil
+}
+
+func handleInteractiveQuestions(client ssh.KeyboardInteractiveChallenge, response keyboardAuthProgramResponse,
+	user User, stdin io.WriteCloser) error {
+	answers, err := getInteractiveAnswers(client, response, user)
+	if err != nil {
+		return err
+	}
 	for _, answer := range answers {
 		if runtime.GOOS == "windows" {
 			answer += "\r"
@@ -1107,12 +1467,46 @@ func handleInteractiveQuestions(client ssh.KeyboardInteractiveChallenge, respons
 	return nil
 }
 
-func doKeyboardInteractiveAuth(user User, authProgram string, client ssh.KeyboardInteractiveChallenge) (User, error) {
+// doTOTPKeyboardInteractiveAuth is the built-in keyboard interactive authentication for users
+// with TOTP enabled, it asks for the password and then for the passcode
+func doTOTPKeyboardInteractiveAuth(p Provider, user User, client ssh.KeyboardInteractiveChallenge) (User, error) {
+	answers, err := client(user.Username, "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		return user, err
+	}
+	if len(answers) != 1 {
+		return user, errors.New("unexpected number of answers to the password question")
+	}
+	if ldapAuth != nil {
+		// the stored password could be outdated, the LDAP server must be checked
+		user, err = doLDAPAuth(p, user.Username, answers[0])
+		if err != nil {
+			return user, err
+		}
+	}
+	user, err = checkUserAndPass(user, answers[0])
+	if err != nil {
+		return user, err
+	}
+	answers, err = client(user.Username, "", []string{"Passcode: "}, []bool{false})
+	if err != nil {
+		return user, err
+	}
+	if len(answers) != 1 {
+		return user, errors.New("unexpected number of answers to the passcode question")
+	}
+	err = checkTOTPPasscode(p, user, answers[0])
+	return user, err
+}
+
+func doKeyboardInteractiveAuth(user User, authProgram string, client ssh.KeyboardInteractiveChallenge,
+	ip string) (User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 	cmd := exec.CommandContext(ctx, authProgram)
 	cmd.Env = append(os.Environ(),
 		fmt.Sprintf("SFTPGO_AUTHD_USERNAME=%v", user.Username),
+		fmt.Sprintf("SFTPGO_AUTHD_IP=%v", ip),
 		fmt.Sprintf("SFTPGO_AUTHD_PASSWORD=%v", user.Password))
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -1172,25 +1566,39 @@ func doKeyboardInteractiveAuth(user User, authProgram string, client ssh.Keyboar
 	return user, nil
 }
 
-func executePreLoginProgram(username, loginMethod string) (User, error) {
-	u, err := provider.userExists(username)
-	if err != nil {
-		return u, err
-	}
+func getPreLoginProgramResponse(u User, loginMethod, ip, protocol string) ([]byte, error) {
 	userAsJSON, err := json.Marshal(u)
 	if err != nil {
-		return u, err
+		return nil, err
 	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 	cmd := exec.CommandContext(ctx, config.PreLoginProgram)
 	cmd.Env = append(os.Environ(),
 		fmt.Sprintf("SFTPGO_LOGIND_USER=%v", string(userAsJSON)),
-		fmt.Sprintf("SFTPGO_LOGIND_METHOD=%v", loginMethod))
+		fmt.Sprintf("SFTPGO_LOGIND_METHOD=%v", loginMethod),
+		fmt.Sprintf("SFTPGO_LOGIND_IP=%v", ip),
+		fmt.Sprintf("SFTPGO_LOGIND_PROTOCOL=%v", protocol))
 	out, err := cmd.Output()
 	if err != nil {
-		return u, fmt.Errorf("Before login program error: %v", err)
+		return nil, fmt.Errorf("Before login program error: %v", err)
+	}
+	return out, nil
+}
+
+func executePreLoginProgram(username, loginMethod, ip, protocol string) (User, error) {
+	u, err := provider.userExists(username)
+	if err != nil {
+		return u, err
+	}
+	var out []byte
+	if utils.IsHTTPURL(config.PreLoginProgram) {
+		out, err = executePreLoginHook(u, loginMethod, ip, protocol)
+	} else {
+		out, err = getPreLoginProgramResponse(u, loginMethod, ip, protocol)
+	}
+	if err != nil {
+		return u, err
 	}
 	if len(strings.TrimSpace(string(out))) == 0 {
 		providerLog(logger.LevelDebug, "empty response from before login program, no modification needed for user %#v", username)
@@ -1219,10 +1627,32 @@ func executePreLoginProgram(username, loginMethod string) (User, error) {
 	return provider.userExists(username)
 }
 
-func doExternalAuth(username, password, pubKey, keyboardInteractive string) (User, error) {
-	var user User
+func getExternalAuthProgramResponse(username, password, pkey, method, ip, protocol string) ([]byte, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
+	keyboardInteractive := ""
+	if method == SSHLoginMethodKeyboardInteractive {
+		keyboardInteractive = "1"
+	}
+	cmd := exec.CommandContext(ctx, config.ExternalAuthProgram)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("SFTPGO_AUTHD_USERNAME=%v", username),
+		fmt.Sprintf("SFTPGO_AUTHD_PASSWORD=%v", password),
+		fmt.Sprintf("SFTPGO_AUTHD_PUBLIC_KEY=%v", pkey),
+		fmt.Sprintf("SFTPGO_AUTHD_KEYBOARD_INTERACTIVE=%v", keyboardInteractive),
+		fmt.Sprintf("SFTPGO_AUTHD_IP=%v", ip),
+		fmt.Sprintf("SFTPGO_AUTHD_PROTOCOL=%v", protocol))
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("External auth error: %v", err)
+	}
+	return out, nil
+}
+
+func doExternalAuth(username, password, pubKey, method, ip, protocol string) (User, error) {
+	var user User
+	var out []byte
+	var err error
 	pkey := ""
 	if len(pubKey) > 0 {
 		k, err := ssh.ParsePublicKey([]byte(pubKey))
@@ -1231,15 +1661,13 @@ func doExternalAuth(username, password, pubKey, keyboardInteractive string) (Use
 		}
 		pkey = string(ssh.MarshalAuthorizedKey(k))
 	}
-	cmd := exec.CommandContext(ctx, config.ExternalAuthProgram)
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("SFTPGO_AUTHD_USERNAME=%v", username),
-		fmt.Sprintf("SFTPGO_AUTHD_PASSWORD=%v", password),
-		fmt.Sprintf("SFTPGO_AUTHD_PUBLIC_KEY=%v", pkey),
-		fmt.Sprintf("SFTPGO_AUTHD_KEYBOARD_INTERACTIVE=%v", keyboardInteractive))
-	out, err := cmd.Output()
+	if utils.IsHTTPURL(config.ExternalAuthProgram) {
+		out, err = executeExternalAuthHook(username, password, pkey, method, ip, protocol)
+	} else {
+		out, err = getExternalAuthProgramResponse(username, password, pkey, method, ip, protocol)
+	}
 	if err != nil {
-		return user, fmt.Errorf("External auth error: %v", err)
+		return user, err
 	}
 	err = json.Unmarshal(out, &user)
 	if err != nil {
@@ -0,0 +1,446 @@
+package dataprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// Supported group membership types
+const (
+	// the primary group can also set the filesystem, the quota, the max sessions
+	// and the bandwidth limits. A user can have at most one primary group
+	GroupTypePrimary = 1
+	// a secondary group can only add permissions, filters and virtual folders
+	GroupTypeSecondary = 2
+)
+
+// placeholder replaced with the username when the group settings are applied to a user
+const usernamePlaceholder = "%username%"
+
+var (
+	groupNameRegex = regexp.MustCompile("^[a-zA-Z0-9-_.@]+$")
+)
+
+// UserGroup defines a group membership for a user
+type UserGroup struct {
+	// Group name
+	Name string `json:"name"`
+	// 1 primary group, 2 secondary group
+	Type int `json:"type"`
+}
+
+// GroupUserSettings defines the settings that the group members inherit.
+// The %username% placeholder is replaced with the member username
+// in permissions and filters paths, virtual folders and key prefixes
+type GroupUserSettings struct {
+	// Maximum concurrent sessions. 0 means unlimited
+	MaxSessions int `json:"max_sessions"`
+	// Maximum size allowed as bytes. 0 means unlimited
+	QuotaSize int64 `json:"quota_size"`
+	// Maximum number of files allowed. 0 means unlimited
+	QuotaFiles int `json:"quota_files"`
+	// List of the granted permissions
+	Permissions map[string][]string `json:"permissions,omitempty"`
+	// Maximum upload bandwidth as KB/s, 0 means unlimited
+	UploadBandwidth int64 `json:"upload_bandwidth"`
+	// Maximum download bandwidth as KB/s, 0 means unlimited
+	DownloadBandwidth int64 `json:"download_bandwidth"`
+	// Additional restrictions
+	Filters UserFilters `json:"filters"`
+	// Filesystem configuration details
+	FsConfig Filesystem `json:"filesystem"`
+	// Virtual folders, mapped to filesystem paths outside the home directory or
+	// stored using a different storage backend
+	VirtualFolders []VirtualFolder `json:"virtual_folders,omitempty"`
+}
+
+// Group defines a set of settings shared between users.
+// The settings are applied to the group members when they login,
+// the settings defined for the user have the precedence
+type Group struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// Unique name
+	Name string `json:"name"`
+	// Optional description
+	Description string `json:"description,omitempty"`
+	// Settings inherited by the group members
+	UserSettings GroupUserSettings `json:"user_settings"`
+}
+
+// GetUserSettingsAsJSON returns the settings inherited by the group members as json byte array
+func (g *Group) GetUserSettingsAsJSON() ([]byte, error) {
+	return json.Marshal(g.UserSettings)
+}
+
+// getUserSettingsFor returns a copy of the group settings with the
+// placeholders replaced for the given username
+func (g *Group) getUserSettingsFor(username string) GroupUserSettings {
+	replacer := strings.NewReplacer(usernamePlaceholder, username)
+	settings := g.UserSettings
+	settings.Permissions = make(map[string][]string)
+	for dir, perms := range g.UserSettings.Permissions {
+		p := make([]string, len(perms))
+		copy(p, perms)
+		settings.Permissions[replacer.Replace(dir)] = p
+	}
+	settings.Filters.FileExtensions = nil
+	for _, f := range g.UserSettings.Filters.FileExtensions {
+		f.Path = replacer.Replace(f.Path)
+		settings.Filters.FileExtensions = append(settings.Filters.FileExtensions, f)
+	}
+	settings.VirtualFolders = nil
+	for _, v := range g.UserSettings.VirtualFolders {
+		folder := v
+		folder.VirtualPath = replacer.Replace(v.VirtualPath)
+		folder.MappedPath = replacer.Replace(v.MappedPath)
+		folder.FsConfig = v.FsConfig.getACopy()
+		replaceFsPlaceholders(&folder.FsConfig, replacer)
+		settings.VirtualFolders = append(settings.VirtualFolders, folder)
+	}
+	replaceFsPlaceholders(&settings.FsConfig, replacer)
+	return settings
+}
+
+func replaceFsPlaceholders(fsConfig *Filesystem, replacer *strings.Replacer) {
+	fsConfig.S3Config.KeyPrefix = replacer.Replace(fsConfig.S3Config.KeyPrefix)
+	fsConfig.GCSConfig.KeyPrefix = replacer.Replace(fsConfig.GCSConfig.KeyPrefix)
+	fsConfig.AzBlobConfig.KeyPrefix = replacer.Replace(fsConfig.AzBlobConfig.KeyPrefix)
+	fsConfig.SFTPConfig.Prefix = replacer.Replace(fsConfig.SFTPConfig.Prefix)
+}
+
+func (g *Group) getACopy() Group {
+	settings := g.UserSettings
+	settings.Permissions = make(map[string][]string)
+	for dir, perms := range g.UserSettings.Permissions {
+		p := make([]string, len(perms))
+		copy(p, perms)
+		settings.Permissions[dir] = p
+	}
+	settings.Filters.AllowedIP = make([]string, len(g.UserSettings.Filters.AllowedIP))
+	copy(settings.Filters.AllowedIP, g.UserSettings.Filters.AllowedIP)
+	settings.Filters.DeniedIP = make([]string, len(g.UserSettings.Filters.DeniedIP))
+	copy(settings.Filters.DeniedIP, g.UserSettings.Filters.DeniedIP)
+	settings.Filters.DeniedLoginMethods = make([]string, len(g.UserSettings.Filters.DeniedLoginMethods))
+	copy(settings.Filters.DeniedLoginMethods, g.UserSettings.Filters.DeniedLoginMethods)
+	settings.Filters.RequiredLoginMethods = make([]string, len(g.UserSettings.Filters.RequiredLoginMethods))
+	copy(settings.Filters.RequiredLoginMethods, g.UserSettings.Filters.RequiredLoginMethods)
+	settings.Filters.FileExtensions = make([]ExtensionsFilter, len(g.UserSettings.Filters.FileExtensions))
+	copy(settings.Filters.FileExtensions, g.UserSettings.Filters.FileExtensions)
+	settings.VirtualFolders = make([]VirtualFolder, 0, len(g.UserSettings.VirtualFolders))
+	for _, v := range g.UserSettings.VirtualFolders {
+		folder := v
+		folder.FsConfig = v.FsConfig.getACopy()
+		settings.VirtualFolders = append(settings.VirtualFolders, folder)
+	}
+	settings.FsConfig = g.UserSettings.FsConfig.getACopy()
+
+	return Group{
+		ID:           g.ID,
+		Name:         g.Name,
+		Description:  g.Description,
+		UserSettings: settings,
+	}
+}
+
+// HideGroupSensitiveData hides group sensitive data
+func HideGroupSensitiveData(group *Group) Group {
+	group.UserSettings.FsConfig.hideSensitiveData()
+	for idx := range group.UserSettings.VirtualFolders {
+		group.UserSettings.VirtualFolders[idx].FsConfig.hideSensitiveData()
+	}
+	return *group
+}
+
+// validateGroup validates the group settings using the same rules applied to
+// users, a temporary user without home directory is used for this purpose
+func validateGroup(group *Group) error {
+	if len(group.Name) == 0 {
+		return &ValidationError{err: "mandatory parameters missing"}
+	}
+	if !groupNameRegex.MatchString(group.Name) {
+		return &ValidationError{err: fmt.Sprintf("name %#v is not valid, the following characters are allowed: "+
+			"a-zA-Z0-9-_.@", group.Name)}
+	}
+	settings := &group.UserSettings
+	if settings.MaxSessions < 0 || settings.QuotaSize < 0 || settings.QuotaFiles < 0 ||
+		settings.UploadBandwidth < 0 || settings.DownloadBandwidth < 0 {
+		return &ValidationError{err: "max sessions, quota and bandwidth limits cannot be negative"}
+	}
+	if settings.FsConfig.Provider == 2 && settings.FsConfig.GCSConfig.AutomaticCredentials == 0 {
+		return &ValidationError{err: "only automatic credentials are supported for GCS filesystems defined in groups"}
+	}
+	for _, folder := range settings.VirtualFolders {
+		if folder.FsConfig.Provider == 2 && folder.FsConfig.GCSConfig.AutomaticCredentials == 0 {
+			return &ValidationError{err: fmt.Sprintf("invalid virtual folder %#v: only automatic credentials are supported "+
+				"for GCS filesystems defined in groups", folder.VirtualPath)}
+		}
+	}
+	permissions, err := cleanPermissions(settings.Permissions)
+	if err != nil {
+		return err
+	}
+	settings.Permissions = permissions
+	user := User{
+		Username:       group.Name,
+		FsConfig:       settings.FsConfig,
+		Filters:        settings.Filters,
+		VirtualFolders: settings.VirtualFolders,
+	}
+	if err := validateFilesystemConfig(&user); err != nil {
+		return err
+	}
+	if err := validateVirtualFolders(&user); err != nil {
+		return err
+	}
+	if err := validateFilters(&user); err != nil {
+		return err
+	}
+	settings.FsConfig = user.FsConfig
+	settings.Filters = user.Filters
+	settings.VirtualFolders = user.VirtualFolders
+	return nil
+}
+
+// validateUserGroups checks the groups memberships for the given user,
+// the referenced groups must exist
+func validateUserGroups(p Provider, user *User) error {
+	var names []string
+	hasPrimary := false
+	for _, g := range user.Groups {
+		if g.Type != GroupTypePrimary && g.Type != GroupTypeSecondary {
+			return &ValidationError{err: fmt.Sprintf("invalid type %v for group %#v", g.Type, g.Name)}
+		}
+		if utils.IsStringInSlice(g.Name, names) {
+			return &ValidationError{err: fmt.Sprintf("duplicate group %#v", g.Name)}
+		}
+		if g.Type == GroupTypePrimary {
+			if hasPrimary {
+				return &ValidationError{err: "only one primary group is allowed"}
+			}
+			hasPrimary = true
+		}
+		if _, err := p.groupExists(g.Name); err != nil {
+			if _, ok := err.(*RecordNotFoundError); ok {
+				return &ValidationError{err: fmt.Sprintf("group %#v does not exist", g.Name)}
+			}
+			return err
+		}
+		names = append(names, g.Name)
+	}
+	return nil
+}
+
+// applyGroupSettings merges the settings of the groups the user belongs to
+// inside the given user. The primary group is applied first
+func applyGroupSettings(p Provider, user *User) error {
+	if len(user.Groups) == 0 {
+		return nil
+	}
+	var groups []UserGroup
+	for _, g := range user.Groups {
+		if g.Type == GroupTypePrimary {
+			groups = append([]UserGroup{g}, groups...)
+		} else {
+			groups = append(groups, g)
+		}
+	}
+	for _, g := range groups {
+		group, err := p.groupExists(g.Name)
+		if err != nil {
+			providerLog(logger.LevelWarn, "unable to get group %#v for user %#v: %v", g.Name, user.Username, err)
+			return err
+		}
+		settings := group.getUserSettingsFor(user.Username)
+		if g.Type == GroupTypePrimary {
+			user.mergePrimaryGroupSettings(settings)
+		}
+		user.mergeGroupSettings(settings, group.Name)
+	}
+	return nil
+}
+
+func (u *User) mergePrimaryGroupSettings(settings GroupUserSettings) {
+	if u.FsConfig.isDefault() && !settings.FsConfig.isDefault() {
+		u.FsConfig = settings.FsConfig
+	}
+	if u.MaxSessions == 0 {
+		u.MaxSessions = settings.MaxSessions
+	}
+	if u.QuotaSize == 0 {
+		u.QuotaSize = settings.QuotaSize
+	}
+	if u.QuotaFiles == 0 {
+		u.QuotaFiles = settings.QuotaFiles
+	}
+	if u.UploadBandwidth == 0 {
+		u.UploadBandwidth = settings.UploadBandwidth
+	}
+	if u.DownloadBandwidth == 0 {
+		u.DownloadBandwidth = settings.DownloadBandwidth
+	}
+}
+
+func (u *User) mergeGroupSettings(settings GroupUserSettings, groupName string) {
+	if u.Permissions == nil {
+		u.Permissions = make(map[string][]string)
+	}
+	for dir, perms := range settings.Permissions {
+		if _, ok := u.Permissions[dir]; !ok {
+			u.Permissions[dir] = perms
+		}
+	}
+	for _, IPMask := range settings.Filters.AllowedIP {
+		if !utils.IsStringInSlice(IPMask, u.Filters.AllowedIP) {
+			u.Filters.AllowedIP = append(u.Filters.AllowedIP, IPMask)
+		}
+	}
+	for _, IPMask := range settings.Filters.DeniedIP {
+		if !utils.IsStringInSlice(IPMask, u.Filters.DeniedIP) {
+			u.Filters.DeniedIP = append(u.Filters.DeniedIP, IPMask)
+		}
+	}
+	for _, method := range settings.Filters.DeniedLoginMethods {
+		if !utils.IsStringInSlice(method, u.Filters.DeniedLoginMethods) {
+			u.Filters.DeniedLoginMethods = append(u.Filters.DeniedLoginMethods, method)
+		}
+	}
+	for _, method := range settings.Filters.RequiredLoginMethods {
+		if !utils.IsStringInSlice(method, u.Filters.RequiredLoginMethods) {
+			u.Filters.RequiredLoginMethods = append(u.Filters.RequiredLoginMethods, method)
+		}
+	}
+	for _, f := range settings.Filters.FileExtensions {
+		if !u.hasFileExtensionsFilter(f.Path) {
+			u.Filters.FileExtensions = append(u.Filters.FileExtensions, f)
+		}
+	}
+	for _, v := range settings.VirtualFolders {
+		if u.isVirtualFolderOverlapped(v) {
+			providerLog(logger.LevelDebug, "virtual folder %#v from group %#v overlaps with an existing folder "+
+				"for user %#v, skipped", v.VirtualPath, groupName, u.Username)
+			continue
+		}
+		u.VirtualFolders = append(u.VirtualFolders, v)
+	}
+}
+
+func (u *User) hasFileExtensionsFilter(p string) bool {
+	for _, f := range u.Filters.FileExtensions {
+		if f.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// isVirtualFolderOverlapped returns true if the given folder overlaps with an existing
+// virtual folder. The mapped paths are only checked for local filesystem folders
+func (u *User) isVirtualFolderOverlapped(folder VirtualFolder) bool {
+	isLocal := folder.FsConfig.Provider == 0
+	if isLocal && isMappedDirOverlapped(filepath.Clean(folder.MappedPath), u.GetHomeDir()) {
+		return true
+	}
+	for _, v := range u.VirtualFolders {
+		if isVirtualDirOverlapped(path.Clean(v.VirtualPath), path.Clean(folder.VirtualPath)) {
+			return true
+		}
+		if isLocal && v.FsConfig.Provider == 0 &&
+			isMappedDirOverlapped(filepath.Clean(v.MappedPath), filepath.Clean(folder.MappedPath)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGroupReferenced returns true if at least a user belongs to the given group
+func isGroupReferenced(p Provider, name string) (bool, error) {
+	limit := 100
+	offset := 0
+	for {
+		users, err := p.getUsers(limit, offset, "ASC", "")
+		if err != nil {
+			return false, err
+		}
+		for _, u := range users {
+			for _, g := range u.Groups {
+				if g.Name == name {
+					return true, nil
+				}
+			}
+		}
+		if len(users) < limit {
+			return false, nil
+		}
+		offset += len(users)
+	}
+}
+
+// GroupExists returns the group with the given name if it exists
+func GroupExists(p Provider, name string) (Group, error) {
+	return p.groupExists(name)
+}
+
+// AddGroup adds a new group.
+// ManageUsers configuration must be set to 1 to enable this method
+func AddGroup(p Provider, group Group) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.addGroup(group)
+}
+
+// UpdateGroup updates an existing group.
+// The changes are applied to the group members on their next login.
+// ManageUsers configuration must be set to 1 to enable this method
+func UpdateGroup(p Provider, group Group) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.updateGroup(group)
+}
+
+// DeleteGroup deletes an existing group, a group cannot be deleted while it has members.
+// ManageUsers configuration must be set to 1 to enable this method
+func DeleteGroup(p Provider, group Group) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	referenced, err := isGroupReferenced(p, group.Name)
+	if err != nil {
+		return err
+	}
+	if referenced {
+		return &ValidationError{err: fmt.Sprintf("group %#v has members and cannot be deleted", group.Name)}
+	}
+	return p.deleteGroup(group)
+}
+
+// GetGroups returns an array of groups respecting limit and offset
+func GetGroups(p Provider, limit, offset int, order string) ([]Group, error) {
+	return p.getGroups(limit, offset, order)
+}
+
+// DumpGroups returns an array with all groups
+func DumpGroups(p Provider) ([]Group, error) {
+	return p.dumpGroups()
+}
+
+// GetUserWithGroupSettings returns the user with the given username and
+// the settings inherited from its groups, these are the effective settings
+// applied when the user logs in
+func GetUserWithGroupSettings(p Provider, username string) (User, error) {
+	user, err := p.userExists(username)
+	if err != nil {
+		return user, err
+	}
+	err = applyGroupSettings(p, &user)
+	return user, err
+}
@@ -0,0 +1,133 @@
+package dataprovider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/xid"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/httpclient"
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	// maximum number of request/response rounds for the keyboard interactive HTTP hook
+	keyboardAuthHookMaxSteps = 10
+	keyboardAuthHookTimeout  = 60 * time.Second
+)
+
+// hookRequest defines the JSON body sent to the external authentication and pre-login HTTP hooks
+type hookRequest struct {
+	Username string `json:"username"`
+	// login method, for example "password" or "publickey"
+	Method string `json:"method"`
+	IP     string `json:"ip"`
+	// protocol used to login: "SSH", "FTP", "DAV" or "HTTP"
+	Protocol string `json:"protocol"`
+	// not empty for external authentication using a password
+	Password string `json:"password,omitempty"`
+	// not empty for external authentication using a public key
+	PublicKey string `json:"public_key,omitempty"`
+	// the user trying to login, for the pre-login hook only
+	User *User `json:"user,omitempty"`
+}
+
+// keyboardAuthHookRequest defines the JSON body sent to the keyboard interactive HTTP hook
+type keyboardAuthHookRequest struct {
+	// RequestID is the same for all the requests of a single authentication
+	RequestID string `json:"request_id"`
+	Username  string `json:"username"`
+	IP        string `json:"ip"`
+	// hashed password as stored inside the data provider
+	Password string `json:"password"`
+	// the questions sent to the client in the previous step and the client answers, empty for the first request
+	Questions []string `json:"questions,omitempty"`
+	Answers   []string `json:"answers,omitempty"`
+}
+
+func executeHook(hookURL string, req interface{}) ([]byte, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return httpclient.Post(hookURL, "application/json", body)
+}
+
+func executeExternalAuthHook(username, password, pubKey, method, ip, protocol string) ([]byte, error) {
+	out, err := executeHook(config.ExternalAuthProgram, hookRequest{
+		Username:  username,
+		Method:    method,
+		IP:        ip,
+		Protocol:  protocol,
+		Password:  password,
+		PublicKey: pubKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("External auth hook error: %v", err)
+	}
+	return out, nil
+}
+
+func executePreLoginHook(user User, method, ip, protocol string) ([]byte, error) {
+	out, err := executeHook(config.PreLoginProgram, hookRequest{
+		Username: user.Username,
+		Method:   method,
+		IP:       ip,
+		Protocol: protocol,
+		User:     &user,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Pre-login hook error: %v", err)
+	}
+	return out, nil
+}
+
+// doKeyboardInteractiveHookAuth is the same as doKeyboardInteractiveAuth but the questions are
+// returned by an HTTP hook. The hook receives the answers to the previous questions in the next
+// request and it must set auth_result to finalize the authentication
+func doKeyboardInteractiveHookAuth(user User, authHook string, client ssh.KeyboardInteractiveChallenge,
+	ip string) (User, error) {
+	req := keyboardAuthHookRequest{
+		RequestID: xid.New().String(),
+		Username:  user.Username,
+		IP:        ip,
+		Password:  user.Password,
+	}
+	deadline := time.Now().Add(keyboardAuthHookTimeout)
+	authResult := 0
+	for step := 0; step < keyboardAuthHookMaxSteps && time.Now().Before(deadline); step++ {
+		out, err := executeHook(authHook, req)
+		if err != nil {
+			providerLog(logger.LevelInfo, "keyboard interactive hook error: %v", err)
+			return user, err
+		}
+		var response keyboardAuthProgramResponse
+		if err = json.Unmarshal(out, &response); err != nil {
+			providerLog(logger.LevelInfo, "keyboard interactive hook error parsing response: %v", err)
+			return user, err
+		}
+		if response.AuthResult != 0 {
+			authResult = response.AuthResult
+			break
+		}
+		if len(response.Questions) == 0 || len(response.Questions) != len(response.Echos) {
+			providerLog(logger.LevelInfo, "keyboard interactive hook error, invalid questions: %v echos: %v",
+				len(response.Questions), len(response.Echos))
+			return user, errors.New("invalid keyboard interactive hook response")
+		}
+		answers, err := getInteractiveAnswers(client, response, user)
+		if err != nil {
+			return user, err
+		}
+		req.Questions = response.Questions
+		req.Answers = answers
+	}
+	if authResult != 1 {
+		return user, fmt.Errorf("keyboard interactive auth failed, result: %v", authResult)
+	}
+	err := checkLoginConditions(user)
+	return user, err
+}
@@ -0,0 +1,344 @@
+package dataprovider
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	ldapUsernameInvalidChars = ",+\"\\<>;=#*()/"
+	ldapSearchSizeLimit      = 2
+)
+
+var (
+	ldapAuth              *ldapAuthenticator
+	errLDAPAuthFailed     = errors.New("LDAP authentication failed")
+	errLDAPNoTemplateUser = errors.New("no LDAP template user defined for the groups of this user")
+)
+
+// LDAPGroupMapping maps the members of an LDAP group to an SFTPGo template user
+type LDAPGroupMapping struct {
+	// Distinguished name of the LDAP group, for example "cn=sftp-admins,ou=groups,dc=example,dc=com".
+	// It is compared, case insensitive, with the values of the configured group attribute
+	Group string `json:"group" mapstructure:"group"`
+	// Username of the SFTPGo user to use as template for the group members
+	TemplateUser string `json:"template_user" mapstructure:"template_user"`
+}
+
+// LDAPConfig defines the configuration for the built-in LDAP/Active Directory authentication.
+// If enabled, password authentication is done binding to the LDAP server as the user trying
+// to login. The authenticated users are created or updated inside the data provider copying
+// the settings from a template user selected based on their LDAP groups
+type LDAPConfig struct {
+	// LDAP server URL, for example "ldaps://ldap.example.com" or "ldap://ldap.example.com:389".
+	// Leave empty to disable LDAP authentication
+	URL string `json:"url" mapstructure:"url"`
+	// Set to true to upgrade "ldap://" connections to TLS using the StartTLS extended operation
+	StartTLS bool `json:"start_tls" mapstructure:"start_tls"`
+	// Set to true to skip the verification of the LDAP server certificate. Use for testing only
+	SkipTLSVerify bool `json:"skip_tls_verify" mapstructure:"skip_tls_verify"`
+	// Path to a PEM file containing the certificate authorities to use to verify the LDAP server
+	// certificate. It can be a path relative to the config dir or an absolute path.
+	// Leave empty to use the system root certificates
+	CACertificateFile string `json:"ca_certificate_file" mapstructure:"ca_certificate_file"`
+	// Template for the distinguished name to bind as. "%s" is replaced with the username, for example
+	// "uid=%s,ou=people,dc=example,dc=com" or "%s@example.com" for Active Directory.
+	// If empty, the user is searched using SearchFilter and then the found entry is used to bind
+	BindDNTemplate string `json:"bind_dn_template" mapstructure:"bind_dn_template"`
+	// Distinguished name and password to bind as to search users.
+	// Leave empty to search anonymously
+	SearchBindDN       string `json:"search_bind_dn" mapstructure:"search_bind_dn"`
+	SearchBindPassword string `json:"search_bind_password" mapstructure:"search_bind_password"`
+	// Base distinguished name for users search, for example "ou=people,dc=example,dc=com"
+	BaseDN string `json:"base_dn" mapstructure:"base_dn"`
+	// Filter to search users, "%s" is replaced with the escaped username, for example "(uid=%s)"
+	// or "(&(objectClass=user)(sAMAccountName=%s))" for Active Directory.
+	// It is used to search the users to bind as, if BindDNTemplate is empty, and to find their groups
+	SearchFilter string `json:"search_filter" mapstructure:"search_filter"`
+	// User attribute containing the groups distinguished names, for example "memberOf"
+	GroupAttribute string `json:"group_attribute" mapstructure:"group_attribute"`
+	// Mappings from LDAP groups to template users. They are checked in order and the first
+	// mapping matching a group of the user is used
+	GroupMappings []LDAPGroupMapping `json:"group_mappings" mapstructure:"group_mappings"`
+	// Template user to use if no group mapping matches. Leave empty to deny the login in this case
+	DefaultTemplateUser string `json:"default_template_user" mapstructure:"default_template_user"`
+	// Timeout, in seconds, for connecting to the LDAP server and for each LDAP operation
+	Timeout int `json:"timeout" mapstructure:"timeout"`
+}
+
+// IsEnabled returns true if LDAP authentication is configured
+func (c *LDAPConfig) IsEnabled() bool {
+	return len(c.URL) > 0
+}
+
+func (c *LDAPConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid LDAP URL %#v: %v", c.URL, err)
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return fmt.Errorf("invalid LDAP URL %#v: only ldap:// and ldaps:// are supported", c.URL)
+	}
+	if c.StartTLS && u.Scheme != "ldap" {
+		return errors.New("LDAP StartTLS is supported for ldap:// URLs only")
+	}
+	if len(c.BindDNTemplate) > 0 && strings.Count(c.BindDNTemplate, "%s") != 1 {
+		return fmt.Errorf("invalid LDAP bind_dn_template %#v: it must contain \"%%s\" exactly once", c.BindDNTemplate)
+	}
+	if len(c.SearchFilter) > 0 && strings.Count(c.SearchFilter, "%s") != 1 {
+		return fmt.Errorf("invalid LDAP search_filter %#v: it must contain \"%%s\" exactly once", c.SearchFilter)
+	}
+	if len(c.BindDNTemplate) == 0 && (len(c.BaseDN) == 0 || len(c.SearchFilter) == 0) {
+		return errors.New("LDAP base_dn and search_filter are required if bind_dn_template is empty")
+	}
+	if len(c.GroupMappings) > 0 && (len(c.GroupAttribute) == 0 || len(c.BaseDN) == 0 || len(c.SearchFilter) == 0) {
+		return errors.New("LDAP group_attribute, base_dn and search_filter are required to map groups")
+	}
+	for _, m := range c.GroupMappings {
+		if len(m.Group) == 0 || len(m.TemplateUser) == 0 {
+			return fmt.Errorf("invalid LDAP group mapping %+v: group and template user are required", m)
+		}
+	}
+	if len(c.GroupMappings) == 0 && len(c.DefaultTemplateUser) == 0 {
+		return errors.New("at least a LDAP template user is required")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid LDAP timeout: %v", c.Timeout)
+	}
+	return nil
+}
+
+func (c *LDAPConfig) isTemplateUser(username string) bool {
+	if username == c.DefaultTemplateUser {
+		return true
+	}
+	for _, m := range c.GroupMappings {
+		if username == m.TemplateUser {
+			return true
+		}
+	}
+	return false
+}
+
+// getTemplateUsername returns the template user for the given LDAP groups
+func (c *LDAPConfig) getTemplateUsername(groups []string) (string, error) {
+	for _, m := range c.GroupMappings {
+		for _, g := range groups {
+			if strings.EqualFold(strings.TrimSpace(g), strings.TrimSpace(m.Group)) {
+				return m.TemplateUser, nil
+			}
+		}
+	}
+	if len(c.DefaultTemplateUser) > 0 {
+		return c.DefaultTemplateUser, nil
+	}
+	return "", errLDAPNoTemplateUser
+}
+
+type ldapAuthenticator struct {
+	config    LDAPConfig
+	tlsConfig *tls.Config
+	timeout   time.Duration
+}
+
+func newLDAPAuthenticator(conf LDAPConfig, basePath string) (*ldapAuthenticator, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(conf.URL)
+	a := &ldapAuthenticator{
+		config: conf,
+		tlsConfig: &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: conf.SkipTLSVerify,
+		},
+		timeout: time.Duration(conf.Timeout) * time.Second,
+	}
+	if len(conf.CACertificateFile) > 0 {
+		caFile := conf.CACertificateFile
+		if !filepath.IsAbs(caFile) {
+			caFile = filepath.Join(basePath, caFile)
+		}
+		pemCerts, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read LDAP CA certificate file %#v: %v", caFile, err)
+		}
+		a.tlsConfig.RootCAs = x509.NewCertPool()
+		if !a.tlsConfig.RootCAs.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no valid certificate found in LDAP CA certificate file %#v", caFile)
+		}
+	}
+	return a, nil
+}
+
+func (a *ldapAuthenticator) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: a.timeout}),
+		ldap.DialWithTLSConfig(a.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.timeout)
+	if a.config.StartTLS {
+		if err = conn.StartTLS(a.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *ldapAuthenticator) searchUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	var attributes []string
+	if len(a.config.GroupAttribute) > 0 {
+		attributes = append(attributes, a.config.GroupAttribute)
+	}
+	req := ldap.NewSearchRequest(a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, ldapSearchSizeLimit,
+		a.config.Timeout, false, fmt.Sprintf(a.config.SearchFilter, ldap.EscapeFilter(username)), attributes, nil)
+	result, err := conn.Search(req)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, fmt.Errorf("LDAP search for user %#v returned more than one entry", username)
+		}
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("LDAP search for user %#v returned %v entries, expected 1", username,
+			len(result.Entries))
+	}
+	return result.Entries[0], nil
+}
+
+// authenticate binds as the given user and returns its groups
+func (a *ldapAuthenticator) authenticate(username, password string) ([]string, error) {
+	conn, err := a.connect()
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to connect to the LDAP server: %v", err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	var entry *ldap.Entry
+	if len(a.config.BindDNTemplate) > 0 {
+		if err = conn.Bind(fmt.Sprintf(a.config.BindDNTemplate, username), password); err != nil {
+			providerLog(logger.LevelDebug, "LDAP bind failed for user %#v: %v", username, err)
+			return nil, errLDAPAuthFailed
+		}
+		if len(a.config.BaseDN) == 0 || len(a.config.SearchFilter) == 0 {
+			return nil, nil
+		}
+		// the groups are searched with the privileges of the authenticated user
+		entry, err = a.searchUser(conn, username)
+		if err != nil {
+			providerLog(logger.LevelWarn, "unable to get the LDAP groups for user %#v: %v", username, err)
+			return nil, err
+		}
+	} else {
+		if len(a.config.SearchBindDN) > 0 {
+			err = conn.Bind(a.config.SearchBindDN, a.config.SearchBindPassword)
+		} else {
+			err = conn.UnauthenticatedBind("")
+		}
+		if err != nil {
+			providerLog(logger.LevelWarn, "LDAP bind failed for search DN %#v: %v", a.config.SearchBindDN, err)
+			return nil, err
+		}
+		entry, err = a.searchUser(conn, username)
+		if err != nil {
+			providerLog(logger.LevelDebug, "unable to find LDAP user %#v: %v", username, err)
+			return nil, errLDAPAuthFailed
+		}
+		if err = conn.Bind(entry.DN, password); err != nil {
+			providerLog(logger.LevelDebug, "LDAP bind failed for user %#v, DN %#v: %v", username, entry.DN, err)
+			return nil, errLDAPAuthFailed
+		}
+	}
+	if len(a.config.GroupAttribute) == 0 {
+		return nil, nil
+	}
+	return entry.GetEqualFoldAttributeValues(a.config.GroupAttribute), nil
+}
+
+func isLDAPUsernameValid(username string) bool {
+	if len(username) == 0 || strings.TrimSpace(username) != username {
+		return false
+	}
+	for _, r := range username {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(ldapUsernameInvalidChars, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// doLDAPAuth authenticates the given user against the LDAP server and creates, or updates,
+// the user inside the data provider using the template user matching its LDAP groups
+func doLDAPAuth(p Provider, username, password string) (User, error) {
+	var user User
+	if len(password) == 0 || !isLDAPUsernameValid(username) {
+		return user, errLDAPAuthFailed
+	}
+	if ldapAuth.config.isTemplateUser(username) {
+		providerLog(logger.LevelWarn, "LDAP login denied for template user %#v", username)
+		return user, errLDAPAuthFailed
+	}
+	startTime := time.Now()
+	groups, err := ldapAuth.authenticate(username, password)
+	if err != nil {
+		return user, err
+	}
+	templateUsername, err := ldapAuth.config.getTemplateUsername(groups)
+	if err != nil {
+		providerLog(logger.LevelInfo, "LDAP login denied for user %#v, groups: %v: %v", username, groups, err)
+		return user, err
+	}
+	template, err := p.userExists(templateUsername)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get LDAP template user %#v: %v", templateUsername, err)
+		return user, err
+	}
+	user = template.getACopy()
+	user.ID = 0
+	user.Username = username
+	user.Password = password
+	user.PublicKeys = nil
+	user.HomeDir = filepath.Join(template.HomeDir, username)
+	user.Status = 1
+	user.ExpirationDate = 0
+	user.UsedQuotaSize = 0
+	user.UsedQuotaFiles = 0
+	user.LastQuotaUpdate = 0
+	user.LastLogin = 0
+	user.TOTPConfig = UserTOTPConfig{}
+	u, err := p.userExists(username)
+	if err == nil {
+		user.ID = u.ID
+		user.PublicKeys = u.PublicKeys
+		user.UsedQuotaSize = u.UsedQuotaSize
+		user.UsedQuotaFiles = u.UsedQuotaFiles
+		user.LastQuotaUpdate = u.LastQuotaUpdate
+		user.LastLogin = u.LastLogin
+		user.TOTPConfig = u.TOTPConfig
+		err = p.updateUser(user)
+	} else {
+		err = p.addUser(user)
+	}
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to save LDAP user %#v: %v", username, err)
+		return user, err
+	}
+	providerLog(logger.LevelDebug, "LDAP authentication succeeded for user %#v, template user: %#v, elapsed: %v",
+		username, templateUsername, time.Since(startTime))
+	return p.userExists(username)
+}
@@ -27,6 +27,20 @@ type memoryProviderHandle struct {
 	usersIdx map[int64]string
 	// map for users, username is the key
 	users map[string]User
+	// map for shares, share ID is the key
+	shares map[string]Share
+	// map for admins, username is the key
+	admins map[string]Admin
+	// slice with ordered admins username
+	adminsUsernames []string
+	// map for API keys, key ID is the key
+	apiKeys map[string]APIKey
+	// map for groups, group name is the key
+	groups map[string]Group
+	// slice with ordered group names
+	groupNames []string
+	// map for banned IP addresses, the IP is the key
+	bannedIPs map[string]BannedIP
 	// configuration file to use for loading users
 	configFile string
 	lock       *sync.Mutex
@@ -51,6 +65,12 @@ func initializeMemoryProvider(basePath string) error {
 			usernames:  []string{},
 			usersIdx:   make(map[int64]string),
 			users:      make(map[string]User),
+			shares:     make(map[string]Share),
+			admins:     make(map[string]Admin),
+			apiKeys:    make(map[string]APIKey),
+			groups:     make(map[string]Group),
+			groupNames: []string{},
+			bannedIPs:  make(map[string]BannedIP),
 			configFile: configFile,
 			lock:       new(sync.Mutex),
 		},
@@ -130,6 +150,23 @@ func (p MemoryProvider) updateLastLogin(username string) error {
 	return nil
 }
 
+func (p MemoryProvider) useTOTPRecoveryCode(username, hash string) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		return err
+	}
+	if err = user.TOTPConfig.removeRecoveryCode(hash); err != nil {
+		return err
+	}
+	p.dbHandle.users[user.Username] = user
+	return nil
+}
+
 func (p MemoryProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
 	p.dbHandle.lock.Lock()
 	defer p.dbHandle.lock.Unlock()
@@ -167,6 +204,39 @@ func (p MemoryProvider) getUsedQuota(username string) (int, int64, error) {
 	return user.UsedQuotaFiles, user.UsedQuotaSize, err
 }
 
+func (p MemoryProvider) updateFolderQuota(username, virtualPath string, filesAdd int, sizeAdd int64, reset bool) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to update quota for user %v, virtual folder %v error: %v", username,
+			virtualPath, err)
+		return err
+	}
+	user.updateFolderQuota(virtualPath, filesAdd, sizeAdd, reset)
+	p.dbHandle.users[user.Username] = user
+	return nil
+}
+
+func (p MemoryProvider) getUsedFolderQuota(username, virtualPath string) (int, int64, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return 0, 0, errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get quota for user %v, virtual folder %v error: %v", username,
+			virtualPath, err)
+		return 0, 0, err
+	}
+	files, size := user.getUsedFolderQuota(virtualPath)
+	return files, size, nil
+}
+
 func (p MemoryProvider) addUser(user User) error {
 	p.dbHandle.lock.Lock()
 	defer p.dbHandle.lock.Unlock()
@@ -189,7 +259,7 @@ func (p MemoryProvider) addUser(user User) error {
 	return nil
 }
 
-func (p MemoryProvider) updateUser(user User) error {
+func (p MemoryProvider) restoreUser(user User) error {
 	p.dbHandle.lock.Lock()
 	defer p.dbHandle.lock.Unlock()
 	if p.dbHandle.isClosed {
@@ -200,9 +270,35 @@ func (p MemoryProvider) updateUser(user User) error {
 		return err
 	}
 	_, err = p.userExistsInternal(user.Username)
+	if err == nil {
+		return fmt.Errorf("username %v already exists", user.Username)
+	}
+	if _, ok := p.dbHandle.usersIdx[user.ID]; ok {
+		return fmt.Errorf("user ID %v already exists", user.ID)
+	}
+	p.dbHandle.users[user.Username] = user
+	p.dbHandle.usersIdx[user.ID] = user.Username
+	p.dbHandle.usernames = append(p.dbHandle.usernames, user.Username)
+	sort.Strings(p.dbHandle.usernames)
+	return nil
+}
+
+func (p MemoryProvider) updateUser(user User) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateUser(&user)
+	if err != nil {
+		return err
+	}
+	u, err := p.userExistsInternal(user.Username)
 	if err != nil {
 		return err
 	}
+	// the used folders quota is updated using the dedicated methods
+	user.FoldersQuota = u.FoldersQuota
 	p.dbHandle.users[user.Username] = user
 	return nil
 }
@@ -219,6 +315,11 @@ func (p MemoryProvider) deleteUser(user User) error {
 	}
 	delete(p.dbHandle.users, user.Username)
 	delete(p.dbHandle.usersIdx, user.ID)
+	for shareID, share := range p.dbHandle.shares {
+		if share.Username == user.Username {
+			delete(p.dbHandle.shares, shareID)
+		}
+	}
 	// this could be more efficient
 	p.dbHandle.usernames = []string{}
 	for username := range p.dbHandle.users {
@@ -313,6 +414,518 @@ func (p MemoryProvider) userExistsInternal(username string) (User, error) {
 	return User{}, &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", username)}
 }
 
+func (p MemoryProvider) addShare(share Share) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateShare(&share)
+	if err != nil {
+		return err
+	}
+	if _, ok := p.dbHandle.shares[share.ShareID]; ok {
+		return fmt.Errorf("share %v already exists", share.ShareID)
+	}
+	share.ID = p.getNextShareID()
+	p.dbHandle.shares[share.ShareID] = share
+	return nil
+}
+
+func (p MemoryProvider) updateShare(share Share) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateShare(&share)
+	if err != nil {
+		return err
+	}
+	if _, ok := p.dbHandle.shares[share.ShareID]; !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist", share.ShareID)}
+	}
+	p.dbHandle.shares[share.ShareID] = share
+	return nil
+}
+
+func (p MemoryProvider) deleteShare(share Share) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.shares[share.ShareID]; !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist", share.ShareID)}
+	}
+	delete(p.dbHandle.shares, share.ShareID)
+	return nil
+}
+
+func (p MemoryProvider) getShareByID(shareID string) (Share, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return Share{}, errMemoryProviderClosed
+	}
+	if share, ok := p.dbHandle.shares[shareID]; ok {
+		return share, nil
+	}
+	return Share{}, &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist", shareID)}
+}
+
+func (p MemoryProvider) getShares(limit int, offset int, order string, username string) ([]Share, error) {
+	shares := []Share{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return shares, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return shares, nil
+	}
+	var shareIDs []string
+	for shareID, share := range p.dbHandle.shares {
+		if len(username) == 0 || share.Username == username {
+			shareIDs = append(shareIDs, shareID)
+		}
+	}
+	if order == "ASC" {
+		sort.Strings(shareIDs)
+	} else {
+		sort.Sort(sort.Reverse(sort.StringSlice(shareIDs)))
+	}
+	for i, shareID := range shareIDs {
+		if i < offset {
+			continue
+		}
+		share := p.dbHandle.shares[shareID]
+		shares = append(shares, HideShareSensitiveData(&share))
+		if len(shares) >= limit {
+			break
+		}
+	}
+	return shares, nil
+}
+
+func (p MemoryProvider) updateShareUsage(shareID string, numTokens int) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	share, ok := p.dbHandle.shares[shareID]
+	if !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist, unable to update usage", shareID)}
+	}
+	if !share.hasTokens(numTokens) {
+		return ErrShareTokensExhausted
+	}
+	share.UsedTokens += numTokens
+	share.LastUseAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+	p.dbHandle.shares[shareID] = share
+	return nil
+}
+
+func (p MemoryProvider) getNextShareID() int64 {
+	nextID := int64(1)
+	for _, share := range p.dbHandle.shares {
+		if share.ID >= nextID {
+			nextID = share.ID + 1
+		}
+	}
+	return nextID
+}
+
+func (p MemoryProvider) adminExists(username string) (Admin, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return Admin{}, errMemoryProviderClosed
+	}
+	return p.adminExistsInternal(username)
+}
+
+func (p MemoryProvider) adminExistsInternal(username string) (Admin, error) {
+	if val, ok := p.dbHandle.admins[username]; ok {
+		admin := val
+		admin.Permissions = make([]string, len(val.Permissions))
+		copy(admin.Permissions, val.Permissions)
+		return admin, nil
+	}
+	return Admin{}, &RecordNotFoundError{err: fmt.Sprintf("admin %v does not exist", username)}
+}
+
+func (p MemoryProvider) addAdmin(admin Admin) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	_, err = p.adminExistsInternal(admin.Username)
+	if err == nil {
+		return fmt.Errorf("admin %v already exists", admin.Username)
+	}
+	admin.ID = p.getNextAdminID()
+	p.dbHandle.admins[admin.Username] = admin
+	p.dbHandle.adminsUsernames = append(p.dbHandle.adminsUsernames, admin.Username)
+	sort.Strings(p.dbHandle.adminsUsernames)
+	return nil
+}
+
+func (p MemoryProvider) updateAdmin(admin Admin) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	a, err := p.adminExistsInternal(admin.Username)
+	if err != nil {
+		return err
+	}
+	admin.ID = a.ID
+	p.dbHandle.admins[admin.Username] = admin
+	return nil
+}
+
+func (p MemoryProvider) deleteAdmin(admin Admin) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	_, err := p.adminExistsInternal(admin.Username)
+	if err != nil {
+		return err
+	}
+	delete(p.dbHandle.admins, admin.Username)
+	for keyID, key := range p.dbHandle.apiKeys {
+		if key.Admin == admin.Username {
+			delete(p.dbHandle.apiKeys, keyID)
+		}
+	}
+	p.dbHandle.adminsUsernames = []string{}
+	for username := range p.dbHandle.admins {
+		p.dbHandle.adminsUsernames = append(p.dbHandle.adminsUsernames, username)
+	}
+	sort.Strings(p.dbHandle.adminsUsernames)
+	return nil
+}
+
+func (p MemoryProvider) getAdmins(limit int, offset int, order string) ([]Admin, error) {
+	admins := []Admin{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return admins, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return admins, nil
+	}
+	itNum := 0
+	if order == "ASC" {
+		for _, username := range p.dbHandle.adminsUsernames {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			a := p.dbHandle.admins[username]
+			admins = append(admins, HideAdminSensitiveData(&a))
+			if len(admins) >= limit {
+				break
+			}
+		}
+	} else {
+		for i := len(p.dbHandle.adminsUsernames) - 1; i >= 0; i-- {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			a := p.dbHandle.admins[p.dbHandle.adminsUsernames[i]]
+			admins = append(admins, HideAdminSensitiveData(&a))
+			if len(admins) >= limit {
+				break
+			}
+		}
+	}
+	return admins, nil
+}
+
+func (p MemoryProvider) dumpAdmins() ([]Admin, error) {
+	admins := []Admin{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return admins, errMemoryProviderClosed
+	}
+	for _, username := range p.dbHandle.adminsUsernames {
+		admins = append(admins, p.dbHandle.admins[username])
+	}
+	return admins, nil
+}
+
+func (p MemoryProvider) getNextAdminID() int64 {
+	nextID := int64(1)
+	for _, a := range p.dbHandle.admins {
+		if a.ID >= nextID {
+			nextID = a.ID + 1
+		}
+	}
+	return nextID
+}
+
+func (p MemoryProvider) apiKeyExists(keyID string) (APIKey, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return APIKey{}, errMemoryProviderClosed
+	}
+	if key, ok := p.dbHandle.apiKeys[keyID]; ok {
+		key.Permissions = make([]string, len(key.Permissions))
+		copy(key.Permissions, p.dbHandle.apiKeys[keyID].Permissions)
+		return key, nil
+	}
+	return APIKey{}, &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist", keyID)}
+}
+
+func (p MemoryProvider) addAPIKey(key APIKey) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateAPIKey(&key)
+	if err != nil {
+		return err
+	}
+	if _, ok := p.dbHandle.apiKeys[key.KeyID]; ok {
+		return fmt.Errorf("API key %v already exists", key.KeyID)
+	}
+	key.ID = p.getNextAPIKeyID()
+	p.dbHandle.apiKeys[key.KeyID] = key
+	return nil
+}
+
+func (p MemoryProvider) deleteAPIKey(key APIKey) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.apiKeys[key.KeyID]; !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist", key.KeyID)}
+	}
+	delete(p.dbHandle.apiKeys, key.KeyID)
+	return nil
+}
+
+func (p MemoryProvider) getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error) {
+	keys := []APIKey{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return keys, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return keys, nil
+	}
+	var keyIDs []string
+	for keyID, key := range p.dbHandle.apiKeys {
+		if len(admin) == 0 || key.Admin == admin {
+			keyIDs = append(keyIDs, keyID)
+		}
+	}
+	if order == "ASC" {
+		sort.Strings(keyIDs)
+	} else {
+		sort.Sort(sort.Reverse(sort.StringSlice(keyIDs)))
+	}
+	for i, keyID := range keyIDs {
+		if i < offset {
+			continue
+		}
+		key := p.dbHandle.apiKeys[keyID]
+		keys = append(keys, HideAPIKeySensitiveData(&key))
+		if len(keys) >= limit {
+			break
+		}
+	}
+	return keys, nil
+}
+
+func (p MemoryProvider) updateAPIKeyLastUse(keyID string) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	key, ok := p.dbHandle.apiKeys[keyID]
+	if !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist, unable to update last use", keyID)}
+	}
+	key.LastUseAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+	p.dbHandle.apiKeys[keyID] = key
+	return nil
+}
+
+func (p MemoryProvider) getNextAPIKeyID() int64 {
+	nextID := int64(1)
+	for _, key := range p.dbHandle.apiKeys {
+		if key.ID >= nextID {
+			nextID = key.ID + 1
+		}
+	}
+	return nextID
+}
+
+func (p MemoryProvider) groupExists(name string) (Group, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return Group{}, errMemoryProviderClosed
+	}
+	return p.groupExistsInternal(name)
+}
+
+func (p MemoryProvider) groupExistsInternal(name string) (Group, error) {
+	if val, ok := p.dbHandle.groups[name]; ok {
+		return val.getACopy(), nil
+	}
+	return Group{}, &RecordNotFoundError{err: fmt.Sprintf("group %v does not exist", name)}
+}
+
+func (p MemoryProvider) addGroup(group Group) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	_, err = p.groupExistsInternal(group.Name)
+	if err == nil {
+		return fmt.Errorf("group %v already exists", group.Name)
+	}
+	group.ID = p.getNextGroupID()
+	p.dbHandle.groups[group.Name] = group
+	p.dbHandle.groupNames = append(p.dbHandle.groupNames, group.Name)
+	sort.Strings(p.dbHandle.groupNames)
+	return nil
+}
+
+func (p MemoryProvider) updateGroup(group Group) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	g, err := p.groupExistsInternal(group.Name)
+	if err != nil {
+		return err
+	}
+	group.ID = g.ID
+	p.dbHandle.groups[group.Name] = group
+	return nil
+}
+
+func (p MemoryProvider) deleteGroup(group Group) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	_, err := p.groupExistsInternal(group.Name)
+	if err != nil {
+		return err
+	}
+	delete(p.dbHandle.groups, group.Name)
+	p.dbHandle.groupNames = []string{}
+	for name := range p.dbHandle.groups {
+		p.dbHandle.groupNames = append(p.dbHandle.groupNames, name)
+	}
+	sort.Strings(p.dbHandle.groupNames)
+	return nil
+}
+
+func (p MemoryProvider) getGroups(limit int, offset int, order string) ([]Group, error) {
+	groups := []Group{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return groups, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return groups, nil
+	}
+	itNum := 0
+	if order == "ASC" {
+		for _, name := range p.dbHandle.groupNames {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			g := p.dbHandle.groups[name]
+			g = g.getACopy()
+			groups = append(groups, HideGroupSensitiveData(&g))
+			if len(groups) >= limit {
+				break
+			}
+		}
+	} else {
+		for i := len(p.dbHandle.groupNames) - 1; i >= 0; i-- {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			g := p.dbHandle.groups[p.dbHandle.groupNames[i]]
+			g = g.getACopy()
+			groups = append(groups, HideGroupSensitiveData(&g))
+			if len(groups) >= limit {
+				break
+			}
+		}
+	}
+	return groups, nil
+}
+
+func (p MemoryProvider) dumpGroups() ([]Group, error) {
+	groups := []Group{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return groups, errMemoryProviderClosed
+	}
+	for _, name := range p.dbHandle.groupNames {
+		g := p.dbHandle.groups[name]
+		groups = append(groups, g.getACopy())
+	}
+	return groups, nil
+}
+
+func (p MemoryProvider) getNextGroupID() int64 {
+	nextID := int64(1)
+	for _, g := range p.dbHandle.groups {
+		if g.ID >= nextID {
+			nextID = g.ID + 1
+		}
+	}
+	return nextID
+}
+
 func (p MemoryProvider) getNextID() int64 {
 	nextID := int64(1)
 	for id := range p.dbHandle.usersIdx {
@@ -331,6 +944,137 @@ func (p MemoryProvider) clearUsers() {
 	p.dbHandle.users = make(map[string]User)
 }
 
+func (p MemoryProvider) bannedIPExists(ip string) (BannedIP, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return BannedIP{}, errMemoryProviderClosed
+	}
+	if ban, ok := p.dbHandle.bannedIPs[ip]; ok {
+		return ban, nil
+	}
+	return BannedIP{}, &RecordNotFoundError{err: fmt.Sprintf("banned IP %v does not exist", ip)}
+}
+
+func (p MemoryProvider) addBannedIP(ban BannedIP) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateBannedIP(&ban)
+	if err != nil {
+		return err
+	}
+	if _, ok := p.dbHandle.bannedIPs[ban.IP]; ok {
+		return fmt.Errorf("banned IP %v already exists", ban.IP)
+	}
+	ban.ID = p.getNextBannedIPID()
+	p.dbHandle.bannedIPs[ban.IP] = ban
+	return nil
+}
+
+func (p MemoryProvider) updateBannedIP(ban BannedIP) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateBannedIP(&ban)
+	if err != nil {
+		return err
+	}
+	b, ok := p.dbHandle.bannedIPs[ban.IP]
+	if !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("banned IP %v does not exist", ban.IP)}
+	}
+	ban.ID = b.ID
+	p.dbHandle.bannedIPs[ban.IP] = ban
+	return nil
+}
+
+func (p MemoryProvider) deleteBannedIP(ban BannedIP) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.bannedIPs[ban.IP]; !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("banned IP %v does not exist", ban.IP)}
+	}
+	delete(p.dbHandle.bannedIPs, ban.IP)
+	return nil
+}
+
+func (p MemoryProvider) getBannedIPs(limit int, offset int, order string) ([]BannedIP, error) {
+	bans := []BannedIP{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return bans, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return bans, nil
+	}
+	var ips []string
+	for ip := range p.dbHandle.bannedIPs {
+		ips = append(ips, ip)
+	}
+	if order == "ASC" {
+		sort.Strings(ips)
+	} else {
+		sort.Sort(sort.Reverse(sort.StringSlice(ips)))
+	}
+	for i, ip := range ips {
+		if i < offset {
+			continue
+		}
+		bans = append(bans, p.dbHandle.bannedIPs[ip])
+		if len(bans) >= limit {
+			break
+		}
+	}
+	return bans, nil
+}
+
+func (p MemoryProvider) cleanupBannedIPs(before int64) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	for ip, ban := range p.dbHandle.bannedIPs {
+		if ban.BannedUntil < before {
+			delete(p.dbHandle.bannedIPs, ip)
+		}
+	}
+	return nil
+}
+
+func (p MemoryProvider) getNextBannedIPID() int64 {
+	nextID := int64(1)
+	for _, ban := range p.dbHandle.bannedIPs {
+		if ban.ID >= nextID {
+			nextID = ban.ID + 1
+		}
+	}
+	return nextID
+}
+
+func (p MemoryProvider) clearGroups() {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	p.dbHandle.groupNames = []string{}
+	p.dbHandle.groups = make(map[string]Group)
+}
+
+func (p MemoryProvider) clearAdmins() {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	p.dbHandle.adminsUsernames = []string{}
+	p.dbHandle.admins = make(map[string]Admin)
+}
+
 func (p MemoryProvider) reloadConfig() error {
 	if len(p.dbHandle.configFile) == 0 {
 		providerLog(logger.LevelDebug, "no users configuration file defined")
@@ -363,6 +1107,15 @@ func (p MemoryProvider) reloadConfig() error {
 		providerLog(logger.LevelWarn, "error loading users: %v", err)
 		return err
 	}
+	// groups must be loaded before the users that reference them
+	p.clearGroups()
+	for _, group := range dump.Groups {
+		err = p.addGroup(group)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error adding group %#v: %v", group.Name, err)
+			return err
+		}
+	}
 	p.clearUsers()
 	for _, user := range dump.Users {
 		u, err := p.userExists(user.Username)
@@ -387,6 +1140,14 @@ func (p MemoryProvider) reloadConfig() error {
 			}
 		}
 	}
+	p.clearAdmins()
+	for _, admin := range dump.Admins {
+		err = p.addAdmin(admin)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error adding admin %#v: %v", admin.Username, err)
+			return err
+		}
+	}
 	providerLog(logger.LevelDebug, "users loaded from file: %#v", p.dbHandle.configFile)
 	return nil
 }
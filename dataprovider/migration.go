@@ -0,0 +1,501 @@
+package dataprovider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	defaultMigrationBatchSize = 100
+	migrationKindAdmin        = "admin"
+	migrationKindAPIKey       = "API key"
+	migrationKindShare        = "share"
+	migrationKindBannedIP     = "banned IP"
+)
+
+// MigrationOptions defines the options for a data provider migration
+type MigrationOptions struct {
+	// Number of users, API keys, shares and banned IPs to read from the source data provider for each batch
+	BatchSize int
+	// If true the source data is read and validated but it is not written to the destination.
+	// The destination data provider is not modified
+	DryRun bool
+}
+
+// MigrationResult defines the result of a data provider migration
+type MigrationResult struct {
+	Groups    int
+	Users     int
+	Admins    int
+	APIKeys   int
+	Shares    int
+	BannedIPs int
+	// SourceChecksum is computed over the users read from the source data provider,
+	// DestinationChecksum over the users read back from the destination one.
+	// They are the same if the migration succeeded
+	SourceChecksum      string
+	DestinationChecksum string
+}
+
+// providerState is the package level state used by a data provider.
+// The data providers share some package level state, such as the configuration
+// and the SQL placeholders, so a migration opens the source and the destination
+// data providers and activates the state of the one to use before each operation
+type providerState struct {
+	conf           Config
+	placeholders   []string
+	credentialsDir string
+	logSender      string
+	p              Provider
+}
+
+func saveProviderState() *providerState {
+	return &providerState{
+		conf:           config,
+		placeholders:   sqlPlaceholders,
+		credentialsDir: credentialsDirPath,
+		logSender:      logSender,
+		p:              provider,
+	}
+}
+
+func openMigrationProvider(conf Config, basePath string, migrate bool) (*providerState, error) {
+	config = conf
+	sqlPlaceholders = getSQLPlaceholders()
+	if err := validateCredentialsDir(basePath); err != nil {
+		return nil, err
+	}
+	if err := createProvider(basePath); err != nil {
+		return nil, err
+	}
+	if migrate {
+		if err := provider.migrateDatabase(); err != nil {
+			provider.close()
+			return nil, err
+		}
+	}
+	return saveProviderState(), nil
+}
+
+func (s *providerState) activate() Provider {
+	config = s.conf
+	sqlPlaceholders = s.placeholders
+	credentialsDirPath = s.credentialsDir
+	logSender = s.logSender
+	provider = s.p
+	return s.p
+}
+
+func (s *providerState) close() {
+	s.activate().close()
+}
+
+// forEachUser calls fn for each user read from the data provider in batches
+func (s *providerState) forEachUser(batchSize int, fn func(user User) error) error {
+	return forEachUser(s.activate, batchSize, fn)
+}
+
+// MigrateProvider copies the groups, the users, the admins, the API keys, the shares and the banned IPs
+// from the source data provider to the destination one. The users are read and written in batches, the user
+// IDs, the used quota and the last login are preserved. The destination data provider must be empty.
+// After the copy the migrated data is read back from the destination data provider and compared with the
+// source one.
+// The source data provider should not be modified while the migration is in progress.
+// The package level data provider is not usable while a migration is in progress
+func MigrateProvider(source, destination Config, basePath string, opts MigrationOptions) (MigrationResult, error) {
+	var result MigrationResult
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultMigrationBatchSize
+	}
+	state := saveProviderState()
+	defer state.activate()
+
+	src, err := openMigrationProvider(source, basePath, false)
+	if err != nil {
+		return result, fmt.Errorf("unable to open the source data provider: %v", err)
+	}
+	defer src.close()
+	dst, err := openMigrationProvider(destination, basePath, !opts.DryRun)
+	if err != nil {
+		return result, fmt.Errorf("unable to open the destination data provider: %v", err)
+	}
+	defer dst.close()
+
+	if err = checkMigrationDestination(dst.activate()); err != nil {
+		return result, err
+	}
+	groups, err := src.activate().dumpGroups()
+	if err != nil {
+		return result, fmt.Errorf("unable to read the source groups: %v", err)
+	}
+	for _, group := range groups {
+		if !opts.DryRun {
+			if err = dst.activate().addGroup(group); err != nil {
+				return result, fmt.Errorf("unable to add group %#v: %v", group.Name, err)
+			}
+		}
+		result.Groups++
+	}
+	providerLog(logger.LevelInfo, "migrated %v groups, dry run: %v", result.Groups, opts.DryRun)
+
+	sourceDigests := make(map[string]string)
+	err = src.forEachUser(opts.BatchSize, func(user User) error {
+		digest, err := getUserDigest(user)
+		if err != nil {
+			return err
+		}
+		sourceDigests[user.Username] = digest
+		if opts.DryRun {
+			// the credentials are already stored inside the source credentials dir
+			user.FsConfig.GCSConfig.Credentials = kms.Secret{}
+			err = validateUser(&user)
+		} else {
+			err = dst.activate().restoreUser(user)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to migrate user %#v: %v", user.Username, err)
+		}
+		result.Users++
+		if result.Users%opts.BatchSize == 0 {
+			providerLog(logger.LevelInfo, "migrated %v users, dry run: %v", result.Users, opts.DryRun)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	result.SourceChecksum = getDigestsChecksum(sourceDigests)
+	providerLog(logger.LevelInfo, "migrated %v users, dry run: %v, checksum: %v", result.Users, opts.DryRun,
+		result.SourceChecksum)
+
+	sourceRecords := make(map[string]string)
+	err = forEachMigrationRecord(src.activate, opts.BatchSize, func(kind, name string, record interface{}) error {
+		digest, err := getRecordDigest(record)
+		if err != nil {
+			return err
+		}
+		sourceRecords[kind+"/"+name] = digest
+		if err = migrateRecord(dst.activate, record, opts.DryRun); err != nil {
+			return fmt.Errorf("unable to migrate %v %#v: %v", kind, name, err)
+		}
+		result.addRecord(kind)
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	providerLog(logger.LevelInfo, "migrated %v admins, %v API keys, %v shares, %v banned IPs, dry run: %v",
+		result.Admins, result.APIKeys, result.Shares, result.BannedIPs, opts.DryRun)
+	if opts.DryRun {
+		return result, nil
+	}
+	if err = verifyMigration(dst, sourceDigests, len(groups), opts.BatchSize, &result); err != nil {
+		return result, err
+	}
+	return result, verifyMigratedRecords(dst, sourceRecords, opts.BatchSize)
+}
+
+func (r *MigrationResult) addRecord(kind string) {
+	switch kind {
+	case migrationKindAdmin:
+		r.Admins++
+	case migrationKindAPIKey:
+		r.APIKeys++
+	case migrationKindShare:
+		r.Shares++
+	case migrationKindBannedIP:
+		r.BannedIPs++
+	}
+}
+
+func checkMigrationDestination(p Provider) error {
+	users, err := p.getUsers(1, 0, "ASC", "")
+	if err != nil {
+		return fmt.Errorf("unable to read the destination users: %v", err)
+	}
+	groups, err := p.getGroups(1, 0, "ASC")
+	if err != nil {
+		return fmt.Errorf("unable to read the destination groups: %v", err)
+	}
+	admins, err := p.getAdmins(1, 0, "ASC")
+	if err != nil {
+		return fmt.Errorf("unable to read the destination admins: %v", err)
+	}
+	apiKeys, err := p.getAPIKeys(1, 0, "ASC", "")
+	if err != nil {
+		return fmt.Errorf("unable to read the destination API keys: %v", err)
+	}
+	shares, err := p.getShares(1, 0, "ASC", "")
+	if err != nil {
+		return fmt.Errorf("unable to read the destination shares: %v", err)
+	}
+	bans, err := p.getBannedIPs(1, 0, "ASC")
+	if err != nil {
+		return fmt.Errorf("unable to read the destination banned IPs: %v", err)
+	}
+	if len(users) > 0 || len(groups) > 0 || len(admins) > 0 || len(apiKeys) > 0 || len(shares) > 0 || len(bans) > 0 {
+		return errors.New("the destination data provider must not contain any user, group, admin, API key, share " +
+			"or banned IP")
+	}
+	return nil
+}
+
+// forEachMigrationRecord calls fn for each admin, API key, share and banned IP, including the hashed
+// passwords and keys, read from the data provider returned by getProvider. The records are read in
+// this order, so the admins and the users are migrated before the API keys and the shares that refer to them
+func forEachMigrationRecord(getProvider func() Provider, batchSize int,
+	fn func(kind, name string, record interface{}) error) error {
+	admins, err := getProvider().dumpAdmins()
+	if err != nil {
+		return fmt.Errorf("unable to read the admins: %v", err)
+	}
+	for _, admin := range admins {
+		if err = fn(migrationKindAdmin, admin.Username, admin); err != nil {
+			return err
+		}
+	}
+	for offset := 0; ; offset += batchSize {
+		keys, err := getProvider().getAPIKeys(batchSize, offset, "ASC", "")
+		if err != nil {
+			return fmt.Errorf("unable to read the API keys: %v", err)
+		}
+		for _, k := range keys {
+			key, err := getProvider().apiKeyExists(k.KeyID)
+			if err != nil {
+				return fmt.Errorf("unable to read the API key %#v: %v", k.KeyID, err)
+			}
+			if err = fn(migrationKindAPIKey, key.KeyID, key); err != nil {
+				return err
+			}
+		}
+		if len(keys) < batchSize {
+			break
+		}
+	}
+	for offset := 0; ; offset += batchSize {
+		shares, err := getProvider().getShares(batchSize, offset, "ASC", "")
+		if err != nil {
+			return fmt.Errorf("unable to read the shares: %v", err)
+		}
+		for _, s := range shares {
+			share, err := getProvider().getShareByID(s.ShareID)
+			if err != nil {
+				return fmt.Errorf("unable to read the share %#v: %v", s.ShareID, err)
+			}
+			if err = fn(migrationKindShare, share.ShareID, share); err != nil {
+				return err
+			}
+		}
+		if len(shares) < batchSize {
+			break
+		}
+	}
+	for offset := 0; ; offset += batchSize {
+		bans, err := getProvider().getBannedIPs(batchSize, offset, "ASC")
+		if err != nil {
+			return fmt.Errorf("unable to read the banned IPs: %v", err)
+		}
+		for _, ban := range bans {
+			if err = fn(migrationKindBannedIP, ban.IP, ban); err != nil {
+				return err
+			}
+		}
+		if len(bans) < batchSize {
+			break
+		}
+	}
+	return nil
+}
+
+// migrateRecord adds the given record to the data provider returned by getProvider,
+// or only validates it for a dry run
+func migrateRecord(getProvider func() Provider, record interface{}, dryRun bool) error {
+	switch r := record.(type) {
+	case Admin:
+		if dryRun {
+			return validateAdmin(&r)
+		}
+		return getProvider().addAdmin(r)
+	case APIKey:
+		if dryRun {
+			return validateAPIKey(&r)
+		}
+		return getProvider().addAPIKey(r)
+	case Share:
+		if dryRun {
+			return validateShare(&r)
+		}
+		return getProvider().addShare(r)
+	case BannedIP:
+		if dryRun {
+			return validateBannedIP(&r)
+		}
+		return getProvider().addBannedIP(r)
+	}
+	return fmt.Errorf("unsupported record type %T", record)
+}
+
+func verifyMigration(dst *providerState, sourceDigests map[string]string, numGroups, batchSize int,
+	result *MigrationResult) error {
+	groups, err := dst.activate().dumpGroups()
+	if err != nil {
+		return fmt.Errorf("unable to read the migrated groups: %v", err)
+	}
+	if len(groups) != numGroups {
+		return fmt.Errorf("groups count mismatch, source: %v destination: %v", numGroups, len(groups))
+	}
+	destinationDigests := make(map[string]string)
+	err = dst.forEachUser(batchSize, func(user User) error {
+		digest, err := getUserDigest(user)
+		if err != nil {
+			return err
+		}
+		destinationDigests[user.Username] = digest
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read the migrated users: %v", err)
+	}
+	result.DestinationChecksum = getDigestsChecksum(destinationDigests)
+	if len(destinationDigests) != len(sourceDigests) {
+		return fmt.Errorf("users count mismatch, source: %v destination: %v", len(sourceDigests), len(destinationDigests))
+	}
+	for username, digest := range sourceDigests {
+		if destinationDigests[username] != digest {
+			return fmt.Errorf("checksum mismatch for user %#v", username)
+		}
+	}
+	if result.DestinationChecksum != result.SourceChecksum {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+// verifyMigratedRecords reads back the admins, the API keys, the shares and the banned IPs from the
+// destination data provider and compares them with the source ones
+func verifyMigratedRecords(dst *providerState, sourceRecords map[string]string, batchSize int) error {
+	destinationRecords := make(map[string]string)
+	err := forEachMigrationRecord(dst.activate, batchSize, func(kind, name string, record interface{}) error {
+		digest, err := getRecordDigest(record)
+		if err != nil {
+			return err
+		}
+		destinationRecords[kind+"/"+name] = digest
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read the migrated data: %v", err)
+	}
+	if len(destinationRecords) != len(sourceRecords) {
+		return fmt.Errorf("admins, API keys, shares and banned IPs count mismatch, source: %v destination: %v",
+			len(sourceRecords), len(destinationRecords))
+	}
+	for name, digest := range sourceRecords {
+		if destinationRecords[name] != digest {
+			return fmt.Errorf("checksum mismatch for %v", name)
+		}
+	}
+	return nil
+}
+
+// getUserDigest returns a digest for the given user that does not depend on the data provider:
+// empty values are removed from the JSON representation before computing the digest so, for
+// example, a nil slice and an empty one produce the same digest
+func getUserDigest(user User) (string, error) {
+	// the secrets are re-encrypted if the source uses the legacy format or a previous master key,
+	// so the digest is computed on their plain text
+	if err := decryptUserSecrets(&user); err != nil {
+		return "", err
+	}
+	return getJSONDigest(user, false)
+}
+
+// getRecordDigest returns a digest for an admin, an API key, a share or a banned IP.
+// The database identifiers are not preserved so they are not included
+func getRecordDigest(record interface{}) (string, error) {
+	return getJSONDigest(record, true)
+}
+
+func getJSONDigest(record interface{}, ignoreID bool) (string, error) {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	var v interface{}
+	if err = json.Unmarshal(buf, &v); err != nil {
+		return "", err
+	}
+	if m, ok := v.(map[string]interface{}); ok && ignoreID {
+		delete(m, "id")
+	}
+	buf, err = json.Marshal(removeEmptyJSONValues(v))
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(buf)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+func removeEmptyJSONValues(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			item = removeEmptyJSONValues(item)
+			if isEmptyJSONValue(item) {
+				delete(val, k)
+			} else {
+				val[k] = item
+			}
+		}
+		return val
+	case []interface{}:
+		for idx, item := range val {
+			val[idx] = removeEmptyJSONValues(item)
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+func isEmptyJSONValue(v interface{}) bool {
+	switch val := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !val
+	case float64:
+		return val == 0
+	case string:
+		return val == ""
+	case []interface{}:
+		return len(val) == 0
+	case map[string]interface{}:
+		return len(val) == 0
+	}
+	return false
+}
+
+// getDigestsChecksum returns a checksum for the given user digests, it does not depend
+// on the order used by the data providers to return the users
+func getDigestsChecksum(digests map[string]string) string {
+	usernames := make([]string, 0, len(digests))
+	for username := range digests {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	h := sha256.New()
+	for _, username := range usernames {
+		h.Write([]byte(username))          //nolint:errcheck
+		h.Write([]byte{0})                 //nolint:errcheck
+		h.Write([]byte(digests[username])) //nolint:errcheck
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
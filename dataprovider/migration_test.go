@@ -0,0 +1,246 @@
+package dataprovider
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMigrateProvider(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "migrate_provider")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(basePath)
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("unable to start redis server: %v", err)
+	}
+	defer server.Close()
+	port, _ := strconv.Atoi(server.Port())
+	source := Config{
+		Driver:          BoltDataProviderName,
+		Name:            "sftpgo.db",
+		CredentialsPath: "credentials",
+	}
+	destination := Config{
+		Driver:          RedisDataProviderName,
+		Host:            server.Host(),
+		Port:            port,
+		CredentialsPath: "credentials",
+	}
+	// populate the source provider, the first user is deleted so the IDs are not contiguous
+	state := saveProviderState()
+	src, err := openMigrationProvider(source, basePath, true)
+	if err != nil {
+		t.Fatalf("unable to open source provider: %v", err)
+	}
+	p := src.activate()
+	if err = p.addGroup(Group{Name: "group1"}); err != nil {
+		t.Errorf("unable to add group: %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		user := getRedisTestUser(fmt.Sprintf("migrate_user%v", i))
+		user.Groups = []UserGroup{{Name: "group1", Type: GroupTypePrimary}}
+		if err = p.addUser(user); err != nil {
+			t.Errorf("unable to add user: %v", err)
+		}
+		if err = p.updateQuota(user.Username, i, int64(i*100), false); err != nil {
+			t.Errorf("unable to update quota: %v", err)
+		}
+		if err = p.updateLastLogin(user.Username); err != nil {
+			t.Errorf("unable to update last login: %v", err)
+		}
+	}
+	deletedUser, err := p.userExists("migrate_user0")
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if err = p.deleteUser(deletedUser); err != nil {
+		t.Errorf("unable to delete user: %v", err)
+	}
+	sourceUser, err := p.userExists("migrate_user3")
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	sourceAdmin := Admin{
+		Username:    "migrate_admin",
+		Password:    "password",
+		Status:      1,
+		Permissions: []string{PermAdminAny},
+	}
+	if err = p.addAdmin(sourceAdmin); err != nil {
+		t.Errorf("unable to add admin: %v", err)
+	}
+	sourceKey := APIKey{
+		KeyID:       "migrate_key_id",
+		Name:        "migrate key",
+		Key:         hashAPIKeySecret("secret"),
+		Admin:       sourceAdmin.Username,
+		Permissions: []string{PermAdminAny},
+		CreatedAt:   1000,
+		LastUseAt:   2000,
+	}
+	if err = p.addAPIKey(sourceKey); err != nil {
+		t.Errorf("unable to add API key: %v", err)
+	}
+	sourceShare := Share{
+		ShareID:    "migrate_share_id",
+		Username:   sourceUser.Username,
+		Path:       "/",
+		Scope:      ShareScopeRead,
+		Password:   "share password",
+		MaxTokens:  5,
+		UsedTokens: 3,
+		CreatedAt:  1000,
+		LastUseAt:  3000,
+	}
+	if err = p.addShare(sourceShare); err != nil {
+		t.Errorf("unable to add share: %v", err)
+	}
+	if err = p.addBannedIP(BannedIP{IP: "192.168.1.1", BannedUntil: 4000, BanCount: 2}); err != nil {
+		t.Errorf("unable to add banned IP: %v", err)
+	}
+	sourceShare, err = p.getShareByID(sourceShare.ShareID)
+	if err != nil {
+		t.Errorf("unable to get share: %v", err)
+	}
+	src.close()
+	state.activate()
+
+	result, err := MigrateProvider(source, destination, basePath, MigrationOptions{BatchSize: 4, DryRun: true})
+	if err != nil {
+		t.Errorf("dry run failed: %v", err)
+	}
+	if result.Users != 6 || result.Groups != 1 || result.Admins != 1 || result.APIKeys != 1 || result.Shares != 1 ||
+		result.BannedIPs != 1 || len(result.SourceChecksum) == 0 || len(result.DestinationChecksum) > 0 {
+		t.Errorf("unexpected dry run result: %+v", result)
+	}
+	if len(server.Keys()) > 0 {
+		t.Errorf("dry run must not modify the destination, keys: %v", server.Keys())
+	}
+	result, err = MigrateProvider(source, destination, basePath, MigrationOptions{BatchSize: 4})
+	if err != nil {
+		t.Errorf("migration failed: %v", err)
+	}
+	if result.Users != 6 || result.Groups != 1 || result.Admins != 1 || result.APIKeys != 1 || result.Shares != 1 ||
+		result.BannedIPs != 1 || result.SourceChecksum != result.DestinationChecksum {
+		t.Errorf("unexpected migration result: %+v", result)
+	}
+	if GetProvider() != state.p {
+		t.Error("the package level provider must be restored after a migration")
+	}
+	_, err = MigrateProvider(source, destination, basePath, MigrationOptions{})
+	if err == nil {
+		t.Error("migrating to a not empty destination must fail")
+	}
+
+	dst, err := openMigrationProvider(destination, basePath, true)
+	if err != nil {
+		t.Fatalf("unable to open destination provider: %v", err)
+	}
+	defer state.activate()
+	p = dst.activate()
+	user, err := p.userExists(sourceUser.Username)
+	if err != nil {
+		t.Errorf("unable to get migrated user: %v", err)
+	}
+	if user.ID != sourceUser.ID || user.UsedQuotaFiles != 3 || user.UsedQuotaSize != 300 ||
+		user.LastLogin != sourceUser.LastLogin || user.LastQuotaUpdate != sourceUser.LastQuotaUpdate ||
+		user.Password != sourceUser.Password || len(user.Groups) != 1 {
+		t.Errorf("unexpected migrated user: %+v, source: %+v", user, sourceUser)
+	}
+	admin, err := p.adminExists(sourceAdmin.Username)
+	if err != nil || admin.Password == sourceAdmin.Password || len(admin.Password) == 0 {
+		t.Errorf("unexpected migrated admin: %+v, err: %v", admin, err)
+	}
+	key, err := p.apiKeyExists(sourceKey.KeyID)
+	if err != nil || key.Key != sourceKey.Key || key.LastUseAt != sourceKey.LastUseAt || key.CreatedAt != sourceKey.CreatedAt {
+		t.Errorf("unexpected migrated API key: %+v, err: %v", key, err)
+	}
+	share, err := p.getShareByID(sourceShare.ShareID)
+	if err != nil || share.Password != sourceShare.Password || share.UsedTokens != sourceShare.UsedTokens ||
+		share.LastUseAt != sourceShare.LastUseAt {
+		t.Errorf("unexpected migrated share: %+v, source: %+v, err: %v", share, sourceShare, err)
+	}
+	if _, err = p.bannedIPExists("192.168.1.1"); err != nil {
+		t.Errorf("unable to get migrated banned IP: %v", err)
+	}
+	if _, err = p.getUserByID(deletedUser.ID); err == nil {
+		t.Error("the deleted user ID must not be migrated")
+	}
+	// new users must not reuse the migrated IDs
+	newUser := getRedisTestUser("migrate_new_user")
+	if err = p.addUser(newUser); err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	newUser, err = p.userExists(newUser.Username)
+	if err != nil || newUser.ID <= 7 {
+		t.Errorf("unexpected ID for a new user: %v, err: %v", newUser.ID, err)
+	}
+	dst.close()
+
+	// the migrated users can be migrated again to a SQL database
+	sqliteConf := Config{
+		Driver:          SQLiteDataProviderName,
+		Name:            "sftpgo_migrate.db",
+		CredentialsPath: "credentials",
+		UsersTable:      "users",
+	}
+	sqlite, err := openMigrationProvider(sqliteConf, basePath, false)
+	if err != nil {
+		t.Fatalf("unable to open sqlite provider: %v", err)
+	}
+	err = sqlite.activate().initializeDatabase()
+	sqlite.close()
+	if err != nil {
+		t.Fatalf("unable to initialize sqlite provider: %v", err)
+	}
+	result, err = MigrateProvider(destination, sqliteConf, basePath, MigrationOptions{BatchSize: 5})
+	if err != nil {
+		t.Errorf("migration failed: %v", err)
+	}
+	if result.Users != 7 || result.Groups != 1 || result.Shares != 1 || result.APIKeys != 1 ||
+		result.SourceChecksum != result.DestinationChecksum {
+		t.Errorf("unexpected migration result: %+v", result)
+	}
+	sqlite, err = openMigrationProvider(sqliteConf, basePath, false)
+	if err != nil {
+		t.Fatalf("unable to open sqlite provider: %v", err)
+	}
+	p = sqlite.activate()
+	share, err = p.getShareByID(sourceShare.ShareID)
+	if err != nil || share.UsedTokens != sourceShare.UsedTokens || share.LastUseAt != sourceShare.LastUseAt {
+		t.Errorf("unexpected migrated share: %+v, err: %v", share, err)
+	}
+	key, err = p.apiKeyExists(sourceKey.KeyID)
+	if err != nil || key.LastUseAt != sourceKey.LastUseAt {
+		t.Errorf("unexpected migrated API key: %+v, err: %v", key, err)
+	}
+	sqlite.close()
+
+	// a destination containing only a banned IP is not empty
+	boltConf := Config{
+		Driver:          BoltDataProviderName,
+		Name:            "sftpgo_bans.db",
+		CredentialsPath: "credentials",
+	}
+	boltState, err := openMigrationProvider(boltConf, basePath, true)
+	if err != nil {
+		t.Fatalf("unable to open bolt provider: %v", err)
+	}
+	err = boltState.activate().addBannedIP(BannedIP{IP: "192.168.1.2", BannedUntil: 4000, BanCount: 1})
+	boltState.close()
+	if err != nil {
+		t.Errorf("unable to add banned IP: %v", err)
+	}
+	_, err = MigrateProvider(source, boltConf, basePath, MigrationOptions{DryRun: true})
+	if err == nil {
+		t.Error("migrating to a destination with banned IPs must fail")
+	}
+}
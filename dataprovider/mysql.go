@@ -20,6 +20,26 @@ const (
 		"`filesystem` longtext DEFAULT NULL);"
 	mysqlSchemaTableSQL = "CREATE TABLE `schema_version` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, `version` integer NOT NULL);"
 	mysqlUsersV2SQL     = "ALTER TABLE `{{users}}` ADD COLUMN `virtual_folders` longtext NULL;"
+	mysqlSharesV3SQL    = "CREATE TABLE `shares` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`share_id` varchar(64) NOT NULL UNIQUE, `description` varchar(255) NULL, `username` varchar(255) NOT NULL, " +
+		"`path` longtext NOT NULL, `scope` integer NOT NULL, `password` varchar(255) NULL, `expires_at` bigint(20) NOT NULL, " +
+		"`max_tokens` integer NOT NULL, `used_tokens` integer NOT NULL, `created_at` bigint(20) NOT NULL, " +
+		"`last_use_at` bigint(20) NOT NULL, INDEX `shares_username_idx` (`username`));"
+	mysqlAdminsV4SQL = "CREATE TABLE `admins` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`username` varchar(255) NOT NULL UNIQUE, `password` varchar(255) NOT NULL, `status` integer NOT NULL, " +
+		"`email` varchar(255) NULL, `permissions` longtext NOT NULL, `description` varchar(512) NULL);"
+	mysqlAPIKeysV5SQL = "CREATE TABLE `api_keys` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`key_id` varchar(64) NOT NULL UNIQUE, `name` varchar(255) NOT NULL, `api_key` varchar(255) NOT NULL, " +
+		"`admin` varchar(255) NOT NULL, `permissions` longtext NOT NULL, `description` varchar(512) NULL, " +
+		"`expires_at` bigint(20) NOT NULL, `created_at` bigint(20) NOT NULL, `last_use_at` bigint(20) NOT NULL, " +
+		"INDEX `api_keys_admin_idx` (`admin`));"
+	mysqlGroupsV6SQL = "CREATE TABLE `user_groups` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`name` varchar(255) NOT NULL UNIQUE, `description` varchar(512) NULL, `user_settings` longtext NOT NULL);"
+	mysqlUsersV6SQL     = "ALTER TABLE `{{users}}` ADD COLUMN `group_memberships` longtext NULL;"
+	mysqlBannedIPsV7SQL = "CREATE TABLE `banned_ips` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`ip` varchar(50) NOT NULL UNIQUE, `banned_until` bigint NOT NULL, `ban_count` integer NOT NULL);"
+	mysqlUsersV8SQL = "ALTER TABLE `{{users}}` ADD COLUMN `totp_config` longtext NULL;"
+	mysqlUsersV9SQL = "ALTER TABLE `{{users}}` ADD COLUMN `folders_quota` longtext NULL;"
 )
 
 // MySQLProvider auth provider for MySQL/MariaDB database
@@ -82,10 +102,22 @@ func (p MySQLProvider) updateLastLogin(username string) error {
 	return sqlCommonUpdateLastLogin(username, p.dbHandle)
 }
 
+func (p MySQLProvider) useTOTPRecoveryCode(username, hash string) error {
+	return sqlCommonUseTOTPRecoveryCode(username, hash, p.dbHandle)
+}
+
 func (p MySQLProvider) getUsedQuota(username string) (int, int64, error) {
 	return sqlCommonGetUsedQuota(username, p.dbHandle)
 }
 
+func (p MySQLProvider) updateFolderQuota(username, virtualPath string, filesAdd int, sizeAdd int64, reset bool) error {
+	return sqlCommonUpdateFolderQuota(username, virtualPath, filesAdd, sizeAdd, reset, p.dbHandle)
+}
+
+func (p MySQLProvider) getUsedFolderQuota(username, virtualPath string) (int, int64, error) {
+	return sqlCommonGetUsedFolderQuota(username, virtualPath, p.dbHandle)
+}
+
 func (p MySQLProvider) userExists(username string) (User, error) {
 	return sqlCommonCheckUserExists(username, p.dbHandle)
 }
@@ -94,6 +126,10 @@ func (p MySQLProvider) addUser(user User) error {
 	return sqlCommonAddUser(user, p.dbHandle)
 }
 
+func (p MySQLProvider) restoreUser(user User) error {
+	return sqlCommonRestoreUser(user, p.dbHandle)
+}
+
 func (p MySQLProvider) updateUser(user User) error {
 	return sqlCommonUpdateUser(user, p.dbHandle)
 }
@@ -110,6 +146,122 @@ func (p MySQLProvider) getUsers(limit int, offset int, order string, username st
 	return sqlCommonGetUsers(limit, offset, order, username, p.dbHandle)
 }
 
+func (p MySQLProvider) addShare(share Share) error {
+	return sqlCommonAddShare(share, p.dbHandle)
+}
+
+func (p MySQLProvider) updateShare(share Share) error {
+	return sqlCommonUpdateShare(share, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteShare(share Share) error {
+	return sqlCommonDeleteShare(share, p.dbHandle)
+}
+
+func (p MySQLProvider) getShareByID(shareID string) (Share, error) {
+	return sqlCommonGetShareByID(shareID, p.dbHandle)
+}
+
+func (p MySQLProvider) getShares(limit int, offset int, order string, username string) ([]Share, error) {
+	return sqlCommonGetShares(limit, offset, order, username, p.dbHandle)
+}
+
+func (p MySQLProvider) updateShareUsage(shareID string, numTokens int) error {
+	return sqlCommonUpdateShareUsage(shareID, numTokens, p.dbHandle)
+}
+
+func (p MySQLProvider) adminExists(username string) (Admin, error) {
+	return sqlCommonGetAdminByUsername(username, p.dbHandle)
+}
+
+func (p MySQLProvider) addAdmin(admin Admin) error {
+	return sqlCommonAddAdmin(admin, p.dbHandle)
+}
+
+func (p MySQLProvider) updateAdmin(admin Admin) error {
+	return sqlCommonUpdateAdmin(admin, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteAdmin(admin Admin) error {
+	return sqlCommonDeleteAdmin(admin, p.dbHandle)
+}
+
+func (p MySQLProvider) getAdmins(limit int, offset int, order string) ([]Admin, error) {
+	return sqlCommonGetAdmins(limit, offset, order, p.dbHandle)
+}
+
+func (p MySQLProvider) dumpAdmins() ([]Admin, error) {
+	return sqlCommonDumpAdmins(p.dbHandle)
+}
+
+func (p MySQLProvider) apiKeyExists(keyID string) (APIKey, error) {
+	return sqlCommonGetAPIKeyByID(keyID, p.dbHandle)
+}
+
+func (p MySQLProvider) addAPIKey(key APIKey) error {
+	return sqlCommonAddAPIKey(key, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteAPIKey(key APIKey) error {
+	return sqlCommonDeleteAPIKey(key, p.dbHandle)
+}
+
+func (p MySQLProvider) getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error) {
+	return sqlCommonGetAPIKeys(limit, offset, order, admin, p.dbHandle)
+}
+
+func (p MySQLProvider) updateAPIKeyLastUse(keyID string) error {
+	return sqlCommonUpdateAPIKeyLastUse(keyID, p.dbHandle)
+}
+
+func (p MySQLProvider) groupExists(name string) (Group, error) {
+	return sqlCommonGetGroupByName(name, p.dbHandle)
+}
+
+func (p MySQLProvider) addGroup(group Group) error {
+	return sqlCommonAddGroup(group, p.dbHandle)
+}
+
+func (p MySQLProvider) updateGroup(group Group) error {
+	return sqlCommonUpdateGroup(group, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteGroup(group Group) error {
+	return sqlCommonDeleteGroup(group, p.dbHandle)
+}
+
+func (p MySQLProvider) getGroups(limit int, offset int, order string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, p.dbHandle)
+}
+
+func (p MySQLProvider) dumpGroups() ([]Group, error) {
+	return sqlCommonDumpGroups(p.dbHandle)
+}
+
+func (p MySQLProvider) bannedIPExists(ip string) (BannedIP, error) {
+	return sqlCommonGetBannedIP(ip, p.dbHandle)
+}
+
+func (p MySQLProvider) addBannedIP(ban BannedIP) error {
+	return sqlCommonAddBannedIP(ban, p.dbHandle)
+}
+
+func (p MySQLProvider) updateBannedIP(ban BannedIP) error {
+	return sqlCommonUpdateBannedIP(ban, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteBannedIP(ban BannedIP) error {
+	return sqlCommonDeleteBannedIP(ban, p.dbHandle)
+}
+
+func (p MySQLProvider) getBannedIPs(limit int, offset int, order string) ([]BannedIP, error) {
+	return sqlCommonGetBannedIPs(limit, offset, order, p.dbHandle)
+}
+
+func (p MySQLProvider) cleanupBannedIPs(before int64) error {
+	return sqlCommonCleanupBannedIPs(before, p.dbHandle)
+}
+
 func (p MySQLProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -152,8 +304,51 @@ func (p MySQLProvider) migrateDatabase() error {
 		providerLog(logger.LevelDebug, "sql database is updated, current version: %v", dbVersion.Version)
 		return nil
 	}
-	if dbVersion.Version == 1 {
-		return updateMySQLDatabaseFrom1To2(p.dbHandle)
+	switch dbVersion.Version {
+	case 1:
+		err = updateMySQLDatabaseFrom1To2(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 2:
+		err = updateMySQLDatabaseFrom2To3(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 3:
+		err = updateMySQLDatabaseFrom3To4(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 4:
+		err = updateMySQLDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 5:
+		err = updateMySQLDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 6:
+		err = updateMySQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 7:
+		err = updateMySQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 8:
+		return updateMySQLDatabaseFrom8To9(p.dbHandle)
 	}
 	return nil
 }
@@ -177,3 +372,144 @@ func updateMySQLDatabaseFrom1To2(dbHandle *sql.DB) error {
 	}
 	return tx.Commit()
 }
+
+func updateMySQLDatabaseFrom2To3(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 2 -> 3")
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(mysqlSharesV3SQL)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 3)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateMySQLDatabaseFrom3To4(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 3 -> 4")
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(mysqlAdminsV4SQL)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 4)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateMySQLDatabaseFrom4To5(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 4 -> 5")
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(mysqlAPIKeysV5SQL)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 5)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateMySQLDatabaseFrom5To6(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 5 -> 6")
+	sql := strings.Replace(mysqlUsersV6SQL, "{{users}}", config.UsersTable, 1)
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(mysqlGroupsV6SQL)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(sql)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 6)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateMySQLDatabaseFrom6To7(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 6 -> 7")
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(mysqlBannedIPsV7SQL)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 7)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateMySQLDatabaseFrom7To8(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	sql := strings.Replace(mysqlUsersV8SQL, "{{users}}", config.UsersTable, 1)
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sql)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 8)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateMySQLDatabaseFrom8To9(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 8 -> 9")
+	sql := strings.Replace(mysqlUsersV9SQL, "{{users}}", config.UsersTable, 1)
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sql)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 9)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -1,9 +1,14 @@
 package dataprovider
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 
 	"github.com/drakkan/sftpgo/logger"
 )
@@ -18,6 +23,27 @@ const (
 "filesystem" text NULL);`
 	pgsqlSchemaTableSQL = `CREATE TABLE "schema_version" ("id" serial NOT NULL PRIMARY KEY, "version" integer NOT NULL);`
 	pgsqlUsersV2SQL     = `ALTER TABLE "{{users}}" ADD COLUMN "virtual_folders" text NULL;`
+	pgsqlSharesV3SQL    = `CREATE TABLE "shares" ("id" serial NOT NULL PRIMARY KEY, "share_id" varchar(64) NOT NULL UNIQUE,
+"description" varchar(255) NULL, "username" varchar(255) NOT NULL, "path" text NOT NULL, "scope" integer NOT NULL,
+"password" varchar(255) NULL, "expires_at" bigint NOT NULL, "max_tokens" integer NOT NULL, "used_tokens" integer NOT NULL,
+"created_at" bigint NOT NULL, "last_use_at" bigint NOT NULL);
+CREATE INDEX "shares_username_idx" ON "shares" ("username");`
+	pgsqlAdminsV4SQL = `CREATE TABLE "admins" ("id" serial NOT NULL PRIMARY KEY, "username" varchar(255) NOT NULL UNIQUE,
+"password" varchar(255) NOT NULL, "status" integer NOT NULL, "email" varchar(255) NULL, "permissions" text NOT NULL,
+"description" varchar(512) NULL);`
+	pgsqlAPIKeysV5SQL = `CREATE TABLE "api_keys" ("id" serial NOT NULL PRIMARY KEY, "key_id" varchar(64) NOT NULL UNIQUE,
+"name" varchar(255) NOT NULL, "api_key" varchar(255) NOT NULL, "admin" varchar(255) NOT NULL, "permissions" text NOT NULL,
+"description" varchar(512) NULL, "expires_at" bigint NOT NULL, "created_at" bigint NOT NULL, "last_use_at" bigint NOT NULL);
+CREATE INDEX "api_keys_admin_idx" ON "api_keys" ("admin");`
+	pgsqlGroupsV6SQL = `CREATE TABLE "user_groups" ("id" serial NOT NULL PRIMARY KEY, "name" varchar(255) NOT NULL UNIQUE,
+"description" varchar(512) NULL, "user_settings" text NOT NULL);
+ALTER TABLE "{{users}}" ADD COLUMN "group_memberships" text NULL;`
+	pgsqlBannedIPsV7SQL = `CREATE TABLE "banned_ips" ("id" serial NOT NULL PRIMARY KEY, "ip" varchar(50) NOT NULL UNIQUE,
+"banned_until" bigint NOT NULL, "ban_count" integer NOT NULL);`
+	pgsqlUsersV8SQL = `ALTER TABLE "{{users}}" ADD COLUMN "totp_config" text NULL;`
+	pgsqlUsersV9SQL = `ALTER TABLE "{{users}}" ADD COLUMN "folders_quota" text NULL;`
+	// channel used to notify the user changes to the other instances with the users cache enabled
+	pgsqlUsersCacheChannel = "sftpgo_users_cache"
 )
 
 // PGSQLProvider auth provider for PostgreSQL database
@@ -56,6 +82,37 @@ func getPGSQLConnectionString(redactedPwd bool) string {
 	return connectionString
 }
 
+func (p PGSQLProvider) notifyUserChange(username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := p.dbHandle.ExecContext(ctx, "SELECT pg_notify($1, $2)", pgsqlUsersCacheChannel, username)
+	return err
+}
+
+func (p PGSQLProvider) listenUserChanges(onChange func(username string)) (io.Closer, error) {
+	listener := pq.NewListener(getPGSQLConnectionString(false), 10*time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				providerLog(logger.LevelWarn, "users cache listener event: %v, error: %v", event, err)
+			}
+		})
+	if err := listener.Listen(pgsqlUsersCacheChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	go func() {
+		for n := range listener.Notify {
+			if n == nil {
+				// the connection was reestablished, notifications could be lost
+				onChange("")
+				continue
+			}
+			onChange(n.Extra)
+		}
+	}()
+	return listener, nil
+}
+
 func (p PGSQLProvider) checkAvailability() error {
 	return sqlCommonCheckAvailability(p.dbHandle)
 }
@@ -80,10 +137,22 @@ func (p PGSQLProvider) updateLastLogin(username string) error {
 	return sqlCommonUpdateLastLogin(username, p.dbHandle)
 }
 
+func (p PGSQLProvider) useTOTPRecoveryCode(username, hash string) error {
+	return sqlCommonUseTOTPRecoveryCode(username, hash, p.dbHandle)
+}
+
 func (p PGSQLProvider) getUsedQuota(username string) (int, int64, error) {
 	return sqlCommonGetUsedQuota(username, p.dbHandle)
 }
 
+func (p PGSQLProvider) updateFolderQuota(username, virtualPath string, filesAdd int, sizeAdd int64, reset bool) error {
+	return sqlCommonUpdateFolderQuota(username, virtualPath, filesAdd, sizeAdd, reset, p.dbHandle)
+}
+
+func (p PGSQLProvider) getUsedFolderQuota(username, virtualPath string) (int, int64, error) {
+	return sqlCommonGetUsedFolderQuota(username, virtualPath, p.dbHandle)
+}
+
 func (p PGSQLProvider) userExists(username string) (User, error) {
 	return sqlCommonCheckUserExists(username, p.dbHandle)
 }
@@ -92,6 +161,17 @@ func (p PGSQLProvider) addUser(user User) error {
 	return sqlCommonAddUser(user, p.dbHandle)
 }
 
+func (p PGSQLProvider) restoreUser(user User) error {
+	if err := sqlCommonRestoreUser(user, p.dbHandle); err != nil {
+		return err
+	}
+	// the serial sequence is not updated for explicit IDs
+	q := fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('"%v"', 'id'), (SELECT MAX(id) FROM "%v"))`,
+		config.UsersTable, config.UsersTable)
+	_, err := p.dbHandle.Exec(q)
+	return err
+}
+
 func (p PGSQLProvider) updateUser(user User) error {
 	return sqlCommonUpdateUser(user, p.dbHandle)
 }
@@ -108,6 +188,122 @@ func (p PGSQLProvider) getUsers(limit int, offset int, order string, username st
 	return sqlCommonGetUsers(limit, offset, order, username, p.dbHandle)
 }
 
+func (p PGSQLProvider) addShare(share Share) error {
+	return sqlCommonAddShare(share, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateShare(share Share) error {
+	return sqlCommonUpdateShare(share, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteShare(share Share) error {
+	return sqlCommonDeleteShare(share, p.dbHandle)
+}
+
+func (p PGSQLProvider) getShareByID(shareID string) (Share, error) {
+	return sqlCommonGetShareByID(shareID, p.dbHandle)
+}
+
+func (p PGSQLProvider) getShares(limit int, offset int, order string, username string) ([]Share, error) {
+	return sqlCommonGetShares(limit, offset, order, username, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateShareUsage(shareID string, numTokens int) error {
+	return sqlCommonUpdateShareUsage(shareID, numTokens, p.dbHandle)
+}
+
+func (p PGSQLProvider) adminExists(username string) (Admin, error) {
+	return sqlCommonGetAdminByUsername(username, p.dbHandle)
+}
+
+func (p PGSQLProvider) addAdmin(admin Admin) error {
+	return sqlCommonAddAdmin(admin, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateAdmin(admin Admin) error {
+	return sqlCommonUpdateAdmin(admin, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteAdmin(admin Admin) error {
+	return sqlCommonDeleteAdmin(admin, p.dbHandle)
+}
+
+func (p PGSQLProvider) getAdmins(limit int, offset int, order string) ([]Admin, error) {
+	return sqlCommonGetAdmins(limit, offset, order, p.dbHandle)
+}
+
+func (p PGSQLProvider) dumpAdmins() ([]Admin, error) {
+	return sqlCommonDumpAdmins(p.dbHandle)
+}
+
+func (p PGSQLProvider) apiKeyExists(keyID string) (APIKey, error) {
+	return sqlCommonGetAPIKeyByID(keyID, p.dbHandle)
+}
+
+func (p PGSQLProvider) addAPIKey(key APIKey) error {
+	return sqlCommonAddAPIKey(key, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteAPIKey(key APIKey) error {
+	return sqlCommonDeleteAPIKey(key, p.dbHandle)
+}
+
+func (p PGSQLProvider) getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error) {
+	return sqlCommonGetAPIKeys(limit, offset, order, admin, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateAPIKeyLastUse(keyID string) error {
+	return sqlCommonUpdateAPIKeyLastUse(keyID, p.dbHandle)
+}
+
+func (p PGSQLProvider) groupExists(name string) (Group, error) {
+	return sqlCommonGetGroupByName(name, p.dbHandle)
+}
+
+func (p PGSQLProvider) addGroup(group Group) error {
+	return sqlCommonAddGroup(group, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateGroup(group Group) error {
+	return sqlCommonUpdateGroup(group, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteGroup(group Group) error {
+	return sqlCommonDeleteGroup(group, p.dbHandle)
+}
+
+func (p PGSQLProvider) getGroups(limit int, offset int, order string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, p.dbHandle)
+}
+
+func (p PGSQLProvider) dumpGroups() ([]Group, error) {
+	return sqlCommonDumpGroups(p.dbHandle)
+}
+
+func (p PGSQLProvider) bannedIPExists(ip string) (BannedIP, error) {
+	return sqlCommonGetBannedIP(ip, p.dbHandle)
+}
+
+func (p PGSQLProvider) addBannedIP(ban BannedIP) error {
+	return sqlCommonAddBannedIP(ban, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateBannedIP(ban BannedIP) error {
+	return sqlCommonUpdateBannedIP(ban, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteBannedIP(ban BannedIP) error {
+	return sqlCommonDeleteBannedIP(ban, p.dbHandle)
+}
+
+func (p PGSQLProvider) getBannedIPs(limit int, offset int, order string) ([]BannedIP, error) {
+	return sqlCommonGetBannedIPs(limit, offset, order, p.dbHandle)
+}
+
+func (p PGSQLProvider) cleanupBannedIPs(before int64) error {
+	return sqlCommonCleanupBannedIPs(before, p.dbHandle)
+}
+
 func (p PGSQLProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -150,8 +346,51 @@ func (p PGSQLProvider) migrateDatabase() error {
 		providerLog(logger.LevelDebug, "sql database is updated, current version: %v", dbVersion.Version)
 		return nil
 	}
-	if dbVersion.Version == 1 {
-		return updatePGSQLDatabaseFrom1To2(p.dbHandle)
+	switch dbVersion.Version {
+	case 1:
+		err = updatePGSQLDatabaseFrom1To2(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 2:
+		err = updatePGSQLDatabaseFrom2To3(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 3:
+		err = updatePGSQLDatabaseFrom3To4(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 4:
+		err = updatePGSQLDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 5:
+		err = updatePGSQLDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 6:
+		err = updatePGSQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 7:
+		err = updatePGSQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 8:
+		return updatePGSQLDatabaseFrom8To9(p.dbHandle)
 	}
 	return nil
 }
@@ -175,3 +414,139 @@ func updatePGSQLDatabaseFrom1To2(dbHandle *sql.DB) error {
 	}
 	return tx.Commit()
 }
+
+func updatePGSQLDatabaseFrom2To3(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 2 -> 3")
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(pgsqlSharesV3SQL)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 3)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updatePGSQLDatabaseFrom3To4(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 3 -> 4")
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(pgsqlAdminsV4SQL)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 4)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updatePGSQLDatabaseFrom4To5(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 4 -> 5")
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(pgsqlAPIKeysV5SQL)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 5)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updatePGSQLDatabaseFrom5To6(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 5 -> 6")
+	sql := strings.Replace(pgsqlGroupsV6SQL, "{{users}}", config.UsersTable, 1)
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sql)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 6)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updatePGSQLDatabaseFrom6To7(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 6 -> 7")
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(pgsqlBannedIPsV7SQL)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 7)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updatePGSQLDatabaseFrom7To8(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	sql := strings.Replace(pgsqlUsersV8SQL, "{{users}}", config.UsersTable, 1)
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sql)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 8)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updatePGSQLDatabaseFrom8To9(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 8 -> 9")
+	sql := strings.Replace(pgsqlUsersV9SQL, "{{users}}", config.UsersTable, 1)
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sql)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 9)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,1085 @@
+package dataprovider
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	redisDatabaseVersion = 1
+	redisKeyPrefix       = "sftpgo"
+	// maximum number of attempts for optimistic transactions failed because a watched key was modified
+	redisMaxTxAttempts = 10
+	// number of records to read for each request while iterating over all the records
+	redisScanPageSize = 100
+	// fields for the users usage hash
+	redisUsedQuotaSizeField   = "used_quota_size"
+	redisUsedQuotaFilesField  = "used_quota_files"
+	redisLastQuotaUpdateField = "last_quota_update"
+	redisLastLoginField       = "last_login"
+	// prefixes for the virtual folders usage fields, the virtual path is appended
+	redisFolderUsedQuotaSizePrefix   = "folder_used_quota_size:"
+	redisFolderUsedQuotaFilesPrefix  = "folder_used_quota_files:"
+	redisFolderLastQuotaUpdatePrefix = "folder_last_quota_update:"
+)
+
+// redisEntity defines the keys used to store a record type.
+// Records are serialized as JSON inside a hash, the names are also stored inside
+// a sorted set, all with the same score, so they are returned in lexicographical
+// order and can be efficiently paginated
+type redisEntity struct {
+	// hash with record name -> JSON serialized record
+	records string
+	// sorted set with the record names
+	index string
+	// counter used to generate the record IDs
+	sequence string
+	// description used inside the error messages
+	description string
+}
+
+func newRedisEntity(name, description string) redisEntity {
+	return redisEntity{
+		records:     fmt.Sprintf("%v:%v", redisKeyPrefix, name),
+		index:       fmt.Sprintf("%v:%v:idx", redisKeyPrefix, name),
+		sequence:    fmt.Sprintf("%v:%v:seq", redisKeyPrefix, name),
+		description: description,
+	}
+}
+
+var (
+	redisUsers     = newRedisEntity("users", "username")
+	redisShares    = newRedisEntity("shares", "share")
+	redisAdmins    = newRedisEntity("admins", "admin")
+	redisAPIKeys   = newRedisEntity("api_keys", "API key")
+	redisGroups    = newRedisEntity("groups", "group")
+	redisBannedIPs = newRedisEntity("banned_ips", "banned IP")
+	// hash with user ID -> username
+	redisUsersIDIdx        = fmt.Sprintf("%v:users:ids", redisKeyPrefix)
+	redisSchemaVersionKey  = fmt.Sprintf("%v:schema_version", redisKeyPrefix)
+	errRedisTxMaxAttempts  = errors.New("unable to complete the transaction, too many concurrent modifications")
+	errRedisRecordNotFound = errors.New("record not found")
+)
+
+// RedisProvider auth provider for Redis key/value store
+type RedisProvider struct {
+	client *redis.Client
+}
+
+func initializeRedisProvider() error {
+	logSender = RedisDataProviderName
+	options, err := getRedisOptions()
+	if err != nil {
+		providerLog(logger.LevelWarn, "invalid redis configuration: %v", err)
+		return err
+	}
+	client := redis.NewClient(options)
+	if err = client.Ping().Err(); err != nil {
+		providerLog(logger.LevelWarn, "error connecting to redis server %#v: %v", options.Addr, err)
+		client.Close()
+		return err
+	}
+	providerLog(logger.LevelDebug, "redis client created, address: %#v, db: %v, pool size: %v", options.Addr,
+		options.DB, config.PoolSize)
+	provider = RedisProvider{client: client}
+	return nil
+}
+
+func getRedisOptions() (*redis.Options, error) {
+	if len(config.ConnectionString) > 0 {
+		return redis.ParseURL(config.ConnectionString)
+	}
+	db := 0
+	if len(config.Name) > 0 {
+		var err error
+		db, err = strconv.Atoi(config.Name)
+		if err != nil || db < 0 {
+			return nil, fmt.Errorf("invalid redis database number: %#v", config.Name)
+		}
+	}
+	options := &redis.Options{
+		Addr:     net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
+		Username: config.Username,
+		Password: config.Password,
+		DB:       db,
+		PoolSize: config.PoolSize,
+	}
+	if config.SSLMode > 0 {
+		options.TLSConfig = &tls.Config{
+			ServerName:         config.Host,
+			InsecureSkipVerify: config.SSLMode == 1,
+		}
+	}
+	return options, nil
+}
+
+func getRedisUsageKey(username string) string {
+	return fmt.Sprintf("%v:users:usage:%v", redisKeyPrefix, username)
+}
+
+// watch executes fn as an optimistic transaction, it is retried if the watched keys are modified
+func (p RedisProvider) watch(fn func(*redis.Tx) error, keys ...string) error {
+	for i := 0; i < redisMaxTxAttempts; i++ {
+		err := p.client.Watch(fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errRedisTxMaxAttempts
+}
+
+func (p RedisProvider) getRecord(e redisEntity, name string, v interface{}) error {
+	buf, err := p.client.HGet(e.records, name).Bytes()
+	if err == redis.Nil {
+		return &RecordNotFoundError{err: fmt.Sprintf("%v %v does not exist", e.description, name)}
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// addRecord stores a new record, getBuf receives the generated ID and must return the serialized record.
+// additionalCmds, if not nil, can queue other commands to execute inside the same transaction
+func (p RedisProvider) addRecord(e redisEntity, name string, getBuf func(id int64) ([]byte, error),
+	additionalCmds func(pipe redis.Pipeliner, id int64)) error {
+	return p.watch(func(tx *redis.Tx) error {
+		exists, err := tx.HExists(e.records, name).Result()
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%v %v already exists", e.description, name)
+		}
+		id, err := tx.Incr(e.sequence).Result()
+		if err != nil {
+			return err
+		}
+		buf, err := getBuf(id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(e.records, name, buf)
+			pipe.ZAdd(e.index, &redis.Z{Score: 0, Member: name})
+			if additionalCmds != nil {
+				additionalCmds(pipe, id)
+			}
+			return nil
+		})
+		return err
+	}, e.records)
+}
+
+// updateRecord replaces an existing record, getBuf receives the stored record and must return
+// the serialized updated record
+func (p RedisProvider) updateRecord(e redisEntity, name string, getBuf func(old []byte) ([]byte, error)) error {
+	return p.watch(func(tx *redis.Tx) error {
+		old, err := tx.HGet(e.records, name).Bytes()
+		if err == redis.Nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("%v %v does not exist", e.description, name)}
+		}
+		if err != nil {
+			return err
+		}
+		buf, err := getBuf(old)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(e.records, name, buf)
+			return nil
+		})
+		return err
+	}, e.records)
+}
+
+// deleteRecord removes an existing record, additionalCmds, if not nil, can queue other
+// commands to execute inside the same transaction
+func (p RedisProvider) deleteRecord(e redisEntity, name string, additionalCmds func(pipe redis.Pipeliner)) error {
+	return p.watch(func(tx *redis.Tx) error {
+		exists, err := tx.HExists(e.records, name).Result()
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return &RecordNotFoundError{err: fmt.Sprintf("%v %v does not exist", e.description, name)}
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HDel(e.records, name)
+			pipe.ZRem(e.index, name)
+			if additionalCmds != nil {
+				additionalCmds(pipe)
+			}
+			return nil
+		})
+		return err
+	}, e.records)
+}
+
+// getRecordsPage returns the serialized records, respecting limit and offset, ordered by name
+func (p RedisProvider) getRecordsPage(e redisEntity, limit, offset int, order string) ([]string, []string, error) {
+	start := int64(offset)
+	stop := int64(offset + limit - 1)
+	var names []string
+	var err error
+	if order == "ASC" {
+		names, err = p.client.ZRange(e.index, start, stop).Result()
+	} else {
+		names, err = p.client.ZRevRange(e.index, start, stop).Result()
+	}
+	if err != nil || len(names) == 0 {
+		return names, nil, err
+	}
+	values, err := p.client.HMGet(e.records, names...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	var foundNames, records []string
+	for idx, v := range values {
+		// the record could be removed between the two requests
+		if s, ok := v.(string); ok {
+			foundNames = append(foundNames, names[idx])
+			records = append(records, s)
+		}
+	}
+	return foundNames, records, nil
+}
+
+// scanRecords calls fn for each serialized record, ordered by name, until it returns false or an error
+func (p RedisProvider) scanRecords(e redisEntity, order string, fn func(name, record string) (bool, error)) error {
+	for offset := 0; ; offset += redisScanPageSize {
+		names, records, err := p.getRecordsPage(e, redisScanPageSize, offset, order)
+		if err != nil {
+			return err
+		}
+		for idx, record := range records {
+			next, err := fn(names[idx], record)
+			if err != nil || !next {
+				return err
+			}
+		}
+		if len(names) < redisScanPageSize {
+			return nil
+		}
+	}
+}
+
+// setUserUsage sets the quota usage and the last login fields, they are stored inside a separate
+// hash so they can be atomically updated
+func (p RedisProvider) setUserUsage(user *User, usage map[string]string) {
+	user.UsedQuotaSize, _ = strconv.ParseInt(usage[redisUsedQuotaSizeField], 10, 64)
+	user.UsedQuotaFiles, _ = strconv.Atoi(usage[redisUsedQuotaFilesField])
+	user.LastQuotaUpdate, _ = strconv.ParseInt(usage[redisLastQuotaUpdateField], 10, 64)
+	user.LastLogin, _ = strconv.ParseInt(usage[redisLastLoginField], 10, 64)
+	user.FoldersQuota = nil
+	for field, value := range usage {
+		if !strings.HasPrefix(field, redisFolderUsedQuotaSizePrefix) {
+			continue
+		}
+		virtualPath := strings.TrimPrefix(field, redisFolderUsedQuotaSizePrefix)
+		var quota VirtualFolderQuota
+		quota.UsedQuotaSize, _ = strconv.ParseInt(value, 10, 64)
+		quota.UsedQuotaFiles, _ = strconv.Atoi(usage[redisFolderUsedQuotaFilesPrefix+virtualPath])
+		quota.LastQuotaUpdate, _ = strconv.ParseInt(usage[redisFolderLastQuotaUpdatePrefix+virtualPath], 10, 64)
+		if user.FoldersQuota == nil {
+			user.FoldersQuota = make(map[string]VirtualFolderQuota)
+		}
+		user.FoldersQuota[virtualPath] = quota
+	}
+}
+
+func (p RedisProvider) loadUsersUsage(users []User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	pipe := p.client.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, 0, len(users))
+	for _, user := range users {
+		cmds = append(cmds, pipe.HGetAll(getRedisUsageKey(user.Username)))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+	for idx := range users {
+		p.setUserUsage(&users[idx], cmds[idx].Val())
+	}
+	return nil
+}
+
+// getRedisUserBuf serializes the given user without the usage fields
+func getRedisUserBuf(user User) ([]byte, error) {
+	user.UsedQuotaSize = 0
+	user.UsedQuotaFiles = 0
+	user.LastQuotaUpdate = 0
+	user.LastLogin = 0
+	user.FoldersQuota = nil
+	return json.Marshal(user)
+}
+
+func (p RedisProvider) checkAvailability() error {
+	return p.client.Ping().Err()
+}
+
+func (p RedisProvider) validateUserAndPass(username string, password string) (User, error) {
+	var user User
+	if len(password) == 0 {
+		return user, errors.New("Credentials cannot be null or empty")
+	}
+	user, err := p.userExists(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error authenticating user: %v, error: %v", username, err)
+		return user, err
+	}
+	return checkUserAndPass(user, password)
+}
+
+func (p RedisProvider) validateUserAndPubKey(username string, pubKey string) (User, string, error) {
+	var user User
+	if len(pubKey) == 0 {
+		return user, "", errors.New("Credentials cannot be null or empty")
+	}
+	user, err := p.userExists(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error authenticating user: %v, error: %v", username, err)
+		return user, "", err
+	}
+	return checkUserAndPubKey(user, pubKey)
+}
+
+func (p RedisProvider) getUserByID(ID int64) (User, error) {
+	username, err := p.client.HGet(redisUsersIDIdx, strconv.FormatInt(ID, 10)).Result()
+	if err == redis.Nil {
+		return User{}, &RecordNotFoundError{err: fmt.Sprintf("user with ID %v does not exist", ID)}
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return p.userExists(username)
+}
+
+// redisUpdateUsageScript updates the usage hash, KEYS[2], only if the user ARGV[1] exists inside
+// the users hash, KEYS[1]. The other arguments are triplets: command, HSET or HINCRBY, field and value.
+// The existence check and the update are atomic, so the users hash does not need to be watched
+var redisUpdateUsageScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+for i = 2, #ARGV, 3 do
+	redis.call(ARGV[i], KEYS[2], ARGV[i + 1], ARGV[i + 2])
+end
+return 1`)
+
+// updateUserUsage applies the given commands to the usage hash if the given user exists
+func (p RedisProvider) updateUserUsage(username string, commands ...interface{}) error {
+	args := append([]interface{}{username}, commands...)
+	updated, err := redisUpdateUsageScript.Run(p.client, []string{redisUsers.records, getRedisUsageKey(username)},
+		args...).Int()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return errRedisRecordNotFound
+	}
+	return nil
+}
+
+func (p RedisProvider) updateLastLogin(username string) error {
+	err := p.updateUserUsage(username, "HSET", redisLastLoginField, utils.GetTimeAsMsSinceEpoch(time.Now()))
+	if err == errRedisRecordNotFound {
+		return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update last login", username)}
+	}
+	return err
+}
+
+func (p RedisProvider) useTOTPRecoveryCode(username, hash string) error {
+	return p.updateRecord(redisUsers, username, func(old []byte) ([]byte, error) {
+		var user User
+		if err := json.Unmarshal(old, &user); err != nil {
+			return nil, err
+		}
+		if err := user.TOTPConfig.removeRecoveryCode(hash); err != nil {
+			return nil, err
+		}
+		return json.Marshal(user)
+	})
+}
+
+// getRedisQuotaCommands returns the commands to update the given quota fields for updateUserUsage
+func getRedisQuotaCommands(sizeField, filesField, lastUpdateField string, filesAdd int, sizeAdd int64,
+	reset bool) []interface{} {
+	command := "HINCRBY"
+	if reset {
+		command = "HSET"
+	}
+	return []interface{}{
+		command, sizeField, sizeAdd,
+		command, filesField, filesAdd,
+		"HSET", lastUpdateField, utils.GetTimeAsMsSinceEpoch(time.Now()),
+	}
+}
+
+func (p RedisProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
+	err := p.updateUserUsage(username, getRedisQuotaCommands(redisUsedQuotaSizeField, redisUsedQuotaFilesField,
+		redisLastQuotaUpdateField, filesAdd, sizeAdd, reset)...)
+	if err == errRedisRecordNotFound {
+		return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update quota", username)}
+	}
+	return err
+}
+
+func (p RedisProvider) getUsedQuota(username string) (int, int64, error) {
+	user, err := p.userExists(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get quota for user %v error: %v", username, err)
+		return 0, 0, err
+	}
+	return user.UsedQuotaFiles, user.UsedQuotaSize, err
+}
+
+func (p RedisProvider) updateFolderQuota(username, virtualPath string, filesAdd int, sizeAdd int64, reset bool) error {
+	err := p.updateUserUsage(username, getRedisQuotaCommands(redisFolderUsedQuotaSizePrefix+virtualPath,
+		redisFolderUsedQuotaFilesPrefix+virtualPath, redisFolderLastQuotaUpdatePrefix+virtualPath, filesAdd, sizeAdd,
+		reset)...)
+	if err == errRedisRecordNotFound {
+		return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update quota", username)}
+	}
+	return err
+}
+
+func (p RedisProvider) getUsedFolderQuota(username, virtualPath string) (int, int64, error) {
+	user, err := p.userExists(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get quota for user %v, virtual folder %v error: %v", username, virtualPath, err)
+		return 0, 0, err
+	}
+	files, size := user.getUsedFolderQuota(virtualPath)
+	return files, size, nil
+}
+
+func (p RedisProvider) userExists(username string) (User, error) {
+	var user User
+	pipe := p.client.Pipeline()
+	userCmd := pipe.HGet(redisUsers.records, username)
+	usageCmd := pipe.HGetAll(getRedisUsageKey(username))
+	_, err := pipe.Exec()
+	if err == redis.Nil {
+		return user, &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", username)}
+	}
+	if err != nil {
+		return user, err
+	}
+	err = json.Unmarshal([]byte(userCmd.Val()), &user)
+	if err != nil {
+		return user, err
+	}
+	p.setUserUsage(&user, usageCmd.Val())
+	return user, nil
+}
+
+func (p RedisProvider) addUser(user User) error {
+	err := validateUser(&user)
+	if err != nil {
+		return err
+	}
+	return p.addRecord(redisUsers, user.Username, func(id int64) ([]byte, error) {
+		user.ID = id
+		return getRedisUserBuf(user)
+	}, func(pipe redis.Pipeliner, id int64) {
+		pipe.HSet(redisUsersIDIdx, strconv.FormatInt(id, 10), user.Username)
+		pipe.Del(getRedisUsageKey(user.Username))
+	})
+}
+
+func (p RedisProvider) restoreUser(user User) error {
+	err := validateUser(&user)
+	if err != nil {
+		return err
+	}
+	userID := strconv.FormatInt(user.ID, 10)
+	return p.watch(func(tx *redis.Tx) error {
+		exists, err := tx.HExists(redisUsers.records, user.Username).Result()
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%v %v already exists", redisUsers.description, user.Username)
+		}
+		exists, err = tx.HExists(redisUsersIDIdx, userID).Result()
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("user ID %v already exists", user.ID)
+		}
+		sequence, err := tx.Get(redisUsers.sequence).Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		buf, err := getRedisUserBuf(user)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(redisUsers.records, user.Username, buf)
+			pipe.ZAdd(redisUsers.index, &redis.Z{Score: 0, Member: user.Username})
+			pipe.HSet(redisUsersIDIdx, userID, user.Username)
+			usage := map[string]interface{}{
+				redisUsedQuotaSizeField:   user.UsedQuotaSize,
+				redisUsedQuotaFilesField:  user.UsedQuotaFiles,
+				redisLastQuotaUpdateField: user.LastQuotaUpdate,
+				redisLastLoginField:       user.LastLogin,
+			}
+			for virtualPath, quota := range user.FoldersQuota {
+				usage[redisFolderUsedQuotaSizePrefix+virtualPath] = quota.UsedQuotaSize
+				usage[redisFolderUsedQuotaFilesPrefix+virtualPath] = quota.UsedQuotaFiles
+				usage[redisFolderLastQuotaUpdatePrefix+virtualPath] = quota.LastQuotaUpdate
+			}
+			pipe.HSet(getRedisUsageKey(user.Username), usage)
+			if user.ID > sequence {
+				pipe.Set(redisUsers.sequence, user.ID, 0)
+			}
+			return nil
+		})
+		return err
+	}, redisUsers.records, redisUsersIDIdx, redisUsers.sequence)
+}
+
+func (p RedisProvider) updateUser(user User) error {
+	err := validateUser(&user)
+	if err != nil {
+		return err
+	}
+	return p.updateRecord(redisUsers, user.Username, func(old []byte) ([]byte, error) {
+		var oldUser User
+		if err := json.Unmarshal(old, &oldUser); err != nil {
+			return nil, err
+		}
+		user.ID = oldUser.ID
+		return getRedisUserBuf(user)
+	})
+}
+
+func (p RedisProvider) deleteUser(user User) error {
+	userID := strconv.FormatInt(user.ID, 10)
+	// the user shares are read after watching the shares hash, so a share added
+	// concurrently makes the transaction fail and it is retried
+	return p.watch(func(tx *redis.Tx) error {
+		username, err := tx.HGet(redisUsersIDIdx, userID).Result()
+		if err == redis.Nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("user with id %v does not exist", user.ID)}
+		}
+		if err != nil {
+			return err
+		}
+		shareIDs, err := getRedisUserShareIDs(tx, username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HDel(redisUsers.records, username)
+			pipe.ZRem(redisUsers.index, username)
+			pipe.HDel(redisUsersIDIdx, userID)
+			pipe.Del(getRedisUsageKey(username))
+			for _, shareID := range shareIDs {
+				pipe.HDel(redisShares.records, shareID)
+				pipe.ZRem(redisShares.index, shareID)
+			}
+			return nil
+		})
+		return err
+	}, redisUsers.records, redisUsersIDIdx, redisShares.records)
+}
+
+func (p RedisProvider) dumpUsers() ([]User, error) {
+	users := []User{}
+	err := p.scanRecords(redisUsers, "ASC", func(name, record string) (bool, error) {
+		var user User
+		if err := json.Unmarshal([]byte(record), &user); err != nil {
+			return false, err
+		}
+		if err := addCredentialsToUser(&user); err != nil {
+			return false, err
+		}
+		users = append(users, user)
+		return true, nil
+	})
+	if err != nil {
+		return users, err
+	}
+	err = p.loadUsersUsage(users)
+	return users, err
+}
+
+func (p RedisProvider) getUsers(limit int, offset int, order string, username string) ([]User, error) {
+	users := []User{}
+	var err error
+	if limit <= 0 {
+		return users, err
+	}
+	if len(username) > 0 {
+		if offset == 0 {
+			user, err := p.userExists(username)
+			if err == nil {
+				users = append(users, HideUserSensitiveData(&user))
+			}
+		}
+		return users, err
+	}
+	_, records, err := p.getRecordsPage(redisUsers, limit, offset, order)
+	if err != nil {
+		return users, err
+	}
+	for _, record := range records {
+		var user User
+		if err = json.Unmarshal([]byte(record), &user); err == nil {
+			users = append(users, user)
+		}
+	}
+	if err = p.loadUsersUsage(users); err != nil {
+		return users, err
+	}
+	for idx := range users {
+		users[idx] = HideUserSensitiveData(&users[idx])
+	}
+	return users, nil
+}
+
+func (p RedisProvider) close() error {
+	return p.client.Close()
+}
+
+func (p RedisProvider) reloadConfig() error {
+	return nil
+}
+
+// initializeDatabase does nothing, no initilization is needed for redis provider
+func (p RedisProvider) initializeDatabase() error {
+	return errNoInitRequired
+}
+
+func (p RedisProvider) migrateDatabase() error {
+	version, err := p.client.Get(redisSchemaVersionKey).Int()
+	if err == redis.Nil {
+		providerLog(logger.LevelInfo, "initializing redis database, version: %v", redisDatabaseVersion)
+		return p.client.Set(redisSchemaVersionKey, redisDatabaseVersion, 0).Err()
+	}
+	if err != nil {
+		return err
+	}
+	if version == redisDatabaseVersion {
+		providerLog(logger.LevelDebug, "redis database is updated, current version: %v", version)
+		return nil
+	}
+	if version > redisDatabaseVersion {
+		return fmt.Errorf("redis database version %v is newer than the supported one: %v", version, redisDatabaseVersion)
+	}
+	return fmt.Errorf("unsupported redis database version: %v", version)
+}
+
+func (p RedisProvider) addShare(share Share) error {
+	err := validateShare(&share)
+	if err != nil {
+		return err
+	}
+	return p.addRecord(redisShares, share.ShareID, func(id int64) ([]byte, error) {
+		share.ID = id
+		return json.Marshal(share)
+	}, nil)
+}
+
+func (p RedisProvider) updateShare(share Share) error {
+	err := validateShare(&share)
+	if err != nil {
+		return err
+	}
+	return p.updateRecord(redisShares, share.ShareID, func(old []byte) ([]byte, error) {
+		return json.Marshal(share)
+	})
+}
+
+func (p RedisProvider) deleteShare(share Share) error {
+	return p.deleteRecord(redisShares, share.ShareID, nil)
+}
+
+func (p RedisProvider) getShareByID(shareID string) (Share, error) {
+	var share Share
+	err := p.getRecord(redisShares, shareID, &share)
+	return share, err
+}
+
+func (p RedisProvider) getShares(limit int, offset int, order string, username string) ([]Share, error) {
+	shares := []Share{}
+	if limit <= 0 {
+		return shares, nil
+	}
+	itNum := 0
+	err := p.scanRecords(redisShares, order, func(name, record string) (bool, error) {
+		var share Share
+		if err := json.Unmarshal([]byte(record), &share); err != nil {
+			return false, err
+		}
+		if len(username) > 0 && share.Username != username {
+			return true, nil
+		}
+		itNum++
+		if itNum <= offset {
+			return true, nil
+		}
+		shares = append(shares, HideShareSensitiveData(&share))
+		return len(shares) < limit, nil
+	})
+	return shares, err
+}
+
+func (p RedisProvider) updateShareUsage(shareID string, numTokens int) error {
+	err := p.updateRecord(redisShares, shareID, func(old []byte) ([]byte, error) {
+		var share Share
+		if err := json.Unmarshal(old, &share); err != nil {
+			return nil, err
+		}
+		if !share.hasTokens(numTokens) {
+			return nil, ErrShareTokensExhausted
+		}
+		share.UsedTokens += numTokens
+		share.LastUseAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+		return json.Marshal(share)
+	})
+	if _, ok := err.(*RecordNotFoundError); ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist, unable to update usage", shareID)}
+	}
+	return err
+}
+
+// getRedisUserShareIDs returns the IDs of the shares owned by the given user, the shares
+// are read using the given transaction
+func getRedisUserShareIDs(tx *redis.Tx, username string) ([]string, error) {
+	var shareIDs []string
+	var cursor uint64
+	for {
+		values, next, err := tx.HScan(redisShares.records, cursor, "", redisScanPageSize).Result()
+		if err != nil {
+			return nil, err
+		}
+		// values contains share ID and serialized share pairs
+		for idx := 0; idx+1 < len(values); idx += 2 {
+			var share Share
+			if err := json.Unmarshal([]byte(values[idx+1]), &share); err != nil {
+				return nil, err
+			}
+			if share.Username == username {
+				shareIDs = append(shareIDs, values[idx])
+			}
+		}
+		if next == 0 {
+			return shareIDs, nil
+		}
+		cursor = next
+	}
+}
+
+func (p RedisProvider) adminExists(username string) (Admin, error) {
+	var admin Admin
+	err := p.getRecord(redisAdmins, username, &admin)
+	return admin, err
+}
+
+func (p RedisProvider) addAdmin(admin Admin) error {
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	return p.addRecord(redisAdmins, admin.Username, func(id int64) ([]byte, error) {
+		admin.ID = id
+		return json.Marshal(admin)
+	}, nil)
+}
+
+func (p RedisProvider) updateAdmin(admin Admin) error {
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	return p.updateRecord(redisAdmins, admin.Username, func(old []byte) ([]byte, error) {
+		var oldAdmin Admin
+		if err := json.Unmarshal(old, &oldAdmin); err != nil {
+			return nil, err
+		}
+		admin.ID = oldAdmin.ID
+		return json.Marshal(admin)
+	})
+}
+
+func (p RedisProvider) deleteAdmin(admin Admin) error {
+	var keyIDs []string
+	err := p.scanRecords(redisAPIKeys, "ASC", func(name, record string) (bool, error) {
+		var key APIKey
+		if err := json.Unmarshal([]byte(record), &key); err != nil {
+			return false, err
+		}
+		if key.Admin == admin.Username {
+			keyIDs = append(keyIDs, name)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	return p.deleteRecord(redisAdmins, admin.Username, func(pipe redis.Pipeliner) {
+		for _, keyID := range keyIDs {
+			pipe.HDel(redisAPIKeys.records, keyID)
+			pipe.ZRem(redisAPIKeys.index, keyID)
+		}
+	})
+}
+
+func (p RedisProvider) getAdmins(limit int, offset int, order string) ([]Admin, error) {
+	admins := []Admin{}
+	if limit <= 0 {
+		return admins, nil
+	}
+	_, records, err := p.getRecordsPage(redisAdmins, limit, offset, order)
+	if err != nil {
+		return admins, err
+	}
+	for _, record := range records {
+		var admin Admin
+		if err = json.Unmarshal([]byte(record), &admin); err != nil {
+			return admins, err
+		}
+		admins = append(admins, HideAdminSensitiveData(&admin))
+	}
+	return admins, nil
+}
+
+func (p RedisProvider) dumpAdmins() ([]Admin, error) {
+	admins := []Admin{}
+	err := p.scanRecords(redisAdmins, "ASC", func(name, record string) (bool, error) {
+		var admin Admin
+		if err := json.Unmarshal([]byte(record), &admin); err != nil {
+			return false, err
+		}
+		admins = append(admins, admin)
+		return true, nil
+	})
+	return admins, err
+}
+
+func (p RedisProvider) apiKeyExists(keyID string) (APIKey, error) {
+	var key APIKey
+	err := p.getRecord(redisAPIKeys, keyID, &key)
+	return key, err
+}
+
+func (p RedisProvider) addAPIKey(key APIKey) error {
+	err := validateAPIKey(&key)
+	if err != nil {
+		return err
+	}
+	return p.addRecord(redisAPIKeys, key.KeyID, func(id int64) ([]byte, error) {
+		key.ID = id
+		return json.Marshal(key)
+	}, nil)
+}
+
+func (p RedisProvider) deleteAPIKey(key APIKey) error {
+	return p.deleteRecord(redisAPIKeys, key.KeyID, nil)
+}
+
+func (p RedisProvider) getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error) {
+	keys := []APIKey{}
+	if limit <= 0 {
+		return keys, nil
+	}
+	itNum := 0
+	err := p.scanRecords(redisAPIKeys, order, func(name, record string) (bool, error) {
+		var key APIKey
+		if err := json.Unmarshal([]byte(record), &key); err != nil {
+			return false, err
+		}
+		if len(admin) > 0 && key.Admin != admin {
+			return true, nil
+		}
+		itNum++
+		if itNum <= offset {
+			return true, nil
+		}
+		keys = append(keys, HideAPIKeySensitiveData(&key))
+		return len(keys) < limit, nil
+	})
+	return keys, err
+}
+
+func (p RedisProvider) updateAPIKeyLastUse(keyID string) error {
+	err := p.updateRecord(redisAPIKeys, keyID, func(old []byte) ([]byte, error) {
+		var key APIKey
+		if err := json.Unmarshal(old, &key); err != nil {
+			return nil, err
+		}
+		key.LastUseAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+		return json.Marshal(key)
+	})
+	if _, ok := err.(*RecordNotFoundError); ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist, unable to update last use", keyID)}
+	}
+	return err
+}
+
+func (p RedisProvider) groupExists(name string) (Group, error) {
+	var group Group
+	err := p.getRecord(redisGroups, name, &group)
+	return group, err
+}
+
+func (p RedisProvider) addGroup(group Group) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	return p.addRecord(redisGroups, group.Name, func(id int64) ([]byte, error) {
+		group.ID = id
+		return json.Marshal(group)
+	}, nil)
+}
+
+func (p RedisProvider) updateGroup(group Group) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	return p.updateRecord(redisGroups, group.Name, func(old []byte) ([]byte, error) {
+		var oldGroup Group
+		if err := json.Unmarshal(old, &oldGroup); err != nil {
+			return nil, err
+		}
+		group.ID = oldGroup.ID
+		return json.Marshal(group)
+	})
+}
+
+func (p RedisProvider) deleteGroup(group Group) error {
+	return p.deleteRecord(redisGroups, group.Name, nil)
+}
+
+func (p RedisProvider) getGroups(limit int, offset int, order string) ([]Group, error) {
+	groups := []Group{}
+	if limit <= 0 {
+		return groups, nil
+	}
+	_, records, err := p.getRecordsPage(redisGroups, limit, offset, order)
+	if err != nil {
+		return groups, err
+	}
+	for _, record := range records {
+		var group Group
+		if err = json.Unmarshal([]byte(record), &group); err != nil {
+			return groups, err
+		}
+		groups = append(groups, HideGroupSensitiveData(&group))
+	}
+	return groups, nil
+}
+
+func (p RedisProvider) dumpGroups() ([]Group, error) {
+	groups := []Group{}
+	err := p.scanRecords(redisGroups, "ASC", func(name, record string) (bool, error) {
+		var group Group
+		if err := json.Unmarshal([]byte(record), &group); err != nil {
+			return false, err
+		}
+		groups = append(groups, group)
+		return true, nil
+	})
+	return groups, err
+}
+
+func (p RedisProvider) bannedIPExists(ip string) (BannedIP, error) {
+	var ban BannedIP
+	err := p.getRecord(redisBannedIPs, ip, &ban)
+	return ban, err
+}
+
+func (p RedisProvider) addBannedIP(ban BannedIP) error {
+	err := validateBannedIP(&ban)
+	if err != nil {
+		return err
+	}
+	return p.addRecord(redisBannedIPs, ban.IP, func(id int64) ([]byte, error) {
+		ban.ID = id
+		return json.Marshal(ban)
+	}, nil)
+}
+
+func (p RedisProvider) updateBannedIP(ban BannedIP) error {
+	err := validateBannedIP(&ban)
+	if err != nil {
+		return err
+	}
+	return p.updateRecord(redisBannedIPs, ban.IP, func(old []byte) ([]byte, error) {
+		var oldBan BannedIP
+		if err := json.Unmarshal(old, &oldBan); err != nil {
+			return nil, err
+		}
+		ban.ID = oldBan.ID
+		return json.Marshal(ban)
+	})
+}
+
+func (p RedisProvider) deleteBannedIP(ban BannedIP) error {
+	return p.deleteRecord(redisBannedIPs, ban.IP, nil)
+}
+
+func (p RedisProvider) getBannedIPs(limit int, offset int, order string) ([]BannedIP, error) {
+	bans := []BannedIP{}
+	if limit <= 0 {
+		return bans, nil
+	}
+	_, records, err := p.getRecordsPage(redisBannedIPs, limit, offset, order)
+	if err != nil {
+		return bans, err
+	}
+	for _, record := range records {
+		var ban BannedIP
+		if err = json.Unmarshal([]byte(record), &ban); err != nil {
+			return bans, err
+		}
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+func (p RedisProvider) cleanupBannedIPs(before int64) error {
+	var expired []string
+	err := p.scanRecords(redisBannedIPs, "ASC", func(name, record string) (bool, error) {
+		var ban BannedIP
+		if err := json.Unmarshal([]byte(record), &ban); err != nil {
+			return false, err
+		}
+		if ban.BannedUntil < before {
+			expired = append(expired, name)
+		}
+		return true, nil
+	})
+	if err != nil || len(expired) == 0 {
+		return err
+	}
+	_, err = p.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, ip := range expired {
+			pipe.HDel(redisBannedIPs.records, ip)
+			pipe.ZRem(redisBannedIPs.index, ip)
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,304 @@
+package dataprovider
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/drakkan/sftpgo/kms"
+)
+
+var redisTestServer *miniredis.Miniredis
+
+func TestMain(m *testing.M) {
+	var err error
+	redisTestServer, err = miniredis.Run()
+	if err != nil {
+		fmt.Printf("unable to start redis test server: %v\n", err)
+		os.Exit(1)
+	}
+	basePath, err := ioutil.TempDir("", "redis_provider")
+	if err != nil {
+		fmt.Printf("unable to create temp dir: %v\n", err)
+		os.Exit(1)
+	}
+	err = kms.Config{MasterKeyPath: "master.key"}.Initialize(basePath)
+	if err != nil {
+		fmt.Printf("unable to initialize secrets encryption: %v\n", err)
+		os.Exit(1)
+	}
+	port, _ := strconv.Atoi(redisTestServer.Port())
+	err = Initialize(Config{
+		Driver:          RedisDataProviderName,
+		Host:            redisTestServer.Host(),
+		Port:            port,
+		ManageUsers:     1,
+		TrackQuota:      1,
+		CredentialsPath: "credentials",
+	}, basePath)
+	if err != nil {
+		fmt.Printf("unable to initialize redis provider: %v\n", err)
+		os.Exit(1)
+	}
+	exitCode := m.Run()
+	Close(GetProvider())
+	redisTestServer.Close()
+	os.RemoveAll(basePath)
+	os.Exit(exitCode)
+}
+
+func getRedisTestUser(username string) User {
+	return User{
+		Username:    username,
+		Password:    "password",
+		HomeDir:     filepath.Join(os.TempDir(), username),
+		Status:      1,
+		Permissions: map[string][]string{"/": {PermAny}},
+	}
+}
+
+func TestRedisProviderUsers(t *testing.T) {
+	p := GetProvider()
+
+	for i := 0; i < 5; i++ {
+		err := AddUser(p, getRedisTestUser(fmt.Sprintf("user%v", i)))
+		if err != nil {
+			t.Errorf("unable to add user: %v", err)
+		}
+	}
+	if err := AddUser(p, getRedisTestUser("user1")); err == nil {
+		t.Error("adding a duplicate user must fail")
+	}
+	users, err := GetUsers(p, 2, 1, "ASC", "")
+	if err != nil {
+		t.Errorf("unable to get users: %v", err)
+	}
+	if len(users) != 2 || users[0].Username != "user1" || users[1].Username != "user2" {
+		t.Errorf("unexpected users page: %+v", users)
+	}
+	users, err = GetUsers(p, 10, 3, "DESC", "")
+	if err != nil {
+		t.Errorf("unable to get users: %v", err)
+	}
+	if len(users) != 2 || users[0].Username != "user1" || users[1].Username != "user0" {
+		t.Errorf("unexpected users page: %+v", users)
+	}
+	if len(users[0].Password) > 0 {
+		t.Error("the password must be hidden")
+	}
+	user, err := UserExists(p, "user3")
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	userByID, err := GetUserByID(p, user.ID)
+	if err != nil || userByID.Username != user.Username {
+		t.Errorf("unable to get user by ID: %v", err)
+	}
+	_, err = CheckUserAndPass(p, "user3", "password", "127.0.0.1", "SSH")
+	if err != nil {
+		t.Errorf("unable to authenticate user: %v", err)
+	}
+	_, err = CheckUserAndPass(p, "user3", "wrong", "127.0.0.1", "SSH")
+	if err == nil {
+		t.Error("authentication with a wrong password must fail")
+	}
+	otherUser, err := UserExists(p, "user4")
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	// concurrent quota updates must be atomic and they are not affected by updates to the other users
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := UpdateUser(p, otherUser); err != nil {
+				t.Errorf("unable to update user: %v", err)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := UpdateUserQuota(p, user, 1, 100, false); err != nil {
+				t.Errorf("unable to update quota: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	files, size, err := GetUsedQuota(p, user.Username)
+	if err != nil || files != 20 || size != 2000 {
+		t.Errorf("unexpected used quota, files: %v size: %v err: %v", files, size, err)
+	}
+	err = UpdateLastLogin(p, user)
+	if err != nil {
+		t.Errorf("unable to update last login: %v", err)
+	}
+	// quota and last login are not overwritten by updates
+	user.MaxSessions = 2
+	err = UpdateUser(p, user)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	user, err = UserExists(p, user.Username)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if user.MaxSessions != 2 || user.UsedQuotaFiles != 20 || user.UsedQuotaSize != 2000 || user.LastLogin == 0 ||
+		user.ID != userByID.ID {
+		t.Errorf("unexpected user after update: %+v", user)
+	}
+	err = UpdateUserQuota(p, user, 1, 10, true)
+	if err != nil {
+		t.Errorf("unable to reset quota: %v", err)
+	}
+	files, size, err = GetUsedQuota(p, user.Username)
+	if err != nil || files != 1 || size != 10 {
+		t.Errorf("unexpected used quota after reset, files: %v size: %v err: %v", files, size, err)
+	}
+	err = p.addShare(Share{ShareID: "share1", Username: user.Username, Path: "/", Scope: ShareScopeRead,
+		MaxTokens: 2})
+	if err != nil {
+		t.Errorf("unable to add share: %v", err)
+	}
+	err = p.addShare(Share{ShareID: "share2", Username: otherUser.Username, Path: "/", Scope: ShareScopeRead})
+	if err != nil {
+		t.Errorf("unable to add share: %v", err)
+	}
+	usageErrors := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			usageErrors <- p.updateShareUsage("share1", 1)
+		}()
+	}
+	wg.Wait()
+	close(usageErrors)
+	numConsumed := 0
+	for err := range usageErrors {
+		if err == nil {
+			numConsumed++
+		} else if err != ErrShareTokensExhausted {
+			t.Errorf("unexpected error updating share usage: %v", err)
+		}
+	}
+	share, err := p.getShareByID("share1")
+	if err != nil || numConsumed != 2 || share.UsedTokens != 2 {
+		t.Errorf("unexpected share usage, consumed: %v used tokens: %v err: %v", numConsumed, share.UsedTokens, err)
+	}
+	dump, err := DumpUsers(p)
+	if err != nil || len(dump) != 5 {
+		t.Errorf("unexpected users dump, len: %v, err: %v", len(dump), err)
+	}
+	err = DeleteUser(p, user)
+	if err != nil {
+		t.Errorf("unable to delete user: %v", err)
+	}
+	_, err = UserExists(p, user.Username)
+	if _, ok := err.(*RecordNotFoundError); !ok {
+		t.Errorf("unexpected error for a deleted user: %v", err)
+	}
+	_, err = GetUserByID(p, user.ID)
+	if err == nil {
+		t.Error("get a deleted user by ID must fail")
+	}
+	_, err = p.getShareByID("share1")
+	if err == nil {
+		t.Error("the shares must be removed with their user")
+	}
+	_, err = p.getShareByID("share2")
+	if err != nil {
+		t.Errorf("the shares of the other users must be preserved: %v", err)
+	}
+	if redisTestServer.Exists(getRedisUsageKey(user.Username)) {
+		t.Error("the usage must be removed with the user")
+	}
+	err = UpdateUserQuota(p, user, 1, 10, false)
+	if _, ok := err.(*RecordNotFoundError); !ok {
+		t.Errorf("unexpected error updating quota for a deleted user: %v", err)
+	}
+	err = DeleteUser(p, user)
+	if _, ok := err.(*RecordNotFoundError); !ok {
+		t.Errorf("unexpected error deleting a missing user: %v", err)
+	}
+}
+
+func TestRedisProviderGroupsAndAdmins(t *testing.T) {
+	p := GetProvider()
+
+	for i := 0; i < 3; i++ {
+		if err := p.addGroup(Group{Name: fmt.Sprintf("group%v", i)}); err != nil {
+			t.Errorf("unable to add group: %v", err)
+		}
+	}
+	groups, err := p.getGroups(2, 0, "DESC")
+	if err != nil || len(groups) != 2 || groups[0].Name != "group2" || groups[1].Name != "group1" {
+		t.Errorf("unexpected groups: %+v, err: %v", groups, err)
+	}
+	group, err := p.groupExists("group1")
+	if err != nil {
+		t.Errorf("unable to get group: %v", err)
+	}
+	group.Description = "desc"
+	group.ID = 0
+	if err = p.updateGroup(group); err != nil {
+		t.Errorf("unable to update group: %v", err)
+	}
+	updatedGroup, err := p.groupExists("group1")
+	if err != nil || updatedGroup.Description != "desc" || updatedGroup.ID != groups[1].ID {
+		t.Errorf("unexpected updated group: %+v, err: %v", updatedGroup, err)
+	}
+	if err = p.deleteGroup(group); err != nil {
+		t.Errorf("unable to delete group: %v", err)
+	}
+	if err = p.updateGroup(group); err == nil {
+		t.Error("updating a deleted group must fail")
+	}
+
+	admin := Admin{Username: "admin1", Password: "password", Status: 1, Permissions: []string{PermAdminAny}}
+	if err = p.addAdmin(admin); err != nil {
+		t.Errorf("unable to add admin: %v", err)
+	}
+	key := APIKey{KeyID: "key1", Name: "key", Key: "secret", Admin: admin.Username, Permissions: []string{PermAdminAny}}
+	if err = p.addAPIKey(key); err != nil {
+		t.Errorf("unable to add API key: %v", err)
+	}
+	if err = p.updateAPIKeyLastUse(key.KeyID); err != nil {
+		t.Errorf("unable to update API key last use: %v", err)
+	}
+	keys, err := p.getAPIKeys(10, 0, "ASC", admin.Username)
+	if err != nil || len(keys) != 1 || keys[0].LastUseAt == 0 {
+		t.Errorf("unexpected API keys: %+v, err: %v", keys, err)
+	}
+	if err = p.deleteAdmin(admin); err != nil {
+		t.Errorf("unable to delete admin: %v", err)
+	}
+	if _, err = p.apiKeyExists(key.KeyID); err == nil {
+		t.Error("the API keys must be removed with their admin")
+	}
+}
+
+func TestRedisProviderSchemaVersion(t *testing.T) {
+	p := GetProvider()
+
+	version, err := redisTestServer.Get(redisSchemaVersionKey)
+	if err != nil || version != strconv.Itoa(redisDatabaseVersion) {
+		t.Errorf("unexpected schema version: %v, err: %v", version, err)
+	}
+	if err = p.migrateDatabase(); err != nil {
+		t.Errorf("migrating an updated database must succeed: %v", err)
+	}
+	redisTestServer.Set(redisSchemaVersionKey, strconv.Itoa(redisDatabaseVersion+1)) //nolint:errcheck
+	if err = p.migrateDatabase(); err == nil {
+		t.Error("migrating a newer database must fail")
+	}
+	redisTestServer.Set(redisSchemaVersionKey, strconv.Itoa(redisDatabaseVersion)) //nolint:errcheck
+}
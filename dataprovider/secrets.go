@@ -0,0 +1,170 @@
+package dataprovider
+
+import (
+	"fmt"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+)
+
+// encryptSecret encrypts the given secret using the active secrets provider. An already
+// encrypted secret is re-encrypted only if it uses the legacy format, a different secrets
+// provider or a key that is not the active one
+func encryptSecret(secret *kms.Secret) error {
+	if secret.IsEmpty() {
+		return nil
+	}
+	if err := secret.Validate(); err != nil {
+		return err
+	}
+	if secret.IsEncrypted() {
+		if !secret.NeedsReencryption() {
+			return nil
+		}
+		if err := secret.Decrypt(); err != nil {
+			return err
+		}
+	}
+	return secret.Encrypt()
+}
+
+// decryptSecret replaces an encrypted secret with its plain text, the other secrets are left as is
+func decryptSecret(secret *kms.Secret) error {
+	if !secret.IsEncrypted() {
+		return nil
+	}
+	return secret.Decrypt()
+}
+
+// decryptUserSecrets replaces the encrypted secrets for the given user with their plain text.
+// The GCS credentials are base64 encoded as when they are added using the REST API
+func decryptUserSecrets(user *User) error {
+	var err error
+	if err = decryptFsSecrets(&user.FsConfig); err != nil {
+		return err
+	}
+	for idx := range user.VirtualFolders {
+		if err = decryptFsSecrets(&user.VirtualFolders[idx].FsConfig); err != nil {
+			return fmt.Errorf("virtual folder %#v: %v", user.VirtualFolders[idx].VirtualPath, err)
+		}
+	}
+	if err = decryptSecret(&user.TOTPConfig.Secret); err != nil {
+		return fmt.Errorf("unable to decrypt the TOTP secret: %v", err)
+	}
+	return nil
+}
+
+func decryptFsSecrets(fsConfig *Filesystem) error {
+	if err := decryptSecret(&fsConfig.S3Config.AccessSecret); err != nil {
+		return fmt.Errorf("unable to decrypt the S3 access secret: %v", err)
+	}
+	if err := decryptSecret(&fsConfig.AzBlobConfig.AccountKey); err != nil {
+		return fmt.Errorf("unable to decrypt the Azure Blob account key: %v", err)
+	}
+	if err := decryptSecret(&fsConfig.SFTPConfig.Password); err != nil {
+		return fmt.Errorf("unable to decrypt the SFTP password: %v", err)
+	}
+	if err := decryptSecret(&fsConfig.SFTPConfig.PrivateKey); err != nil {
+		return fmt.Errorf("unable to decrypt the SFTP private key: %v", err)
+	}
+	if err := decryptSecret(&fsConfig.CryptConfig.Passphrase); err != nil {
+		return fmt.Errorf("unable to decrypt the passphrase: %v", err)
+	}
+	if err := decryptSecret(&fsConfig.GCSConfig.Credentials); err != nil {
+		return fmt.Errorf("unable to decrypt the GCS credentials: %v", err)
+	}
+	return nil
+}
+
+// reencryptSecrets encrypts again, using the active key, the secrets stored using the legacy
+// format or a previous master key. The users and groups that cannot be updated are skipped
+func reencryptSecrets(p Provider) error {
+	var numGroups, numUsers int
+	groups, err := p.dumpGroups()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if !groupNeedsReencryption(&group) {
+			continue
+		}
+		if err = p.updateGroup(group); err != nil {
+			providerLog(logger.LevelWarn, "unable to re-encrypt the secrets for group %#v: %v", group.Name, err)
+			continue
+		}
+		numGroups++
+	}
+	for offset := 0; ; offset += defaultMigrationBatchSize {
+		users, err := p.getUsers(defaultMigrationBatchSize, offset, "ASC", "")
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			user, err := p.userExists(u.Username)
+			if err != nil {
+				return err
+			}
+			if err = addCredentialsToUser(&user); err != nil {
+				providerLog(logger.LevelWarn, "unable to read the credentials for user %#v: %v", user.Username, err)
+				continue
+			}
+			if !userNeedsReencryption(&user) {
+				continue
+			}
+			if err = p.updateUser(user); err != nil {
+				providerLog(logger.LevelWarn, "unable to re-encrypt the secrets for user %#v: %v", user.Username, err)
+				continue
+			}
+			numUsers++
+		}
+		if len(users) < defaultMigrationBatchSize {
+			break
+		}
+	}
+	if numGroups > 0 || numUsers > 0 {
+		providerLog(logger.LevelInfo, "secrets re-encrypted for %v groups and %v users", numGroups, numUsers)
+	}
+	return nil
+}
+
+func userNeedsReencryption(user *User) bool {
+	if user.TOTPConfig.Secret.NeedsReencryption() || fsNeedsReencryption(&user.FsConfig) ||
+		foldersNeedReencryption(user.VirtualFolders) {
+		return true
+	}
+	if gcsCredentialsNeedReencryption(user.FsConfig.GCSConfig.Credentials) {
+		return true
+	}
+	for idx := range user.VirtualFolders {
+		if gcsCredentialsNeedReencryption(user.VirtualFolders[idx].FsConfig.GCSConfig.Credentials) {
+			return true
+		}
+	}
+	return false
+}
+
+func gcsCredentialsNeedReencryption(credentials kms.Secret) bool {
+	// plain text credentials saved by older versions
+	return credentials.IsPlain() || credentials.NeedsReencryption()
+}
+
+func groupNeedsReencryption(group *Group) bool {
+	return fsNeedsReencryption(&group.UserSettings.FsConfig) || foldersNeedReencryption(group.UserSettings.VirtualFolders)
+}
+
+func foldersNeedReencryption(folders []VirtualFolder) bool {
+	for idx := range folders {
+		if fsNeedsReencryption(&folders[idx].FsConfig) {
+			return true
+		}
+	}
+	return false
+}
+
+func fsNeedsReencryption(fsConfig *Filesystem) bool {
+	return fsConfig.S3Config.AccessSecret.NeedsReencryption() ||
+		fsConfig.AzBlobConfig.AccountKey.NeedsReencryption() ||
+		fsConfig.SFTPConfig.Password.NeedsReencryption() ||
+		fsConfig.SFTPConfig.PrivateKey.NeedsReencryption() ||
+		fsConfig.CryptConfig.Passphrase.NeedsReencryption()
+}
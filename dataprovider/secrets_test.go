@@ -0,0 +1,214 @@
+package dataprovider
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	testGCSCredentials = `{"type": "service_account"}`
+	testTOTPSecret     = "JBSWY3DPEHPK3PXP"
+	// "legacy secret" encrypted using the legacy format
+	testLegacySecret = "$aes$a8a0aaa275a83aeb589a9848f5c03d09$896550a8c453abc4bfab4a4f0619ccc17d76e039b692020836d798c32f04" +
+		"f071a8e85d0f7e276762f9"
+)
+
+func TestReencryptSecrets(t *testing.T) {
+	p := GetProvider()
+	keysDir, err := ioutil.TempDir("", "master_keys")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(keysDir)
+	oldMasterKey := "0123456789abcdef0123456789abcdef"
+	err = ioutil.WriteFile(filepath.Join(keysDir, "old.key"), []byte(oldMasterKey), 0600)
+	if err != nil {
+		t.Fatalf("unable to write the old master key: %v", err)
+	}
+	if err = (kms.Config{MasterKey: oldMasterKey}.Initialize(keysDir)); err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+
+	s3User := getRedisTestUser("secrets_s3")
+	s3User.FsConfig.Provider = 1
+	s3User.FsConfig.S3Config.Bucket = "bucket"
+	s3User.FsConfig.S3Config.Region = "us-east-1"
+	s3User.FsConfig.S3Config.AccessKey = "access key"
+	s3User.FsConfig.S3Config.AccessSecret = kms.NewPlainSecret("access secret")
+	s3User.TOTPConfig.Secret = kms.NewPlainSecret(testTOTPSecret)
+	gcsUser := getRedisTestUser("secrets_gcs")
+	gcsUser.FsConfig.Provider = 2
+	gcsUser.FsConfig.GCSConfig.Bucket = "bucket"
+	gcsUser.FsConfig.GCSConfig.Credentials = kms.NewPlainSecret(base64.StdEncoding.EncodeToString([]byte(testGCSCredentials)))
+	gcsUser.VirtualFolders = append(gcsUser.VirtualFolders, VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{VirtualPath: "/gcs"},
+		FsConfig: Filesystem{
+			Provider: 2,
+			GCSConfig: vfs.GCSFsConfig{
+				Bucket:      "folder bucket",
+				Credentials: kms.NewPlainSecret(base64.StdEncoding.EncodeToString([]byte(testGCSCredentials))),
+			},
+		},
+	})
+	folderCredentialsFile := gcsUser.getFolderGCSCredentialsFilePath("/gcs")
+	azUser := getRedisTestUser("secrets_azblob")
+	azUser.FsConfig.Provider = 3
+	azUser.FsConfig.AzBlobConfig.Container = "container"
+	azUser.FsConfig.AzBlobConfig.AccountName = "account"
+	azUser.FsConfig.AzBlobConfig.AccountKey = kms.NewPlainSecret("account key")
+	sftpUser := getRedisTestUser("secrets_sftp")
+	sftpUser.FsConfig.Provider = 4
+	sftpUser.FsConfig.SFTPConfig.Endpoint = "127.0.0.1:22"
+	sftpUser.FsConfig.SFTPConfig.Username = "remote"
+	sftpUser.FsConfig.SFTPConfig.Password = kms.NewPlainSecret("remote password")
+	sftpUser.FsConfig.SFTPConfig.PrivateKey = kms.NewPlainSecret("remote private key")
+	sftpUser.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("crypt passphrase")
+	group := Group{Name: "secrets_group"}
+	group.UserSettings.FsConfig = s3User.FsConfig
+	for _, user := range []User{s3User, gcsUser, azUser, sftpUser} {
+		if err = AddUser(p, user); err != nil {
+			t.Fatalf("unable to add user: %v", err)
+		}
+	}
+	if err = p.addGroup(group); err != nil {
+		t.Fatalf("unable to add group: %v", err)
+	}
+	credentials, err := readGCSCredentials(gcsUser.getGCSCredentialsFilePath())
+	if err != nil || !credentials.IsEncrypted() {
+		t.Errorf("the GCS credentials must be saved encrypted, err: %v", err)
+	}
+	credentials, err = readGCSCredentials(folderCredentialsFile)
+	if err != nil || !credentials.IsEncrypted() {
+		t.Errorf("the GCS credentials for the virtual folder must be saved encrypted, err: %v", err)
+	}
+	if folderCredentialsFile == gcsUser.getGCSCredentialsFilePath() ||
+		folderCredentialsFile == gcsUser.getFolderGCSCredentialsFilePath("/other") {
+		t.Errorf("each virtual folder must use its own GCS credentials file: %v", folderCredentialsFile)
+	}
+	// simulate plain text credentials saved by an older version
+	err = ioutil.WriteFile(gcsUser.getGCSCredentialsFilePath(), []byte(testGCSCredentials), 0600)
+	if err != nil {
+		t.Fatalf("unable to write the GCS credentials: %v", err)
+	}
+	err = kms.Config{
+		MasterKey:         "fedcba9876543210fedcba9876543210",
+		OldMasterKeyPaths: []string{"old.key"},
+	}.Initialize(keysDir)
+	if err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+	user, err := p.userExists(s3User.Username)
+	if err != nil {
+		t.Fatalf("unable to get user: %v", err)
+	}
+	if !userNeedsReencryption(&user) {
+		t.Error("the secrets encrypted using the old master key must be re-encrypted")
+	}
+	if err = reencryptSecrets(p); err != nil {
+		t.Errorf("unable to re-encrypt the secrets: %v", err)
+	}
+
+	user, err = p.userExists(s3User.Username)
+	if err != nil {
+		t.Fatalf("unable to get user: %v", err)
+	}
+	if userNeedsReencryption(&user) {
+		t.Error("the secrets must be encrypted using the active master key")
+	}
+	if err = decryptUserSecrets(&user); err != nil {
+		t.Errorf("unable to decrypt user secrets: %v", err)
+	}
+	if user.FsConfig.S3Config.AccessSecret != kms.NewPlainSecret("access secret") ||
+		user.TOTPConfig.Secret != kms.NewPlainSecret(testTOTPSecret) {
+		t.Errorf("unexpected decrypted secrets: %+v", user)
+	}
+	user, err = p.userExists(azUser.Username)
+	if err != nil {
+		t.Fatalf("unable to get user: %v", err)
+	}
+	if userNeedsReencryption(&user) {
+		t.Error("the Azure Blob account key must be encrypted using the active master key")
+	}
+	if err = decryptUserSecrets(&user); err != nil || user.FsConfig.AzBlobConfig.AccountKey != kms.NewPlainSecret("account key") {
+		t.Errorf("unexpected Azure Blob account key %#v, err: %v", user.FsConfig.AzBlobConfig.AccountKey, err)
+	}
+	user, err = p.userExists(sftpUser.Username)
+	if err != nil {
+		t.Fatalf("unable to get user: %v", err)
+	}
+	if userNeedsReencryption(&user) {
+		t.Error("the SFTP secrets must be encrypted using the active master key")
+	}
+	err = decryptUserSecrets(&user)
+	if err != nil || user.FsConfig.SFTPConfig.Password != kms.NewPlainSecret("remote password") ||
+		user.FsConfig.SFTPConfig.PrivateKey != kms.NewPlainSecret("remote private key") ||
+		user.FsConfig.CryptConfig.Passphrase != kms.NewPlainSecret("crypt passphrase") {
+		t.Errorf("unexpected SFTP secrets: %+v, err: %v", user.FsConfig.SFTPConfig, err)
+	}
+	updatedGroup, err := p.groupExists(group.Name)
+	if err != nil {
+		t.Fatalf("unable to get group: %v", err)
+	}
+	accessSecret := updatedGroup.UserSettings.FsConfig.S3Config.AccessSecret
+	if accessSecret.NeedsReencryption() {
+		t.Error("the group secret must be encrypted using the active master key")
+	}
+	if err = decryptSecret(&accessSecret); err != nil || accessSecret.Payload != "access secret" {
+		t.Errorf("unexpected decrypted group secret %+v, err: %v", accessSecret, err)
+	}
+	expectedCredentials := kms.NewPlainSecret(base64.StdEncoding.EncodeToString([]byte(testGCSCredentials)))
+	for _, filePath := range []string{gcsUser.getGCSCredentialsFilePath(), folderCredentialsFile} {
+		credentials, err = readGCSCredentials(filePath)
+		if err != nil || !credentials.IsEncrypted() || credentials.NeedsReencryption() {
+			t.Errorf("the GCS credentials %#v must be encrypted using the active master key, err: %v", filePath, err)
+		}
+		if err = decryptSecret(&credentials); err != nil || credentials != expectedCredentials {
+			t.Errorf("unexpected GCS credentials %+v, err: %v", credentials, err)
+		}
+	}
+	// the secrets stored as strings by older versions are loaded using the legacy format
+	var secret kms.Secret
+	if err = json.Unmarshal([]byte(`"`+testLegacySecret+`"`), &secret); err != nil {
+		t.Fatalf("unable to unmarshal the legacy secret: %v", err)
+	}
+	if err = encryptSecret(&secret); err != nil || secret.NeedsReencryption() {
+		t.Errorf("unexpected re-encrypted legacy secret %+v, err: %v", secret, err)
+	}
+	if err = decryptSecret(&secret); err != nil || secret.Payload != "legacy secret" {
+		t.Errorf("unexpected decrypted legacy secret %+v, err: %v", secret, err)
+	}
+	// the status decides if a secret is encrypted, not the shape of the value
+	for _, value := range []string{"$local$key$value", "$unknown$0123456789abcdef$abcd"} {
+		secret = kms.NewPlainSecret(value)
+		if err = encryptSecret(&secret); err != nil || !secret.IsEncrypted() || secret.Payload == value {
+			t.Errorf("the plain text value %#v must be encrypted, got %+v, err: %v", value, secret, err)
+		}
+		if err = decryptSecret(&secret); err != nil || secret.Payload != value {
+			t.Errorf("unexpected decrypted secret %+v, err: %v", secret, err)
+		}
+	}
+	secret = kms.Secret{Status: kms.SecretStatusRedacted}
+	if err = encryptSecret(&secret); err == nil {
+		t.Error("a redacted secret must not be saved")
+	}
+
+	for _, username := range []string{s3User.Username, gcsUser.Username, azUser.Username, sftpUser.Username} {
+		user, err := p.userExists(username)
+		if err != nil {
+			t.Fatalf("unable to get user: %v", err)
+		}
+		if err = DeleteUser(p, user); err != nil {
+			t.Errorf("unable to delete user: %v", err)
+		}
+	}
+	if err = p.deleteGroup(group); err != nil {
+		t.Errorf("unable to delete group: %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package dataprovider
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	redactedSharePassword = "[**redacted**]"
+)
+
+// ErrShareTokensExhausted is returned if a share token cannot be consumed because
+// the share reached the maximum allowed usage
+var ErrShareTokensExhausted = errors.New("the share reached the maximum allowed usage")
+
+// Available share scopes
+const (
+	// ShareScopeRead allows to download the shared file or a zip archive of the shared directory
+	ShareScopeRead = 1
+	// ShareScopeWrite allows to upload files inside the shared directory
+	ShareScopeWrite = 2
+)
+
+// Share defines a public link to a file or a directory of an existing user.
+// Files are read from and written to the user's filesystem using the user's permissions
+type Share struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// Random unique identifier used to build the public URL
+	ShareID string `json:"share_id"`
+	// Optional description
+	Description string `json:"description,omitempty"`
+	// The user that owns the shared path
+	Username string `json:"username"`
+	// Shared path, a file or a directory, relative to the user's home directory
+	Path string `json:"path"`
+	// ShareScopeRead or ShareScopeWrite
+	Scope int `json:"scope"`
+	// Optional password, it is stored hashed
+	Password string `json:"password,omitempty"`
+	// Expiration date as unix timestamp in milliseconds, 0 means no expiration
+	ExpiresAt int64 `json:"expires_at"`
+	// Maximum number of times the share can be used, 0 means no limit
+	MaxTokens int `json:"max_tokens"`
+	// Number of times the share has been used
+	UsedTokens int `json:"used_tokens"`
+	// Creation time as unix timestamp in milliseconds
+	CreatedAt int64 `json:"created_at"`
+	// Last use as unix timestamp in milliseconds
+	LastUseAt int64 `json:"last_use_at"`
+}
+
+// HasPassword returns true if the share is protected by a password
+func (s *Share) HasPassword() bool {
+	return len(s.Password) > 0
+}
+
+// CheckPassword returns true if the given password matches the share password
+func (s *Share) CheckPassword(password string) (bool, error) {
+	if !s.HasPassword() {
+		return true, nil
+	}
+	if len(password) == 0 {
+		return false, nil
+	}
+	if strings.HasPrefix(s.Password, bcryptPwdPrefix) {
+		if err := bcrypt.CompareHashAndPassword([]byte(s.Password), []byte(password)); err != nil {
+			return false, nil
+		}
+		return true, nil
+	}
+	return argon2id.ComparePasswordAndHash(password, s.Password)
+}
+
+// IsUsable returns an error if the share is expired or if the maximum
+// number of uses is reached
+func (s *Share) IsUsable() error {
+	if s.ExpiresAt > 0 && s.ExpiresAt < utils.GetTimeAsMsSinceEpoch(time.Now()) {
+		return fmt.Errorf("share %#v is expired", s.ShareID)
+	}
+	if s.MaxTokens > 0 && s.UsedTokens >= s.MaxTokens {
+		return fmt.Errorf("share %#v reached the maximum allowed usage: %v", s.ShareID, s.MaxTokens)
+	}
+	return nil
+}
+
+// hasTokens returns true if the given number of tokens can be consumed
+func (s *Share) hasTokens(numTokens int) bool {
+	return s.MaxTokens == 0 || s.UsedTokens+numTokens <= s.MaxTokens
+}
+
+// GetExpirationDateAsString returns the share expiration date formatted as YYYY-MM-DD
+func (s *Share) GetExpirationDateAsString() string {
+	if s.ExpiresAt > 0 {
+		t := utils.GetTimeFromMsecSinceEpoch(s.ExpiresAt)
+		return t.Format("2006-01-02")
+	}
+	return ""
+}
+
+// HideShareSensitiveData hides share sensitive data
+func HideShareSensitiveData(share *Share) Share {
+	if share.HasPassword() {
+		share.Password = redactedSharePassword
+	}
+	return *share
+}
+
+func generateShareID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validateShare(share *Share) error {
+	if len(share.ShareID) == 0 {
+		return &ValidationError{err: "share_id is mandatory"}
+	}
+	if len(share.Username) == 0 {
+		return &ValidationError{err: "username is mandatory"}
+	}
+	if len(share.Path) == 0 {
+		return &ValidationError{err: "path is mandatory"}
+	}
+	share.Path = utils.CleanSFTPPath(share.Path)
+	if share.Scope != ShareScopeRead && share.Scope != ShareScopeWrite {
+		return &ValidationError{err: fmt.Sprintf("invalid scope: %v", share.Scope)}
+	}
+	if share.MaxTokens < 0 {
+		return &ValidationError{err: fmt.Sprintf("invalid max_tokens: %v", share.MaxTokens)}
+	}
+	if share.ExpiresAt < 0 {
+		return &ValidationError{err: fmt.Sprintf("invalid expires_at: %v", share.ExpiresAt)}
+	}
+	if len(share.Password) > 0 && !strings.HasPrefix(share.Password, argonPwdPrefix) &&
+		!strings.HasPrefix(share.Password, bcryptPwdPrefix) {
+		pwd, err := argon2id.CreateHash(share.Password, argon2id.DefaultParams)
+		if err != nil {
+			return err
+		}
+		share.Password = pwd
+	}
+	return nil
+}
+
+// AddShare adds a new share for an existing user.
+// The share identifier is generated and set inside the given share.
+// ManageUsers configuration must be set to 1 to enable this method
+func AddShare(p Provider, share *Share) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	if _, err := p.userExists(share.Username); err != nil {
+		if _, ok := err.(*RecordNotFoundError); ok {
+			return &ValidationError{err: fmt.Sprintf("username %#v does not exist", share.Username)}
+		}
+		return err
+	}
+	shareID, err := generateShareID()
+	if err != nil {
+		return err
+	}
+	share.ShareID = shareID
+	share.CreatedAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+	share.UsedTokens = 0
+	share.LastUseAt = 0
+	return p.addShare(*share)
+}
+
+// UpdateShare updates an existing share.
+// The owner, the usage counters and the creation time cannot be changed.
+// If the password is redacted the existing one is preserved.
+// ManageUsers configuration must be set to 1 to enable this method
+func UpdateShare(p Provider, share Share) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	current, err := p.getShareByID(share.ShareID)
+	if err != nil {
+		return err
+	}
+	if share.Password == redactedSharePassword {
+		share.Password = current.Password
+	}
+	share.ID = current.ID
+	share.Username = current.Username
+	share.UsedTokens = current.UsedTokens
+	share.CreatedAt = current.CreatedAt
+	share.LastUseAt = current.LastUseAt
+	return p.updateShare(share)
+}
+
+// DeleteShare deletes an existing share.
+// ManageUsers configuration must be set to 1 to enable this method
+func DeleteShare(p Provider, share Share) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.deleteShare(share)
+}
+
+// GetShareByID returns the share with the given share identifier if a match is found or an error
+func GetShareByID(p Provider, shareID string) (Share, error) {
+	return p.getShareByID(shareID)
+}
+
+// GetShares returns an array of shares respecting limit and offset and filtered by username exact match if not empty
+func GetShares(p Provider, limit int, offset int, order string, username string) ([]Share, error) {
+	return p.getShares(limit, offset, order, username)
+}
+
+// UpdateShareUsage increments the used tokens and updates the last use for the given share.
+// The tokens are consumed atomically, ErrShareTokensExhausted is returned and nothing is
+// updated if the maximum allowed usage would be exceeded
+func UpdateShareUsage(p Provider, share Share, numTokens int) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	err := p.updateShareUsage(share.ShareID, numTokens)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to update usage for share %#v: %v", share.ShareID, err)
+	}
+	return err
+}
+
+// CheckShareAndPass returns the share with the given identifier if it is usable
+// and the password matches
+func CheckShareAndPass(p Provider, shareID, password string) (Share, error) {
+	share, err := p.getShareByID(shareID)
+	if err != nil {
+		return share, err
+	}
+	if err = share.IsUsable(); err != nil {
+		return share, err
+	}
+	match, err := share.CheckPassword(password)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error comparing password for share %#v: %v", shareID, err)
+		return share, err
+	}
+	if !match {
+		return share, errors.New("Invalid credentials")
+	}
+	return share, nil
+}
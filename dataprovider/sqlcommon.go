@@ -9,11 +9,10 @@ import (
 
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/utils"
-	"github.com/drakkan/sftpgo/vfs"
 )
 
 const (
-	sqlDatabaseVersion  = 2
+	sqlDatabaseVersion  = 9
 	initialDBVersionSQL = "INSERT INTO schema_version (version) VALUES (1);"
 )
 
@@ -95,6 +94,127 @@ func sqlCommonUpdateQuota(username string, filesAdd int, sizeAdd int64, reset bo
 	return err
 }
 
+// sqlCommonUpdateFolderQuota updates the used quota for a virtual folder. The quota for all
+// the folders is stored as JSON inside the user's row, so it is read and written again
+// inside a transaction
+func sqlCommonUpdateFolderQuota(username, virtualPath string, filesAdd int, sizeAdd int64, reset bool, dbHandle *sql.DB) error {
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	var user User
+	user.FoldersQuota, err = getFoldersQuota(tx.QueryRow(getFoldersQuotaQuery(true), username))
+	if err != nil {
+		tx.Rollback()
+		providerLog(logger.LevelWarn, "error getting folders quota for user %#v: %v", username, err)
+		return err
+	}
+	user.updateFolderQuota(virtualPath, filesAdd, sizeAdd, reset)
+	foldersQuota, err := json.Marshal(user.FoldersQuota)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(getUpdateFoldersQuotaQuery(), string(foldersQuota), username)
+	if err != nil {
+		tx.Rollback()
+		providerLog(logger.LevelWarn, "error updating quota for user %#v, virtual folder %#v: %v", username, virtualPath, err)
+		return err
+	}
+	err = tx.Commit()
+	if err == nil {
+		providerLog(logger.LevelDebug, "quota updated for user %#v, virtual folder %#v, files increment: %v size increment: %v "+
+			"is reset? %v", username, virtualPath, filesAdd, sizeAdd, reset)
+	}
+	return err
+}
+
+// sqlCommonUseTOTPRecoveryCode removes a recovery code from the TOTP configuration stored inside
+// the user's row. The configuration is read and written again inside a transaction, so a recovery
+// code cannot be used by concurrent logins
+func sqlCommonUseTOTPRecoveryCode(username, hash string, dbHandle *sql.DB) error {
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	var oldConfig sql.NullString
+	err = tx.QueryRow(getTOTPConfigQuery(true), username).Scan(&oldConfig)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return &RecordNotFoundError{err: err.Error()}
+		}
+		return err
+	}
+	var totpConfig UserTOTPConfig
+	if oldConfig.Valid {
+		if err = json.Unmarshal([]byte(oldConfig.String), &totpConfig); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = totpConfig.removeRecoveryCode(hash); err != nil {
+		tx.Rollback()
+		return err
+	}
+	newConfig, err := json.Marshal(totpConfig)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	res, err := tx.Exec(getUpdateTOTPConfigQuery(), string(newConfig), username, oldConfig.String)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if rows == 0 {
+		tx.Rollback()
+		return errTOTPRecoveryCodeUsed
+	}
+	return tx.Commit()
+}
+
+func sqlCommonGetUsedFolderQuota(username, virtualPath string, dbHandle *sql.DB) (int, int64, error) {
+	q := getFoldersQuotaQuery(false)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return 0, 0, err
+	}
+	defer stmt.Close()
+
+	var user User
+	user.FoldersQuota, err = getFoldersQuota(stmt.QueryRow(username))
+	if err != nil {
+		providerLog(logger.LevelWarn, "error getting folders quota for user: %v, error: %v", username, err)
+		return 0, 0, err
+	}
+	files, size := user.getUsedFolderQuota(virtualPath)
+	return files, size, nil
+}
+
+func getFoldersQuota(row *sql.Row) (map[string]VirtualFolderQuota, error) {
+	var foldersQuota sql.NullString
+	if err := row.Scan(&foldersQuota); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &RecordNotFoundError{err: err.Error()}
+		}
+		return nil, err
+	}
+	quota := make(map[string]VirtualFolderQuota)
+	if foldersQuota.Valid && len(foldersQuota.String) > 0 {
+		if err := json.Unmarshal([]byte(foldersQuota.String), &quota); err != nil {
+			return nil, err
+		}
+	}
+	return quota, nil
+}
+
 func sqlCommonUpdateLastLogin(username string, dbHandle *sql.DB) error {
 	q := getUpdateLastLoginQuery()
 	stmt, err := dbHandle.Prepare(q)
@@ -176,9 +296,69 @@ func sqlCommonAddUser(user User, dbHandle *sql.DB) error {
 	if err != nil {
 		return err
 	}
+	groups, err := user.GetGroupsAsJSON()
+	if err != nil {
+		return err
+	}
+	totpConfig, err := user.GetTOTPConfigAsJSON()
+	if err != nil {
+		return err
+	}
 	_, err = stmt.Exec(user.Username, user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
 		user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth, user.Status, user.ExpirationDate, string(filters),
-		string(fsConfig), string(virtualFolders))
+		string(fsConfig), string(virtualFolders), string(groups), string(totpConfig))
+	return err
+}
+
+// sqlCommonRestoreUser adds the given user preserving its ID, used quota and last login
+func sqlCommonRestoreUser(user User, dbHandle *sql.DB) error {
+	err := validateUser(&user)
+	if err != nil {
+		return err
+	}
+	q := getRestoreUserQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	permissions, err := user.GetPermissionsAsJSON()
+	if err != nil {
+		return err
+	}
+	publicKeys, err := user.GetPublicKeysAsJSON()
+	if err != nil {
+		return err
+	}
+	filters, err := user.GetFiltersAsJSON()
+	if err != nil {
+		return err
+	}
+	fsConfig, err := user.GetFsConfigAsJSON()
+	if err != nil {
+		return err
+	}
+	virtualFolders, err := user.GetVirtualFoldersAsJSON()
+	if err != nil {
+		return err
+	}
+	groups, err := user.GetGroupsAsJSON()
+	if err != nil {
+		return err
+	}
+	totpConfig, err := user.GetTOTPConfigAsJSON()
+	if err != nil {
+		return err
+	}
+	foldersQuota, err := json.Marshal(user.FoldersQuota)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(user.ID, user.Username, user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID,
+		user.MaxSessions, user.QuotaSize, user.QuotaFiles, string(permissions), user.UsedQuotaSize, user.UsedQuotaFiles,
+		user.LastQuotaUpdate, user.UploadBandwidth, user.DownloadBandwidth, user.Status, user.LastLogin, user.ExpirationDate,
+		string(filters), string(fsConfig), string(virtualFolders), string(groups), string(totpConfig), string(foldersQuota))
 	return err
 }
 
@@ -214,22 +394,37 @@ func sqlCommonUpdateUser(user User, dbHandle *sql.DB) error {
 	if err != nil {
 		return err
 	}
+	groups, err := user.GetGroupsAsJSON()
+	if err != nil {
+		return err
+	}
+	totpConfig, err := user.GetTOTPConfigAsJSON()
+	if err != nil {
+		return err
+	}
 	_, err = stmt.Exec(user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
 		user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth, user.Status, user.ExpirationDate,
-		string(filters), string(fsConfig), string(virtualFolders), user.ID)
+		string(filters), string(fsConfig), string(virtualFolders), string(groups), string(totpConfig), user.ID)
 	return err
 }
 
+// sqlCommonDeleteUser deletes the given user and its shares
 func sqlCommonDeleteUser(user User, dbHandle *sql.DB) error {
-	q := getDeleteUserQuery()
-	stmt, err := dbHandle.Prepare(q)
+	tx, err := dbHandle.Begin()
 	if err != nil {
-		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
 		return err
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec(user.ID)
-	return err
+	_, err = tx.Exec(getDeleteUserSharesQuery(), user.Username)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(getDeleteUserQuery(), user.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 func sqlCommonDumpUsers(dbHandle *sql.DB) ([]User, error) {
@@ -317,18 +512,21 @@ func getUserFromDbRow(row *sql.Row, rows *sql.Rows) (User, error) {
 	var filters sql.NullString
 	var fsConfig sql.NullString
 	var virtualFolders sql.NullString
+	var groups sql.NullString
+	var totpConfig sql.NullString
+	var foldersQuota sql.NullString
 	var err error
 	if row != nil {
 		err = row.Scan(&user.ID, &user.Username, &password, &publicKey, &user.HomeDir, &user.UID, &user.GID, &user.MaxSessions,
 			&user.QuotaSize, &user.QuotaFiles, &permissions, &user.UsedQuotaSize, &user.UsedQuotaFiles, &user.LastQuotaUpdate,
 			&user.UploadBandwidth, &user.DownloadBandwidth, &user.ExpirationDate, &user.LastLogin, &user.Status, &filters, &fsConfig,
-			&virtualFolders)
+			&virtualFolders, &groups, &totpConfig, &foldersQuota)
 
 	} else {
 		err = rows.Scan(&user.ID, &user.Username, &password, &publicKey, &user.HomeDir, &user.UID, &user.GID, &user.MaxSessions,
 			&user.QuotaSize, &user.QuotaFiles, &permissions, &user.UsedQuotaSize, &user.UsedQuotaFiles, &user.LastQuotaUpdate,
 			&user.UploadBandwidth, &user.DownloadBandwidth, &user.ExpirationDate, &user.LastLogin, &user.Status, &filters, &fsConfig,
-			&virtualFolders)
+			&virtualFolders, &groups, &totpConfig, &foldersQuota)
 	}
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -370,15 +568,691 @@ func getUserFromDbRow(row *sql.Row, rows *sql.Rows) (User, error) {
 		}
 	}
 	if virtualFolders.Valid {
-		var list []vfs.VirtualFolder
+		var list []VirtualFolder
 		err = json.Unmarshal([]byte(virtualFolders.String), &list)
 		if err == nil {
 			user.VirtualFolders = list
 		}
 	}
+	if groups.Valid {
+		var list []UserGroup
+		err = json.Unmarshal([]byte(groups.String), &list)
+		if err == nil {
+			user.Groups = list
+		}
+	}
+	if totpConfig.Valid {
+		var totp UserTOTPConfig
+		err = json.Unmarshal([]byte(totpConfig.String), &totp)
+		if err == nil {
+			user.TOTPConfig = totp
+		}
+	}
+	if foldersQuota.Valid && len(foldersQuota.String) > 0 {
+		var quota map[string]VirtualFolderQuota
+		if err := json.Unmarshal([]byte(foldersQuota.String), &quota); err == nil {
+			user.FoldersQuota = quota
+		}
+	}
 	return user, err
 }
 
+func sqlCommonAddShare(share Share, dbHandle *sql.DB) error {
+	err := validateShare(&share)
+	if err != nil {
+		return err
+	}
+	q := getAddShareQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(share.ShareID, share.Description, share.Username, share.Path, share.Scope, share.Password,
+		share.ExpiresAt, share.MaxTokens, share.UsedTokens, share.CreatedAt, share.LastUseAt)
+	return err
+}
+
+func sqlCommonUpdateShare(share Share, dbHandle *sql.DB) error {
+	err := validateShare(&share)
+	if err != nil {
+		return err
+	}
+	q := getUpdateShareQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(share.Description, share.Path, share.Scope, share.Password, share.ExpiresAt, share.MaxTokens,
+		share.ShareID)
+	return err
+}
+
+func sqlCommonDeleteShare(share Share, dbHandle *sql.DB) error {
+	q := getDeleteShareQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(share.ShareID)
+	return err
+}
+
+func sqlCommonGetShareByID(shareID string, dbHandle *sql.DB) (Share, error) {
+	var share Share
+	q := getShareByIDQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return share, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(shareID)
+	return getShareFromDbRow(row, nil)
+}
+
+func sqlCommonGetShares(limit int, offset int, order string, username string, dbHandle *sql.DB) ([]Share, error) {
+	shares := []Share{}
+	q := getSharesQuery(order, username)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	var rows *sql.Rows
+	if len(username) > 0 {
+		rows, err = stmt.Query(username, limit, offset)
+	} else {
+		rows, err = stmt.Query(limit, offset)
+	}
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			s, err := getShareFromDbRow(nil, rows)
+			if err == nil {
+				shares = append(shares, HideShareSensitiveData(&s))
+			} else {
+				break
+			}
+		}
+	}
+
+	return shares, err
+}
+
+func sqlCommonUpdateShareUsage(shareID string, numTokens int, dbHandle *sql.DB) error {
+	q := getUpdateShareUsageQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	res, err := stmt.Exec(numTokens, utils.GetTimeAsMsSinceEpoch(time.Now()), shareID, numTokens)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		// the share does not exist or it has no tokens left
+		if _, err = sqlCommonGetShareByID(shareID, dbHandle); err != nil {
+			return err
+		}
+		return ErrShareTokensExhausted
+	}
+	providerLog(logger.LevelDebug, "usage updated for share %#v, tokens increment: %v", shareID, numTokens)
+	return nil
+}
+
+func getShareFromDbRow(row *sql.Row, rows *sql.Rows) (Share, error) {
+	var share Share
+	var description sql.NullString
+	var password sql.NullString
+	var err error
+	if row != nil {
+		err = row.Scan(&share.ID, &share.ShareID, &description, &share.Username, &share.Path, &share.Scope, &password,
+			&share.ExpiresAt, &share.MaxTokens, &share.UsedTokens, &share.CreatedAt, &share.LastUseAt)
+	} else {
+		err = rows.Scan(&share.ID, &share.ShareID, &description, &share.Username, &share.Path, &share.Scope, &password,
+			&share.ExpiresAt, &share.MaxTokens, &share.UsedTokens, &share.CreatedAt, &share.LastUseAt)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return share, &RecordNotFoundError{err: err.Error()}
+		}
+		return share, err
+	}
+	if description.Valid {
+		share.Description = description.String
+	}
+	if password.Valid {
+		share.Password = password.String
+	}
+	return share, nil
+}
+
+func sqlCommonGetAdminByUsername(username string, dbHandle *sql.DB) (Admin, error) {
+	var admin Admin
+	q := getAdminByUsernameQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return admin, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(username)
+	return getAdminFromDbRow(row, nil)
+}
+
+func sqlCommonAddAdmin(admin Admin, dbHandle *sql.DB) error {
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	q := getAddAdminQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	permissions, err := json.Marshal(admin.Permissions)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(admin.Username, admin.Password, admin.Status, admin.Email, string(permissions),
+		admin.Description)
+	return err
+}
+
+func sqlCommonUpdateAdmin(admin Admin, dbHandle *sql.DB) error {
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	q := getUpdateAdminQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	permissions, err := json.Marshal(admin.Permissions)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(admin.Password, admin.Status, admin.Email, string(permissions), admin.Description,
+		admin.Username)
+	return err
+}
+
+// sqlCommonDeleteAdmin deletes the given admin and its API keys
+func sqlCommonDeleteAdmin(admin Admin, dbHandle *sql.DB) error {
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(getDeleteAdminAPIKeysQuery(), admin.Username)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(getDeleteAdminQuery(), admin.Username)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func sqlCommonGetAdmins(limit, offset int, order string, dbHandle *sql.DB) ([]Admin, error) {
+	admins := []Admin{}
+	q := getAdminsQuery(order)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(limit, offset)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			a, err := getAdminFromDbRow(nil, rows)
+			if err == nil {
+				admins = append(admins, HideAdminSensitiveData(&a))
+			} else {
+				break
+			}
+		}
+	}
+	return admins, err
+}
+
+func sqlCommonDumpAdmins(dbHandle *sql.DB) ([]Admin, error) {
+	admins := []Admin{}
+	q := getDumpAdminsQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			a, err := getAdminFromDbRow(nil, rows)
+			if err != nil {
+				return admins, err
+			}
+			admins = append(admins, a)
+		}
+	}
+	return admins, err
+}
+
+func getAdminFromDbRow(row *sql.Row, rows *sql.Rows) (Admin, error) {
+	var admin Admin
+	var email, permissions, description sql.NullString
+	var err error
+	if row != nil {
+		err = row.Scan(&admin.ID, &admin.Username, &admin.Password, &admin.Status, &email, &permissions, &description)
+	} else {
+		err = rows.Scan(&admin.ID, &admin.Username, &admin.Password, &admin.Status, &email, &permissions, &description)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return admin, &RecordNotFoundError{err: err.Error()}
+		}
+		return admin, err
+	}
+	if email.Valid {
+		admin.Email = email.String
+	}
+	if permissions.Valid {
+		var perms []string
+		err = json.Unmarshal([]byte(permissions.String), &perms)
+		if err != nil {
+			return admin, err
+		}
+		admin.Permissions = perms
+	}
+	if description.Valid {
+		admin.Description = description.String
+	}
+	return admin, nil
+}
+
+func sqlCommonGetAPIKeyByID(keyID string, dbHandle *sql.DB) (APIKey, error) {
+	var key APIKey
+	q := getAPIKeyByIDQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return key, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(keyID)
+	return getAPIKeyFromDbRow(row, nil)
+}
+
+func sqlCommonAddAPIKey(key APIKey, dbHandle *sql.DB) error {
+	err := validateAPIKey(&key)
+	if err != nil {
+		return err
+	}
+	q := getAddAPIKeyQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	permissions, err := json.Marshal(key.Permissions)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(key.KeyID, key.Name, key.Key, key.Admin, string(permissions), key.Description, key.ExpiresAt,
+		key.CreatedAt, key.LastUseAt)
+	return err
+}
+
+func sqlCommonDeleteAPIKey(key APIKey, dbHandle *sql.DB) error {
+	q := getDeleteAPIKeyQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(key.KeyID)
+	return err
+}
+
+func sqlCommonGetAPIKeys(limit int, offset int, order string, admin string, dbHandle *sql.DB) ([]APIKey, error) {
+	keys := []APIKey{}
+	q := getAPIKeysQuery(order, admin)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	var rows *sql.Rows
+	if len(admin) > 0 {
+		rows, err = stmt.Query(admin, limit, offset)
+	} else {
+		rows, err = stmt.Query(limit, offset)
+	}
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			k, err := getAPIKeyFromDbRow(nil, rows)
+			if err == nil {
+				keys = append(keys, HideAPIKeySensitiveData(&k))
+			} else {
+				break
+			}
+		}
+	}
+	return keys, err
+}
+
+func sqlCommonUpdateAPIKeyLastUse(keyID string, dbHandle *sql.DB) error {
+	q := getUpdateAPIKeyLastUseQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(utils.GetTimeAsMsSinceEpoch(time.Now()), keyID)
+	return err
+}
+
+func getAPIKeyFromDbRow(row *sql.Row, rows *sql.Rows) (APIKey, error) {
+	var key APIKey
+	var permissions string
+	var description sql.NullString
+	var err error
+	if row != nil {
+		err = row.Scan(&key.ID, &key.KeyID, &key.Name, &key.Key, &key.Admin, &permissions, &description, &key.ExpiresAt,
+			&key.CreatedAt, &key.LastUseAt)
+	} else {
+		err = rows.Scan(&key.ID, &key.KeyID, &key.Name, &key.Key, &key.Admin, &permissions, &description, &key.ExpiresAt,
+			&key.CreatedAt, &key.LastUseAt)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return key, &RecordNotFoundError{err: err.Error()}
+		}
+		return key, err
+	}
+	err = json.Unmarshal([]byte(permissions), &key.Permissions)
+	if err != nil {
+		return key, err
+	}
+	if description.Valid {
+		key.Description = description.String
+	}
+	return key, nil
+}
+
+func sqlCommonGetGroupByName(name string, dbHandle *sql.DB) (Group, error) {
+	var group Group
+	q := getGroupByNameQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return group, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(name)
+	return getGroupFromDbRow(row, nil)
+}
+
+func sqlCommonAddGroup(group Group, dbHandle *sql.DB) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	q := getAddGroupQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	settings, err := group.GetUserSettingsAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(group.Name, group.Description, string(settings))
+	return err
+}
+
+func sqlCommonUpdateGroup(group Group, dbHandle *sql.DB) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	q := getUpdateGroupQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	settings, err := group.GetUserSettingsAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(group.Description, string(settings), group.Name)
+	return err
+}
+
+func sqlCommonDeleteGroup(group Group, dbHandle *sql.DB) error {
+	q := getDeleteGroupQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(group.Name)
+	return err
+}
+
+func sqlCommonGetGroups(limit, offset int, order string, dbHandle *sql.DB) ([]Group, error) {
+	groups := []Group{}
+	q := getGroupsQuery(order)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(limit, offset)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			g, err := getGroupFromDbRow(nil, rows)
+			if err == nil {
+				groups = append(groups, HideGroupSensitiveData(&g))
+			} else {
+				break
+			}
+		}
+	}
+	return groups, err
+}
+
+func sqlCommonDumpGroups(dbHandle *sql.DB) ([]Group, error) {
+	groups := []Group{}
+	q := getDumpGroupsQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			g, err := getGroupFromDbRow(nil, rows)
+			if err != nil {
+				return groups, err
+			}
+			groups = append(groups, g)
+		}
+	}
+	return groups, err
+}
+
+func getGroupFromDbRow(row *sql.Row, rows *sql.Rows) (Group, error) {
+	var group Group
+	var description sql.NullString
+	var settings string
+	var err error
+	if row != nil {
+		err = row.Scan(&group.ID, &group.Name, &description, &settings)
+	} else {
+		err = rows.Scan(&group.ID, &group.Name, &description, &settings)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return group, &RecordNotFoundError{err: err.Error()}
+		}
+		return group, err
+	}
+	if description.Valid {
+		group.Description = description.String
+	}
+	err = json.Unmarshal([]byte(settings), &group.UserSettings)
+	return group, err
+}
+
+func sqlCommonGetBannedIP(ip string, dbHandle *sql.DB) (BannedIP, error) {
+	var ban BannedIP
+	q := getBannedIPQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return ban, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(ip)
+	return getBannedIPFromDbRow(row, nil)
+}
+
+func sqlCommonAddBannedIP(ban BannedIP, dbHandle *sql.DB) error {
+	err := validateBannedIP(&ban)
+	if err != nil {
+		return err
+	}
+	q := getAddBannedIPQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(ban.IP, ban.BannedUntil, ban.BanCount)
+	return err
+}
+
+func sqlCommonUpdateBannedIP(ban BannedIP, dbHandle *sql.DB) error {
+	err := validateBannedIP(&ban)
+	if err != nil {
+		return err
+	}
+	q := getUpdateBannedIPQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(ban.BannedUntil, ban.BanCount, ban.IP)
+	return err
+}
+
+func sqlCommonDeleteBannedIP(ban BannedIP, dbHandle *sql.DB) error {
+	q := getDeleteBannedIPQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(ban.IP)
+	return err
+}
+
+func sqlCommonGetBannedIPs(limit, offset int, order string, dbHandle *sql.DB) ([]BannedIP, error) {
+	bans := []BannedIP{}
+	q := getBannedIPsQuery(order)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(limit, offset)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			b, err := getBannedIPFromDbRow(nil, rows)
+			if err == nil {
+				bans = append(bans, b)
+			} else {
+				break
+			}
+		}
+	}
+	return bans, err
+}
+
+func sqlCommonCleanupBannedIPs(before int64, dbHandle *sql.DB) error {
+	q := getCleanupBannedIPsQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(before)
+	return err
+}
+
+func getBannedIPFromDbRow(row *sql.Row, rows *sql.Rows) (BannedIP, error) {
+	var ban BannedIP
+	var err error
+	if row != nil {
+		err = row.Scan(&ban.ID, &ban.IP, &ban.BannedUntil, &ban.BanCount)
+	} else {
+		err = rows.Scan(&ban.ID, &ban.IP, &ban.BannedUntil, &ban.BanCount)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ban, &RecordNotFoundError{err: err.Error()}
+		}
+		return ban, err
+	}
+	return ban, nil
+}
+
 func sqlCommonGetDatabaseVersion(dbHandle *sql.DB) (schemaVersion, error) {
 	var result schemaVersion
 	q := getDatabaseVersionQuery()
@@ -20,6 +20,26 @@ NOT NULL UNIQUE, "password" varchar(255) NULL, "public_keys" text NULL, "home_di
 "filesystem" text NULL);`
 	sqliteSchemaTableSQL = `CREATE TABLE "schema_version" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "version" integer NOT NULL);`
 	sqliteUsersV2SQL     = `ALTER TABLE "{{users}}" ADD COLUMN "virtual_folders" text NULL;`
+	sqliteSharesV3SQL    = `CREATE TABLE "shares" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"share_id" varchar(64) NOT NULL UNIQUE, "description" varchar(255) NULL, "username" varchar(255) NOT NULL,
+"path" text NOT NULL, "scope" integer NOT NULL, "password" varchar(255) NULL, "expires_at" bigint NOT NULL,
+"max_tokens" integer NOT NULL, "used_tokens" integer NOT NULL, "created_at" bigint NOT NULL, "last_use_at" bigint NOT NULL);
+CREATE INDEX "shares_username_idx" ON "shares" ("username");`
+	sqliteAdminsV4SQL = `CREATE TABLE "admins" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"username" varchar(255) NOT NULL UNIQUE, "password" varchar(255) NOT NULL, "status" integer NOT NULL,
+"email" varchar(255) NULL, "permissions" text NOT NULL, "description" varchar(512) NULL);`
+	sqliteAPIKeysV5SQL = `CREATE TABLE "api_keys" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"key_id" varchar(64) NOT NULL UNIQUE, "name" varchar(255) NOT NULL, "api_key" varchar(255) NOT NULL,
+"admin" varchar(255) NOT NULL, "permissions" text NOT NULL, "description" varchar(512) NULL,
+"expires_at" bigint NOT NULL, "created_at" bigint NOT NULL, "last_use_at" bigint NOT NULL);
+CREATE INDEX "api_keys_admin_idx" ON "api_keys" ("admin");`
+	sqliteGroupsV6SQL = `CREATE TABLE "user_groups" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"name" varchar(255) NOT NULL UNIQUE, "description" varchar(512) NULL, "user_settings" text NOT NULL);
+ALTER TABLE "{{users}}" ADD COLUMN "group_memberships" text NULL;`
+	sqliteBannedIPsV7SQL = `CREATE TABLE "banned_ips" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"ip" varchar(50) NOT NULL UNIQUE, "banned_until" bigint NOT NULL, "ban_count" integer NOT NULL);`
+	sqliteUsersV8SQL = `ALTER TABLE "{{users}}" ADD COLUMN "totp_config" text NULL;`
+	sqliteUsersV9SQL = `ALTER TABLE "{{users}}" ADD COLUMN "folders_quota" text NULL;`
 )
 
 // SQLiteProvider auth provider for SQLite database
@@ -79,10 +99,22 @@ func (p SQLiteProvider) updateLastLogin(username string) error {
 	return sqlCommonUpdateLastLogin(username, p.dbHandle)
 }
 
+func (p SQLiteProvider) useTOTPRecoveryCode(username, hash string) error {
+	return sqlCommonUseTOTPRecoveryCode(username, hash, p.dbHandle)
+}
+
 func (p SQLiteProvider) getUsedQuota(username string) (int, int64, error) {
 	return sqlCommonGetUsedQuota(username, p.dbHandle)
 }
 
+func (p SQLiteProvider) updateFolderQuota(username, virtualPath string, filesAdd int, sizeAdd int64, reset bool) error {
+	return sqlCommonUpdateFolderQuota(username, virtualPath, filesAdd, sizeAdd, reset, p.dbHandle)
+}
+
+func (p SQLiteProvider) getUsedFolderQuota(username, virtualPath string) (int, int64, error) {
+	return sqlCommonGetUsedFolderQuota(username, virtualPath, p.dbHandle)
+}
+
 func (p SQLiteProvider) userExists(username string) (User, error) {
 	return sqlCommonCheckUserExists(username, p.dbHandle)
 }
@@ -91,6 +123,10 @@ func (p SQLiteProvider) addUser(user User) error {
 	return sqlCommonAddUser(user, p.dbHandle)
 }
 
+func (p SQLiteProvider) restoreUser(user User) error {
+	return sqlCommonRestoreUser(user, p.dbHandle)
+}
+
 func (p SQLiteProvider) updateUser(user User) error {
 	return sqlCommonUpdateUser(user, p.dbHandle)
 }
@@ -107,6 +143,122 @@ func (p SQLiteProvider) getUsers(limit int, offset int, order string, username s
 	return sqlCommonGetUsers(limit, offset, order, username, p.dbHandle)
 }
 
+func (p SQLiteProvider) addShare(share Share) error {
+	return sqlCommonAddShare(share, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateShare(share Share) error {
+	return sqlCommonUpdateShare(share, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteShare(share Share) error {
+	return sqlCommonDeleteShare(share, p.dbHandle)
+}
+
+func (p SQLiteProvider) getShareByID(shareID string) (Share, error) {
+	return sqlCommonGetShareByID(shareID, p.dbHandle)
+}
+
+func (p SQLiteProvider) getShares(limit int, offset int, order string, username string) ([]Share, error) {
+	return sqlCommonGetShares(limit, offset, order, username, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateShareUsage(shareID string, numTokens int) error {
+	return sqlCommonUpdateShareUsage(shareID, numTokens, p.dbHandle)
+}
+
+func (p SQLiteProvider) adminExists(username string) (Admin, error) {
+	return sqlCommonGetAdminByUsername(username, p.dbHandle)
+}
+
+func (p SQLiteProvider) addAdmin(admin Admin) error {
+	return sqlCommonAddAdmin(admin, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateAdmin(admin Admin) error {
+	return sqlCommonUpdateAdmin(admin, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteAdmin(admin Admin) error {
+	return sqlCommonDeleteAdmin(admin, p.dbHandle)
+}
+
+func (p SQLiteProvider) getAdmins(limit int, offset int, order string) ([]Admin, error) {
+	return sqlCommonGetAdmins(limit, offset, order, p.dbHandle)
+}
+
+func (p SQLiteProvider) dumpAdmins() ([]Admin, error) {
+	return sqlCommonDumpAdmins(p.dbHandle)
+}
+
+func (p SQLiteProvider) apiKeyExists(keyID string) (APIKey, error) {
+	return sqlCommonGetAPIKeyByID(keyID, p.dbHandle)
+}
+
+func (p SQLiteProvider) addAPIKey(key APIKey) error {
+	return sqlCommonAddAPIKey(key, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteAPIKey(key APIKey) error {
+	return sqlCommonDeleteAPIKey(key, p.dbHandle)
+}
+
+func (p SQLiteProvider) getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error) {
+	return sqlCommonGetAPIKeys(limit, offset, order, admin, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateAPIKeyLastUse(keyID string) error {
+	return sqlCommonUpdateAPIKeyLastUse(keyID, p.dbHandle)
+}
+
+func (p SQLiteProvider) groupExists(name string) (Group, error) {
+	return sqlCommonGetGroupByName(name, p.dbHandle)
+}
+
+func (p SQLiteProvider) addGroup(group Group) error {
+	return sqlCommonAddGroup(group, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateGroup(group Group) error {
+	return sqlCommonUpdateGroup(group, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteGroup(group Group) error {
+	return sqlCommonDeleteGroup(group, p.dbHandle)
+}
+
+func (p SQLiteProvider) getGroups(limit int, offset int, order string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, p.dbHandle)
+}
+
+func (p SQLiteProvider) dumpGroups() ([]Group, error) {
+	return sqlCommonDumpGroups(p.dbHandle)
+}
+
+func (p SQLiteProvider) bannedIPExists(ip string) (BannedIP, error) {
+	return sqlCommonGetBannedIP(ip, p.dbHandle)
+}
+
+func (p SQLiteProvider) addBannedIP(ban BannedIP) error {
+	return sqlCommonAddBannedIP(ban, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateBannedIP(ban BannedIP) error {
+	return sqlCommonUpdateBannedIP(ban, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteBannedIP(ban BannedIP) error {
+	return sqlCommonDeleteBannedIP(ban, p.dbHandle)
+}
+
+func (p SQLiteProvider) getBannedIPs(limit int, offset int, order string) ([]BannedIP, error) {
+	return sqlCommonGetBannedIPs(limit, offset, order, p.dbHandle)
+}
+
+func (p SQLiteProvider) cleanupBannedIPs(before int64) error {
+	return sqlCommonCleanupBannedIPs(before, p.dbHandle)
+}
+
 func (p SQLiteProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -132,8 +284,51 @@ func (p SQLiteProvider) migrateDatabase() error {
 		providerLog(logger.LevelDebug, "sql database is updated, current version: %v", dbVersion.Version)
 		return nil
 	}
-	if dbVersion.Version == 1 {
-		return updateSQLiteDatabaseFrom1To2(p.dbHandle)
+	switch dbVersion.Version {
+	case 1:
+		err = updateSQLiteDatabaseFrom1To2(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 2:
+		err = updateSQLiteDatabaseFrom2To3(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 3:
+		err = updateSQLiteDatabaseFrom3To4(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 4:
+		err = updateSQLiteDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 5:
+		err = updateSQLiteDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 6:
+		err = updateSQLiteDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 7:
+		err = updateSQLiteDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case 8:
+		return updateSQLiteDatabaseFrom8To9(p.dbHandle)
 	}
 	return nil
 }
@@ -147,3 +342,69 @@ func updateSQLiteDatabaseFrom1To2(dbHandle *sql.DB) error {
 	}
 	return sqlCommonUpdateDatabaseVersion(dbHandle, 2)
 }
+
+func updateSQLiteDatabaseFrom2To3(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 2 -> 3")
+	_, err := dbHandle.Exec(sqliteSharesV3SQL)
+	if err != nil {
+		return err
+	}
+	return sqlCommonUpdateDatabaseVersion(dbHandle, 3)
+}
+
+func updateSQLiteDatabaseFrom3To4(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 3 -> 4")
+	_, err := dbHandle.Exec(sqliteAdminsV4SQL)
+	if err != nil {
+		return err
+	}
+	return sqlCommonUpdateDatabaseVersion(dbHandle, 4)
+}
+
+func updateSQLiteDatabaseFrom4To5(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 4 -> 5")
+	_, err := dbHandle.Exec(sqliteAPIKeysV5SQL)
+	if err != nil {
+		return err
+	}
+	return sqlCommonUpdateDatabaseVersion(dbHandle, 5)
+}
+
+func updateSQLiteDatabaseFrom5To6(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 5 -> 6")
+	sql := strings.Replace(sqliteGroupsV6SQL, "{{users}}", config.UsersTable, 1)
+	_, err := dbHandle.Exec(sql)
+	if err != nil {
+		return err
+	}
+	return sqlCommonUpdateDatabaseVersion(dbHandle, 6)
+}
+
+func updateSQLiteDatabaseFrom6To7(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 6 -> 7")
+	_, err := dbHandle.Exec(sqliteBannedIPsV7SQL)
+	if err != nil {
+		return err
+	}
+	return sqlCommonUpdateDatabaseVersion(dbHandle, 7)
+}
+
+func updateSQLiteDatabaseFrom7To8(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	sql := strings.Replace(sqliteUsersV8SQL, "{{users}}", config.UsersTable, 1)
+	_, err := dbHandle.Exec(sql)
+	if err != nil {
+		return err
+	}
+	return sqlCommonUpdateDatabaseVersion(dbHandle, 8)
+}
+
+func updateSQLiteDatabaseFrom8To9(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 8 -> 9")
+	sql := strings.Replace(sqliteUsersV9SQL, "{{users}}", config.UsersTable, 1)
+	_, err := dbHandle.Exec(sql)
+	if err != nil {
+		return err
+	}
+	return sqlCommonUpdateDatabaseVersion(dbHandle, 9)
+}
@@ -5,12 +5,23 @@ import "fmt"
 const (
 	selectUserFields = "id,username,password,public_keys,home_dir,uid,gid,max_sessions,quota_size,quota_files,permissions,used_quota_size," +
 		"used_quota_files,last_quota_update,upload_bandwidth,download_bandwidth,expiration_date,last_login,status,filters,filesystem," +
-		"virtual_folders"
+		"virtual_folders,group_memberships,totp_config,folders_quota"
+	selectShareFields = "id,share_id,description,username,path,scope,password,expires_at,max_tokens,used_tokens,created_at," +
+		"last_use_at"
+	selectAdminFields    = "id,username,password,status,email,permissions,description"
+	selectAPIKeyFields   = "id,key_id,name,api_key,admin,permissions,description,expires_at,created_at,last_use_at"
+	selectGroupFields    = "id,name,description,user_settings"
+	selectBannedIPFields = "id,ip,banned_until,ban_count"
+	sharesTableName      = "shares"
+	adminsTableName      = "admins"
+	apiKeysTableName     = "api_keys"
+	groupsTableName      = "user_groups"
+	bannedIPsTableName   = "banned_ips"
 )
 
 func getSQLPlaceholders() []string {
 	var placeholders []string
-	for i := 1; i <= 20; i++ {
+	for i := 1; i <= 25; i++ {
 		if config.Driver == PGSQLDataProviderName {
 			placeholders = append(placeholders, fmt.Sprintf("$%v", i))
 		} else {
@@ -59,23 +70,67 @@ func getQuotaQuery() string {
 		sqlPlaceholders[0])
 }
 
+// getFoldersQuotaQuery returns the query to read the used quota for the virtual folders,
+// the row is locked if the quota is read to update it
+func getFoldersQuotaQuery(forUpdate bool) string {
+	q := fmt.Sprintf(`SELECT folders_quota FROM %v WHERE username = %v`, config.UsersTable, sqlPlaceholders[0])
+	if forUpdate && config.Driver != SQLiteDataProviderName {
+		q += " FOR UPDATE"
+	}
+	return q
+}
+
+func getUpdateFoldersQuotaQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET folders_quota = %v WHERE username = %v`, config.UsersTable, sqlPlaceholders[0],
+		sqlPlaceholders[1])
+}
+
+// getTOTPConfigQuery returns the query to read the TOTP configuration for a user,
+// the row is locked if the configuration is read to update it
+func getTOTPConfigQuery(forUpdate bool) string {
+	q := fmt.Sprintf(`SELECT totp_config FROM %v WHERE username = %v`, config.UsersTable, sqlPlaceholders[0])
+	if forUpdate && config.Driver != SQLiteDataProviderName {
+		q += " FOR UPDATE"
+	}
+	return q
+}
+
+// getUpdateTOTPConfigQuery returns the query to replace the TOTP configuration for a user,
+// the row is updated only if the stored configuration was not modified in the meantime
+func getUpdateTOTPConfigQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET totp_config = %v WHERE username = %v AND totp_config = %v`, config.UsersTable,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
 func getAddUserQuery() string {
 	return fmt.Sprintf(`INSERT INTO %v (username,password,public_keys,home_dir,uid,gid,max_sessions,quota_size,quota_files,permissions,
 		used_quota_size,used_quota_files,last_quota_update,upload_bandwidth,download_bandwidth,status,last_login,expiration_date,filters,
-		filesystem,virtual_folders)
-		VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,0,0,0,%v,%v,%v,0,%v,%v,%v,%v)`, config.UsersTable, sqlPlaceholders[0], sqlPlaceholders[1],
-		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7],
-		sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12], sqlPlaceholders[13],
-		sqlPlaceholders[14], sqlPlaceholders[15], sqlPlaceholders[16])
+		filesystem,virtual_folders,group_memberships,totp_config)
+		VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,0,0,0,%v,%v,%v,0,%v,%v,%v,%v,%v,%v)`, config.UsersTable, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6],
+		sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12],
+		sqlPlaceholders[13], sqlPlaceholders[14], sqlPlaceholders[15], sqlPlaceholders[16], sqlPlaceholders[17], sqlPlaceholders[18])
+}
+
+func getRestoreUserQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (id,username,password,public_keys,home_dir,uid,gid,max_sessions,quota_size,quota_files,
+		permissions,used_quota_size,used_quota_files,last_quota_update,upload_bandwidth,download_bandwidth,status,last_login,
+		expiration_date,filters,filesystem,virtual_folders,group_memberships,totp_config,folders_quota)
+		VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v)`, config.UsersTable, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6],
+		sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12],
+		sqlPlaceholders[13], sqlPlaceholders[14], sqlPlaceholders[15], sqlPlaceholders[16], sqlPlaceholders[17], sqlPlaceholders[18],
+		sqlPlaceholders[19], sqlPlaceholders[20], sqlPlaceholders[21], sqlPlaceholders[22], sqlPlaceholders[23],
+		sqlPlaceholders[24])
 }
 
 func getUpdateUserQuery() string {
 	return fmt.Sprintf(`UPDATE %v SET password=%v,public_keys=%v,home_dir=%v,uid=%v,gid=%v,max_sessions=%v,quota_size=%v,
 		quota_files=%v,permissions=%v,upload_bandwidth=%v,download_bandwidth=%v,status=%v,expiration_date=%v,filters=%v,filesystem=%v,
-		virtual_folders=%v WHERE id = %v`, config.UsersTable, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3],
-		sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9],
-		sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12], sqlPlaceholders[13], sqlPlaceholders[14], sqlPlaceholders[15],
-		sqlPlaceholders[16])
+		virtual_folders=%v,group_memberships=%v,totp_config=%v WHERE id = %v`, config.UsersTable, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6],
+		sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12],
+		sqlPlaceholders[13], sqlPlaceholders[14], sqlPlaceholders[15], sqlPlaceholders[16], sqlPlaceholders[17], sqlPlaceholders[18])
 }
 
 func getDeleteUserQuery() string {
@@ -89,3 +144,158 @@ func getDatabaseVersionQuery() string {
 func getUpdateDBVersionQuery() string {
 	return fmt.Sprintf(`UPDATE schema_version SET version=%v`, sqlPlaceholders[0])
 }
+
+func getShareByIDQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE share_id = %v`, selectShareFields, sharesTableName, sqlPlaceholders[0])
+}
+
+func getSharesQuery(order string, username string) string {
+	if len(username) > 0 {
+		return fmt.Sprintf(`SELECT %v FROM %v WHERE username = %v ORDER BY share_id %v LIMIT %v OFFSET %v`,
+			selectShareFields, sharesTableName, sqlPlaceholders[0], order, sqlPlaceholders[1], sqlPlaceholders[2])
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY share_id %v LIMIT %v OFFSET %v`, selectShareFields, sharesTableName,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getAddShareQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (share_id,description,username,path,scope,password,expires_at,max_tokens,used_tokens,
+		created_at,last_use_at) VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v)`, sharesTableName, sqlPlaceholders[0], sqlPlaceholders[1],
+		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7],
+		sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10])
+}
+
+func getUpdateShareQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET description=%v,path=%v,scope=%v,password=%v,expires_at=%v,max_tokens=%v
+		WHERE share_id = %v`, sharesTableName, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3],
+		sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6])
+}
+
+func getDeleteShareQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE share_id = %v`, sharesTableName, sqlPlaceholders[0])
+}
+
+func getDeleteUserSharesQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE username = %v`, sharesTableName, sqlPlaceholders[0])
+}
+
+func getUpdateShareUsageQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET used_tokens = used_tokens + %v,last_use_at = %v WHERE share_id = %v AND
+		(max_tokens = 0 OR used_tokens + %v <= max_tokens)`, sharesTableName, sqlPlaceholders[0], sqlPlaceholders[1],
+		sqlPlaceholders[2], sqlPlaceholders[3])
+}
+
+func getAdminByUsernameQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE username = %v`, selectAdminFields, adminsTableName, sqlPlaceholders[0])
+}
+
+func getAdminsQuery(order string) string {
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY username %v LIMIT %v OFFSET %v`, selectAdminFields, adminsTableName,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDumpAdminsQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v`, selectAdminFields, adminsTableName)
+}
+
+func getAddAdminQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (username,password,status,email,permissions,description)
+		VALUES (%v,%v,%v,%v,%v,%v)`, adminsTableName, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
+		sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5])
+}
+
+func getUpdateAdminQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET password=%v,status=%v,email=%v,permissions=%v,description=%v
+		WHERE username = %v`, adminsTableName, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
+		sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5])
+}
+
+func getDeleteAdminQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE username = %v`, adminsTableName, sqlPlaceholders[0])
+}
+
+func getAPIKeyByIDQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE key_id = %v`, selectAPIKeyFields, apiKeysTableName, sqlPlaceholders[0])
+}
+
+func getAPIKeysQuery(order string, admin string) string {
+	if len(admin) > 0 {
+		return fmt.Sprintf(`SELECT %v FROM %v WHERE admin = %v ORDER BY key_id %v LIMIT %v OFFSET %v`,
+			selectAPIKeyFields, apiKeysTableName, sqlPlaceholders[0], order, sqlPlaceholders[1], sqlPlaceholders[2])
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY key_id %v LIMIT %v OFFSET %v`, selectAPIKeyFields, apiKeysTableName,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getAddAPIKeyQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (key_id,name,api_key,admin,permissions,description,expires_at,created_at,last_use_at)
+		VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v)`, apiKeysTableName, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
+		sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8])
+}
+
+func getDeleteAPIKeyQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE key_id = %v`, apiKeysTableName, sqlPlaceholders[0])
+}
+
+func getDeleteAdminAPIKeysQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE admin = %v`, apiKeysTableName, sqlPlaceholders[0])
+}
+
+func getUpdateAPIKeyLastUseQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET last_use_at = %v WHERE key_id = %v`, apiKeysTableName, sqlPlaceholders[0],
+		sqlPlaceholders[1])
+}
+
+func getGroupByNameQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE name = %v`, selectGroupFields, groupsTableName, sqlPlaceholders[0])
+}
+
+func getGroupsQuery(order string) string {
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY name %v LIMIT %v OFFSET %v`, selectGroupFields, groupsTableName,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDumpGroupsQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v`, selectGroupFields, groupsTableName)
+}
+
+func getAddGroupQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (name,description,user_settings) VALUES (%v,%v,%v)`, groupsTableName,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getUpdateGroupQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET description=%v,user_settings=%v WHERE name = %v`, groupsTableName,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getDeleteGroupQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE name = %v`, groupsTableName, sqlPlaceholders[0])
+}
+
+func getBannedIPQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE ip = %v`, selectBannedIPFields, bannedIPsTableName, sqlPlaceholders[0])
+}
+
+func getBannedIPsQuery(order string) string {
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY ip %v LIMIT %v OFFSET %v`, selectBannedIPFields, bannedIPsTableName,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getAddBannedIPQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (ip,banned_until,ban_count) VALUES (%v,%v,%v)`, bannedIPsTableName,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getUpdateBannedIPQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET banned_until=%v,ban_count=%v WHERE ip = %v`, bannedIPsTableName,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getDeleteBannedIPQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE ip = %v`, bannedIPsTableName, sqlPlaceholders[0])
+}
+
+func getCleanupBannedIPsQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE banned_until < %v`, bannedIPsTableName, sqlPlaceholders[0])
+}
@@ -0,0 +1,320 @@
+package dataprovider
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	totpIssuer            = "SFTPGo"
+	totpDigits            = 6
+	totpPeriod            = 30
+	totpSecretSize        = 20
+	totpRecoveryCodes     = 10
+	totpRecoveryCodeSize  = 5
+	totpAllowedClockSteps = 1
+)
+
+var (
+	totpEncoding    = base32.StdEncoding.WithPadding(base32.NoPadding)
+	errTOTPRequired = errors.New("TOTP is enabled for this user, password only authentication is not allowed")
+	errInvalidTOTP  = errors.New("invalid TOTP passcode")
+	// errTOTPRecoveryCodeUsed is returned if the recovery code was already used, for example by a concurrent login
+	errTOTPRecoveryCodeUsed = errors.New("TOTP recovery code already used")
+	totpUsedPasscodes       = &totpPasscodesTracker{
+		lastUsed: make(map[string]uint64),
+	}
+)
+
+// UserTOTPConfig defines the time-based one-time password (RFC 6238) configuration for a user.
+// If enabled, a passcode is required, after the password, for keyboard interactive logins
+type UserTOTPConfig struct {
+	// Enabled is true after the first passcode is verified
+	Enabled bool `json:"enabled"`
+	// Base32 encoded secret, it is encrypted before saving it to the data provider
+	Secret kms.Secret `json:"secret,omitempty"`
+	// SHA256 hashes of the unused recovery codes, each code can be used once instead of a passcode
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// TOTPEnrollment defines the data required to configure an authenticator app
+type TOTPEnrollment struct {
+	// Base32 encoded secret
+	Secret string `json:"secret"`
+	// otpauth URI, it can be converted to a QR code to scan with an authenticator app
+	URI string `json:"uri"`
+}
+
+// TOTPRecoveryCodes defines the recovery codes generated when TOTP is enabled.
+// They are returned only once, only their hashes are stored
+type TOTPRecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// totpPasscodesTracker keeps the last used time step for each user so a passcode cannot be reused
+type totpPasscodesTracker struct {
+	sync.Mutex
+	lastUsed map[string]uint64
+}
+
+// markUsed returns false if a passcode for the given time step, or a newer one, was already used
+func (t *totpPasscodesTracker) markUsed(username string, counter uint64) bool {
+	t.Lock()
+	defer t.Unlock()
+	if last, ok := t.lastUsed[username]; ok && counter <= last {
+		return false
+	}
+	t.lastUsed[username] = counter
+	return true
+}
+
+func (t *totpPasscodesTracker) remove(username string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.lastUsed, username)
+}
+
+func getTOTPPasscode(secret []byte, counter uint64) string {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(buf) //nolint:errcheck
+	sum := mac.Sum(nil)
+	// dynamic truncation as defined in RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// validateTOTPPasscode returns the time step matching the given passcode, the adjacent
+// time steps are accepted too, to allow for clock drift
+func validateTOTPPasscode(secret, passcode string, t time.Time) (uint64, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, fmt.Errorf("invalid TOTP secret: %v", err)
+	}
+	passcode = strings.TrimSpace(passcode)
+	if len(passcode) != totpDigits {
+		return 0, errInvalidTOTP
+	}
+	current := uint64(t.Unix()) / totpPeriod
+	for i := -totpAllowedClockSteps; i <= totpAllowedClockSteps; i++ {
+		counter := current + uint64(i)
+		if subtle.ConstantTimeCompare([]byte(getTOTPPasscode(key, counter)), []byte(passcode)) == 1 {
+			return counter, nil
+		}
+	}
+	return 0, errInvalidTOTP
+}
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func getTOTPURI(username, secret string) string {
+	label := url.PathEscape(fmt.Sprintf("%v:%v", totpIssuer, username))
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%v", totpDigits))
+	params.Set("period", fmt.Sprintf("%v", totpPeriod))
+	return fmt.Sprintf("otpauth://totp/%v?%v", label, params.Encode())
+}
+
+func generateTOTPRecoveryCodes() ([]string, []string, error) {
+	var codes, hashes []string
+	for i := 0; i < totpRecoveryCodes; i++ {
+		buf := make([]byte, totpRecoveryCodeSize)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(buf)
+		codes = append(codes, code)
+		hashes = append(hashes, hashTOTPRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashTOTPRecoveryCode(code string) string {
+	h := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(h[:])
+}
+
+func validateTOTPConfig(user *User) error {
+	if user.TOTPConfig.Secret.IsEmpty() {
+		if user.TOTPConfig.Enabled {
+			return &ValidationError{err: "a TOTP secret is required if TOTP is enabled"}
+		}
+		user.TOTPConfig.RecoveryCodes = nil
+		return nil
+	}
+	secret := &user.TOTPConfig.Secret
+	if secret.IsPlain() {
+		secret.Payload = strings.ToUpper(secret.Payload)
+		if _, err := totpEncoding.DecodeString(secret.Payload); err != nil {
+			return &ValidationError{err: fmt.Sprintf("invalid TOTP secret: %v", err)}
+		}
+	}
+	if err := encryptSecret(secret); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not encrypt TOTP secret: %v", err)}
+	}
+	return nil
+}
+
+// checkTOTPPasscode validates the given passcode, or recovery code, for a user with TOTP enabled.
+// A used recovery code is removed from the user's recovery codes
+func checkTOTPPasscode(p Provider, user User, passcode string) error {
+	secret := user.TOTPConfig.Secret
+	if err := secret.Decrypt(); err != nil {
+		providerLog(logger.LevelWarn, "unable to decrypt TOTP secret for user %#v: %v", user.Username, err)
+		return err
+	}
+	counter, err := validateTOTPPasscode(secret.Payload, passcode, time.Now())
+	if err == nil {
+		if !totpUsedPasscodes.markUsed(user.Username, counter) {
+			return errors.New("TOTP passcode already used")
+		}
+		return nil
+	}
+	hash := hashTOTPRecoveryCode(passcode)
+	for _, code := range user.TOTPConfig.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(code), []byte(hash)) == 1 {
+			return useTOTPRecoveryCode(p, user.Username, hash)
+		}
+	}
+	return errInvalidTOTP
+}
+
+// removeRecoveryCode removes the given recovery code hash, an error is returned if the
+// hash is not found
+func (c *UserTOTPConfig) removeRecoveryCode(hash string) error {
+	var codes []string
+	for _, code := range c.RecoveryCodes {
+		if code != hash {
+			codes = append(codes, code)
+		}
+	}
+	if len(codes) == len(c.RecoveryCodes) {
+		return errTOTPRecoveryCodeUsed
+	}
+	c.RecoveryCodes = codes
+	return nil
+}
+
+// useTOTPRecoveryCode removes the given recovery code hash from the stored user.
+// Each provider removes the code atomically so it cannot be used twice
+func useTOTPRecoveryCode(p Provider, username, hash string) error {
+	if err := p.useTOTPRecoveryCode(username, hash); err != nil {
+		providerLog(logger.LevelWarn, "unable to remove the used TOTP recovery code for user %#v: %v", username, err)
+		return err
+	}
+	providerLog(logger.LevelInfo, "TOTP recovery code used for user %#v", username)
+	return nil
+}
+
+// GenerateTOTPSecret generates and saves a new TOTP secret for the given user.
+// TOTP is not enabled until the first passcode is verified using EnableTOTP
+func GenerateTOTPSecret(p Provider, username string) (TOTPEnrollment, error) {
+	var enrollment TOTPEnrollment
+	if config.ManageUsers == 0 {
+		return enrollment, &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	user, err := p.userExists(username)
+	if err != nil {
+		return enrollment, err
+	}
+	if user.TOTPConfig.Enabled {
+		return enrollment, &ValidationError{err: "TOTP is already enabled for this user, disable it first"}
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return enrollment, err
+	}
+	user.TOTPConfig = UserTOTPConfig{
+		Secret: kms.NewPlainSecret(secret),
+	}
+	if err = p.updateUser(user); err != nil {
+		return enrollment, err
+	}
+	enrollment.Secret = secret
+	enrollment.URI = getTOTPURI(username, secret)
+	return enrollment, nil
+}
+
+// EnableTOTP verifies the given passcode against the secret generated using GenerateTOTPSecret
+// and, if it matches, enables TOTP for the given user. The returned recovery codes cannot be
+// retrieved again
+func EnableTOTP(p Provider, username, passcode string) (TOTPRecoveryCodes, error) {
+	var result TOTPRecoveryCodes
+	if config.ManageUsers == 0 {
+		return result, &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	user, err := p.userExists(username)
+	if err != nil {
+		return result, err
+	}
+	if user.TOTPConfig.Enabled {
+		return result, &ValidationError{err: "TOTP is already enabled for this user"}
+	}
+	if user.TOTPConfig.Secret.IsEmpty() {
+		return result, &ValidationError{err: "no TOTP secret generated for this user"}
+	}
+	secret := user.TOTPConfig.Secret
+	if err = secret.Decrypt(); err != nil {
+		return result, err
+	}
+	counter, err := validateTOTPPasscode(secret.Payload, passcode, time.Now())
+	if err != nil {
+		return result, &ValidationError{err: err.Error()}
+	}
+	codes, hashes, err := generateTOTPRecoveryCodes()
+	if err != nil {
+		return result, err
+	}
+	user.TOTPConfig.Enabled = true
+	user.TOTPConfig.RecoveryCodes = hashes
+	if err = p.updateUser(user); err != nil {
+		return result, err
+	}
+	totpUsedPasscodes.remove(username)
+	totpUsedPasscodes.markUsed(username, counter)
+	result.RecoveryCodes = codes
+	return result, nil
+}
+
+// DisableTOTP disables TOTP for the given user and removes its secret and recovery codes
+func DisableTOTP(p Provider, username string) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	user, err := p.userExists(username)
+	if err != nil {
+		return err
+	}
+	user.TOTPConfig = UserTOTPConfig{}
+	if err = p.updateUser(user); err != nil {
+		return err
+	}
+	totpUsedPasscodes.remove(username)
+	return nil
+}
@@ -0,0 +1,100 @@
+package dataprovider
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/drakkan/sftpgo/kms"
+)
+
+func TestUseTOTPRecoveryCodeConcurrently(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "totp_recovery")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(basePath)
+	port, _ := strconv.Atoi(redisTestServer.Port())
+	configs := []Config{
+		{Driver: MemoryDataProviderName, CredentialsPath: "credentials"},
+		{Driver: BoltDataProviderName, Name: "totp.db", CredentialsPath: "credentials"},
+		{Driver: SQLiteDataProviderName, Name: "totp.sqlite", CredentialsPath: "credentials", UsersTable: "users"},
+		{Driver: RedisDataProviderName, Host: redisTestServer.Host(), Port: port, CredentialsPath: "credentials"},
+	}
+	state := saveProviderState()
+	defer state.activate()
+
+	for _, conf := range configs {
+		s, err := openMigrationProvider(conf, basePath, false)
+		if err != nil {
+			t.Fatalf("unable to open %v provider: %v", conf.Driver, err)
+		}
+		p := s.activate()
+		if conf.Driver == SQLiteDataProviderName {
+			if err = p.initializeDatabase(); err != nil {
+				t.Fatalf("unable to initialize sqlite provider: %v", err)
+			}
+			if err = p.migrateDatabase(); err != nil {
+				t.Fatalf("unable to migrate sqlite provider: %v", err)
+			}
+		}
+		secret, err := generateTOTPSecret()
+		if err != nil {
+			t.Fatalf("unable to generate TOTP secret: %v", err)
+		}
+		codes, hashes, err := generateTOTPRecoveryCodes()
+		if err != nil {
+			t.Fatalf("unable to generate recovery codes: %v", err)
+		}
+		user := getRedisTestUser("totp_recovery_user")
+		user.TOTPConfig = UserTOTPConfig{
+			Enabled:       true,
+			Secret:        kms.NewPlainSecret(secret),
+			RecoveryCodes: hashes,
+		}
+		if err = p.addUser(user); err != nil {
+			t.Fatalf("unable to add user to %v provider: %v", conf.Driver, err)
+		}
+		user, err = p.userExists(user.Username)
+		if err != nil {
+			t.Fatalf("unable to get user from %v provider: %v", conf.Driver, err)
+		}
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		successes := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if checkTOTPPasscode(p, user, codes[0]) == nil {
+					mu.Lock()
+					successes++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if successes != 1 {
+			t.Errorf("%v provider: the recovery code was used %v times", conf.Driver, successes)
+		}
+		if err = checkTOTPPasscode(p, user, codes[0]); err == nil {
+			t.Errorf("%v provider: a used recovery code must be rejected", conf.Driver)
+		}
+		if err = checkTOTPPasscode(p, user, codes[1]); err != nil {
+			t.Errorf("%v provider: unable to use an unused recovery code: %v", conf.Driver, err)
+		}
+		user, err = p.userExists(user.Username)
+		if err != nil {
+			t.Errorf("unable to get user from %v provider: %v", conf.Driver, err)
+		}
+		if len(user.TOTPConfig.RecoveryCodes) != len(hashes)-2 {
+			t.Errorf("%v provider: unexpected recovery codes: %v", conf.Driver, user.TOTPConfig.RecoveryCodes)
+		}
+		if err = p.deleteUser(user); err != nil {
+			t.Errorf("unable to delete user from %v provider: %v", conf.Driver, err)
+		}
+		s.close()
+	}
+}
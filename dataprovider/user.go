@@ -1,8 +1,11 @@
 package dataprovider
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"path"
@@ -11,6 +14,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/vfs"
@@ -50,8 +54,16 @@ const (
 	SSHLoginMethodPublicKey           = "publickey"
 	SSHLoginMethodPassword            = "password"
 	SSHLoginMethodKeyboardInteractive = "keyboard-interactive"
+	SSHLoginMethodPublicKeyCert       = "publickey-cert"
+	// multi-step login methods: a public key followed by a password or by
+	// keyboard interactive authentication
+	SSHLoginMethodKeyAndPassword    = "publickey,password"
+	SSHLoginMethodKeyAndKeyboardInt = "publickey,keyboard-interactive"
 )
 
+// SSHMultiStepsLoginMethods defines the login methods combinations that can be required
+var SSHMultiStepsLoginMethods = []string{SSHLoginMethodKeyAndPassword, SSHLoginMethodKeyAndKeyboardInt}
+
 // ExtensionsFilter defines filters based on file extensions.
 // These restrictions do not apply to files listing for performance reasons, so
 // a denied file cannot be downloaded/overwritten/renamed but will still be
@@ -87,6 +99,10 @@ type UserFilters struct {
 	// these login methods are not allowed.
 	// If null or empty any available login method is allowed
 	DeniedLoginMethods []string `json:"denied_login_methods,omitempty"`
+	// login methods combinations required to authenticate, for example "publickey,password".
+	// If not empty, a single login method is not enough and the user must authenticate using
+	// one of these combinations
+	RequiredLoginMethods []string `json:"required_login_methods,omitempty"`
 	// filters based on file extensions.
 	// Please note that these restrictions can be easily bypassed.
 	FileExtensions []ExtensionsFilter `json:"file_extensions,omitempty"`
@@ -94,10 +110,140 @@ type UserFilters struct {
 
 // Filesystem defines cloud storage filesystem details
 type Filesystem struct {
-	// 0 local filesystem, 1 Amazon S3 compatible, 2 Google Cloud Storage
-	Provider  int             `json:"provider"`
-	S3Config  vfs.S3FsConfig  `json:"s3config,omitempty"`
-	GCSConfig vfs.GCSFsConfig `json:"gcsconfig,omitempty"`
+	// 0 local filesystem, 1 Amazon S3 compatible, 2 Google Cloud Storage, 3 Azure Blob Storage,
+	// 4 SFTP
+	Provider     int                `json:"provider"`
+	S3Config     vfs.S3FsConfig     `json:"s3config,omitempty"`
+	GCSConfig    vfs.GCSFsConfig    `json:"gcsconfig,omitempty"`
+	AzBlobConfig vfs.AzBlobFsConfig `json:"azblobconfig,omitempty"`
+	SFTPConfig   vfs.SFTPFsConfig   `json:"sftpconfig,omitempty"`
+	// client side encryption, supported for all the providers
+	CryptConfig vfs.CryptFsConfig `json:"cryptconfig,omitempty"`
+}
+
+// isDefault returns true for the local filesystem without client side encryption
+func (f *Filesystem) isDefault() bool {
+	return f.Provider == 0 && f.CryptConfig.Passphrase.IsEmpty()
+}
+
+// getRemoteFs returns the filesystem for the cloud and SFTP storage backends.
+// The local directory is used for temporary files
+func (f *Filesystem) getRemoteFs(connectionID, localTempDir, gcsCredentialsFile string) (vfs.Fs, error) {
+	switch f.Provider {
+	case 1:
+		return vfs.NewS3Fs(connectionID, localTempDir, f.S3Config)
+	case 2:
+		config := f.GCSConfig
+		config.CredentialFile = gcsCredentialsFile
+		config.Credentials = kms.Secret{}
+		if config.AutomaticCredentials == 0 {
+			credentials, err := readGCSCredentials(gcsCredentialsFile)
+			if err != nil {
+				return nil, err
+			}
+			config.Credentials = credentials
+		}
+		return vfs.NewGCSFs(connectionID, localTempDir, config)
+	case 3:
+		return vfs.NewAzBlobFs(connectionID, localTempDir, f.AzBlobConfig)
+	case 4:
+		return vfs.NewSFTPFs(connectionID, localTempDir, f.SFTPConfig)
+	}
+	return nil, fmt.Errorf("unsupported storage provider: %v", f.Provider)
+}
+
+// hideSensitiveData redacts the secrets, the GCS credentials are removed
+func (f *Filesystem) hideSensitiveData() {
+	if f.Provider == 1 {
+		f.S3Config.AccessSecret = f.S3Config.AccessSecret.Redacted()
+	} else if f.Provider == 2 {
+		f.GCSConfig.Credentials = kms.Secret{}
+	} else if f.Provider == 3 {
+		f.AzBlobConfig.AccountKey = f.AzBlobConfig.AccountKey.Redacted()
+	} else if f.Provider == 4 {
+		f.SFTPConfig.Password = f.SFTPConfig.Password.Redacted()
+		f.SFTPConfig.PrivateKey = f.SFTPConfig.PrivateKey.Redacted()
+	}
+	f.CryptConfig.Passphrase = f.CryptConfig.Passphrase.Redacted()
+}
+
+func (f *Filesystem) getACopy() Filesystem {
+	fsConfig := Filesystem{
+		Provider: f.Provider,
+		S3Config: vfs.S3FsConfig{
+			Bucket:            f.S3Config.Bucket,
+			Region:            f.S3Config.Region,
+			AccessKey:         f.S3Config.AccessKey,
+			AccessSecret:      f.S3Config.AccessSecret,
+			Endpoint:          f.S3Config.Endpoint,
+			StorageClass:      f.S3Config.StorageClass,
+			KeyPrefix:         f.S3Config.KeyPrefix,
+			UploadPartSize:    f.S3Config.UploadPartSize,
+			UploadConcurrency: f.S3Config.UploadConcurrency,
+		},
+		GCSConfig: vfs.GCSFsConfig{
+			Bucket:               f.GCSConfig.Bucket,
+			CredentialFile:       f.GCSConfig.CredentialFile,
+			AutomaticCredentials: f.GCSConfig.AutomaticCredentials,
+			StorageClass:         f.GCSConfig.StorageClass,
+			KeyPrefix:            f.GCSConfig.KeyPrefix,
+		},
+		AzBlobConfig: vfs.AzBlobFsConfig{
+			Container:         f.AzBlobConfig.Container,
+			AccountName:       f.AzBlobConfig.AccountName,
+			AccountKey:        f.AzBlobConfig.AccountKey,
+			Endpoint:          f.AzBlobConfig.Endpoint,
+			SASURL:            f.AzBlobConfig.SASURL,
+			KeyPrefix:         f.AzBlobConfig.KeyPrefix,
+			UploadPartSize:    f.AzBlobConfig.UploadPartSize,
+			UploadConcurrency: f.AzBlobConfig.UploadConcurrency,
+			UseEmulator:       f.AzBlobConfig.UseEmulator,
+			AccessTier:        f.AzBlobConfig.AccessTier,
+		},
+		SFTPConfig: vfs.SFTPFsConfig{
+			Endpoint:     f.SFTPConfig.Endpoint,
+			Username:     f.SFTPConfig.Username,
+			Password:     f.SFTPConfig.Password,
+			PrivateKey:   f.SFTPConfig.PrivateKey,
+			Fingerprints: make([]string, len(f.SFTPConfig.Fingerprints)),
+			Prefix:       f.SFTPConfig.Prefix,
+		},
+	}
+	copy(fsConfig.SFTPConfig.Fingerprints, f.SFTPConfig.Fingerprints)
+	fsConfig.CryptConfig = vfs.CryptFsConfig{
+		Passphrase: f.CryptConfig.Passphrase,
+	}
+	return fsConfig
+}
+
+// VirtualFolder defines a virtual folder: a virtual path exposed to the SFTP/SCP
+// clients and the storage backend used for its files.
+// For the local filesystem the files are stored inside the mapped path, the
+// other storage backends are configured using the filesystem details.
+// A virtual folder has its own quota, it is not included in the user's one
+type VirtualFolder struct {
+	vfs.VirtualFolder
+	// Maximum size allowed as bytes. 0 means unlimited
+	QuotaSize int64 `json:"quota_size"`
+	// Maximum number of files allowed. 0 means unlimited
+	QuotaFiles int `json:"quota_files"`
+	// Storage backend for this folder, the local filesystem is the default
+	FsConfig Filesystem `json:"filesystem"`
+}
+
+// HasQuotaRestrictions returns true if there is a quota restriction on number of files or size or both
+func (v *VirtualFolder) HasQuotaRestrictions() bool {
+	return v.QuotaFiles > 0 || v.QuotaSize > 0
+}
+
+// VirtualFolderQuota defines the used quota for a virtual folder
+type VirtualFolderQuota struct {
+	// Used quota as bytes
+	UsedQuotaSize int64 `json:"used_quota_size"`
+	// Used quota as number of files
+	UsedQuotaFiles int `json:"used_quota_files"`
+	// Last quota update as unix timestamp in milliseconds
+	LastQuotaUpdate int64 `json:"last_quota_update"`
 }
 
 // User defines an SFTP user
@@ -119,8 +265,9 @@ type User struct {
 	PublicKeys []string `json:"public_keys,omitempty"`
 	// The user cannot upload or download files outside this directory. Must be an absolute path
 	HomeDir string `json:"home_dir"`
-	// Mapping between virtual paths and filesystem paths outside the home directory. Supported for local filesystem only
-	VirtualFolders []vfs.VirtualFolder `json:"virtual_folders,omitempty"`
+	// Virtual folders, mapped to filesystem paths outside the home directory or
+	// stored using a different storage backend
+	VirtualFolders []VirtualFolder `json:"virtual_folders,omitempty"`
 	// If sftpgo runs as root system user then the created files and directories will be assigned to this system UID
 	UID int `json:"uid"`
 	// If sftpgo runs as root system user then the created files and directories will be assigned to this system GID
@@ -139,6 +286,8 @@ type User struct {
 	UsedQuotaFiles int `json:"used_quota_files"`
 	// Last quota update as unix timestamp in milliseconds
 	LastQuotaUpdate int64 `json:"last_quota_update"`
+	// Used quota for the virtual folders, the map key is the virtual path
+	FoldersQuota map[string]VirtualFolderQuota `json:"folders_quota,omitempty"`
 	// Maximum upload bandwidth as KB/s, 0 means unlimited
 	UploadBandwidth int64 `json:"upload_bandwidth"`
 	// Maximum download bandwidth as KB/s, 0 means unlimited
@@ -149,18 +298,112 @@ type User struct {
 	Filters UserFilters `json:"filters"`
 	// Filesystem configuration details
 	FsConfig Filesystem `json:"filesystem"`
+	// Groups the user belongs to, at most one primary group is allowed.
+	// The settings inherited from the groups are applied when the user logs in
+	Groups []UserGroup `json:"groups,omitempty"`
+	// Time-based one-time password configuration, it is managed using the dedicated REST API
+	TOTPConfig UserTOTPConfig `json:"totp_config"`
 }
 
-// GetFilesystem returns the filesystem for this user
+// GetFilesystem returns the filesystem for this user.
+// If a passphrase is configured the filesystem is wrapped inside a CryptFs
 func (u *User) GetFilesystem(connectionID string) (vfs.Fs, error) {
-	if u.FsConfig.Provider == 1 {
-		return vfs.NewS3Fs(connectionID, u.GetHomeDir(), u.FsConfig.S3Config)
-	} else if u.FsConfig.Provider == 2 {
-		config := u.FsConfig.GCSConfig
-		config.CredentialFile = u.getGCSCredentialsFilePath()
-		return vfs.NewGCSFs(connectionID, u.GetHomeDir(), config)
+	fs, err := u.getBaseFilesystem(connectionID)
+	if err != nil || u.FsConfig.CryptConfig.Passphrase.IsEmpty() {
+		return fs, err
+	}
+	return vfs.NewCryptFs(fs, u.GetHomeDir(), u.FsConfig.CryptConfig)
+}
+
+func (u *User) getBaseFilesystem(connectionID string) (vfs.Fs, error) {
+	if u.FsConfig.Provider == 0 {
+		return vfs.NewOsFs(connectionID, u.GetHomeDir(), u.getMappedFolders()), nil
+	}
+	return u.FsConfig.getRemoteFs(connectionID, u.GetHomeDir(), u.getGCSCredentialsFilePath())
+}
+
+// GetVirtualFolderFilesystem returns the filesystem for the given virtual folder.
+// Folders mapped inside the user's local filesystem are encrypted using the user's
+// passphrase, the other ones using their own passphrase, if any
+func (u *User) GetVirtualFolderFilesystem(connectionID string, folder VirtualFolder) (vfs.Fs, error) {
+	var fs vfs.Fs
+	cryptConfig := folder.FsConfig.CryptConfig
+	if folder.FsConfig.Provider == 0 {
+		fs = vfs.NewOsFs(connectionID, folder.MappedPath, nil)
+		if u.IsMappedVirtualFolder(folder) {
+			cryptConfig = u.FsConfig.CryptConfig
+		}
+	} else {
+		var err error
+		fs, err = folder.FsConfig.getRemoteFs(connectionID, u.GetHomeDir(),
+			u.getFolderGCSCredentialsFilePath(folder.VirtualPath))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cryptConfig.Passphrase.IsEmpty() {
+		return fs, nil
+	}
+	return vfs.NewCryptFs(fs, u.GetHomeDir(), cryptConfig)
+}
+
+// IsMappedVirtualFolder returns true if the given virtual folder is served by the
+// user's local filesystem: a folder on the local filesystem without its own
+// encryption settings for a user with a local home directory
+func (u *User) IsMappedVirtualFolder(folder VirtualFolder) bool {
+	return u.FsConfig.Provider == 0 && folder.FsConfig.isDefault()
+}
+
+// GetVirtualFolderForPath returns the virtual folder containing the given SFTP path.
+// If the path is inside nested virtual folders the deepest one is returned
+func (u *User) GetVirtualFolderForPath(sftpPath string) (VirtualFolder, error) {
+	var folder VirtualFolder
+	if len(u.VirtualFolders) == 0 {
+		return folder, errNoMatchingVirtualFolder
+	}
+	dirsForPath := utils.GetDirsForSFTPPath(sftpPath)
+	for _, val := range dirsForPath {
+		for _, v := range u.VirtualFolders {
+			if v.VirtualPath == val {
+				return v, nil
+			}
+		}
+	}
+	return folder, errNoMatchingVirtualFolder
+}
+
+func (u *User) getMappedFolders() []vfs.VirtualFolder {
+	var folders []vfs.VirtualFolder
+	for _, v := range u.VirtualFolders {
+		if u.IsMappedVirtualFolder(v) {
+			folders = append(folders, v.VirtualFolder)
+		}
+	}
+	return folders
+}
+
+// updateFolderQuota updates the used quota for the folder with the given virtual path.
+// If reset is true filesAdd and sizeAdd are the total files and the total size
+func (u *User) updateFolderQuota(virtualPath string, filesAdd int, sizeAdd int64, reset bool) {
+	if u.FoldersQuota == nil {
+		u.FoldersQuota = make(map[string]VirtualFolderQuota)
 	}
-	return vfs.NewOsFs(connectionID, u.GetHomeDir(), u.VirtualFolders), nil
+	quota := u.FoldersQuota[virtualPath]
+	if reset {
+		quota.UsedQuotaSize = sizeAdd
+		quota.UsedQuotaFiles = filesAdd
+	} else {
+		quota.UsedQuotaSize += sizeAdd
+		quota.UsedQuotaFiles += filesAdd
+	}
+	quota.LastQuotaUpdate = utils.GetTimeAsMsSinceEpoch(time.Now())
+	u.FoldersQuota[virtualPath] = quota
+}
+
+// getUsedFolderQuota returns the used quota for the folder with the given virtual path
+func (u *User) getUsedFolderQuota(virtualPath string) (int, int64) {
+	quota := u.FoldersQuota[virtualPath]
+	return quota.UsedQuotaFiles, quota.UsedQuotaSize
 }
 
 // GetPermissionsForPath returns the permissions for the given path.
@@ -246,17 +489,68 @@ func (u *User) HasPerms(permissions []string, path string) bool {
 	return true
 }
 
-// IsLoginMethodAllowed returns true if the specified login method is allowed for the user
+// IsLoginMethodAllowed returns true if the specified login method is allowed for the user.
+// The login methods combinations are allowed only if required and, if they are required,
+// the single login methods are not allowed
 func (u *User) IsLoginMethodAllowed(loginMetod string) bool {
+	if len(u.Filters.RequiredLoginMethods) > 0 || utils.IsStringInSlice(loginMetod, SSHMultiStepsLoginMethods) {
+		if !utils.IsStringInSlice(loginMetod, u.Filters.RequiredLoginMethods) {
+			return false
+		}
+	}
 	if len(u.Filters.DeniedLoginMethods) == 0 {
 		return true
 	}
 	if utils.IsStringInSlice(loginMetod, u.Filters.DeniedLoginMethods) {
 		return false
 	}
+	// a certificate is a public key at the SSH protocol level, denying public keys
+	// denies certificates too
+	if loginMetod == SSHLoginMethodPublicKeyCert &&
+		utils.IsStringInSlice(SSHLoginMethodPublicKey, u.Filters.DeniedLoginMethods) {
+		return false
+	}
 	return true
 }
 
+// IsPartialAuth returns true if a successful authentication using the specified login method
+// is only the first step for the user: a public key is accepted only as the first step of the
+// required login methods combinations
+func (u *User) IsPartialAuth(loginMethod string) bool {
+	if loginMethod != SSHLoginMethodPublicKey {
+		return false
+	}
+	return len(u.GetNextAuthMethods()) > 0
+}
+
+// GetNextAuthMethods returns the login methods allowed to complete the authentication
+// after a successful public key authentication
+func (u *User) GetNextAuthMethods() []string {
+	var methods []string
+	for _, method := range u.Filters.RequiredLoginMethods {
+		if !u.IsLoginMethodAllowed(method) {
+			continue
+		}
+		switch method {
+		case SSHLoginMethodKeyAndPassword:
+			methods = append(methods, SSHLoginMethodPassword)
+		case SSHLoginMethodKeyAndKeyboardInt:
+			methods = append(methods, SSHLoginMethodKeyboardInteractive)
+		}
+	}
+	return methods
+}
+
+// hasAllowedLoginMethods returns true if at least a login method is allowed
+func (u *User) hasAllowedLoginMethods() bool {
+	for _, method := range ValidSSHLoginMethods {
+		if u.IsLoginMethodAllowed(method) {
+			return true
+		}
+	}
+	return false
+}
+
 // IsFileAllowed returns true if the specified file is allowed by the file restrictions filters
 func (u *User) IsFileAllowed(sftpPath string) bool {
 	if len(u.Filters.FileExtensions) == 0 {
@@ -352,6 +646,16 @@ func (u *User) GetVirtualFoldersAsJSON() ([]byte, error) {
 	return json.Marshal(u.VirtualFolders)
 }
 
+// GetGroupsAsJSON returns the groups memberships as json byte array
+func (u *User) GetGroupsAsJSON() ([]byte, error) {
+	return json.Marshal(u.Groups)
+}
+
+// GetTOTPConfigAsJSON returns the TOTP configuration as json byte array
+func (u *User) GetTOTPConfigAsJSON() ([]byte, error) {
+	return json.Marshal(u.TOTPConfig)
+}
+
 // GetUID returns a validate uid, suitable for use with os.Chown
 func (u *User) GetUID() int {
 	if u.UID <= 0 || u.UID > 65535 {
@@ -452,6 +756,13 @@ func (u *User) GetInfoString() string {
 		result += fmt.Sprintf("Storage: S3 ")
 	} else if u.FsConfig.Provider == 2 {
 		result += fmt.Sprintf("Storage: GCS ")
+	} else if u.FsConfig.Provider == 3 {
+		result += fmt.Sprintf("Storage: Azure ")
+	} else if u.FsConfig.Provider == 4 {
+		result += fmt.Sprintf("Storage: SFTP ")
+	}
+	if !u.FsConfig.CryptConfig.Passphrase.IsEmpty() {
+		result += "Encrypted "
 	}
 	if len(u.PublicKeys) > 0 {
 		result += fmt.Sprintf("Public keys: %v ", len(u.PublicKeys))
@@ -510,14 +821,30 @@ func (u User) GetDeniedIPAsString() string {
 func (u *User) getACopy() User {
 	pubKeys := make([]string, len(u.PublicKeys))
 	copy(pubKeys, u.PublicKeys)
-	virtualFolders := make([]vfs.VirtualFolder, len(u.VirtualFolders))
-	copy(virtualFolders, u.VirtualFolders)
+	virtualFolders := make([]VirtualFolder, 0, len(u.VirtualFolders))
+	for _, v := range u.VirtualFolders {
+		folder := v
+		folder.FsConfig = v.FsConfig.getACopy()
+		virtualFolders = append(virtualFolders, folder)
+	}
+	var foldersQuota map[string]VirtualFolderQuota
+	if u.FoldersQuota != nil {
+		foldersQuota = make(map[string]VirtualFolderQuota)
+		for k, v := range u.FoldersQuota {
+			foldersQuota[k] = v
+		}
+	}
 	permissions := make(map[string][]string)
 	for k, v := range u.Permissions {
 		perms := make([]string, len(v))
 		copy(perms, v)
 		permissions[k] = perms
 	}
+	groups := make([]UserGroup, len(u.Groups))
+	copy(groups, u.Groups)
+	totpConfig := u.TOTPConfig
+	totpConfig.RecoveryCodes = make([]string, len(u.TOTPConfig.RecoveryCodes))
+	copy(totpConfig.RecoveryCodes, u.TOTPConfig.RecoveryCodes)
 	filters := UserFilters{}
 	filters.AllowedIP = make([]string, len(u.Filters.AllowedIP))
 	copy(filters.AllowedIP, u.Filters.AllowedIP)
@@ -525,30 +852,10 @@ func (u *User) getACopy() User {
 	copy(filters.DeniedIP, u.Filters.DeniedIP)
 	filters.DeniedLoginMethods = make([]string, len(u.Filters.DeniedLoginMethods))
 	copy(filters.DeniedLoginMethods, u.Filters.DeniedLoginMethods)
+	filters.RequiredLoginMethods = make([]string, len(u.Filters.RequiredLoginMethods))
+	copy(filters.RequiredLoginMethods, u.Filters.RequiredLoginMethods)
 	filters.FileExtensions = make([]ExtensionsFilter, len(u.Filters.FileExtensions))
 	copy(filters.FileExtensions, u.Filters.FileExtensions)
-	fsConfig := Filesystem{
-		Provider: u.FsConfig.Provider,
-		S3Config: vfs.S3FsConfig{
-			Bucket:            u.FsConfig.S3Config.Bucket,
-			Region:            u.FsConfig.S3Config.Region,
-			AccessKey:         u.FsConfig.S3Config.AccessKey,
-			AccessSecret:      u.FsConfig.S3Config.AccessSecret,
-			Endpoint:          u.FsConfig.S3Config.Endpoint,
-			StorageClass:      u.FsConfig.S3Config.StorageClass,
-			KeyPrefix:         u.FsConfig.S3Config.KeyPrefix,
-			UploadPartSize:    u.FsConfig.S3Config.UploadPartSize,
-			UploadConcurrency: u.FsConfig.S3Config.UploadConcurrency,
-		},
-		GCSConfig: vfs.GCSFsConfig{
-			Bucket:               u.FsConfig.GCSConfig.Bucket,
-			CredentialFile:       u.FsConfig.GCSConfig.CredentialFile,
-			AutomaticCredentials: u.FsConfig.GCSConfig.AutomaticCredentials,
-			StorageClass:         u.FsConfig.GCSConfig.StorageClass,
-			KeyPrefix:            u.FsConfig.GCSConfig.KeyPrefix,
-		},
-	}
-
 	return User{
 		ID:                u.ID,
 		Username:          u.Username,
@@ -565,13 +872,16 @@ func (u *User) getACopy() User {
 		UsedQuotaSize:     u.UsedQuotaSize,
 		UsedQuotaFiles:    u.UsedQuotaFiles,
 		LastQuotaUpdate:   u.LastQuotaUpdate,
+		FoldersQuota:      foldersQuota,
 		UploadBandwidth:   u.UploadBandwidth,
 		DownloadBandwidth: u.DownloadBandwidth,
 		Status:            u.Status,
 		ExpirationDate:    u.ExpirationDate,
 		LastLogin:         u.LastLogin,
 		Filters:           filters,
-		FsConfig:          fsConfig,
+		FsConfig:          u.FsConfig.getACopy(),
+		Groups:            groups,
+		TOTPConfig:        totpConfig,
 	}
 }
 
@@ -607,3 +917,25 @@ func (u *User) getNotificationFieldsAsEnvVars(action string) []string {
 func (u *User) getGCSCredentialsFilePath() string {
 	return filepath.Join(credentialsDirPath, fmt.Sprintf("%v_gcs_credentials.json", u.Username))
 }
+
+// getFolderGCSCredentialsFilePath returns the path for the GCS credentials of the virtual folder
+// with the given virtual path. The virtual path is hashed, this way the file name is always valid
+func (u *User) getFolderGCSCredentialsFilePath(virtualPath string) string {
+	hash := sha256.Sum256([]byte(virtualPath))
+	return filepath.Join(credentialsDirPath, fmt.Sprintf("%v_folder_%x_gcs_credentials.json", u.Username, hash[:16]))
+}
+
+// readGCSCredentials returns the GCS credentials stored inside the given file. The file contains
+// the encrypted secret as JSON but it could contain the plain text credentials saved by older
+// versions, they are returned as a plain secret with the base64 encoded credentials
+func readGCSCredentials(filePath string) (kms.Secret, error) {
+	var credentials kms.Secret
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return credentials, err
+	}
+	if err = json.Unmarshal(content, &credentials); err == nil && credentials.IsEncrypted() {
+		return credentials, nil
+	}
+	return kms.NewPlainSecret(base64.StdEncoding.EncodeToString(content)), nil
+}
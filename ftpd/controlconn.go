@@ -0,0 +1,160 @@
+package ftpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+)
+
+// FTP reply codes not defined inside ftpserverlib
+const (
+	statusBadSequence        = 503 // RFC 959, 4.2.1
+	statusDataConnNotAllowed = 521 // RFC 4217, 9
+	statusPolicyDenied       = 534 // RFC 2228, 3
+)
+
+const (
+	protPRequiredMessage   = "Data connections must be encrypted, please use PROT P"
+	alreadySecuredMessage  = "The connection is already secured"
+	protCNotAllowedMessage = "Clear data connections are not allowed, please use PROT P"
+)
+
+// tlsRequiredListener wraps the control connections listener so the TLS policy is enforced
+// before the commands reach ftpserverlib
+type tlsRequiredListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+	isTLS     bool
+}
+
+// Accept waits for and returns the next control connection
+func (l *tlsRequiredListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	return newTLSRequiredConn(conn, l.tlsConfig, l.isTLS), nil
+}
+
+// tlsRequiredConn is a control connection that requires TLS.
+// ftpserverlib cannot refuse USER and PASS on a plain connection or clear data connections
+// so the commands are inspected here: USER and PASS are rejected until the client
+// secures the connection using AUTH TLS and the data connection commands are rejected
+// until the client requests encrypted data connections using PROT P.
+// The explicit TLS negotiation is handled here too, this way the commands sent after
+// AUTH TLS can be inspected as well
+type tlsRequiredConn struct {
+	net.Conn
+	// conn is the connection used to read commands and write replies, it is the TLS
+	// connection after a successful AUTH TLS
+	conn      net.Conn
+	reader    *bufio.Reader
+	tlsConfig *tls.Config
+	isTLS     bool
+	isProtP   bool
+	// commands to pass to ftpserverlib
+	buf     []byte
+	readErr error
+}
+
+func newTLSRequiredConn(conn net.Conn, tlsConfig *tls.Config, isTLS bool) *tlsRequiredConn {
+	return &tlsRequiredConn{
+		Conn:      conn,
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		tlsConfig: tlsConfig,
+		isTLS:     isTLS,
+	}
+}
+
+// Read returns the allowed commands, the denied ones are answered here and
+// ftpserverlib will never see them
+func (c *tlsRequiredConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		line, err := c.reader.ReadString('\n')
+		if len(line) > 0 {
+			c.filterCommand(line)
+		}
+		if err != nil && c.readErr == nil {
+			c.readErr = err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Write writes a reply to the client
+func (c *tlsRequiredConn) Write(p []byte) (int, error) {
+	return c.conn.Write(p)
+}
+
+// Close closes the connection
+func (c *tlsRequiredConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *tlsRequiredConn) filterCommand(line string) {
+	params := strings.SplitN(strings.Trim(line, "\r\n"), " ", 2)
+	command := strings.ToUpper(params[0])
+	param := ""
+	if len(params) > 1 {
+		param = strings.ToUpper(strings.TrimSpace(params[1]))
+	}
+	switch command {
+	case "AUTH":
+		if c.isTLS {
+			c.reply(statusBadSequence, alreadySecuredMessage)
+			return
+		}
+		c.secure()
+		return
+	case "USER", "PASS":
+		if !c.isTLS {
+			c.reply(ftpserver.StatusNotLoggedIn, errTLSRequired.Error())
+			return
+		}
+	case "PROT":
+		if param != "P" {
+			c.reply(statusPolicyDenied, protCNotAllowedMessage)
+			return
+		}
+		c.isProtP = true
+	case "PASV", "EPSV", "PORT", "EPRT":
+		if !c.isProtP {
+			c.reply(statusDataConnNotAllowed, protPRequiredMessage)
+			return
+		}
+	}
+	c.buf = append(c.buf, line...)
+}
+
+// secure negotiates TLS on a plain control connection after an AUTH command
+func (c *tlsRequiredConn) secure() {
+	if c.tlsConfig == nil {
+		c.reply(ftpserver.StatusActionNotTaken, fmt.Sprintf("Cannot get a TLS config: %v", errNoTLSCertificate))
+		return
+	}
+	c.reply(ftpserver.StatusAuthAccepted, "AUTH command ok. Expecting TLS Negotiation.")
+	tlsConn := tls.Server(c.Conn, c.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		c.readErr = err
+		return
+	}
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	c.isTLS = true
+}
+
+func (c *tlsRequiredConn) reply(code int, message string) {
+	if _, err := fmt.Fprintf(c.conn, "%d %s\r\n", code, message); err != nil && c.readErr == nil {
+		c.readErr = err
+	}
+}
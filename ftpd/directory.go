@@ -0,0 +1,108 @@
+package ftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	errIsDirectory = errors.New("operation not supported for a directory")
+)
+
+// directory is the afero.File returned to ftpserverlib to list a directory.
+// The directory contents are read, using the SFTP connection, when it is opened
+type directory struct {
+	name  string
+	files []os.FileInfo
+}
+
+func newDirectory(name string, files []os.FileInfo) *directory {
+	return &directory{
+		name:  name,
+		files: files,
+	}
+}
+
+// Name returns the name of the directory
+func (d *directory) Name() string {
+	return d.name
+}
+
+// Readdir returns up to count directory entries, all the remaining ones if count <= 0
+func (d *directory) Readdir(count int) ([]os.FileInfo, error) {
+	if count <= 0 {
+		files := d.files
+		d.files = nil
+		return files, nil
+	}
+	if len(d.files) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.files) {
+		count = len(d.files)
+	}
+	files := d.files[:count]
+	d.files = d.files[count:]
+	return files, nil
+}
+
+// Readdirnames returns up to n directory entry names, all the remaining ones if n <= 0
+func (d *directory) Readdirnames(n int) ([]string, error) {
+	files, err := d.Readdir(n)
+	names := make([]string, 0, len(files))
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	return names, err
+}
+
+// Stat is not implemented
+func (d *directory) Stat() (os.FileInfo, error) {
+	return nil, errNotImplemented
+}
+
+// Read is not supported for a directory
+func (d *directory) Read(p []byte) (int, error) {
+	return 0, errIsDirectory
+}
+
+// ReadAt is not supported for a directory
+func (d *directory) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errIsDirectory
+}
+
+// Write is not supported for a directory
+func (d *directory) Write(p []byte) (int, error) {
+	return 0, errIsDirectory
+}
+
+// WriteAt is not supported for a directory
+func (d *directory) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errIsDirectory
+}
+
+// WriteString is not supported for a directory
+func (d *directory) WriteString(s string) (int, error) {
+	return 0, errIsDirectory
+}
+
+// Seek is not supported for a directory
+func (d *directory) Seek(offset int64, whence int) (int64, error) {
+	return 0, errIsDirectory
+}
+
+// Truncate is not supported for a directory
+func (d *directory) Truncate(size int64) error {
+	return errIsDirectory
+}
+
+// Sync is a no-op
+func (d *directory) Sync() error {
+	return nil
+}
+
+// Close is a no-op
+func (d *directory) Close() error {
+	return nil
+}
@@ -0,0 +1,117 @@
+// Package ftpd implements the FTP protocol, with optional explicit and implicit TLS support.
+// It uses ftpserverlib:
+// https://github.com/fclairamb/ftpserverlib
+// Users, permissions, quotas and storage backends are shared with the SFTP server.
+package ftpd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	logSender   = "ftpd"
+	protocolFTP = "FTP"
+)
+
+var (
+	dataProvider dataprovider.Provider
+	certMgr      *utils.CertManager
+)
+
+// PortRange defines a port range
+type PortRange struct {
+	// Range start
+	Start int `json:"start" mapstructure:"start"`
+	// Range end
+	End int `json:"end" mapstructure:"end"`
+}
+
+// Configuration defines the configuration for the FTP server
+type Configuration struct {
+	// The port used for serving FTP requests. 0 means disabled
+	BindPort int `json:"bind_port" mapstructure:"bind_port"`
+	// The address to listen on. A blank value means listen on all available network interfaces.
+	BindAddress string `json:"bind_address" mapstructure:"bind_address"`
+	// Greeting banner displayed when a connection first comes in
+	Banner string `json:"banner" mapstructure:"banner"`
+	// External IP address to expose for passive connections.
+	// Leave empty to autodetect it
+	ForcePassiveIP string `json:"force_passive_ip" mapstructure:"force_passive_ip"`
+	// Port Range for data connections. Random if not specified
+	PassivePortRange PortRange `json:"passive_port_range" mapstructure:"passive_port_range"`
+	// Maximum time, in seconds, to establish passive or active data connections.
+	// 0 means the ftpserverlib default: 30 seconds
+	ConnectionTimeout int `json:"connection_timeout" mapstructure:"connection_timeout"`
+	// If files containing a certificate and matching private key for the server are provided the server will
+	// accept both plain FTP an explicit FTP over TLS.
+	// Certificate and key files can be reloaded on demand sending a "SIGHUP" signal on Unix based systems and
+	// a "paramchange" request to the running service on Windows.
+	CertificateFile    string `json:"certificate_file" mapstructure:"certificate_file"`
+	CertificateKeyFile string `json:"certificate_key_file" mapstructure:"certificate_key_file"`
+	// TLSMode defines the TLS mode, it requires a certificate and a private key:
+	// 0 plain FTP and explicit FTP over TLS are both allowed
+	// 1 explicit FTP over TLS is required, plain FTP connections are rejected
+	// 2 implicit FTP over TLS
+	// With modes 1 and 2 encrypted data connections, PROT P, are required too
+	TLSMode int `json:"tls_mode" mapstructure:"tls_mode"`
+}
+
+// SetDataProvider sets the data provider to use to authenticate users
+func SetDataProvider(provider dataprovider.Provider) {
+	dataProvider = provider
+}
+
+// Initialize configures and starts the FTP server
+func (c Configuration) Initialize(configDir string) error {
+	logger.Debug(logSender, "", "initializing FTP server with config %+v", c)
+	if c.BindPort <= 0 {
+		return fmt.Errorf("invalid bind port %v", c.BindPort)
+	}
+	if c.ConnectionTimeout < 0 {
+		return fmt.Errorf("invalid connection timeout %v", c.ConnectionTimeout)
+	}
+	if c.TLSMode < 0 || c.TLSMode > 2 {
+		return fmt.Errorf("unsupported TLS mode: %v", c.TLSMode)
+	}
+	server := newServer(c)
+	certificateFile := getConfigPath(c.CertificateFile, configDir)
+	certificateKeyFile := getConfigPath(c.CertificateKeyFile, configDir)
+	if len(certificateFile) > 0 && len(certificateKeyFile) > 0 {
+		var err error
+		certMgr, err = utils.NewCertManager(certificateFile, certificateKeyFile)
+		if err != nil {
+			return err
+		}
+	} else if c.TLSMode > 0 {
+		return fmt.Errorf("TLS mode %v requires a certificate and a private key", c.TLSMode)
+	}
+	if err := server.listen(); err != nil {
+		return err
+	}
+	ftpServer := ftpserver.NewFtpServer(server)
+	return ftpServer.ListenAndServe()
+}
+
+// ReloadTLSCertificate reloads the TLS certificate and key from the configured paths
+func ReloadTLSCertificate() {
+	if certMgr != nil {
+		certMgr.LoadCertificate()
+	}
+}
+
+func getConfigPath(name, configDir string) string {
+	if !utils.IsFileInputValid(name) {
+		return ""
+	}
+	if len(name) > 0 && !filepath.IsAbs(name) {
+		return filepath.Join(configDir, name)
+	}
+	return name
+}
@@ -0,0 +1,123 @@
+package ftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+
+	"github.com/drakkan/sftpgo/sftpd"
+)
+
+var (
+	errNotImplemented = errors.New("Not implemented")
+)
+
+// Connection details for an authenticated FTP user.
+// FTP requests are translated to SFTP requests and then handled by the SFTP connection
+// so users, permissions, quotas and actions are exactly the same for both protocols.
+// It implements the ftpserverlib ClientDriver interface, an afero.Fs.
+// Stat, ReadDir, Chmod and Chtimes are provided by the embedded SFTP connection
+type Connection struct {
+	sftpd.Connection
+}
+
+// Name returns the name of this connection
+func (c *Connection) Name() string {
+	return c.ID
+}
+
+// Create is not implemented, uploads are handled using OpenFile
+func (c *Connection) Create(name string) (afero.File, error) {
+	return nil, errNotImplemented
+}
+
+// Mkdir creates a directory using the connection filesystem
+func (c *Connection) Mkdir(name string, perm os.FileMode) error {
+	return c.handleCmd(sftp.NewRequest("Mkdir", name))
+}
+
+// MkdirAll is not implemented
+func (c *Connection) MkdirAll(path string, perm os.FileMode) error {
+	return errNotImplemented
+}
+
+// Open returns a directory whose contents can be listed.
+// ftpserverlib uses Open only for directory listings, files are opened using OpenFile
+func (c *Connection) Open(name string) (afero.File, error) {
+	files, err := c.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return newDirectory(name, files), nil
+}
+
+// OpenFile opens a file for a download or an upload
+func (c *Connection) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return c.uploadFile(name, flag)
+	}
+	return c.downloadFile(name)
+}
+
+// Remove removes a file or an empty directory
+func (c *Connection) Remove(name string) error {
+	fi, err := c.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return c.handleCmd(sftp.NewRequest("Rmdir", name))
+	}
+	return c.handleCmd(sftp.NewRequest("Remove", name))
+}
+
+// RemoveAll is not implemented
+func (c *Connection) RemoveAll(path string) error {
+	return errNotImplemented
+}
+
+// Rename renames a file or a directory
+func (c *Connection) Rename(oldname, newname string) error {
+	request := sftp.NewRequest("Rename", oldname)
+	request.Target = newname
+	return c.handleCmd(request)
+}
+
+func (c *Connection) downloadFile(name string) (afero.File, error) {
+	r, err := c.Fileread(sftp.NewRequest("Get", name))
+	if err != nil {
+		return nil, err
+	}
+	return newTransfer(name, r, nil, 0), nil
+}
+
+func (c *Connection) uploadFile(name string, flag int) (afero.File, error) {
+	if flag&os.O_APPEND != 0 {
+		// APPE command, we have to write starting from the current file size
+		var offset int64
+		if fi, err := c.Stat(name); err == nil {
+			offset = fi.Size()
+		}
+		w, err := c.Filewrite(sftpd.NewUploadRequest(name, true))
+		if err != nil {
+			return nil, err
+		}
+		return newTransfer(name, nil, w, offset), nil
+	}
+	// STOR command, ftpserverlib seeks to the offset requested using REST after opening
+	// the file so we open the upload on the first write, with resume if the offset is > 0
+	return newDeferredUpload(name, func(resume bool) (io.WriterAt, error) {
+		return c.Filewrite(sftpd.NewUploadRequest(name, resume))
+	}), nil
+}
+
+func (c *Connection) handleCmd(request *sftp.Request) error {
+	err := c.Filecmd(request)
+	if err == sftp.ErrSSHFxOk {
+		return nil
+	}
+	return err
+}
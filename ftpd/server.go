@@ -0,0 +1,254 @@
+package ftpd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+var (
+	errNoTLSCertificate = errors.New("no TLS certificate configured")
+	errTLSRequired      = errors.New("TLS is required, please secure the connection using AUTH TLS")
+)
+
+// Server implements the ftpserverlib MainDriver interface
+type Server struct {
+	config   Configuration
+	listener net.Listener
+	// control connections by remote address, ftpserverlib does not allow to close
+	// a client or to know if it negotiated TLS so we track the accepted connections
+	connsMutex   sync.RWMutex
+	controlConns map[string]*controlConn
+}
+
+type controlConn struct {
+	conn  net.Conn
+	isTLS bool
+}
+
+// controlListener tracks the control connections accepted by the FTP server
+type controlListener struct {
+	net.Listener
+	server *Server
+}
+
+// Accept waits for and returns the next control connection
+func (l *controlListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.server.addControlConn(conn)
+	}
+	return conn, err
+}
+
+func newServer(config Configuration) *Server {
+	return &Server{
+		config:       config,
+		controlConns: make(map[string]*controlConn),
+	}
+}
+
+// listen creates the listener for the control connections, it is secured
+// using TLS if implicit FTPS is configured. If TLS is required plain logins
+// and clear data connections are refused
+func (s *Server) listen() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.config.BindAddress, s.config.BindPort))
+	if err != nil {
+		return err
+	}
+	s.listener = &controlListener{
+		Listener: listener,
+		server:   s,
+	}
+	if s.config.TLSMode == 0 {
+		return nil
+	}
+	tlsConfig, err := s.GetTLSConfig()
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	if s.config.TLSMode == 2 {
+		s.listener = tls.NewListener(s.listener, tlsConfig)
+	}
+	s.listener = &tlsRequiredListener{
+		Listener:  s.listener,
+		tlsConfig: tlsConfig,
+		isTLS:     s.config.TLSMode == 2,
+	}
+	return nil
+}
+
+// GetSettings returns FTP server settings
+func (s *Server) GetSettings() (*ftpserver.Settings, error) {
+	var portRange *ftpserver.PortRange
+	if s.config.PassivePortRange.Start > 0 && s.config.PassivePortRange.End > s.config.PassivePortRange.Start {
+		portRange = &ftpserver.PortRange{
+			Start: s.config.PassivePortRange.Start,
+			End:   s.config.PassivePortRange.End,
+		}
+	}
+	return &ftpserver.Settings{
+		Listener:                 s.listener,
+		ListenAddr:               fmt.Sprintf("%s:%d", s.config.BindAddress, s.config.BindPort),
+		PublicHost:               s.config.ForcePassiveIP,
+		PassiveTransferPortRange: portRange,
+		ConnectionTimeout:        s.config.ConnectionTimeout,
+	}, nil
+}
+
+// ClientConnected is called to send the very first welcome message
+func (s *Server) ClientConnected(cc ftpserver.ClientContext) (string, error) {
+	logger.Debug(logSender, getConnectionID(cc), "client connected, remote address: %v", cc.RemoteAddr().String())
+	ipAddr := utils.GetIPFromRemoteAddress(cc.RemoteAddr().String())
+	if sftpd.IsBanned(ipAddr) {
+		logger.Debug(logSender, getConnectionID(cc), "connection refused, the remote host %#v is banned", ipAddr)
+		return "Access denied, banned client IP", sftpd.ErrHostBanned
+	}
+	return s.config.Banner, nil
+}
+
+// ClientDisconnected is called when the user disconnects, even if he never authenticated
+func (s *Server) ClientDisconnected(cc ftpserver.ClientContext) {
+	logger.Debug(logSender, getConnectionID(cc), "client disconnected, remote address: %v", cc.RemoteAddr().String())
+	s.removeControlConn(cc.RemoteAddr().String())
+	sftpd.RemoveConnection(getConnectionID(cc))
+}
+
+// AuthUser authenticates the user and selects an handling driver
+func (s *Server) AuthUser(cc ftpserver.ClientContext, username, password string) (ftpserver.ClientDriver, error) {
+	remoteAddr := cc.RemoteAddr().String()
+	if s.config.TLSMode == 1 && !s.isTLSControlConn(remoteAddr) {
+		logger.Debug(logSender, getConnectionID(cc), "login denied for user %#v, TLS is required", username)
+		return nil, errTLSRequired
+	}
+	method := dataprovider.SSHLoginMethodPassword
+	metrics.AddLoginAttempt(method)
+	user, err := dataprovider.CheckUserAndPass(dataProvider, username, password,
+		utils.GetIPFromRemoteAddress(remoteAddr), protocolFTP)
+	if err == nil {
+		err = sftpd.CheckLoginConditions(user, method, remoteAddr)
+	}
+	var connection *Connection
+	if err == nil {
+		connection, err = s.validateUser(user, cc)
+	}
+	if err != nil {
+		ipAddr := utils.GetIPFromRemoteAddress(remoteAddr)
+		logger.ConnectionFailedLog(username, ipAddr, method, err.Error())
+		sftpd.AddDefenderEvent(ipAddr, sftpd.GetLoginFailedEvent(err))
+	}
+	metrics.AddLoginResult(method, err)
+	if err != nil {
+		return nil, err
+	}
+	return connection, nil
+}
+
+// GetTLSConfig returns a TLS Certificate to use
+func (s *Server) GetTLSConfig() (*tls.Config, error) {
+	if certMgr == nil {
+		return nil, errNoTLSCertificate
+	}
+	return &tls.Config{
+		GetCertificate:     certMgr.GetCertificateFunc(),
+		GetConfigForClient: s.onTLSHandshake,
+		MinVersion:         tls.VersionTLS12,
+	}, nil
+}
+
+func (s *Server) validateUser(user dataprovider.User, cc ftpserver.ClientContext) (*Connection, error) {
+	connectionID := getConnectionID(cc)
+	fs, err := user.GetFilesystem(connectionID)
+	if err != nil {
+		logger.Warn(logSender, connectionID, "could create filesystem for user %#v err: %v", user.Username, err)
+		return nil, err
+	}
+	fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+	connection := &Connection{
+		Connection: sftpd.NewConnection(connectionID, protocolFTP, cc.GetClientVersion(), cc.RemoteAddr(), user, fs,
+			&clientCloser{server: s, remoteAddr: cc.RemoteAddr().String()}),
+	}
+	sftpd.AddConnection(connection.Connection)
+	connection.Log(logger.LevelInfo, logSender, "User id: %d, logged in with FTP, username: %#v, home_dir: %#v remote addr: %#v",
+		user.ID, user.Username, user.HomeDir, cc.RemoteAddr().String())
+	dataprovider.UpdateLastLogin(dataProvider, user)
+	return connection, nil
+}
+
+// clientCloser allows to disconnect an FTP client, for example if the connection
+// is idle or if it is closed using the REST API
+type clientCloser struct {
+	server     *Server
+	remoteAddr string
+}
+
+func (c *clientCloser) Close() error {
+	return c.server.closeControlConn(c.remoteAddr)
+}
+
+// onTLSHandshake marks a control connection as secured. It is called for data connections
+// too, they are ignored since they are not tracked
+func (s *Server) onTLSHandshake(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+
+	if c, ok := s.controlConns[hello.Conn.RemoteAddr().String()]; ok {
+		c.isTLS = true
+	}
+	return nil, nil
+}
+
+func (s *Server) addControlConn(conn net.Conn) {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+
+	s.controlConns[conn.RemoteAddr().String()] = &controlConn{
+		conn:  conn,
+		isTLS: false,
+	}
+}
+
+func (s *Server) removeControlConn(remoteAddr string) {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+
+	delete(s.controlConns, remoteAddr)
+}
+
+func (s *Server) isTLSControlConn(remoteAddr string) bool {
+	s.connsMutex.RLock()
+	defer s.connsMutex.RUnlock()
+
+	if c, ok := s.controlConns[remoteAddr]; ok {
+		return c.isTLS
+	}
+	return false
+}
+
+// closeControlConn closes the underlying network connection, ftpserverlib will
+// notice the error and it will disconnect the client
+func (s *Server) closeControlConn(remoteAddr string) error {
+	s.connsMutex.RLock()
+	c, ok := s.controlConns[remoteAddr]
+	s.connsMutex.RUnlock()
+
+	if !ok {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func getConnectionID(cc ftpserver.ClientContext) string {
+	return fmt.Sprintf("%v_%v", protocolFTP, cc.ID())
+}
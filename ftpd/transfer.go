@@ -0,0 +1,161 @@
+package ftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	errTransferClosed     = errors.New("transfer already closed")
+	errUnsupportedSeek    = errors.New("seek is only supported from the start of the file")
+	errInvalidTransferDir = errors.New("operation not supported for this transfer direction")
+)
+
+// transfer adapts the SFTP transfers, that expose ReadAt and WriteAt, to the sequential
+// reads and writes required by FTP. It implements the afero.File interface.
+// The wrapped SFTP transfer handles quota, bandwidth throttling, logs, metrics and actions
+type transfer struct {
+	name   string
+	reader io.ReaderAt
+	writer io.WriterAt
+	// getWriter opens the upload on the first write, this way the offset requested
+	// with a REST command is known before the file is opened
+	getWriter func(resume bool) (io.WriterAt, error)
+	offset    int64
+	isClosed  bool
+}
+
+func newTransfer(name string, reader io.ReaderAt, writer io.WriterAt, offset int64) *transfer {
+	return &transfer{
+		name:     name,
+		reader:   reader,
+		writer:   writer,
+		offset:   offset,
+		isClosed: false,
+	}
+}
+
+func newDeferredUpload(name string, getWriter func(resume bool) (io.WriterAt, error)) *transfer {
+	return &transfer{
+		name:      name,
+		getWriter: getWriter,
+		offset:    0,
+		isClosed:  false,
+	}
+}
+
+// Name returns the name of the transferred file
+func (t *transfer) Name() string {
+	return t.name
+}
+
+// Read reads the contents to downloads.
+func (t *transfer) Read(p []byte) (int, error) {
+	n, err := t.ReadAt(p, t.offset)
+	t.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads the contents to downloads starting from the given offset
+func (t *transfer) ReadAt(p []byte, off int64) (int, error) {
+	if t.reader == nil {
+		return 0, errInvalidTransferDir
+	}
+	return t.reader.ReadAt(p, off)
+}
+
+// Write writes the uploaded contents.
+func (t *transfer) Write(p []byte) (int, error) {
+	n, err := t.WriteAt(p, t.offset)
+	t.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes the uploaded contents starting from the given offset
+func (t *transfer) WriteAt(p []byte, off int64) (int, error) {
+	if err := t.openWriter(); err != nil {
+		return 0, err
+	}
+	if t.writer == nil {
+		return 0, errInvalidTransferDir
+	}
+	return t.writer.WriteAt(p, off)
+}
+
+// WriteString writes the uploaded contents from a string
+func (t *transfer) WriteString(s string) (int, error) {
+	return t.Write([]byte(s))
+}
+
+// Seek sets the offset to resume an upload or a download
+func (t *transfer) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart || offset < 0 {
+		return t.offset, errUnsupportedSeek
+	}
+	t.offset = offset
+	return t.offset, nil
+}
+
+// Readdir is not supported for transfers
+func (t *transfer) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errInvalidTransferDir
+}
+
+// Readdirnames is not supported for transfers
+func (t *transfer) Readdirnames(n int) ([]string, error) {
+	return nil, errInvalidTransferDir
+}
+
+// Stat is not implemented
+func (t *transfer) Stat() (os.FileInfo, error) {
+	return nil, errNotImplemented
+}
+
+// Sync is a no-op, the uploaded data are flushed when the transfer is closed
+func (t *transfer) Sync() error {
+	return nil
+}
+
+// Truncate is not implemented
+func (t *transfer) Truncate(size int64) error {
+	return errNotImplemented
+}
+
+// Close it is called when the transfer is completed.
+func (t *transfer) Close() error {
+	if t.isClosed {
+		return errTransferClosed
+	}
+	// an empty upload must create an empty file
+	if err := t.openWriter(); err != nil {
+		t.isClosed = true
+		return err
+	}
+	t.isClosed = true
+	if t.reader != nil {
+		if c, ok := t.reader.(io.Closer); ok {
+			return c.Close()
+		}
+	}
+	if t.writer != nil {
+		if c, ok := t.writer.(io.Closer); ok {
+			return c.Close()
+		}
+	}
+	return nil
+}
+
+func (t *transfer) openWriter() error {
+	if t.getWriter == nil {
+		return nil
+	}
+	getWriter := t.getWriter
+	t.getWriter = nil
+	w, err := getWriter(t.offset > 0)
+	if err != nil {
+		return err
+	}
+	t.writer = w
+	return nil
+}
@@ -0,0 +1,213 @@
+// Package httpclient provides the HTTP client used to execute the HTTP hooks,
+// such as external authentication, pre-login and keyboard interactive hooks.
+// Connections are kept alive and reused and failed requests are retried
+package httpclient
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	logSender = "httpclient"
+	// maximum size for the hook responses
+	maxResponseSize = 1048576
+)
+
+// TLSKeyPair defines the paths for a TLS key pair
+type TLSKeyPair struct {
+	Cert string `json:"cert" mapstructure:"cert"`
+	Key  string `json:"key" mapstructure:"key"`
+}
+
+// Config defines the configuration for the HTTP client used for the HTTP hooks
+type Config struct {
+	// Timeout, in seconds, for each HTTP request
+	Timeout int `json:"timeout" mapstructure:"timeout"`
+	// Maximum number of retries if a request fails because of a network error
+	// or a 429/5xx response. 0 disables retries
+	RetryMax int `json:"retry_max" mapstructure:"retry_max"`
+	// Minimum and maximum time, in seconds, to wait before retrying a request.
+	// The wait time is doubled after each retry
+	RetryWaitMin int `json:"retry_wait_min" mapstructure:"retry_wait_min"`
+	RetryWaitMax int `json:"retry_wait_max" mapstructure:"retry_wait_max"`
+	// Paths to PEM files containing additional certificate authorities to trust.
+	// They can be relative to the config dir or absolute paths
+	CACertificates []string `json:"ca_certificates" mapstructure:"ca_certificates"`
+	// Client certificates to use for mutual TLS authentication.
+	// The paths can be relative to the config dir or absolute paths
+	Certificates []TLSKeyPair `json:"certificates" mapstructure:"certificates"`
+	// Set to true to skip the verification of the server certificate. Use for testing only
+	SkipTLSVerify bool `json:"skip_tls_verify" mapstructure:"skip_tls_verify"`
+	client        *http.Client
+}
+
+var httpConfig = getDefaultConfig()
+
+func getDefaultConfig() Config {
+	c := Config{
+		Timeout:      20,
+		RetryMax:     0,
+		RetryWaitMin: 1,
+		RetryWaitMax: 10,
+	}
+	c.client = c.newClient(&tls.Config{})
+	return c
+}
+
+func getConfigPath(name, configDir string) string {
+	if !filepath.IsAbs(name) {
+		return filepath.Join(configDir, name)
+	}
+	return name
+}
+
+func (c *Config) validate() error {
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid HTTP client timeout: %v", c.Timeout)
+	}
+	if c.RetryMax < 0 {
+		return fmt.Errorf("invalid HTTP client retry_max: %v", c.RetryMax)
+	}
+	if c.RetryWaitMin <= 0 || c.RetryWaitMax < c.RetryWaitMin {
+		return fmt.Errorf("invalid HTTP client retry wait times, min: %v max: %v", c.RetryWaitMin, c.RetryWaitMax)
+	}
+	return nil
+}
+
+func (c *Config) getTLSConfig(configDir string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.SkipTLSVerify,
+	}
+	if len(c.CACertificates) > 0 {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		for _, ca := range c.CACertificates {
+			caPath := getConfigPath(ca, configDir)
+			pemCerts, err := ioutil.ReadFile(caPath)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read CA certificate %#v: %v", caPath, err)
+			}
+			if !rootCAs.AppendCertsFromPEM(pemCerts) {
+				return nil, fmt.Errorf("no valid certificate found in CA certificate file %#v", caPath)
+			}
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	for _, pair := range c.Certificates {
+		cert, err := tls.LoadX509KeyPair(getConfigPath(pair.Cert, configDir), getConfigPath(pair.Key, configDir))
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate %#v: %v", pair.Cert, err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+	return tlsConfig, nil
+}
+
+func (c *Config) newClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.MaxIdleConnsPerHost = 32
+	return &http.Client{
+		Timeout:   time.Duration(c.Timeout) * time.Second,
+		Transport: transport,
+	}
+}
+
+// Initialize configures the HTTP client.
+// If it is not called, a client without retries and with default timeouts is used
+func (c Config) Initialize(configDir string) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	tlsConfig, err := c.getTLSConfig(configDir)
+	if err != nil {
+		return err
+	}
+	c.client = c.newClient(tlsConfig)
+	httpConfig = c
+	return nil
+}
+
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented)
+}
+
+// Post sends a POST request with the given body, retrying on network errors and 429/5xx responses.
+// The response body is read, up to 1MB, and returned, so the connection can be reused.
+// An error is returned if the final response status code is not 200
+func Post(hookURL, contentType string, body []byte) ([]byte, error) {
+	c := httpConfig
+	redactedURL := getRedactedURL(hookURL)
+	wait := time.Duration(c.RetryWaitMin) * time.Second
+	for attempt := 0; ; attempt++ {
+		startTime := time.Now()
+		resp, err := c.client.Post(hookURL, contentType, bytes.NewReader(body))
+		if attempt >= c.RetryMax || !isRetryable(resp, err) {
+			if err != nil {
+				logger.Warn(logSender, "", "error sending request to %#v: %v", redactedURL, err)
+				return nil, err
+			}
+			return readResponse(redactedURL, resp, startTime)
+		}
+		if err != nil {
+			logger.Debug(logSender, "", "request to %#v failed, attempt %v: %v, retrying in %v", redactedURL, attempt+1, err,
+				wait)
+		} else {
+			// drain and close the body so the connection can be reused
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize)) //nolint:errcheck
+			resp.Body.Close()
+			logger.Debug(logSender, "", "request to %#v failed, attempt %v, status code: %v, retrying in %v", redactedURL,
+				attempt+1, resp.StatusCode, wait)
+		}
+		time.Sleep(wait)
+		wait *= 2
+		if maxWait := time.Duration(c.RetryWaitMax) * time.Second; wait > maxWait {
+			wait = maxWait
+		}
+	}
+}
+
+func readResponse(redactedURL string, resp *http.Response, startTime time.Time) ([]byte, error) {
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug(logSender, "", "request to %#v completed, status code: %v, elapsed: %v", redactedURL, resp.StatusCode,
+		time.Since(startTime))
+	if len(respBody) > maxResponseSize {
+		return nil, errors.New("response too large")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+	return respBody, nil
+}
+
+// getRedactedURL removes the credentials, if any, from the given URL so it can be logged
+func getRedactedURL(hookURL string) string {
+	u, err := url.Parse(hookURL)
+	if err != nil || u.User == nil {
+		return hookURL
+	}
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,141 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+func getAdmins(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	offset := 0
+	order := "ASC"
+	var err error
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order = r.URL.Query().Get("order")
+		if order != "ASC" && order != "DESC" {
+			err = errors.New("Invalid order")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	admins, err := dataprovider.GetAdmins(dataProvider, limit, offset, order)
+	if err == nil {
+		render.JSON(w, r, admins)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func getAdminByUsername(w http.ResponseWriter, r *http.Request) {
+	admin, err := dataprovider.AdminExists(dataProvider, chi.URLParam(r, "username"))
+	if err == nil {
+		render.JSON(w, r, dataprovider.HideAdminSensitiveData(&admin))
+	} else if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func addAdmin(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var admin dataprovider.Admin
+	err := render.DecodeJSON(r.Body, &admin)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.AddAdmin(dataProvider, admin)
+	if err == nil {
+		admin, err = dataprovider.AdminExists(dataProvider, admin.Username)
+		if err == nil {
+			render.JSON(w, r, dataprovider.HideAdminSensitiveData(&admin))
+		} else {
+			sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		}
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
+
+func updateAdmin(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	username := chi.URLParam(r, "username")
+	admin, err := dataprovider.AdminExists(dataProvider, username)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	currentPassword := admin.Password
+	admin.Password = ""
+	admin.Permissions = nil
+	err = render.DecodeJSON(r.Body, &admin)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	// we use the new password if passed otherwise the old one
+	if len(admin.Password) == 0 {
+		admin.Password = currentPassword
+	}
+	if admin.Username != username {
+		sendAPIResponse(w, r, err, "admin username in request body does not match username in path parameter",
+			http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.UpdateAdmin(dataProvider, admin)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Admin updated", http.StatusOK)
+	}
+}
+
+func deleteAdmin(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	if username == getAdminFromRequest(r).Username {
+		sendAPIResponse(w, r, errors.New("You cannot delete yourself"), "", http.StatusBadRequest)
+		return
+	}
+	admin, err := dataprovider.AdminExists(dataProvider, username)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	err = dataprovider.DeleteAdmin(dataProvider, admin)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Admin deleted", http.StatusOK)
+	}
+}
@@ -0,0 +1,149 @@
+package httpd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+var errAuthenticationDisabled = errors.New("no admin is defined, authentication is disabled")
+
+func getToken(w http.ResponseWriter, r *http.Request) {
+	admin := getAdminFromRequest(r)
+	if len(admin.Username) == 0 {
+		sendAPIResponse(w, r, errAuthenticationDisabled, "", http.StatusBadRequest)
+		return
+	}
+	token, expiration, err := createJWT(admin)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to create token for admin %#v: %v", admin.Username, err)
+		sendAPIResponse(w, r, err, "Unable to create token", http.StatusInternalServerError)
+		return
+	}
+	logger.Debug(logSender, "", "token issued for admin %#v, expiration: %v", admin.Username, expiration)
+	render.JSON(w, r, tokenResponse{
+		AccessToken: token,
+		ExpiresAt:   expiration.UTC().Format(time.RFC3339),
+	})
+}
+
+func getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	offset := 0
+	order := "ASC"
+	var err error
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order = r.URL.Query().Get("order")
+		if order != "ASC" && order != "DESC" {
+			err = errors.New("Invalid order")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	admin := getAdminFromRequest(r)
+	if len(admin.Username) == 0 {
+		sendAPIResponse(w, r, errAuthenticationDisabled, "", http.StatusBadRequest)
+		return
+	}
+	keys, err := dataprovider.GetAPIKeys(dataProvider, limit, offset, order, admin.Username)
+	if err == nil {
+		render.JSON(w, r, keys)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func getAPIKeyByID(w http.ResponseWriter, r *http.Request) {
+	key, status, err := getRequestAPIKey(r)
+	if err == nil {
+		render.JSON(w, r, dataprovider.HideAPIKeySensitiveData(&key))
+	} else {
+		sendAPIResponse(w, r, err, "", status)
+	}
+}
+
+func addAPIKey(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	admin := getAdminFromRequest(r)
+	if len(admin.Username) == 0 {
+		sendAPIResponse(w, r, errAuthenticationDisabled, "", http.StatusBadRequest)
+		return
+	}
+	var key dataprovider.APIKey
+	err := render.DecodeJSON(r.Body, &key)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	// API keys are always owned by the admin that creates them
+	key.Admin = admin.Username
+	plainKey, err := dataprovider.AddAPIKey(dataProvider, &key)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	key, err = dataprovider.GetAPIKeyByID(dataProvider, key.KeyID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	// the plain key is returned only here, it cannot be retrieved later
+	key.Key = plainKey
+	render.JSON(w, r, key)
+}
+
+func deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	key, status, err := getRequestAPIKey(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", status)
+		return
+	}
+	err = dataprovider.DeleteAPIKey(dataProvider, key)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "API key deleted", http.StatusOK)
+	}
+}
+
+// getRequestAPIKey returns the API key referenced in the request path or an
+// error and the HTTP status to send. Admins can only access their own API keys
+func getRequestAPIKey(r *http.Request) (dataprovider.APIKey, int, error) {
+	keyID := chi.URLParam(r, "keyID")
+	key, err := dataprovider.GetAPIKeyByID(dataProvider, keyID)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		return key, http.StatusNotFound, err
+	} else if err != nil {
+		return key, http.StatusInternalServerError, err
+	}
+	if key.Admin != getAdminFromRequest(r).Username {
+		return key, http.StatusNotFound, fmt.Errorf("Not found: API key %v does not exist", keyID)
+	}
+	return key, http.StatusOK, nil
+}
@@ -0,0 +1,134 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+func getGroups(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	offset := 0
+	order := "ASC"
+	var err error
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order = r.URL.Query().Get("order")
+		if order != "ASC" && order != "DESC" {
+			err = errors.New("Invalid order")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	groups, err := dataprovider.GetGroups(dataProvider, limit, offset, order)
+	if err == nil {
+		render.JSON(w, r, groups)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func getGroupByName(w http.ResponseWriter, r *http.Request) {
+	group, err := dataprovider.GroupExists(dataProvider, chi.URLParam(r, "name"))
+	if err == nil {
+		render.JSON(w, r, dataprovider.HideGroupSensitiveData(&group))
+	} else if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func addGroup(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var group dataprovider.Group
+	err := render.DecodeJSON(r.Body, &group)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.AddGroup(dataProvider, group)
+	if err == nil {
+		group, err = dataprovider.GroupExists(dataProvider, group.Name)
+		if err == nil {
+			render.JSON(w, r, dataprovider.HideGroupSensitiveData(&group))
+		} else {
+			sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		}
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
+
+func updateGroup(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	name := chi.URLParam(r, "name")
+	group, err := dataprovider.GroupExists(dataProvider, name)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	currentFsConfig := group.UserSettings.FsConfig
+	currentVirtualFolders := group.UserSettings.VirtualFolders
+	group.UserSettings = dataprovider.GroupUserSettings{}
+	err = render.DecodeJSON(r.Body, &group)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	restoreFsSecrets(&group.UserSettings.FsConfig, currentFsConfig)
+	restoreFoldersSecrets(group.UserSettings.VirtualFolders, currentVirtualFolders)
+	if group.Name != name {
+		sendAPIResponse(w, r, err, "group name in request body does not match name in path parameter",
+			http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.UpdateGroup(dataProvider, group)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Group updated", http.StatusOK)
+	}
+}
+
+func deleteGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := dataprovider.GroupExists(dataProvider, chi.URLParam(r, "name"))
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	err = dataprovider.DeleteGroup(dataProvider, group)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Group deleted", http.StatusOK)
+	}
+}
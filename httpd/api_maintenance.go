@@ -1,29 +1,66 @@
 package httpd
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/backup"
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/sftpd"
 )
 
+const (
+	// multipart form field containing the backup to restore
+	loadDataFormField = "backup_file"
+)
+
+// loadDataResponse is the response for a restore. The records that cannot be restored
+// are reported inside Errors and they do not stop the restore
+type loadDataResponse struct {
+	apiResponse
+	Groups int                 `json:"groups"`
+	Users  int                 `json:"users"`
+	Admins int                 `json:"admins"`
+	Errors []loadDataErrorItem `json:"errors,omitempty"`
+}
+
+// loadDataErrorItem describes a record that cannot be restored
+type loadDataErrorItem struct {
+	// group, user or admin
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
 func dumpData(w http.ResponseWriter, r *http.Request) {
-	var outputFile, indent string
+	var outputFile, outputData, indent string
 	if _, ok := r.URL.Query()["output_file"]; ok {
 		outputFile = strings.TrimSpace(r.URL.Query().Get("output_file"))
 	}
+	if _, ok := r.URL.Query()["output_data"]; ok {
+		outputData = strings.TrimSpace(r.URL.Query().Get("output_data"))
+	}
 	if _, ok := r.URL.Query()["indent"]; ok {
 		indent = strings.TrimSpace(r.URL.Query().Get("indent"))
 	}
+	if outputData == "1" {
+		dumpDataToResponse(w, r, indent == "1")
+		return
+	}
 	if len(outputFile) == 0 {
 		sendAPIResponse(w, r, errors.New("Invalid or missing output_file"), "", http.StatusBadRequest)
 		return
@@ -39,33 +76,69 @@ func dumpData(w http.ResponseWriter, r *http.Request) {
 	outputFile = filepath.Join(backupsPath, outputFile)
 	logger.Debug(logSender, "", "dumping data to: %#v", outputFile)
 
-	users, err := dataprovider.DumpUsers(dataProvider)
+	err := dumpDataToFile(outputFile, indent == "1")
 	if err != nil {
 		logger.Warn(logSender, "", "dumping data error: %v, output file: %#v", err, outputFile)
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
-	var dump []byte
-	if indent == "1" {
-		dump, err = json.MarshalIndent(dataprovider.BackupData{
-			Users: users,
-		}, "", "  ")
-	} else {
-		dump, err = json.Marshal(dataprovider.BackupData{
-			Users: users,
-		})
+	logger.Debug(logSender, "", "dumping data completed, output file: %#v, error: %v", outputFile, err)
+	sendAPIResponse(w, r, err, "Data saved", http.StatusOK)
+}
+
+func dumpDataToFile(outputFile string, indent bool) error {
+	// groups and admins are read before creating the file, so the data provider errors
+	// are detected before overwriting an existing backup
+	groups, admins, err := getGroupsAndAdminsToDump()
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(outputFile), 0700)
+	f, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
 	}
+	bw := bufio.NewWriter(f)
+	err = dataprovider.WriteBackup(dataProvider, bw, groups, admins, indent)
 	if err == nil {
-		os.MkdirAll(filepath.Dir(outputFile), 0700)
-		err = ioutil.WriteFile(outputFile, dump, 0600)
+		err = bw.Flush()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
 	}
 	if err != nil {
-		logger.Warn(logSender, "", "dumping data error: %v, output file: %#v", err, outputFile)
+		os.Remove(outputFile)
+	}
+	return err
+}
+
+func dumpDataToResponse(w http.ResponseWriter, r *http.Request, indent bool) {
+	groups, admins, err := getGroupsAndAdminsToDump()
+	if err != nil {
+		logger.Warn(logSender, "", "dumping data error: %v", err)
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
-	logger.Debug(logSender, "", "dumping data completed, output file: %#v, error: %v", outputFile, err)
-	sendAPIResponse(w, r, err, "Data saved", http.StatusOK)
+	logger.Debug(logSender, "", "dumping data as response")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"sftpgo-backup-%v.json\"",
+		time.Now().Format("2006-01-02T15-04-05")))
+	bw := bufio.NewWriter(w)
+	err = dataprovider.WriteBackup(dataProvider, bw, groups, admins, indent)
+	if err == nil {
+		err = bw.Flush()
+	}
+	// the response status is already sent, the client will receive an incomplete JSON
+	logger.Debug(logSender, "", "dumping data as response completed, error: %v", err)
+}
+
+func getGroupsAndAdminsToDump() ([]dataprovider.Group, []dataprovider.Admin, error) {
+	groups, err := dataprovider.DumpGroups(dataProvider)
+	if err != nil {
+		return nil, nil, err
+	}
+	admins, err := dataprovider.DumpAdmins(dataProvider)
+	return groups, admins, err
 }
 
 func loadData(w http.ResponseWriter, r *http.Request) {
@@ -74,68 +147,300 @@ func loadData(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
-	if !filepath.IsAbs(inputFile) {
-		sendAPIResponse(w, r, fmt.Errorf("Invalid input_file %#v: it must be an absolute path", inputFile), "", http.StatusBadRequest)
-		return
+	var reader io.Reader
+	if r.Method == http.MethodPost {
+		inputFile = "request body"
+		reader, err = getLoadDataRequestReader(r)
+		if err != nil {
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if !filepath.IsAbs(inputFile) {
+			sendAPIResponse(w, r, fmt.Errorf("Invalid input_file %#v: it must be an absolute path", inputFile), "",
+				http.StatusBadRequest)
+			return
+		}
+		f, err := os.Open(inputFile)
+		if err != nil {
+			sendAPIResponse(w, r, err, "", getRespStatus(err))
+			return
+		}
+		defer f.Close()
+		reader = bufio.NewReader(f)
 	}
-	fi, err := os.Stat(inputFile)
+	// compressed and encrypted backups, as generated by the scheduler, are supported too
+	reader, err = backup.NewReader(reader)
 	if err != nil {
-		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to read backup from %v", inputFile), http.StatusBadRequest)
 		return
 	}
-	if fi.Size() > maxRestoreSize {
-		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to restore input file: %#v size too big: %v/%v bytes",
-			inputFile, fi.Size(), maxRestoreSize), http.StatusBadRequest)
+	restorer := dataRestorer{
+		source:    inputFile,
+		scanQuota: scanQuota,
+		mode:      mode,
+	}
+	err = restorer.restore(reader)
+	resp := restorer.getResponse(err)
+	logger.Debug(logSender, "", "backup restored from %#v, groups: %v, users: %v, admins: %v, errors: %v, error: %v",
+		inputFile, resp.Groups, resp.Users, resp.Admins, len(resp.Errors), err)
+	ctx := context.WithValue(r.Context(), render.StatusCtxKey, resp.HTTPStatus)
+	render.JSON(w, r.WithContext(ctx), resp)
+}
+
+// getLoadDataRequestReader returns a reader for the backup sent inside the request body,
+// as multipart form or as raw JSON
+func getLoadDataRequestReader(r *http.Request) (io.Reader, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return r.Body, nil
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Missing %#v form field", loadDataFormField)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == loadDataFormField {
+			return part, nil
+		}
+	}
+}
+
+// dataRestorer restores a backup while it is decoded, so it does not need to be loaded
+// all in memory. A record that cannot be restored does not stop the restore
+type dataRestorer struct {
+	source    string
+	scanQuota int
+	mode      int
+	result    loadDataResponse
+	// status code for the first record that cannot be restored
+	errorStatus int
+	// the users that belong to some groups are restored after the groups,
+	// they are kept in memory if the groups come after the users inside the backup
+	groupsRestored bool
+	pendingUsers   []dataprovider.User
+}
+
+func (d *dataRestorer) getResponse(err error) loadDataResponse {
+	resp := d.result
+	switch {
+	case err != nil:
+		resp.Error = err.Error()
+		resp.Message = fmt.Sprintf("Unable to parse backup from %v", d.source)
+		resp.HTTPStatus = http.StatusBadRequest
+	case len(resp.Errors) > 0:
+		resp.Error = fmt.Sprintf("%v records cannot be restored", len(resp.Errors))
+		resp.Message = "Data partially restored"
+		resp.HTTPStatus = d.errorStatus
+	default:
+		resp.Message = "Data restored"
+		resp.HTTPStatus = http.StatusOK
+	}
+	return resp
+}
+
+func (d *dataRestorer) addError(recordType, name string, err error) {
+	if len(d.result.Errors) == 0 {
+		d.errorStatus = getRespStatus(err)
+	}
+	d.result.Errors = append(d.result.Errors, loadDataErrorItem{
+		Type:  recordType,
+		Name:  name,
+		Error: err.Error(),
+	})
+}
+
+// restore decodes and restores the given backup, an error is returned if the backup is not valid JSON
+func (d *dataRestorer) restore(reader io.Reader) error {
+	dec := json.NewDecoder(reader)
+	if err := expectJSONDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := t.(string)
+		if !ok {
+			return fmt.Errorf("unexpected JSON token %v", t)
+		}
+		switch key {
+		case "groups":
+			err = decodeJSONArray(dec, func() error {
+				var group dataprovider.Group
+				if err := dec.Decode(&group); err != nil {
+					return err
+				}
+				d.restoreGroup(group)
+				return nil
+			})
+			d.restorePendingUsers()
+		case "users":
+			err = decodeJSONArray(dec, func() error {
+				var user dataprovider.User
+				if err := dec.Decode(&user); err != nil {
+					return err
+				}
+				if !d.groupsRestored && len(user.Groups) > 0 {
+					d.pendingUsers = append(d.pendingUsers, user)
+					return nil
+				}
+				d.restoreUser(user)
+				return nil
+			})
+		case "admins":
+			err = decodeJSONArray(dec, func() error {
+				var admin dataprovider.Admin
+				if err := dec.Decode(&admin); err != nil {
+					return err
+				}
+				d.restoreAdmin(admin)
+				return nil
+			})
+		default:
+			var unknown json.RawMessage
+			err = dec.Decode(&unknown)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	d.restorePendingUsers()
+	return expectJSONDelim(dec, '}')
+}
+
+func (d *dataRestorer) restorePendingUsers() {
+	d.groupsRestored = true
+	for _, user := range d.pendingUsers {
+		d.restoreUser(user)
+	}
+	d.pendingUsers = nil
+}
+
+func (d *dataRestorer) restoreGroup(group dataprovider.Group) {
+	_, err := dataprovider.GroupExists(dataProvider, group.Name)
+	if err == nil {
+		if d.mode == 1 {
+			logger.Debug(logSender, "", "loaddata mode 1, existing group %#v not updated", group.Name)
+			return
+		}
+		err = dataprovider.UpdateGroup(dataProvider, group)
+		logger.Debug(logSender, "", "restoring existing group: %#v, dump file: %#v, error: %v", group.Name,
+			d.source, err)
+	} else {
+		err = dataprovider.AddGroup(dataProvider, group)
+		logger.Debug(logSender, "", "adding new group: %#v, dump file: %#v, error: %v", group.Name,
+			d.source, err)
+	}
+	if err != nil {
+		d.addError("group", group.Name, err)
 		return
 	}
+	d.result.Groups++
+}
 
-	content, err := ioutil.ReadFile(inputFile)
+func (d *dataRestorer) restoreUser(user dataprovider.User) {
+	username := user.Username
+	u, err := dataprovider.UserExists(dataProvider, username)
+	if err == nil {
+		if d.mode == 1 {
+			logger.Debug(logSender, "", "loaddata mode 1, existing user %#v not updated", u.Username)
+			return
+		}
+		user.ID = u.ID
+		user.LastLogin = u.LastLogin
+		user.UsedQuotaSize = u.UsedQuotaSize
+		user.UsedQuotaFiles = u.UsedQuotaFiles
+		err = dataprovider.UpdateUser(dataProvider, user)
+		user.Password = "[redacted]"
+		logger.Debug(logSender, "", "restoring existing user: %+v, dump file: %#v, error: %v", user, d.source, err)
+	} else {
+		user.LastLogin = 0
+		user.UsedQuotaSize = 0
+		user.UsedQuotaFiles = 0
+		err = dataprovider.AddUser(dataProvider, user)
+		user.Password = "[redacted]"
+		logger.Debug(logSender, "", "adding new user: %+v, dump file: %#v, error: %v", user, d.source, err)
+	}
 	if err != nil {
-		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		d.addError("user", username, err)
 		return
 	}
-	var dump dataprovider.BackupData
-	err = json.Unmarshal(content, &dump)
+	d.result.Users++
+	// the quota scan must use the filesystem and the limits inherited from the groups
+	user, err = dataprovider.GetUserWithGroupSettings(dataProvider, username)
 	if err != nil {
-		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to parse input file: %#v", inputFile), http.StatusBadRequest)
+		d.addError("user", username, err)
 		return
 	}
-
-	for _, user := range dump.Users {
-		u, err := dataprovider.UserExists(dataProvider, user.Username)
-		if err == nil {
-			if mode == 1 {
-				logger.Debug(logSender, "", "loaddata mode 1, existing user %#v not updated", u.Username)
-				continue
-			}
-			user.ID = u.ID
-			user.LastLogin = u.LastLogin
-			user.UsedQuotaSize = u.UsedQuotaSize
-			user.UsedQuotaFiles = u.UsedQuotaFiles
-			err = dataprovider.UpdateUser(dataProvider, user)
-			user.Password = "[redacted]"
-			logger.Debug(logSender, "", "restoring existing user: %+v, dump file: %#v, error: %v", user, inputFile, err)
-		} else {
-			user.LastLogin = 0
-			user.UsedQuotaSize = 0
-			user.UsedQuotaFiles = 0
-			err = dataprovider.AddUser(dataProvider, user)
-			user.Password = "[redacted]"
-			logger.Debug(logSender, "", "adding new user: %+v, dump file: %#v, error: %v", user, inputFile, err)
+	if needQuotaScan(d.scanQuota, &user) {
+		if sftpd.AddQuotaScan(user.Username) {
+			logger.Debug(logSender, "", "starting quota scan for restored user: %#v", user.Username)
+			go doQuotaScan(user)
 		}
-		if err != nil {
-			sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
+
+func (d *dataRestorer) restoreAdmin(admin dataprovider.Admin) {
+	_, err := dataprovider.AdminExists(dataProvider, admin.Username)
+	if err == nil {
+		if d.mode == 1 {
+			logger.Debug(logSender, "", "loaddata mode 1, existing admin %#v not updated", admin.Username)
 			return
 		}
-		if needQuotaScan(scanQuota, &user) {
-			if sftpd.AddQuotaScan(user.Username) {
-				logger.Debug(logSender, "", "starting quota scan for restored user: %#v", user.Username)
-				go doQuotaScan(user)
-			}
+		err = dataprovider.UpdateAdmin(dataProvider, admin)
+		logger.Debug(logSender, "", "restoring existing admin: %#v, dump file: %#v, error: %v", admin.Username,
+			d.source, err)
+	} else {
+		err = dataprovider.AddAdmin(dataProvider, admin)
+		logger.Debug(logSender, "", "adding new admin: %#v, dump file: %#v, error: %v", admin.Username,
+			d.source, err)
+	}
+	if err != nil {
+		d.addError("admin", admin.Username, err)
+		return
+	}
+	d.result.Admins++
+}
+
+func expectJSONDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("unexpected JSON token %v, expected %v", t, delim)
+	}
+	return nil
+}
+
+// decodeJSONArray calls decodeItem for each item of the next JSON array, a null value is
+// handled as an empty array
+func decodeJSONArray(dec *json.Decoder, decodeItem func() error) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	if t != json.Delim('[') {
+		return fmt.Errorf("unexpected JSON token %v, expected [", t)
+	}
+	for dec.More() {
+		if err = decodeItem(); err != nil {
+			return err
 		}
 	}
-	logger.Debug(logSender, "", "backup restored, users: %v", len(dump.Users))
-	sendAPIResponse(w, r, err, "Data restored", http.StatusOK)
+	return expectJSONDelim(dec, ']')
 }
 
 func needQuotaScan(scanQuota int, user *dataprovider.User) bool {
@@ -21,7 +21,7 @@ func startQuotaScan(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
-	user, err := dataprovider.UserExists(dataProvider, u.Username)
+	user, err := dataprovider.GetUserWithGroupSettings(dataProvider, u.Username)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusNotFound)
 		return
@@ -48,5 +48,38 @@ func doQuotaScan(user dataprovider.User) error {
 		err = dataprovider.UpdateUserQuota(dataProvider, user, numFiles, size, true)
 		logger.Debug(logSender, "", "user home dir scanned, user: %#v, error: %v", user.Username, err)
 	}
+	if folderErr := doVirtualFoldersQuotaScan(user); folderErr != nil && err == nil {
+		err = folderErr
+	}
 	return err
 }
+
+// doVirtualFoldersQuotaScan updates the used quota for the user's virtual folders,
+// each folder has its own quota
+func doVirtualFoldersQuotaScan(user dataprovider.User) error {
+	var result error
+	for _, folder := range user.VirtualFolders {
+		if !folder.HasQuotaRestrictions() && dataprovider.GetQuotaTracking() == 2 {
+			continue
+		}
+		fs, err := user.GetVirtualFolderFilesystem("", folder)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to scan quota for virtual folder %#v, user %#v, error creating filesystem: %v",
+				folder.VirtualPath, user.Username, err)
+			result = err
+			continue
+		}
+		numFiles, size, err := fs.ScanRootDirContents()
+		if err != nil {
+			logger.Warn(logSender, "", "error scanning virtual folder %#v, user %#v: %v", folder.VirtualPath, user.Username, err)
+			result = err
+			continue
+		}
+		err = dataprovider.UpdateVirtualFolderQuota(dataProvider, user, folder, numFiles, size, true)
+		logger.Debug(logSender, "", "virtual folder %#v scanned, user: %#v, error: %v", folder.VirtualPath, user.Username, err)
+		if err != nil {
+			result = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,135 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+func getShares(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	offset := 0
+	order := "ASC"
+	username := ""
+	var err error
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order = r.URL.Query().Get("order")
+		if order != "ASC" && order != "DESC" {
+			err = errors.New("Invalid order")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["username"]; ok {
+		username = r.URL.Query().Get("username")
+	}
+	shares, err := dataprovider.GetShares(dataProvider, limit, offset, order, username)
+	if err == nil {
+		render.JSON(w, r, shares)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func getShareByID(w http.ResponseWriter, r *http.Request) {
+	share, err := dataprovider.GetShareByID(dataProvider, chi.URLParam(r, "shareID"))
+	if err == nil {
+		render.JSON(w, r, dataprovider.HideShareSensitiveData(&share))
+	} else if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func addShare(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var share dataprovider.Share
+	err := render.DecodeJSON(r.Body, &share)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.AddShare(dataProvider, &share)
+	if err == nil {
+		share, err = dataprovider.GetShareByID(dataProvider, share.ShareID)
+		if err == nil {
+			render.JSON(w, r, dataprovider.HideShareSensitiveData(&share))
+		} else {
+			sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		}
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
+
+func updateShare(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	shareID := chi.URLParam(r, "shareID")
+	share, err := dataprovider.GetShareByID(dataProvider, shareID)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	// an omitted password removes the share protection, the redacted password preserves it
+	share.Password = ""
+	err = render.DecodeJSON(r.Body, &share)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if share.ShareID != shareID {
+		sendAPIResponse(w, r, err, "share ID in request body does not match share ID in path parameter",
+			http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.UpdateShare(dataProvider, share)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Share updated", http.StatusOK)
+	}
+}
+
+func deleteShare(w http.ResponseWriter, r *http.Request) {
+	share, err := dataprovider.GetShareByID(dataProvider, chi.URLParam(r, "shareID"))
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	err = dataprovider.DeleteShare(dataProvider, share)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Share deleted", http.StatusOK)
+	}
+}
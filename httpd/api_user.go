@@ -6,7 +6,8 @@ import (
 	"strconv"
 
 	"github.com/drakkan/sftpgo/dataprovider"
-	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/vfs"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 )
@@ -80,6 +81,8 @@ func addUser(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
+	// TOTP can only be enabled using the dedicated API
+	user.TOTPConfig = dataprovider.UserTOTPConfig{}
 	err = dataprovider.AddUser(dataProvider, user)
 	if err == nil {
 		user, err = dataprovider.UserExists(dataProvider, user.Username)
@@ -104,12 +107,13 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	user, err := dataprovider.GetUserByID(dataProvider, userID)
 	currentPermissions := user.Permissions
 	currentFileExtensions := user.Filters.FileExtensions
-	currentS3AccessSecret := ""
-	if user.FsConfig.Provider == 1 {
-		currentS3AccessSecret = user.FsConfig.S3Config.AccessSecret
-	}
+	currentTOTPConfig := user.TOTPConfig
+	currentFsConfig := user.FsConfig
+	currentVirtualFolders := user.VirtualFolders
 	user.Permissions = make(map[string][]string)
 	user.Filters.FileExtensions = []dataprovider.ExtensionsFilter{}
+	user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
+	user.VirtualFolders = nil
 	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
 		sendAPIResponse(w, r, err, "", http.StatusNotFound)
 		return
@@ -130,13 +134,15 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	if len(user.Filters.FileExtensions) == 0 {
 		user.Filters.FileExtensions = currentFileExtensions
 	}
-	// we use the new access secret if different from the old one and not empty
-	if user.FsConfig.Provider == 1 {
-		if utils.RemoveDecryptionKey(currentS3AccessSecret) == user.FsConfig.S3Config.AccessSecret ||
-			(len(user.FsConfig.S3Config.AccessSecret) == 0 && len(user.FsConfig.S3Config.AccessKey) > 0) {
-			user.FsConfig.S3Config.AccessSecret = currentS3AccessSecret
-		}
+	// TOTP can only be changed using the dedicated API
+	user.TOTPConfig = currentTOTPConfig
+	// we use the new virtual folders if passed otherwise the old ones
+	if user.VirtualFolders == nil {
+		user.VirtualFolders = currentVirtualFolders
+	} else {
+		restoreFoldersSecrets(user.VirtualFolders, currentVirtualFolders)
 	}
+	restoreFsSecrets(&user.FsConfig, currentFsConfig)
 	if user.ID != userID {
 		sendAPIResponse(w, r, err, "user ID in request body does not match user ID in path parameter", http.StatusBadRequest)
 		return
@@ -171,3 +177,134 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "User deleted", http.StatusOK)
 	}
 }
+
+// totpValidateRequest is the request body to enable TOTP for a user
+type totpValidateRequest struct {
+	Passcode string `json:"passcode"`
+}
+
+func getUserForTOTP(w http.ResponseWriter, r *http.Request) (dataprovider.User, bool) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return dataprovider.User{}, false
+	}
+	user, err := dataprovider.GetUserByID(dataProvider, userID)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return user, false
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return user, false
+	}
+	return user, true
+}
+
+func generateUserTOTPSecret(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUserForTOTP(w, r)
+	if !ok {
+		return
+	}
+	enrollment, err := dataprovider.GenerateTOTPSecret(dataProvider, user.Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, enrollment)
+}
+
+func enableUserTOTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	user, ok := getUserForTOTP(w, r)
+	if !ok {
+		return
+	}
+	var req totpValidateRequest
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	codes, err := dataprovider.EnableTOTP(dataProvider, user.Username, req.Passcode)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, codes)
+}
+
+func disableUserTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUserForTOTP(w, r)
+	if !ok {
+		return
+	}
+	err := dataprovider.DisableTOTP(dataProvider, user.Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "TOTP disabled", http.StatusOK)
+}
+
+// restoreFsSecrets replaces the redacted secrets in fsConfig with the current ones.
+// We use the new secrets if not redacted and not empty.
+// An empty passphrase disables the encryption, the redacted one keeps the current passphrase
+func restoreFsSecrets(fsConfig *dataprovider.Filesystem, currentFsConfig dataprovider.Filesystem) {
+	if fsConfig.Provider == 1 {
+		var currentS3AccessSecret kms.Secret
+		if currentFsConfig.Provider == 1 {
+			currentS3AccessSecret = currentFsConfig.S3Config.AccessSecret
+		}
+		if fsConfig.S3Config.AccessSecret.IsEmpty() && len(fsConfig.S3Config.AccessKey) > 0 {
+			fsConfig.S3Config.AccessSecret = currentS3AccessSecret
+		}
+		restoreSecret(&fsConfig.S3Config.AccessSecret, currentS3AccessSecret)
+	} else if fsConfig.Provider == 3 {
+		var currentAzAccountKey kms.Secret
+		if currentFsConfig.Provider == 3 {
+			currentAzAccountKey = currentFsConfig.AzBlobConfig.AccountKey
+		}
+		if fsConfig.AzBlobConfig.AccountKey.IsEmpty() && len(fsConfig.AzBlobConfig.AccountName) > 0 {
+			fsConfig.AzBlobConfig.AccountKey = currentAzAccountKey
+		}
+		restoreSecret(&fsConfig.AzBlobConfig.AccountKey, currentAzAccountKey)
+	} else if fsConfig.Provider == 4 {
+		var currentSFTPPassword, currentSFTPPrivateKey kms.Secret
+		if currentFsConfig.Provider == 4 {
+			currentSFTPPassword = currentFsConfig.SFTPConfig.Password
+			currentSFTPPrivateKey = currentFsConfig.SFTPConfig.PrivateKey
+		}
+		sftpConfig := &fsConfig.SFTPConfig
+		if sftpConfig.Password.IsEmpty() && sftpConfig.PrivateKey.IsEmpty() && len(sftpConfig.Username) > 0 {
+			sftpConfig.Password = currentSFTPPassword
+			sftpConfig.PrivateKey = currentSFTPPrivateKey
+		}
+		restoreSecret(&sftpConfig.Password, currentSFTPPassword)
+		restoreSecret(&sftpConfig.PrivateKey, currentSFTPPrivateKey)
+	}
+	restoreSecret(&fsConfig.CryptConfig.Passphrase, currentFsConfig.CryptConfig.Passphrase)
+}
+
+// restoreSecret replaces a redacted secret with the current one. A redacted secret
+// without a current value is left as is and it is rejected by the validation
+func restoreSecret(secret *kms.Secret, current kms.Secret) {
+	if secret.IsRedacted() && !current.IsEmpty() {
+		*secret = current
+	}
+}
+
+// restoreFoldersSecrets restores the redacted secrets for the virtual folders,
+// the current folders are matched using their virtual path
+func restoreFoldersSecrets(folders, currentFolders []dataprovider.VirtualFolder) {
+	for idx := range folders {
+		var currentFsConfig dataprovider.Filesystem
+		for _, current := range currentFolders {
+			if current.VirtualPath == folders[idx].VirtualPath {
+				currentFsConfig = current.FsConfig
+				break
+			}
+		}
+		restoreFsSecrets(&folders[idx].FsConfig, currentFsConfig)
+	}
+}
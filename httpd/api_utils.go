@@ -17,7 +17,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/drakkan/sftpgo/backup"
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/go-chi/render"
@@ -27,14 +29,23 @@ var (
 	httpBaseURL  = "http://127.0.0.1:8080"
 	authUsername = ""
 	authPassword = ""
+	authToken    = ""
 )
 
 // SetBaseURLAndCredentials sets the base url and the optional credentials to use for HTTP requests.
-// Default URL is "http://127.0.0.1:8080" with empty credentials
+// Default URL is "http://127.0.0.1:8080" with empty credentials.
+// Any Bearer token previously set is removed
 func SetBaseURLAndCredentials(url, username, password string) {
 	httpBaseURL = url
 	authUsername = username
 	authPassword = password
+	authToken = ""
+}
+
+// SetBearerToken sets a JWT or an API key to use for HTTP requests instead of the basic auth credentials.
+// An empty token restores the basic auth credentials
+func SetBearerToken(token string) {
+	authToken = token
 }
 
 // gets an HTTP Client with a timeout
@@ -50,9 +61,11 @@ func sendHTTPRequest(method, url string, body io.Reader, contentType string) (*h
 		return nil, err
 	}
 	if len(contentType) > 0 {
-		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Type", contentType)
 	}
-	if len(authUsername) > 0 || len(authPassword) > 0 {
+	if len(authToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	} else if len(authUsername) > 0 || len(authPassword) > 0 {
 		req.SetBasicAuth(authUsername, authPassword)
 	}
 	return getHTTPClient().Do(req)
@@ -70,90 +83,694 @@ func sendAPIResponse(w http.ResponseWriter, r *http.Request, err error, message
 	if err != nil {
 		errorString = err.Error()
 	}
-	resp := apiResponse{
-		Error:      errorString,
-		Message:    message,
-		HTTPStatus: code,
+	resp := apiResponse{
+		Error:      errorString,
+		Message:    message,
+		HTTPStatus: code,
+	}
+	ctx := context.WithValue(r.Context(), render.StatusCtxKey, code)
+	render.JSON(w, r.WithContext(ctx), resp)
+}
+
+func getRespStatus(err error) int {
+	if _, ok := err.(*dataprovider.ValidationError); ok {
+		return http.StatusBadRequest
+	}
+	if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+		return http.StatusForbidden
+	}
+	if os.IsNotExist(err) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// AddUser adds a new user and checks the received HTTP Status code against expectedStatusCode.
+func AddUser(user dataprovider.User, expectedStatusCode int) (dataprovider.User, []byte, error) {
+	var newUser dataprovider.User
+	var body []byte
+	userAsJSON, err := json.Marshal(user)
+	if err != nil {
+		return newUser, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(userPath), bytes.NewBuffer(userAsJSON),
+		"application/json")
+	if err != nil {
+		return newUser, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		body, _ = getResponseBody(resp)
+		return newUser, body, err
+	}
+	if err == nil {
+		err = render.DecodeJSON(resp.Body, &newUser)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	if err == nil {
+		err = checkUser(&user, &newUser)
+	}
+	return newUser, body, err
+}
+
+// UpdateUser updates an existing user and checks the received HTTP Status code against expectedStatusCode.
+func UpdateUser(user dataprovider.User, expectedStatusCode int) (dataprovider.User, []byte, error) {
+	var newUser dataprovider.User
+	var body []byte
+	userAsJSON, err := json.Marshal(user)
+	if err != nil {
+		return user, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPut, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10)),
+		bytes.NewBuffer(userAsJSON), "application/json")
+	if err != nil {
+		return user, body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		return newUser, body, err
+	}
+	if err == nil {
+		newUser, body, err = GetUserByID(user.ID, expectedStatusCode)
+	}
+	if err == nil {
+		err = checkUser(&user, &newUser)
+	}
+	return newUser, body, err
+}
+
+// RemoveUser removes an existing user and checks the received HTTP Status code against expectedStatusCode.
+func RemoveUser(user dataprovider.User, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10)), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GenerateUserTOTPSecret generates a new TOTP secret for the given user and checks the received HTTP Status
+// code against expectedStatusCode.
+func GenerateUserTOTPSecret(user dataprovider.User, expectedStatusCode int) (dataprovider.TOTPEnrollment, []byte, error) {
+	var enrollment dataprovider.TOTPEnrollment
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10),
+		"totp", "generate"), nil, "")
+	if err != nil {
+		return enrollment, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &enrollment)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return enrollment, body, err
+}
+
+// EnableUserTOTP enables TOTP for the given user if the passcode is valid and checks the received HTTP Status
+// code against expectedStatusCode.
+func EnableUserTOTP(user dataprovider.User, passcode string, expectedStatusCode int) (dataprovider.TOTPRecoveryCodes, []byte, error) {
+	var codes dataprovider.TOTPRecoveryCodes
+	var body []byte
+	reqAsJSON, err := json.Marshal(map[string]string{"passcode": passcode})
+	if err != nil {
+		return codes, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10),
+		"totp", "validate"), bytes.NewBuffer(reqAsJSON), "application/json")
+	if err != nil {
+		return codes, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &codes)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return codes, body, err
+}
+
+// DisableUserTOTP disables TOTP for the given user and checks the received HTTP Status code against expectedStatusCode.
+func DisableUserTOTP(user dataprovider.User, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10),
+		"totp"), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetUserByID gets an user by database id and checks the received HTTP Status code against expectedStatusCode.
+func GetUserByID(userID int64, expectedStatusCode int) (dataprovider.User, []byte, error) {
+	var user dataprovider.User
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(userPath, strconv.FormatInt(userID, 10)), nil, "")
+	if err != nil {
+		return user, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &user)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return user, body, err
+}
+
+// GetUsers allows to get a list of users and checks the received HTTP Status code against expectedStatusCode.
+// The number of results can be limited specifying a limit.
+// Some results can be skipped specifying an offset.
+// The results can be filtered specifying an username, the username filter is an exact match
+func GetUsers(limit int64, offset int64, username string, expectedStatusCode int) ([]dataprovider.User, []byte, error) {
+	var users []dataprovider.User
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(userPath))
+	if err != nil {
+		return users, body, err
+	}
+	q := url.Query()
+	if limit > 0 {
+		q.Add("limit", strconv.FormatInt(limit, 10))
+	}
+	if offset > 0 {
+		q.Add("offset", strconv.FormatInt(offset, 10))
+	}
+	if len(username) > 0 {
+		q.Add("username", username)
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return users, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &users)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return users, body, err
+}
+
+// AddShare adds a new share and checks the received HTTP Status code against expectedStatusCode.
+func AddShare(share dataprovider.Share, expectedStatusCode int) (dataprovider.Share, []byte, error) {
+	var newShare dataprovider.Share
+	var body []byte
+	shareAsJSON, err := json.Marshal(share)
+	if err != nil {
+		return newShare, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(sharePath), bytes.NewBuffer(shareAsJSON),
+		"application/json")
+	if err != nil {
+		return newShare, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		body, _ = getResponseBody(resp)
+		return newShare, body, err
+	}
+	if err == nil {
+		err = render.DecodeJSON(resp.Body, &newShare)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	if err == nil {
+		err = checkShare(&share, &newShare)
+	}
+	return newShare, body, err
+}
+
+// UpdateShare updates an existing share and checks the received HTTP Status code against expectedStatusCode.
+func UpdateShare(share dataprovider.Share, expectedStatusCode int) (dataprovider.Share, []byte, error) {
+	var newShare dataprovider.Share
+	var body []byte
+	shareAsJSON, err := json.Marshal(share)
+	if err != nil {
+		return share, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPut, buildURLRelativeToBase(sharePath, share.ShareID),
+		bytes.NewBuffer(shareAsJSON), "application/json")
+	if err != nil {
+		return share, body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		return newShare, body, err
+	}
+	if err == nil {
+		newShare, body, err = GetShareByID(share.ShareID, expectedStatusCode)
+	}
+	if err == nil {
+		err = checkShare(&share, &newShare)
+	}
+	return newShare, body, err
+}
+
+// RemoveShare removes an existing share and checks the received HTTP Status code against expectedStatusCode.
+func RemoveShare(share dataprovider.Share, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(sharePath, share.ShareID), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetShareByID gets a share by its share identifier and checks the received HTTP Status code against expectedStatusCode.
+func GetShareByID(shareID string, expectedStatusCode int) (dataprovider.Share, []byte, error) {
+	var share dataprovider.Share
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(sharePath, shareID), nil, "")
+	if err != nil {
+		return share, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &share)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return share, body, err
+}
+
+// GetShares allows to get a list of shares and checks the received HTTP Status code against expectedStatusCode.
+// The number of results can be limited specifying a limit.
+// Some results can be skipped specifying an offset.
+// The results can be filtered specifying an username, the username filter is an exact match
+func GetShares(limit int64, offset int64, username string, expectedStatusCode int) ([]dataprovider.Share, []byte, error) {
+	var shares []dataprovider.Share
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(sharePath))
+	if err != nil {
+		return shares, body, err
+	}
+	q := url.Query()
+	if limit > 0 {
+		q.Add("limit", strconv.FormatInt(limit, 10))
+	}
+	if offset > 0 {
+		q.Add("offset", strconv.FormatInt(offset, 10))
+	}
+	if len(username) > 0 {
+		q.Add("username", username)
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return shares, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &shares)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return shares, body, err
+}
+
+// AddAdmin adds a new admin and checks the received HTTP Status code against expectedStatusCode.
+func AddAdmin(admin dataprovider.Admin, expectedStatusCode int) (dataprovider.Admin, []byte, error) {
+	var newAdmin dataprovider.Admin
+	var body []byte
+	adminAsJSON, err := json.Marshal(admin)
+	if err != nil {
+		return newAdmin, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(adminPath), bytes.NewBuffer(adminAsJSON),
+		"application/json")
+	if err != nil {
+		return newAdmin, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		body, _ = getResponseBody(resp)
+		return newAdmin, body, err
+	}
+	if err == nil {
+		err = render.DecodeJSON(resp.Body, &newAdmin)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	if err == nil {
+		err = checkAdmin(&admin, &newAdmin)
+	}
+	return newAdmin, body, err
+}
+
+// UpdateAdmin updates an existing admin and checks the received HTTP Status code against expectedStatusCode.
+func UpdateAdmin(admin dataprovider.Admin, expectedStatusCode int) (dataprovider.Admin, []byte, error) {
+	var newAdmin dataprovider.Admin
+	var body []byte
+	adminAsJSON, err := json.Marshal(admin)
+	if err != nil {
+		return admin, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPut, buildURLRelativeToBase(adminPath, url.PathEscape(admin.Username)),
+		bytes.NewBuffer(adminAsJSON), "application/json")
+	if err != nil {
+		return admin, body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		return newAdmin, body, err
+	}
+	if err == nil {
+		newAdmin, body, err = GetAdminByUsername(admin.Username, expectedStatusCode)
+	}
+	if err == nil {
+		err = checkAdmin(&admin, &newAdmin)
+	}
+	return newAdmin, body, err
+}
+
+// RemoveAdmin removes an existing admin and checks the received HTTP Status code against expectedStatusCode.
+func RemoveAdmin(admin dataprovider.Admin, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(adminPath, url.PathEscape(admin.Username)),
+		nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetAdminByUsername gets an admin by username and checks the received HTTP Status code against expectedStatusCode.
+func GetAdminByUsername(username string, expectedStatusCode int) (dataprovider.Admin, []byte, error) {
+	var admin dataprovider.Admin
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(adminPath, url.PathEscape(username)), nil, "")
+	if err != nil {
+		return admin, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &admin)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return admin, body, err
+}
+
+// GetAdmins allows to get a list of admins and checks the received HTTP Status code against expectedStatusCode.
+// The number of results can be limited specifying a limit.
+// Some results can be skipped specifying an offset.
+func GetAdmins(limit, offset int64, expectedStatusCode int) ([]dataprovider.Admin, []byte, error) {
+	var admins []dataprovider.Admin
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(adminPath))
+	if err != nil {
+		return admins, body, err
+	}
+	q := url.Query()
+	if limit > 0 {
+		q.Add("limit", strconv.FormatInt(limit, 10))
+	}
+	if offset > 0 {
+		q.Add("offset", strconv.FormatInt(offset, 10))
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return admins, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &admins)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return admins, body, err
+}
+
+// AddGroup adds a new group and checks the received HTTP Status code against expectedStatusCode.
+func AddGroup(group dataprovider.Group, expectedStatusCode int) (dataprovider.Group, []byte, error) {
+	var newGroup dataprovider.Group
+	var body []byte
+	groupAsJSON, err := json.Marshal(group)
+	if err != nil {
+		return newGroup, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(groupPath), bytes.NewBuffer(groupAsJSON),
+		"application/json")
+	if err != nil {
+		return newGroup, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		body, _ = getResponseBody(resp)
+		return newGroup, body, err
+	}
+	if err == nil {
+		err = render.DecodeJSON(resp.Body, &newGroup)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	if err == nil {
+		err = checkGroup(&group, &newGroup)
+	}
+	return newGroup, body, err
+}
+
+// UpdateGroup updates an existing group and checks the received HTTP Status code against expectedStatusCode.
+func UpdateGroup(group dataprovider.Group, expectedStatusCode int) (dataprovider.Group, []byte, error) {
+	var newGroup dataprovider.Group
+	var body []byte
+	groupAsJSON, err := json.Marshal(group)
+	if err != nil {
+		return group, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPut, buildURLRelativeToBase(groupPath, url.PathEscape(group.Name)),
+		bytes.NewBuffer(groupAsJSON), "application/json")
+	if err != nil {
+		return group, body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		return newGroup, body, err
+	}
+	if err == nil {
+		newGroup, body, err = GetGroupByName(group.Name, expectedStatusCode)
+	}
+	if err == nil {
+		err = checkGroup(&group, &newGroup)
+	}
+	return newGroup, body, err
+}
+
+// RemoveGroup removes an existing group and checks the received HTTP Status code against expectedStatusCode.
+func RemoveGroup(group dataprovider.Group, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(groupPath, url.PathEscape(group.Name)),
+		nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetGroupByName gets a group by name and checks the received HTTP Status code against expectedStatusCode.
+func GetGroupByName(name string, expectedStatusCode int) (dataprovider.Group, []byte, error) {
+	var group dataprovider.Group
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(groupPath, url.PathEscape(name)), nil, "")
+	if err != nil {
+		return group, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &group)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return group, body, err
+}
+
+// GetGroups allows to get a list of groups and checks the received HTTP Status code against expectedStatusCode.
+// The number of results can be limited specifying a limit.
+// Some results can be skipped specifying an offset.
+func GetGroups(limit, offset int64, expectedStatusCode int) ([]dataprovider.Group, []byte, error) {
+	var groups []dataprovider.Group
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(groupPath))
+	if err != nil {
+		return groups, body, err
+	}
+	q := url.Query()
+	if limit > 0 {
+		q.Add("limit", strconv.FormatInt(limit, 10))
+	}
+	if offset > 0 {
+		q.Add("offset", strconv.FormatInt(offset, 10))
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return groups, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &groups)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return groups, body, err
+}
+
+// GetBannedIPs allows to get a list of the hosts banned by the defender and checks the received HTTP Status code
+// against expectedStatusCode.
+// The number of results can be limited specifying a limit.
+// Some results can be skipped specifying an offset.
+func GetBannedIPs(limit, offset int64, expectedStatusCode int) ([]dataprovider.BannedIP, []byte, error) {
+	var bans []dataprovider.BannedIP
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(defenderBansPath))
+	if err != nil {
+		return bans, body, err
+	}
+	q := url.Query()
+	if limit > 0 {
+		q.Add("limit", strconv.FormatInt(limit, 10))
+	}
+	if offset > 0 {
+		q.Add("offset", strconv.FormatInt(offset, 10))
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return bans, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &bans)
+	} else {
+		body, _ = getResponseBody(resp)
 	}
-	ctx := context.WithValue(r.Context(), render.StatusCtxKey, code)
-	render.JSON(w, r.WithContext(ctx), resp)
+	return bans, body, err
 }
 
-func getRespStatus(err error) int {
-	if _, ok := err.(*dataprovider.ValidationError); ok {
-		return http.StatusBadRequest
-	}
-	if _, ok := err.(*dataprovider.MethodDisabledError); ok {
-		return http.StatusForbidden
+// GetBannedIP gets the ban for the given IP address and checks the received HTTP Status code against expectedStatusCode.
+func GetBannedIP(ip string, expectedStatusCode int) (dataprovider.BannedIP, []byte, error) {
+	var ban dataprovider.BannedIP
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(defenderBansPath, url.PathEscape(ip)), nil, "")
+	if err != nil {
+		return ban, body, err
 	}
-	if os.IsNotExist(err) {
-		return http.StatusBadRequest
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &ban)
+	} else {
+		body, _ = getResponseBody(resp)
 	}
-	return http.StatusInternalServerError
+	return ban, body, err
 }
 
-// AddUser adds a new user and checks the received HTTP Status code against expectedStatusCode.
-func AddUser(user dataprovider.User, expectedStatusCode int) (dataprovider.User, []byte, error) {
-	var newUser dataprovider.User
+// RemoveBannedIP removes the ban for the given IP address and checks the received HTTP Status code
+// against expectedStatusCode.
+func RemoveBannedIP(ip string, expectedStatusCode int) ([]byte, error) {
 	var body []byte
-	userAsJSON, err := json.Marshal(user)
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(defenderBansPath, url.PathEscape(ip)),
+		nil, "")
 	if err != nil {
-		return newUser, body, err
+		return body, err
 	}
-	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(userPath), bytes.NewBuffer(userAsJSON),
-		"application/json")
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetToken requests a new token and checks the received HTTP Status code against expectedStatusCode.
+func GetToken(expectedStatusCode int) (string, []byte, error) {
+	var token tokenResponse
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(tokenPath), nil, "")
 	if err != nil {
-		return newUser, body, err
+		return token.AccessToken, body, err
 	}
 	defer resp.Body.Close()
 	err = checkResponse(resp.StatusCode, expectedStatusCode)
-	if expectedStatusCode != http.StatusOK {
-		body, _ = getResponseBody(resp)
-		return newUser, body, err
-	}
-	if err == nil {
-		err = render.DecodeJSON(resp.Body, &newUser)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &token)
 	} else {
 		body, _ = getResponseBody(resp)
 	}
-	if err == nil {
-		err = checkUser(&user, &newUser)
-	}
-	return newUser, body, err
+	return token.AccessToken, body, err
 }
 
-// UpdateUser updates an existing user and checks the received HTTP Status code against expectedStatusCode.
-func UpdateUser(user dataprovider.User, expectedStatusCode int) (dataprovider.User, []byte, error) {
-	var newUser dataprovider.User
+// AddAPIKey adds a new API key and checks the received HTTP Status code against expectedStatusCode.
+// The returned API key contains the plain key, it can be used as Bearer token
+func AddAPIKey(key dataprovider.APIKey, expectedStatusCode int) (dataprovider.APIKey, []byte, error) {
+	var newKey dataprovider.APIKey
 	var body []byte
-	userAsJSON, err := json.Marshal(user)
+	keyAsJSON, err := json.Marshal(key)
 	if err != nil {
-		return user, body, err
+		return newKey, body, err
 	}
-	resp, err := sendHTTPRequest(http.MethodPut, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10)),
-		bytes.NewBuffer(userAsJSON), "application/json")
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(apiKeyPath), bytes.NewBuffer(keyAsJSON),
+		"application/json")
 	if err != nil {
-		return user, body, err
+		return newKey, body, err
 	}
 	defer resp.Body.Close()
-	body, _ = getResponseBody(resp)
 	err = checkResponse(resp.StatusCode, expectedStatusCode)
 	if expectedStatusCode != http.StatusOK {
-		return newUser, body, err
+		body, _ = getResponseBody(resp)
+		return newKey, body, err
 	}
 	if err == nil {
-		newUser, body, err = GetUserByID(user.ID, expectedStatusCode)
+		err = render.DecodeJSON(resp.Body, &newKey)
+	} else {
+		body, _ = getResponseBody(resp)
 	}
 	if err == nil {
-		err = checkUser(&user, &newUser)
+		err = checkAPIKey(&key, &newKey)
 	}
-	return newUser, body, err
+	return newKey, body, err
 }
 
-// RemoveUser removes an existing user and checks the received HTTP Status code against expectedStatusCode.
-func RemoveUser(user dataprovider.User, expectedStatusCode int) ([]byte, error) {
+// RemoveAPIKey revokes an existing API key and checks the received HTTP Status code against expectedStatusCode.
+func RemoveAPIKey(key dataprovider.APIKey, expectedStatusCode int) ([]byte, error) {
 	var body []byte
-	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10)), nil, "")
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(apiKeyPath, url.PathEscape(key.KeyID)),
+		nil, "")
 	if err != nil {
 		return body, err
 	}
@@ -162,34 +779,34 @@ func RemoveUser(user dataprovider.User, expectedStatusCode int) ([]byte, error)
 	return body, checkResponse(resp.StatusCode, expectedStatusCode)
 }
 
-// GetUserByID gets an user by database id and checks the received HTTP Status code against expectedStatusCode.
-func GetUserByID(userID int64, expectedStatusCode int) (dataprovider.User, []byte, error) {
-	var user dataprovider.User
+// GetAPIKeyByID gets an API key by its key ID and checks the received HTTP Status code against expectedStatusCode.
+func GetAPIKeyByID(keyID string, expectedStatusCode int) (dataprovider.APIKey, []byte, error) {
+	var key dataprovider.APIKey
 	var body []byte
-	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(userPath, strconv.FormatInt(userID, 10)), nil, "")
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(apiKeyPath, url.PathEscape(keyID)), nil, "")
 	if err != nil {
-		return user, body, err
+		return key, body, err
 	}
 	defer resp.Body.Close()
 	err = checkResponse(resp.StatusCode, expectedStatusCode)
 	if err == nil && expectedStatusCode == http.StatusOK {
-		err = render.DecodeJSON(resp.Body, &user)
+		err = render.DecodeJSON(resp.Body, &key)
 	} else {
 		body, _ = getResponseBody(resp)
 	}
-	return user, body, err
+	return key, body, err
 }
 
-// GetUsers allows to get a list of users and checks the received HTTP Status code against expectedStatusCode.
+// GetAPIKeys allows to get a list of API keys, owned by the authenticated admin, and checks the received
+// HTTP Status code against expectedStatusCode.
 // The number of results can be limited specifying a limit.
 // Some results can be skipped specifying an offset.
-// The results can be filtered specifying an username, the username filter is an exact match
-func GetUsers(limit int64, offset int64, username string, expectedStatusCode int) ([]dataprovider.User, []byte, error) {
-	var users []dataprovider.User
+func GetAPIKeys(limit, offset int64, expectedStatusCode int) ([]dataprovider.APIKey, []byte, error) {
+	var keys []dataprovider.APIKey
 	var body []byte
-	url, err := url.Parse(buildURLRelativeToBase(userPath))
+	url, err := url.Parse(buildURLRelativeToBase(apiKeyPath))
 	if err != nil {
-		return users, body, err
+		return keys, body, err
 	}
 	q := url.Query()
 	if limit > 0 {
@@ -198,22 +815,19 @@ func GetUsers(limit int64, offset int64, username string, expectedStatusCode int
 	if offset > 0 {
 		q.Add("offset", strconv.FormatInt(offset, 10))
 	}
-	if len(username) > 0 {
-		q.Add("username", username)
-	}
 	url.RawQuery = q.Encode()
 	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
 	if err != nil {
-		return users, body, err
+		return keys, body, err
 	}
 	defer resp.Body.Close()
 	err = checkResponse(resp.StatusCode, expectedStatusCode)
 	if err == nil && expectedStatusCode == http.StatusOK {
-		err = render.DecodeJSON(resp.Body, &users)
+		err = render.DecodeJSON(resp.Body, &keys)
 	} else {
 		body, _ = getResponseBody(resp)
 	}
-	return users, body, err
+	return keys, body, err
 }
 
 // GetQuotaScans gets active quota scans and checks the received HTTP Status code against expectedStatusCode.
@@ -268,6 +882,25 @@ func GetConnections(expectedStatusCode int) ([]sftpd.ConnectionStatus, []byte, e
 	return connections, body, err
 }
 
+// GetNetConnectionsStatus returns the status for the network connections accepted by the SFTP server
+// and checks the received HTTP Status code against expectedStatusCode.
+func GetNetConnectionsStatus(expectedStatusCode int) (sftpd.NetConnectionsStatus, []byte, error) {
+	var status sftpd.NetConnectionsStatus
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(connectionsStatsPath), nil, "")
+	if err != nil {
+		return status, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &status)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return status, body, err
+}
+
 // CloseConnection closes an active  connection identified by connectionID
 func CloseConnection(connectionID string, expectedStatusCode int) ([]byte, error) {
 	var body []byte
@@ -317,6 +950,24 @@ func GetProviderStatus(expectedStatusCode int) (map[string]interface{}, []byte,
 	return response, body, err
 }
 
+// GetBackupStatus returns the status for the scheduled backups
+func GetBackupStatus(expectedStatusCode int) (backup.Status, []byte, error) {
+	var status backup.Status
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(backupStatusPath), nil, "")
+	if err != nil {
+		return status, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &status)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return status, body, err
+}
+
 // Dumpdata requests a backup to outputFile.
 // outputFile is relative to the configured backups_path
 func Dumpdata(outputFile, indent string, expectedStatusCode int) (map[string]interface{}, []byte, error) {
@@ -347,8 +998,8 @@ func Dumpdata(outputFile, indent string, expectedStatusCode int) (map[string]int
 }
 
 // Loaddata restores a backup.
-// New users are added, existing users are updated. Users will be restored one by one and the restore is stopped if a
-// user cannot be added/updated, so it could happen a partial restore
+// New users are added, existing users are updated. Users will be restored one by one and a user that cannot be
+// added/updated is reported inside the response and it does not stop the restore, so it could happen a partial restore
 func Loaddata(inputFile, scanQuota, mode string, expectedStatusCode int) (map[string]interface{}, []byte, error) {
 	var response map[string]interface{}
 	var body []byte
@@ -379,6 +1030,59 @@ func Loaddata(inputFile, scanQuota, mode string, expectedStatusCode int) (map[st
 	return response, body, err
 }
 
+// DumpdataAsResponse returns the backup streamed inside the response body instead of saving it
+// to a local file
+func DumpdataAsResponse(indent string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(dumpDataPath))
+	if err != nil {
+		return body, err
+	}
+	q := url.Query()
+	q.Add("output_data", "1")
+	if len(indent) > 0 {
+		q.Add("indent", indent)
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// LoaddataFromReader restores a backup sent inside the request body. If contentType is
+// multipart/form-data the body must contain the backup inside the "backup_file" field,
+// otherwise the body must be the backup as JSON.
+// Users that cannot be restored are reported inside the response and they do not stop the restore
+func LoaddataFromReader(body io.Reader, contentType, scanQuota, mode string, expectedStatusCode int) (map[string]interface{}, error) {
+	var response map[string]interface{}
+	url, err := url.Parse(buildURLRelativeToBase(loadDataPath))
+	if err != nil {
+		return response, err
+	}
+	q := url.Query()
+	if len(scanQuota) > 0 {
+		q.Add("scan_quota", scanQuota)
+	}
+	if len(mode) > 0 {
+		q.Add("mode", mode)
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodPost, url.String(), body, contentType)
+	if err != nil {
+		return response, err
+	}
+	defer resp.Body.Close()
+	err = render.DecodeJSON(resp.Body, &response)
+	if err != nil {
+		return response, err
+	}
+	return response, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
 func checkResponse(actual int, expected int) error {
 	if expected != actual {
 		return fmt.Errorf("wrong status code: got %v want %v", actual, expected)
@@ -394,6 +1098,9 @@ func checkUser(expected *dataprovider.User, actual *dataprovider.User) error {
 	if len(actual.Password) > 0 {
 		return errors.New("User password must not be visible")
 	}
+	if !actual.TOTPConfig.Secret.IsEmpty() || len(actual.TOTPConfig.RecoveryCodes) > 0 {
+		return errors.New("User TOTP secret and recovery codes must not be visible")
+	}
 	if expected.ID <= 0 {
 		if actual.ID <= 0 {
 			return errors.New("actual user ID must be > 0")
@@ -426,9 +1133,160 @@ func checkUser(expected *dataprovider.User, actual *dataprovider.User) error {
 	if err := compareUserVirtualFolders(expected, actual); err != nil {
 		return err
 	}
+	if len(expected.Groups) != len(actual.Groups) {
+		return errors.New("groups mismatch")
+	}
+	for idx, g := range expected.Groups {
+		if actual.Groups[idx] != g {
+			return errors.New("groups mismatch")
+		}
+	}
 	return compareEqualsUserFields(expected, actual)
 }
 
+func checkShare(expected *dataprovider.Share, actual *dataprovider.Share) error {
+	if len(actual.ShareID) == 0 {
+		return errors.New("share ID must be set")
+	}
+	if len(expected.ShareID) > 0 && expected.ShareID != actual.ShareID {
+		return errors.New("share ID mismatch")
+	}
+	if expected.HasPassword() != actual.HasPassword() {
+		return errors.New("share password mismatch")
+	}
+	if actual.HasPassword() && actual.Password != "[**redacted**]" {
+		return errors.New("share password must not be visible")
+	}
+	if expected.Username != actual.Username {
+		return errors.New("username mismatch")
+	}
+	if utils.CleanSFTPPath(expected.Path) != actual.Path {
+		return errors.New("path mismatch")
+	}
+	if expected.Scope != actual.Scope {
+		return errors.New("scope mismatch")
+	}
+	if expected.Description != actual.Description {
+		return errors.New("description mismatch")
+	}
+	if expected.ExpiresAt != actual.ExpiresAt {
+		return errors.New("expires_at mismatch")
+	}
+	if expected.MaxTokens != actual.MaxTokens {
+		return errors.New("max_tokens mismatch")
+	}
+	return nil
+}
+
+func checkAdmin(expected *dataprovider.Admin, actual *dataprovider.Admin) error {
+	if len(actual.Password) > 0 {
+		return errors.New("admin password must not be visible")
+	}
+	if expected.Username != actual.Username {
+		return errors.New("username mismatch")
+	}
+	if expected.Status != actual.Status {
+		return errors.New("status mismatch")
+	}
+	if expected.Email != actual.Email {
+		return errors.New("email mismatch")
+	}
+	if expected.Description != actual.Description {
+		return errors.New("description mismatch")
+	}
+	if len(expected.Permissions) != len(actual.Permissions) {
+		return errors.New("permissions mismatch")
+	}
+	for _, p := range expected.Permissions {
+		if !utils.IsStringInSlice(p, actual.Permissions) {
+			return errors.New("permissions mismatch")
+		}
+	}
+	return nil
+}
+
+func checkGroup(expected *dataprovider.Group, actual *dataprovider.Group) error {
+	if expected.ID <= 0 {
+		if actual.ID <= 0 {
+			return errors.New("actual group ID must be > 0")
+		}
+	} else if actual.ID != expected.ID {
+		return errors.New("group ID mismatch")
+	}
+	if expected.Name != actual.Name {
+		return errors.New("name mismatch")
+	}
+	if expected.Description != actual.Description {
+		return errors.New("description mismatch")
+	}
+	expectedUser := dataprovider.User{
+		MaxSessions:       expected.UserSettings.MaxSessions,
+		QuotaSize:         expected.UserSettings.QuotaSize,
+		QuotaFiles:        expected.UserSettings.QuotaFiles,
+		UploadBandwidth:   expected.UserSettings.UploadBandwidth,
+		DownloadBandwidth: expected.UserSettings.DownloadBandwidth,
+		Filters:           expected.UserSettings.Filters,
+		FsConfig:          expected.UserSettings.FsConfig,
+		VirtualFolders:    expected.UserSettings.VirtualFolders,
+	}
+	actualUser := dataprovider.User{
+		MaxSessions:       actual.UserSettings.MaxSessions,
+		QuotaSize:         actual.UserSettings.QuotaSize,
+		QuotaFiles:        actual.UserSettings.QuotaFiles,
+		UploadBandwidth:   actual.UserSettings.UploadBandwidth,
+		DownloadBandwidth: actual.UserSettings.DownloadBandwidth,
+		Filters:           actual.UserSettings.Filters,
+		FsConfig:          actual.UserSettings.FsConfig,
+		VirtualFolders:    actual.UserSettings.VirtualFolders,
+	}
+	if len(expected.UserSettings.Permissions) != len(actual.UserSettings.Permissions) {
+		return errors.New("permissions mismatch")
+	}
+	for dir, perms := range expected.UserSettings.Permissions {
+		actualPerms, ok := actual.UserSettings.Permissions[dir]
+		if !ok || len(actualPerms) != len(perms) {
+			return errors.New("permissions mismatch")
+		}
+	}
+	if err := compareUserFilters(&expectedUser, &actualUser); err != nil {
+		return err
+	}
+	if err := compareUserFsConfig(&expectedUser, &actualUser); err != nil {
+		return err
+	}
+	if err := compareUserVirtualFolders(&expectedUser, &actualUser); err != nil {
+		return err
+	}
+	return compareEqualsUserFields(&expectedUser, &actualUser)
+}
+
+func checkAPIKey(expected *dataprovider.APIKey, actual *dataprovider.APIKey) error {
+	if len(actual.KeyID) == 0 || !strings.HasPrefix(actual.Key, actual.KeyID+".") {
+		return errors.New("the plain API key must be returned")
+	}
+	if expected.Name != actual.Name {
+		return errors.New("name mismatch")
+	}
+	if expected.Description != actual.Description {
+		return errors.New("description mismatch")
+	}
+	if expected.ExpiresAt != actual.ExpiresAt {
+		return errors.New("expires_at mismatch")
+	}
+	if actual.CreatedAt == 0 {
+		return errors.New("created_at not set")
+	}
+	if len(expected.Permissions) != len(actual.Permissions) {
+		return errors.New("permissions mismatch")
+	}
+	for _, p := range expected.Permissions {
+		if !utils.IsStringInSlice(p, actual.Permissions) {
+			return errors.New("permissions mismatch")
+		}
+	}
+	return nil
+}
+
 func compareUserVirtualFolders(expected *dataprovider.User, actual *dataprovider.User) error {
 	if len(actual.VirtualFolders) != len(expected.VirtualFolders) {
 		return errors.New("Virtual folders mismatch")
@@ -436,11 +1294,19 @@ func compareUserVirtualFolders(expected *dataprovider.User, actual *dataprovider
 	for _, v := range actual.VirtualFolders {
 		found := false
 		for _, v1 := range expected.VirtualFolders {
-			if path.Clean(v.VirtualPath) == path.Clean(v1.VirtualPath) &&
-				filepath.Clean(v.MappedPath) == filepath.Clean(v1.MappedPath) {
-				found = true
-				break
+			if path.Clean(v.VirtualPath) != path.Clean(v1.VirtualPath) {
+				continue
+			}
+			if v.QuotaSize != v1.QuotaSize || v.QuotaFiles != v1.QuotaFiles ||
+				v.FsConfig.Provider != v1.FsConfig.Provider {
+				return errors.New("Virtual folders mismatch")
 			}
+			// the mapped path is ignored for folders not stored on the local filesystem
+			if v.FsConfig.Provider == 0 && filepath.Clean(v.MappedPath) != filepath.Clean(v1.MappedPath) {
+				return errors.New("Virtual folders mismatch")
+			}
+			found = true
+			break
 		}
 		if !found {
 			return errors.New("Virtual folders mismatch")
@@ -459,7 +1325,14 @@ func compareUserFsConfig(expected *dataprovider.User, actual *dataprovider.User)
 	if err := compareGCSConfig(expected, actual); err != nil {
 		return err
 	}
-	return nil
+	if err := compareAzBlobConfig(expected, actual); err != nil {
+		return err
+	}
+	if err := compareSFTPFsConfig(expected, actual); err != nil {
+		return err
+	}
+	return checkEncryptedSecret("CryptFs passphrase", expected.FsConfig.CryptConfig.Passphrase,
+		actual.FsConfig.CryptConfig.Passphrase)
 }
 
 func compareS3Config(expected *dataprovider.User, actual *dataprovider.User) error {
@@ -472,7 +1345,8 @@ func compareS3Config(expected *dataprovider.User, actual *dataprovider.User) err
 	if expected.FsConfig.S3Config.AccessKey != actual.FsConfig.S3Config.AccessKey {
 		return errors.New("S3 access key mismatch")
 	}
-	if err := checkS3AccessSecret(expected.FsConfig.S3Config.AccessSecret, actual.FsConfig.S3Config.AccessSecret); err != nil {
+	if err := checkEncryptedSecret("S3 access secret", expected.FsConfig.S3Config.AccessSecret,
+		actual.FsConfig.S3Config.AccessSecret); err != nil {
 		return err
 	}
 	if expected.FsConfig.S3Config.Endpoint != actual.FsConfig.S3Config.Endpoint {
@@ -511,30 +1385,87 @@ func compareGCSConfig(expected *dataprovider.User, actual *dataprovider.User) er
 	return nil
 }
 
-func checkS3AccessSecret(expectedAccessSecret, actualAccessSecret string) error {
-	if len(expectedAccessSecret) > 0 {
-		vals := strings.Split(expectedAccessSecret, "$")
-		if strings.HasPrefix(expectedAccessSecret, "$aes$") && len(vals) == 4 {
-			expectedAccessSecret = utils.RemoveDecryptionKey(expectedAccessSecret)
-			if expectedAccessSecret != actualAccessSecret {
-				return fmt.Errorf("S3 access secret mismatch, expected: %v", expectedAccessSecret)
-			}
-		} else {
-			// here we check that actualAccessSecret is aes encrypted without the nonce
-			parts := strings.Split(actualAccessSecret, "$")
-			if !strings.HasPrefix(actualAccessSecret, "$aes$") || len(parts) != 3 {
-				return errors.New("Invalid S3 access secret")
-			}
-			if len(parts) == len(vals) {
-				if expectedAccessSecret != actualAccessSecret {
-					return errors.New("S3 encrypted access secret mismatch")
-				}
-			}
+func compareAzBlobConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.AzBlobConfig.Container != actual.FsConfig.AzBlobConfig.Container {
+		return errors.New("Azure Blob container mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.AccountName != actual.FsConfig.AzBlobConfig.AccountName {
+		return errors.New("Azure Blob account name mismatch")
+	}
+	if err := checkEncryptedSecret("Azure Blob account key", expected.FsConfig.AzBlobConfig.AccountKey,
+		actual.FsConfig.AzBlobConfig.AccountKey); err != nil {
+		return err
+	}
+	if expected.FsConfig.AzBlobConfig.Endpoint != actual.FsConfig.AzBlobConfig.Endpoint {
+		return errors.New("Azure Blob endpoint mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.SASURL != actual.FsConfig.AzBlobConfig.SASURL {
+		return errors.New("Azure Blob SAS URL mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.UploadPartSize != actual.FsConfig.AzBlobConfig.UploadPartSize {
+		return errors.New("Azure Blob upload part size mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.UploadConcurrency != actual.FsConfig.AzBlobConfig.UploadConcurrency {
+		return errors.New("Azure Blob upload concurrency mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.UseEmulator != actual.FsConfig.AzBlobConfig.UseEmulator {
+		return errors.New("Azure Blob use emulator mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.AccessTier != actual.FsConfig.AzBlobConfig.AccessTier {
+		return errors.New("Azure Blob access tier mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.KeyPrefix != actual.FsConfig.AzBlobConfig.KeyPrefix &&
+		expected.FsConfig.AzBlobConfig.KeyPrefix+"/" != actual.FsConfig.AzBlobConfig.KeyPrefix {
+		return errors.New("Azure Blob key prefix mismatch")
+	}
+	return nil
+}
+
+func compareSFTPFsConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.SFTPConfig.Endpoint != actual.FsConfig.SFTPConfig.Endpoint {
+		return errors.New("SFTPFs endpoint mismatch")
+	}
+	if expected.FsConfig.SFTPConfig.Username != actual.FsConfig.SFTPConfig.Username {
+		return errors.New("SFTPFs username mismatch")
+	}
+	if err := checkEncryptedSecret("SFTPFs password", expected.FsConfig.SFTPConfig.Password,
+		actual.FsConfig.SFTPConfig.Password); err != nil {
+		return err
+	}
+	if err := checkEncryptedSecret("SFTPFs private key", expected.FsConfig.SFTPConfig.PrivateKey,
+		actual.FsConfig.SFTPConfig.PrivateKey); err != nil {
+		return err
+	}
+	if len(expected.FsConfig.SFTPConfig.Fingerprints) != len(actual.FsConfig.SFTPConfig.Fingerprints) {
+		return errors.New("SFTPFs fingerprints mismatch")
+	}
+	for _, value := range actual.FsConfig.SFTPConfig.Fingerprints {
+		if !utils.IsStringInSlice(value, expected.FsConfig.SFTPConfig.Fingerprints) {
+			return errors.New("SFTPFs fingerprints mismatch")
 		}
-	} else {
-		if expectedAccessSecret != actualAccessSecret {
-			return errors.New("S3 access secret mismatch")
+	}
+	if expected.FsConfig.SFTPConfig.Prefix != actual.FsConfig.SFTPConfig.Prefix {
+		// an empty prefix is saved as "/" and trailing slashes are removed
+		if path.Clean("/"+expected.FsConfig.SFTPConfig.Prefix) != actual.FsConfig.SFTPConfig.Prefix {
+			return errors.New("SFTPFs prefix mismatch")
+		}
+	}
+	return nil
+}
+
+func checkEncryptedSecret(secretName string, expectedSecret, actualSecret kms.Secret) error {
+	if expectedSecret.IsEmpty() {
+		if !actualSecret.IsEmpty() {
+			return fmt.Errorf("%v mismatch", secretName)
 		}
+		return nil
+	}
+	// the secrets are returned redacted, without the payload
+	if !actualSecret.IsRedacted() || len(actualSecret.Payload) > 0 || len(actualSecret.Provider) == 0 {
+		return fmt.Errorf("Invalid %v", secretName)
+	}
+	if expectedSecret.IsEncrypted() && actualSecret != expectedSecret.Redacted() {
+		return fmt.Errorf("%v mismatch, expected: %+v", secretName, expectedSecret.Redacted())
 	}
 	return nil
 }
@@ -564,6 +1495,14 @@ func compareUserFilters(expected *dataprovider.User, actual *dataprovider.User)
 			return errors.New("Denied login methods contents mismatch")
 		}
 	}
+	if len(expected.Filters.RequiredLoginMethods) != len(actual.Filters.RequiredLoginMethods) {
+		return errors.New("Required login methods mismatch")
+	}
+	for _, method := range expected.Filters.RequiredLoginMethods {
+		if !utils.IsStringInSlice(method, actual.Filters.RequiredLoginMethods) {
+			return errors.New("Required login methods contents mismatch")
+		}
+	}
 	if err := compareUserFileExtensionsFilters(expected, actual); err != nil {
 		return err
 	}
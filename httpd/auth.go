@@ -1,117 +1,172 @@
 package httpd
 
 import (
+	"context"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
-	"sync"
 
+	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
-	unixcrypt "github.com/nathanaelle/password"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	authenticationHeader = "WWW-Authenticate"
 	authenticationRealm  = "SFTPGo Web"
 	unauthResponse       = "Unauthorized"
+	forbiddenResponse    = "Forbidden"
+	bearerAuthPrefix     = "Bearer "
 )
 
-var (
-	md5CryptPwdPrefixes = []string{"$1$", "$apr1$"}
-	bcryptPwdPrefixes   = []string{"$2a$", "$2$", "$2x$", "$2y$", "$2b$"}
+// supported authentication methods
+const (
+	// no admin is defined, authentication is disabled
+	authMethodNone     = "none"
+	authMethodPassword = "password"
+	authMethodToken    = "token"
+	authMethodAPIKey   = "api_key"
 )
 
-type httpAuthProvider interface {
-	getHashedPassword(username string) (string, bool)
-	isEnabled() bool
-}
-
-type basicAuthProvider struct {
-	Path  string
-	Info  os.FileInfo
-	Users map[string]string
-	lock  *sync.RWMutex
-}
-
-func newBasicAuthProvider(authUserFile string) (httpAuthProvider, error) {
-	basicAuthProvider := basicAuthProvider{
-		Path:  authUserFile,
-		Info:  nil,
-		Users: make(map[string]string),
-		lock:  new(sync.RWMutex),
-	}
-	return &basicAuthProvider, basicAuthProvider.loadUsers()
-}
-
-func (p *basicAuthProvider) isEnabled() bool {
-	return len(p.Path) > 0
-}
+const (
+	adminContextKey      = contextKey("admin")
+	authMethodContextKey = contextKey("auth_method")
+	connAddrContextKey   = contextKey("connection_address")
+)
 
-func (p *basicAuthProvider) isReloadNeeded(info os.FileInfo) bool {
-	p.lock.RLock()
-	defer p.lock.RUnlock()
-	return p.Info == nil || p.Info.ModTime() != info.ModTime() || p.Info.Size() != info.Size()
-}
+var (
+	errNoCredentials = errors.New("no credentials provided")
+	errHostBanned    = errors.New("Access denied, banned client IP")
+)
 
-func (p *basicAuthProvider) loadUsers() error {
-	if !p.isEnabled() {
+// importAuthUserFile imports the users defined in an htpasswd file as admins
+// with all the permissions. The import is done only if no admin is defined
+// inside the data provider. The htpasswd file is deprecated, admins should
+// be managed using the REST API or the web interface
+func importAuthUserFile(authUserFile string) error {
+	if len(authUserFile) == 0 {
 		return nil
 	}
-	info, err := os.Stat(p.Path)
+	r, err := os.Open(authUserFile)
 	if err != nil {
-		logger.Debug(logSender, "", "unable to stat basic auth users file: %v", err)
+		logger.Warn(logSender, "", "unable to open basic auth users file: %v", err)
 		return err
 	}
-	if p.isReloadNeeded(info) {
-		r, err := os.Open(p.Path)
-		if err != nil {
-			logger.Debug(logSender, "", "unable to open basic auth users file: %v", err)
-			return err
+	defer r.Close()
+	reader := csv.NewReader(r)
+	reader.Comma = ':'
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		logger.Warn(logSender, "", "unable to parse basic auth users file: %v", err)
+		return err
+	}
+	hasAdmins, err := dataprovider.HasAdmins(dataProvider)
+	if err != nil {
+		return err
+	}
+	if hasAdmins {
+		logger.Debug(logSender, "", "admins already defined, basic auth users file %#v ignored", authUserFile)
+		return nil
+	}
+	logger.Warn(logSender, "", "auth_user_file is deprecated, importing its users as admins with full permissions")
+	for _, record := range records {
+		if len(record) != 2 {
+			continue
 		}
-		defer r.Close()
-		reader := csv.NewReader(r)
-		reader.Comma = ':'
-		reader.Comment = '#'
-		reader.TrimLeadingSpace = true
-		records, err := reader.ReadAll()
-		if err != nil {
-			logger.Debug(logSender, "", "unable to parse basic auth users file: %v", err)
-			return err
+		admin := dataprovider.Admin{
+			Username:    record[0],
+			Password:    record[1],
+			Status:      1,
+			Permissions: []string{dataprovider.PermAdminAny},
 		}
-		p.lock.Lock()
-		defer p.lock.Unlock()
-		p.Users = make(map[string]string)
-		for _, record := range records {
-			if len(record) == 2 {
-				p.Users[record[0]] = record[1]
-			}
+		err = dataprovider.AddAdmin(dataProvider, admin)
+		logger.Debug(logSender, "", "importing admin %#v from basic auth users file, error: %v", admin.Username, err)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to import admin %#v: %v", admin.Username, err)
 		}
-		logger.Debug(logSender, "", "number of users loaded for httpd basic auth: %v", len(p.Users))
-		p.Info = info
 	}
 	return nil
 }
 
-func (p *basicAuthProvider) getHashedPassword(username string) (string, bool) {
-	err := p.loadUsers()
-	if err != nil {
-		return "", false
+// checkDenyList rejects the requests from the hosts inside the server wide deny list
+func checkDenyList(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ipAddr := utils.GetIPFromRemoteAddress(r.RemoteAddr)
+		if utils.IsIPDenyListed(ipAddr) {
+			logger.Debug(logSender, "", "request refused, the remote host %#v is deny listed", ipAddr)
+			sendAPIResponse(w, r, nil, "Access denied", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// saveConnectionAddress stores the address of the network connection inside the request
+// context. RealIP replaces the request remote address with the value of headers that
+// clients can set freely so the defender uses the saved address
+func saveConnectionAddress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), connAddrContextKey, r.RemoteAddr)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// getConnectionIP returns the IP address of the network connection for the given request
+func getConnectionIP(r *http.Request) string {
+	if addr, ok := r.Context().Value(connAddrContextKey).(string); ok {
+		return utils.GetIPFromRemoteAddress(addr)
 	}
-	p.lock.RLock()
-	defer p.lock.RUnlock()
-	pwd, ok := p.Users[username]
-	return pwd, ok
+	return utils.GetIPFromRemoteAddress(r.RemoteAddr)
+}
+
+// checkBannedHost returns errHostBanned if the defender banned the client
+// that sent the given request
+func checkBannedHost(r *http.Request) error {
+	if ipAddr := getConnectionIP(r); sftpd.IsBanned(ipAddr) {
+		logger.Debug(logSender, "", "request %v %v refused, the remote host %#v is banned", r.Method, r.RequestURI,
+			ipAddr)
+		return errHostBanned
+	}
+	return nil
 }
 
 func checkAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !validateCredentials(r) {
-			w.Header().Set(authenticationHeader, fmt.Sprintf("Basic realm=\"%v\"", authenticationRealm))
+		if err := checkBannedHost(r); err != nil {
+			if strings.HasPrefix(r.RequestURI, apiPrefix) {
+				sendAPIResponse(w, r, err, "", http.StatusForbidden)
+			} else {
+				http.Error(w, err.Error(), http.StatusForbidden)
+			}
+			return
+		}
+		hasAdmins, err := dataprovider.HasAdmins(dataProvider)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to check if admins are defined: %v", err)
+			if strings.HasPrefix(r.RequestURI, apiPrefix) {
+				sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+			} else {
+				http.Error(w, page500Body, http.StatusInternalServerError)
+			}
+			return
+		}
+		admin, authMethod, err := validateCredentials(r, hasAdmins)
+		if err != nil {
+			logger.Debug(logSender, "", "authentication failed for request %v %v: %v", r.Method, r.RequestURI, err)
+			if err != errNoCredentials {
+				sftpd.AddDefenderEvent(getConnectionIP(r), sftpd.GetLoginFailedEvent(err))
+			}
+			if authMethod == authMethodPassword {
+				w.Header().Set(authenticationHeader, fmt.Sprintf("Basic realm=\"%v\"", authenticationRealm))
+			} else {
+				w.Header().Set(authenticationHeader, fmt.Sprintf("Bearer realm=\"%v\"", authenticationRealm))
+			}
 			if strings.HasPrefix(r.RequestURI, apiPrefix) {
 				sendAPIResponse(w, r, errors.New(unauthResponse), "", http.StatusUnauthorized)
 			} else {
@@ -119,32 +174,113 @@ func checkAuth(next http.Handler) http.Handler {
 			}
 			return
 		}
-		next.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), adminContextKey, admin)
+		ctx = context.WithValue(ctx, authMethodContextKey, authMethod)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func validateCredentials(r *http.Request) bool {
-	if !httpAuth.isEnabled() {
-		return true
+// checkPerm returns a middleware that allows the request only if the
+// authenticated admin has the given permission.
+// Requests that can modify something are logged together with the admin
+// that made them
+func checkPerm(perm string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			admin := getAdminFromRequest(r)
+			if !admin.HasPermission(perm) {
+				logger.Info(logSender, "", "admin %#v is not allowed to %v %v, missing permission %#v", admin.Username,
+					r.Method, r.RequestURI, perm)
+				if strings.HasPrefix(r.RequestURI, apiPrefix) {
+					sendAPIResponse(w, r, errors.New(forbiddenResponse), "", http.StatusForbidden)
+				} else {
+					http.Error(w, forbiddenResponse, http.StatusForbidden)
+				}
+				return
+			}
+			if r.Method != http.MethodGet || perm == dataprovider.PermAdminManageBackups {
+				logger.Info(logSender, "", "admin %#v request %v %v", admin.Username, r.Method, r.RequestURI)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// checkAuthMethod returns a middleware that allows the request only if the admin
+// was authenticated using one of the given methods
+func checkAuthMethod(methods ...string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authMethod := getAuthMethodFromRequest(r)
+			if !utils.IsStringInSlice(authMethod, methods) {
+				logger.Info(logSender, "", "admin %#v is not allowed to %v %v using the authentication method %#v",
+					getAdminFromRequest(r).Username, r.Method, r.RequestURI, authMethod)
+				sendAPIResponse(w, r, fmt.Errorf("authentication method %#v is not allowed for this request", authMethod),
+					"", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// getAuthMethodFromRequest returns the method used by checkAuth to authenticate the admin
+func getAuthMethodFromRequest(r *http.Request) string {
+	if authMethod, ok := r.Context().Value(authMethodContextKey).(string); ok {
+		return authMethod
+	}
+	return ""
+}
+
+// getAdminFromRequest returns the admin authenticated by checkAuth
+func getAdminFromRequest(r *http.Request) dataprovider.Admin {
+	if admin, ok := r.Context().Value(adminContextKey).(dataprovider.Admin); ok {
+		return admin
+	}
+	return dataprovider.Admin{}
+}
+
+// validateCredentials returns the admin matching the basic auth credentials or
+// the Bearer token, a JWT or an API key, and the used authentication method.
+// If no admin is defined authentication is disabled and an admin with all
+// the permissions is returned
+func validateCredentials(r *http.Request, hasAdmins bool) (dataprovider.Admin, string, error) {
+	if !hasAdmins {
+		return dataprovider.Admin{
+			Status:      1,
+			Permissions: []string{dataprovider.PermAdminAny},
+		}, authMethodNone, nil
+	}
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, bearerAuthPrefix) {
+		token := strings.TrimSpace(strings.TrimPrefix(authHeader, bearerAuthPrefix))
+		if strings.Count(token, ".") == 2 {
+			admin, err := validateJWT(token)
+			return admin, authMethodToken, err
+		}
+		admin, _, err := dataprovider.CheckAPIKey(dataProvider, token)
+		return admin, authMethodAPIKey, err
 	}
 	username, password, ok := r.BasicAuth()
 	if !ok {
-		return false
+		return dataprovider.Admin{}, authMethodPassword, errNoCredentials
 	}
-	if hashedPwd, ok := httpAuth.getHashedPassword(username); ok {
-		if utils.IsStringPrefixInSlice(hashedPwd, bcryptPwdPrefixes) {
-			err := bcrypt.CompareHashAndPassword([]byte(hashedPwd), []byte(password))
-			return err == nil
-		}
-		if utils.IsStringPrefixInSlice(hashedPwd, md5CryptPwdPrefixes) {
-			crypter, ok := unixcrypt.MD5.CrypterFound(hashedPwd)
-			if !ok {
-				err := errors.New("cannot found matching MD5 crypter")
-				logger.Debug(logSender, "", "error comparing password with MD5 crypt hash: %v", err)
-				return false
-			}
-			return crypter.Verify([]byte(password))
-		}
+	admin, err := dataprovider.CheckAdminAndPass(dataProvider, username, password)
+	return admin, authMethodPassword, err
+}
+
+// validateJWT returns the enabled admin referenced by the given token
+func validateJWT(token string) (dataprovider.Admin, error) {
+	claims, err := parseJWT(token)
+	if err != nil {
+		return dataprovider.Admin{}, err
+	}
+	admin, err := dataprovider.AdminExists(dataProvider, claims.Subject)
+	if err != nil {
+		return admin, err
+	}
+	if admin.Status != 1 {
+		return admin, fmt.Errorf("admin %#v is disabled", admin.Username)
 	}
-	return false
+	return admin, nil
 }
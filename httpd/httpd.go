@@ -1,9 +1,13 @@
 // Package httpd implements REST API and Web interface for SFTPGo.
-// REST API allows to manage users and quota and to get real time reports for the active connections
+// REST API allows to manage users, admins and quota and to get real time reports for the active connections
 // with possibility of forcibly closing a connection.
+// Each admin can only use the features allowed by its permissions.
+// Admins can authenticate using HTTP basic authentication, short-lived tokens or API keys.
 // The OpenAPI 3 schema for the exposed API can be found inside the source tree:
 // https://github.com/drakkan/sftpgo/tree/master/api/schema/openapi.yaml
-// A basic Web interface to manage users and connections is provided too
+// A basic Web interface to manage users and connections is provided too.
+// Users can browse, download and upload their files using the web client.
+// Files and directories can be shared using public links
 package httpd
 
 import (
@@ -23,29 +27,46 @@ const (
 	logSender             = "httpd"
 	apiPrefix             = "/api/v1"
 	activeConnectionsPath = "/api/v1/connection"
+	connectionsStatsPath  = "/api/v1/connection/stats"
 	quotaScanPath         = "/api/v1/quota_scan"
 	userPath              = "/api/v1/user"
+	sharePath             = "/api/v1/share"
+	adminPath             = "/api/v1/admin"
+	groupPath             = "/api/v1/group"
+	defenderBansPath      = "/api/v1/defender/bans"
+	tokenPath             = "/api/v1/token"
+	apiKeyPath            = "/api/v1/apikey"
 	versionPath           = "/api/v1/version"
 	providerStatusPath    = "/api/v1/providerstatus"
 	dumpDataPath          = "/api/v1/dumpdata"
 	loadDataPath          = "/api/v1/loaddata"
+	backupStatusPath      = "/api/v1/backupstatus"
 	metricsPath           = "/metrics"
 	pprofBasePath         = "/debug"
 	webBasePath           = "/web"
 	webUsersPath          = "/web/users"
 	webUserPath           = "/web/user"
+	webAdminsPath         = "/web/admins"
+	webAdminPath          = "/web/admin"
 	webConnectionsPath    = "/web/connections"
 	webStaticFilesPath    = "/static"
-	maxRestoreSize        = 10485760 // 10 MB
-	maxRequestSize        = 1048576  // 1MB
+	webClientBasePath     = "/webclient"
+	webClientLoginPath    = "/webclient/login"
+	webClientLogoutPath   = "/webclient/logout"
+	webClientFilesPath    = "/webclient/files"
+	webClientUploadPath   = "/webclient/upload"
+	webClientMkdirPath    = "/webclient/mkdir"
+	webClientRenamePath   = "/webclient/rename"
+	webClientDeletePath   = "/webclient/delete"
+	publicSharePath       = "/share"
+	maxRequestSize        = 1048576 // 1MB
 )
 
 var (
 	router       *chi.Mux
 	dataProvider dataprovider.Provider
 	backupsPath  string
-	httpAuth     httpAuthProvider
-	certMgr      *certManager
+	certMgr      *utils.CertManager
 )
 
 // Conf httpd daemon configuration
@@ -60,11 +81,11 @@ type Conf struct {
 	StaticFilesPath string `json:"static_files_path" mapstructure:"static_files_path"`
 	// Path to the backup directory. This can be an absolute path or a path relative to the config dir
 	BackupsPath string `json:"backups_path" mapstructure:"backups_path"`
-	// Path to a file used to store usernames and password for basic authentication.
+	// Deprecated: admins are now stored inside the data provider.
+	// Path to a file in the format generated using the Apache htpasswd tool. If no admin is defined inside
+	// the data provider, the users in this file are imported as admins with all the permissions.
 	// This can be an absolute path or a path relative to the config dir.
-	// We support HTTP basic authentication and the file format must conform to the one generated using the Apache
-	// htpasswd tool. The supported password formats are bcrypt ($2y$ prefix) and md5 crypt ($apr1$ prefix).
-	// If empty HTTP authentication is disabled
+	// The supported password formats are bcrypt ($2y$ prefix) and md5 crypt ($apr1$ prefix).
 	AuthUserFile string `json:"auth_user_file" mapstructure:"auth_user_file"`
 	// If files containing a certificate and matching private key for the server are provided the server will expect
 	// HTTPS connections.
@@ -96,11 +117,18 @@ func (c Conf) Initialize(configDir string, profiler bool) error {
 		return fmt.Errorf("Required directory is invalid, backup path %#v, static file path: %#v template path: %#v",
 			backupsPath, staticFilesPath, templatesPath)
 	}
+	err = initializeJWTSigningKey()
+	if err != nil {
+		return err
+	}
 	authUserFile := getConfigPath(c.AuthUserFile, configDir)
-	httpAuth, err = newBasicAuthProvider(authUserFile)
+	err = importAuthUserFile(authUserFile)
 	if err != nil {
 		return err
 	}
+	if hasAdmins, err := dataprovider.HasAdmins(dataProvider); err == nil && !hasAdmins {
+		logger.Warn(logSender, "", "no admin defined, HTTP authentication is disabled")
+	}
 	certificateFile := getConfigPath(c.CertificateFile, configDir)
 	certificateKeyFile := getConfigPath(c.CertificateKeyFile, configDir)
 	loadTemplates(templatesPath)
@@ -114,7 +142,7 @@ func (c Conf) Initialize(configDir string, profiler bool) error {
 		MaxHeaderBytes: 1 << 16, // 64KB
 	}
 	if len(certificateFile) > 0 && len(certificateKeyFile) > 0 {
-		certMgr, err = newCertManager(certificateFile, certificateKeyFile)
+		certMgr, err = utils.NewCertManager(certificateFile, certificateKeyFile)
 		if err != nil {
 			return err
 		}
@@ -130,7 +158,7 @@ func (c Conf) Initialize(configDir string, profiler bool) error {
 // ReloadTLSCertificate reloads the TLS certificate and key from the configured paths
 func ReloadTLSCertificate() {
 	if certMgr != nil {
-		certMgr.loadCertificate()
+		certMgr.LoadCertificate()
 	}
 }
 
@@ -1,9 +1,15 @@
 package httpd_test
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -18,6 +24,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -27,9 +34,11 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog"
 
+	"github.com/drakkan/sftpgo/backup"
 	"github.com/drakkan/sftpgo/config"
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/httpd"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
@@ -39,9 +48,14 @@ import (
 const (
 	defaultUsername       = "test_user"
 	defaultPassword       = "test_password"
+	defaultAdminUsername  = "test_admin"
+	defaultAdminPassword  = "test_admin_password"
+	httpBaseURL           = "http://127.0.0.1:8081"
 	testPubKey            = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQC03jj0D+djk7pxIf/0OhrxrchJTRZklofJ1NoIu4752Sq02mdXmarMVsqJ1cAjV5LBVy3D1F5U6XW4rppkXeVtd04Pxb09ehtH0pRRPaoHHlALiJt8CoMpbKYMA8b3KXPPriGxgGomvtU2T2RMURSwOZbMtpsugfjYSWenyYX+VORYhylWnSXL961LTyC21ehd6d6QnW9G7E5hYMITMY9TuQZz3bROYzXiTsgN0+g6Hn7exFQp50p45StUMfV/SftCMdCxlxuyGny2CrN/vfjO7xxOo2uv7q1qm10Q46KPWJQv+pgZ/OfL+EDjy07n5QVSKHlbx+2nT4Q0EgOSQaCTYwn3YjtABfIxWwgAFdyj6YlPulCL22qU4MYhDcA6PSBwDdf8hvxBfvsiHdM+JcSHvv8/VeJhk6CmnZxGY0fxBupov27z3yEO8nAg8k+6PaUiW1MSUfuGMF/ktB8LOstXsEPXSszuyXiOv4DaryOXUiSn7bmRqKcEFlJusO6aZP0= nicola@p1"
 	logSender             = "APITesting"
 	userPath              = "/api/v1/user"
+	sharePath             = "/api/v1/share"
+	adminPath             = "/api/v1/admin"
 	activeConnectionsPath = "/api/v1/connection"
 	quotaScanPath         = "/api/v1/quota_scan"
 	versionPath           = "/api/v1/version"
@@ -53,7 +67,18 @@ const (
 	webBasePath           = "/web"
 	webUsersPath          = "/web/users"
 	webUserPath           = "/web/user"
+	webAdminsPath         = "/web/admins"
+	webAdminPath          = "/web/admin"
 	webConnectionsPath    = "/web/connections"
+	webClientLoginPath    = "/webclient/login"
+	webClientLogoutPath   = "/webclient/logout"
+	webClientFilesPath    = "/webclient/files"
+	webClientUploadPath   = "/webclient/upload"
+	webClientMkdirPath    = "/webclient/mkdir"
+	webClientRenamePath   = "/webclient/rename"
+	webClientDeletePath   = "/webclient/delete"
+	publicSharePath       = "/share"
+	redactedSecret        = "[**redacted**]"
 	configDir             = ".."
 	httpsCert             = `-----BEGIN CERTIFICATE-----
 MIICHTCCAaKgAwIBAgIUHnqw7QnB1Bj9oUsNpdb+ZkFPOxMwCgYIKoZIzj0EAwIw
@@ -99,8 +124,15 @@ func TestMain(m *testing.M) {
 	providerConf.CredentialsPath = credentialsPath
 	providerDriverName = providerConf.Driver
 	os.RemoveAll(credentialsPath)
+	kmsConf := config.GetKMSConfig()
+	kmsConf.MasterKeyPath = filepath.Join(os.TempDir(), "sftpgo_api_test_master.key")
+	err := kmsConf.Initialize(configDir)
+	if err != nil {
+		logger.Warn(logSender, "", "error initializing secrets encryption: %v", err)
+		os.Exit(1)
+	}
 
-	err := dataprovider.Initialize(providerConf, configDir)
+	err = dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
 		logger.Warn(logSender, "", "error initializing data provider: %v", err)
 		os.Exit(1)
@@ -109,7 +141,7 @@ func TestMain(m *testing.M) {
 	httpdConf := config.GetHTTPDConfig()
 
 	httpdConf.BindPort = 8081
-	httpd.SetBaseURLAndCredentials("http://127.0.0.1:8081", "", "")
+	httpd.SetBaseURLAndCredentials(httpBaseURL, "", "")
 	backupsPath = filepath.Join(os.TempDir(), "test_backups")
 	httpdConf.BackupsPath = backupsPath
 	os.MkdirAll(backupsPath, 0777)
@@ -207,382 +239,1543 @@ func TestBasicUserHandling(t *testing.T) {
 	}
 }
 
-func TestUserStatus(t *testing.T) {
-	u := getTestUser()
-	u.Status = 3
-	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+func TestBasicShareHandling(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(), http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with bad status: %v", err)
+		t.Errorf("unable to add user: %v", err)
 	}
-	u.Status = 0
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	share := dataprovider.Share{
+		Username:    user.Username,
+		Path:        "/adir/../afile",
+		Scope:       dataprovider.ShareScopeRead,
+		Password:    "share pwd",
+		Description: "test share",
+		MaxTokens:   10,
+	}
+	share, _, err = httpd.AddShare(share, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		t.Errorf("unable to add share: %v", err)
 	}
-	user.Status = 2
-	_, _, err = httpd.UpdateUser(user, http.StatusBadRequest)
+	share.MaxTokens = 5
+	share.ExpiresAt = utils.GetTimeAsMsSinceEpoch(time.Now().Add(24 * time.Hour))
+	share, _, err = httpd.UpdateShare(share, http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error updating user with bad status: %v", err)
+		t.Errorf("unable to update share: %v", err)
 	}
-	user.Status = 1
-	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if !share.HasPassword() {
+		t.Errorf("the share password must be preserved")
+	}
+	shares, _, err := httpd.GetShares(0, 0, user.Username, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to update user: %v", err)
+		t.Errorf("unable to get shares: %v", err)
+	}
+	if len(shares) != 1 {
+		t.Errorf("number of shares mismatch, expected: 1, actual: %v", len(shares))
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove: %v", err)
 	}
-}
-
-func TestAddUserNoCredentials(t *testing.T) {
-	u := getTestUser()
-	u.Password = ""
-	u.PublicKeys = []string{}
-	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	_, _, err = httpd.GetShareByID(share.ShareID, http.StatusNotFound)
 	if err != nil {
-		t.Errorf("unexpected error adding user with no credentials: %v", err)
+		t.Errorf("shares must be removed with their owner: %v", err)
 	}
 }
 
-func TestAddUserNoUsername(t *testing.T) {
-	u := getTestUser()
-	u.Username = ""
-	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+func TestAddShareInvalid(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(), http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with no home dir: %v", err)
+		t.Errorf("unable to add user: %v", err)
 	}
-}
-
-func TestAddUserNoHomeDir(t *testing.T) {
-	u := getTestUser()
-	u.HomeDir = ""
-	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	share := dataprovider.Share{
+		Username: "missing user",
+		Path:     "/",
+		Scope:    dataprovider.ShareScopeRead,
+	}
+	_, _, err = httpd.AddShare(share, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with no home dir: %v", err)
+		t.Errorf("unexpected error adding a share for a missing user: %v", err)
 	}
-}
-
-func TestAddUserInvalidHomeDir(t *testing.T) {
-	u := getTestUser()
-	u.HomeDir = "relative_path"
-	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	share.Username = user.Username
+	share.Scope = 10
+	_, _, err = httpd.AddShare(share, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid home dir: %v", err)
+		t.Errorf("unexpected error adding a share with an invalid scope: %v", err)
 	}
-}
-
-func TestAddUserNoPerms(t *testing.T) {
-	u := getTestUser()
-	u.Permissions = make(map[string][]string)
-	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	share.Scope = dataprovider.ShareScopeWrite
+	share.MaxTokens = -1
+	_, _, err = httpd.AddShare(share, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with no perms: %v", err)
+		t.Errorf("unexpected error adding a share with invalid max tokens: %v", err)
 	}
-	u.Permissions["/"] = []string{}
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	share.MaxTokens = 0
+	share.Path = ""
+	_, _, err = httpd.AddShare(share, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with no perms: %v", err)
+		t.Errorf("unexpected error adding a share without a path: %v", err)
 	}
-}
-
-func TestAddUserInvalidPerms(t *testing.T) {
-	u := getTestUser()
-	u.Permissions["/"] = []string{"invalidPerm"}
-	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	_, err = httpd.RemoveShare(dataprovider.Share{ShareID: "missing"}, http.StatusNotFound)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid perms: %v", err)
+		t.Errorf("unexpected error removing a missing share: %v", err)
 	}
-	// permissions for root dir are mandatory
-	u.Permissions["/"] = []string{}
-	u.Permissions["/somedir"] = []string{dataprovider.PermAny}
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	_, _, err = httpd.UpdateShare(dataprovider.Share{ShareID: "missing"}, http.StatusNotFound)
 	if err != nil {
-		t.Errorf("unexpected error adding user with no root dir perms: %v", err)
+		t.Errorf("unexpected error updating a missing share: %v", err)
 	}
-	u.Permissions["/"] = []string{dataprovider.PermAny}
-	u.Permissions["/subdir/.."] = []string{dataprovider.PermAny}
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid dir perms: %v", err)
+		t.Errorf("unable to remove: %v", err)
 	}
 }
 
-func TestAddUserInvalidFilters(t *testing.T) {
-	u := getTestUser()
-	u.Filters.AllowedIP = []string{"192.168.1.0/24", "192.168.2.0"}
-	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+func TestBasicGroupHandling(t *testing.T) {
+	group, _, err := httpd.AddGroup(getTestGroup(), http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid filters: %v", err)
+		t.Errorf("unable to add group: %v", err)
 	}
-	u.Filters.AllowedIP = []string{}
-	u.Filters.DeniedIP = []string{"192.168.3.0/16", "invalid"}
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	_, _, err = httpd.AddGroup(getTestGroup(), http.StatusInternalServerError)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid filters: %v", err)
+		t.Errorf("adding a duplicate group must fail: %v", err)
 	}
-	u.Filters.DeniedIP = []string{}
-	u.Filters.DeniedLoginMethods = []string{"invalid"}
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	group.Description = "updated description"
+	group.UserSettings.QuotaFiles = 20
+	group.UserSettings.Filters.DeniedIP = []string{"10.1.1.0/24"}
+	group, _, err = httpd.UpdateGroup(group, http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid filters: %v", err)
+		t.Errorf("unable to update group: %v", err)
 	}
-	u.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodKeyboardInteractive,
-		dataprovider.SSHLoginMethodPassword, dataprovider.SSHLoginMethodPublicKey}
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	groups, _, err := httpd.GetGroups(0, 0, http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid filters: %v", err)
+		t.Errorf("unable to get groups: %v", err)
 	}
-	u.Filters.DeniedLoginMethods = []string{}
-	u.Filters.FileExtensions = []dataprovider.ExtensionsFilter{
-		{
-			Path:              "relative",
-			AllowedExtensions: []string{},
-			DeniedExtensions:  []string{},
-		},
+	if len(groups) != 1 {
+		t.Errorf("number of groups mismatch, expected: 1, actual: %v", len(groups))
 	}
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	_, err = httpd.RemoveGroup(group, http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid extensions filters: %v", err)
-	}
-	u.Filters.FileExtensions = []dataprovider.ExtensionsFilter{
-		{
-			Path:              "/",
-			AllowedExtensions: []string{},
-			DeniedExtensions:  []string{},
-		},
+		t.Errorf("unable to remove group: %v", err)
 	}
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	_, _, err = httpd.GetGroupByName(group.Name, http.StatusNotFound)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid extensions filters: %v", err)
+		t.Errorf("unexpected error getting a missing group: %v", err)
 	}
-	u.Filters.FileExtensions = []dataprovider.ExtensionsFilter{
-		{
-			Path:              "/subdir",
-			AllowedExtensions: []string{".zip"},
-			DeniedExtensions:  []string{},
-		},
-		{
-			Path:              "/subdir",
-			AllowedExtensions: []string{".rar"},
-			DeniedExtensions:  []string{".jpg"},
-		},
+	_, _, err = httpd.UpdateGroup(group, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error updating a missing group: %v", err)
 	}
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	_, err = httpd.RemoveGroup(group, http.StatusNotFound)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid extensions filters: %v", err)
+		t.Errorf("unexpected error removing a missing group: %v", err)
 	}
 }
 
-func TestAddUserInvalidFsConfig(t *testing.T) {
-	u := getTestUser()
-	u.FsConfig.Provider = 1
-	u.FsConfig.S3Config.Bucket = ""
-	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+func TestAddGroupInvalid(t *testing.T) {
+	group := getTestGroup()
+	group.Name = ""
+	_, _, err := httpd.AddGroup(group, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+		t.Errorf("unexpected error adding a group without a name: %v", err)
 	}
-	os.RemoveAll(credentialsPath)
-	os.MkdirAll(credentialsPath, 0700)
-	u.FsConfig.S3Config.Bucket = "test"
-	u.FsConfig.S3Config.Region = "eu-west-1"
-	u.FsConfig.S3Config.AccessKey = "access-key"
-	u.FsConfig.S3Config.AccessSecret = "access-secret"
-	u.FsConfig.S3Config.Endpoint = "http://127.0.0.1:9000/path?a=b"
-	u.FsConfig.S3Config.StorageClass = "Standard"
-	u.FsConfig.S3Config.KeyPrefix = "/somedir/subdir/"
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	group.Name = "invalid name"
+	_, _, err = httpd.AddGroup(group, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+		t.Errorf("unexpected error adding a group with an invalid name: %v", err)
 	}
-	u.FsConfig.S3Config.KeyPrefix = ""
-	u.FsConfig.S3Config.UploadPartSize = 3
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	group = getTestGroup()
+	group.UserSettings.QuotaSize = -1
+	_, _, err = httpd.AddGroup(group, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+		t.Errorf("unexpected error adding a group with an invalid quota: %v", err)
 	}
-	u.FsConfig.S3Config.UploadPartSize = 0
-	u.FsConfig.S3Config.UploadConcurrency = -1
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	group = getTestGroup()
+	group.UserSettings.Permissions["/sub"] = []string{"invalid"}
+	_, _, err = httpd.AddGroup(group, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+		t.Errorf("unexpected error adding a group with invalid permissions: %v", err)
 	}
-	u = getTestUser()
-	u.FsConfig.Provider = 2
-	u.FsConfig.GCSConfig.Bucket = ""
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	group = getTestGroup()
+	group.UserSettings.FsConfig.Provider = 2
+	group.UserSettings.FsConfig.GCSConfig.Bucket = "bucket"
+	group.UserSettings.FsConfig.GCSConfig.Credentials = kms.NewPlainSecret(base64.StdEncoding.EncodeToString([]byte("{}")))
+	_, _, err = httpd.AddGroup(group, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+		t.Errorf("unexpected error adding a group with GCS credentials: %v", err)
 	}
-	u.FsConfig.GCSConfig.Bucket = "test"
-	u.FsConfig.GCSConfig.StorageClass = "Standard"
-	u.FsConfig.GCSConfig.KeyPrefix = "/somedir/subdir/"
-	u.FsConfig.GCSConfig.Credentials = base64.StdEncoding.EncodeToString([]byte("test"))
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	group = getTestGroup()
+	group.UserSettings.VirtualFolders = append(group.UserSettings.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/gcs",
+		},
+		FsConfig: dataprovider.Filesystem{
+			Provider: 2,
+			GCSConfig: vfs.GCSFsConfig{
+				Bucket:      "bucket",
+				Credentials: kms.NewPlainSecret(base64.StdEncoding.EncodeToString([]byte("{}"))),
+			},
+		},
+	})
+	_, _, err = httpd.AddGroup(group, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+		t.Errorf("unexpected error adding a group with GCS credentials for a virtual folder: %v", err)
 	}
-	u.FsConfig.GCSConfig.KeyPrefix = "somedir/subdir/"
-	u.FsConfig.GCSConfig.Credentials = ""
-	u.FsConfig.GCSConfig.AutomaticCredentials = 0
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+}
+
+func TestUserGroups(t *testing.T) {
+	primaryGroup, _, err := httpd.AddGroup(getTestGroup(), http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+		t.Errorf("unable to add group: %v", err)
 	}
-	u.FsConfig.GCSConfig.Credentials = "no base64 encoded"
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	secondaryGroup := getTestGroup()
+	secondaryGroup.Name = "secondary"
+	secondaryGroup.UserSettings.Permissions = map[string][]string{
+		"/%username%/sub": {dataprovider.PermListItems},
+	}
+	secondaryGroup.UserSettings.Filters.AllowedIP = []string{"192.168.1.0/24"}
+	secondaryGroup, _, err = httpd.AddGroup(secondaryGroup, http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+		t.Errorf("unable to add group: %v", err)
 	}
-}
-
-func TestAddUserInvalidVirtualFolders(t *testing.T) {
 	u := getTestUser()
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "vdir",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
-	})
-	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
-	if err != nil {
-		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+	u.Permissions = nil
+	u.Groups = []dataprovider.UserGroup{
+		{Name: "missing", Type: dataprovider.GroupTypePrimary},
 	}
-	u.VirtualFolders = nil
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
-	})
 	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+		t.Errorf("unexpected error adding a user with a missing group: %v", err)
+	}
+	u.Groups = []dataprovider.UserGroup{
+		{Name: primaryGroup.Name, Type: dataprovider.GroupTypePrimary},
+		{Name: secondaryGroup.Name, Type: dataprovider.GroupTypePrimary},
 	}
-	u.VirtualFolders = nil
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir",
-		MappedPath:  filepath.Join(u.GetHomeDir(), "mapped_dir"),
-	})
 	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+		t.Errorf("unexpected error adding a user with two primary groups: %v", err)
+	}
+	u.Groups = []dataprovider.UserGroup{
+		{Name: primaryGroup.Name, Type: dataprovider.GroupTypePrimary},
+		{Name: primaryGroup.Name, Type: dataprovider.GroupTypeSecondary},
 	}
-	u.VirtualFolders = nil
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir",
-		MappedPath:  u.GetHomeDir(),
-	})
 	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+		t.Errorf("unexpected error adding a user with duplicated groups: %v", err)
+	}
+	u.Groups = []dataprovider.UserGroup{
+		{Name: primaryGroup.Name, Type: 3},
 	}
-	u.VirtualFolders = nil
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir",
-		MappedPath:  filepath.Join(u.GetHomeDir(), ".."),
-	})
 	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+		t.Errorf("unexpected error adding a user with an invalid group type: %v", err)
 	}
-	u.VirtualFolders = nil
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
-	})
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir1"),
-	})
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	u.Groups = []dataprovider.UserGroup{
+		{Name: primaryGroup.Name, Type: dataprovider.GroupTypePrimary},
+		{Name: secondaryGroup.Name, Type: dataprovider.GroupTypeSecondary},
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+		t.Errorf("unable to add user with groups: %v", err)
 	}
-	u.VirtualFolders = nil
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir1",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
-	})
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir2",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
-	})
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if len(user.Permissions) != 0 || user.QuotaFiles != 0 {
+		t.Errorf("group settings must not be stored inside the user: %+v", user)
+	}
+	_, err = httpd.RemoveGroup(secondaryGroup, http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+		t.Errorf("removing a group with members must fail: %v", err)
 	}
-	u.VirtualFolders = nil
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir1",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir", "subdir"),
-	})
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir2",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
-	})
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	user, err = dataprovider.CheckUserAndPass(dataprovider.GetProvider(), defaultUsername, defaultPassword,
+		"127.0.0.1", "HTTP")
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+		t.Errorf("unable to authenticate user with groups: %v", err)
 	}
-	u.VirtualFolders = nil
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir1",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
-	})
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir2",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir", "subdir"),
-	})
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if user.QuotaFiles != primaryGroup.UserSettings.QuotaFiles {
+		t.Errorf("quota files not inherited from the primary group: %v", user.QuotaFiles)
+	}
+	if user.MaxSessions != primaryGroup.UserSettings.MaxSessions {
+		t.Errorf("max sessions not inherited from the primary group: %v", user.MaxSessions)
+	}
+	if _, ok := user.Permissions["/"]; !ok {
+		t.Errorf("root permissions not inherited from the primary group: %+v", user.Permissions)
+	}
+	if _, ok := user.Permissions["/"+defaultUsername+"/sub"]; !ok {
+		t.Errorf("username placeholder not replaced in secondary group permissions: %+v", user.Permissions)
+	}
+	if len(user.Filters.AllowedIP) != 1 {
+		t.Errorf("allowed IP not inherited from the secondary group: %+v", user.Filters.AllowedIP)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+		t.Errorf("unable to remove user: %v", err)
 	}
-	u.VirtualFolders = nil
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir1/subdir",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir1"),
-	})
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir1/../vdir1",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir2"),
-	})
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	_, err = httpd.RemoveGroup(primaryGroup, http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+		t.Errorf("unable to remove group: %v", err)
 	}
-	u.VirtualFolders = nil
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir1/",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir1"),
-	})
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir1/subdir",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir2"),
-	})
-	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	_, err = httpd.RemoveGroup(secondaryGroup, http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+		t.Errorf("unable to remove group: %v", err)
 	}
 }
 
-func TestUserPublicKey(t *testing.T) {
-	u := getTestUser()
-	invalidPubKey := "invalid"
-	validPubKey := "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQC03jj0D+djk7pxIf/0OhrxrchJTRZklofJ1NoIu4752Sq02mdXmarMVsqJ1cAjV5LBVy3D1F5U6XW4rppkXeVtd04Pxb09ehtH0pRRPaoHHlALiJt8CoMpbKYMA8b3KXPPriGxgGomvtU2T2RMURSwOZbMtpsugfjYSWenyYX+VORYhylWnSXL961LTyC21ehd6d6QnW9G7E5hYMITMY9TuQZz3bROYzXiTsgN0+g6Hn7exFQp50p45StUMfV/SftCMdCxlxuyGny2CrN/vfjO7xxOo2uv7q1qm10Q46KPWJQv+pgZ/OfL+EDjy07n5QVSKHlbx+2nT4Q0EgOSQaCTYwn3YjtABfIxWwgAFdyj6YlPulCL22qU4MYhDcA6PSBwDdf8hvxBfvsiHdM+JcSHvv8/VeJhk6CmnZxGY0fxBupov27z3yEO8nAg8k+6PaUiW1MSUfuGMF/ktB8LOstXsEPXSszuyXiOv4DaryOXUiSn7bmRqKcEFlJusO6aZP0= nicola@p1"
-	u.PublicKeys = []string{invalidPubKey}
-	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
-	if err != nil {
-		t.Errorf("unexpected error adding user with invalid pub key: %v", err)
+func TestDefenderBans(t *testing.T) {
+	ban := dataprovider.BannedIP{
+		IP:          "172.16.1.1",
+		BannedUntil: utils.GetTimeAsMsSinceEpoch(time.Now().Add(10 * time.Minute)),
+		BanCount:    1,
 	}
-	u.PublicKeys = []string{validPubKey}
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	err := dataprovider.AddBannedIP(dataprovider.GetProvider(), ban)
 	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+		t.Errorf("unable to add ban: %v", err)
 	}
-	user.PublicKeys = []string{validPubKey, invalidPubKey}
-	_, _, err = httpd.UpdateUser(user, http.StatusBadRequest)
+	bans, _, err := httpd.GetBannedIPs(0, 0, http.StatusOK)
 	if err != nil {
-		t.Errorf("update user with invalid public key must fail: %v", err)
+		t.Errorf("unable to get bans: %v", err)
 	}
-	user.PublicKeys = []string{validPubKey, validPubKey, validPubKey}
-	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if len(bans) != 1 {
+		t.Errorf("number of bans mismatch, expected: 1, actual: %v", len(bans))
+	}
+	ban, _, err = httpd.GetBannedIP(ban.IP, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get ban: %v", err)
+	}
+	if ban.BanCount != 1 || !ban.IsActive() {
+		t.Errorf("unexpected ban: %+v", ban)
+	}
+	_, err = httpd.RemoveBannedIP(ban.IP, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove ban: %v", err)
+	}
+	_, _, err = httpd.GetBannedIP(ban.IP, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error getting a missing ban: %v", err)
+	}
+	_, err = httpd.RemoveBannedIP(ban.IP, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error removing a missing ban: %v", err)
+	}
+	ban.IP = "invalid IP"
+	err = dataprovider.AddBannedIP(dataprovider.GetProvider(), ban)
+	if err == nil {
+		t.Errorf("adding a ban with an invalid IP must fail")
+	}
+}
+
+func TestDefenderHTTPMock(t *testing.T) {
+	err := sftpd.InitializeDefender(sftpd.DefenderConfig{
+		Enabled:         true,
+		BanTime:         10,
+		Threshold:       2,
+		ScoreValid:      1,
+		ScoreInvalid:    2,
+		ObservationTime: 15,
+		EntriesLimit:    100,
+	})
+	if err != nil {
+		t.Fatalf("unable to initialize the defender: %v", err)
+	}
+	defer sftpd.InitializeDefender(sftpd.DefenderConfig{}) //nolint:errcheck
+	user, _, err := httpd.AddUser(getTestUser(), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	share, _, err := httpd.AddShare(dataprovider.Share{
+		Username: user.Username,
+		Path:     "/",
+		Scope:    dataprovider.ShareScopeRead,
+		Password: defaultPassword,
+	}, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add share: %v", err)
+	}
+	bannedIPs := []string{"172.16.2.1", "172.16.2.2", "172.16.2.3", "172.16.2.4", "172.16.2.5"}
+	// web client login, the client IP headers must be ignored
+	form := make(url.Values)
+	form.Set("username", defaultUsername)
+	form.Set("password", "wrong password")
+	for _, expectedStatus := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusForbidden} {
+		req, _ := http.NewRequest(http.MethodPost, webClientLoginPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", "172.16.3.1")
+		req.RemoteAddr = bannedIPs[0] + ":1234"
+		rr := executeRequest(req)
+		checkResponseCode(t, expectedStatus, rr.Code)
+		form.Set("password", defaultPassword)
+		form.Set("username", defaultUsername+"_missing")
+	}
+	// share password
+	for _, expectedStatus := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusForbidden} {
+		req, _ := http.NewRequest(http.MethodGet, publicSharePath+"/"+share.ShareID, nil)
+		req.SetBasicAuth("", "wrong password")
+		req.RemoteAddr = bannedIPs[1] + ":1234"
+		rr := executeRequest(req)
+		checkResponseCode(t, expectedStatus, rr.Code)
+	}
+	// a request without password must not be scored
+	req, _ := http.NewRequest(http.MethodGet, publicSharePath+"/"+share.ShareID, nil)
+	req.RemoteAddr = "172.16.3.2:1234"
+	for i := 0; i < 3; i++ {
+		rr := executeRequest(req)
+		checkResponseCode(t, http.StatusUnauthorized, rr.Code)
+	}
+	_, _, err = httpd.AddAdmin(getTestAdmin(), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add admin: %v", err)
+	}
+	httpd.SetBaseURLAndCredentials(httpBaseURL, defaultAdminUsername, defaultAdminPassword)
+	// admin basic auth, JWT and API key
+	for idx, setAuth := range []func(*http.Request){
+		func(r *http.Request) { r.SetBasicAuth(defaultAdminUsername, "wrong password") },
+		func(r *http.Request) { r.Header.Set("Authorization", "Bearer invalid.jwt.token") },
+		func(r *http.Request) { r.Header.Set("Authorization", "Bearer invalidapikey") },
+	} {
+		for _, expectedStatus := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusForbidden} {
+			req, _ := http.NewRequest(http.MethodGet, versionPath, nil)
+			setAuth(req)
+			req.RemoteAddr = bannedIPs[idx+2] + ":1234"
+			rr := executeRequest(req)
+			checkResponseCode(t, expectedStatus, rr.Code)
+		}
+	}
+	// a request without credentials must not be scored
+	req, _ = http.NewRequest(http.MethodGet, versionPath, nil)
+	req.RemoteAddr = "172.16.3.3:1234"
+	for i := 0; i < 3; i++ {
+		rr := executeRequest(req)
+		checkResponseCode(t, http.StatusUnauthorized, rr.Code)
+	}
+	for _, ip := range bannedIPs {
+		if !sftpd.IsBanned(ip) {
+			t.Errorf("host %#v must be banned", ip)
+		}
+		_, err = httpd.RemoveBannedIP(ip, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to remove ban: %v", err)
+		}
+	}
+	for _, ip := range []string{"172.16.3.1", "172.16.3.2", "172.16.3.3"} {
+		if sftpd.IsBanned(ip) {
+			t.Errorf("host %#v must not be banned", ip)
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	removeTestAdmin(t)
+}
+
+func TestBasicAdminHandling(t *testing.T) {
+	admin, _, err := httpd.AddAdmin(getTestAdmin(), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add admin: %v", err)
+	}
+	// an admin is now defined so authentication is required
+	_, _, err = httpd.GetAdmins(0, 0, http.StatusUnauthorized)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	httpd.SetBaseURLAndCredentials(httpBaseURL, defaultAdminUsername, defaultAdminPassword)
+	admin.Email = "admin@example.com"
+	admin.Description = "SFTPGo admin"
+	admin, _, err = httpd.UpdateAdmin(admin, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update admin: %v", err)
+	}
+	// the password is preserved if not provided
+	_, _, err = httpd.GetVersion(http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	admins, _, err := httpd.GetAdmins(0, 0, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get admins: %v", err)
+	}
+	if len(admins) != 1 {
+		t.Errorf("number of admins mismatch, expected: 1, actual: %v", len(admins))
+	}
+	_, _, err = httpd.GetAdmins(1, 1, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get admins: %v", err)
+	}
+	admin1 := getTestAdmin()
+	admin1.Username += "1"
+	admin1.Permissions = []string{dataprovider.PermAdminViewConnections, dataprovider.PermAdminViewConnections}
+	_, _, err = httpd.AddAdmin(admin1, http.StatusOK)
+	if err == nil {
+		t.Error("duplicated permissions must be removed")
+	}
+	admin1, _, err = httpd.GetAdminByUsername(defaultAdminUsername+"1", http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get admin: %v", err)
+	}
+	if len(admin1.Permissions) != 1 {
+		t.Errorf("unexpected permissions: %+v", admin1.Permissions)
+	}
+	_, err = httpd.RemoveAdmin(admin, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("an admin must not be able to remove itself: %v", err)
+	}
+	httpd.SetBaseURLAndCredentials(httpBaseURL, admin1.Username, defaultAdminPassword)
+	_, _, err = httpd.GetConnections(http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, _, err = httpd.GetVersion(http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, _, err = httpd.GetUsers(0, 0, "", http.StatusForbidden)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, _, err = httpd.GetAdmins(0, 0, http.StatusForbidden)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, err = httpd.CloseConnection("connectionID", http.StatusForbidden)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, _, err = httpd.Dumpdata("backup.json", "", http.StatusForbidden)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, _, err = httpd.GetQuotaScans(http.StatusForbidden)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	resp, err := http.Get(httpBaseURL + metricsPath)
+	if err == nil {
+		resp.Body.Close()
+		checkResponseCode(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+	admin1.Status = 0
+	httpd.SetBaseURLAndCredentials(httpBaseURL, defaultAdminUsername, defaultAdminPassword)
+	_, _, err = httpd.UpdateAdmin(admin1, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update admin: %v", err)
+	}
+	httpd.SetBaseURLAndCredentials(httpBaseURL, admin1.Username, defaultAdminPassword)
+	_, _, err = httpd.GetVersion(http.StatusUnauthorized)
+	if err != nil {
+		t.Errorf("disabled admins must not be able to login: %v", err)
+	}
+	httpd.SetBaseURLAndCredentials(httpBaseURL, defaultAdminUsername, defaultAdminPassword)
+	_, err = httpd.RemoveAdmin(admin1, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove admin: %v", err)
+	}
+	removeTestAdmin(t)
+}
+
+func TestAddAdminInvalid(t *testing.T) {
+	admin := getTestAdmin()
+	admin.Permissions = nil
+	_, _, err := httpd.AddAdmin(admin, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding an admin without permissions: %v", err)
+	}
+	admin.Permissions = []string{"invalid"}
+	_, _, err = httpd.AddAdmin(admin, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding an admin with invalid permissions: %v", err)
+	}
+	admin = getTestAdmin()
+	admin.Password = ""
+	_, _, err = httpd.AddAdmin(admin, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding an admin without password: %v", err)
+	}
+	admin = getTestAdmin()
+	admin.Username = "invalid admin"
+	_, _, err = httpd.AddAdmin(admin, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding an admin with an invalid username: %v", err)
+	}
+	admin = getTestAdmin()
+	admin.Status = 3
+	_, _, err = httpd.AddAdmin(admin, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding an admin with an invalid status: %v", err)
+	}
+	_, _, err = httpd.UpdateAdmin(getTestAdmin(), http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error updating a missing admin: %v", err)
+	}
+	_, _, err = httpd.GetAdminByUsername(defaultAdminUsername, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error getting a missing admin: %v", err)
+	}
+	_, err = httpd.RemoveAdmin(getTestAdmin(), http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error removing a missing admin: %v", err)
+	}
+	_, _, err = httpd.GetAdmins(0, 0, http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	// authentication is disabled if no admin is defined
+	_, _, err := httpd.GetToken(http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	admin, _, err := httpd.AddAdmin(getTestAdmin(), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add admin: %v", err)
+	}
+	_, _, err = httpd.GetToken(http.StatusUnauthorized)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	httpd.SetBaseURLAndCredentials(httpBaseURL, defaultAdminUsername, defaultAdminPassword)
+	token, _, err := httpd.GetToken(http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get token: %v", err)
+	}
+	httpd.SetBearerToken(token)
+	_, _, err = httpd.GetUsers(0, 0, "", http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users using a token: %v", err)
+	}
+	// a token cannot be used to get a new token
+	_, _, err = httpd.GetToken(http.StatusForbidden)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	httpd.SetBearerToken(token + "a")
+	_, _, err = httpd.GetVersion(http.StatusUnauthorized)
+	if err != nil {
+		t.Errorf("a token with an invalid signature must be rejected: %v", err)
+	}
+	admin.Status = 0
+	admin.Password = defaultAdminPassword
+	err = dataprovider.UpdateAdmin(dataprovider.GetProvider(), admin)
+	if err != nil {
+		t.Errorf("unable to update admin: %v", err)
+	}
+	httpd.SetBearerToken(token)
+	_, _, err = httpd.GetVersion(http.StatusUnauthorized)
+	if err != nil {
+		t.Errorf("tokens issued to disabled admins must be rejected: %v", err)
+	}
+	removeTestAdmin(t)
+}
+
+func TestAPIKeyHandling(t *testing.T) {
+	_, _, err := httpd.AddAdmin(getTestAdmin(), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add admin: %v", err)
+	}
+	httpd.SetBaseURLAndCredentials(httpBaseURL, defaultAdminUsername, defaultAdminPassword)
+	key := dataprovider.APIKey{
+		Name:        "cron job",
+		Description: "nightly backups",
+		Permissions: []string{dataprovider.PermAdminManageBackups, dataprovider.PermAdminManageBackups},
+	}
+	_, _, err = httpd.AddAPIKey(key, http.StatusOK)
+	if err == nil {
+		t.Error("duplicated permissions must be removed")
+	}
+	keys, _, err := httpd.GetAPIKeys(0, 0, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get API keys: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("number of API keys mismatch, expected: 1, actual: %v", len(keys))
+	} else {
+		_, err = httpd.RemoveAPIKey(keys[0], http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to remove API key: %v", err)
+		}
+	}
+	key.Permissions = []string{dataprovider.PermAdminManageBackups, dataprovider.PermAdminViewConnections}
+	apiKey, _, err := httpd.AddAPIKey(key, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add API key: %v", err)
+	}
+	if apiKey.Admin != defaultAdminUsername {
+		t.Errorf("unexpected API key owner: %#v", apiKey.Admin)
+	}
+	plainKey := apiKey.Key
+	apiKey, _, err = httpd.GetAPIKeyByID(apiKey.KeyID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get API key: %v", err)
+	}
+	if len(apiKey.Key) > 0 {
+		t.Errorf("the API key secret must not be returned")
+	}
+	_, _, err = httpd.GetAPIKeys(1, 1, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get API keys: %v", err)
+	}
+	httpd.SetBearerToken(plainKey)
+	_, _, err = httpd.GetConnections(http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get connections using an API key: %v", err)
+	}
+	_, _, err = httpd.GetUsers(0, 0, "", http.StatusForbidden)
+	if err != nil {
+		t.Errorf("an API key must be restricted to its permissions: %v", err)
+	}
+	// API keys cannot be used to manage API keys or to get tokens
+	_, _, err = httpd.GetAPIKeys(0, 0, http.StatusForbidden)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, _, err = httpd.GetToken(http.StatusForbidden)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	httpd.SetBearerToken(plainKey + "a")
+	_, _, err = httpd.GetVersion(http.StatusUnauthorized)
+	if err != nil {
+		t.Errorf("an invalid API key must be rejected: %v", err)
+	}
+	httpd.SetBearerToken("")
+	_, err = httpd.RemoveAPIKey(apiKey, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove API key: %v", err)
+	}
+	_, err = httpd.RemoveAPIKey(apiKey, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	httpd.SetBearerToken(plainKey)
+	_, _, err = httpd.GetVersion(http.StatusUnauthorized)
+	if err != nil {
+		t.Errorf("a revoked API key must be rejected: %v", err)
+	}
+	httpd.SetBaseURLAndCredentials(httpBaseURL, defaultAdminUsername, defaultAdminPassword)
+	key.ExpiresAt = utils.GetTimeAsMsSinceEpoch(time.Now().Add(-1 * time.Hour))
+	apiKey, _, err = httpd.AddAPIKey(key, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add API key: %v", err)
+	}
+	httpd.SetBearerToken(apiKey.Key)
+	_, _, err = httpd.GetVersion(http.StatusUnauthorized)
+	if err != nil {
+		t.Errorf("an expired API key must be rejected: %v", err)
+	}
+	httpd.SetBearerToken("")
+	// deleting the admin removes its API keys too
+	removeTestAdmin(t)
+	_, err = dataprovider.GetAPIKeyByID(dataprovider.GetProvider(), apiKey.KeyID)
+	if err == nil {
+		t.Errorf("API keys must be removed together with their admin")
+	}
+}
+
+func TestAPIKeyPermissionsRestriction(t *testing.T) {
+	_, _, err := httpd.AddAdmin(getTestAdmin(), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add admin: %v", err)
+	}
+	admin := getTestAdmin()
+	admin.Username += "1"
+	admin.Permissions = []string{dataprovider.PermAdminViewConnections}
+	httpd.SetBaseURLAndCredentials(httpBaseURL, defaultAdminUsername, defaultAdminPassword)
+	_, _, err = httpd.AddAdmin(admin, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add admin: %v", err)
+	}
+	// an API key cannot grant more permissions than the ones of its admin
+	httpd.SetBaseURLAndCredentials(httpBaseURL, admin.Username, defaultAdminPassword)
+	apiKey, _, err := httpd.AddAPIKey(dataprovider.APIKey{
+		Name:        "all",
+		Permissions: []string{dataprovider.PermAdminAny},
+	}, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add API key: %v", err)
+	}
+	_, _, err = httpd.AddAPIKey(dataprovider.APIKey{
+		Permissions: []string{dataprovider.PermAdminAny},
+	}, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding an API key without a name: %v", err)
+	}
+	_, _, err = httpd.AddAPIKey(dataprovider.APIKey{
+		Name:        "invalid",
+		Permissions: []string{"invalid"},
+	}, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding an API key with invalid permissions: %v", err)
+	}
+	httpd.SetBearerToken(apiKey.Key)
+	_, _, err = httpd.GetConnections(http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, _, err = httpd.GetUsers(0, 0, "", http.StatusForbidden)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// admins can only access their own API keys
+	httpd.SetBaseURLAndCredentials(httpBaseURL, defaultAdminUsername, defaultAdminPassword)
+	_, _, err = httpd.GetAPIKeyByID(apiKey.KeyID, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, err = httpd.RemoveAPIKey(apiKey, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	keys, _, err := httpd.GetAPIKeys(0, 0, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get API keys: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("unexpected API keys: %+v", keys)
+	}
+	_, err = httpd.RemoveAdmin(admin, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove admin: %v", err)
+	}
+	removeTestAdmin(t)
+}
+
+func TestUserStatus(t *testing.T) {
+	u := getTestUser()
+	u.Status = 3
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with bad status: %v", err)
+	}
+	u.Status = 0
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.Status = 2
+	_, _, err = httpd.UpdateUser(user, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error updating user with bad status: %v", err)
+	}
+	user.Status = 1
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+}
+
+func TestAddUserNoCredentials(t *testing.T) {
+	u := getTestUser()
+	u.Password = ""
+	u.PublicKeys = []string{}
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with no credentials: %v", err)
+	}
+}
+
+func TestAddUserNoUsername(t *testing.T) {
+	u := getTestUser()
+	u.Username = ""
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with no home dir: %v", err)
+	}
+}
+
+func TestAddUserNoHomeDir(t *testing.T) {
+	u := getTestUser()
+	u.HomeDir = ""
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with no home dir: %v", err)
+	}
+}
+
+func TestAddUserInvalidHomeDir(t *testing.T) {
+	u := getTestUser()
+	u.HomeDir = "relative_path"
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid home dir: %v", err)
+	}
+}
+
+func TestAddUserNoPerms(t *testing.T) {
+	u := getTestUser()
+	u.Permissions = make(map[string][]string)
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with no perms: %v", err)
+	}
+	u.Permissions["/"] = []string{}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with no perms: %v", err)
+	}
+}
+
+func TestAddUserInvalidPerms(t *testing.T) {
+	u := getTestUser()
+	u.Permissions["/"] = []string{"invalidPerm"}
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid perms: %v", err)
+	}
+	// permissions for root dir are mandatory
+	u.Permissions["/"] = []string{}
+	u.Permissions["/somedir"] = []string{dataprovider.PermAny}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with no root dir perms: %v", err)
+	}
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	u.Permissions["/subdir/.."] = []string{dataprovider.PermAny}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid dir perms: %v", err)
+	}
+}
+
+func TestAddUserInvalidFilters(t *testing.T) {
+	u := getTestUser()
+	u.Filters.AllowedIP = []string{"192.168.1.0/24", "192.168.2.0"}
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid filters: %v", err)
+	}
+	u.Filters.AllowedIP = []string{}
+	u.Filters.DeniedIP = []string{"192.168.3.0/16", "invalid"}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid filters: %v", err)
+	}
+	u.Filters.DeniedIP = []string{}
+	u.Filters.DeniedLoginMethods = []string{"invalid"}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid filters: %v", err)
+	}
+	// the combined login method must be one of the supported ones
+	u.Filters.DeniedLoginMethods = []string{"password,publickey"}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid filters: %v", err)
+	}
+	u.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodKeyboardInteractive,
+		dataprovider.SSHLoginMethodPassword, dataprovider.SSHLoginMethodPublicKey,
+		dataprovider.SSHLoginMethodPublicKeyCert}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid filters: %v", err)
+	}
+	// denying public keys denies certificates too so no login method is allowed
+	u.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodKeyboardInteractive,
+		dataprovider.SSHLoginMethodPassword, dataprovider.SSHLoginMethodPublicKey}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid filters: %v", err)
+	}
+	u.Filters.DeniedLoginMethods = []string{}
+	// only login methods combinations can be required
+	u.Filters.RequiredLoginMethods = []string{dataprovider.SSHLoginMethodPublicKey}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid filters: %v", err)
+	}
+	// a required login method cannot be denied
+	u.Filters.RequiredLoginMethods = []string{dataprovider.SSHLoginMethodKeyAndPassword}
+	u.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodKeyAndPassword}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid filters: %v", err)
+	}
+	u.Filters.RequiredLoginMethods = []string{}
+	u.Filters.DeniedLoginMethods = []string{}
+	u.Filters.FileExtensions = []dataprovider.ExtensionsFilter{
+		{
+			Path:              "relative",
+			AllowedExtensions: []string{},
+			DeniedExtensions:  []string{},
+		},
+	}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid extensions filters: %v", err)
+	}
+	u.Filters.FileExtensions = []dataprovider.ExtensionsFilter{
+		{
+			Path:              "/",
+			AllowedExtensions: []string{},
+			DeniedExtensions:  []string{},
+		},
+	}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid extensions filters: %v", err)
+	}
+	u.Filters.FileExtensions = []dataprovider.ExtensionsFilter{
+		{
+			Path:              "/subdir",
+			AllowedExtensions: []string{".zip"},
+			DeniedExtensions:  []string{},
+		},
+		{
+			Path:              "/subdir",
+			AllowedExtensions: []string{".rar"},
+			DeniedExtensions:  []string{".jpg"},
+		},
+	}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid extensions filters: %v", err)
+	}
+}
+
+func TestAddUserInvalidFsConfig(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.Provider = 1
+	u.FsConfig.S3Config.Bucket = ""
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	os.RemoveAll(credentialsPath)
+	os.MkdirAll(credentialsPath, 0700)
+	u.FsConfig.S3Config.Bucket = "test"
+	u.FsConfig.S3Config.Region = "eu-west-1"
+	u.FsConfig.S3Config.AccessKey = "access-key"
+	u.FsConfig.S3Config.AccessSecret = kms.NewPlainSecret("access-secret")
+	u.FsConfig.S3Config.Endpoint = "http://127.0.0.1:9000/path?a=b"
+	u.FsConfig.S3Config.StorageClass = "Standard"
+	u.FsConfig.S3Config.KeyPrefix = "/somedir/subdir/"
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.S3Config.KeyPrefix = ""
+	u.FsConfig.S3Config.UploadPartSize = 3
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.S3Config.UploadPartSize = 0
+	u.FsConfig.S3Config.UploadConcurrency = -1
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u = getTestUser()
+	u.FsConfig.Provider = 2
+	u.FsConfig.GCSConfig.Bucket = ""
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.GCSConfig.Bucket = "test"
+	u.FsConfig.GCSConfig.StorageClass = "Standard"
+	u.FsConfig.GCSConfig.KeyPrefix = "/somedir/subdir/"
+	u.FsConfig.GCSConfig.Credentials = kms.NewPlainSecret(base64.StdEncoding.EncodeToString([]byte("test")))
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.GCSConfig.KeyPrefix = "somedir/subdir/"
+	u.FsConfig.GCSConfig.Credentials = kms.Secret{}
+	u.FsConfig.GCSConfig.AutomaticCredentials = 0
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.GCSConfig.Credentials = kms.NewPlainSecret("no base64 encoded")
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u = getTestUser()
+	u.FsConfig.Provider = 3
+	u.FsConfig.AzBlobConfig.SASURL = "http://foo\x7f.com/"
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.AzBlobConfig.SASURL = "https://myaccount.blob.core.windows.net/?sig=signature"
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.AzBlobConfig.SASURL = ""
+	u.FsConfig.AzBlobConfig.AccountName = "name"
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.AzBlobConfig.Container = "container"
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.AzBlobConfig.AccountKey = kms.NewPlainSecret("key")
+	u.FsConfig.AzBlobConfig.KeyPrefix = "/amedir/subdir/"
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.AzBlobConfig.KeyPrefix = "amedir/subdir/"
+	u.FsConfig.AzBlobConfig.UploadPartSize = 101
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.AzBlobConfig.UploadPartSize = 0
+	u.FsConfig.AzBlobConfig.UploadConcurrency = 65
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.AzBlobConfig.UploadConcurrency = 0
+	u.FsConfig.AzBlobConfig.AccessTier = "Premium"
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u = getTestUser()
+	u.FsConfig.Provider = 4
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.SFTPConfig.Endpoint = "127.0.0.1"
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.SFTPConfig.Endpoint = "127.0.0.1:2022"
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.SFTPConfig.Username = "remote_user"
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.SFTPConfig.Password = kms.NewPlainSecret("remote_password")
+	u.FsConfig.SFTPConfig.Fingerprints = []string{"MD5:fd:5e:7d:2f:4b:5e:2b:4d:e2:57:ba:cc:a4:57:5b:01"}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+	u.FsConfig.SFTPConfig.Fingerprints = nil
+	u.FsConfig.SFTPConfig.Prefix = "relative/path"
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid fs config: %v", err)
+	}
+}
+
+func TestAddUserInvalidVirtualFolders(t *testing.T) {
+	u := getTestUser()
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "vdir",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
+		},
+	})
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
+		},
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir",
+			MappedPath:  filepath.Join(u.GetHomeDir(), "mapped_dir"),
+		},
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir",
+			MappedPath:  u.GetHomeDir(),
+		},
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir",
+			MappedPath:  filepath.Join(u.GetHomeDir(), ".."),
+		},
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
+		},
+	})
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir1"),
+		},
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir1",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
+		},
+	})
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir2",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
+		},
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir1",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir", "subdir"),
+		},
+	})
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir2",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
+		},
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir1",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir"),
+		},
+	})
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir2",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir", "subdir"),
+		},
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir1/subdir",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir1"),
+		},
+	})
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir1/../vdir1",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir2"),
+		},
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir1/",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir1"),
+		},
+	})
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir1/subdir",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir2"),
+		},
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir1",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir1"),
+		},
+		QuotaFiles: -1,
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder quota: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir1",
+		},
+		FsConfig: dataprovider.Filesystem{
+			Provider: 1,
+		},
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid virtual folder fs config: %v", err)
+	}
+	u.VirtualFolders = nil
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir1",
+		},
+		FsConfig: dataprovider.Filesystem{
+			Provider: 2,
+			GCSConfig: vfs.GCSFsConfig{
+				Bucket: "test",
+			},
+		},
+	})
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("GCS virtual folders must require credentials or automatic credentials: %v", err)
+	}
+	u.VirtualFolders[0].FsConfig.GCSConfig.Credentials = kms.NewPlainSecret("invalid base64")
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid GCS credentials for a virtual folder: %v", err)
+	}
+}
+
+func TestUserVirtualFoldersStorageBackends(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.Provider = 1
+	u.FsConfig.S3Config.Bucket = "test"
+	u.FsConfig.S3Config.Region = "us-east-1"
+	u.FsConfig.S3Config.AccessKey = "Server-Access-Key"
+	u.FsConfig.S3Config.AccessSecret = kms.NewPlainSecret("Server-Access-Secret")
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/archive",
+			// ignored for folders not stored on the local filesystem
+			MappedPath: "relative/path",
+		},
+		QuotaSize:  1048576,
+		QuotaFiles: 10,
+		FsConfig: dataprovider.Filesystem{
+			Provider: 1,
+			S3Config: vfs.S3FsConfig{
+				Bucket:       "archive",
+				Region:       "us-east-1",
+				AccessKey:    "Archive-Access-Key",
+				AccessSecret: kms.NewPlainSecret("Archive-Access-Secret"),
+				KeyPrefix:    "somedir/",
+			},
+		},
+	})
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/shared",
+		},
+		FsConfig: dataprovider.Filesystem{
+			Provider: 2,
+			GCSConfig: vfs.GCSFsConfig{
+				Bucket:               "shared",
+				AutomaticCredentials: 1,
+			},
+		},
+	})
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/reports",
+		},
+		FsConfig: dataprovider.Filesystem{
+			Provider: 2,
+			GCSConfig: vfs.GCSFsConfig{
+				Bucket:      "reports",
+				Credentials: kms.NewPlainSecret(base64.StdEncoding.EncodeToString([]byte(`{"type": "service_account"}`))),
+			},
+		},
+	})
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	// each GCS virtual folder with explicit credentials has its own encrypted credentials file
+	credentialsFiles, err := filepath.Glob(filepath.Join(credentialsPath, user.Username+"_folder_*_gcs_credentials.json"))
+	if err != nil || len(credentialsFiles) != 1 {
+		t.Fatalf("unexpected GCS credentials files for the virtual folders: %v, err: %v", credentialsFiles, err)
+	}
+	content, err := ioutil.ReadFile(credentialsFiles[0])
+	if err != nil || !strings.Contains(string(content), `"status":"Encrypted"`) ||
+		strings.Contains(string(content), "service_account") {
+		t.Errorf("the GCS credentials for the virtual folder must be stored encrypted: %#v, err: %v", string(content), err)
+	}
+	for _, folder := range user.VirtualFolders {
+		if len(folder.MappedPath) > 0 {
+			t.Errorf("the mapped path must be empty for folder %#v: %#v", folder.VirtualPath, folder.MappedPath)
+		}
+		if folder.FsConfig.Provider == 1 && !folder.FsConfig.S3Config.AccessSecret.IsRedacted() {
+			t.Errorf("the folder access secret must be returned redacted: %+v", folder.FsConfig.S3Config.AccessSecret)
+		}
+	}
+	// sending back the redacted secrets must keep the stored ones
+	user.VirtualFolders[0].QuotaFiles = 20
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	if user.VirtualFolders[0].QuotaFiles != 20 {
+		t.Errorf("unexpected virtual folder quota: %v", user.VirtualFolders[0].QuotaFiles)
+	}
+	for _, folder := range user.VirtualFolders {
+		if folder.FsConfig.Provider == 2 && !folder.FsConfig.GCSConfig.Credentials.IsEmpty() {
+			t.Errorf("the GCS credentials for the virtual folder %#v must not be returned", folder.VirtualPath)
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+}
+
+func TestUserTOTP(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	_, _, err = httpd.EnableUserTOTP(user, "123456", http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("enabling TOTP without a secret must fail: %v", err)
+	}
+	enrollment, _, err := httpd.GenerateUserTOTPSecret(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to generate TOTP secret: %v", err)
+	}
+	if len(enrollment.Secret) == 0 || !strings.HasPrefix(enrollment.URI, "otpauth://totp/") ||
+		!strings.Contains(enrollment.URI, enrollment.Secret) {
+		t.Errorf("invalid TOTP enrollment: %+v", enrollment)
+	}
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if user.TOTPConfig.Enabled || !user.TOTPConfig.Secret.IsEmpty() {
+		t.Errorf("TOTP must not be enabled and the secret must be hidden: %+v", user.TOTPConfig)
+	}
+	_, _, err = httpd.EnableUserTOTP(user, "invalid", http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("enabling TOTP with an invalid passcode must fail: %v", err)
+	}
+	codes, _, err := httpd.EnableUserTOTP(user, getTOTPPasscode(enrollment.Secret, time.Now()), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to enable TOTP: %v", err)
+	}
+	if len(codes.RecoveryCodes) != 10 {
+		t.Errorf("unexpected recovery codes: %v", codes.RecoveryCodes)
+	}
+	_, _, err = httpd.GenerateUserTOTPSecret(user, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("generating a new secret with TOTP enabled must fail: %v", err)
+	}
+	// a user update cannot change the TOTP configuration
+	user.TOTPConfig.Enabled = false
+	user.MaxSessions = 10
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if !user.TOTPConfig.Enabled || !user.TOTPConfig.Secret.IsEmpty() || len(user.TOTPConfig.RecoveryCodes) > 0 {
+		t.Errorf("TOTP must be enabled and the secret must be hidden: %+v", user.TOTPConfig)
+	}
+	_, err = httpd.DisableUserTOTP(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to disable TOTP: %v", err)
+	}
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if user.TOTPConfig.Enabled {
+		t.Error("TOTP must be disabled")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	_, _, err = httpd.GenerateUserTOTPSecret(user, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error generating TOTP secret for a missing user: %v", err)
+	}
+	_, err = httpd.DisableUserTOTP(user, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error disabling TOTP for a missing user: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, userPath+"/0/totp/validate", bytes.NewBuffer([]byte("invalid json")))
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, rr.Code)
+	req, _ = http.NewRequest(http.MethodPost, userPath+"/a/totp/generate", nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestUserPublicKey(t *testing.T) {
+	u := getTestUser()
+	invalidPubKey := "invalid"
+	validPubKey := "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQC03jj0D+djk7pxIf/0OhrxrchJTRZklofJ1NoIu4752Sq02mdXmarMVsqJ1cAjV5LBVy3D1F5U6XW4rppkXeVtd04Pxb09ehtH0pRRPaoHHlALiJt8CoMpbKYMA8b3KXPPriGxgGomvtU2T2RMURSwOZbMtpsugfjYSWenyYX+VORYhylWnSXL961LTyC21ehd6d6QnW9G7E5hYMITMY9TuQZz3bROYzXiTsgN0+g6Hn7exFQp50p45StUMfV/SftCMdCxlxuyGny2CrN/vfjO7xxOo2uv7q1qm10Q46KPWJQv+pgZ/OfL+EDjy07n5QVSKHlbx+2nT4Q0EgOSQaCTYwn3YjtABfIxWwgAFdyj6YlPulCL22qU4MYhDcA6PSBwDdf8hvxBfvsiHdM+JcSHvv8/VeJhk6CmnZxGY0fxBupov27z3yEO8nAg8k+6PaUiW1MSUfuGMF/ktB8LOstXsEPXSszuyXiOv4DaryOXUiSn7bmRqKcEFlJusO6aZP0= nicola@p1"
+	u.PublicKeys = []string{invalidPubKey}
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid pub key: %v", err)
+	}
+	u.PublicKeys = []string{validPubKey}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.PublicKeys = []string{validPubKey, invalidPubKey}
+	_, _, err = httpd.UpdateUser(user, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("update user with invalid public key must fail: %v", err)
+	}
+	user.PublicKeys = []string{validPubKey, validPubKey, validPubKey}
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to update user: %v", err)
 	}
@@ -616,25 +1809,237 @@ func TestUpdateUser(t *testing.T) {
 	user.UploadBandwidth = 1024
 	user.DownloadBandwidth = 512
 	user.VirtualFolders = nil
-	user.VirtualFolders = append(user.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir1",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir1"),
+	user.VirtualFolders = append(user.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir1",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir1"),
+		},
 	})
-	user.VirtualFolders = append(user.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir12/subdir",
-		MappedPath:  filepath.Join(os.TempDir(), "mapped_dir2"),
+	user.VirtualFolders = append(user.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir12/subdir",
+			MappedPath:  filepath.Join(os.TempDir(), "mapped_dir2"),
+		},
 	})
 	user, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to update user: %v", err)
 	}
-	user.Permissions["/subdir"] = []string{}
-	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	user.Permissions["/subdir"] = []string{}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	if len(user.Permissions["/subdir"]) > 0 {
+		t.Errorf("unexpected subdir permissions, must be empty")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+}
+
+func TestUserS3Config(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.FsConfig.Provider = 1
+	user.FsConfig.S3Config.Bucket = "test"
+	user.FsConfig.S3Config.Region = "us-east-1"
+	user.FsConfig.S3Config.AccessKey = "Server-Access-Key"
+	user.FsConfig.S3Config.AccessSecret = kms.NewPlainSecret("Server-Access-Secret")
+	user.FsConfig.S3Config.Endpoint = "http://127.0.0.1:9000"
+	user.FsConfig.S3Config.UploadPartSize = 8
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+	user.Password = defaultPassword
+	user.ID = 0
+	secret := encryptSecret(t, "Server-Access-Secret")
+	user.FsConfig.S3Config.AccessSecret = secret
+	user, _, err = httpd.AddUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.FsConfig.Provider = 1
+	user.FsConfig.S3Config.Bucket = "test1"
+	user.FsConfig.S3Config.Region = "us-east-1"
+	user.FsConfig.S3Config.AccessKey = "Server-Access-Key1"
+	user.FsConfig.S3Config.Endpoint = "http://localhost:9000"
+	user.FsConfig.S3Config.KeyPrefix = "somedir/subdir"
+	user.FsConfig.S3Config.UploadConcurrency = 5
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	user.FsConfig.Provider = 0
+	user.FsConfig.S3Config.Bucket = ""
+	user.FsConfig.S3Config.Region = ""
+	user.FsConfig.S3Config.AccessKey = ""
+	user.FsConfig.S3Config.AccessSecret = kms.Secret{}
+	user.FsConfig.S3Config.Endpoint = ""
+	user.FsConfig.S3Config.KeyPrefix = ""
+	user.FsConfig.S3Config.UploadPartSize = 0
+	user.FsConfig.S3Config.UploadConcurrency = 0
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	// test user without access key and access secret (shared config state)
+	user.FsConfig.Provider = 1
+	user.FsConfig.S3Config.Bucket = "test1"
+	user.FsConfig.S3Config.Region = "us-east-1"
+	user.FsConfig.S3Config.AccessKey = ""
+	user.FsConfig.S3Config.AccessSecret = kms.Secret{}
+	user.FsConfig.S3Config.Endpoint = ""
+	user.FsConfig.S3Config.KeyPrefix = "somedir/subdir"
+	user.FsConfig.S3Config.UploadPartSize = 6
+	user.FsConfig.S3Config.UploadConcurrency = 4
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	// the user has no access secret, a redacted one cannot be restored
+	user.FsConfig.S3Config.AccessKey = "Server-Access-Key"
+	user.FsConfig.S3Config.AccessSecret = secret.Redacted()
+	_, _, err = httpd.UpdateUser(user, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error updating user with a redacted access secret: %v", err)
+	}
+	// a plain text secret is never considered encrypted because of its format
+	user.FsConfig.S3Config.AccessSecret = kms.NewPlainSecret(secret.Payload)
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	userGet, err := dataprovider.UserExists(dataprovider.GetProvider(), user.Username)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	accessSecret, err := decryptSecret(userGet.FsConfig.S3Config.AccessSecret)
+	if err != nil || accessSecret != secret.Payload {
+		t.Errorf("unexpected access secret %#v, err: %v", accessSecret, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+}
+
+func TestUserAzureBlobConfig(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.FsConfig.Provider = 3
+	user.FsConfig.AzBlobConfig.Container = "test"
+	user.FsConfig.AzBlobConfig.AccountName = "Server-Account-Name"
+	user.FsConfig.AzBlobConfig.AccountKey = kms.NewPlainSecret("Server-Account-Key")
+	user.FsConfig.AzBlobConfig.Endpoint = "http://127.0.0.1:9000"
+	user.FsConfig.AzBlobConfig.UploadPartSize = 8
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	if !user.FsConfig.AzBlobConfig.AccountKey.IsRedacted() {
+		t.Errorf("the account key must be encrypted: %#v", user.FsConfig.AzBlobConfig.AccountKey)
+	}
+	// the redacted account key is sent back, the current key must be preserved
+	user.FsConfig.AzBlobConfig.AccessTier = "Cool"
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	userGet, err := dataprovider.UserExists(dataprovider.GetProvider(), user.Username)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	accountKey, err := decryptSecret(userGet.FsConfig.AzBlobConfig.AccountKey)
+	if err != nil || accountKey != "Server-Account-Key" {
+		t.Errorf("unexpected account key %#v, err: %v", accountKey, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+	user.Password = defaultPassword
+	user.ID = 0
+	secret := encryptSecret(t, "Server-Account-Key")
+	user.FsConfig.AzBlobConfig.AccountKey = secret
+	user, _, err = httpd.AddUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.FsConfig.AzBlobConfig.Container = "test-container"
+	user.FsConfig.AzBlobConfig.AccountKey = kms.Secret{}
+	user.FsConfig.AzBlobConfig.Endpoint = ""
+	user.FsConfig.AzBlobConfig.KeyPrefix = "somedir/subdir"
+	user.FsConfig.AzBlobConfig.UploadConcurrency = 5
+	user.FsConfig.AzBlobConfig.AccessTier = "Hot"
+	// an empty account key with a non empty account name preserves the current key,
+	// so the returned user will not match the empty key we sent
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err == nil {
+		t.Error("the current account key is expected in the response")
+	}
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if user.FsConfig.AzBlobConfig.AccountKey != secret.Redacted() {
+		t.Errorf("unexpected account key %#v", user.FsConfig.AzBlobConfig.AccountKey)
+	}
+	user.FsConfig.Provider = 0
+	user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	// test SAS url
+	user.FsConfig.Provider = 3
+	user.FsConfig.AzBlobConfig.AccountName = ""
+	user.FsConfig.AzBlobConfig.AccountKey = kms.Secret{}
+	user.FsConfig.AzBlobConfig.Container = ""
+	user.FsConfig.AzBlobConfig.SASURL = "https://myaccount.blob.core.windows.net/mycontainer?sig=signature"
+	user.FsConfig.AzBlobConfig.UseEmulator = true
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	user.FsConfig.Provider = 0
+	user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	// the user has no account key, a redacted one cannot be restored
+	user.FsConfig.Provider = 3
+	user.FsConfig.AzBlobConfig.Container = "test"
+	user.FsConfig.AzBlobConfig.AccountName = "Server-Account-Name"
+	user.FsConfig.AzBlobConfig.AccountKey = secret.Redacted()
+	_, _, err = httpd.UpdateUser(user, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error updating user with a redacted account key: %v", err)
+	}
+	// a plain text key is never considered encrypted because of its format
+	user.FsConfig.AzBlobConfig.AccountKey = kms.NewPlainSecret(secret.Payload)
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	userGet, err = dataprovider.UserExists(dataprovider.GetProvider(), user.Username)
 	if err != nil {
-		t.Errorf("unable to update user: %v", err)
+		t.Errorf("unable to get user: %v", err)
 	}
-	if len(user.Permissions["/subdir"]) > 0 {
-		t.Errorf("unexpected subdir permissions, must be empty")
+	accountKey, err = decryptSecret(userGet.FsConfig.AzBlobConfig.AccountKey)
+	if err != nil || accountKey != secret.Payload {
+		t.Errorf("unexpected account key %#v, err: %v", accountKey, err)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -642,18 +2047,69 @@ func TestUpdateUser(t *testing.T) {
 	}
 }
 
-func TestUserS3Config(t *testing.T) {
+func TestUserSFTPFsConfig(t *testing.T) {
 	user, _, err := httpd.AddUser(getTestUser(), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	user.FsConfig.Provider = 1
-	user.FsConfig.S3Config.Bucket = "test"
-	user.FsConfig.S3Config.Region = "us-east-1"
-	user.FsConfig.S3Config.AccessKey = "Server-Access-Key"
-	user.FsConfig.S3Config.AccessSecret = "Server-Access-Secret"
-	user.FsConfig.S3Config.Endpoint = "http://127.0.0.1:9000"
-	user.FsConfig.S3Config.UploadPartSize = 8
+	user.FsConfig.Provider = 4
+	user.FsConfig.SFTPConfig.Endpoint = "127.0.0.1:2022"
+	user.FsConfig.SFTPConfig.Username = "remote_user"
+	user.FsConfig.SFTPConfig.Password = kms.NewPlainSecret("remote_password")
+	user.FsConfig.SFTPConfig.Fingerprints = []string{" SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4", ""}
+	user.FsConfig.SFTPConfig.Prefix = "/remote/dir/"
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err == nil {
+		t.Error("the fingerprints and the prefix are cleaned, the returned user must not match")
+	}
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if len(user.FsConfig.SFTPConfig.Fingerprints) != 1 || user.FsConfig.SFTPConfig.Prefix != "/remote/dir" {
+		t.Errorf("unexpected SFTP config: %+v", user.FsConfig.SFTPConfig)
+	}
+	if !user.FsConfig.SFTPConfig.Password.IsRedacted() {
+		t.Errorf("the password must be encrypted: %#v", user.FsConfig.SFTPConfig.Password)
+	}
+	// the redacted password is sent back, the current password must be preserved
+	user.FsConfig.SFTPConfig.PrivateKey = kms.NewPlainSecret("remote private key")
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	userGet, err := dataprovider.UserExists(dataprovider.GetProvider(), user.Username)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	password, err := decryptSecret(userGet.FsConfig.SFTPConfig.Password)
+	if err != nil || password != "remote_password" {
+		t.Errorf("unexpected password %#v, err: %v", password, err)
+	}
+	privateKey, err := decryptSecret(userGet.FsConfig.SFTPConfig.PrivateKey)
+	if err != nil || privateKey != "remote private key" {
+		t.Errorf("unexpected private key %#v, err: %v", privateKey, err)
+	}
+	// empty secrets with a non empty username preserve the current ones
+	user.FsConfig.SFTPConfig.Password = kms.Secret{}
+	user.FsConfig.SFTPConfig.PrivateKey = kms.Secret{}
+	user.FsConfig.SFTPConfig.Prefix = "/"
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err == nil {
+		t.Error("the current secrets are expected in the response")
+	}
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if user.FsConfig.SFTPConfig.Password.IsEmpty() || user.FsConfig.SFTPConfig.PrivateKey.IsEmpty() {
+		t.Errorf("the current secrets must be preserved: %+v", user.FsConfig.SFTPConfig)
+	}
+	if user.FsConfig.SFTPConfig.Prefix != "/" {
+		t.Errorf("unexpected prefix %#v", user.FsConfig.SFTPConfig.Prefix)
+	}
+	user.FsConfig.Provider = 0
+	user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
 	user, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to update user: %v", err)
@@ -662,56 +2118,83 @@ func TestUserS3Config(t *testing.T) {
 	if err != nil {
 		t.Errorf("unable to remove: %v", err)
 	}
-	user.Password = defaultPassword
-	user.ID = 0
-	secret, _ := utils.EncryptData("Server-Access-Secret")
-	user.FsConfig.S3Config.AccessSecret = secret
-	user, _, err = httpd.AddUser(user, http.StatusOK)
+}
+
+func TestUserCryptFsConfig(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("crypt passphrase")
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	user.FsConfig.Provider = 1
-	user.FsConfig.S3Config.Bucket = "test1"
-	user.FsConfig.S3Config.Region = "us-east-1"
-	user.FsConfig.S3Config.AccessKey = "Server-Access-Key1"
-	user.FsConfig.S3Config.Endpoint = "http://localhost:9000"
-	user.FsConfig.S3Config.KeyPrefix = "somedir/subdir"
-	user.FsConfig.S3Config.UploadConcurrency = 5
+	if !user.FsConfig.CryptConfig.Passphrase.IsRedacted() {
+		t.Errorf("the passphrase must be encrypted: %#v", user.FsConfig.CryptConfig.Passphrase)
+	}
+	// the redacted passphrase is sent back, the current passphrase must be preserved
+	user.MaxSessions = 2
 	user, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to update user: %v", err)
 	}
-	user.FsConfig.Provider = 0
-	user.FsConfig.S3Config.Bucket = ""
-	user.FsConfig.S3Config.Region = ""
-	user.FsConfig.S3Config.AccessKey = ""
-	user.FsConfig.S3Config.AccessSecret = ""
-	user.FsConfig.S3Config.Endpoint = ""
-	user.FsConfig.S3Config.KeyPrefix = ""
-	user.FsConfig.S3Config.UploadPartSize = 0
-	user.FsConfig.S3Config.UploadConcurrency = 0
+	userGet, err := dataprovider.UserExists(dataprovider.GetProvider(), user.Username)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	passphrase, err := decryptSecret(userGet.FsConfig.CryptConfig.Passphrase)
+	if err != nil || passphrase != "crypt passphrase" {
+		t.Errorf("unexpected passphrase %#v, err: %v", passphrase, err)
+	}
+	if !strings.Contains(user.GetInfoString(), "Encrypted") {
+		t.Errorf("unexpected info string %#v", user.GetInfoString())
+	}
+	// an empty passphrase disables the encryption
+	user.FsConfig.CryptConfig.Passphrase = kms.Secret{}
 	user, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to update user: %v", err)
 	}
-	// test user without access key and access secret (shared config state)
-	user.FsConfig.Provider = 1
-	user.FsConfig.S3Config.Bucket = "test1"
-	user.FsConfig.S3Config.Region = "us-east-1"
-	user.FsConfig.S3Config.AccessKey = ""
-	user.FsConfig.S3Config.AccessSecret = ""
-	user.FsConfig.S3Config.Endpoint = ""
-	user.FsConfig.S3Config.KeyPrefix = "somedir/subdir"
-	user.FsConfig.S3Config.UploadPartSize = 6
-	user.FsConfig.S3Config.UploadConcurrency = 4
+	if !user.FsConfig.CryptConfig.Passphrase.IsEmpty() {
+		t.Errorf("the encryption must be disabled: %+v", user.FsConfig.CryptConfig)
+	}
+	// the encryption is inherited from the primary group
+	group := getTestGroup()
+	group.UserSettings.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("group passphrase")
+	group, _, err = httpd.AddGroup(group, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add group: %v", err)
+	}
+	if !group.UserSettings.FsConfig.CryptConfig.Passphrase.IsRedacted() {
+		t.Errorf("the group passphrase must be encrypted: %#v", group.UserSettings.FsConfig.CryptConfig.Passphrase)
+	}
+	group.UserSettings.MaxSessions = 3
+	group, _, err = httpd.UpdateGroup(group, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update group: %v", err)
+	}
+	user.Groups = []dataprovider.UserGroup{
+		{Name: group.Name, Type: dataprovider.GroupTypePrimary},
+	}
 	user, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to update user: %v", err)
 	}
+	user, err = dataprovider.CheckUserAndPass(dataprovider.GetProvider(), defaultUsername, defaultPassword,
+		"127.0.0.1", "HTTP")
+	if err != nil {
+		t.Errorf("unable to authenticate user with groups: %v", err)
+	}
+	passphrase, err = decryptSecret(user.FsConfig.CryptConfig.Passphrase)
+	if err != nil || passphrase != "group passphrase" {
+		t.Errorf("unexpected passphrase inherited from the group %#v, err: %v", passphrase, err)
+	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove: %v", err)
 	}
+	_, err = httpd.RemoveGroup(group, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove group: %v", err)
+	}
 }
 
 func TestUserGCSConfig(t *testing.T) {
@@ -723,7 +2206,7 @@ func TestUserGCSConfig(t *testing.T) {
 	os.MkdirAll(credentialsPath, 0700)
 	user.FsConfig.Provider = 2
 	user.FsConfig.GCSConfig.Bucket = "test"
-	user.FsConfig.GCSConfig.Credentials = base64.StdEncoding.EncodeToString([]byte("fake credentials"))
+	user.FsConfig.GCSConfig.Credentials = kms.NewPlainSecret(base64.StdEncoding.EncodeToString([]byte("fake credentials")))
 	user, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to update user: %v", err)
@@ -741,7 +2224,7 @@ func TestUserGCSConfig(t *testing.T) {
 	}
 	os.RemoveAll(credentialsPath)
 	os.MkdirAll(credentialsPath, 0700)
-	user.FsConfig.GCSConfig.Credentials = ""
+	user.FsConfig.GCSConfig.Credentials = kms.Secret{}
 	user.FsConfig.GCSConfig.AutomaticCredentials = 1
 	user, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
@@ -751,7 +2234,7 @@ func TestUserGCSConfig(t *testing.T) {
 	user.FsConfig.S3Config.Bucket = "test1"
 	user.FsConfig.S3Config.Region = "us-east-1"
 	user.FsConfig.S3Config.AccessKey = "Server-Access-Key1"
-	user.FsConfig.S3Config.AccessSecret = "secret"
+	user.FsConfig.S3Config.AccessSecret = kms.NewPlainSecret("secret")
 	user.FsConfig.S3Config.Endpoint = "http://localhost:9000"
 	user.FsConfig.S3Config.KeyPrefix = "somedir/subdir"
 	user, _, err = httpd.UpdateUser(user, http.StatusOK)
@@ -760,7 +2243,7 @@ func TestUserGCSConfig(t *testing.T) {
 	}
 	user.FsConfig.Provider = 2
 	user.FsConfig.GCSConfig.Bucket = "test1"
-	user.FsConfig.GCSConfig.Credentials = base64.StdEncoding.EncodeToString([]byte("fake credentials"))
+	user.FsConfig.GCSConfig.Credentials = kms.NewPlainSecret(base64.StdEncoding.EncodeToString([]byte("fake credentials")))
 	user, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to update user: %v", err)
@@ -968,6 +2451,20 @@ func TestGetConnections(t *testing.T) {
 	}
 }
 
+func TestGetConnectionsStats(t *testing.T) {
+	status, _, err := httpd.GetNetConnectionsStatus(http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get connections stats: %v", err)
+	}
+	if status.Active != 0 || len(status.ActivePerHost) != 0 {
+		t.Errorf("unexpected connections stats: %+v", status)
+	}
+	_, _, err = httpd.GetNetConnectionsStatus(http.StatusInternalServerError)
+	if err == nil {
+		t.Errorf("get connections stats request must succeed, we requested to check a wrong status code")
+	}
+}
+
 func TestCloseActiveConnection(t *testing.T) {
 	_, err := httpd.CloseConnection("non_existent_id", http.StatusNotFound)
 	if err != nil {
@@ -1131,110 +2628,406 @@ func TestLoaddata(t *testing.T) {
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	_, _, err = httpd.Loaddata(backupFilePath, "", "a", http.StatusBadRequest)
+	_, _, err = httpd.Loaddata(backupFilePath, "", "a", http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, _, err = httpd.Loaddata("backup.json", "1", "", http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, _, err = httpd.Loaddata(backupFilePath+"a", "1", "", http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if runtime.GOOS != "windows" {
+		os.Chmod(backupFilePath, 0111)
+		_, _, err = httpd.Loaddata(backupFilePath, "1", "", http.StatusInternalServerError)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		os.Chmod(backupFilePath, 0644)
+	}
+	// add user from backup
+	_, _, err = httpd.Loaddata(backupFilePath, "1", "", http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// update user from backup
+	_, _, err = httpd.Loaddata(backupFilePath, "2", "", http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	users, _, err := httpd.GetUsers(1, 0, user.Username, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v", err)
+	}
+	if len(users) != 1 {
+		t.Error("Unable to get restored user")
+	}
+	user = users[0]
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.Remove(backupFilePath)
+	createTestFile(backupFilePath, 10485761)
+	_, _, err = httpd.Loaddata(backupFilePath, "1", "0", http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	os.Remove(backupFilePath)
+	createTestFile(backupFilePath, 65535)
+	_, _, err = httpd.Loaddata(backupFilePath, "1", "0", http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	os.Remove(backupFilePath)
+}
+
+func TestLoaddataMode(t *testing.T) {
+	user := getTestUser()
+	user.ID = 1
+	user.Username = "test_user_restore"
+	backupData := dataprovider.BackupData{}
+	backupData.Users = append(backupData.Users, user)
+	backupContent, _ := json.Marshal(backupData)
+	backupFilePath := filepath.Join(backupsPath, "backup.json")
+	ioutil.WriteFile(backupFilePath, backupContent, 0666)
+	_, _, err := httpd.Loaddata(backupFilePath, "0", "0", http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	users, _, err := httpd.GetUsers(1, 0, user.Username, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v", err)
+	}
+	if len(users) != 1 {
+		t.Error("Unable to get restored user")
+	}
+	user = users[0]
+	oldUploadBandwidth := user.UploadBandwidth
+	user.UploadBandwidth = oldUploadBandwidth + 128
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	_, _, err = httpd.Loaddata(backupFilePath, "0", "1", http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	users, _, err = httpd.GetUsers(1, 0, user.Username, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v", err)
+	}
+	if len(users) != 1 {
+		t.Error("Unable to get restored user")
+	}
+	user = users[0]
+	if user.UploadBandwidth == oldUploadBandwidth {
+		t.Error("user must not be modified")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.Remove(backupFilePath)
+}
+
+func TestLoaddataAdmins(t *testing.T) {
+	admin := getTestAdmin()
+	backupData := dataprovider.BackupData{}
+	backupData.Admins = append(backupData.Admins, admin)
+	backupContent, _ := json.Marshal(backupData)
+	backupFilePath := filepath.Join(backupsPath, "backup.json")
+	ioutil.WriteFile(backupFilePath, backupContent, 0666)
+	_, _, err := httpd.Loaddata(backupFilePath, "0", "0", http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	httpd.SetBaseURLAndCredentials(httpBaseURL, defaultAdminUsername, defaultAdminPassword)
+	admin, _, err = httpd.GetAdminByUsername(defaultAdminUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get restored admin: %v", err)
+	}
+	admin.Description = "updated"
+	admin, _, err = httpd.UpdateAdmin(admin, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update admin: %v", err)
+	}
+	_, _, err = httpd.Loaddata(backupFilePath, "0", "1", http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	admin, _, err = httpd.GetAdminByUsername(defaultAdminUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get admin: %v", err)
+	}
+	if admin.Description != "updated" {
+		t.Error("admin must not be modified")
+	}
+	_, _, err = httpd.Dumpdata("backup.json", "", http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	content, err := ioutil.ReadFile(backupFilePath)
+	if err != nil {
+		t.Errorf("unable to read dump file: %v", err)
+	}
+	var dump dataprovider.BackupData
+	err = json.Unmarshal(content, &dump)
+	if err != nil {
+		t.Errorf("unable to parse dump file: %v", err)
+	}
+	if len(dump.Admins) != 1 || len(dump.Admins[0].Password) == 0 {
+		t.Errorf("unexpected admins in dump: %+v", dump.Admins)
+	}
+	removeTestAdmin(t)
+	os.Remove(backupFilePath)
+}
+
+func TestLoaddataGroups(t *testing.T) {
+	group := getTestGroup()
+	user := getTestUser()
+	user.Groups = []dataprovider.UserGroup{
+		{Name: group.Name, Type: dataprovider.GroupTypePrimary},
+	}
+	backupData := dataprovider.BackupData{}
+	backupData.Groups = append(backupData.Groups, group)
+	backupData.Users = append(backupData.Users, user)
+	backupContent, _ := json.Marshal(backupData)
+	backupFilePath := filepath.Join(backupsPath, "backup.json")
+	ioutil.WriteFile(backupFilePath, backupContent, 0666)
+	_, _, err := httpd.Loaddata(backupFilePath, "0", "0", http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	group, _, err = httpd.GetGroupByName(group.Name, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get restored group: %v", err)
+	}
+	group.Description = "updated"
+	group, _, err = httpd.UpdateGroup(group, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update group: %v", err)
+	}
+	_, _, err = httpd.Loaddata(backupFilePath, "0", "1", http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	group, _, err = httpd.GetGroupByName(group.Name, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get group: %v", err)
+	}
+	if group.Description != "updated" {
+		t.Error("group must not be modified")
+	}
+	users, _, err := httpd.GetUsers(1, 0, user.Username, http.StatusOK)
+	if err != nil || len(users) != 1 {
+		t.Errorf("unable to get restored user: %v", err)
+	}
+	_, _, err = httpd.Dumpdata("backup.json", "", http.StatusOK)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	_, _, err = httpd.Loaddata("backup.json", "1", "", http.StatusBadRequest)
+	content, err := ioutil.ReadFile(backupFilePath)
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Errorf("unable to read dump file: %v", err)
 	}
-	_, _, err = httpd.Loaddata(backupFilePath+"a", "1", "", http.StatusBadRequest)
+	var dump dataprovider.BackupData
+	err = json.Unmarshal(content, &dump)
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Errorf("unable to parse dump file: %v", err)
 	}
-	if runtime.GOOS != "windows" {
-		os.Chmod(backupFilePath, 0111)
-		_, _, err = httpd.Loaddata(backupFilePath, "1", "", http.StatusInternalServerError)
+	if len(dump.Groups) != 1 || dump.Groups[0].Name != group.Name {
+		t.Errorf("unexpected groups in dump: %+v", dump.Groups)
+	}
+	for _, u := range users {
+		_, err = httpd.RemoveUser(u, http.StatusOK)
 		if err != nil {
-			t.Errorf("unexpected error: %v", err)
+			t.Errorf("unable to remove user: %v", err)
 		}
-		os.Chmod(backupFilePath, 0644)
 	}
-	// add user from backup
-	_, _, err = httpd.Loaddata(backupFilePath, "1", "", http.StatusOK)
+	_, err = httpd.RemoveGroup(group, http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Errorf("unable to remove group: %v", err)
 	}
-	// update user from backup
-	_, _, err = httpd.Loaddata(backupFilePath, "2", "", http.StatusOK)
+	os.Remove(backupFilePath)
+}
+
+func TestLoaddataFromRequestBody(t *testing.T) {
+	group := getTestGroup()
+	user := getTestUser()
+	user.Username = "test_user_restore_body"
+	user.Groups = []dataprovider.UserGroup{
+		{Name: group.Name, Type: dataprovider.GroupTypePrimary},
+	}
+	invalidUser := getTestUser()
+	invalidUser.Username = "test_user_restore_invalid"
+	invalidUser.HomeDir = "relative_path"
+	user1 := getTestUser()
+	user1.Username = "test_user_restore_body1"
+	// the users come before the groups they belong to
+	backupContent, _ := json.Marshal(map[string]interface{}{
+		"users":  []dataprovider.User{user, invalidUser, user1},
+		"groups": []dataprovider.Group{group},
+	})
+	response, err := httpd.LoaddataFromReader(bytes.NewReader(backupContent), "application/json", "0", "0",
+		http.StatusBadRequest)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
+	errors, ok := response["errors"].([]interface{})
+	if !ok || len(errors) != 1 || response["users"].(float64) != 2 || response["groups"].(float64) != 1 {
+		t.Errorf("unexpected response: %+v", response)
+	} else if errors[0].(map[string]interface{})["name"] != invalidUser.Username {
+		t.Errorf("unexpected restore error: %+v", errors[0])
+	}
 	users, _, err := httpd.GetUsers(1, 0, user.Username, http.StatusOK)
+	if err != nil || len(users) != 1 {
+		t.Errorf("unable to get restored user: %v", err)
+	}
+	// the same backup without the invalid user sent as multipart form
+	backupContent, _ = json.Marshal(dataprovider.BackupData{
+		Groups: []dataprovider.Group{group},
+		Users:  []dataprovider.User{user, user1},
+	})
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("backup_file", "backup.json")
+	part.Write(backupContent)
+	mw.Close()
+	response, err = httpd.LoaddataFromReader(bytes.NewReader(body.Bytes()), mw.FormDataContentType(), "0", "1",
+		http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v, response: %+v", err, response)
+	}
+	body.Reset()
+	mw = multipart.NewWriter(&body)
+	mw.WriteField("file", "content")
+	mw.Close()
+	_, err = httpd.LoaddataFromReader(bytes.NewReader(body.Bytes()), mw.FormDataContentType(), "0", "1",
+		http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unable to get users: %v", err)
+		t.Errorf("unexpected error: %v", err)
 	}
-	if len(users) != 1 {
-		t.Error("Unable to get restored user")
+	_, err = httpd.LoaddataFromReader(strings.NewReader(`{"users":[{"username":`), "application/json", "0", "0",
+		http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
-	user = users[0]
-	_, err = httpd.RemoveUser(user, http.StatusOK)
+	// a backup streamed inside the response can be restored
+	dump, err := httpd.DumpdataAsResponse("1", http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+		t.Errorf("unexpected error: %v", err)
 	}
-	os.Remove(backupFilePath)
-	createTestFile(backupFilePath, 10485761)
-	_, _, err = httpd.Loaddata(backupFilePath, "1", "0", http.StatusBadRequest)
+	var backupData dataprovider.BackupData
+	err = json.Unmarshal(dump, &backupData)
+	if err != nil {
+		t.Errorf("unable to parse dump: %v", err)
+	}
+	if len(backupData.Groups) != 1 || len(backupData.Users) != 2 {
+		t.Errorf("unexpected dump: %+v", backupData)
+	}
+	for _, u := range backupData.Users {
+		if len(u.Password) == 0 {
+			t.Errorf("the dump must contain the hashed password for user %#v", u.Username)
+		}
+	}
+	_, err = httpd.LoaddataFromReader(bytes.NewReader(dump), "application/json", "0", "0", http.StatusOK)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	os.Remove(backupFilePath)
-	createTestFile(backupFilePath, 65535)
-	_, _, err = httpd.Loaddata(backupFilePath, "1", "0", http.StatusBadRequest)
+	dump, err = httpd.DumpdataAsResponse("", http.StatusOK)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	os.Remove(backupFilePath)
+	err = json.Unmarshal(dump, &backupData)
+	if err != nil {
+		t.Errorf("unable to parse dump: %v", err)
+	}
+	for _, username := range []string{user.Username, user1.Username} {
+		users, _, err = httpd.GetUsers(1, 0, username, http.StatusOK)
+		if err != nil || len(users) != 1 {
+			t.Errorf("unable to get restored user: %v", err)
+			continue
+		}
+		_, err = httpd.RemoveUser(users[0], http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to remove user: %v", err)
+		}
+	}
+	_, err = httpd.RemoveGroup(group, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove group: %v", err)
+	}
 }
 
-func TestLoaddataMode(t *testing.T) {
+func TestLoaddataCompressed(t *testing.T) {
 	user := getTestUser()
-	user.ID = 1
-	user.Username = "test_user_restore"
-	backupData := dataprovider.BackupData{}
-	backupData.Users = append(backupData.Users, user)
-	backupContent, _ := json.Marshal(backupData)
-	backupFilePath := filepath.Join(backupsPath, "backup.json")
-	ioutil.WriteFile(backupFilePath, backupContent, 0666)
-	_, _, err := httpd.Loaddata(backupFilePath, "0", "0", http.StatusOK)
+	user.Username = "test_user_restore_gzip"
+	backupContent, _ := json.Marshal(dataprovider.BackupData{
+		Users: []dataprovider.User{user},
+	})
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	gw.Write(backupContent)
+	gw.Close()
+	response, err := httpd.LoaddataFromReader(bytes.NewReader(compressed.Bytes()), "application/json", "0", "0",
+		http.StatusOK)
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Errorf("unexpected error: %v, response: %+v", err, response)
 	}
 	users, _, err := httpd.GetUsers(1, 0, user.Username, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to get users: %v", err)
-	}
-	if len(users) != 1 {
-		t.Error("Unable to get restored user")
+	if err != nil || len(users) != 1 {
+		t.Errorf("unable to get restored user: %v", err)
+	} else {
+		_, err = httpd.RemoveUser(users[0], http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to remove user: %v", err)
+		}
 	}
-	user = users[0]
-	oldUploadBandwidth := user.UploadBandwidth
-	user.UploadBandwidth = oldUploadBandwidth + 128
-	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	_, err = httpd.LoaddataFromReader(bytes.NewReader(compressed.Bytes()[:compressed.Len()/2]), "application/json",
+		"0", "0", http.StatusBadRequest)
 	if err != nil {
-		t.Errorf("unable to update user: %v", err)
+		t.Errorf("unexpected error: %v", err)
 	}
-	_, _, err = httpd.Loaddata(backupFilePath, "0", "1", http.StatusOK)
+	// no passphrase is configured
+	_, err = httpd.LoaddataFromReader(strings.NewReader("SFTPGOBACKUPENC1 encrypted"), "application/json", "0", "0",
+		http.StatusBadRequest)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	users, _, err = httpd.GetUsers(1, 0, user.Username, http.StatusOK)
+}
+
+func TestBackupStatus(t *testing.T) {
+	status, _, err := httpd.GetBackupStatus(http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to get users: %v", err)
-	}
-	if len(users) != 1 {
-		t.Error("Unable to get restored user")
+		t.Errorf("unable to get backup status: %v", err)
 	}
-	user = users[0]
-	if user.UploadBandwidth == oldUploadBandwidth {
-		t.Error("user must not be modified")
+	if status.Enabled {
+		t.Errorf("scheduled backups must be disabled: %+v", status)
 	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
+	backupsConf := config.GetBackupsConfig()
+	backupsConf.Schedule = "@yearly"
+	err = backupsConf.Initialize(configDir, backupsPath)
 	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+		t.Errorf("unable to initialize scheduled backups: %v", err)
+	}
+	status, _, err = httpd.GetBackupStatus(http.StatusOK)
+	// the next run is set by the scheduler goroutine
+	for i := 0; i < 20 && err == nil && status.NextRun == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		status, _, err = httpd.GetBackupStatus(http.StatusOK)
+	}
+	if err != nil || !status.Enabled || status.Schedule != backupsConf.Schedule || status.NextRun == 0 {
+		t.Errorf("unexpected backup status: %+v, err: %v", status, err)
+	}
+	backup.Stop()
+	status, _, err = httpd.GetBackupStatus(http.StatusOK)
+	if err != nil || status.Enabled || status.NextRun != 0 {
+		t.Errorf("unexpected backup status: %+v, err: %v", status, err)
 	}
-	os.Remove(backupFilePath)
 }
 
 func TestHTTPSConnection(t *testing.T) {
@@ -2031,7 +3824,7 @@ func TestWebUserS3Mock(t *testing.T) {
 	user.FsConfig.S3Config.Bucket = "test"
 	user.FsConfig.S3Config.Region = "eu-west-1"
 	user.FsConfig.S3Config.AccessKey = "access-key"
-	user.FsConfig.S3Config.AccessSecret = "access-secret"
+	user.FsConfig.S3Config.AccessSecret = kms.NewPlainSecret("access-secret")
 	user.FsConfig.S3Config.Endpoint = "http://127.0.0.1:9000/path?a=b"
 	user.FsConfig.S3Config.StorageClass = "Standard"
 	user.FsConfig.S3Config.KeyPrefix = "somedir/subdir/"
@@ -2057,7 +3850,7 @@ func TestWebUserS3Mock(t *testing.T) {
 	form.Set("s3_bucket", user.FsConfig.S3Config.Bucket)
 	form.Set("s3_region", user.FsConfig.S3Config.Region)
 	form.Set("s3_access_key", user.FsConfig.S3Config.AccessKey)
-	form.Set("s3_access_secret", user.FsConfig.S3Config.AccessSecret)
+	form.Set("s3_access_secret", user.FsConfig.S3Config.AccessSecret.Payload)
 	form.Set("s3_storage_class", user.FsConfig.S3Config.StorageClass)
 	form.Set("s3_endpoint", user.FsConfig.S3Config.Endpoint)
 	form.Set("s3_key_prefix", user.FsConfig.S3Config.KeyPrefix)
@@ -2109,7 +3902,7 @@ func TestWebUserS3Mock(t *testing.T) {
 	if updateUser.FsConfig.S3Config.AccessKey != user.FsConfig.S3Config.AccessKey {
 		t.Error("s3 access key mismatch")
 	}
-	if !strings.HasPrefix(updateUser.FsConfig.S3Config.AccessSecret, "$aes$") {
+	if !updateUser.FsConfig.S3Config.AccessSecret.IsRedacted() {
 		t.Error("s3 access secret is not encrypted")
 	}
 	if updateUser.FsConfig.S3Config.StorageClass != user.FsConfig.S3Config.StorageClass {
@@ -2118,17 +3911,262 @@ func TestWebUserS3Mock(t *testing.T) {
 	if updateUser.FsConfig.S3Config.Endpoint != user.FsConfig.S3Config.Endpoint {
 		t.Error("s3 endpoint mismatch")
 	}
-	if updateUser.FsConfig.S3Config.KeyPrefix != user.FsConfig.S3Config.KeyPrefix {
-		t.Error("s3 key prefix mismatch")
+	if updateUser.FsConfig.S3Config.KeyPrefix != user.FsConfig.S3Config.KeyPrefix {
+		t.Error("s3 key prefix mismatch")
+	}
+	if updateUser.FsConfig.S3Config.UploadPartSize != user.FsConfig.S3Config.UploadPartSize {
+		t.Error("s3 upload part size mismatch")
+	}
+	if updateUser.FsConfig.S3Config.UploadConcurrency != user.FsConfig.S3Config.UploadConcurrency {
+		t.Error("s3 upload concurrency mismatch")
+	}
+	if len(updateUser.Filters.FileExtensions) != 2 {
+		t.Errorf("unexpected extensions filter: %+v", updateUser.Filters.FileExtensions)
+	}
+	// the web page shows a placeholder instead of the encrypted secret
+	req, _ = http.NewRequest(http.MethodGet, webUserPath+"/"+strconv.FormatInt(user.ID, 10), nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	if !strings.Contains(rr.Body.String(), redactedSecret) {
+		t.Error("the s3 access secret placeholder is not rendered")
+	}
+	// posting back the placeholder must preserve the current secret
+	form.Set("s3_access_secret", redactedSecret)
+	b, contentType, _ = getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, webUserPath+"/"+strconv.FormatInt(user.ID, 10), &b)
+	req.Header.Set("Content-Type", contentType)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusSeeOther, rr.Code)
+	userGet, err := dataprovider.UserExists(dataprovider.GetProvider(), user.Username)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	accessSecret, err := decryptSecret(userGet.FsConfig.S3Config.AccessSecret)
+	if err != nil || accessSecret != user.FsConfig.S3Config.AccessSecret.Payload {
+		t.Errorf("unexpected s3 access secret %#v, err: %v", accessSecret, err)
+	}
+	req, _ = http.NewRequest(http.MethodDelete, userPath+"/"+strconv.FormatInt(user.ID, 10), nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+}
+
+func TestWebUserAzureBlobMock(t *testing.T) {
+	user := getTestUser()
+	userAsJSON := getUserAsJSON(t, user)
+	req, _ := http.NewRequest(http.MethodPost, userPath, bytes.NewBuffer(userAsJSON))
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	err := render.DecodeJSON(rr.Body, &user)
+	if err != nil {
+		t.Errorf("Error get user: %v", err)
+	}
+	user.FsConfig.Provider = 3
+	user.FsConfig.AzBlobConfig.Container = "container"
+	user.FsConfig.AzBlobConfig.AccountName = "aname"
+	user.FsConfig.AzBlobConfig.AccountKey = kms.NewPlainSecret("access-skey")
+	user.FsConfig.AzBlobConfig.Endpoint = "http://127.0.0.1:9000/path?b=c"
+	user.FsConfig.AzBlobConfig.KeyPrefix = "somedir/subdir/"
+	user.FsConfig.AzBlobConfig.UploadPartSize = 5
+	user.FsConfig.AzBlobConfig.UploadConcurrency = 4
+	user.FsConfig.AzBlobConfig.UseEmulator = true
+	user.FsConfig.AzBlobConfig.AccessTier = "Cool"
+	form := make(url.Values)
+	form.Set("username", user.Username)
+	form.Set("home_dir", user.HomeDir)
+	form.Set("uid", "0")
+	form.Set("gid", strconv.FormatInt(int64(user.GID), 10))
+	form.Set("max_sessions", strconv.FormatInt(int64(user.MaxSessions), 10))
+	form.Set("quota_size", strconv.FormatInt(user.QuotaSize, 10))
+	form.Set("quota_files", strconv.FormatInt(int64(user.QuotaFiles), 10))
+	form.Set("upload_bandwidth", "0")
+	form.Set("download_bandwidth", "0")
+	form.Set("permissions", "*")
+	form.Set("sub_dirs_permissions", "")
+	form.Set("status", strconv.Itoa(user.Status))
+	form.Set("expiration_date", "2020-01-01 00:00:00")
+	form.Set("allowed_ip", "")
+	form.Set("denied_ip", "")
+	form.Set("fs_provider", "3")
+	form.Set("az_container", user.FsConfig.AzBlobConfig.Container)
+	form.Set("az_account_name", user.FsConfig.AzBlobConfig.AccountName)
+	form.Set("az_account_key", user.FsConfig.AzBlobConfig.AccountKey.Payload)
+	form.Set("az_sas_url", user.FsConfig.AzBlobConfig.SASURL)
+	form.Set("az_endpoint", user.FsConfig.AzBlobConfig.Endpoint)
+	form.Set("az_key_prefix", user.FsConfig.AzBlobConfig.KeyPrefix)
+	form.Set("az_access_tier", user.FsConfig.AzBlobConfig.AccessTier)
+	form.Set("az_use_emulator", "checked")
+	form.Set("allowed_extensions", "/dir1::.jpg,.png")
+	form.Set("denied_extensions", "/dir2::.zip")
+	// test invalid az_upload_part_size
+	form.Set("az_upload_part_size", "a")
+	b, contentType, _ := getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, webUserPath+"/"+strconv.FormatInt(user.ID, 10), &b)
+	req.Header.Set("Content-Type", contentType)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	// test invalid az_upload_concurrency
+	form.Set("az_upload_part_size", strconv.FormatInt(user.FsConfig.AzBlobConfig.UploadPartSize, 10))
+	form.Set("az_upload_concurrency", "a")
+	b, contentType, _ = getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, webUserPath+"/"+strconv.FormatInt(user.ID, 10), &b)
+	req.Header.Set("Content-Type", contentType)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	// now add the user
+	form.Set("az_upload_concurrency", strconv.Itoa(user.FsConfig.AzBlobConfig.UploadConcurrency))
+	b, contentType, _ = getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, webUserPath+"/"+strconv.FormatInt(user.ID, 10), &b)
+	req.Header.Set("Content-Type", contentType)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusSeeOther, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, userPath+"?limit=1&offset=0&order=ASC&username="+user.Username, nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	var users []dataprovider.User
+	err = render.DecodeJSON(rr.Body, &users)
+	if err != nil {
+		t.Errorf("Error decoding users: %v", err)
+	}
+	if len(users) != 1 {
+		t.Errorf("1 user is expected")
+	}
+	updateUser := users[0]
+	if updateUser.ExpirationDate != 1577836800000 {
+		t.Errorf("invalid expiration date: %v", updateUser.ExpirationDate)
+	}
+	if updateUser.FsConfig.AzBlobConfig.Container != user.FsConfig.AzBlobConfig.Container {
+		t.Error("Azure Blob container mismatch")
+	}
+	if updateUser.FsConfig.AzBlobConfig.AccountName != user.FsConfig.AzBlobConfig.AccountName {
+		t.Error("Azure Blob account name mismatch")
+	}
+	if !updateUser.FsConfig.AzBlobConfig.AccountKey.IsRedacted() {
+		t.Error("Azure Blob account key is not encrypted")
+	}
+	if updateUser.FsConfig.AzBlobConfig.Endpoint != user.FsConfig.AzBlobConfig.Endpoint {
+		t.Error("Azure Blob endpoint mismatch")
+	}
+	if updateUser.FsConfig.AzBlobConfig.KeyPrefix != user.FsConfig.AzBlobConfig.KeyPrefix {
+		t.Error("Azure Blob key prefix mismatch")
+	}
+	if updateUser.FsConfig.AzBlobConfig.UploadPartSize != user.FsConfig.AzBlobConfig.UploadPartSize {
+		t.Error("Azure Blob upload part size mismatch")
+	}
+	if updateUser.FsConfig.AzBlobConfig.UploadConcurrency != user.FsConfig.AzBlobConfig.UploadConcurrency {
+		t.Error("Azure Blob upload concurrency mismatch")
+	}
+	if !updateUser.FsConfig.AzBlobConfig.UseEmulator {
+		t.Error("Azure Blob use emulator mismatch")
+	}
+	if updateUser.FsConfig.AzBlobConfig.AccessTier != user.FsConfig.AzBlobConfig.AccessTier {
+		t.Error("Azure Blob access tier mismatch")
+	}
+	if len(updateUser.Filters.FileExtensions) != 2 {
+		t.Errorf("unexpected extensions filter: %+v", updateUser.Filters.FileExtensions)
+	}
+	req, _ = http.NewRequest(http.MethodDelete, userPath+"/"+strconv.FormatInt(user.ID, 10), nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+}
+
+func TestWebUserSFTPFsMock(t *testing.T) {
+	user := getTestUser()
+	userAsJSON := getUserAsJSON(t, user)
+	req, _ := http.NewRequest(http.MethodPost, userPath, bytes.NewBuffer(userAsJSON))
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	err := render.DecodeJSON(rr.Body, &user)
+	if err != nil {
+		t.Errorf("Error get user: %v", err)
+	}
+	user.FsConfig.Provider = 4
+	user.FsConfig.SFTPConfig.Endpoint = "127.0.0.1:2022"
+	user.FsConfig.SFTPConfig.Username = "remote_user"
+	user.FsConfig.SFTPConfig.Password = kms.NewPlainSecret("remote_password")
+	user.FsConfig.SFTPConfig.PrivateKey = kms.NewPlainSecret("remote private key")
+	user.FsConfig.SFTPConfig.Fingerprints = []string{"SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4",
+		"SHA256:WLpVh1YzXgGWl2dDdTGg1fmqVQKMx5FbzXNOJ6eDdoI"}
+	user.FsConfig.SFTPConfig.Prefix = "/remote/dir"
+	form := make(url.Values)
+	form.Set("username", user.Username)
+	form.Set("home_dir", user.HomeDir)
+	form.Set("uid", "0")
+	form.Set("gid", strconv.FormatInt(int64(user.GID), 10))
+	form.Set("max_sessions", strconv.FormatInt(int64(user.MaxSessions), 10))
+	form.Set("quota_size", strconv.FormatInt(user.QuotaSize, 10))
+	form.Set("quota_files", strconv.FormatInt(int64(user.QuotaFiles), 10))
+	form.Set("upload_bandwidth", "0")
+	form.Set("download_bandwidth", "0")
+	form.Set("permissions", "*")
+	form.Set("sub_dirs_permissions", "")
+	form.Set("status", strconv.Itoa(user.Status))
+	form.Set("expiration_date", "2020-01-01 00:00:00")
+	form.Set("allowed_ip", "")
+	form.Set("denied_ip", "")
+	form.Set("fs_provider", "4")
+	form.Set("sftp_endpoint", user.FsConfig.SFTPConfig.Endpoint)
+	form.Set("sftp_username", user.FsConfig.SFTPConfig.Username)
+	form.Set("sftp_password", user.FsConfig.SFTPConfig.Password.Payload)
+	form.Set("sftp_private_key", user.FsConfig.SFTPConfig.PrivateKey.Payload)
+	form.Set("sftp_fingerprints", strings.Join(user.FsConfig.SFTPConfig.Fingerprints, "\r\n"))
+	form.Set("sftp_prefix", user.FsConfig.SFTPConfig.Prefix)
+	form.Set("crypt_passphrase", "crypt passphrase")
+	form.Set("allowed_extensions", "")
+	form.Set("denied_extensions", "")
+	// test an invalid endpoint
+	form.Set("sftp_endpoint", "127.0.0.1")
+	b, contentType, _ := getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, webUserPath+"/"+strconv.FormatInt(user.ID, 10), &b)
+	req.Header.Set("Content-Type", contentType)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	// now update the user
+	form.Set("sftp_endpoint", user.FsConfig.SFTPConfig.Endpoint)
+	b, contentType, _ = getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, webUserPath+"/"+strconv.FormatInt(user.ID, 10), &b)
+	req.Header.Set("Content-Type", contentType)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusSeeOther, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, userPath+"?limit=1&offset=0&order=ASC&username="+user.Username, nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	var users []dataprovider.User
+	err = render.DecodeJSON(rr.Body, &users)
+	if err != nil {
+		t.Errorf("Error decoding users: %v", err)
+	}
+	if len(users) != 1 {
+		t.Errorf("1 user is expected")
+	}
+	updateUser := users[0]
+	if updateUser.FsConfig.Provider != 4 {
+		t.Error("fs provider mismatch")
+	}
+	if updateUser.FsConfig.SFTPConfig.Endpoint != user.FsConfig.SFTPConfig.Endpoint {
+		t.Error("SFTP endpoint mismatch")
+	}
+	if updateUser.FsConfig.SFTPConfig.Username != user.FsConfig.SFTPConfig.Username {
+		t.Error("SFTP username mismatch")
+	}
+	if !updateUser.FsConfig.SFTPConfig.Password.IsRedacted() {
+		t.Error("SFTP password is not encrypted")
+	}
+	if !updateUser.FsConfig.SFTPConfig.PrivateKey.IsRedacted() {
+		t.Error("SFTP private key is not encrypted")
 	}
-	if updateUser.FsConfig.S3Config.UploadPartSize != user.FsConfig.S3Config.UploadPartSize {
-		t.Error("s3 upload part size mismatch")
+	if !updateUser.FsConfig.CryptConfig.Passphrase.IsRedacted() {
+		t.Error("CryptFs passphrase is not encrypted")
 	}
-	if updateUser.FsConfig.S3Config.UploadConcurrency != user.FsConfig.S3Config.UploadConcurrency {
-		t.Error("s3 upload concurrency mismatch")
+	if len(updateUser.FsConfig.SFTPConfig.Fingerprints) != 2 {
+		t.Errorf("unexpected SFTP fingerprints: %+v", updateUser.FsConfig.SFTPConfig.Fingerprints)
 	}
-	if len(updateUser.Filters.FileExtensions) != 2 {
-		t.Errorf("unexpected extensions filter: %+v", updateUser.Filters.FileExtensions)
+	for _, fp := range user.FsConfig.SFTPConfig.Fingerprints {
+		if !utils.IsStringInSlice(fp, updateUser.FsConfig.SFTPConfig.Fingerprints) {
+			t.Errorf("SFTP fingerprint %#v not found", fp)
+		}
+	}
+	if updateUser.FsConfig.SFTPConfig.Prefix != user.FsConfig.SFTPConfig.Prefix {
+		t.Error("SFTP prefix mismatch")
 	}
 	req, _ = http.NewRequest(http.MethodDelete, userPath+"/"+strconv.FormatInt(user.ID, 10), nil)
 	rr = executeRequest(req)
@@ -2276,12 +4314,511 @@ func TestProviderClosedMock(t *testing.T) {
 	sftpd.SetDataProvider(dataprovider.GetProvider())
 }
 
+func TestBasicAdminHandlingMock(t *testing.T) {
+	admin := getTestAdmin()
+	adminAsJSON, _ := json.Marshal(admin)
+	req, _ := http.NewRequest(http.MethodPost, adminPath, bytes.NewBuffer(adminAsJSON))
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, adminPath, nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, adminPath+"?limit=a", nil)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, adminPath+"?offset=a", nil)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, adminPath+"?order=a", nil)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, adminPath+"?limit=1000&order=DESC", nil)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	req, _ = http.NewRequest(http.MethodPost, adminPath, bytes.NewBuffer([]byte("invalid json")))
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	req, _ = http.NewRequest(http.MethodPut, adminPath+"/"+defaultAdminUsername, bytes.NewBuffer([]byte("invalid json")))
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	admin.Username += "1"
+	adminAsJSON, _ = json.Marshal(admin)
+	req, _ = http.NewRequest(http.MethodPut, adminPath+"/"+defaultAdminUsername, bytes.NewBuffer(adminAsJSON))
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, versionPath, nil)
+	req.SetBasicAuth(defaultAdminUsername, "wrong password")
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, webUsersPath, nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, rr.Code)
+	removeTestAdmin(t)
+}
+
+func TestBasicWebAdminsMock(t *testing.T) {
+	form := make(url.Values)
+	form.Set("username", defaultAdminUsername)
+	form.Set("password", defaultAdminPassword)
+	form.Set("status", "a")
+	form.Add("permissions", dataprovider.PermAdminManageAdmins)
+	form.Add("permissions", dataprovider.PermAdminViewConnections)
+	b, contentType, _ := getMultipartFormData(form, "", "")
+	req, _ := http.NewRequest(http.MethodPost, webAdminPath, &b)
+	req.Header.Set("Content-Type", contentType)
+	rr := executeRequest(req)
+	// invalid status
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	form.Set("status", "1")
+	b, contentType, _ = getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, webAdminPath, &b)
+	req.Header.Set("Content-Type", contentType)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusSeeOther, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, webAdminsPath, nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, webAdminsPath+"?qlimit=a", nil)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, webAdminsPath+"?qlimit=1", nil)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, webAdminPath, nil)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, webAdminPath+"/"+defaultAdminUsername, nil)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, webAdminPath+"/missing", nil)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, rr.Code)
+	// manage_users is not granted
+	req, _ = http.NewRequest(http.MethodGet, webUsersPath, nil)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, webConnectionsPath, nil)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	form.Set("password", "")
+	form.Set("email", "admin@example.com")
+	form.Add("permissions", dataprovider.PermAdminManageUsers)
+	b, contentType, _ = getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, webAdminPath+"/"+defaultAdminUsername, &b)
+	req.Header.Set("Content-Type", contentType)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusSeeOther, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, webUsersPath, nil)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	form.Add("permissions", "invalid")
+	b, contentType, _ = getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, webAdminPath+"/"+defaultAdminUsername, &b)
+	req.Header.Set("Content-Type", contentType)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	b, contentType, _ = getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, webAdminPath+"/missing", &b)
+	req.Header.Set("Content-Type", contentType)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, rr.Code)
+	form.Set("status", "a")
+	b, contentType, _ = getMultipartFormData(form, "", "")
+	req, _ = http.NewRequest(http.MethodPost, webAdminPath+"/"+defaultAdminUsername, &b)
+	req.Header.Set("Content-Type", contentType)
+	req.SetBasicAuth(defaultAdminUsername, defaultAdminPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	admin, err := dataprovider.AdminExists(dataprovider.GetProvider(), defaultAdminUsername)
+	if err != nil {
+		t.Errorf("unable to get admin: %v", err)
+	}
+	if admin.Email != "admin@example.com" || len(admin.Permissions) != 3 {
+		t.Errorf("admin not updated: %+v", admin)
+	}
+	removeTestAdmin(t)
+}
+
 func TestGetWebConnectionsMock(t *testing.T) {
 	req, _ := http.NewRequest(http.MethodGet, webConnectionsPath, nil)
 	rr := executeRequest(req)
 	checkResponseCode(t, http.StatusOK, rr.Code)
 }
 
+func TestWebClientMock(t *testing.T) {
+	u := getTestUser()
+	u.QuotaFiles = 100
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, webClientFilesPath, nil)
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusFound, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, webClientLoginPath, nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	form := make(url.Values)
+	form.Set("username", defaultUsername)
+	form.Set("password", "wrong password")
+	rr = executeClientFormRequest(webClientLoginPath, form, nil)
+	checkResponseCode(t, http.StatusUnauthorized, rr.Code)
+	form.Set("password", defaultPassword)
+	rr = executeClientFormRequest(webClientLoginPath, form, nil)
+	checkResponseCode(t, http.StatusSeeOther, rr.Code)
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("unexpected session cookies: %+v", cookies)
+	}
+	cookie := cookies[0]
+	req, _ = http.NewRequest(http.MethodGet, webClientFilesPath, nil)
+	req.AddCookie(cookie)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	b, contentType, _ := getMultipartFormData(make(url.Values), "files", testFilePath)
+	req, _ = http.NewRequest(http.MethodPost, webClientUploadPath+"?path=%2F", &b)
+	req.Header.Set("Content-Type", contentType)
+	req.AddCookie(cookie)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusSeeOther, rr.Code)
+	users, _, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil || len(users) != 1 {
+		t.Errorf("unable to get user: %v", err)
+	} else if users[0].UsedQuotaFiles != 1 || users[0].UsedQuotaSize != testFileSize {
+		t.Errorf("quota not updated after upload, files: %v size: %v", users[0].UsedQuotaFiles,
+			users[0].UsedQuotaSize)
+	}
+	req, _ = http.NewRequest(http.MethodGet, webClientFilesPath+"?path="+testFileName, nil)
+	req.AddCookie(cookie)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	if int64(rr.Body.Len()) != testFileSize {
+		t.Errorf("unexpected download size: %v", rr.Body.Len())
+	}
+	form = make(url.Values)
+	form.Set("path", "/")
+	form.Set("name", "adir")
+	rr = executeClientFormRequest(webClientMkdirPath, form, cookie)
+	checkResponseCode(t, http.StatusSeeOther, rr.Code)
+	rr = executeClientFormRequest(webClientMkdirPath, form, cookie)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	form.Set("name", "a/dir")
+	rr = executeClientFormRequest(webClientMkdirPath, form, cookie)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	form.Set("name", testFileName)
+	form.Set("target", "../"+testFileName)
+	rr = executeClientFormRequest(webClientRenamePath, form, cookie)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	form.Set("target", testFileName+"_renamed")
+	rr = executeClientFormRequest(webClientRenamePath, form, cookie)
+	checkResponseCode(t, http.StatusSeeOther, rr.Code)
+	form.Set("name", testFileName+"_renamed")
+	rr = executeClientFormRequest(webClientDeletePath, form, cookie)
+	checkResponseCode(t, http.StatusSeeOther, rr.Code)
+	form.Set("name", "adir")
+	rr = executeClientFormRequest(webClientDeletePath, form, cookie)
+	checkResponseCode(t, http.StatusSeeOther, rr.Code)
+	if _, err = os.Stat(filepath.Join(user.HomeDir, "adir")); !os.IsNotExist(err) {
+		t.Errorf("directory must be deleted")
+	}
+	users, _, err = httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil || len(users) != 1 {
+		t.Errorf("unable to get user: %v", err)
+	} else if users[0].UsedQuotaFiles != 0 || users[0].UsedQuotaSize != 0 {
+		t.Errorf("quota not updated after delete, files: %v size: %v", users[0].UsedQuotaFiles,
+			users[0].UsedQuotaSize)
+	}
+	req, _ = http.NewRequest(http.MethodGet, webClientLogoutPath, nil)
+	req.AddCookie(cookie)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusFound, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, webClientFilesPath, nil)
+	req.AddCookie(cookie)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusFound, rr.Code)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	os.Remove(testFilePath)
+}
+
+func TestWebClientPermissionsMock(t *testing.T) {
+	u := getTestUser()
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	form := make(url.Values)
+	form.Set("username", defaultUsername)
+	form.Set("password", defaultPassword)
+	rr := executeClientFormRequest(webClientLoginPath, form, nil)
+	checkResponseCode(t, http.StatusSeeOther, rr.Code)
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("unexpected session cookies: %+v", cookies)
+	}
+	form = make(url.Values)
+	form.Set("path", "/")
+	form.Set("name", "adir")
+	rr = executeClientFormRequest(webClientMkdirPath, form, cookies[0])
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	if !strings.Contains(rr.Body.String(), "Permission denied") {
+		t.Errorf("mkdir without permission must fail")
+	}
+	if _, err = os.Stat(filepath.Join(user.HomeDir, "adir")); !os.IsNotExist(err) {
+		t.Errorf("directory must not be created")
+	}
+	user.Status = 0
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, webClientFilesPath, nil)
+	req.AddCookie(cookies[0])
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusFound, rr.Code)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestShareMock(t *testing.T) {
+	u := getTestUser()
+	u.QuotaFiles = 100
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileName := "test_file.dat"
+	testFileSize := int64(65535)
+	err = createTestFile(filepath.Join(user.GetHomeDir(), "adir", testFileName), testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	share, _, err := httpd.AddShare(dataprovider.Share{
+		Username:  user.Username,
+		Path:      "/adir/" + testFileName,
+		Scope:     dataprovider.ShareScopeRead,
+		Password:  defaultPassword,
+		MaxTokens: 2,
+	}, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add share: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, publicSharePath+"/"+share.ShareID, nil)
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, rr.Code)
+	if len(rr.Header().Get("WWW-Authenticate")) == 0 {
+		t.Errorf("authentication challenge not sent")
+	}
+	req.SetBasicAuth("", defaultPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	if int64(rr.Body.Len()) != testFileSize {
+		t.Errorf("unexpected download size: %v", rr.Body.Len())
+	}
+	b, contentType, _ := getMultipartFormData(make(url.Values), "files",
+		filepath.Join(user.GetHomeDir(), "adir", testFileName))
+	req, _ = http.NewRequest(http.MethodPost, publicSharePath+"/"+share.ShareID, &b)
+	req.Header.Set("Content-Type", contentType)
+	req.SetBasicAuth("", defaultPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, publicSharePath+"/"+share.ShareID, nil)
+	req.SetBasicAuth("", defaultPassword)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	// all the tokens are used now
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, rr.Code)
+	share, _, err = httpd.GetShareByID(share.ShareID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get share: %v", err)
+	}
+	if share.UsedTokens != 2 || share.LastUseAt == 0 {
+		t.Errorf("share usage not updated, used tokens: %v last use: %v", share.UsedTokens, share.LastUseAt)
+	}
+
+	dirShare, _, err := httpd.AddShare(dataprovider.Share{
+		Username: user.Username,
+		Path:     "/adir",
+		Scope:    dataprovider.ShareScopeRead,
+	}, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add share: %v", err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, publicSharePath+"/"+dirShare.ShareID, nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Errorf("unable to read the zip archive: %v", err)
+	} else if len(zr.File) != 2 || zr.File[1].Name != "adir/"+testFileName ||
+		zr.File[1].UncompressedSize64 != uint64(testFileSize) {
+		t.Errorf("unexpected zip archive contents: %+v", zr.File)
+	}
+
+	uploadShare, _, err := httpd.AddShare(dataprovider.Share{
+		Username: user.Username,
+		Path:     "/adir",
+		Scope:    dataprovider.ShareScopeWrite,
+	}, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add share: %v", err)
+	}
+	testFilePath := filepath.Join(homeBasePath, "upload_"+testFileName)
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	b, contentType, _ = getMultipartFormData(make(url.Values), "files", testFilePath)
+	req, _ = http.NewRequest(http.MethodPost, publicSharePath+"/"+uploadShare.ShareID, &b)
+	req.Header.Set("Content-Type", contentType)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, rr.Code)
+	users, _, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil || len(users) != 1 {
+		t.Errorf("unable to get user: %v", err)
+	} else if users[0].UsedQuotaFiles != 1 || users[0].UsedQuotaSize != testFileSize {
+		t.Errorf("quota not updated after upload, files: %v size: %v", users[0].UsedQuotaFiles,
+			users[0].UsedQuotaSize)
+	}
+	if _, err = os.Stat(filepath.Join(user.GetHomeDir(), "adir", "upload_"+testFileName)); err != nil {
+		t.Errorf("uploaded file not found: %v", err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, publicSharePath+"/"+uploadShare.ShareID, nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, publicSharePath+"/missing", nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, rr.Code)
+	user.Status = 0
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, publicSharePath+"/"+dirShare.ShareID, nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, rr.Code)
+	_, err = httpd.RemoveShare(dirShare, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove share: %v", err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	os.Remove(testFilePath)
+}
+
+func TestShareConcurrentUsageMock(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileName := "test_file.dat"
+	err = createTestFile(filepath.Join(user.GetHomeDir(), testFileName), 1024)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	share, _, err := httpd.AddShare(dataprovider.Share{
+		Username:  user.Username,
+		Path:      "/" + testFileName,
+		Scope:     dataprovider.ShareScopeRead,
+		MaxTokens: 3,
+	}, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add share: %v", err)
+	}
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, publicSharePath+"/"+share.ShareID, nil)
+			codes <- executeRequest(req).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	numOK := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			numOK++
+		} else if code != http.StatusNotFound {
+			t.Errorf("unexpected response code: %v", code)
+		}
+	}
+	if numOK != share.MaxTokens {
+		t.Errorf("unexpected number of successful requests: %v", numOK)
+	}
+	share, _, err = httpd.GetShareByID(share.ShareID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get share: %v", err)
+	}
+	if share.UsedTokens != share.MaxTokens {
+		t.Errorf("unexpected used tokens: %v", share.UsedTokens)
+	}
+	err = dataprovider.UpdateShareUsage(dataprovider.GetProvider(), share, 1)
+	if err != dataprovider.ErrShareTokensExhausted {
+		t.Errorf("consuming a token from an exhausted share must fail: %v", err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	err = dataprovider.UpdateShareUsage(dataprovider.GetProvider(), share, 1)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); !ok {
+		t.Errorf("consuming a token from a missing share must fail: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestShareInvalidJsonMock(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, sharePath, bytes.NewBuffer([]byte("invalid json")))
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, sharePath+"?limit=a", nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	req, _ = http.NewRequest(http.MethodGet, sharePath+"?order=a", nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+}
+
 func TestStaticFilesMock(t *testing.T) {
 	req, _ := http.NewRequest(http.MethodGet, "/static/favicon.ico", nil)
 	rr := executeRequest(req)
@@ -2302,6 +4839,32 @@ func waitTCPListening(address string) {
 	}
 }
 
+// getTOTPPasscode returns the RFC 6238 passcode, with the default parameters, for the given time
+func getTOTPPasscode(secret string, t time.Time) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix())/30)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter) //nolint:errcheck
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+func encryptSecret(t *testing.T, plaintext string) kms.Secret {
+	secret := kms.NewPlainSecret(plaintext)
+	if err := secret.Encrypt(); err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	return secret
+}
+
+func decryptSecret(secret kms.Secret) (string, error) {
+	err := secret.Decrypt()
+	return secret.Payload, err
+}
+
 func getTestUser() dataprovider.User {
 	user := dataprovider.User{
 		Username: defaultUsername,
@@ -2314,6 +4877,39 @@ func getTestUser() dataprovider.User {
 	return user
 }
 
+func getTestGroup() dataprovider.Group {
+	return dataprovider.Group{
+		Name:        "test_group",
+		Description: "test group",
+		UserSettings: dataprovider.GroupUserSettings{
+			MaxSessions: 2,
+			QuotaFiles:  10,
+			Permissions: map[string][]string{
+				"/": defaultPerms,
+			},
+		},
+	}
+}
+
+func getTestAdmin() dataprovider.Admin {
+	return dataprovider.Admin{
+		Username:    defaultAdminUsername,
+		Password:    defaultAdminPassword,
+		Status:      1,
+		Permissions: []string{dataprovider.PermAdminAny},
+	}
+}
+
+// removeTestAdmin removes the default test admin directly from the data provider,
+// so authentication is disabled again, and resets the credentials for HTTP requests
+func removeTestAdmin(t *testing.T) {
+	err := dataprovider.DeleteAdmin(dataprovider.GetProvider(), getTestAdmin())
+	if err != nil {
+		t.Errorf("unable to remove admin: %v", err)
+	}
+	httpd.SetBaseURLAndCredentials(httpBaseURL, "", "")
+}
+
 func getUserAsJSON(t *testing.T, user dataprovider.User) []byte {
 	json, err := json.Marshal(user)
 	if err != nil {
@@ -2329,6 +4925,15 @@ func executeRequest(req *http.Request) *httptest.ResponseRecorder {
 	return rr
 }
 
+func executeClientFormRequest(path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	return executeRequest(req)
+}
+
 func checkResponseCode(t *testing.T, expected, actual int) {
 	if expected != actual {
 		t.Errorf("Expected response code %d. Got %d", expected, actual)
@@ -2,6 +2,8 @@ package httpd
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
@@ -10,11 +12,14 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
 
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/vfs"
@@ -105,17 +110,21 @@ func TestCheckUser(t *testing.T) {
 		t.Errorf("Fs providers are not equal")
 	}
 	actual.FsConfig.Provider = 0
-	expected.VirtualFolders = append(expected.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir",
-		MappedPath:  os.TempDir(),
+	expected.VirtualFolders = append(expected.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir",
+			MappedPath:  os.TempDir(),
+		},
 	})
 	err = checkUser(expected, actual)
 	if err == nil {
 		t.Errorf("Virtual folders are not equal")
 	}
-	actual.VirtualFolders = append(actual.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir1",
-		MappedPath:  os.TempDir(),
+	actual.VirtualFolders = append(actual.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir1",
+			MappedPath:  os.TempDir(),
+		},
 	})
 	err = checkUser(expected, actual)
 	if err == nil {
@@ -319,32 +328,40 @@ func TestCompareUserFsConfig(t *testing.T) {
 		t.Errorf("S3 access key does not match")
 	}
 	expected.FsConfig.S3Config.AccessKey = ""
-	actual.FsConfig.S3Config.AccessSecret = "access secret"
+	actual.FsConfig.S3Config.AccessSecret = kms.NewPlainSecret("access secret")
 	err = compareUserFsConfig(expected, actual)
 	if err == nil {
 		t.Errorf("S3 access secret does not match")
 	}
-	secret, _ := utils.EncryptData("access secret")
-	actual.FsConfig.S3Config.AccessSecret = ""
+	secret := kms.NewPlainSecret("access secret")
+	if err = secret.Encrypt(); err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	actual.FsConfig.S3Config.AccessSecret = kms.Secret{}
 	expected.FsConfig.S3Config.AccessSecret = secret
 	err = compareUserFsConfig(expected, actual)
 	if err == nil {
 		t.Errorf("S3 access secret does not match")
 	}
-	expected.FsConfig.S3Config.AccessSecret = utils.RemoveDecryptionKey(secret)
-	actual.FsConfig.S3Config.AccessSecret = utils.RemoveDecryptionKey(secret) + "a"
+	actual.FsConfig.S3Config.AccessSecret = secret
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("S3 access secret must be redacted")
+	}
+	actual.FsConfig.S3Config.AccessSecret = secret.Redacted()
+	actual.FsConfig.S3Config.AccessSecret.KeyID += "a"
 	err = compareUserFsConfig(expected, actual)
 	if err == nil {
 		t.Errorf("S3 access secret does not match")
 	}
-	expected.FsConfig.S3Config.AccessSecret = "test"
-	actual.FsConfig.S3Config.AccessSecret = ""
+	expected.FsConfig.S3Config.AccessSecret = kms.NewPlainSecret("test")
+	actual.FsConfig.S3Config.AccessSecret = kms.Secret{}
 	err = compareUserFsConfig(expected, actual)
 	if err == nil {
 		t.Errorf("S3 access secret does not match")
 	}
-	expected.FsConfig.S3Config.AccessSecret = ""
-	actual.FsConfig.S3Config.AccessSecret = ""
+	expected.FsConfig.S3Config.AccessSecret = kms.Secret{}
+	actual.FsConfig.S3Config.AccessSecret = kms.Secret{}
 	expected.FsConfig.S3Config.Endpoint = "http://127.0.0.1:9000/"
 	err = compareUserFsConfig(expected, actual)
 	if err == nil {
@@ -405,6 +422,132 @@ func TestCompareUserGCSConfig(t *testing.T) {
 	expected.FsConfig.GCSConfig.AutomaticCredentials = 0
 }
 
+func TestCompareUserAzBlobConfig(t *testing.T) {
+	expected := &dataprovider.User{}
+	actual := &dataprovider.User{}
+	expected.FsConfig.AzBlobConfig.Container = "a"
+	err := compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob container does not match")
+	}
+	expected.FsConfig.AzBlobConfig.Container = ""
+	expected.FsConfig.AzBlobConfig.AccountName = "name"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob account name does not match")
+	}
+	expected.FsConfig.AzBlobConfig.AccountName = ""
+	expected.FsConfig.AzBlobConfig.AccountKey = kms.NewPlainSecret("key")
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob account key does not match")
+	}
+	expected.FsConfig.AzBlobConfig.AccountKey = kms.Secret{}
+	expected.FsConfig.AzBlobConfig.Endpoint = "endpoint"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob endpoint does not match")
+	}
+	expected.FsConfig.AzBlobConfig.Endpoint = ""
+	expected.FsConfig.AzBlobConfig.SASURL = "url"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob SAS URL does not match")
+	}
+	expected.FsConfig.AzBlobConfig.SASURL = ""
+	expected.FsConfig.AzBlobConfig.UploadPartSize = 1
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob upload part size does not match")
+	}
+	expected.FsConfig.AzBlobConfig.UploadPartSize = 0
+	expected.FsConfig.AzBlobConfig.UploadConcurrency = 1
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob upload concurrency does not match")
+	}
+	expected.FsConfig.AzBlobConfig.UploadConcurrency = 0
+	expected.FsConfig.AzBlobConfig.UseEmulator = true
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob use emulator does not match")
+	}
+	expected.FsConfig.AzBlobConfig.UseEmulator = false
+	expected.FsConfig.AzBlobConfig.AccessTier = "Hot"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob access tier does not match")
+	}
+	expected.FsConfig.AzBlobConfig.AccessTier = ""
+	expected.FsConfig.AzBlobConfig.KeyPrefix = "somedir/subdir"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("Azure Blob key prefix does not match")
+	}
+	expected.FsConfig.AzBlobConfig.KeyPrefix = ""
+	err = compareUserFsConfig(expected, actual)
+	if err != nil {
+		t.Errorf("Azure Blob config must match: %v", err)
+	}
+}
+
+func TestCompareUserSFTPFsConfig(t *testing.T) {
+	expected := &dataprovider.User{}
+	actual := &dataprovider.User{}
+	expected.FsConfig.SFTPConfig.Endpoint = "127.0.0.1:22"
+	err := compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTPFs endpoint does not match")
+	}
+	expected.FsConfig.SFTPConfig.Endpoint = ""
+	expected.FsConfig.SFTPConfig.Username = "user"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTPFs username does not match")
+	}
+	expected.FsConfig.SFTPConfig.Username = ""
+	expected.FsConfig.SFTPConfig.Password = kms.NewPlainSecret("password")
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTPFs password does not match")
+	}
+	expected.FsConfig.SFTPConfig.Password = kms.Secret{}
+	expected.FsConfig.SFTPConfig.PrivateKey = kms.NewPlainSecret("key")
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTPFs private key does not match")
+	}
+	expected.FsConfig.SFTPConfig.PrivateKey = kms.Secret{}
+	expected.FsConfig.SFTPConfig.Fingerprints = []string{"SHA256:fp1"}
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTPFs fingerprints do not match")
+	}
+	actual.FsConfig.SFTPConfig.Fingerprints = []string{"SHA256:fp2"}
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTPFs fingerprints do not match")
+	}
+	expected.FsConfig.SFTPConfig.Fingerprints = nil
+	actual.FsConfig.SFTPConfig.Fingerprints = nil
+	expected.FsConfig.SFTPConfig.Prefix = "/dir"
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("SFTPFs prefix does not match")
+	}
+	actual.FsConfig.SFTPConfig.Prefix = "/dir"
+	expected.FsConfig.SFTPConfig.Prefix = "/dir/"
+	err = compareUserFsConfig(expected, actual)
+	if err != nil {
+		t.Errorf("SFTPFs config must match: %v", err)
+	}
+	expected.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("passphrase")
+	err = compareUserFsConfig(expected, actual)
+	if err == nil {
+		t.Errorf("CryptFs passphrase does not match")
+	}
+}
+
 func TestGCSWebInvalidFormFile(t *testing.T) {
 	form := make(url.Values)
 	form.Set("username", "test_username")
@@ -517,9 +660,21 @@ func TestBasicAuth(t *testing.T) {
 	oldAuthPassword := authPassword
 	authUserFile := filepath.Join(os.TempDir(), "http_users.txt")
 	authUserData := []byte("test1:$2y$05$bcHSED7aO1cfLto6ZdDBOOKzlwftslVhtpIkRhAtSa4GuLmk5mola\n")
+	authUserData = append(authUserData, []byte("test2:$apr1$gLnIkRIf$Xr/6aJfmIrihP4b2N2tcs/\n")...)
+	authUserData = append(authUserData, []byte("test3:$apr1$gLnIkRIf$Xr/6$aJfmIr$ihP4b2N2tcs/\n")...)
 	ioutil.WriteFile(authUserFile, authUserData, 0666)
-	httpAuth, _ = newBasicAuthProvider(authUserFile)
-	_, _, err := GetVersion(http.StatusUnauthorized)
+	err := importAuthUserFile(authUserFile)
+	if err != nil {
+		t.Errorf("unable to import auth user file: %v", err)
+	}
+	admins, err := dataprovider.DumpAdmins(dataProvider)
+	if err != nil {
+		t.Errorf("unable to dump admins: %v", err)
+	}
+	if len(admins) != 3 {
+		t.Errorf("unexpected number of imported admins: %v", len(admins))
+	}
+	_, _, err = GetVersion(http.StatusUnauthorized)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -534,8 +689,6 @@ func TestBasicAuth(t *testing.T) {
 	if resp.StatusCode != http.StatusUnauthorized {
 		t.Errorf("request with wrong password must fail, status code: %v", resp.StatusCode)
 	}
-	authUserData = append(authUserData, []byte("test2:$apr1$gLnIkRIf$Xr/6aJfmIrihP4b2N2tcs/\n")...)
-	ioutil.WriteFile(authUserFile, authUserData, 0666)
 	SetBaseURLAndCredentials(httpBaseURL, "test2", "password2")
 	_, _, err = GetVersion(http.StatusOK)
 	if err != nil {
@@ -546,42 +699,89 @@ func TestBasicAuth(t *testing.T) {
 	if err == nil {
 		t.Error("request with wrong password must fail")
 	}
-	authUserData = append(authUserData, []byte("test3:$apr1$gLnIkRIf$Xr/6$aJfmIr$ihP4b2N2tcs/\n")...)
-	ioutil.WriteFile(authUserFile, authUserData, 0666)
-	SetBaseURLAndCredentials(httpBaseURL, "test3", "wrong_password")
+	SetBaseURLAndCredentials(httpBaseURL, "test3", "password2")
 	_, _, err = GetVersion(http.StatusUnauthorized)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	authUserData = append(authUserData, []byte("test4:$invalid$gLnIkRIf$Xr/6$aJfmIr$ihP4b2N2tcs/\n")...)
+	// admins are already defined, the file must be ignored
+	authUserData = append(authUserData, []byte("test4:$apr1$gLnIkRIf$Xr/6aJfmIrihP4b2N2tcs/\n")...)
 	ioutil.WriteFile(authUserFile, authUserData, 0666)
-	SetBaseURLAndCredentials(httpBaseURL, "test3", "password2")
+	err = importAuthUserFile(authUserFile)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	SetBaseURLAndCredentials(httpBaseURL, "test4", "password2")
 	_, _, err = GetVersion(http.StatusUnauthorized)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	if runtime.GOOS != "windows" {
-		authUserData = append(authUserData, []byte("test5:$apr1$gLnIkRIf$Xr/6aJfmIrihP4b2N2tcs/\n")...)
-		ioutil.WriteFile(authUserFile, authUserData, 0666)
-		os.Chmod(authUserFile, 0001)
-		SetBaseURLAndCredentials(httpBaseURL, "test5", "password2")
-		_, _, err = GetVersion(http.StatusUnauthorized)
+	for _, admin := range admins {
+		err = dataprovider.DeleteAdmin(dataProvider, admin)
 		if err != nil {
-			t.Errorf("unexpected error: %v", err)
+			t.Errorf("unable to delete admin: %v", err)
 		}
-		os.Chmod(authUserFile, 0666)
-
 	}
 	authUserData = append(authUserData, []byte("\"foo\"bar\"\r\n")...)
 	ioutil.WriteFile(authUserFile, authUserData, 0666)
-	SetBaseURLAndCredentials(httpBaseURL, "test2", "password2")
-	_, _, err = GetVersion(http.StatusUnauthorized)
-	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+	err = importAuthUserFile(authUserFile)
+	if err == nil {
+		t.Error("import of an invalid auth user file must fail")
 	}
 	os.Remove(authUserFile)
+	err = importAuthUserFile(authUserFile)
+	if err == nil {
+		t.Error("import of a missing auth user file must fail")
+	}
 	SetBaseURLAndCredentials(httpBaseURL, oldAuthUsername, oldAuthPassword)
-	httpAuth, _ = newBasicAuthProvider("")
+	_, _, err = GetVersion(http.StatusOK)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAdminPermissions(t *testing.T) {
+	admin := dataprovider.Admin{
+		Permissions: []string{dataprovider.PermAdminViewConnections, dataprovider.PermAdminQuotaScans},
+	}
+	if !admin.HasPermission(dataprovider.PermAdminViewConnections) {
+		t.Error("view connections permission must be granted")
+	}
+	if admin.HasPermission(dataprovider.PermAdminManageUsers) {
+		t.Error("manage users permission must not be granted")
+	}
+	handler := checkPerm(dataprovider.PermAdminManageUsers)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	req, _ := http.NewRequest(http.MethodGet, userPath, nil)
+	req = req.WithContext(context.WithValue(req.Context(), adminContextKey, admin))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected response code 403. Got %d", rr.Code)
+	}
+	req, _ = http.NewRequest(http.MethodGet, webUsersPath, nil)
+	req = req.WithContext(context.WithValue(req.Context(), adminContextKey, admin))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected response code 403. Got %d", rr.Code)
+	}
+	// no admin in the request context
+	req, _ = http.NewRequest(http.MethodGet, userPath, nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected response code 403. Got %d", rr.Code)
+	}
+	admin.Permissions = append(admin.Permissions, dataprovider.PermAdminAny)
+	req, _ = http.NewRequest(http.MethodPost, userPath, nil)
+	req = req.WithContext(context.WithValue(req.Context(), adminContextKey, admin))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected response code 200. Got %d", rr.Code)
+	}
 }
 
 func TestCloseConnectionHandler(t *testing.T) {
@@ -624,3 +824,322 @@ func TestQuotaScanInvalidFs(t *testing.T) {
 		t.Error("quota scan with bad fs must fail")
 	}
 }
+
+func TestClientSessions(t *testing.T) {
+	token, err := clientSessions.add("user")
+	if err != nil {
+		t.Errorf("unable to add session: %v", err)
+	}
+	username, ok := clientSessions.get(token)
+	if !ok || username != "user" {
+		t.Errorf("unexpected session username: %#v", username)
+	}
+	clientSessions.Lock()
+	session := clientSessions.sessions[token]
+	session.expiration = time.Now().Add(-1 * time.Minute)
+	clientSessions.sessions[token] = session
+	clientSessions.Unlock()
+	_, ok = clientSessions.get(token)
+	if ok {
+		t.Errorf("expired session must not be valid")
+	}
+	token, err = clientSessions.add("user")
+	if err != nil {
+		t.Errorf("unable to add session: %v", err)
+	}
+	clientSessions.remove(token)
+	_, ok = clientSessions.get(token)
+	if ok {
+		t.Errorf("removed session must not be valid")
+	}
+	req, _ := http.NewRequest(http.MethodGet, webClientFilesPath, nil)
+	_, err = getClientSessionUser(req)
+	if err != errClientSessionNotFound {
+		t.Errorf("unexpected error for a request without session: %v", err)
+	}
+	req.AddCookie(&http.Cookie{Name: clientSessionCookie, Value: "invalid"})
+	_, err = getClientSessionUser(req)
+	if err != errClientSessionNotFound {
+		t.Errorf("unexpected error for an invalid session: %v", err)
+	}
+}
+
+func TestClientTransferAdapters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &transferReader{ctx: ctx, reader: strings.NewReader("data")}
+	b := make([]byte, 2)
+	n, err := reader.Read(b)
+	if err != nil || n != 2 || reader.offset != 2 {
+		t.Errorf("unexpected read result n: %v err: %v", n, err)
+	}
+	file, err := ioutil.TempFile("", "webclient")
+	if err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	writer := &transferWriter{ctx: ctx, writer: file}
+	n, err = writer.Write(b)
+	if err != nil || n != 2 || writer.offset != 2 {
+		t.Errorf("unexpected write result n: %v err: %v", n, err)
+	}
+	cancel()
+	_, err = reader.Read(b)
+	if err != context.Canceled {
+		t.Errorf("read after cancel must fail: %v", err)
+	}
+	_, err = writer.Write(b)
+	if err != context.Canceled {
+		t.Errorf("write after cancel must fail: %v", err)
+	}
+}
+
+func TestClientErrorMessage(t *testing.T) {
+	if getClientErrorMessage(sftp.ErrSSHFxPermissionDenied) != "Permission denied" {
+		t.Errorf("unexpected error message for permission denied")
+	}
+	if getClientErrorMessage(sftp.ErrSSHFxNoSuchFile) != "No such file or directory" {
+		t.Errorf("unexpected error message for missing files")
+	}
+	err := errors.New("custom error")
+	if getClientErrorMessage(err) != err.Error() {
+		t.Errorf("unexpected error message for a custom error")
+	}
+	if getClientFilesURL("/a dir") != webClientFilesPath+"?path=%2Fa+dir" {
+		t.Errorf("unexpected files URL: %v", getClientFilesURL("/a dir"))
+	}
+}
+
+func TestShareErrorStatus(t *testing.T) {
+	if getShareErrorStatus(sftp.ErrSSHFxNoSuchFile) != http.StatusNotFound {
+		t.Errorf("unexpected status code for missing files")
+	}
+	if getShareErrorStatus(sftp.ErrSSHFxPermissionDenied) != http.StatusForbidden {
+		t.Errorf("unexpected status code for permission denied")
+	}
+	if getShareErrorStatus(errors.New("custom error")) != http.StatusInternalServerError {
+		t.Errorf("unexpected status code for a custom error")
+	}
+}
+
+func TestShareUsable(t *testing.T) {
+	share := dataprovider.Share{
+		ShareID:   "id",
+		ExpiresAt: utils.GetTimeAsMsSinceEpoch(time.Now().Add(-1 * time.Minute)),
+	}
+	if share.IsUsable() == nil {
+		t.Errorf("expired share must not be usable")
+	}
+	share.ExpiresAt = 0
+	share.MaxTokens = 1
+	share.UsedTokens = 1
+	if share.IsUsable() == nil {
+		t.Errorf("share without available tokens must not be usable")
+	}
+	share.UsedTokens = 0
+	if err := share.IsUsable(); err != nil {
+		t.Errorf("share must be usable: %v", err)
+	}
+	match, err := share.CheckPassword("")
+	if err != nil || !match {
+		t.Errorf("share without password must match any password")
+	}
+	share.Password = "$2a$10$invalid"
+	match, _ = share.CheckPassword("pwd")
+	if match {
+		t.Errorf("invalid bcrypt hash must not match")
+	}
+}
+
+func TestJWTValidation(t *testing.T) {
+	admin := dataprovider.Admin{
+		Username: "admin",
+	}
+	savedKey := jwtSigningKey
+	jwtSigningKey = nil
+	_, _, err := createJWT(admin)
+	if err == nil {
+		t.Error("creating a token without a signing key must fail")
+	}
+	_, err = parseJWT("a.b.c")
+	if err == nil {
+		t.Error("parsing a token without a signing key must fail")
+	}
+	err = initializeJWTSigningKey()
+	if err != nil {
+		t.Errorf("unable to initialize the signing key: %v", err)
+	}
+	token, expiration, err := createJWT(admin)
+	if err != nil {
+		t.Errorf("unable to create token: %v", err)
+	}
+	if !expiration.After(time.Now()) {
+		t.Errorf("unexpected token expiration: %v", expiration)
+	}
+	claims, err := parseJWT(token)
+	if err != nil {
+		t.Errorf("unable to parse token: %v", err)
+	}
+	if claims.Subject != admin.Username {
+		t.Errorf("unexpected token subject: %#v", claims.Subject)
+	}
+	_, err = parseJWT("malformed")
+	if err == nil {
+		t.Error("parsing a malformed token must fail")
+	}
+	parts := strings.Split(token, ".")
+	_, err = parseJWT("invalid." + parts[1] + "." + parts[2])
+	if err == nil {
+		t.Error("parsing a token with an invalid header must fail")
+	}
+	header, _ := encodeJWTSegment(jwtHeader{Algorithm: "none", Type: "JWT"})
+	_, err = parseJWT(header + "." + parts[1] + ".")
+	if err == nil {
+		t.Error("parsing a token with an unsupported algorithm must fail")
+	}
+	_, err = parseJWT(parts[0] + "." + parts[1] + "." + parts[2] + "a")
+	if err == nil {
+		t.Error("parsing a token with an invalid signature must fail")
+	}
+	payload, _ := encodeJWTSegment(jwtClaims{
+		Issuer:    tokenIssuer,
+		Subject:   admin.Username,
+		ExpiresAt: time.Now().Add(-1 * time.Minute).Unix(),
+	})
+	_, err = parseJWT(parts[0] + "." + payload + "." + signJWTPayload(parts[0]+"."+payload))
+	if err == nil {
+		t.Error("parsing an expired token must fail")
+	}
+	payload, _ = encodeJWTSegment(jwtClaims{
+		Issuer:    "invalid",
+		Subject:   admin.Username,
+		ExpiresAt: time.Now().Add(1 * time.Minute).Unix(),
+	})
+	_, err = parseJWT(parts[0] + "." + payload + "." + signJWTPayload(parts[0]+"."+payload))
+	if err == nil {
+		t.Error("parsing a token with an invalid issuer must fail")
+	}
+	invalidPayload := base64.RawURLEncoding.EncodeToString([]byte("invalid"))
+	_, err = parseJWT(parts[0] + "." + invalidPayload + "." + signJWTPayload(parts[0]+"."+invalidPayload))
+	if err == nil {
+		t.Error("parsing a token with invalid claims must fail")
+	}
+	jwtSigningKey = savedKey
+}
+
+func TestAuthMethodRestriction(t *testing.T) {
+	handler := checkAuthMethod(authMethodPassword)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	req, _ := http.NewRequest(http.MethodGet, tokenPath, nil)
+	ctx := context.WithValue(req.Context(), authMethodContextKey, authMethodAPIKey)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req.WithContext(ctx))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("unexpected status code: %v", rr.Code)
+	}
+	ctx = context.WithValue(req.Context(), authMethodContextKey, authMethodPassword)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req.WithContext(ctx))
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected status code: %v", rr.Code)
+	}
+}
+
+func TestIPLists(t *testing.T) {
+	listFile := filepath.Join(os.TempDir(), "deny_list.txt")
+	err := ioutil.WriteFile(listFile, []byte("# networks to deny\n\n10.8.0.0/16\n"), 0666)
+	if err != nil {
+		t.Fatalf("unable to write IP list file: %v", err)
+	}
+	err = utils.InitializeIPLists(utils.IPListsConfig{
+		AllowList:    []string{"192.168.5.5", "10.8.1.0/24"},
+		DenyList:     []string{"192.168.5.0/24", "2001:db8::1"},
+		DenyListFile: listFile,
+	}, os.TempDir())
+	if err != nil {
+		t.Errorf("unable to initialize IP lists: %v", err)
+	}
+	handler := checkDenyList(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for addr, expectedStatus := range map[string]int{
+		"192.168.5.1:1234":  http.StatusForbidden,
+		"192.168.5.5:1234":  http.StatusOK,
+		"192.168.6.1:1234":  http.StatusOK,
+		"10.8.2.1:1234":     http.StatusForbidden,
+		"10.8.1.1:1234":     http.StatusOK,
+		"[2001:db8::1]:123": http.StatusForbidden,
+		"[2001:db8::2]:123": http.StatusOK,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, versionPath, nil)
+		req.RemoteAddr = addr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != expectedStatus {
+			t.Errorf("unexpected status for remote address %v: %v, expected: %v", addr, rr.Code, expectedStatus)
+		}
+	}
+	// the deny list cannot be bypassed using a spoofed client IP header
+	for _, header := range []string{"X-Forwarded-For", "X-Real-IP"} {
+		req, _ := http.NewRequest(http.MethodGet, versionPath, nil)
+		req.RemoteAddr = "192.168.5.1:1234"
+		req.Header.Set(header, "192.168.6.1")
+		rr := httptest.NewRecorder()
+		GetHTTPRouter().ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status with a spoofed %v header: %v", header, rr.Code)
+		}
+	}
+	if !utils.IsIPAllowListed("10.8.1.2") || utils.IsIPAllowListed("10.8.2.2") {
+		t.Errorf("unexpected allow list result")
+	}
+	// reload the file with an updated deny list
+	err = ioutil.WriteFile(listFile, []byte("10.9.0.0/16\n"), 0666)
+	if err != nil {
+		t.Errorf("unable to write IP list file: %v", err)
+	}
+	err = utils.ReloadIPLists()
+	if err != nil {
+		t.Errorf("unable to reload IP lists: %v", err)
+	}
+	if utils.IsIPDenyListed("10.8.2.1") || !utils.IsIPDenyListed("10.9.2.1") {
+		t.Errorf("the reloaded deny list is not applied")
+	}
+	// an invalid file must not change the loaded lists
+	err = ioutil.WriteFile(listFile, []byte("invalid entry\n"), 0666)
+	if err != nil {
+		t.Errorf("unable to write IP list file: %v", err)
+	}
+	err = utils.ReloadIPLists()
+	if err == nil {
+		t.Errorf("reloading an invalid IP list must fail")
+	}
+	if !utils.IsIPDenyListed("10.9.2.1") {
+		t.Errorf("the current lists must be kept if the reload fails")
+	}
+	os.Remove(listFile)
+	err = utils.ReloadIPLists()
+	if err == nil {
+		t.Errorf("reloading a missing IP list file must fail")
+	}
+	err = utils.InitializeIPLists(utils.IPListsConfig{
+		AllowList: []string{"invalid"},
+	}, os.TempDir())
+	if err == nil {
+		t.Errorf("initializing IP lists with invalid entries must fail")
+	}
+	err = utils.InitializeIPLists(utils.IPListsConfig{
+		DenyList: []string{"10.0.0.0/33"},
+	}, os.TempDir())
+	if err == nil {
+		t.Errorf("initializing IP lists with invalid networks must fail")
+	}
+	err = utils.InitializeIPLists(utils.IPListsConfig{}, os.TempDir())
+	if err != nil {
+		t.Errorf("unable to reset IP lists: %v", err)
+	}
+	if utils.IsIPDenyListed("10.9.2.1") || utils.IsIPDenyListed("invalid") || utils.IsIPAllowListed("invalid") {
+		t.Errorf("unexpected IP lists result after reset")
+	}
+}
@@ -0,0 +1,140 @@
+package httpd
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+)
+
+const (
+	tokenDuration = 20 * time.Minute
+	tokenIssuer   = "SFTPGo"
+)
+
+// the signing key is generated at startup, so the issued tokens are
+// invalidated each time the service restarts
+var jwtSigningKey []byte
+
+// tokenResponse is the response of the token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresAt   string `json:"expires_at"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+}
+
+// jwtClaims defines the claims included in the issued tokens.
+// The admin permissions are not included, they are read from the data provider
+// on each request, so permissions changes are effective immediately
+type jwtClaims struct {
+	ID        string `json:"jti"`
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func initializeJWTSigningKey() error {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	jwtSigningKey = key
+	return nil
+}
+
+func signJWTPayload(payload string) string {
+	mac := hmac.New(sha256.New, jwtSigningKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func encodeJWTSegment(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// createJWT returns a signed HS256 token for the given admin and its expiration time
+func createJWT(admin dataprovider.Admin) (string, time.Time, error) {
+	now := time.Now()
+	expiration := now.Add(tokenDuration)
+	if len(jwtSigningKey) == 0 {
+		return "", expiration, errors.New("token signing key not initialized")
+	}
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", expiration, err
+	}
+	header, err := encodeJWTSegment(jwtHeader{Algorithm: "HS256", Type: "JWT"})
+	if err != nil {
+		return "", expiration, err
+	}
+	claims, err := encodeJWTSegment(jwtClaims{
+		ID:        hex.EncodeToString(id),
+		Issuer:    tokenIssuer,
+		Subject:   admin.Username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiration.Unix(),
+	})
+	if err != nil {
+		return "", expiration, err
+	}
+	payload := header + "." + claims
+	return payload + "." + signJWTPayload(payload), expiration, nil
+}
+
+// parseJWT verifies the signature and the expiration of the given token and returns its claims
+func parseJWT(token string) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed token")
+	}
+	if len(jwtSigningKey) == 0 {
+		return claims, errors.New("token signing key not initialized")
+	}
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return claims, fmt.Errorf("invalid token header: %v", err)
+	}
+	if header.Algorithm != "HS256" {
+		return claims, fmt.Errorf("unsupported token algorithm: %#v", header.Algorithm)
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(signJWTPayload(parts[0]+"."+parts[1]))) {
+		return claims, errors.New("invalid token signature")
+	}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return claims, fmt.Errorf("invalid token claims: %v", err)
+	}
+	if claims.Issuer != tokenIssuer || len(claims.Subject) == 0 {
+		return claims, errors.New("invalid token claims")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errors.New("token is expired")
+	}
+	return claims, nil
+}
@@ -3,6 +3,7 @@ package httpd
 import (
 	"net/http"
 
+	"github.com/drakkan/sftpgo/backup"
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/sftpd"
@@ -21,6 +22,10 @@ func GetHTTPRouter() http.Handler {
 func initializeRouter(staticFilesPath string, profiler bool) {
 	router = chi.NewRouter()
 	router.Use(middleware.RequestID)
+	// the deny list must be checked against the connection address, RealIP
+	// replaces it with the value of headers that clients can set freely
+	router.Use(checkDenyList)
+	router.Use(saveConnectionAddress)
 	router.Use(middleware.RealIP)
 	router.Use(logger.NewStructuredLogger(logger.GetLogger()))
 	router.Use(middleware.Recoverer)
@@ -50,7 +55,7 @@ func initializeRouter(staticFilesPath string, profiler bool) {
 			http.Redirect(w, r, webUsersPath, http.StatusMovedPermanently)
 		})
 
-		router.Handle(metricsPath, promhttp.Handler())
+		router.With(checkPerm(dataprovider.PermAdminViewMetrics)).Handle(metricsPath, promhttp.Handler())
 
 		router.Get(versionPath, func(w http.ResponseWriter, r *http.Request) {
 			render.JSON(w, r, utils.GetAppVersion())
@@ -65,75 +70,287 @@ func initializeRouter(staticFilesPath string, profiler bool) {
 			}
 		})
 
-		router.Get(activeConnectionsPath, func(w http.ResponseWriter, r *http.Request) {
-			render.JSON(w, r, sftpd.GetConnectionsStats())
-		})
+		router.With(checkAuthMethod(authMethodPassword, authMethodNone)).Get(tokenPath,
+			func(w http.ResponseWriter, r *http.Request) {
+				getToken(w, r)
+			})
 
-		router.Delete(activeConnectionsPath+"/{connectionID}", func(w http.ResponseWriter, r *http.Request) {
-			handleCloseConnection(w, r)
-		})
+		router.Group(func(router chi.Router) {
+			// API keys cannot be used to create or revoke other API keys
+			router.Use(checkAuthMethod(authMethodPassword, authMethodToken, authMethodNone))
 
-		router.Get(quotaScanPath, func(w http.ResponseWriter, r *http.Request) {
-			getQuotaScans(w, r)
-		})
+			router.Get(apiKeyPath, func(w http.ResponseWriter, r *http.Request) {
+				getAPIKeys(w, r)
+			})
 
-		router.Post(quotaScanPath, func(w http.ResponseWriter, r *http.Request) {
-			startQuotaScan(w, r)
-		})
+			router.Post(apiKeyPath, func(w http.ResponseWriter, r *http.Request) {
+				addAPIKey(w, r)
+			})
 
-		router.Get(userPath, func(w http.ResponseWriter, r *http.Request) {
-			getUsers(w, r)
-		})
+			router.Get(apiKeyPath+"/{keyID}", func(w http.ResponseWriter, r *http.Request) {
+				getAPIKeyByID(w, r)
+			})
 
-		router.Post(userPath, func(w http.ResponseWriter, r *http.Request) {
-			addUser(w, r)
+			router.Delete(apiKeyPath+"/{keyID}", func(w http.ResponseWriter, r *http.Request) {
+				deleteAPIKey(w, r)
+			})
 		})
 
-		router.Get(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
-			getUserByID(w, r)
-		})
+		router.With(checkPerm(dataprovider.PermAdminViewConnections)).Get(activeConnectionsPath,
+			func(w http.ResponseWriter, r *http.Request) {
+				render.JSON(w, r, sftpd.GetConnectionsStats())
+			})
 
-		router.Put(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
-			updateUser(w, r)
-		})
+		router.With(checkPerm(dataprovider.PermAdminViewConnections)).Get(connectionsStatsPath,
+			func(w http.ResponseWriter, r *http.Request) {
+				render.JSON(w, r, sftpd.GetNetConnectionsStatus())
+			})
 
-		router.Delete(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
-			deleteUser(w, r)
+		router.With(checkPerm(dataprovider.PermAdminCloseConnections)).Delete(activeConnectionsPath+"/{connectionID}",
+			func(w http.ResponseWriter, r *http.Request) {
+				handleCloseConnection(w, r)
+			})
+
+		router.With(checkPerm(dataprovider.PermAdminQuotaScans)).Get(quotaScanPath,
+			func(w http.ResponseWriter, r *http.Request) {
+				getQuotaScans(w, r)
+			})
+
+		router.With(checkPerm(dataprovider.PermAdminQuotaScans)).Post(quotaScanPath,
+			func(w http.ResponseWriter, r *http.Request) {
+				startQuotaScan(w, r)
+			})
+
+		router.Group(func(router chi.Router) {
+			router.Use(checkPerm(dataprovider.PermAdminManageUsers))
+
+			router.Get(userPath, func(w http.ResponseWriter, r *http.Request) {
+				getUsers(w, r)
+			})
+
+			router.Post(userPath, func(w http.ResponseWriter, r *http.Request) {
+				addUser(w, r)
+			})
+
+			router.Get(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
+				getUserByID(w, r)
+			})
+
+			router.Put(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
+				updateUser(w, r)
+			})
+
+			router.Delete(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
+				deleteUser(w, r)
+			})
+
+			router.Post(userPath+"/{userID}/totp/generate", func(w http.ResponseWriter, r *http.Request) {
+				generateUserTOTPSecret(w, r)
+			})
+
+			router.Post(userPath+"/{userID}/totp/validate", func(w http.ResponseWriter, r *http.Request) {
+				enableUserTOTP(w, r)
+			})
+
+			router.Delete(userPath+"/{userID}/totp", func(w http.ResponseWriter, r *http.Request) {
+				disableUserTOTP(w, r)
+			})
+
+			router.Get(groupPath, func(w http.ResponseWriter, r *http.Request) {
+				getGroups(w, r)
+			})
+
+			router.Post(groupPath, func(w http.ResponseWriter, r *http.Request) {
+				addGroup(w, r)
+			})
+
+			router.Get(groupPath+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+				getGroupByName(w, r)
+			})
+
+			router.Put(groupPath+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+				updateGroup(w, r)
+			})
+
+			router.Delete(groupPath+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+				deleteGroup(w, r)
+			})
+
+			router.Get(sharePath, func(w http.ResponseWriter, r *http.Request) {
+				getShares(w, r)
+			})
+
+			router.Post(sharePath, func(w http.ResponseWriter, r *http.Request) {
+				addShare(w, r)
+			})
+
+			router.Get(sharePath+"/{shareID}", func(w http.ResponseWriter, r *http.Request) {
+				getShareByID(w, r)
+			})
+
+			router.Put(sharePath+"/{shareID}", func(w http.ResponseWriter, r *http.Request) {
+				updateShare(w, r)
+			})
+
+			router.Delete(sharePath+"/{shareID}", func(w http.ResponseWriter, r *http.Request) {
+				deleteShare(w, r)
+			})
+
+			router.Get(webUsersPath, func(w http.ResponseWriter, r *http.Request) {
+				handleGetWebUsers(w, r)
+			})
+
+			router.Get(webUserPath, func(w http.ResponseWriter, r *http.Request) {
+				handleWebAddUserGet(w, r)
+			})
+
+			router.Get(webUserPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
+				handleWebUpdateUserGet(chi.URLParam(r, "userID"), w, r)
+			})
+
+			router.Post(webUserPath, func(w http.ResponseWriter, r *http.Request) {
+				handleWebAddUserPost(w, r)
+			})
+
+			router.Post(webUserPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
+				handleWebUpdateUserPost(chi.URLParam(r, "userID"), w, r)
+			})
 		})
 
-		router.Get(dumpDataPath, func(w http.ResponseWriter, r *http.Request) {
-			dumpData(w, r)
-		})
+		router.Group(func(router chi.Router) {
+			router.Use(checkPerm(dataprovider.PermAdminManageDefender))
+
+			router.Get(defenderBansPath, func(w http.ResponseWriter, r *http.Request) {
+				getBannedIPs(w, r)
+			})
 
-		router.Get(loadDataPath, func(w http.ResponseWriter, r *http.Request) {
-			loadData(w, r)
+			router.Get(defenderBansPath+"/{ip}", func(w http.ResponseWriter, r *http.Request) {
+				getBannedIP(w, r)
+			})
+
+			router.Delete(defenderBansPath+"/{ip}", func(w http.ResponseWriter, r *http.Request) {
+				deleteBannedIP(w, r)
+			})
 		})
 
-		router.Get(webUsersPath, func(w http.ResponseWriter, r *http.Request) {
-			handleGetWebUsers(w, r)
+		router.Group(func(router chi.Router) {
+			router.Use(checkPerm(dataprovider.PermAdminManageAdmins))
+
+			router.Get(adminPath, func(w http.ResponseWriter, r *http.Request) {
+				getAdmins(w, r)
+			})
+
+			router.Post(adminPath, func(w http.ResponseWriter, r *http.Request) {
+				addAdmin(w, r)
+			})
+
+			router.Get(adminPath+"/{username}", func(w http.ResponseWriter, r *http.Request) {
+				getAdminByUsername(w, r)
+			})
+
+			router.Put(adminPath+"/{username}", func(w http.ResponseWriter, r *http.Request) {
+				updateAdmin(w, r)
+			})
+
+			router.Delete(adminPath+"/{username}", func(w http.ResponseWriter, r *http.Request) {
+				deleteAdmin(w, r)
+			})
+
+			router.Get(webAdminsPath, func(w http.ResponseWriter, r *http.Request) {
+				handleGetWebAdmins(w, r)
+			})
+
+			router.Get(webAdminPath, func(w http.ResponseWriter, r *http.Request) {
+				handleWebAddAdminGet(w, r)
+			})
+
+			router.Get(webAdminPath+"/{username}", func(w http.ResponseWriter, r *http.Request) {
+				handleWebUpdateAdminGet(chi.URLParam(r, "username"), w, r)
+			})
+
+			router.Post(webAdminPath, func(w http.ResponseWriter, r *http.Request) {
+				handleWebAddAdminPost(w, r)
+			})
+
+			router.Post(webAdminPath+"/{username}", func(w http.ResponseWriter, r *http.Request) {
+				handleWebUpdateAdminPost(chi.URLParam(r, "username"), w, r)
+			})
 		})
 
-		router.Get(webUserPath, func(w http.ResponseWriter, r *http.Request) {
-			handleWebAddUserGet(w, r)
+		router.With(checkPerm(dataprovider.PermAdminManageBackups)).Get(dumpDataPath,
+			func(w http.ResponseWriter, r *http.Request) {
+				dumpData(w, r)
+			})
+
+		router.With(checkPerm(dataprovider.PermAdminManageBackups)).Get(loadDataPath,
+			func(w http.ResponseWriter, r *http.Request) {
+				loadData(w, r)
+			})
+
+		router.With(checkPerm(dataprovider.PermAdminManageBackups)).Post(loadDataPath,
+			func(w http.ResponseWriter, r *http.Request) {
+				loadData(w, r)
+			})
+
+		router.With(checkPerm(dataprovider.PermAdminManageBackups)).Get(backupStatusPath,
+			func(w http.ResponseWriter, r *http.Request) {
+				render.JSON(w, r, backup.GetStatus())
+			})
+
+		router.With(checkPerm(dataprovider.PermAdminViewConnections)).Get(webConnectionsPath,
+			func(w http.ResponseWriter, r *http.Request) {
+				handleWebGetConnections(w, r)
+			})
+	})
+
+	router.Get(webClientBasePath, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, webClientFilesPath, http.StatusMovedPermanently)
+	})
+
+	router.Get(webClientLoginPath, func(w http.ResponseWriter, r *http.Request) {
+		handleClientLoginGet(w, r)
+	})
+
+	router.Post(webClientLoginPath, func(w http.ResponseWriter, r *http.Request) {
+		handleClientLoginPost(w, r)
+	})
+
+	router.Get(webClientLogoutPath, func(w http.ResponseWriter, r *http.Request) {
+		handleClientLogout(w, r)
+	})
+
+	router.Group(func(router chi.Router) {
+		router.Use(checkClientSession)
+
+		router.Get(webClientFilesPath, func(w http.ResponseWriter, r *http.Request) {
+			handleClientGetFiles(w, r)
 		})
 
-		router.Get(webUserPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
-			handleWebUpdateUserGet(chi.URLParam(r, "userID"), w, r)
+		router.Post(webClientUploadPath, func(w http.ResponseWriter, r *http.Request) {
+			handleClientUpload(w, r)
 		})
 
-		router.Post(webUserPath, func(w http.ResponseWriter, r *http.Request) {
-			handleWebAddUserPost(w, r)
+		router.Post(webClientMkdirPath, func(w http.ResponseWriter, r *http.Request) {
+			handleClientMkdir(w, r)
 		})
 
-		router.Post(webUserPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
-			handleWebUpdateUserPost(chi.URLParam(r, "userID"), w, r)
+		router.Post(webClientRenamePath, func(w http.ResponseWriter, r *http.Request) {
+			handleClientRename(w, r)
 		})
 
-		router.Get(webConnectionsPath, func(w http.ResponseWriter, r *http.Request) {
-			handleWebGetConnections(w, r)
+		router.Post(webClientDeletePath, func(w http.ResponseWriter, r *http.Request) {
+			handleClientDelete(w, r)
 		})
 	})
 
+	router.Get(publicSharePath+"/{shareID}", func(w http.ResponseWriter, r *http.Request) {
+		handleShareGet(w, r)
+	})
+
+	router.Post(publicSharePath+"/{shareID}", func(w http.ResponseWriter, r *http.Request) {
+		handleSharePost(w, r)
+	})
+
 	router.Group(func(router chi.Router) {
 		router.Use(middleware.DefaultCompress)
 		fileServer(router, webStaticFilesPath, http.Dir(staticFilesPath))
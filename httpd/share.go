@@ -0,0 +1,234 @@
+package httpd
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	protocolHTTPShare = "HTTPShare"
+	shareAuthRealm    = "Basic realm=\"SFTPGo share\""
+)
+
+// getShareConnection validates the requested share and returns a connection for
+// the user that owns the shared path. The share password, if any, is read from
+// the basic auth header, the username is ignored.
+// Each successful call consumes a share token.
+// An error response is sent to the client if the share cannot be used
+func getShareConnection(w http.ResponseWriter, r *http.Request, scope int) (dataprovider.Share, *clientConnection, error) {
+	if err := checkBannedHost(r); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusForbidden)
+		return dataprovider.Share{}, nil, err
+	}
+	password, hasPassword := getSharePassword(r)
+	share, err := dataprovider.CheckShareAndPass(dataProvider, chi.URLParam(r, "shareID"), password)
+	if err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+			sftpd.AddDefenderEvent(getConnectionIP(r), sftpd.HostEventUserNotFound)
+		} else if share.IsUsable() == nil && share.HasPassword() {
+			if hasPassword {
+				sftpd.AddDefenderEvent(getConnectionIP(r), sftpd.HostEventLoginFailed)
+			}
+			w.Header().Set("WWW-Authenticate", shareAuthRealm)
+			sendAPIResponse(w, r, nil, "Unauthorized", http.StatusUnauthorized)
+			return share, nil, err
+		}
+		sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+		return share, nil, err
+	}
+	if share.Scope != scope {
+		sendAPIResponse(w, r, nil, "Operation not allowed for this share", http.StatusForbidden)
+		return share, nil, fmt.Errorf("invalid scope %v for share %#v", share.Scope, share.ShareID)
+	}
+	user, err := dataprovider.GetUserWithGroupSettings(dataProvider, share.Username)
+	if err != nil {
+		sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+		return share, nil, err
+	}
+	if user.Status < 1 || (user.ExpirationDate > 0 &&
+		user.ExpirationDate < utils.GetTimeAsMsSinceEpoch(time.Now())) {
+		sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+		return share, nil, fmt.Errorf("user %#v is disabled or expired", user.Username)
+	}
+	if err = dataprovider.UpdateShareUsage(dataProvider, share, 1); err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); ok || err == dataprovider.ErrShareTokensExhausted {
+			sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+		} else {
+			sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		}
+		return share, nil, err
+	}
+	connection, err := newClientConnection(r, user, protocolHTTPShare)
+	if err != nil {
+		sendAPIResponse(w, r, nil, page500Body, http.StatusInternalServerError)
+		return share, nil, err
+	}
+	connection.Log(logger.LevelDebug, logSender, "new share request, method: %v share: %#v path: %#v", r.Method,
+		share.ShareID, share.Path)
+	return share, connection, nil
+}
+
+// getSharePassword returns the password sent using basic auth and true
+// if a password was sent
+func getSharePassword(r *http.Request) (string, bool) {
+	_, password, ok := r.BasicAuth()
+	return password, ok && len(password) > 0
+}
+
+// getShareErrorStatus returns the HTTP status code for the given filesystem error
+func getShareErrorStatus(err error) int {
+	switch err {
+	case sftp.ErrSSHFxNoSuchFile:
+		return http.StatusNotFound
+	case sftp.ErrSSHFxPermissionDenied:
+		return http.StatusForbidden
+	case sftp.ErrSSHFxOpUnsupported:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// handleShareGet downloads the shared file or a zip archive with the contents
+// of the shared directory
+func handleShareGet(w http.ResponseWriter, r *http.Request) {
+	share, connection, err := getShareConnection(w, r, dataprovider.ShareScopeRead)
+	if err != nil {
+		return
+	}
+	defer connection.close()
+
+	fi, err := connection.Stat(share.Path)
+	if err != nil {
+		sendAPIResponse(w, r, nil, getClientErrorMessage(err), getShareErrorStatus(err))
+		return
+	}
+	if fi.IsDir() {
+		downloadZip(w, connection, share.Path, fi)
+		return
+	}
+	if err = downloadFile(w, connection, share.Path, fi); err != nil {
+		sendAPIResponse(w, r, nil, getClientErrorMessage(err), getShareErrorStatus(err))
+	}
+}
+
+// handleSharePost stores the files included in the multipart body inside the
+// shared directory
+func handleSharePost(w http.ResponseWriter, r *http.Request) {
+	share, connection, err := getShareConnection(w, r, dataprovider.ShareScopeWrite)
+	if err != nil {
+		return
+	}
+	defer connection.close()
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	numFiles := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if len(part.FileName()) == 0 {
+			continue
+		}
+		err = uploadFile(connection, path.Join(share.Path, path.Base(filepath.ToSlash(part.FileName()))), part)
+		if err != nil {
+			sendAPIResponse(w, r, nil, getClientErrorMessage(err), getShareErrorStatus(err))
+			return
+		}
+		numFiles++
+	}
+	if numFiles == 0 {
+		sendAPIResponse(w, r, nil, "No files uploaded", http.StatusBadRequest)
+		return
+	}
+	sendAPIResponse(w, r, nil, "Upload completed", http.StatusCreated)
+}
+
+// downloadZip streams a zip archive with the contents of the given directory.
+// Each file is downloaded as a separate transfer so quota, logs and actions are
+// handled as for any other download. Errors after the response is started can
+// only be logged, the client will receive a truncated archive
+func downloadZip(w http.ResponseWriter, connection *clientConnection, dir string, info os.FileInfo) {
+	baseDir := path.Base(dir)
+	if dir == "/" {
+		baseDir = "share"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%#v", baseDir+".zip"))
+	wr := zip.NewWriter(w)
+	if err := addZipEntry(wr, connection, dir, baseDir, info); err != nil {
+		connection.Log(logger.LevelWarn, logSender, "unable to create zip archive for dir %#v: %v", dir, err)
+	}
+	if err := wr.Close(); err != nil {
+		connection.Log(logger.LevelWarn, logSender, "unable to close zip archive for dir %#v: %v", dir, err)
+	}
+}
+
+func addZipEntry(wr *zip.Writer, connection *clientConnection, entryPath, entryName string, info os.FileInfo) error {
+	if info.IsDir() {
+		_, err := wr.CreateHeader(&zip.FileHeader{
+			Name:     entryName + "/",
+			Method:   zip.Deflate,
+			Modified: info.ModTime(),
+		})
+		if err != nil {
+			return err
+		}
+		contents, err := connection.ReadDir(entryPath)
+		if err != nil {
+			return err
+		}
+		for _, fi := range contents {
+			err = addZipEntry(wr, connection, path.Join(entryPath, fi.Name()), path.Join(entryName, fi.Name()), fi)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !info.Mode().IsRegular() {
+		// symlinks and special files are not included
+		return nil
+	}
+	reader, err := connection.Fileread(sftp.NewRequest("Get", entryPath))
+	if err != nil {
+		return err
+	}
+	f, err := wr.CreateHeader(&zip.FileHeader{
+		Name:     entryName,
+		Method:   zip.Deflate,
+		Modified: info.ModTime(),
+	})
+	if err == nil {
+		_, err = io.Copy(f, &transferReader{ctx: connection.ctx, reader: reader})
+	}
+	if t, ok := reader.(*sftpd.Transfer); ok {
+		if err != nil {
+			t.TransferError(err)
+		}
+		t.Close()
+	}
+	return err
+}
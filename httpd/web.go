@@ -7,6 +7,7 @@ import (
 	"html/template"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"path"
 	"path/filepath"
 	"strconv"
@@ -14,6 +15,7 @@ import (
 	"time"
 
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/vfs"
@@ -24,9 +26,12 @@ const (
 	templateUsers          = "users.html"
 	templateUser           = "user.html"
 	templateConnections    = "connections.html"
+	templateAdmins         = "admins.html"
+	templateAdmin          = "admin.html"
 	templateMessage        = "message.html"
 	pageUsersTitle         = "Users"
 	pageConnectionsTitle   = "Connections"
+	pageAdminsTitle        = "Admins"
 	page400Title           = "Bad request"
 	page404Title           = "Not found"
 	page404Body            = "The page you are looking for does not exist."
@@ -34,6 +39,9 @@ const (
 	page500Body            = "The server is unable to fulfill your request."
 	defaultUsersQueryLimit = 500
 	webDateTimeFormat      = "2006-01-02 15:04:05" // YYYY-MM-DD HH:MM:SS
+	// the encrypted secrets are displayed using this placeholder, if it is posted back the
+	// current secret is kept
+	redactedSecret = "[**redacted**]"
 )
 
 var (
@@ -49,8 +57,12 @@ type basePage struct {
 	APIConnectionsURL string
 	APIQuotaScanURL   string
 	ConnectionsURL    string
+	AdminsURL         string
+	AdminURL          string
+	APIAdminURL       string
 	UsersTitle        string
 	ConnectionsTitle  string
+	AdminsTitle       string
 	Version           string
 }
 
@@ -61,18 +73,34 @@ type usersPage struct {
 
 type connectionsPage struct {
 	basePage
-	Connections []sftpd.ConnectionStatus
+	Connections    []sftpd.ConnectionStatus
+	NetConnections sftpd.NetConnectionsStatus
 }
 
 type userPage struct {
 	basePage
-	IsAdd                bool
-	User                 dataprovider.User
-	RootPerms            []string
-	Error                string
-	ValidPerms           []string
-	ValidSSHLoginMethods []string
-	RootDirPerms         []string
+	IsAdd                     bool
+	User                      dataprovider.User
+	RootPerms                 []string
+	Error                     string
+	ValidPerms                []string
+	ValidSSHLoginMethods      []string
+	SSHMultiStepsLoginMethods []string
+	RootDirPerms              []string
+	RedactedSecret            string
+}
+
+type adminsPage struct {
+	basePage
+	Admins []dataprovider.Admin
+}
+
+type adminPage struct {
+	basePage
+	IsAdd      bool
+	Admin      dataprovider.Admin
+	Error      string
+	ValidPerms []string
 }
 
 type messagePage struct {
@@ -94,6 +122,14 @@ func loadTemplates(templatesPath string) {
 		filepath.Join(templatesPath, templateBase),
 		filepath.Join(templatesPath, templateConnections),
 	}
+	adminsPaths := []string{
+		filepath.Join(templatesPath, templateBase),
+		filepath.Join(templatesPath, templateAdmins),
+	}
+	adminPaths := []string{
+		filepath.Join(templatesPath, templateBase),
+		filepath.Join(templatesPath, templateAdmin),
+	}
 	messagePath := []string{
 		filepath.Join(templatesPath, templateBase),
 		filepath.Join(templatesPath, templateMessage),
@@ -101,12 +137,18 @@ func loadTemplates(templatesPath string) {
 	usersTmpl := utils.LoadTemplate(template.ParseFiles(usersPaths...))
 	userTmpl := utils.LoadTemplate(template.ParseFiles(userPaths...))
 	connectionsTmpl := utils.LoadTemplate(template.ParseFiles(connectionsPaths...))
+	adminsTmpl := utils.LoadTemplate(template.ParseFiles(adminsPaths...))
+	adminTmpl := utils.LoadTemplate(template.ParseFiles(adminPaths...))
 	messageTmpl := utils.LoadTemplate(template.ParseFiles(messagePath...))
 
 	templates[templateUsers] = usersTmpl
 	templates[templateUser] = userTmpl
 	templates[templateConnections] = connectionsTmpl
+	templates[templateAdmins] = adminsTmpl
+	templates[templateAdmin] = adminTmpl
 	templates[templateMessage] = messageTmpl
+
+	loadClientTemplates(templatesPath)
 }
 
 func getBasePageData(title, currentURL string) basePage {
@@ -120,8 +162,12 @@ func getBasePageData(title, currentURL string) basePage {
 		APIConnectionsURL: activeConnectionsPath,
 		APIQuotaScanURL:   quotaScanPath,
 		ConnectionsURL:    webConnectionsPath,
+		AdminsURL:         webAdminsPath,
+		AdminURL:          webAdminPath,
+		APIAdminURL:       adminPath,
 		UsersTitle:        pageUsersTitle,
 		ConnectionsTitle:  pageConnectionsTitle,
+		AdminsTitle:       pageAdminsTitle,
 		Version:           version.GetVersionAsString(),
 	}
 }
@@ -164,40 +210,68 @@ func renderNotFoundPage(w http.ResponseWriter, err error) {
 
 func renderAddUserPage(w http.ResponseWriter, user dataprovider.User, error string) {
 	data := userPage{
-		basePage:             getBasePageData("Add a new user", webUserPath),
-		IsAdd:                true,
-		Error:                error,
-		User:                 user,
-		ValidPerms:           dataprovider.ValidPerms,
-		ValidSSHLoginMethods: dataprovider.ValidSSHLoginMethods,
-		RootDirPerms:         user.GetPermissionsForPath("/"),
+		basePage:                  getBasePageData("Add a new user", webUserPath),
+		IsAdd:                     true,
+		Error:                     error,
+		User:                      user,
+		ValidPerms:                dataprovider.ValidPerms,
+		ValidSSHLoginMethods:      dataprovider.ValidSSHLoginMethods,
+		SSHMultiStepsLoginMethods: dataprovider.SSHMultiStepsLoginMethods,
+		RootDirPerms:              user.GetPermissionsForPath("/"),
+		RedactedSecret:            redactedSecret,
 	}
 	renderTemplate(w, templateUser, data)
 }
 
 func renderUpdateUserPage(w http.ResponseWriter, user dataprovider.User, error string) {
 	data := userPage{
-		basePage:             getBasePageData("Update user", fmt.Sprintf("%v/%v", webUserPath, user.ID)),
-		IsAdd:                false,
-		Error:                error,
-		User:                 user,
-		ValidPerms:           dataprovider.ValidPerms,
-		ValidSSHLoginMethods: dataprovider.ValidSSHLoginMethods,
-		RootDirPerms:         user.GetPermissionsForPath("/"),
+		basePage:                  getBasePageData("Update user", fmt.Sprintf("%v/%v", webUserPath, user.ID)),
+		IsAdd:                     false,
+		Error:                     error,
+		User:                      user,
+		ValidPerms:                dataprovider.ValidPerms,
+		ValidSSHLoginMethods:      dataprovider.ValidSSHLoginMethods,
+		SSHMultiStepsLoginMethods: dataprovider.SSHMultiStepsLoginMethods,
+		RootDirPerms:              user.GetPermissionsForPath("/"),
+		RedactedSecret:            redactedSecret,
 	}
 	renderTemplate(w, templateUser, data)
 }
 
-func getVirtualFoldersFromPostFields(r *http.Request) []vfs.VirtualFolder {
-	var virtualFolders []vfs.VirtualFolder
+func renderAddAdminPage(w http.ResponseWriter, admin dataprovider.Admin, error string) {
+	data := adminPage{
+		basePage:   getBasePageData("Add a new admin", webAdminPath),
+		IsAdd:      true,
+		Error:      error,
+		Admin:      admin,
+		ValidPerms: dataprovider.ValidAdminPerms,
+	}
+	renderTemplate(w, templateAdmin, data)
+}
+
+func renderUpdateAdminPage(w http.ResponseWriter, admin dataprovider.Admin, error string) {
+	data := adminPage{
+		basePage:   getBasePageData("Update admin", fmt.Sprintf("%v/%v", webAdminPath, url.PathEscape(admin.Username))),
+		IsAdd:      false,
+		Error:      error,
+		Admin:      admin,
+		ValidPerms: dataprovider.ValidAdminPerms,
+	}
+	renderTemplate(w, templateAdmin, data)
+}
+
+func getVirtualFoldersFromPostFields(r *http.Request) []dataprovider.VirtualFolder {
+	var virtualFolders []dataprovider.VirtualFolder
 	formValue := r.Form.Get("virtual_folders")
 	for _, cleaned := range getSliceFromDelimitedValues(formValue, "\n") {
 		if strings.Contains(cleaned, "::") {
 			mapping := strings.Split(cleaned, "::")
 			if len(mapping) > 1 {
-				virtualFolders = append(virtualFolders, vfs.VirtualFolder{
-					VirtualPath: strings.TrimSpace(mapping[0]),
-					MappedPath:  strings.TrimSpace(mapping[1]),
+				virtualFolders = append(virtualFolders, dataprovider.VirtualFolder{
+					VirtualFolder: vfs.VirtualFolder{
+						VirtualPath: strings.TrimSpace(mapping[0]),
+						MappedPath:  strings.TrimSpace(mapping[1]),
+					},
 				})
 			}
 		}
@@ -205,6 +279,21 @@ func getVirtualFoldersFromPostFields(r *http.Request) []vfs.VirtualFolder {
 	return virtualFolders
 }
 
+// restoreVirtualFoldersSettings keeps the quota and the storage settings, that cannot
+// be edited using the web interface, for the posted folders that already exist
+func restoreVirtualFoldersSettings(folders, currentFolders []dataprovider.VirtualFolder) {
+	for idx := range folders {
+		for _, current := range currentFolders {
+			if current.VirtualPath == folders[idx].VirtualPath {
+				folders[idx].QuotaSize = current.QuotaSize
+				folders[idx].QuotaFiles = current.QuotaFiles
+				folders[idx].FsConfig = current.FsConfig
+				break
+			}
+		}
+	}
+}
+
 func getUserPermissionsFromPostFields(r *http.Request) map[string][]string {
 	permissions := make(map[string][]string)
 	permissions["/"] = r.Form["permissions"]
@@ -281,6 +370,7 @@ func getFiltersFromUserPostFields(r *http.Request) dataprovider.UserFilters {
 	filters.AllowedIP = getSliceFromDelimitedValues(r.Form.Get("allowed_ip"), ",")
 	filters.DeniedIP = getSliceFromDelimitedValues(r.Form.Get("denied_ip"), ",")
 	filters.DeniedLoginMethods = r.Form["ssh_login_methods"]
+	filters.RequiredLoginMethods = r.Form["ssh_required_login_methods"]
 	allowedExtensions := getFileExtensionsFromPostField(r.Form.Get("allowed_extensions"), 1)
 	deniedExtensions := getFileExtensionsFromPostField(r.Form.Get("denied_extensions"), 2)
 	extensions := []dataprovider.ExtensionsFilter{}
@@ -314,6 +404,16 @@ func getFiltersFromUserPostFields(r *http.Request) dataprovider.UserFilters {
 	return filters
 }
 
+// getSecretFromFormField returns the secret posted using the given field, the redacted
+// placeholder is returned as a redacted secret so the current secret is kept
+func getSecretFromFormField(r *http.Request, field string) kms.Secret {
+	value := r.Form.Get(field)
+	if value == redactedSecret {
+		return kms.Secret{Status: kms.SecretStatusRedacted}
+	}
+	return kms.NewPlainSecret(value)
+}
+
 func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, error) {
 	var fs dataprovider.Filesystem
 	provider, err := strconv.Atoi(r.Form.Get("fs_provider"))
@@ -325,7 +425,7 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 		fs.S3Config.Bucket = r.Form.Get("s3_bucket")
 		fs.S3Config.Region = r.Form.Get("s3_region")
 		fs.S3Config.AccessKey = r.Form.Get("s3_access_key")
-		fs.S3Config.AccessSecret = r.Form.Get("s3_access_secret")
+		fs.S3Config.AccessSecret = getSecretFromFormField(r, "s3_access_secret")
 		fs.S3Config.Endpoint = r.Form.Get("s3_endpoint")
 		fs.S3Config.StorageClass = r.Form.Get("s3_storage_class")
 		fs.S3Config.KeyPrefix = r.Form.Get("s3_key_prefix")
@@ -362,9 +462,34 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 			}
 			return fs, err
 		}
-		fs.GCSConfig.Credentials = base64.StdEncoding.EncodeToString(fileBytes)
+		fs.GCSConfig.Credentials = kms.NewPlainSecret(base64.StdEncoding.EncodeToString(fileBytes))
 		fs.GCSConfig.AutomaticCredentials = 0
-	}
+	} else if fs.Provider == 3 {
+		fs.AzBlobConfig.Container = r.Form.Get("az_container")
+		fs.AzBlobConfig.AccountName = r.Form.Get("az_account_name")
+		fs.AzBlobConfig.AccountKey = getSecretFromFormField(r, "az_account_key")
+		fs.AzBlobConfig.SASURL = r.Form.Get("az_sas_url")
+		fs.AzBlobConfig.Endpoint = r.Form.Get("az_endpoint")
+		fs.AzBlobConfig.KeyPrefix = r.Form.Get("az_key_prefix")
+		fs.AzBlobConfig.AccessTier = r.Form.Get("az_access_tier")
+		fs.AzBlobConfig.UseEmulator = len(r.Form.Get("az_use_emulator")) > 0
+		fs.AzBlobConfig.UploadPartSize, err = strconv.ParseInt(r.Form.Get("az_upload_part_size"), 10, 64)
+		if err != nil {
+			return fs, err
+		}
+		fs.AzBlobConfig.UploadConcurrency, err = strconv.Atoi(r.Form.Get("az_upload_concurrency"))
+		if err != nil {
+			return fs, err
+		}
+	} else if fs.Provider == 4 {
+		fs.SFTPConfig.Endpoint = r.Form.Get("sftp_endpoint")
+		fs.SFTPConfig.Username = r.Form.Get("sftp_username")
+		fs.SFTPConfig.Password = getSecretFromFormField(r, "sftp_password")
+		fs.SFTPConfig.PrivateKey = getSecretFromFormField(r, "sftp_private_key")
+		fs.SFTPConfig.Fingerprints = getSliceFromDelimitedValues(r.Form.Get("sftp_fingerprints"), "\n")
+		fs.SFTPConfig.Prefix = r.Form.Get("sftp_prefix")
+	}
+	fs.CryptConfig.Passphrase = getSecretFromFormField(r, "crypt_passphrase")
 	return fs, nil
 }
 
@@ -443,6 +568,27 @@ func getUserFromPostFields(r *http.Request) (dataprovider.User, error) {
 	return user, err
 }
 
+func getAdminFromPostFields(r *http.Request) (dataprovider.Admin, error) {
+	var admin dataprovider.Admin
+	err := r.ParseMultipartForm(maxRequestSize)
+	if err != nil {
+		return admin, err
+	}
+	status, err := strconv.Atoi(r.Form.Get("status"))
+	if err != nil {
+		return admin, err
+	}
+	admin = dataprovider.Admin{
+		Username:    r.Form.Get("username"),
+		Password:    r.Form.Get("password"),
+		Status:      status,
+		Email:       r.Form.Get("email"),
+		Permissions: r.Form["permissions"],
+		Description: r.Form.Get("description"),
+	}
+	return admin, err
+}
+
 func handleGetWebUsers(w http.ResponseWriter, r *http.Request) {
 	limit := defaultUsersQueryLimit
 	if _, ok := r.URL.Query()["qlimit"]; ok {
@@ -530,6 +676,9 @@ func handleWebUpdateUserPost(userID string, w http.ResponseWriter, r *http.Reque
 		return
 	}
 	updatedUser.ID = user.ID
+	updatedUser.TOTPConfig = user.TOTPConfig
+	restoreVirtualFoldersSettings(updatedUser.VirtualFolders, user.VirtualFolders)
+	restoreFsSecrets(&updatedUser.FsConfig, user.FsConfig)
 	if len(updatedUser.Password) == 0 {
 		updatedUser.Password = user.Password
 	}
@@ -541,11 +690,100 @@ func handleWebUpdateUserPost(userID string, w http.ResponseWriter, r *http.Reque
 	}
 }
 
+func handleGetWebAdmins(w http.ResponseWriter, r *http.Request) {
+	limit := defaultUsersQueryLimit
+	if _, ok := r.URL.Query()["qlimit"]; ok {
+		var err error
+		limit, err = strconv.Atoi(r.URL.Query().Get("qlimit"))
+		if err != nil {
+			limit = defaultUsersQueryLimit
+		}
+	}
+	var admins []dataprovider.Admin
+	a, err := dataprovider.GetAdmins(dataProvider, limit, 0, "ASC")
+	admins = append(admins, a...)
+	for len(a) == limit {
+		a, err = dataprovider.GetAdmins(dataProvider, limit, len(admins), "ASC")
+		if err == nil && len(a) > 0 {
+			admins = append(admins, a...)
+		} else {
+			break
+		}
+	}
+	if err != nil {
+		renderInternalServerErrorPage(w, err)
+		return
+	}
+	data := adminsPage{
+		basePage: getBasePageData(pageAdminsTitle, webAdminsPath),
+		Admins:   admins,
+	}
+	renderTemplate(w, templateAdmins, data)
+}
+
+func handleWebAddAdminGet(w http.ResponseWriter, r *http.Request) {
+	renderAddAdminPage(w, dataprovider.Admin{Status: 1}, "")
+}
+
+func handleWebUpdateAdminGet(username string, w http.ResponseWriter, r *http.Request) {
+	admin, err := dataprovider.AdminExists(dataProvider, username)
+	if err == nil {
+		renderUpdateAdminPage(w, admin, "")
+	} else if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		renderNotFoundPage(w, err)
+	} else {
+		renderInternalServerErrorPage(w, err)
+	}
+}
+
+func handleWebAddAdminPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	admin, err := getAdminFromPostFields(r)
+	if err != nil {
+		renderAddAdminPage(w, admin, err.Error())
+		return
+	}
+	err = dataprovider.AddAdmin(dataProvider, admin)
+	if err == nil {
+		http.Redirect(w, r, webAdminsPath, http.StatusSeeOther)
+	} else {
+		renderAddAdminPage(w, admin, err.Error())
+	}
+}
+
+func handleWebUpdateAdminPost(username string, w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	admin, err := dataprovider.AdminExists(dataProvider, username)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		renderNotFoundPage(w, err)
+		return
+	} else if err != nil {
+		renderInternalServerErrorPage(w, err)
+		return
+	}
+	updatedAdmin, err := getAdminFromPostFields(r)
+	if err != nil {
+		renderUpdateAdminPage(w, admin, err.Error())
+		return
+	}
+	updatedAdmin.Username = admin.Username
+	if len(updatedAdmin.Password) == 0 {
+		updatedAdmin.Password = admin.Password
+	}
+	err = dataprovider.UpdateAdmin(dataProvider, updatedAdmin)
+	if err == nil {
+		http.Redirect(w, r, webAdminsPath, http.StatusSeeOther)
+	} else {
+		renderUpdateAdminPage(w, admin, err.Error())
+	}
+}
+
 func handleWebGetConnections(w http.ResponseWriter, r *http.Request) {
 	connectionStats := sftpd.GetConnectionsStats()
 	data := connectionsPage{
-		basePage:    getBasePageData(pageConnectionsTitle, webConnectionsPath),
-		Connections: connectionStats,
+		basePage:       getBasePageData(pageConnectionsTitle, webConnectionsPath),
+		Connections:    connectionStats,
+		NetConnections: sftpd.GetNetConnectionsStatus(),
 	}
 	renderTemplate(w, templateConnections, data)
 }
@@ -0,0 +1,651 @@
+package httpd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	templateClientBase    = "clientbase.html"
+	templateClientLogin   = "clientlogin.html"
+	templateClientFiles   = "clientfiles.html"
+	templateClientMessage = "clientmessage.html"
+	pageClientFilesTitle  = "My Files"
+	protocolHTTP          = "HTTP"
+	clientSessionCookie   = "sftpgo_client_session"
+	clientSessionTimeout  = 20 * time.Minute
+	clientUserKey         = contextKey("client_user")
+)
+
+var (
+	errClientSessionNotFound = errors.New("web client session not found or expired")
+	clientSessions           = clientSessionStore{
+		sessions: make(map[string]clientSession),
+	}
+)
+
+type contextKey string
+
+type clientSession struct {
+	username   string
+	expiration time.Time
+}
+
+// clientSessionStore keeps the web client sessions in memory,
+// users have to login again if SFTPGo is restarted
+type clientSessionStore struct {
+	sync.RWMutex
+	sessions map[string]clientSession
+}
+
+func (s *clientSessionStore) add(username string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	s.Lock()
+	defer s.Unlock()
+	for t, session := range s.sessions {
+		if session.expiration.Before(time.Now()) {
+			delete(s.sessions, t)
+		}
+	}
+	s.sessions[token] = clientSession{
+		username:   username,
+		expiration: time.Now().Add(clientSessionTimeout),
+	}
+	return token, nil
+}
+
+// get returns the username for the given token and extends the session expiration
+func (s *clientSessionStore) get(token string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	session, ok := s.sessions[token]
+	if !ok {
+		return "", false
+	}
+	if session.expiration.Before(time.Now()) {
+		delete(s.sessions, token)
+		return "", false
+	}
+	session.expiration = time.Now().Add(clientSessionTimeout)
+	s.sessions[token] = session
+	return session.username, true
+}
+
+func (s *clientSessionStore) remove(token string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.sessions, token)
+}
+
+type clientBasePage struct {
+	Title     string
+	FilesURL  string
+	LogoutURL string
+	Username  string
+	Version   string
+}
+
+type clientLoginPage struct {
+	Title    string
+	LoginURL string
+	Error    string
+	Version  string
+}
+
+type clientFileItem struct {
+	Name    string
+	Path    string
+	IsDir   bool
+	Size    string
+	ModTime string
+}
+
+type clientFilesPage struct {
+	clientBasePage
+	CurrentDir     string
+	Dirs           []clientFileItem
+	Files          []clientFileItem
+	Error          string
+	CanUpload      bool
+	CanCreateDirs  bool
+	CanRename      bool
+	CanDelete      bool
+	UploadURL      string
+	MkdirURL       string
+	RenameURL      string
+	DeleteURL      string
+	ParentDirsPath []clientFileItem
+}
+
+type clientMessagePage struct {
+	clientBasePage
+	Error string
+}
+
+// clientConnection is the SFTP connection used to serve a web client request.
+// Each request is tracked as a new connection so it is listed within the active
+// connections and it can be closed as any other connection
+type clientConnection struct {
+	sftpd.Connection
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (c *clientConnection) close() {
+	c.cancel()
+	sftpd.RemoveConnection(c.ID)
+}
+
+func (c *clientConnection) handleCmd(request *sftp.Request) error {
+	err := c.Filecmd(request)
+	if err == sftp.ErrSSHFxOk {
+		return nil
+	}
+	if err != nil {
+		c.Log(logger.LevelDebug, logSender, "web client command %v for path %#v failed: %v", request.Method,
+			request.Filepath, err)
+	}
+	return err
+}
+
+// requestCanceler allows to abort a web client request, for example if the
+// connection is closed using the REST API
+type requestCanceler struct {
+	cancel context.CancelFunc
+}
+
+func (c *requestCanceler) Close() error {
+	c.cancel()
+	return nil
+}
+
+// transferReader adapts a download transfer to io.Reader, reads fail as soon
+// as the connection is closed
+type transferReader struct {
+	ctx    context.Context
+	reader io.ReaderAt
+	offset int64
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.reader.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	return n, err
+}
+
+// transferWriter adapts an upload transfer to io.Writer, writes fail as soon
+// as the connection is closed
+type transferWriter struct {
+	ctx    context.Context
+	writer io.WriterAt
+	offset int64
+}
+
+func (w *transferWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := w.writer.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+func loadClientTemplates(templatesPath string) {
+	loginPath := []string{
+		filepath.Join(templatesPath, templateClientLogin),
+	}
+	filesPaths := []string{
+		filepath.Join(templatesPath, templateClientBase),
+		filepath.Join(templatesPath, templateClientFiles),
+	}
+	messagePaths := []string{
+		filepath.Join(templatesPath, templateClientBase),
+		filepath.Join(templatesPath, templateClientMessage),
+	}
+	templates[templateClientLogin] = utils.LoadTemplate(template.ParseFiles(loginPath...))
+	templates[templateClientFiles] = utils.LoadTemplate(template.ParseFiles(filesPaths...))
+	templates[templateClientMessage] = utils.LoadTemplate(template.ParseFiles(messagePaths...))
+}
+
+func getClientBasePageData(title string, user dataprovider.User) clientBasePage {
+	version := utils.GetAppVersion()
+	return clientBasePage{
+		Title:     title,
+		FilesURL:  webClientFilesPath,
+		LogoutURL: webClientLogoutPath,
+		Username:  user.Username,
+		Version:   version.GetVersionAsString(),
+	}
+}
+
+func renderClientLoginPage(w http.ResponseWriter, statusCode int, error string) {
+	version := utils.GetAppVersion()
+	data := clientLoginPage{
+		Title:    "Login",
+		LoginURL: webClientLoginPath,
+		Error:    error,
+		Version:  version.GetVersionAsString(),
+	}
+	w.WriteHeader(statusCode)
+	renderTemplate(w, templateClientLogin, data)
+}
+
+func renderClientMessagePage(w http.ResponseWriter, user dataprovider.User, title string, statusCode int, err error) {
+	data := clientMessagePage{
+		clientBasePage: getClientBasePageData(title, user),
+		Error:          err.Error(),
+	}
+	w.WriteHeader(statusCode)
+	renderTemplate(w, templateClientMessage, data)
+}
+
+func renderClientFilesPage(w http.ResponseWriter, connection *clientConnection, dir string, error string) {
+	user := connection.User
+	data := clientFilesPage{
+		clientBasePage: getClientBasePageData(pageClientFilesTitle, user),
+		CurrentDir:     dir,
+		Error:          error,
+		CanUpload:      user.HasPerm(dataprovider.PermUpload, dir),
+		CanCreateDirs:  user.HasPerm(dataprovider.PermCreateDirs, dir),
+		CanRename:      user.HasPerm(dataprovider.PermRename, dir),
+		CanDelete:      user.HasPerm(dataprovider.PermDelete, dir),
+		UploadURL:      webClientUploadPath,
+		MkdirURL:       webClientMkdirPath,
+		RenameURL:      webClientRenamePath,
+		DeleteURL:      webClientDeletePath,
+	}
+	dirs := utils.GetDirsForSFTPPath(dir)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		data.ParentDirsPath = append(data.ParentDirsPath, clientFileItem{
+			Name:  path.Base(dirs[i]),
+			Path:  dirs[i],
+			IsDir: true,
+		})
+	}
+	files, err := connection.ReadDir(dir)
+	if err != nil {
+		connection.Log(logger.LevelDebug, logSender, "unable to list directory %#v: %v", dir, err)
+		data.Error = getClientErrorMessage(err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return strings.ToLower(files[i].Name()) < strings.ToLower(files[j].Name())
+	})
+	for _, fi := range files {
+		item := clientFileItem{
+			Name:    fi.Name(),
+			Path:    path.Join(dir, fi.Name()),
+			IsDir:   fi.IsDir(),
+			ModTime: fi.ModTime().Format(webDateTimeFormat),
+		}
+		if fi.IsDir() {
+			data.Dirs = append(data.Dirs, item)
+		} else {
+			item.Size = utils.ByteCountSI(fi.Size())
+			data.Files = append(data.Files, item)
+		}
+	}
+	renderTemplate(w, templateClientFiles, data)
+}
+
+// getClientErrorMessage returns an error message that can be safely displayed to web client users
+func getClientErrorMessage(err error) string {
+	switch err {
+	case sftp.ErrSSHFxNoSuchFile:
+		return "No such file or directory"
+	case sftp.ErrSSHFxPermissionDenied:
+		return "Permission denied"
+	case sftp.ErrSSHFxOpUnsupported:
+		return "Operation not supported"
+	case sftp.ErrSSHFxFailure:
+		return "Operation failed"
+	}
+	return err.Error()
+}
+
+func getClientUserFromContext(r *http.Request) dataprovider.User {
+	if user, ok := r.Context().Value(clientUserKey).(dataprovider.User); ok {
+		return user
+	}
+	return dataprovider.User{}
+}
+
+// getClientSessionUser returns the user associated to the session cookie,
+// the user is loaded from the data provider for each request so changes
+// to users, for example permissions, are applied immediately
+func getClientSessionUser(r *http.Request) (dataprovider.User, error) {
+	cookie, err := r.Cookie(clientSessionCookie)
+	if err != nil {
+		return dataprovider.User{}, errClientSessionNotFound
+	}
+	username, ok := clientSessions.get(cookie.Value)
+	if !ok {
+		return dataprovider.User{}, errClientSessionNotFound
+	}
+	user, err := dataprovider.GetUserWithGroupSettings(dataProvider, username)
+	if err != nil {
+		clientSessions.remove(cookie.Value)
+		return user, err
+	}
+	if user.Status < 1 || (user.ExpirationDate > 0 &&
+		user.ExpirationDate < utils.GetTimeAsMsSinceEpoch(time.Now())) {
+		clientSessions.remove(cookie.Value)
+		return user, fmt.Errorf("user %#v is disabled or expired", username)
+	}
+	return user, nil
+}
+
+func checkClientSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := getClientSessionUser(r)
+		if err != nil {
+			http.Redirect(w, r, webClientLoginPath, http.StatusFound)
+			return
+		}
+		ctx := context.WithValue(r.Context(), clientUserKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func getClientConnection(w http.ResponseWriter, r *http.Request) (*clientConnection, error) {
+	user := getClientUserFromContext(r)
+	err := sftpd.CheckLoginConditions(user, dataprovider.SSHLoginMethodPassword, r.RemoteAddr)
+	if err != nil {
+		renderClientMessagePage(w, user, "Forbidden", http.StatusForbidden, err)
+		return nil, err
+	}
+	connection, err := newClientConnection(r, user, protocolHTTP)
+	if err != nil {
+		renderClientMessagePage(w, user, page500Title, http.StatusInternalServerError, errors.New(page500Body))
+		return nil, err
+	}
+	connection.Log(logger.LevelDebug, logSender, "new web client request, method: %v path: %#v user: %#v", r.Method,
+		r.URL.Path, user.Username)
+	return connection, nil
+}
+
+// newClientConnection creates and tracks a new connection for the given user,
+// the caller must close it when the request is done
+func newClientConnection(r *http.Request, user dataprovider.User, protocol string) (*clientConnection, error) {
+	connectionID := fmt.Sprintf("%v_%v", protocol, xid.New().String())
+	fs, err := user.GetFilesystem(connectionID)
+	if err != nil {
+		logger.Warn(logSender, connectionID, "could not create filesystem for user %#v err: %v", user.Username, err)
+		return nil, err
+	}
+	fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+	ctx, cancel := context.WithCancel(r.Context())
+	connection := &clientConnection{
+		Connection: sftpd.NewConnection(connectionID, protocol, r.UserAgent(), getRemoteAddress(r), user, fs,
+			&requestCanceler{cancel: cancel}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	sftpd.AddConnection(connection.Connection)
+	return connection, nil
+}
+
+func getRemoteAddress(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+func handleClientLoginGet(w http.ResponseWriter, r *http.Request) {
+	renderClientLoginPage(w, http.StatusOK, "")
+}
+
+func handleClientLoginPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if err := r.ParseForm(); err != nil {
+		renderClientLoginPage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	username := r.Form.Get("username")
+	password := r.Form.Get("password")
+	if len(username) == 0 || len(password) == 0 {
+		renderClientLoginPage(w, http.StatusBadRequest, "Please provide username and password")
+		return
+	}
+	if err := checkBannedHost(r); err != nil {
+		renderClientLoginPage(w, http.StatusForbidden, err.Error())
+		return
+	}
+	method := dataprovider.SSHLoginMethodPassword
+	metrics.AddLoginAttempt(method)
+	user, err := dataprovider.CheckUserAndPass(dataProvider, username, password,
+		utils.GetIPFromRemoteAddress(r.RemoteAddr), protocolHTTP)
+	if err == nil {
+		err = sftpd.CheckLoginConditions(user, method, r.RemoteAddr)
+	}
+	metrics.AddLoginResult(method, err)
+	if err != nil {
+		logger.ConnectionFailedLog(username, utils.GetIPFromRemoteAddress(r.RemoteAddr), method, err.Error())
+		sftpd.AddDefenderEvent(getConnectionIP(r), sftpd.GetLoginFailedEvent(err))
+		renderClientLoginPage(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+	token, err := clientSessions.add(user.Username)
+	if err != nil {
+		renderClientLoginPage(w, http.StatusInternalServerError, page500Body)
+		return
+	}
+	logger.Info(logSender, "", "web client login for user %#v from %v", user.Username, r.RemoteAddr)
+	http.SetCookie(w, &http.Cookie{
+		Name:     clientSessionCookie,
+		Value:    token,
+		Path:     webClientBasePath,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	dataprovider.UpdateLastLogin(dataProvider, user)
+	http.Redirect(w, r, webClientFilesPath, http.StatusSeeOther)
+}
+
+func handleClientLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(clientSessionCookie); err == nil {
+		clientSessions.remove(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     clientSessionCookie,
+		Value:    "",
+		Path:     webClientBasePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, webClientLoginPath, http.StatusFound)
+}
+
+// handleClientGetFiles lists the requested directory or downloads the requested file
+func handleClientGetFiles(w http.ResponseWriter, r *http.Request) {
+	connection, err := getClientConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer connection.close()
+
+	name := utils.CleanSFTPPath(r.URL.Query().Get("path"))
+	fi, err := connection.Stat(name)
+	if err != nil {
+		renderClientFilesPage(w, connection, "/", getClientErrorMessage(err))
+		return
+	}
+	if fi.IsDir() {
+		renderClientFilesPage(w, connection, name, "")
+		return
+	}
+	if err = downloadFile(w, connection, name, fi); err != nil {
+		renderClientFilesPage(w, connection, path.Dir(name), getClientErrorMessage(err))
+	}
+}
+
+// downloadFile streams the given file to the client. The returned error is not nil
+// only if the download cannot be started, errors during the transfer are handled
+// by the transfer itself
+func downloadFile(w http.ResponseWriter, connection *clientConnection, name string, info os.FileInfo) error {
+	reader, err := connection.Fileread(sftp.NewRequest("Get", name))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%#v", path.Base(name)))
+	w.Header().Set("Content-Length", fmt.Sprintf("%v", info.Size()))
+	_, err = io.Copy(w, &transferReader{ctx: connection.ctx, reader: reader})
+	if t, ok := reader.(*sftpd.Transfer); ok {
+		if err != nil {
+			t.TransferError(err)
+		}
+		t.Close()
+	}
+	return nil
+}
+
+// handleClientUpload streams the uploaded files from the multipart body to
+// the user's filesystem without storing them in memory or in temporary files
+func handleClientUpload(w http.ResponseWriter, r *http.Request) {
+	connection, err := getClientConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer connection.close()
+
+	dir := utils.CleanSFTPPath(r.URL.Query().Get("path"))
+	reader, err := r.MultipartReader()
+	if err != nil {
+		renderClientFilesPage(w, connection, dir, err.Error())
+		return
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			renderClientFilesPage(w, connection, dir, err.Error())
+			return
+		}
+		if len(part.FileName()) == 0 {
+			continue
+		}
+		err = uploadFile(connection, path.Join(dir, path.Base(filepath.ToSlash(part.FileName()))), part)
+		if err != nil {
+			renderClientFilesPage(w, connection, dir, getClientErrorMessage(err))
+			return
+		}
+	}
+	http.Redirect(w, r, getClientFilesURL(dir), http.StatusSeeOther)
+}
+
+func uploadFile(connection *clientConnection, name string, src io.Reader) error {
+	writer, err := connection.Filewrite(sftpd.NewUploadRequest(name, false))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(&transferWriter{ctx: connection.ctx, writer: writer}, src)
+	if t, ok := writer.(*sftpd.Transfer); ok {
+		if err != nil {
+			t.TransferError(err)
+		}
+		closeErr := t.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func handleClientMkdir(w http.ResponseWriter, r *http.Request) {
+	handleClientCmd(w, r, func(connection *clientConnection, dir, name string) error {
+		return connection.handleCmd(sftp.NewRequest("Mkdir", path.Join(dir, name)))
+	})
+}
+
+func handleClientRename(w http.ResponseWriter, r *http.Request) {
+	handleClientCmd(w, r, func(connection *clientConnection, dir, name string) error {
+		target := r.Form.Get("target")
+		if len(target) == 0 || strings.Contains(target, "/") {
+			return errors.New("Invalid target name")
+		}
+		request := sftp.NewRequest("Rename", path.Join(dir, name))
+		request.Target = path.Join(dir, target)
+		return connection.handleCmd(request)
+	})
+}
+
+func handleClientDelete(w http.ResponseWriter, r *http.Request) {
+	handleClientCmd(w, r, func(connection *clientConnection, dir, name string) error {
+		p := path.Join(dir, name)
+		fi, err := connection.Stat(p)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return connection.handleCmd(sftp.NewRequest("Rmdir", p))
+		}
+		return connection.handleCmd(sftp.NewRequest("Remove", p))
+	})
+}
+
+// handleClientCmd parses the form fields common to all the web client commands,
+// runs the given function and then shows the directory again
+func handleClientCmd(w http.ResponseWriter, r *http.Request, cmd func(*clientConnection, string, string) error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	connection, err := getClientConnection(w, r)
+	if err != nil {
+		return
+	}
+	defer connection.close()
+
+	if err = r.ParseForm(); err != nil {
+		renderClientFilesPage(w, connection, "/", err.Error())
+		return
+	}
+	dir := utils.CleanSFTPPath(r.Form.Get("path"))
+	name := r.Form.Get("name")
+	if len(name) == 0 || strings.Contains(name, "/") {
+		renderClientFilesPage(w, connection, dir, "Invalid name")
+		return
+	}
+	if err = cmd(connection, dir, name); err != nil {
+		renderClientFilesPage(w, connection, dir, getClientErrorMessage(err))
+		return
+	}
+	http.Redirect(w, r, getClientFilesURL(dir), http.StatusSeeOther)
+}
+
+func getClientFilesURL(dir string) string {
+	return fmt.Sprintf("%v?path=%v", webClientFilesPath, url.QueryEscape(dir))
+}
@@ -0,0 +1,129 @@
+// Package kms implements the encryption for the secrets stored inside the data provider,
+// such as the S3 access secrets, the GCS credentials and the TOTP secrets.
+// The secrets are encrypted using a pluggable secrets provider, the built-in "local" provider
+// uses a master key read from the configuration, an environment variable or a file.
+// Each Secret stores its status and, once encrypted, the provider and the key used, so a value
+// is never considered encrypted based on its shape.
+//
+// The secrets encrypted by older SFTPGo versions, using the "$aes$" format that stores the
+// key together with the data, can still be decrypted and they are re-encrypted at startup
+package kms
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	logSender = "kms"
+	// LocalProviderName defines the name for the built-in secrets provider
+	LocalProviderName = "local"
+	// the provider name used by the legacy format, it cannot be registered
+	legacyProviderName = "aes"
+	// nonce and authentication tag sizes for AES-GCM, used by the local provider and the
+	// legacy format
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+)
+
+var (
+	providerNameRegex = regexp.MustCompile("^[a-z0-9]+$")
+	errNotInitialized = errors.New("the secrets provider is not initialized")
+
+	registryMutex sync.RWMutex
+	registry      = map[string]ProviderFactory{
+		LocalProviderName: newLocalProvider,
+	}
+
+	stateMutex     sync.RWMutex
+	activeName     string
+	activeProvider SecretProvider
+)
+
+// Config defines the configuration for the secrets encryption
+type Config struct {
+	// Name of the secrets provider to use, "local" is the only built-in provider.
+	// Additional providers can be registered using RegisterProvider
+	Provider string `json:"provider" mapstructure:"provider"`
+	// Master key for the local provider. You should set it using the SFTPGO_KMS__MASTER_KEY
+	// environment variable instead of storing it inside the configuration file.
+	// If empty the master key is read from master_key_path
+	MasterKey string `json:"master_key" mapstructure:"master_key"`
+	// Path to the file containing the master key for the local provider. This can be an absolute
+	// path or a path relative to the config dir. If the file does not exist a new random master key
+	// is generated and saved to this path
+	MasterKeyPath string `json:"master_key_path" mapstructure:"master_key_path"`
+	// Paths to the files containing the previous master keys. They are used to decrypt the secrets
+	// that are not yet re-encrypted with the current master key
+	OldMasterKeyPaths []string `json:"old_master_key_paths" mapstructure:"old_master_key_paths"`
+}
+
+// SecretProvider defines the interface that a secrets provider must implement
+type SecretProvider interface {
+	// ActiveKeyID returns the ID of the key used to encrypt new secrets
+	ActiveKeyID() string
+	// Encrypt encrypts the given plain text using the active key and returns the payload
+	Encrypt(plaintext []byte) (string, error)
+	// Decrypt decrypts a payload encrypted using the key with the given ID
+	Decrypt(keyID, payload string) ([]byte, error)
+}
+
+// ProviderFactory creates a SecretProvider using the given configuration.
+// Relative paths must be resolved against configDir
+type ProviderFactory func(c Config, configDir string) (SecretProvider, error)
+
+// RegisterProvider registers a secrets provider with the given name.
+// The name can contain lowercase letters and digits only
+func RegisterProvider(name string, factory ProviderFactory) error {
+	if !providerNameRegex.MatchString(name) || name == legacyProviderName {
+		return fmt.Errorf("invalid secrets provider name %#v", name)
+	}
+	if factory == nil {
+		return fmt.Errorf("invalid factory for the secrets provider %#v", name)
+	}
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if _, ok := registry[name]; ok {
+		return fmt.Errorf("secrets provider %#v is already registered", name)
+	}
+	registry[name] = factory
+	return nil
+}
+
+// Initialize creates the configured secrets provider and makes it active
+func (c Config) Initialize(configDir string) error {
+	name := c.Provider
+	if len(name) == 0 {
+		name = LocalProviderName
+	}
+	registryMutex.RLock()
+	factory, ok := registry[name]
+	registryMutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown secrets provider %#v", name)
+	}
+	p, err := factory(c, configDir)
+	if err != nil {
+		return fmt.Errorf("unable to initialize the secrets provider %#v: %v", name, err)
+	}
+
+	stateMutex.Lock()
+	activeName = name
+	activeProvider = p
+	stateMutex.Unlock()
+
+	logger.Debug(logSender, "", "secrets provider %#v initialized, active key ID: %v", name, p.ActiveKeyID())
+	return nil
+}
+
+func getActiveProvider() (string, SecretProvider) {
+	stateMutex.RLock()
+	defer stateMutex.RUnlock()
+
+	return activeName, activeProvider
+}
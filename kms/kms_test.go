@@ -0,0 +1,382 @@
+package kms
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testMasterKey    = "0123456789abcdef0123456789abcdef"
+	testOldMasterKey = "fedcba9876543210fedcba9876543210"
+	// "legacy secret" encrypted using the legacy format
+	testLegacySecret = "$aes$a8a0aaa275a83aeb589a9848f5c03d09$896550a8c453abc4bfab4a4f0619ccc17d76e039b692020836d798c32f04" +
+		"f071a8e85d0f7e276762f9"
+)
+
+// reverseProvider is a test secrets provider, the payload is the hex encoded reversed plain text
+type reverseProvider struct{}
+
+func (p reverseProvider) ActiveKeyID() string {
+	return "test"
+}
+
+func (p reverseProvider) Encrypt(plaintext []byte) (string, error) {
+	return hex.EncodeToString(reverse(plaintext)), nil
+}
+
+func (p reverseProvider) Decrypt(keyID, payload string) ([]byte, error) {
+	if keyID != p.ActiveKeyID() {
+		return nil, errors.New("unknown key")
+	}
+	data, err := hex.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	return reverse(data), nil
+}
+
+func encryptSecret(t *testing.T, plaintext string) Secret {
+	secret := NewPlainSecret(plaintext)
+	if err := secret.Encrypt(); err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	return secret
+}
+
+func decryptSecret(secret Secret) (string, error) {
+	err := secret.Decrypt()
+	return secret.Payload, err
+}
+
+func reverse(data []byte) []byte {
+	result := make([]byte, len(data))
+	for i, b := range data {
+		result[len(data)-1-i] = b
+	}
+	return result
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	err := Config{MasterKey: testMasterKey}.Initialize(os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+	secret := encryptSecret(t, "my secret")
+	if !secret.IsEncrypted() || secret.Provider != LocalProviderName || len(secret.KeyID) != localKeyIDLen {
+		t.Errorf("unexpected encrypted secret: %+v", secret)
+	}
+	if err = secret.Validate(); err != nil {
+		t.Errorf("the encrypted secret must be valid: %v", err)
+	}
+	if strings.Contains(secret.Payload, testMasterKey) || strings.Contains(secret.Payload, hex.EncodeToString([]byte("my secret"))) {
+		t.Error("the encrypted secret must not contain the master key or the plain text")
+	}
+	if secret.NeedsReencryption() {
+		t.Error("a secret encrypted with the active key must not be re-encrypted")
+	}
+	if err = secret.Encrypt(); err == nil {
+		t.Error("encrypting an encrypted secret must fail")
+	}
+	secret1 := encryptSecret(t, "my secret")
+	if secret.Payload == secret1.Payload {
+		t.Error("the same plain text must produce different secrets")
+	}
+	plaintext, err := decryptSecret(secret)
+	if err != nil || plaintext != "my secret" {
+		t.Errorf("unexpected decrypted secret %#v, err: %v", plaintext, err)
+	}
+	redacted := secret.Redacted()
+	if !redacted.IsRedacted() || len(redacted.Payload) > 0 || redacted.Provider != secret.Provider ||
+		redacted.KeyID != secret.KeyID {
+		t.Errorf("unexpected redacted secret: %+v", redacted)
+	}
+	if err = redacted.Validate(); err == nil {
+		t.Error("a redacted secret must not be valid")
+	}
+	if _, err = decryptSecret(redacted); err == nil {
+		t.Error("decrypting a redacted secret must fail")
+	}
+	if _, err = decryptSecret(NewPlainSecret("plain")); err == nil {
+		t.Error("decrypting a plain secret must fail")
+	}
+	if !(Secret{}).Redacted().IsEmpty() {
+		t.Error("a redacted empty secret must be empty")
+	}
+	// a modified payload or key ID must be detected
+	modified := secret
+	payload := []byte(modified.Payload)
+	if payload[0] == '0' {
+		payload[0] = '1'
+	} else {
+		payload[0] = '0'
+	}
+	modified.Payload = string(payload)
+	if _, err = decryptSecret(modified); err == nil {
+		t.Error("decrypting a modified secret must fail")
+	}
+	for _, invalid := range []Secret{
+		{Status: SecretStatusEncrypted, Provider: LocalProviderName, KeyID: "abcd", Payload: secret.Payload},
+		{Status: SecretStatusEncrypted, Provider: LocalProviderName, KeyID: secret.KeyID, Payload: "invalid hex"},
+		{Status: SecretStatusEncrypted, Provider: LocalProviderName, KeyID: secret.KeyID, Payload: "abcd"},
+		{Status: SecretStatusEncrypted, Provider: LocalProviderName, KeyID: secret.KeyID},
+		{Status: SecretStatusEncrypted, Provider: LocalProviderName, Payload: secret.Payload},
+		{Status: SecretStatusEncrypted, Provider: "unknown", KeyID: secret.KeyID, Payload: secret.Payload},
+		{Status: SecretStatusEncrypted, Provider: legacyProviderName, Payload: "$aes$short$" + secret.Payload},
+		{Status: SecretStatusEncrypted, Provider: legacyProviderName, Payload: "$aes$a8a0aaa275a83aeb589a9848f5c03d09$not hex"},
+	} {
+		if _, err = decryptSecret(invalid); err == nil {
+			t.Errorf("decrypting %+v must fail", invalid)
+		}
+	}
+	for _, invalid := range []Secret{
+		{Payload: "payload"},
+		{Status: SecretStatusPlain},
+		{Status: "unknown", Payload: "payload"},
+		{Status: SecretStatusEncrypted, Provider: "unknown", KeyID: secret.KeyID, Payload: secret.Payload},
+	} {
+		if err = invalid.Validate(); err == nil {
+			t.Errorf("%+v must not be valid", invalid)
+		}
+	}
+	if err = (Secret{}).Validate(); err != nil {
+		t.Errorf("an empty secret must be valid: %v", err)
+	}
+}
+
+func TestSecretJSON(t *testing.T) {
+	err := Config{MasterKey: testMasterKey}.Initialize(os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+	secret := encryptSecret(t, "my secret")
+	data, err := json.Marshal(secret)
+	if err != nil {
+		t.Fatalf("unable to marshal the secret: %v", err)
+	}
+	var unmarshalled Secret
+	if err = json.Unmarshal(data, &unmarshalled); err != nil || unmarshalled != secret {
+		t.Errorf("unexpected unmarshalled secret %+v, err: %v", unmarshalled, err)
+	}
+	// strings are accepted for compatibility with older versions and the shape of a plain
+	// text value does not matter
+	ciphertext := "$" + secret.Provider + "$" + secret.KeyID + "$" + secret.Payload
+	for value, expected := range map[string]Secret{
+		`""`:                         {},
+		`{}`:                         {},
+		`{"status":"Plain"}`:         {},
+		`"plain"`:                    NewPlainSecret("plain"),
+		`"` + ciphertext + `"`:       NewPlainSecret(ciphertext),
+		`"` + testLegacySecret + `"`: {Status: SecretStatusEncrypted, Provider: legacyProviderName, Payload: testLegacySecret},
+	} {
+		unmarshalled = Secret{}
+		if err = json.Unmarshal([]byte(value), &unmarshalled); err != nil || unmarshalled != expected {
+			t.Errorf("unexpected secret for %v: %+v, err: %v", value, unmarshalled, err)
+		}
+	}
+	if err = json.Unmarshal([]byte(`{"status":1}`), &unmarshalled); err == nil {
+		t.Error("an invalid secret must fail")
+	}
+}
+
+func TestLegacySecret(t *testing.T) {
+	err := Config{MasterKey: testMasterKey}.Initialize(os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+	var secret Secret
+	if err = json.Unmarshal([]byte(`"`+testLegacySecret+`"`), &secret); err != nil {
+		t.Fatalf("unable to unmarshal the legacy secret: %v", err)
+	}
+	if err = secret.Validate(); err != nil {
+		t.Errorf("the legacy secret must be valid: %v", err)
+	}
+	if !secret.NeedsReencryption() {
+		t.Error("the legacy secret must be re-encrypted")
+	}
+	redacted := secret.Redacted()
+	if strings.Contains(redacted.Payload, "a8a0aaa275a83aeb589a9848f5c03d09") {
+		t.Errorf("the redacted legacy secret must not contain the key: %+v", redacted)
+	}
+	plaintext, err := decryptSecret(secret)
+	if err != nil || plaintext != "legacy secret" {
+		t.Errorf("unexpected decrypted legacy secret %#v, err: %v", plaintext, err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "kms")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(configDir)
+
+	err = Config{MasterKey: testOldMasterKey}.Initialize(configDir)
+	if err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+	oldSecret := encryptSecret(t, "rotated secret")
+	err = ioutil.WriteFile(filepath.Join(configDir, "old.key"), []byte(testOldMasterKey+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write the old master key: %v", err)
+	}
+	err = Config{MasterKey: testMasterKey}.Initialize(configDir)
+	if err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+	if !oldSecret.NeedsReencryption() {
+		t.Error("a secret encrypted with an old key must be re-encrypted")
+	}
+	_, err = decryptSecret(oldSecret)
+	if err == nil {
+		t.Error("decrypting a secret encrypted with a not configured key must fail")
+	}
+	err = Config{MasterKey: testMasterKey, OldMasterKeyPaths: []string{"old.key"}}.Initialize(configDir)
+	if err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+	plaintext, err := decryptSecret(oldSecret)
+	if err != nil || plaintext != "rotated secret" {
+		t.Errorf("unexpected decrypted secret %#v, err: %v", plaintext, err)
+	}
+	newSecret := encryptSecret(t, plaintext)
+	if newSecret.NeedsReencryption() || newSecret.KeyID == oldSecret.KeyID {
+		t.Errorf("the new secret must use the active key: %+v", newSecret)
+	}
+	err = Config{MasterKey: testMasterKey, OldMasterKeyPaths: []string{"missing.key"}}.Initialize(configDir)
+	if err == nil {
+		t.Error("a missing old master key must fail")
+	}
+	err = Config{MasterKey: testMasterKey, OldMasterKeyPaths: []string{""}}.Initialize(configDir)
+	if err == nil {
+		t.Error("an empty old master key path must fail")
+	}
+	err = ioutil.WriteFile(filepath.Join(configDir, "short.key"), []byte("short"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write the master key: %v", err)
+	}
+	err = Config{MasterKey: testMasterKey, OldMasterKeyPaths: []string{"short.key"}}.Initialize(configDir)
+	if err == nil {
+		t.Error("a short old master key must fail")
+	}
+}
+
+func TestMasterKeyFile(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "kms")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(configDir)
+
+	keyPath := filepath.Join(configDir, "master.key")
+	err = Config{MasterKeyPath: "master.key"}.Initialize(configDir)
+	if err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		t.Fatalf("the master key must be generated: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected permissions for the generated master key: %v", info.Mode())
+	}
+	secret := encryptSecret(t, "secret")
+	// the generated key is reused
+	err = Config{MasterKeyPath: keyPath}.Initialize(os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+	if secret.NeedsReencryption() {
+		t.Error("the generated master key must be reused")
+	}
+	// the master key from the configuration has the precedence
+	err = Config{MasterKey: testMasterKey, MasterKeyPath: keyPath}.Initialize(configDir)
+	if err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+	if !secret.NeedsReencryption() {
+		t.Error("the configured master key must be used")
+	}
+	err = Config{}.Initialize(configDir)
+	if err == nil {
+		t.Error("a missing master key must fail")
+	}
+	err = Config{MasterKey: "short"}.Initialize(configDir)
+	if err == nil {
+		t.Error("a short master key must fail")
+	}
+	err = Config{MasterKeyPath: filepath.Join(configDir, "missing", "master.key")}.Initialize(configDir)
+	if err == nil {
+		t.Error("a master key that cannot be saved must fail")
+	}
+}
+
+func TestRegisterProvider(t *testing.T) {
+	factory := func(c Config, configDir string) (SecretProvider, error) {
+		return reverseProvider{}, nil
+	}
+	for _, name := range []string{"", "aes", "Test", "test$"} {
+		if err := RegisterProvider(name, factory); err == nil {
+			t.Errorf("registering the provider %#v must fail", name)
+		}
+	}
+	if err := RegisterProvider("reverse", nil); err == nil {
+		t.Error("registering a nil factory must fail")
+	}
+	if err := RegisterProvider("reverse", factory); err != nil {
+		t.Fatalf("unable to register the provider: %v", err)
+	}
+	if err := RegisterProvider("reverse", factory); err == nil {
+		t.Error("registering a provider twice must fail")
+	}
+	if err := RegisterProvider(LocalProviderName, factory); err == nil {
+		t.Error("registering the local provider must fail")
+	}
+	err := RegisterProvider("failing", func(c Config, configDir string) (SecretProvider, error) {
+		return nil, errors.New("failing provider")
+	})
+	if err != nil {
+		t.Fatalf("unable to register the provider: %v", err)
+	}
+	if err = (Config{Provider: "failing"}).Initialize(os.TempDir()); err == nil {
+		t.Error("a failing provider must return an error")
+	}
+	if err = (Config{Provider: "unknown"}).Initialize(os.TempDir()); err == nil {
+		t.Error("an unknown provider must fail")
+	}
+
+	err = Config{MasterKey: testMasterKey}.Initialize(os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+	localSecret := encryptSecret(t, "secret")
+	err = Config{Provider: "reverse"}.Initialize(os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize kms: %v", err)
+	}
+	secret := encryptSecret(t, "secret")
+	expected := Secret{
+		Status:   SecretStatusEncrypted,
+		Payload:  hex.EncodeToString([]byte("terces")),
+		Provider: "reverse",
+		KeyID:    "test",
+	}
+	if secret != expected {
+		t.Errorf("unexpected secret: %+v", secret)
+	}
+	plaintext, err := decryptSecret(secret)
+	if err != nil || plaintext != "secret" {
+		t.Errorf("unexpected decrypted secret %#v, err: %v", plaintext, err)
+	}
+	if !localSecret.NeedsReencryption() {
+		t.Error("a secret encrypted by a different provider must be re-encrypted")
+	}
+	if _, err = decryptSecret(localSecret); err == nil {
+		t.Error("decrypting a secret encrypted by a not active provider must fail")
+	}
+}
@@ -0,0 +1,161 @@
+package kms
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	minMasterKeyLen  = 32
+	localKeySize     = 32
+	localKeyIDLen    = 16
+	localKeyInfo     = "SFTPGo local secrets provider"
+	generatedKeySize = 32
+)
+
+// localProvider encrypts the secrets using AES-256-GCM with keys derived from the configured
+// master keys. The old master keys are only used to decrypt
+type localProvider struct {
+	activeKeyID string
+	keys        map[string]cipher.AEAD
+}
+
+func newLocalProvider(c Config, configDir string) (SecretProvider, error) {
+	p := &localProvider{
+		keys: make(map[string]cipher.AEAD),
+	}
+	masterKey := strings.TrimSpace(c.MasterKey)
+	if len(masterKey) == 0 {
+		keyPath := getKeyPath(c.MasterKeyPath, configDir)
+		if len(keyPath) == 0 {
+			return nil, errors.New("a master key or a master key path is required")
+		}
+		var err error
+		masterKey, err = readOrGenerateMasterKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	keyID, err := p.addKey(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	p.activeKeyID = keyID
+	for _, oldKeyPath := range c.OldMasterKeyPaths {
+		keyPath := getKeyPath(oldKeyPath, configDir)
+		if len(keyPath) == 0 {
+			return nil, fmt.Errorf("invalid old master key path %#v", oldKeyPath)
+		}
+		oldKey, err := readMasterKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.addKey(oldKey); err != nil {
+			return nil, fmt.Errorf("invalid old master key %#v: %v", keyPath, err)
+		}
+	}
+	return p, nil
+}
+
+func (p *localProvider) addKey(masterKey string) (string, error) {
+	if len(masterKey) < minMasterKeyLen {
+		return "", fmt.Errorf("the master key must be at least %v characters long", minMasterKeyLen)
+	}
+	key := make([]byte, localKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(masterKey), nil, []byte(localKeyInfo)), key); err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	// the key ID is derived from the encryption key, so the master key cannot be recovered from it
+	hash := sha256.Sum256(key)
+	keyID := hex.EncodeToString(hash[:])[:localKeyIDLen]
+	p.keys[keyID] = gcm
+	return keyID, nil
+}
+
+func (p *localProvider) ActiveKeyID() string {
+	return p.activeKeyID
+}
+
+func (p *localProvider) Encrypt(plaintext []byte) (string, error) {
+	gcm := p.keys[p.activeKeyID]
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	// the key ID is authenticated, so a payload cannot be moved to a different key ID
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, []byte(p.activeKeyID))
+	return hex.EncodeToString(ciphertext), nil
+}
+
+func (p *localProvider) Decrypt(keyID, payload string) ([]byte, error) {
+	gcm, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key ID %#v, please configure the old master key", keyID)
+	}
+	encrypted, err := hex.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) < gcm.NonceSize() {
+		return nil, errors.New("the encrypted payload is too short")
+	}
+	nonce, ciphertext := encrypted[:gcm.NonceSize()], encrypted[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, []byte(keyID))
+}
+
+func getKeyPath(keyPath, configDir string) string {
+	if !utils.IsFileInputValid(keyPath) {
+		return ""
+	}
+	if !filepath.IsAbs(keyPath) {
+		return filepath.Join(configDir, keyPath)
+	}
+	return keyPath
+}
+
+func readMasterKey(keyPath string) (string, error) {
+	content, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the master key: %v", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func readOrGenerateMasterKey(keyPath string) (string, error) {
+	if _, err := os.Stat(keyPath); err == nil || !os.IsNotExist(err) {
+		return readMasterKey(keyPath)
+	}
+	key := make([]byte, generatedKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	masterKey := hex.EncodeToString(key)
+	if err := ioutil.WriteFile(keyPath, []byte(masterKey+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("unable to save the generated master key: %v", err)
+	}
+	logger.Info(logSender, "", "new master key generated and saved to %#v, please keep a copy in a safe place: "+
+		"the stored secrets cannot be decrypted without it", keyPath)
+	return masterKey, nil
+}
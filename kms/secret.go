@@ -0,0 +1,252 @@
+package kms
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// SecretStatus defines the status of a Secret
+type SecretStatus = string
+
+// supported secret statuses
+const (
+	// SecretStatusPlain means the payload is the plain text secret, it is encrypted
+	// before saving it to the data provider
+	SecretStatusPlain SecretStatus = "Plain"
+	// SecretStatusEncrypted means the payload is encrypted using the secrets provider
+	// and the key defined inside the secret
+	SecretStatusEncrypted SecretStatus = "Encrypted"
+	// SecretStatusRedacted means the payload was removed, this is how the secrets are
+	// returned by the REST API. A redacted secret sent back to the REST API keeps the
+	// current value
+	SecretStatusRedacted SecretStatus = "Redacted"
+)
+
+const legacySecretPrefix = "$" + legacyProviderName + "$"
+
+// Secret defines a secret stored inside the data provider
+type Secret struct {
+	Status SecretStatus `json:"status,omitempty"`
+	// Payload is the plain text secret or the encrypted one, as returned by the secrets provider
+	Payload string `json:"payload,omitempty"`
+	// Provider and KeyID identify the secrets provider and the key used to encrypt the payload.
+	// The secrets encrypted using the legacy format have "aes" as provider and no key ID,
+	// the payload is the whole legacy value
+	Provider string `json:"provider,omitempty"`
+	KeyID    string `json:"key_id,omitempty"`
+}
+
+// NewPlainSecret returns a plain text secret with the given payload,
+// an empty payload means an empty secret
+func NewPlainSecret(payload string) Secret {
+	if len(payload) == 0 {
+		return Secret{}
+	}
+	return Secret{
+		Status:  SecretStatusPlain,
+		Payload: payload,
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Older SFTPGo versions stored the secrets as
+// strings: an empty string is an empty secret, a string with the legacy "$aes$" prefix is
+// encrypted using the legacy format and any other string is a plain text secret
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		if strings.HasPrefix(value, legacySecretPrefix) {
+			*s = Secret{
+				Status:   SecretStatusEncrypted,
+				Payload:  value,
+				Provider: legacyProviderName,
+			}
+			return nil
+		}
+		*s = NewPlainSecret(value)
+		return nil
+	}
+	type secret Secret
+	var result secret
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	*s = Secret(result)
+	if s.IsPlain() && len(s.Payload) == 0 {
+		*s = Secret{}
+	}
+	return nil
+}
+
+// IsEmpty returns true if the secret has no value
+func (s Secret) IsEmpty() bool {
+	return len(s.Status) == 0
+}
+
+// IsPlain returns true if the secret is in plain text
+func (s Secret) IsPlain() bool {
+	return s.Status == SecretStatusPlain
+}
+
+// IsEncrypted returns true if the secret is encrypted
+func (s Secret) IsEncrypted() bool {
+	return s.Status == SecretStatusEncrypted
+}
+
+// IsRedacted returns true if the secret payload was removed
+func (s Secret) IsRedacted() bool {
+	return s.Status == SecretStatusRedacted
+}
+
+// Validate returns an error if the secret status, provider or payload are not valid.
+// Redacted secrets are not valid, they must be replaced with the current value
+func (s Secret) Validate() error {
+	switch s.Status {
+	case "":
+		if len(s.Payload) > 0 || len(s.Provider) > 0 || len(s.KeyID) > 0 {
+			return errors.New("the secret status is required")
+		}
+		return nil
+	case SecretStatusPlain:
+		if len(s.Payload) == 0 {
+			return errors.New("the plain secret has no payload")
+		}
+		return nil
+	case SecretStatusEncrypted:
+		return s.validateEncrypted()
+	case SecretStatusRedacted:
+		return errors.New("a redacted secret cannot be saved, the current value is not available")
+	default:
+		return fmt.Errorf("invalid secret status %#v", s.Status)
+	}
+}
+
+func (s Secret) validateEncrypted() error {
+	if len(s.Payload) == 0 {
+		return errors.New("the encrypted secret has no payload")
+	}
+	if s.Provider == legacyProviderName {
+		if !isValidLegacyPayload(s.Payload) {
+			return errors.New("invalid secret encrypted using the legacy format")
+		}
+		return nil
+	}
+	if len(s.KeyID) == 0 {
+		return fmt.Errorf("the secret encrypted by the secrets provider %#v has no key ID", s.Provider)
+	}
+	registryMutex.RLock()
+	_, ok := registry[s.Provider]
+	registryMutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown secrets provider %#v", s.Provider)
+	}
+	return nil
+}
+
+// Encrypt encrypts a plain text secret using the active secrets provider and key
+func (s *Secret) Encrypt() error {
+	if !s.IsPlain() {
+		return fmt.Errorf("unable to encrypt a secret with status %#v", s.Status)
+	}
+	name, p := getActiveProvider()
+	if p == nil {
+		return errNotInitialized
+	}
+	payload, err := p.Encrypt([]byte(s.Payload))
+	if err != nil {
+		return err
+	}
+	*s = Secret{
+		Status:   SecretStatusEncrypted,
+		Payload:  payload,
+		Provider: name,
+		KeyID:    p.ActiveKeyID(),
+	}
+	return nil
+}
+
+// Decrypt replaces an encrypted secret with its plain text
+func (s *Secret) Decrypt() error {
+	if !s.IsEncrypted() {
+		return fmt.Errorf("unable to decrypt a secret with status %#v", s.Status)
+	}
+	if err := s.validateEncrypted(); err != nil {
+		return err
+	}
+	var plaintext string
+	if s.Provider == legacyProviderName {
+		var err error
+		plaintext, err = utils.DecryptData(s.Payload)
+		if err != nil {
+			return err
+		}
+	} else {
+		name, p := getActiveProvider()
+		if p == nil {
+			return errNotInitialized
+		}
+		if s.Provider != name {
+			return fmt.Errorf("unable to decrypt a secret encrypted by the secrets provider %#v, active provider: %#v",
+				s.Provider, name)
+		}
+		data, err := p.Decrypt(s.KeyID, s.Payload)
+		if err != nil {
+			return err
+		}
+		plaintext = string(data)
+	}
+	*s = Secret{
+		Status:  SecretStatusPlain,
+		Payload: plaintext,
+	}
+	return nil
+}
+
+// NeedsReencryption returns true if the secret is encrypted using the legacy format,
+// a different secrets provider or a key that is not the active one
+func (s Secret) NeedsReencryption() bool {
+	if !s.IsEncrypted() {
+		return false
+	}
+	name, p := getActiveProvider()
+	if p == nil {
+		return false
+	}
+	return s.Provider != name || s.KeyID != p.ActiveKeyID()
+}
+
+// Redacted returns a copy of the secret without the payload, so it can be safely returned
+// by the REST API. The provider and the key ID are preserved
+func (s Secret) Redacted() Secret {
+	if s.IsEmpty() {
+		return s
+	}
+	return Secret{
+		Status:   SecretStatusRedacted,
+		Provider: s.Provider,
+		KeyID:    s.KeyID,
+	}
+}
+
+// isValidLegacyPayload returns true for the "$aes$<key>$<hex encoded nonce and data>"
+// format used by older SFTPGo versions
+func isValidLegacyPayload(payload string) bool {
+	vals := strings.Split(payload, "$")
+	if len(vals) != 4 || len(vals[0]) != 0 || vals[1] != legacyProviderName {
+		return false
+	}
+	switch len(vals[2]) {
+	case 16, 24, 32:
+	default:
+		return false
+	}
+	data, err := hex.DecodeString(vals[3])
+	if err != nil {
+		return false
+	}
+	return len(data) >= gcmNonceSize+gcmTagSize
+}
@@ -19,6 +19,20 @@ var (
 		Help: "Total number of logged in users",
 	})
 
+	// totalRejectedMaxConnections is the metric that reports the total number of connections
+	// rejected because the max total connections limit was exceeded
+	totalRejectedMaxConnections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_rejected_connections_max_total",
+		Help: "The total number of connections rejected because the max total connections limit was exceeded",
+	})
+
+	// totalRejectedMaxPerHostConnections is the metric that reports the total number of connections
+	// rejected because the max connections per host limit was exceeded
+	totalRejectedMaxPerHostConnections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_rejected_connections_max_per_host",
+		Help: "The total number of connections rejected because the max connections per host limit was exceeded",
+	})
+
 	// totalUploads is the metric that reports the total number of successful SFTP/SCP uploads
 	totalUploads = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "sftpgo_uploads_total",
@@ -127,6 +141,27 @@ var (
 		Help: "The total number of failed logins using a public key",
 	})
 
+	// totalCertLoginAttempts is the metric that reports the total number of login attempts
+	// using an SSH user certificate
+	totalCertLoginAttempts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_certificate_login_attempts_total",
+		Help: "The total number of login attempts using an SSH user certificate",
+	})
+
+	// totalCertLoginOK is the metric that reports the total number of successful logins
+	// using an SSH user certificate
+	totalCertLoginOK = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_certificate_login_ok_total",
+		Help: "The total number of successful logins using an SSH user certificate",
+	})
+
+	// totalCertLoginFailed is the metric that reports the total number of failed logins
+	// using an SSH user certificate
+	totalCertLoginFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_certificate_login_ko_total",
+		Help: "The total number of failed logins using an SSH user certificate",
+	})
+
 	// totalInteractiveLoginAttempts is the metric that reports the total number of login attempts
 	// using keyboard interactive authentication
 	totalInteractiveLoginAttempts = promauto.NewCounter(prometheus.CounterOpts{
@@ -148,6 +183,48 @@ var (
 		Help: "The total number of failed logins using keyboard interactive authentication",
 	})
 
+	// totalKeyAndPasswordLoginAttempts is the metric that reports the total number of
+	// login attempts using a public key followed by a password
+	totalKeyAndPasswordLoginAttempts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_key_and_password_login_attempts_total",
+		Help: "The total number of login attempts using a public key followed by a password",
+	})
+
+	// totalKeyAndPasswordLoginOK is the metric that reports the total number of
+	// successful logins using a public key followed by a password
+	totalKeyAndPasswordLoginOK = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_key_and_password_login_ok_total",
+		Help: "The total number of successful logins using a public key followed by a password",
+	})
+
+	// totalKeyAndPasswordLoginFailed is the metric that reports the total number of
+	// failed logins using a public key followed by a password
+	totalKeyAndPasswordLoginFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_key_and_password_login_ko_total",
+		Help: "The total number of failed logins using a public key followed by a password",
+	})
+
+	// totalKeyAndKeyIntLoginAttempts is the metric that reports the total number of
+	// login attempts using a public key followed by keyboard interactive authentication
+	totalKeyAndKeyIntLoginAttempts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_key_and_keyboard_int_login_attempts_total",
+		Help: "The total number of login attempts using a public key followed by keyboard interactive authentication",
+	})
+
+	// totalKeyAndKeyIntLoginOK is the metric that reports the total number of
+	// successful logins using a public key followed by keyboard interactive authentication
+	totalKeyAndKeyIntLoginOK = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_key_and_keyboard_int_login_ok_total",
+		Help: "The total number of successful logins using a public key followed by keyboard interactive authentication",
+	})
+
+	// totalKeyAndKeyIntLoginFailed is the metric that reports the total number of
+	// failed logins using a public key followed by keyboard interactive authentication
+	totalKeyAndKeyIntLoginFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_key_and_keyboard_int_login_ko_total",
+		Help: "The total number of failed logins using a public key followed by keyboard interactive authentication",
+	})
+
 	totalHTTPRequests = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "sftpgo_http_req_total",
 		Help: "The total number of HTTP requests served",
@@ -335,6 +412,120 @@ var (
 		Name: "sftpgo_gcs_head_bucket_errors",
 		Help: "The total number of GCS head bucket errors",
 	})
+
+	// totalAzUploads is the metric that reports the total number of successful Azure Blob uploads
+	totalAzUploads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_uploads_total",
+		Help: "The total number of successful Azure Blob uploads",
+	})
+
+	// totalAzDownloads is the metric that reports the total number of successful Azure Blob downloads
+	totalAzDownloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_downloads_total",
+		Help: "The total number of successful Azure Blob downloads",
+	})
+
+	// totalAzUploadErrors is the metric that reports the total number of Azure Blob upload errors
+	totalAzUploadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_upload_errors_total",
+		Help: "The total number of Azure Blob upload errors",
+	})
+
+	// totalAzDownloadErrors is the metric that reports the total number of Azure Blob download errors
+	totalAzDownloadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_download_errors_total",
+		Help: "The total number of Azure Blob download errors",
+	})
+
+	// totalAzUploadSize is the metric that reports the total Azure Blob uploads size as bytes
+	totalAzUploadSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_upload_size",
+		Help: "The total Azure Blob upload size as bytes, partial uploads are included",
+	})
+
+	// totalAzDownloadSize is the metric that reports the total Azure Blob downloads size as bytes
+	totalAzDownloadSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_download_size",
+		Help: "The total Azure Blob download size as bytes, partial downloads are included",
+	})
+
+	// totalAzListObjects is the metric that reports the total successful Azure Blob list objects requests
+	totalAzListObjects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_list_objects",
+		Help: "The total number of successful Azure Blob list objects requests",
+	})
+
+	// totalAzCopyObject is the metric that reports the total successful Azure Blob copy object requests
+	totalAzCopyObject = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_copy_object",
+		Help: "The total number of successful Azure Blob copy object requests",
+	})
+
+	// totalAzDeleteObject is the metric that reports the total successful Azure Blob delete object requests
+	totalAzDeleteObject = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_delete_object",
+		Help: "The total number of successful Azure Blob delete object requests",
+	})
+
+	// totalAzListObjectsError is the metric that reports the total Azure Blob list objects errors
+	totalAzListObjectsErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_list_objects_errors",
+		Help: "The total number of Azure Blob list objects errors",
+	})
+
+	// totalAzCopyObjectErrors is the metric that reports the total Azure Blob copy object errors
+	totalAzCopyObjectErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_copy_object_errors",
+		Help: "The total number of Azure Blob copy object errors",
+	})
+
+	// totalAzDeleteObjectErrors is the metric that reports the total Azure Blob delete object errors
+	totalAzDeleteObjectErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_delete_object_errors",
+		Help: "The total number of Azure Blob delete object errors",
+	})
+
+	// totalAzHeadContainer is the metric that reports the total successful Azure Blob get container properties requests
+	totalAzHeadContainer = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_head_container",
+		Help: "The total number of successful Azure Blob get container properties requests",
+	})
+
+	// totalAzHeadContainerErrors is the metric that reports the total Azure Blob get container properties errors
+	totalAzHeadContainerErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_head_container_errors",
+		Help: "The total number of Azure Blob get container properties errors",
+	})
+
+	// totalBackups is the metric that reports the total number of successful scheduled backups
+	totalBackups = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_backups_total",
+		Help: "The total number of successful scheduled backups",
+	})
+
+	// totalBackupErrors is the metric that reports the total number of scheduled backup errors
+	totalBackupErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_backup_errors_total",
+		Help: "The total number of scheduled backup errors",
+	})
+
+	// lastBackupTimestamp is the metric that reports the time of the last scheduled backup
+	lastBackupTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_last_backup_timestamp",
+		Help: "The time of the last scheduled backup as unix timestamp, successful or not",
+	})
+
+	// lastBackupSuccess is the metric that reports the result of the last scheduled backup
+	lastBackupSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_last_backup_success",
+		Help: "Result for the last scheduled backup, 1 means OK, 0 KO",
+	})
+
+	// lastBackupSize is the metric that reports the size of the last successful scheduled backup
+	lastBackupSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_last_backup_size",
+		Help: "The size of the last successful scheduled backup as bytes",
+	})
 )
 
 // TransferCompleted updates metrics after an upload or a download
@@ -472,6 +663,63 @@ func GCSHeadBucketCompleted(err error) {
 	}
 }
 
+// AzTransferCompleted updates metrics after an Azure Blob upload or a download
+func AzTransferCompleted(bytes int64, transferKind int, err error) {
+	if transferKind == 0 {
+		// upload
+		if err == nil {
+			totalAzUploads.Inc()
+		} else {
+			totalAzUploadErrors.Inc()
+		}
+		totalAzUploadSize.Add(float64(bytes))
+	} else {
+		// download
+		if err == nil {
+			totalAzDownloads.Inc()
+		} else {
+			totalAzDownloadErrors.Inc()
+		}
+		totalAzDownloadSize.Add(float64(bytes))
+	}
+}
+
+// AzListObjectsCompleted updates metrics after an Azure Blob list objects request terminates
+func AzListObjectsCompleted(err error) {
+	if err == nil {
+		totalAzListObjects.Inc()
+	} else {
+		totalAzListObjectsErrors.Inc()
+	}
+}
+
+// AzCopyObjectCompleted updates metrics after an Azure Blob copy object request terminates
+func AzCopyObjectCompleted(err error) {
+	if err == nil {
+		totalAzCopyObject.Inc()
+	} else {
+		totalAzCopyObjectErrors.Inc()
+	}
+}
+
+// AzDeleteObjectCompleted updates metrics after an Azure Blob delete object request terminates
+func AzDeleteObjectCompleted(err error) {
+	if err == nil {
+		totalAzDeleteObject.Inc()
+	} else {
+		totalAzDeleteObjectErrors.Inc()
+	}
+}
+
+// AzHeadContainerCompleted updates metrics after an Azure Blob get container properties request terminates
+func AzHeadContainerCompleted(err error) {
+	if err == nil {
+		totalAzHeadContainer.Inc()
+	} else {
+		totalAzHeadContainerErrors.Inc()
+	}
+}
+
 // SSHCommandCompleted update metrics after an SSH command terminates
 func SSHCommandCompleted(err error) {
 	if err == nil {
@@ -496,8 +744,14 @@ func AddLoginAttempt(authMethod string) {
 	switch authMethod {
 	case "publickey":
 		totalKeyLoginAttempts.Inc()
+	case "publickey-cert":
+		totalCertLoginAttempts.Inc()
 	case "keyboard-interactive":
 		totalInteractiveLoginAttempts.Inc()
+	case "publickey,password":
+		totalKeyAndPasswordLoginAttempts.Inc()
+	case "publickey,keyboard-interactive":
+		totalKeyAndKeyIntLoginAttempts.Inc()
 	default:
 		totalPasswordLoginAttempts.Inc()
 	}
@@ -510,8 +764,14 @@ func AddLoginResult(authMethod string, err error) {
 		switch authMethod {
 		case "publickey":
 			totalKeyLoginOK.Inc()
+		case "publickey-cert":
+			totalCertLoginOK.Inc()
 		case "keyboard-interactive":
 			totalInteractiveLoginOK.Inc()
+		case "publickey,password":
+			totalKeyAndPasswordLoginOK.Inc()
+		case "publickey,keyboard-interactive":
+			totalKeyAndKeyIntLoginOK.Inc()
 		default:
 			totalPasswordLoginOK.Inc()
 		}
@@ -520,8 +780,14 @@ func AddLoginResult(authMethod string, err error) {
 		switch authMethod {
 		case "publickey":
 			totalKeyLoginFailed.Inc()
+		case "publickey-cert":
+			totalCertLoginFailed.Inc()
 		case "keyboard-interactive":
 			totalInteractiveLoginFailed.Inc()
+		case "publickey,password":
+			totalKeyAndPasswordLoginFailed.Inc()
+		case "publickey,keyboard-interactive":
+			totalKeyAndKeyIntLoginFailed.Inc()
 		default:
 			totalPasswordLoginFailed.Inc()
 		}
@@ -544,3 +810,25 @@ func HTTPRequestServed(status int) {
 func UpdateActiveConnectionsSize(size int) {
 	activeConnections.Set(float64(size))
 }
+
+// AddRejectedConnection increments the metrics for the connections rejected because a limit was exceeded
+func AddRejectedConnection(perHostLimit bool) {
+	if perHostLimit {
+		totalRejectedMaxPerHostConnections.Inc()
+	} else {
+		totalRejectedMaxConnections.Inc()
+	}
+}
+
+// BackupCompleted updates the metrics after a scheduled backup
+func BackupCompleted(size int64, err error) {
+	lastBackupTimestamp.SetToCurrentTime()
+	if err == nil {
+		totalBackups.Inc()
+		lastBackupSuccess.Set(1)
+		lastBackupSize.Set(float64(size))
+	} else {
+		totalBackupErrors.Inc()
+		lastBackupSuccess.Set(0)
+	}
+}
@@ -3,6 +3,7 @@ import argparse
 import base64
 from datetime import datetime
 import json
+import os
 import platform
 import sys
 import time
@@ -28,21 +29,40 @@ except ImportError:
 	pwd = None
 
 
+class HTTPBearerAuth(requests.auth.AuthBase):
+
+	def __init__(self, token):
+		self.token = token
+
+	def __call__(self, r):
+		r.headers['Authorization'] = 'Bearer ' + self.token
+		return r
+
+
 class SFTPGoApiRequests:
 
-	def __init__(self, debug, baseUrl, authType, authUser, authPassword, secure, no_color):
+	def __init__(self, debug, baseUrl, authType, authUser, authPassword, authToken, secure, no_color):
 		self.userPath = urlparse.urljoin(baseUrl, '/api/v1/user')
+		self.groupPath = urlparse.urljoin(baseUrl, '/api/v1/group')
+		self.sharePath = urlparse.urljoin(baseUrl, '/api/v1/share')
+		self.adminPath = urlparse.urljoin(baseUrl, '/api/v1/admin')
+		self.tokenPath = urlparse.urljoin(baseUrl, '/api/v1/token')
+		self.apiKeyPath = urlparse.urljoin(baseUrl, '/api/v1/apikey')
 		self.quotaScanPath = urlparse.urljoin(baseUrl, '/api/v1/quota_scan')
+		self.defenderBansPath = urlparse.urljoin(baseUrl, '/api/v1/defender/bans')
 		self.activeConnectionsPath = urlparse.urljoin(baseUrl, '/api/v1/connection')
 		self.versionPath = urlparse.urljoin(baseUrl, '/api/v1/version')
 		self.providerStatusPath = urlparse.urljoin(baseUrl, '/api/v1/providerstatus')
 		self.dumpDataPath = urlparse.urljoin(baseUrl, '/api/v1/dumpdata')
 		self.loadDataPath = urlparse.urljoin(baseUrl, '/api/v1/loaddata')
+		self.backupStatusPath = urlparse.urljoin(baseUrl, '/api/v1/backupstatus')
 		self.debug = debug
 		if authType == 'basic':
 			self.auth = requests.auth.HTTPBasicAuth(authUser, authPassword)
 		elif authType == 'digest':
 			self.auth = requests.auth.HTTPDigestAuth(authUser, authPassword)
+		elif authType == 'bearer':
+			self.auth = HTTPBearerAuth(authToken)
 		else:
 			self.auth = None
 		self.verify = secure
@@ -76,8 +96,13 @@ class SFTPGoApiRequests:
 					status=1, expiration_date=0, allowed_ip=[], denied_ip=[], fs_provider='local', s3_bucket='',
 					s3_region='', s3_access_key='', s3_access_secret='', s3_endpoint='', s3_storage_class='',
 					s3_key_prefix='', gcs_bucket='', gcs_key_prefix='', gcs_storage_class='', gcs_credentials_file='',
-					gcs_automatic_credentials='automatic', denied_login_methods=[], virtual_folders=[],
-					denied_extensions=[], allowed_extensions=[], s3_upload_part_size=0, s3_upload_concurrency=0):
+					gcs_automatic_credentials='automatic', denied_login_methods=[], required_login_methods=[],
+					virtual_folders=[], denied_extensions=[], allowed_extensions=[], s3_upload_part_size=0,
+					s3_upload_concurrency=0,
+					primary_group='', secondary_groups=[], az_container='', az_account_name='', az_account_key='',
+					az_sas_url='', az_endpoint='', az_key_prefix='', az_upload_part_size=0, az_upload_concurrency=0,
+					az_use_emulator=False, az_access_tier='', sftp_endpoint='', sftp_username='', sftp_password='',
+					sftp_private_key_path='', sftp_fingerprints=[], sftp_prefix='', crypt_passphrase=''):
 		user = {'id':user_id, 'username':username, 'uid':uid, 'gid':gid,
 			'max_sessions':max_sessions, 'quota_size':quota_size, 'quota_files':quota_files,
 			'upload_bandwidth':upload_bandwidth, 'download_bandwidth':download_bandwidth,
@@ -95,15 +120,33 @@ class SFTPGoApiRequests:
 			user.update({'permissions':permissions})
 		if virtual_folders:
 			user.update({'virtual_folders':self.buildVirtualFolders(virtual_folders)})
-		if allowed_ip or denied_ip or denied_login_methods or allowed_extensions or denied_extensions:
+		if (allowed_ip or denied_ip or denied_login_methods or required_login_methods or allowed_extensions or
+				denied_extensions):
 			user.update({'filters':self.buildFilters(allowed_ip, denied_ip, denied_login_methods, denied_extensions,
-													allowed_extensions)})
+													allowed_extensions, required_login_methods)})
 		user.update({'filesystem':self.buildFsConfig(fs_provider, s3_bucket, s3_region, s3_access_key, s3_access_secret,
 													s3_endpoint, s3_storage_class, s3_key_prefix, gcs_bucket,
 													gcs_key_prefix, gcs_storage_class, gcs_credentials_file,
-													gcs_automatic_credentials, s3_upload_part_size, s3_upload_concurrency)})
+													gcs_automatic_credentials, s3_upload_part_size, s3_upload_concurrency,
+													az_container, az_account_name, az_account_key, az_sas_url,
+													az_endpoint, az_key_prefix, az_upload_part_size,
+													az_upload_concurrency, az_use_emulator, az_access_tier,
+													sftp_endpoint, sftp_username, sftp_password,
+													sftp_private_key_path, sftp_fingerprints, sftp_prefix,
+													crypt_passphrase)})
+		if primary_group or secondary_groups:
+			user.update({'groups':self.buildUserGroups(primary_group, secondary_groups)})
 		return user
 
+	def buildUserGroups(self, primary_group, secondary_groups):
+		groups = []
+		if primary_group:
+			groups.append({'name':primary_group, 'type':1})
+		for g in secondary_groups:
+			if g:
+				groups.append({'name':g, 'type':2})
+		return groups
+
 	def buildVirtualFolders(self, vfolders):
 		result = []
 		for f in vfolders:
@@ -135,7 +178,8 @@ class SFTPGoApiRequests:
 					permissions.update({directory:values})
 		return permissions
 
-	def buildFilters(self, allowed_ip, denied_ip, denied_login_methods, denied_extensions, allowed_extensions):
+	def buildFilters(self, allowed_ip, denied_ip, denied_login_methods, denied_extensions, allowed_extensions,
+					required_login_methods=[]):
 		filters = {}
 		if allowed_ip:
 			if len(allowed_ip) == 1 and not allowed_ip[0]:
@@ -152,6 +196,11 @@ class SFTPGoApiRequests:
 				filters.update({'denied_login_methods':[]})
 			else:
 				filters.update({'denied_login_methods':denied_login_methods})
+		if required_login_methods:
+			if len(required_login_methods) == 1 and not required_login_methods[0]:
+				filters.update({'required_login_methods':[]})
+			else:
+				filters.update({'required_login_methods':required_login_methods})
 		extensions_filter = []
 		extensions_denied = []
 		extensions_allowed = []
@@ -202,14 +251,23 @@ class SFTPGoApiRequests:
 			filters.update({'file_extensions':extensions_filter})
 		return filters
 
+	def buildSecret(self, payload):
+		if payload:
+			return {'status':'Plain', 'payload':payload}
+		return {}
+
 	def buildFsConfig(self, fs_provider, s3_bucket, s3_region, s3_access_key, s3_access_secret, s3_endpoint,
 					s3_storage_class, s3_key_prefix, gcs_bucket, gcs_key_prefix, gcs_storage_class,
-					gcs_credentials_file, gcs_automatic_credentials, s3_upload_part_size, s3_upload_concurrency):
+					gcs_credentials_file, gcs_automatic_credentials, s3_upload_part_size, s3_upload_concurrency,
+					az_container='', az_account_name='', az_account_key='', az_sas_url='', az_endpoint='',
+					az_key_prefix='', az_upload_part_size=0, az_upload_concurrency=0, az_use_emulator=False,
+					az_access_tier='', sftp_endpoint='', sftp_username='', sftp_password='', sftp_private_key_path='',
+					sftp_fingerprints=[], sftp_prefix='', crypt_passphrase=''):
 		fs_config = {'provider':0}
 		if fs_provider == 'S3':
 			s3config = {'bucket':s3_bucket, 'region':s3_region, 'access_key':s3_access_key, 'access_secret':
-					s3_access_secret, 'endpoint':s3_endpoint, 'storage_class':s3_storage_class, 'key_prefix':
-					s3_key_prefix, 'upload_part_size':s3_upload_part_size, 'upload_concurrency':s3_upload_concurrency}
+					self.buildSecret(s3_access_secret), 'endpoint':s3_endpoint, 'storage_class':s3_storage_class,
+					'key_prefix':s3_key_prefix, 'upload_part_size':s3_upload_part_size, 'upload_concurrency':s3_upload_concurrency}
 			fs_config.update({'provider':1, 's3config':s3config})
 		elif fs_provider == 'GCS':
 			gcsconfig = {'bucket':gcs_bucket, 'key_prefix':gcs_key_prefix, 'storage_class':gcs_storage_class}
@@ -219,9 +277,24 @@ class SFTPGoApiRequests:
 				gcsconfig.update({'automatic_credentials':0})
 			if gcs_credentials_file:
 				with open(gcs_credentials_file) as creds:
-					gcsconfig.update({'credentials':base64.b64encode(creds.read().encode('UTF-8')).decode('UTF-8'),
-									'automatic_credentials':0})
+					gcsconfig.update({'credentials':self.buildSecret(base64.b64encode(
+									creds.read().encode('UTF-8')).decode('UTF-8')), 'automatic_credentials':0})
 			fs_config.update({'provider':2, 'gcsconfig':gcsconfig})
+		elif fs_provider == 'AzureBlob':
+			azureconfig = {'container':az_container, 'account_name':az_account_name, 'account_key':
+						self.buildSecret(az_account_key), 'sas_url':az_sas_url, 'endpoint':az_endpoint, 'key_prefix':az_key_prefix, 'upload_part_size':
+						az_upload_part_size, 'upload_concurrency':az_upload_concurrency, 'use_emulator':az_use_emulator,
+						'access_tier':az_access_tier}
+			fs_config.update({'provider':3, 'azblobconfig':azureconfig})
+		elif fs_provider == 'SFTP':
+			sftpconfig = {'endpoint':sftp_endpoint, 'username':sftp_username, 'password':
+						self.buildSecret(sftp_password), 'fingerprints':sftp_fingerprints, 'prefix':sftp_prefix}
+			if sftp_private_key_path:
+				with open(sftp_private_key_path) as key:
+					sftpconfig.update({'private_key':self.buildSecret(key.read())})
+			fs_config.update({'provider':4, 'sftpconfig':sftpconfig})
+		if crypt_passphrase:
+			fs_config.update({'cryptconfig':{'passphrase':self.buildSecret(crypt_passphrase)}})
 		return fs_config
 
 	def getUsers(self, limit=100, offset=0, order='ASC', username=''):
@@ -238,14 +311,20 @@ class SFTPGoApiRequests:
 			subdirs_permissions=[], allowed_ip=[], denied_ip=[], fs_provider='local', s3_bucket='', s3_region='',
 			s3_access_key='', s3_access_secret='', s3_endpoint='', s3_storage_class='', s3_key_prefix='', gcs_bucket='',
 			gcs_key_prefix='', gcs_storage_class='', gcs_credentials_file='', gcs_automatic_credentials='automatic',
-			denied_login_methods=[], virtual_folders=[], denied_extensions=[], allowed_extensions=[],
-			s3_upload_part_size=0, s3_upload_concurrency=0):
+			denied_login_methods=[], required_login_methods=[], virtual_folders=[], denied_extensions=[],
+			allowed_extensions=[], s3_upload_part_size=0, s3_upload_concurrency=0, primary_group='', secondary_groups=[], az_container='',
+			az_account_name='', az_account_key='', az_sas_url='', az_endpoint='', az_key_prefix='', az_upload_part_size=0,
+			az_upload_concurrency=0, az_use_emulator=False, az_access_tier='', sftp_endpoint='', sftp_username='',
+			sftp_password='', sftp_private_key_path='', sftp_fingerprints=[], sftp_prefix='', crypt_passphrase=''):
 		u = self.buildUserObject(0, username, password, public_keys, home_dir, uid, gid, max_sessions,
 			quota_size, quota_files, self.buildPermissions(perms, subdirs_permissions), upload_bandwidth, download_bandwidth,
 			status, expiration_date, allowed_ip, denied_ip, fs_provider, s3_bucket, s3_region, s3_access_key,
 			s3_access_secret, s3_endpoint, s3_storage_class, s3_key_prefix, gcs_bucket, gcs_key_prefix, gcs_storage_class,
-			gcs_credentials_file, gcs_automatic_credentials, denied_login_methods, virtual_folders, denied_extensions,
-			allowed_extensions, s3_upload_part_size, s3_upload_concurrency)
+			gcs_credentials_file, gcs_automatic_credentials, denied_login_methods, required_login_methods,
+			virtual_folders, denied_extensions, allowed_extensions, s3_upload_part_size, s3_upload_concurrency, primary_group, secondary_groups, az_container,
+			az_account_name, az_account_key, az_sas_url, az_endpoint, az_key_prefix, az_upload_part_size,
+			az_upload_concurrency, az_use_emulator, az_access_tier, sftp_endpoint, sftp_username, sftp_password,
+			sftp_private_key_path, sftp_fingerprints, sftp_prefix, crypt_passphrase)
 		r = requests.post(self.userPath, json=u, auth=self.auth, verify=self.verify)
 		self.printResponse(r)
 
@@ -254,14 +333,21 @@ class SFTPGoApiRequests:
 				expiration_date=0, subdirs_permissions=[], allowed_ip=[], denied_ip=[], fs_provider='local',
 				s3_bucket='', s3_region='', s3_access_key='', s3_access_secret='', s3_endpoint='', s3_storage_class='',
 				s3_key_prefix='', gcs_bucket='', gcs_key_prefix='', gcs_storage_class='', gcs_credentials_file='',
-				gcs_automatic_credentials='automatic', denied_login_methods=[], virtual_folders=[], denied_extensions=[],
-				allowed_extensions=[], s3_upload_part_size=0, s3_upload_concurrency=0):
+				gcs_automatic_credentials='automatic', denied_login_methods=[], required_login_methods=[],
+				virtual_folders=[], denied_extensions=[], allowed_extensions=[], s3_upload_part_size=0, s3_upload_concurrency=0, primary_group='',
+				secondary_groups=[], az_container='', az_account_name='', az_account_key='', az_sas_url='',
+				az_endpoint='', az_key_prefix='', az_upload_part_size=0, az_upload_concurrency=0, az_use_emulator=False,
+				az_access_tier='', sftp_endpoint='', sftp_username='', sftp_password='', sftp_private_key_path='',
+				sftp_fingerprints=[], sftp_prefix='', crypt_passphrase=''):
 		u = self.buildUserObject(user_id, username, password, public_keys, home_dir, uid, gid, max_sessions,
 			quota_size, quota_files, self.buildPermissions(perms, subdirs_permissions), upload_bandwidth, download_bandwidth,
 			status, expiration_date, allowed_ip, denied_ip, fs_provider, s3_bucket, s3_region, s3_access_key,
 			s3_access_secret, s3_endpoint, s3_storage_class, s3_key_prefix, gcs_bucket, gcs_key_prefix, gcs_storage_class,
-			gcs_credentials_file, gcs_automatic_credentials, denied_login_methods, virtual_folders, denied_extensions,
-			allowed_extensions, s3_upload_part_size, s3_upload_concurrency)
+			gcs_credentials_file, gcs_automatic_credentials, denied_login_methods, required_login_methods,
+			virtual_folders, denied_extensions, allowed_extensions, s3_upload_part_size, s3_upload_concurrency, primary_group, secondary_groups, az_container,
+			az_account_name, az_account_key, az_sas_url, az_endpoint, az_key_prefix, az_upload_part_size,
+			az_upload_concurrency, az_use_emulator, az_access_tier, sftp_endpoint, sftp_username, sftp_password,
+			sftp_private_key_path, sftp_fingerprints, sftp_prefix, crypt_passphrase)
 		r = requests.put(urlparse.urljoin(self.userPath, 'user/' + str(user_id)), json=u, auth=self.auth, verify=self.verify)
 		self.printResponse(r)
 
@@ -269,10 +355,191 @@ class SFTPGoApiRequests:
 		r = requests.delete(urlparse.urljoin(self.userPath, 'user/' + str(user_id)), auth=self.auth, verify=self.verify)
 		self.printResponse(r)
 
+	def generateUserTOTPSecret(self, user_id):
+		r = requests.post(urlparse.urljoin(self.userPath, 'user/' + str(user_id) + '/totp/generate'), auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def enableUserTOTP(self, user_id, passcode):
+		r = requests.post(urlparse.urljoin(self.userPath, 'user/' + str(user_id) + '/totp/validate'),
+						json={'passcode':passcode}, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def disableUserTOTP(self, user_id):
+		r = requests.delete(urlparse.urljoin(self.userPath, 'user/' + str(user_id) + '/totp'), auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def buildShareObject(self, share_id='', username='', path='', scope=1, password='', description='',
+						expires_at=0, max_tokens=0):
+		share = {'share_id':share_id, 'username':username, 'path':path, 'scope':scope, 'description':description,
+				'expires_at':expires_at, 'max_tokens':max_tokens}
+		if password:
+			share.update({'password':password})
+		return share
+
+	def getShares(self, limit=100, offset=0, order='ASC', username=''):
+		r = requests.get(self.sharePath, params={'limit':limit, 'offset':offset, 'order':order,
+											'username':username}, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def getShareByID(self, share_id):
+		r = requests.get(urlparse.urljoin(self.sharePath, 'share/' + share_id), auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def addShare(self, username='', path='', scope=1, password='', description='', expires_at=0, max_tokens=0):
+		share = self.buildShareObject('', username, path, scope, password, description, expires_at, max_tokens)
+		r = requests.post(self.sharePath, json=share, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def updateShare(self, share_id, path='', scope=1, password='', description='', expires_at=0, max_tokens=0):
+		if not password:
+			# the redacted password preserves the existing one
+			password = '[**redacted**]'
+		share = self.buildShareObject(share_id, '', path, scope, password, description, expires_at, max_tokens)
+		r = requests.put(urlparse.urljoin(self.sharePath, 'share/' + share_id), json=share, auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def deleteShare(self, share_id):
+		r = requests.delete(urlparse.urljoin(self.sharePath, 'share/' + share_id), auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def buildGroupObject(self, name='', description='', max_sessions=0, quota_size=0, quota_files=0, permissions={},
+						upload_bandwidth=0, download_bandwidth=0, allowed_ip=[], denied_ip=[], denied_login_methods=[],
+						virtual_folders=[], fs_provider='local', s3_bucket='', s3_region='', s3_access_key='',
+						s3_access_secret='', s3_endpoint='', s3_storage_class='', s3_key_prefix='', gcs_bucket='',
+						gcs_key_prefix='', gcs_storage_class=''):
+		settings = {'max_sessions':max_sessions, 'quota_size':quota_size, 'quota_files':quota_files,
+				'upload_bandwidth':upload_bandwidth, 'download_bandwidth':download_bandwidth}
+		if permissions:
+			settings.update({'permissions':permissions})
+		if virtual_folders:
+			settings.update({'virtual_folders':self.buildVirtualFolders(virtual_folders)})
+		if allowed_ip or denied_ip or denied_login_methods:
+			settings.update({'filters':self.buildFilters(allowed_ip, denied_ip, denied_login_methods, [], [])})
+		settings.update({'filesystem':self.buildFsConfig(fs_provider, s3_bucket, s3_region, s3_access_key,
+													s3_access_secret, s3_endpoint, s3_storage_class, s3_key_prefix,
+													gcs_bucket, gcs_key_prefix, gcs_storage_class, '', 'automatic',
+													0, 0)})
+		return {'name':name, 'description':description, 'user_settings':settings}
+
+	def getGroups(self, limit=100, offset=0, order='ASC'):
+		r = requests.get(self.groupPath, params={'limit':limit, 'offset':offset, 'order':order}, auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def getGroupByName(self, name):
+		r = requests.get(urlparse.urljoin(self.groupPath, 'group/' + name), auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def addGroup(self, name='', description='', max_sessions=0, quota_size=0, quota_files=0, perms=[],
+				subdirs_permissions=[], upload_bandwidth=0, download_bandwidth=0, allowed_ip=[], denied_ip=[],
+				denied_login_methods=[], virtual_folders=[], fs_provider='local', s3_bucket='', s3_region='',
+				s3_access_key='', s3_access_secret='', s3_endpoint='', s3_storage_class='', s3_key_prefix='',
+				gcs_bucket='', gcs_key_prefix='', gcs_storage_class=''):
+		g = self.buildGroupObject(name, description, max_sessions, quota_size, quota_files,
+								self.buildPermissions(perms, subdirs_permissions), upload_bandwidth, download_bandwidth,
+								allowed_ip, denied_ip, denied_login_methods, virtual_folders, fs_provider, s3_bucket,
+								s3_region, s3_access_key, s3_access_secret, s3_endpoint, s3_storage_class, s3_key_prefix,
+								gcs_bucket, gcs_key_prefix, gcs_storage_class)
+		r = requests.post(self.groupPath, json=g, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def updateGroup(self, name='', description='', max_sessions=0, quota_size=0, quota_files=0, perms=[],
+				subdirs_permissions=[], upload_bandwidth=0, download_bandwidth=0, allowed_ip=[], denied_ip=[],
+				denied_login_methods=[], virtual_folders=[], fs_provider='local', s3_bucket='', s3_region='',
+				s3_access_key='', s3_access_secret='', s3_endpoint='', s3_storage_class='', s3_key_prefix='',
+				gcs_bucket='', gcs_key_prefix='', gcs_storage_class=''):
+		g = self.buildGroupObject(name, description, max_sessions, quota_size, quota_files,
+								self.buildPermissions(perms, subdirs_permissions), upload_bandwidth, download_bandwidth,
+								allowed_ip, denied_ip, denied_login_methods, virtual_folders, fs_provider, s3_bucket,
+								s3_region, s3_access_key, s3_access_secret, s3_endpoint, s3_storage_class, s3_key_prefix,
+								gcs_bucket, gcs_key_prefix, gcs_storage_class)
+		r = requests.put(urlparse.urljoin(self.groupPath, 'group/' + name), json=g, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def deleteGroup(self, name):
+		r = requests.delete(urlparse.urljoin(self.groupPath, 'group/' + name), auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def getBannedIPs(self, limit=100, offset=0, order='ASC'):
+		r = requests.get(self.defenderBansPath, params={'limit':limit, 'offset':offset, 'order':order}, auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def getBannedIP(self, ip):
+		r = requests.get(urlparse.urljoin(self.defenderBansPath, 'bans/' + ip), auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def deleteBannedIP(self, ip):
+		r = requests.delete(urlparse.urljoin(self.defenderBansPath, 'bans/' + ip), auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def buildAdminObject(self, username='', password='', status=1, email='', permissions=[], description=''):
+		admin = {'username':username, 'status':status, 'email':email, 'permissions':permissions,
+				'description':description}
+		if password:
+			admin.update({'password':password})
+		return admin
+
+	def getAdmins(self, limit=100, offset=0, order='ASC'):
+		r = requests.get(self.adminPath, params={'limit':limit, 'offset':offset, 'order':order}, auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def getAdminByUsername(self, username):
+		r = requests.get(urlparse.urljoin(self.adminPath, 'admin/' + username), auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def addAdmin(self, username='', password='', status=1, email='', permissions=[], description=''):
+		admin = self.buildAdminObject(username, password, status, email, permissions, description)
+		r = requests.post(self.adminPath, json=admin, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def updateAdmin(self, username='', password='', status=1, email='', permissions=[], description=''):
+		admin = self.buildAdminObject(username, password, status, email, permissions, description)
+		r = requests.put(urlparse.urljoin(self.adminPath, 'admin/' + username), json=admin,
+						auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def deleteAdmin(self, username):
+		r = requests.delete(urlparse.urljoin(self.adminPath, 'admin/' + username), auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def getToken(self):
+		r = requests.get(self.tokenPath, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def getAPIKeys(self, limit=100, offset=0, order='ASC'):
+		r = requests.get(self.apiKeyPath, params={'limit':limit, 'offset':offset, 'order':order}, auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
+	def getAPIKeyByID(self, key_id):
+		r = requests.get(urlparse.urljoin(self.apiKeyPath, 'apikey/' + key_id), auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def addAPIKey(self, name='', permissions=[], description='', expires_at=0):
+		key = {'name':name, 'permissions':permissions, 'description':description, 'expires_at':expires_at}
+		r = requests.post(self.apiKeyPath, json=key, auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def deleteAPIKey(self, key_id):
+		r = requests.delete(urlparse.urljoin(self.apiKeyPath, 'apikey/' + key_id), auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
 	def getConnections(self):
 		r = requests.get(self.activeConnectionsPath, auth=self.auth, verify=self.verify)
 		self.printResponse(r)
 
+	def getConnectionsStats(self):
+		r = requests.get(urlparse.urljoin(self.activeConnectionsPath, 'connection/stats'), auth=self.auth,
+						verify=self.verify)
+		self.printResponse(r)
+
 	def closeConnection(self, connectionID):
 		r = requests.delete(urlparse.urljoin(self.activeConnectionsPath, 'connection/' + str(connectionID)), auth=self.auth)
 		self.printResponse(r)
@@ -294,15 +561,35 @@ class SFTPGoApiRequests:
 		r = requests.get(self.providerStatusPath, auth=self.auth, verify=self.verify)
 		self.printResponse(r)
 
-	def dumpData(self, output_file, indent):
-		r = requests.get(self.dumpDataPath, params={'output_file':output_file, 'indent':indent},
-						auth=self.auth, verify=self.verify)
+	def getBackupStatus(self):
+		r = requests.get(self.backupStatusPath, auth=self.auth, verify=self.verify)
 		self.printResponse(r)
 
-	def loadData(self, input_file, scan_quota, mode):
-		r = requests.get(self.loadDataPath, params={'input_file':input_file, 'scan_quota':scan_quota,
-												'mode':mode},
-						auth=self.auth, verify=self.verify)
+	def dumpData(self, output_file, indent, download):
+		if download:
+			r = requests.get(self.dumpDataPath, params={'output_data':1, 'indent':indent}, auth=self.auth,
+							verify=self.verify, stream=True)
+			if r.status_code == 200:
+				with open(output_file, 'wb') as f:
+					for chunk in r.iter_content(chunk_size=65536):
+						f.write(chunk)
+				print('Data saved to {}'.format(output_file))
+				return
+		else:
+			r = requests.get(self.dumpDataPath, params={'output_file':output_file, 'indent':indent},
+							auth=self.auth, verify=self.verify)
+		self.printResponse(r)
+
+	def loadData(self, input_file, scan_quota, mode, upload):
+		if upload:
+			with open(input_file, 'rb') as f:
+				r = requests.post(self.loadDataPath, params={'scan_quota':scan_quota, 'mode':mode},
+								files={'backup_file':(os.path.basename(input_file), f, 'application/json')},
+								auth=self.auth, verify=self.verify)
+		else:
+			r = requests.get(self.loadDataPath, params={'input_file':input_file, 'scan_quota':scan_quota,
+													'mode':mode},
+							auth=self.auth, verify=self.verify)
 		self.printResponse(r)
 
 
@@ -486,6 +773,33 @@ def getDatetimeAsMillisSinceEpoch(dt):
 	return int((dt - epoch).total_seconds() * 1000)
 
 
+def addCommonShareArguments(parser):
+	parser.add_argument('path', type=str, help='Shared file or directory, relative to the user home directory')
+	parser.add_argument('-s', '--scope', type=int, choices=[1, 2], default=1,
+					help='1 means the shared path can be downloaded, 2 means files can be uploaded inside the shared ' +
+					'directory. Default: %(default)s')
+	parser.add_argument('-P', '--password', type=str, default='',
+					help='Optional password. Updating a share the existing password is preserved if empty. Default: %(default)s')
+	parser.add_argument('--description', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('-E', '--expiration-date', type=validDate, default='',
+					help='Expiration date as YYYY-MM-DD, empty string means no expiration. Default: %(default)s')
+	parser.add_argument('-T', '--max-tokens', type=int, default=0,
+					help='Maximum number of times the share can be used. 0 means unlimited. Default: %(default)s')
+
+
+def addCommonAdminArguments(parser):
+	parser.add_argument('username', type=str)
+	parser.add_argument('-P', '--password', type=str, default='',
+					help='Updating an admin the existing password is preserved if empty. Default: %(default)s')
+	parser.add_argument('-S', '--status', type=int, choices=[0, 1], default=1,
+					help='Admin\'s status. 1 enabled, 0 disabled. Default: %(default)s')
+	parser.add_argument('-E', '--email', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('-p', '--permissions', type=str, nargs='+', default=['*'],
+					choices=['*', 'manage_users', 'manage_admins', 'view_conns', 'close_conns', 'quota_scans',
+							'manage_backups', 'view_metrics', 'manage_defender'], help='Default: %(default)s')
+	parser.add_argument('--description', type=str, default='', help='Default: %(default)s')
+
+
 def addCommonUserArguments(parser):
 	parser.add_argument('username', type=str)
 	parser.add_argument('-P', '--password', type=str, default=None, help='Default: %(default)s')
@@ -503,7 +817,11 @@ def addCommonUserArguments(parser):
 							'create_symlinks', 'chmod', 'chown', 'chtimes'], help='Permissions for the root directory '
 							+'(/). Default: %(default)s')
 	parser.add_argument('-L', '--denied-login-methods', type=str, nargs='+', default=[],
-					choices=['', 'publickey', 'password', 'keyboard-interactive'], help='Default: %(default)s')
+					choices=['', 'publickey', 'password', 'keyboard-interactive', 'publickey-cert', 'publickey,password',
+						'publickey,keyboard-interactive'], help='Default: %(default)s')
+	parser.add_argument('--required-login-methods', type=str, nargs='+', default=[],
+					choices=['', 'publickey,password', 'publickey,keyboard-interactive'], help='Login methods '
+					+'combinations, if set a single login method is not enough. Default: %(default)s')
 	parser.add_argument('--subdirs-permissions', type=str, nargs='*', default=[], help='Permissions for subdirs. '
 					+'For example: "/somedir::list,download" "/otherdir/subdir::*" Default: %(default)s')
 	parser.add_argument('--virtual-folders', type=str, nargs='*', default=[], help='Virtual folder mapping. For example: '
@@ -527,7 +845,7 @@ def addCommonUserArguments(parser):
 	parser.add_argument('--allowed-extensions', type=str, nargs='*', default=[], help='Allowed file extensions case insensitive. '
 					+'The format is /dir::ext1,ext2. For example: "/somedir::.jpg,.png" "/otherdir/subdir::.zip,.rar". ' +
 					'Default: %(default)s')
-	parser.add_argument('--fs', type=str, default='local', choices=['local', 'S3', 'GCS'],
+	parser.add_argument('--fs', type=str, default='local', choices=['local', 'S3', 'GCS', 'AzureBlob', 'SFTP'],
 					help='Filesystem provider. Default: %(default)s')
 	parser.add_argument('--s3-bucket', type=str, default='', help='Default: %(default)s')
 	parser.add_argument('--s3-key-prefix', type=str, default='', help='Virtual root directory. If non empty only this ' +
@@ -550,18 +868,94 @@ def addCommonUserArguments(parser):
 	parser.add_argument('--gcs-credentials-file', type=str, default='', help='Default: %(default)s')
 	parser.add_argument('--gcs-automatic-credentials', type=str, default='automatic', choices=['explicit', 'automatic'],
 					help='If you provide a credentials file this argument will be setted to "explicit". Default: %(default)s')
+	parser.add_argument('--az-container', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--az-account-name', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--az-account-key', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--az-sas-url', type=str, default='', help='Shared access signature URL. Default: %(default)s')
+	parser.add_argument('--az-endpoint', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--az-key-prefix', type=str, default='', help='Virtual root directory. If non empty only this ' +
+					'directory and its contents will be available. Cannot start with "/". For example "folder/subfolder/".' +
+					' Default: %(default)s')
+	parser.add_argument('--az-upload-part-size', type=int, default=0, help='The buffer size for multipart uploads (MB). ' +
+					'Zero means the default (4 MB). Maximum is 100. Default: %(default)s')
+	parser.add_argument('--az-upload-concurrency', type=int, default=0, help='How many parts are uploaded in parallel. ' +
+					'Zero means the default (2). Default: %(default)s')
+	parser.add_argument('--az-use-emulator', dest='az_use_emulator', action='store_true', default=False,
+					help='Set to use an Azure Blob emulator such as Azurite. Default: %(default)s')
+	parser.add_argument('--az-access-tier', type=str, default='', choices=['', 'Hot', 'Cool', 'Archive'],
+					help='Leave empty to use the default account access tier. Default: %(default)s')
+	parser.add_argument('--sftp-endpoint', type=str, default='', help='SFTP endpoint as host:port. Default: %(default)s')
+	parser.add_argument('--sftp-username', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--sftp-password', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--sftp-private-key-path', type=str, default='', help='Path to a PEM encoded private key ' +
+					'without passphrase. Default: %(default)s')
+	parser.add_argument('--sftp-fingerprints', type=str, nargs='*', default=[], help='SHA256 fingerprints to use ' +
+					'for host key verification, for example "SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4". ' +
+					'Default: %(default)s')
+	parser.add_argument('--sftp-prefix', type=str, default='', help='Restrict the user to this absolute path within ' +
+					'the remote server. Default: %(default)s')
+	parser.add_argument('--crypt-passphrase', type=str, default='', help='If set, the files are encrypted before ' +
+					'storing them using the selected filesystem. Default: %(default)s')
+	parser.add_argument('--primary-group', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--secondary-groups', type=str, nargs='*', default=[], help='Default: %(default)s')
+
+
+def addCommonGroupArguments(parser):
+	parser.add_argument('name', type=str)
+	parser.add_argument('--description', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('-C', '--max-sessions', type=int, default=0,
+					help='Maximum concurrent sessions. 0 means unlimited. Default: %(default)s')
+	parser.add_argument('-S', '--quota-size', type=int, default=0,
+					help='Maximum size allowed as bytes. 0 means unlimited. Default: %(default)s')
+	parser.add_argument('-F', '--quota-files', type=int, default=0, help='default: %(default)s')
+	parser.add_argument('-G', '--permissions', type=str, nargs='+', default=[],
+					choices=['*', 'list', 'download', 'upload', 'overwrite', 'delete', 'rename', 'create_dirs',
+							'create_symlinks', 'chmod', 'chown', 'chtimes'], help='Permissions for the root directory '
+							+'(/). Default: %(default)s')
+	parser.add_argument('--subdirs-permissions', type=str, nargs='*', default=[], help='Permissions for subdirs, ' +
+					'%%username%% is replaced with the member username. For example: "/somedir::list,download" ' +
+					'"/%%username%%/subdir::*" Default: %(default)s')
+	parser.add_argument('-U', '--upload-bandwidth', type=int, default=0,
+					help='Maximum upload bandwidth as KB/s, 0 means unlimited. Default: %(default)s')
+	parser.add_argument('-D', '--download-bandwidth', type=int, default=0,
+					help='Maximum download bandwidth as KB/s, 0 means unlimited. Default: %(default)s')
+	parser.add_argument('-Y', '--allowed-ip', type=str, nargs='+', default=[],
+					help='Allowed IP/Mask in CIDR notation. For example "192.168.2.0/24" or "2001:db8::/32". Default: %(default)s')
+	parser.add_argument('-N', '--denied-ip', type=str, nargs='+', default=[],
+					help='Denied IP/Mask in CIDR notation. For example "192.168.2.0/24" or "2001:db8::/32". Default: %(default)s')
+	parser.add_argument('-L', '--denied-login-methods', type=str, nargs='+', default=[],
+					choices=['', 'publickey', 'password', 'keyboard-interactive', 'publickey-cert', 'publickey,password',
+						'publickey,keyboard-interactive'], help='Default: %(default)s')
+	parser.add_argument('--virtual-folders', type=str, nargs='*', default=[], help='Virtual folder mapping. For example: '
+					+'"/vpath::/home/%%username%%/adir". Default: %(default)s')
+	parser.add_argument('--fs', type=str, default='local', choices=['local', 'S3', 'GCS'],
+					help='Filesystem provider. GCS is supported with automatic credentials only. Default: %(default)s')
+	parser.add_argument('--s3-bucket', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--s3-key-prefix', type=str, default='', help='Virtual root directory, %%username%% is ' +
+					'replaced with the member username. For example "%%username%%/". Default: %(default)s')
+	parser.add_argument('--s3-region', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--s3-access-key', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--s3-access-secret', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--s3-endpoint', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--s3-storage-class', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--gcs-bucket', type=str, default='', help='Default: %(default)s')
+	parser.add_argument('--gcs-key-prefix', type=str, default='', help='Virtual root directory, %%username%% is ' +
+					'replaced with the member username. Default: %(default)s')
+	parser.add_argument('--gcs-storage-class', type=str, default='', help='Default: %(default)s')
 
 
 if __name__ == '__main__':
 	parser = argparse.ArgumentParser(formatter_class=argparse.ArgumentDefaultsHelpFormatter)
 	parser.add_argument('-b', '--base-url', type=str, default='http://127.0.0.1:8080',
 					help='Base URL for SFTPGo REST API. Default: %(default)s')
-	parser.add_argument('-a', '--auth-type', type=str, default=None, choices=['basic', 'digest'],
+	parser.add_argument('-a', '--auth-type', type=str, default=None, choices=['basic', 'digest', 'bearer'],
 					help='HTTP authentication type. Default: %(default)s')
 	parser.add_argument('-u', '--auth-user', type=str, default='',
 					help='User for HTTP authentication. Default: %(default)s')
 	parser.add_argument('-p', '--auth-password', type=str, default='',
 					help='Password for HTTP authentication. Default: %(default)s')
+	parser.add_argument('-k', '--auth-token', type=str, default='',
+					help='Token or API key for bearer authentication. Default: %(default)s')
 	parser.add_argument('-d', '--debug', dest='debug', action='store_true')
 	parser.set_defaults(debug=False)
 	parser.add_argument('-i', '--insecure', dest='secure', action='store_false',
@@ -599,9 +993,123 @@ if __name__ == '__main__':
 	parserGetUserByID = subparsers.add_parser('get-user-by-id', help='Find user by ID')
 	parserGetUserByID.add_argument('id', type=int)
 
+	parserGenerateTOTP = subparsers.add_parser('generate-totp-secret', help='Generate a new TOTP secret for the ' +
+											'given user. TOTP is enabled after verifying the first passcode')
+	parserGenerateTOTP.add_argument('id', type=int)
+
+	parserEnableTOTP = subparsers.add_parser('enable-totp', help='Verify a passcode and enable TOTP for the given user')
+	parserEnableTOTP.add_argument('id', type=int)
+	parserEnableTOTP.add_argument('passcode', type=str)
+
+	parserDisableTOTP = subparsers.add_parser('disable-totp', help='Disable TOTP for the given user')
+	parserDisableTOTP.add_argument('id', type=int)
+
+	parserAddGroup = subparsers.add_parser('add-group', help='Add a new group')
+	addCommonGroupArguments(parserAddGroup)
+
+	parserUpdateGroup = subparsers.add_parser('update-group', help='Update an existing group')
+	addCommonGroupArguments(parserUpdateGroup)
+
+	parserDeleteGroup = subparsers.add_parser('delete-group', help='Delete an existing group')
+	parserDeleteGroup.add_argument('name', type=str)
+
+	parserGetGroups = subparsers.add_parser('get-groups', help='Returns an array with one or more groups')
+	parserGetGroups.add_argument('-L', '--limit', type=int, default=100, choices=range(1, 501),
+							help='Maximum allowed value is 500. Default: %(default)s', metavar='[1...500]')
+	parserGetGroups.add_argument('-O', '--offset', type=int, default=0, help='Default: %(default)s')
+	parserGetGroups.add_argument('-S', '--order', type=str, choices=['ASC', 'DESC'], default='ASC',
+							help='default: %(default)s')
+
+	parserGetGroupByName = subparsers.add_parser('get-group-by-name', help='Find group by name')
+	parserGetGroupByName.add_argument('name', type=str)
+
+	parserGetBannedIPs = subparsers.add_parser('get-bans', help='Returns an array with the hosts banned by the defender')
+	parserGetBannedIPs.add_argument('-L', '--limit', type=int, default=100, choices=range(1, 501),
+							help='Maximum allowed value is 500. Default: %(default)s', metavar='[1...500]')
+	parserGetBannedIPs.add_argument('-O', '--offset', type=int, default=0, help='Default: %(default)s')
+	parserGetBannedIPs.add_argument('-S', '--order', type=str, choices=['ASC', 'DESC'], default='ASC',
+							help='default: %(default)s')
+
+	parserGetBannedIP = subparsers.add_parser('get-ban', help='Find the ban for the given IP address')
+	parserGetBannedIP.add_argument('ip', type=str)
+
+	parserDeleteBannedIP = subparsers.add_parser('delete-ban', help='Remove the ban for the given IP address')
+	parserDeleteBannedIP.add_argument('ip', type=str)
+
+	parserAddShare = subparsers.add_parser('add-share', help='Add a new public share for a file or a directory')
+	parserAddShare.add_argument('username', type=str, help='The user that owns the shared path')
+	addCommonShareArguments(parserAddShare)
+
+	parserUpdateShare = subparsers.add_parser('update-share', help='Update an existing share')
+	parserUpdateShare.add_argument('id', type=str, help='Share ID to update')
+	addCommonShareArguments(parserUpdateShare)
+
+	parserDeleteShare = subparsers.add_parser('delete-share', help='Delete an existing share')
+	parserDeleteShare.add_argument('id', type=str, help='Share ID to delete')
+
+	parserGetShares = subparsers.add_parser('get-shares', help='Returns an array with one or more shares')
+	parserGetShares.add_argument('-L', '--limit', type=int, default=100, choices=range(1, 501),
+							help='Maximum allowed value is 500. Default: %(default)s', metavar='[1...500]')
+	parserGetShares.add_argument('-O', '--offset', type=int, default=0, help='Default: %(default)s')
+	parserGetShares.add_argument('-U', '--username', type=str, default='', help='Default: %(default)s')
+	parserGetShares.add_argument('-S', '--order', type=str, choices=['ASC', 'DESC'], default='ASC',
+							help='default: %(default)s')
+
+	parserGetShareByID = subparsers.add_parser('get-share-by-id', help='Find share by share ID')
+	parserGetShareByID.add_argument('id', type=str)
+
+	parserAddAdmin = subparsers.add_parser('add-admin', help='Add a new admin')
+	addCommonAdminArguments(parserAddAdmin)
+
+	parserUpdateAdmin = subparsers.add_parser('update-admin', help='Update an existing admin')
+	addCommonAdminArguments(parserUpdateAdmin)
+
+	parserDeleteAdmin = subparsers.add_parser('delete-admin', help='Delete an existing admin')
+	parserDeleteAdmin.add_argument('username', type=str)
+
+	parserGetAdmins = subparsers.add_parser('get-admins', help='Returns an array with one or more admins')
+	parserGetAdmins.add_argument('-L', '--limit', type=int, default=100, choices=range(1, 501),
+							help='Maximum allowed value is 500. Default: %(default)s', metavar='[1...500]')
+	parserGetAdmins.add_argument('-O', '--offset', type=int, default=0, help='Default: %(default)s')
+	parserGetAdmins.add_argument('-S', '--order', type=str, choices=['ASC', 'DESC'], default='ASC',
+							help='default: %(default)s')
+
+	parserGetAdminByUsername = subparsers.add_parser('get-admin-by-username', help='Find admin by username')
+	parserGetAdminByUsername.add_argument('username', type=str)
+
+	parserGetToken = subparsers.add_parser('get-token', help='Get a short-lived token to use for bearer authentication')
+
+	parserAddAPIKey = subparsers.add_parser('add-apikey', help='Add a new API key owned by the authenticated admin')
+	parserAddAPIKey.add_argument('name', type=str)
+	parserAddAPIKey.add_argument('-p', '--permissions', type=str, nargs='+', default=['*'],
+					choices=['*', 'manage_users', 'manage_admins', 'view_conns', 'close_conns', 'quota_scans',
+							'manage_backups', 'view_metrics', 'manage_defender'],
+					help='Permissions are limited by the admin permissions, * means all the admin permissions. ' +
+					'Default: %(default)s')
+	parserAddAPIKey.add_argument('--description', type=str, default='', help='Default: %(default)s')
+	parserAddAPIKey.add_argument('-E', '--expiration-date', type=validDate, default='',
+					help='Expiration date as YYYY-MM-DD, empty string means no expiration. Default: %(default)s')
+
+	parserDeleteAPIKey = subparsers.add_parser('delete-apikey', help='Revoke an existing API key')
+	parserDeleteAPIKey.add_argument('id', type=str)
+
+	parserGetAPIKeys = subparsers.add_parser('get-apikeys', help='Returns an array with the API keys owned by the ' +
+											'authenticated admin')
+	parserGetAPIKeys.add_argument('-L', '--limit', type=int, default=100, choices=range(1, 501),
+							help='Maximum allowed value is 500. Default: %(default)s', metavar='[1...500]')
+	parserGetAPIKeys.add_argument('-O', '--offset', type=int, default=0, help='Default: %(default)s')
+	parserGetAPIKeys.add_argument('-S', '--order', type=str, choices=['ASC', 'DESC'], default='ASC',
+							help='default: %(default)s')
+
+	parserGetAPIKeyByID = subparsers.add_parser('get-apikey-by-id', help='Find API key by key ID')
+	parserGetAPIKeyByID.add_argument('id', type=str)
+
 	parserGetConnections = subparsers.add_parser('get-connections',
 													help='Get the active users and info about their uploads/downloads')
 
+	parserGetConnectionsStats = subparsers.add_parser('get-connections-stats',
+													help='Get the status for the SFTP network connections and the rejected connections')
+
 	parserCloseConnection = subparsers.add_parser('close-connection', help='Terminate an active SFTP/SCP connection')
 	parserCloseConnection.add_argument('connectionID', type=str)
 
@@ -614,10 +1122,15 @@ if __name__ == '__main__':
 
 	parserGetProviderStatus = subparsers.add_parser('get-provider-status', help='Get data provider status')
 
+	parserGetBackupStatus = subparsers.add_parser('get-backup-status', help='Get the status for the scheduled backups')
+
 	parserDumpData = subparsers.add_parser('dumpdata', help='Backup SFTPGo data serializing them as JSON')
 	parserDumpData.add_argument('output_file', type=str)
 	parserDumpData.add_argument('-I', '--indent', type=int, choices=[0, 1], default=0,
 							help='0 means no indentation. 1 means format the output JSON. Default: %(default)s')
+	parserDumpData.add_argument('--download', dest='download', action='store_true', default=False,
+							help='Download the backup and save it to the local output_file instead of writing it on ' +
+							'the server. Default: %(default)s')
 
 	parserLoadData = subparsers.add_parser('loaddata', help='Restore SFTPGo data from a JSON backup')
 	parserLoadData.add_argument('input_file', type=str)
@@ -627,6 +1140,8 @@ if __name__ == '__main__':
 	parserLoadData.add_argument('-M', '--mode', type=int, choices=[0, 1], default=0,
 							help='0 means new users are added, existing users are updated. 1 means new users are added,' +
 							' existing users are not modified. Default: %(default)s')
+	parserLoadData.add_argument('--upload', dest='upload', action='store_true', default=False,
+							help='Upload the local input_file instead of reading it from the server. Default: %(default)s')
 
 	parserConvertUsers = subparsers.add_parser('convert-users', help='Convert users to a JSON format suitable to use ' +
 											'with loadddata')
@@ -651,8 +1166,8 @@ if __name__ == '__main__':
 
 	args = parser.parse_args()
 
-	api = SFTPGoApiRequests(args.debug, args.base_url, args.auth_type, args.auth_user, args.auth_password, args.secure,
-						 args.no_color)
+	api = SFTPGoApiRequests(args.debug, args.base_url, args.auth_type, args.auth_user, args.auth_password,
+						 args.auth_token, args.secure, args.no_color)
 
 	if args.command == 'add-user':
 		api.addUser(args.username, args.password, args.public_keys, args.home_dir, args.uid, args.gid, args.max_sessions,
@@ -661,8 +1176,12 @@ if __name__ == '__main__':
 				args.denied_ip, args.fs, args.s3_bucket, args.s3_region, args.s3_access_key, args.s3_access_secret,
 				args.s3_endpoint, args.s3_storage_class, args.s3_key_prefix, args.gcs_bucket, args.gcs_key_prefix,
 				args.gcs_storage_class, args.gcs_credentials_file, args.gcs_automatic_credentials,
-				args.denied_login_methods, args.virtual_folders, args.denied_extensions, args.allowed_extensions,
-				args.s3_upload_part_size, args.s3_upload_concurrency)
+				args.denied_login_methods, args.required_login_methods, args.virtual_folders, args.denied_extensions,
+				args.allowed_extensions, args.s3_upload_part_size, args.s3_upload_concurrency, args.primary_group,
+				args.secondary_groups, args.az_container, args.az_account_name, args.az_account_key, args.az_sas_url,
+				args.az_endpoint, args.az_key_prefix, args.az_upload_part_size, args.az_upload_concurrency,
+				args.az_use_emulator, args.az_access_tier, args.sftp_endpoint, args.sftp_username, args.sftp_password,
+				args.sftp_private_key_path, args.sftp_fingerprints, args.sftp_prefix, args.crypt_passphrase)
 	elif args.command == 'update-user':
 		api.updateUser(args.id, args.username, args.password, args.public_keys, args.home_dir, args.uid, args.gid,
 					args.max_sessions, args.quota_size, args.quota_files, args.permissions, args.upload_bandwidth,
@@ -671,16 +1190,85 @@ if __name__ == '__main__':
 					args.s3_access_key, args.s3_access_secret, args.s3_endpoint, args.s3_storage_class,
 					args.s3_key_prefix, args.gcs_bucket, args.gcs_key_prefix, args.gcs_storage_class,
 					args.gcs_credentials_file, args.gcs_automatic_credentials, args.denied_login_methods,
-					args.virtual_folders, args.denied_extensions, args.allowed_extensions, args.s3_upload_part_size,
-					args.s3_upload_concurrency)
+					args.required_login_methods, args.virtual_folders, args.denied_extensions, args.allowed_extensions,
+					args.s3_upload_part_size, args.s3_upload_concurrency, args.primary_group, args.secondary_groups,
+					args.az_container, args.az_account_name, args.az_account_key, args.az_sas_url, args.az_endpoint,
+					args.az_key_prefix, args.az_upload_part_size, args.az_upload_concurrency, args.az_use_emulator,
+					args.az_access_tier, args.sftp_endpoint, args.sftp_username, args.sftp_password, args.sftp_private_key_path,
+					args.sftp_fingerprints, args.sftp_prefix, args.crypt_passphrase)
 	elif args.command == 'delete-user':
 		api.deleteUser(args.id)
 	elif args.command == 'get-users':
 		api.getUsers(args.limit, args.offset, args.order, args.username)
 	elif args.command == 'get-user-by-id':
 		api.getUserByID(args.id)
+	elif args.command == 'generate-totp-secret':
+		api.generateUserTOTPSecret(args.id)
+	elif args.command == 'enable-totp':
+		api.enableUserTOTP(args.id, args.passcode)
+	elif args.command == 'disable-totp':
+		api.disableUserTOTP(args.id)
+	elif args.command == 'add-share':
+		api.addShare(args.username, args.path, args.scope, args.password, args.description,
+					getDatetimeAsMillisSinceEpoch(args.expiration_date), args.max_tokens)
+	elif args.command == 'update-share':
+		api.updateShare(args.id, args.path, args.scope, args.password, args.description,
+					getDatetimeAsMillisSinceEpoch(args.expiration_date), args.max_tokens)
+	elif args.command == 'delete-share':
+		api.deleteShare(args.id)
+	elif args.command == 'get-shares':
+		api.getShares(args.limit, args.offset, args.order, args.username)
+	elif args.command == 'get-share-by-id':
+		api.getShareByID(args.id)
+	elif args.command == 'add-group':
+		api.addGroup(args.name, args.description, args.max_sessions, args.quota_size, args.quota_files, args.permissions,
+					args.subdirs_permissions, args.upload_bandwidth, args.download_bandwidth, args.allowed_ip,
+					args.denied_ip, args.denied_login_methods, args.virtual_folders, args.fs, args.s3_bucket,
+					args.s3_region, args.s3_access_key, args.s3_access_secret, args.s3_endpoint, args.s3_storage_class,
+					args.s3_key_prefix, args.gcs_bucket, args.gcs_key_prefix, args.gcs_storage_class)
+	elif args.command == 'update-group':
+		api.updateGroup(args.name, args.description, args.max_sessions, args.quota_size, args.quota_files, args.permissions,
+					args.subdirs_permissions, args.upload_bandwidth, args.download_bandwidth, args.allowed_ip,
+					args.denied_ip, args.denied_login_methods, args.virtual_folders, args.fs, args.s3_bucket,
+					args.s3_region, args.s3_access_key, args.s3_access_secret, args.s3_endpoint, args.s3_storage_class,
+					args.s3_key_prefix, args.gcs_bucket, args.gcs_key_prefix, args.gcs_storage_class)
+	elif args.command == 'delete-group':
+		api.deleteGroup(args.name)
+	elif args.command == 'get-groups':
+		api.getGroups(args.limit, args.offset, args.order)
+	elif args.command == 'get-group-by-name':
+		api.getGroupByName(args.name)
+	elif args.command == 'get-bans':
+		api.getBannedIPs(args.limit, args.offset, args.order)
+	elif args.command == 'get-ban':
+		api.getBannedIP(args.ip)
+	elif args.command == 'delete-ban':
+		api.deleteBannedIP(args.ip)
+	elif args.command == 'add-admin':
+		api.addAdmin(args.username, args.password, args.status, args.email, args.permissions, args.description)
+	elif args.command == 'update-admin':
+		api.updateAdmin(args.username, args.password, args.status, args.email, args.permissions, args.description)
+	elif args.command == 'delete-admin':
+		api.deleteAdmin(args.username)
+	elif args.command == 'get-admins':
+		api.getAdmins(args.limit, args.offset, args.order)
+	elif args.command == 'get-admin-by-username':
+		api.getAdminByUsername(args.username)
+	elif args.command == 'get-token':
+		api.getToken()
+	elif args.command == 'add-apikey':
+		api.addAPIKey(args.name, args.permissions, args.description,
+					getDatetimeAsMillisSinceEpoch(args.expiration_date))
+	elif args.command == 'delete-apikey':
+		api.deleteAPIKey(args.id)
+	elif args.command == 'get-apikeys':
+		api.getAPIKeys(args.limit, args.offset, args.order)
+	elif args.command == 'get-apikey-by-id':
+		api.getAPIKeyByID(args.id)
 	elif args.command == 'get-connections':
 		api.getConnections()
+	elif args.command == 'get-connections-stats':
+		api.getConnectionsStats()
 	elif args.command == 'close-connection':
 		api.closeConnection(args.connectionID)
 	elif args.command == 'get-quota-scans':
@@ -691,10 +1279,12 @@ if __name__ == '__main__':
 		api.getVersion()
 	elif args.command == 'get-provider-status':
 		api.getProviderStatus()
+	elif args.command == 'get-backup-status':
+		api.getBackupStatus()
 	elif args.command == 'dumpdata':
-		api.dumpData(args.output_file, args.indent)
+		api.dumpData(args.output_file, args.indent, args.download)
 	elif args.command == 'loaddata':
-		api.loadData(args.input_file, args.scan_quota, args.mode)
+		api.loadData(args.input_file, args.scan_quota, args.mode, args.upload)
 	elif args.command == 'convert-users':
 		convertUsers = ConvertUsers(args.input_file, args.users_format, args.output_file, args.min_uid, args.max_uid,
 								args.usernames, args.force_uid, args.force_gid)
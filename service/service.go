@@ -11,12 +11,15 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/drakkan/sftpgo/backup"
 	"github.com/drakkan/sftpgo/config"
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/ftpd"
 	"github.com/drakkan/sftpgo/httpd"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/webdavd"
 	"github.com/grandcat/zeroconf"
 	"github.com/rs/zerolog"
 )
@@ -69,18 +72,49 @@ func (s *Service) Start() error {
 	if s.PortableMode != 1 {
 		config.LoadConfig(s.ConfigDir, s.ConfigFile)
 	}
+	err := config.GetHTTPConfig().Initialize(s.ConfigDir)
+	if err != nil {
+		logger.Error(logSender, "", "error initializing HTTP client: %v", err)
+		logger.ErrorToConsole("error initializing HTTP client: %v", err)
+		return err
+	}
+
+	err = config.GetKMSConfig().Initialize(s.ConfigDir)
+	if err != nil {
+		logger.Error(logSender, "", "error initializing secrets encryption: %v", err)
+		logger.ErrorToConsole("error initializing secrets encryption: %v", err)
+		return err
+	}
+
 	providerConf := config.GetProviderConf()
 
-	err := dataprovider.Initialize(providerConf, s.ConfigDir)
+	err = dataprovider.Initialize(providerConf, s.ConfigDir)
 	if err != nil {
 		logger.Error(logSender, "", "error initializing data provider: %v", err)
 		logger.ErrorToConsole("error initializing data provider: %v", err)
 		return err
 	}
 
+	err = utils.InitializeIPLists(config.GetIPListsConfig(), s.ConfigDir)
+	if err != nil {
+		logger.Error(logSender, "", "error initializing IP lists: %v", err)
+		logger.ErrorToConsole("error initializing IP lists: %v", err)
+		return err
+	}
+
 	dataProvider := dataprovider.GetProvider()
 	sftpdConf := config.GetSFTPDConfig()
 	httpdConf := config.GetHTTPDConfig()
+	ftpdConf := config.GetFTPDConfig()
+	webDavDConf := config.GetWebDAVDConfig()
+	backupsConf := config.GetBackupsConfig()
+
+	err = backupsConf.Initialize(s.ConfigDir, httpdConf.BackupsPath)
+	if err != nil {
+		logger.Error(logSender, "", "error initializing scheduled backups: %v", err)
+		logger.ErrorToConsole("error initializing scheduled backups: %v", err)
+		return err
+	}
 
 	if s.PortableMode == 1 {
 		// create the user for portable mode
@@ -118,6 +152,34 @@ func (s *Service) Start() error {
 			logger.DebugToConsole("HTTP server not started, disabled in config file")
 		}
 	}
+
+	if ftpdConf.BindPort > 0 {
+		ftpd.SetDataProvider(dataProvider)
+
+		go func() {
+			if err := ftpdConf.Initialize(s.ConfigDir); err != nil {
+				logger.Error(logSender, "", "could not start FTP server: %v", err)
+				logger.ErrorToConsole("could not start FTP server: %v", err)
+			}
+			s.Shutdown <- true
+		}()
+	} else {
+		logger.Debug(logSender, "", "FTP server not started, disabled in config file")
+	}
+
+	if webDavDConf.BindPort > 0 {
+		webdavd.SetDataProvider(dataProvider)
+
+		go func() {
+			if err := webDavDConf.Initialize(s.ConfigDir); err != nil {
+				logger.Error(logSender, "", "could not start WebDAV server: %v", err)
+				logger.ErrorToConsole("could not start WebDAV server: %v", err)
+			}
+			s.Shutdown <- true
+		}()
+	} else {
+		logger.Debug(logSender, "", "WebDAV server not started, disabled in config file")
+	}
 	return nil
 }
 
@@ -131,6 +193,7 @@ func (s *Service) Wait() {
 
 // Stop terminates the service unblocking the Wait method
 func (s *Service) Stop() {
+	backup.Stop()
 	close(s.Shutdown)
 	logger.Debug(logSender, "", "Service stopped")
 }
@@ -157,9 +220,15 @@ func (s *Service) StartPortableMode(sftpdPort int, enabledSSHCommands []string,
 	dataProviderConf.Name = ""
 	dataProviderConf.CredentialsPath = filepath.Join(os.TempDir(), "credentials")
 	config.SetProviderConf(dataProviderConf)
+	kmsConf := config.GetKMSConfig()
+	kmsConf.MasterKeyPath = filepath.Join(os.TempDir(), "sftpgo_portable_master.key")
+	config.SetKMSConfig(kmsConf)
 	httpdConf := config.GetHTTPDConfig()
 	httpdConf.BindPort = 0
 	config.SetHTTPDConfig(httpdConf)
+	backupsConf := config.GetBackupsConfig()
+	backupsConf.Schedule = ""
+	config.SetBackupsConfig(backupsConf)
 	sftpdConf := config.GetSFTPDConfig()
 	sftpdConf.MaxAuthTries = 12
 	if sftpdPort > 0 {
@@ -234,6 +303,10 @@ func (s *Service) getPortableDirToServe() string {
 		dirToServe = s.PortableUser.FsConfig.S3Config.KeyPrefix
 	} else if s.PortableUser.FsConfig.Provider == 2 {
 		dirToServe = s.PortableUser.FsConfig.GCSConfig.KeyPrefix
+	} else if s.PortableUser.FsConfig.Provider == 3 {
+		dirToServe = s.PortableUser.FsConfig.AzBlobConfig.KeyPrefix
+	} else if s.PortableUser.FsConfig.Provider == 4 {
+		dirToServe = s.PortableUser.FsConfig.SFTPConfig.Prefix
 	} else {
 		dirToServe = s.PortableUser.HomeDir
 	}
@@ -8,8 +8,12 @@ import (
 	"syscall"
 
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/ftpd"
 	"github.com/drakkan/sftpgo/httpd"
 	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/webdavd"
 )
 
 func registerSigHup() {
@@ -20,6 +24,14 @@ func registerSigHup() {
 			logger.Debug(logSender, "", "Received reload request")
 			dataprovider.ReloadConfig()
 			httpd.ReloadTLSCertificate()
+			ftpd.ReloadTLSCertificate()
+			webdavd.ReloadTLSCertificate()
+			if err := utils.ReloadIPLists(); err != nil {
+				logger.Warn(logSender, "", "unable to reload IP lists: %v", err)
+			}
+			if err := sftpd.ReloadRevokedCertificates(); err != nil {
+				logger.Warn(logSender, "", "unable to reload revoked user certificates: %v", err)
+			}
 		}
 	}()
 }
@@ -0,0 +1,495 @@
+package sftpd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	krlMagic                    = "SSHKRL\n\x00"
+	krlFormatVersion            = 1
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+	krlCertSectionSerialList    = 0x20
+	krlCertSectionSerialRange   = 0x21
+	krlCertSectionSerialBitmap  = 0x22
+	krlCertSectionKeyID         = 0x23
+	sourceAddressOption         = "source-address"
+)
+
+var (
+	certChecker    *ssh.CertChecker
+	revocationList = &revokedCertsManager{
+		lock: new(sync.RWMutex),
+	}
+	errKRLTruncated = errors.New("truncated revocation list")
+)
+
+// krlSerialRange defines a range of revoked certificate serials, both bounds are included
+type krlSerialRange struct {
+	min uint64
+	max uint64
+}
+
+// krlCertificates defines the certificates revoked for a certification authority
+type krlCertificates struct {
+	// empty means any certification authority
+	caKey   []byte
+	serials []krlSerialRange
+	keyIDs  []string
+}
+
+// revocationData defines the revoked keys and certificates loaded from an OpenSSH
+// key revocation list (KRL) or from a plain text file containing public keys, one per line
+type revocationData struct {
+	keys         map[string]bool
+	sha1Hashes   map[string]bool
+	sha256Hashes map[string]bool
+	certificates []krlCertificates
+}
+
+func newRevocationData() *revocationData {
+	return &revocationData{
+		keys:         make(map[string]bool),
+		sha1Hashes:   make(map[string]bool),
+		sha256Hashes: make(map[string]bool),
+	}
+}
+
+func (r *revocationData) isKeyRevoked(key ssh.PublicKey) bool {
+	blob := key.Marshal()
+	if r.keys[string(blob)] {
+		return true
+	}
+	sha1Hash := sha1.Sum(blob)
+	if r.sha1Hashes[string(sha1Hash[:])] {
+		return true
+	}
+	sha256Hash := sha256.Sum256(blob)
+	return r.sha256Hashes[string(sha256Hash[:])]
+}
+
+// isCertRevoked returns true if the certificate, the certified key or the signing CA are revoked
+func (r *revocationData) isCertRevoked(cert *ssh.Certificate) bool {
+	if r.isKeyRevoked(cert.Key) || r.isKeyRevoked(cert.SignatureKey) {
+		return true
+	}
+	caKey := cert.SignatureKey.Marshal()
+	for _, c := range r.certificates {
+		if len(c.caKey) > 0 && !bytes.Equal(c.caKey, caKey) {
+			continue
+		}
+		for _, s := range c.serials {
+			if cert.Serial >= s.min && cert.Serial <= s.max {
+				return true
+			}
+		}
+		if utils.IsStringInSlice(cert.KeyId, c.keyIDs) {
+			return true
+		}
+	}
+	return false
+}
+
+type krlReader struct {
+	data []byte
+}
+
+func (r *krlReader) readByte() (byte, error) {
+	if len(r.data) < 1 {
+		return 0, errKRLTruncated
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b, nil
+}
+
+func (r *krlReader) readUint32() (uint32, error) {
+	if len(r.data) < 4 {
+		return 0, errKRLTruncated
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v, nil
+}
+
+func (r *krlReader) readUint64() (uint64, error) {
+	if len(r.data) < 8 {
+		return 0, errKRLTruncated
+	}
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v, nil
+}
+
+func (r *krlReader) readString() ([]byte, error) {
+	length, err := r.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(r.data)) < length {
+		return nil, errKRLTruncated
+	}
+	s := r.data[:length]
+	r.data = r.data[length:]
+	return s, nil
+}
+
+func (r *krlReader) isEmpty() bool {
+	return len(r.data) == 0
+}
+
+// parseKRL parses an OpenSSH key revocation list, the format is described in PROTOCOL.krl
+// inside the OpenSSH sources. Signature sections are ignored
+func parseKRL(data []byte) (*revocationData, error) {
+	if !bytes.HasPrefix(data, []byte(krlMagic)) {
+		return nil, errors.New("invalid revocation list magic")
+	}
+	r := &krlReader{data: data[len(krlMagic):]}
+	version, err := r.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if version != krlFormatVersion {
+		return nil, fmt.Errorf("unsupported revocation list format version: %v", version)
+	}
+	// krl version, generated date and flags
+	for i := 0; i < 3; i++ {
+		if _, err = r.readUint64(); err != nil {
+			return nil, err
+		}
+	}
+	// reserved and comment
+	for i := 0; i < 2; i++ {
+		if _, err = r.readString(); err != nil {
+			return nil, err
+		}
+	}
+	result := newRevocationData()
+	for !r.isEmpty() {
+		sectionType, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		sectionData, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		switch sectionType {
+		case krlSectionCertificates:
+			certs, err := parseKRLCertificates(sectionData)
+			if err != nil {
+				return nil, err
+			}
+			result.certificates = append(result.certificates, certs)
+		case krlSectionExplicitKey, krlSectionFingerprintSHA1, krlSectionFingerprintSHA256:
+			s := &krlReader{data: sectionData}
+			for !s.isEmpty() {
+				blob, err := s.readString()
+				if err != nil {
+					return nil, err
+				}
+				switch sectionType {
+				case krlSectionExplicitKey:
+					result.keys[string(blob)] = true
+				case krlSectionFingerprintSHA1:
+					result.sha1Hashes[string(blob)] = true
+				default:
+					result.sha256Hashes[string(blob)] = true
+				}
+			}
+		case krlSectionSignature:
+			continue
+		default:
+			return nil, fmt.Errorf("unsupported revocation list section type: %v", sectionType)
+		}
+	}
+	return result, nil
+}
+
+func parseKRLCertificates(data []byte) (krlCertificates, error) {
+	var result krlCertificates
+	r := &krlReader{data: data}
+	caKey, err := r.readString()
+	if err != nil {
+		return result, err
+	}
+	result.caKey = caKey
+	// reserved
+	if _, err = r.readString(); err != nil {
+		return result, err
+	}
+	for !r.isEmpty() {
+		sectionType, err := r.readByte()
+		if err != nil {
+			return result, err
+		}
+		sectionData, err := r.readString()
+		if err != nil {
+			return result, err
+		}
+		s := &krlReader{data: sectionData}
+		switch sectionType {
+		case krlCertSectionSerialList:
+			for !s.isEmpty() {
+				serial, err := s.readUint64()
+				if err != nil {
+					return result, err
+				}
+				result.serials = append(result.serials, krlSerialRange{min: serial, max: serial})
+			}
+		case krlCertSectionSerialRange:
+			min, err := s.readUint64()
+			if err != nil {
+				return result, err
+			}
+			max, err := s.readUint64()
+			if err != nil {
+				return result, err
+			}
+			result.serials = append(result.serials, krlSerialRange{min: min, max: max})
+		case krlCertSectionSerialBitmap:
+			offset, err := s.readUint64()
+			if err != nil {
+				return result, err
+			}
+			bitmap, err := s.readString()
+			if err != nil {
+				return result, err
+			}
+			n := new(big.Int).SetBytes(bitmap)
+			for i := 0; i < n.BitLen(); i++ {
+				if n.Bit(i) == 1 {
+					serial := offset + uint64(i)
+					result.serials = append(result.serials, krlSerialRange{min: serial, max: serial})
+				}
+			}
+		case krlCertSectionKeyID:
+			for !s.isEmpty() {
+				keyID, err := s.readString()
+				if err != nil {
+					return result, err
+				}
+				result.keyIDs = append(result.keyIDs, string(keyID))
+			}
+		default:
+			return result, fmt.Errorf("unsupported revocation list certificate section type: %v", sectionType)
+		}
+	}
+	return result, nil
+}
+
+// parsePublicKeys parses the given public keys, one per line, in authorized keys format.
+// Empty lines and lines starting with "#" are ignored
+func parsePublicKeys(data []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse public key %#v: %v", line, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// parseRevokedKeys parses a plain text file containing revoked public keys,
+// one per line, in authorized keys format
+func parseRevokedKeys(data []byte) (*revocationData, error) {
+	keys, err := parsePublicKeys(data)
+	if err != nil {
+		return nil, err
+	}
+	result := newRevocationData()
+	for _, key := range keys {
+		result.keys[string(key.Marshal())] = true
+	}
+	return result, nil
+}
+
+type revokedCertsManager struct {
+	filePath string
+	data     *revocationData
+	lock     *sync.RWMutex
+}
+
+func (m *revokedCertsManager) load() error {
+	if len(m.filePath) == 0 {
+		return nil
+	}
+	content, err := ioutil.ReadFile(m.filePath)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to read revoked user certificates file %#v: %v", m.filePath, err)
+		return err
+	}
+	var data *revocationData
+	if bytes.HasPrefix(content, []byte(krlMagic)) {
+		data, err = parseKRL(content)
+	} else {
+		data, err = parseRevokedKeys(content)
+	}
+	if err != nil {
+		logger.Warn(logSender, "", "unable to parse revoked user certificates file %#v: %v", m.filePath, err)
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.data = data
+	logger.Debug(logSender, "", "revoked user certificates file %#v loaded", m.filePath)
+	return nil
+}
+
+func (m *revokedCertsManager) isRevoked(cert *ssh.Certificate) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.data == nil {
+		return false
+	}
+	return m.data.isCertRevoked(cert)
+}
+
+func getConfigFilePath(name, configDir string) string {
+	if !filepath.IsAbs(name) {
+		return filepath.Join(configDir, name)
+	}
+	return name
+}
+
+func (c Configuration) configureCertificateAuth(configDir string) error {
+	if len(c.TrustedUserCAKeys) == 0 {
+		return nil
+	}
+	var caKeys []ssh.PublicKey
+	for _, keyFile := range c.TrustedUserCAKeys {
+		keyFile = getConfigFilePath(keyFile, configDir)
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to read trusted user CA keys file %#v: %v", keyFile, err)
+			return err
+		}
+		keys, err := parsePublicKeys(content)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to parse trusted user CA keys file %#v: %v", keyFile, err)
+			return err
+		}
+		for _, key := range keys {
+			logger.Info(logSender, "", "trusted user CA key loaded, type %#v fingerprint %#v", key.Type(),
+				ssh.FingerprintSHA256(key))
+		}
+		caKeys = append(caKeys, keys...)
+	}
+	if len(caKeys) == 0 {
+		return errors.New("no trusted user CA keys found")
+	}
+	revoked := &revokedCertsManager{
+		lock: new(sync.RWMutex),
+	}
+	if len(c.RevokedUserCertsFile) > 0 {
+		revoked.filePath = getConfigFilePath(c.RevokedUserCertsFile, configDir)
+		if err := revoked.load(); err != nil {
+			return err
+		}
+	}
+	revocationList = revoked
+	certChecker = &ssh.CertChecker{
+		SupportedCriticalOptions: []string{sourceAddressOption},
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			authKey := auth.Marshal()
+			for _, k := range caKeys {
+				if bytes.Equal(k.Marshal(), authKey) {
+					return true
+				}
+			}
+			return false
+		},
+		IsRevoked: revoked.isRevoked,
+	}
+	return nil
+}
+
+// checkCertificate validates the given user certificate for the given username and remote address
+func checkCertificate(cert *ssh.Certificate, username string, remoteAddr net.Addr) error {
+	if certChecker == nil {
+		return errors.New("certificate authentication is not enabled")
+	}
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("certificate has type %v", cert.CertType)
+	}
+	if !certChecker.IsUserAuthority(cert.SignatureKey) {
+		return fmt.Errorf("certificate signed by an unrecognized authority, fingerprint %#v",
+			ssh.FingerprintSHA256(cert.SignatureKey))
+	}
+	// certificates without principals are valid for any user, we require an explicit match
+	if !utils.IsStringInSlice(username, cert.ValidPrincipals) {
+		return fmt.Errorf("username %#v is not a valid principal for the certificate, principals: %v", username,
+			cert.ValidPrincipals)
+	}
+	if err := certChecker.CheckCert(username, cert); err != nil {
+		return err
+	}
+	if sourceAddress, ok := cert.CriticalOptions[sourceAddressOption]; ok {
+		if err := checkCertSourceAddress(sourceAddress, remoteAddr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkCertSourceAddress(sourceAddress string, remoteAddr net.Addr) error {
+	ip := net.ParseIP(utils.GetIPFromRemoteAddress(remoteAddr.String()))
+	if ip == nil {
+		return fmt.Errorf("unable to parse remote address %v to check the source-address restriction", remoteAddr)
+	}
+	for _, addr := range strings.Split(sourceAddress, ",") {
+		addr = strings.TrimSpace(addr)
+		if strings.Contains(addr, "/") {
+			_, network, err := net.ParseCIDR(addr)
+			if err != nil {
+				return fmt.Errorf("invalid source-address restriction %#v: %v", addr, err)
+			}
+			if network.Contains(ip) {
+				return nil
+			}
+		} else {
+			allowedIP := net.ParseIP(addr)
+			if allowedIP == nil {
+				return fmt.Errorf("invalid source-address restriction %#v", addr)
+			}
+			if allowedIP.Equal(ip) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("remote address %v is not allowed by the source-address restriction %#v", remoteAddr,
+		sourceAddress)
+}
+
+// ReloadRevokedCertificates reloads the revoked user certificates file, if configured.
+// If the file cannot be loaded the current revocation list is kept
+func ReloadRevokedCertificates() error {
+	return revocationList.load()
+}
@@ -0,0 +1,379 @@
+package sftpd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// HostEvent defines the events that the defender scores for a remote host
+type HostEvent int
+
+// Supported host events
+const (
+	// authentication failed for an existing user
+	HostEventLoginFailed HostEvent = iota
+	// authentication tried for a non-existent user
+	HostEventUserNotFound
+	// the client disconnected or failed the handshake without trying to authenticate
+	HostEventNoLoginTried
+)
+
+const (
+	// expired bans are kept for this time, so the ban time can be increased for repeat offenders
+	defenderBanRetention = 24 * time.Hour
+	defenderBansPageSize = 100
+)
+
+var (
+	defenderMgr *defender
+	// ErrHostBanned is returned if the remote host is banned by the defender
+	ErrHostBanned = errors.New("the remote host is banned")
+)
+
+// DefenderConfig defines the configuration for the built-in defender.
+// The defender keeps a score for each remote host, each failed login,
+// or connection without login, adds to the score and a host is banned
+// when its score, within the observation time, exceeds the threshold
+type DefenderConfig struct {
+	// Set to true to enable the defender
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// BanTime is the number of minutes that a host is banned
+	BanTime int `json:"ban_time" mapstructure:"ban_time"`
+	// Percentage increase of the ban time for each previous ban of the same host
+	BanTimeIncrement int `json:"ban_time_increment" mapstructure:"ban_time_increment"`
+	// Threshold value for banning a host
+	Threshold int `json:"threshold" mapstructure:"threshold"`
+	// Score for a failed login of an existing user
+	ScoreValid int `json:"score_valid" mapstructure:"score_valid"`
+	// Score for a login attempt of a non-existent user
+	ScoreInvalid int `json:"score_invalid" mapstructure:"score_invalid"`
+	// Score for a connection closed, or a handshake failed, without any login attempt
+	ScoreNoAuth int `json:"score_no_auth" mapstructure:"score_no_auth"`
+	// Defines the time window, in minutes, for tracking host events
+	ObservationTime int `json:"observation_time" mapstructure:"observation_time"`
+	// Maximum number of hosts to track, the hosts with the oldest
+	// events are discarded when this limit is exceeded
+	EntriesLimit int `json:"entries_limit" mapstructure:"entries_limit"`
+}
+
+func (c *DefenderConfig) validate() error {
+	if c.BanTime <= 0 {
+		return fmt.Errorf("invalid ban_time: %v", c.BanTime)
+	}
+	if c.BanTimeIncrement < 0 {
+		return fmt.Errorf("invalid ban_time_increment: %v", c.BanTimeIncrement)
+	}
+	if c.Threshold <= 0 {
+		return fmt.Errorf("invalid threshold: %v", c.Threshold)
+	}
+	if c.ScoreValid < 0 || c.ScoreInvalid < 0 || c.ScoreNoAuth < 0 {
+		return errors.New("scores cannot be negative")
+	}
+	if c.ObservationTime <= 0 {
+		return fmt.Errorf("invalid observation_time: %v", c.ObservationTime)
+	}
+	if c.EntriesLimit <= 0 {
+		return fmt.Errorf("invalid entries_limit: %v", c.EntriesLimit)
+	}
+	return nil
+}
+
+type hostEvent struct {
+	date  time.Time
+	score int
+}
+
+type hostScore struct {
+	totalScore int
+	events     []hostEvent
+}
+
+func (h *hostScore) lastEventTime() time.Time {
+	if len(h.events) == 0 {
+		return time.Time{}
+	}
+	return h.events[len(h.events)-1].date
+}
+
+// removeExpiredEvents removes the events older than the given time
+func (h *hostScore) removeExpiredEvents(before time.Time) {
+	var events []hostEvent
+	h.totalScore = 0
+	for _, e := range h.events {
+		if e.date.After(before) {
+			events = append(events, e)
+			h.totalScore += e.score
+		}
+	}
+	h.events = events
+}
+
+type defender struct {
+	sync.RWMutex
+	config DefenderConfig
+	// scores for the tracked hosts, the IP address is the key
+	hosts map[string]*hostScore
+	// ban expiration for the banned hosts, the IP address is the key
+	banned map[string]time.Time
+}
+
+func newDefender(config DefenderConfig) (*defender, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	d := &defender{
+		config: config,
+		hosts:  make(map[string]*hostScore),
+		banned: make(map[string]time.Time),
+	}
+	if err := d.loadBans(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// loadBans loads the active bans from the data provider
+func (d *defender) loadBans() error {
+	offset := 0
+	for {
+		bans, err := dataprovider.GetBannedIPs(dataProvider, defenderBansPageSize, offset, "ASC")
+		if err != nil {
+			return err
+		}
+		for _, ban := range bans {
+			if ban.IsActive() {
+				d.banned[ban.IP] = utils.GetTimeFromMsecSinceEpoch(ban.BannedUntil)
+			}
+		}
+		if len(bans) < defenderBansPageSize {
+			break
+		}
+		offset += len(bans)
+	}
+	logger.Debug(logSender, "", "defender initialized, active bans loaded: %v", len(d.banned))
+	return nil
+}
+
+func (d *defender) isBanned(ip string) bool {
+	d.RLock()
+	banTime, ok := d.banned[ip]
+	d.RUnlock()
+	if !ok {
+		return false
+	}
+	if banTime.After(time.Now()) {
+		return true
+	}
+	d.Lock()
+	// check again, the ban could be updated in the meantime
+	if banTime, ok = d.banned[ip]; ok && !banTime.After(time.Now()) {
+		delete(d.banned, ip)
+	}
+	d.Unlock()
+	return false
+}
+
+func (d *defender) getScore(event HostEvent) int {
+	switch event {
+	case HostEventLoginFailed:
+		return d.config.ScoreValid
+	case HostEventUserNotFound:
+		return d.config.ScoreInvalid
+	default:
+		return d.config.ScoreNoAuth
+	}
+}
+
+func (d *defender) addEvent(ip string, event HostEvent) {
+	score := d.getScore(event)
+	if score == 0 || net.ParseIP(ip) == nil {
+		return
+	}
+	d.Lock()
+	if _, ok := d.banned[ip]; ok {
+		d.Unlock()
+		return
+	}
+	now := time.Now()
+	h, ok := d.hosts[ip]
+	if !ok {
+		h = &hostScore{}
+		d.hosts[ip] = h
+	}
+	h.removeExpiredEvents(now.Add(-time.Duration(d.config.ObservationTime) * time.Minute))
+	h.events = append(h.events, hostEvent{
+		date:  now,
+		score: score,
+	})
+	h.totalScore += score
+	if h.totalScore < d.config.Threshold {
+		d.cleanupHosts(now)
+		d.Unlock()
+		return
+	}
+	delete(d.hosts, ip)
+	// the ban is added to the in memory map before it is persisted, so the host is banned immediately
+	d.banned[ip] = now.Add(time.Duration(d.config.BanTime) * time.Minute)
+	d.Unlock()
+	d.banHost(ip, now)
+}
+
+// banHost persists the ban for the given IP and updates the ban expiration
+// increasing the ban time if the host was already banned
+func (d *defender) banHost(ip string, now time.Time) {
+	ban, err := dataprovider.BannedIPExists(dataProvider, ip)
+	isNew := false
+	if err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); !ok {
+			logger.Warn(logSender, "", "unable to get ban for host %#v: %v", ip, err)
+		}
+		isNew = true
+		ban = dataprovider.BannedIP{
+			IP: ip,
+		}
+	}
+	banTime := time.Duration(d.config.BanTime) * time.Minute
+	banTime += banTime * time.Duration(d.config.BanTimeIncrement*ban.BanCount) / 100
+	banUntil := now.Add(banTime)
+	ban.BanCount++
+	ban.BannedUntil = utils.GetTimeAsMsSinceEpoch(banUntil)
+	if isNew {
+		err = dataprovider.AddBannedIP(dataProvider, ban)
+	} else {
+		err = dataprovider.UpdateBannedIP(dataProvider, ban)
+	}
+	if err != nil {
+		logger.Warn(logSender, "", "unable to save ban for host %#v: %v", ip, err)
+	}
+	d.Lock()
+	d.banned[ip] = banUntil
+	d.Unlock()
+	logger.Info(logSender, "", "host %#v banned until %v, ban count: %v", ip, banUntil.Format(time.RFC3339),
+		ban.BanCount)
+}
+
+// cleanupHosts removes the hosts without events inside the observation time and,
+// if the entries limit is exceeded, the hosts with the oldest events.
+// It must be called with the lock held
+func (d *defender) cleanupHosts(now time.Time) {
+	if len(d.hosts) <= d.config.EntriesLimit {
+		return
+	}
+	before := now.Add(-time.Duration(d.config.ObservationTime) * time.Minute)
+	for ip, h := range d.hosts {
+		h.removeExpiredEvents(before)
+		if len(h.events) == 0 {
+			delete(d.hosts, ip)
+		}
+	}
+	if len(d.hosts) <= d.config.EntriesLimit {
+		return
+	}
+	ips := make([]string, 0, len(d.hosts))
+	for ip := range d.hosts {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return d.hosts[ips[i]].lastEventTime().Before(d.hosts[ips[j]].lastEventTime())
+	})
+	for _, ip := range ips[:len(ips)-d.config.EntriesLimit] {
+		delete(d.hosts, ip)
+	}
+}
+
+// unban removes the ban, if any, for the given IP
+func (d *defender) unban(ip string) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.banned, ip)
+	delete(d.hosts, ip)
+}
+
+// cleanupBans removes the expired bans from memory and the bans
+// expired for more than the retention time from the data provider
+func (d *defender) cleanupBans() {
+	now := time.Now()
+	d.Lock()
+	for ip, banTime := range d.banned {
+		if !banTime.After(now) {
+			delete(d.banned, ip)
+		}
+	}
+	d.Unlock()
+	err := dataprovider.CleanupBannedIPs(dataProvider, utils.GetTimeAsMsSinceEpoch(now.Add(-defenderBanRetention)))
+	if err != nil {
+		logger.Warn(logSender, "", "unable to cleanup expired bans: %v", err)
+	}
+}
+
+func startDefenderCleanup() {
+	ticker := time.NewTicker(30 * time.Minute)
+	go func() {
+		for range ticker.C {
+			defenderMgr.cleanupBans()
+		}
+	}()
+}
+
+// InitializeDefender configures the defender shared by all the protocols,
+// it is disabled if the given configuration is not enabled
+func InitializeDefender(config DefenderConfig) error {
+	if !config.Enabled {
+		defenderMgr = nil
+		return nil
+	}
+	d, err := newDefender(config)
+	if err != nil {
+		return err
+	}
+	defenderMgr = d
+	return nil
+}
+
+// IsBanned returns true if the defender is enabled and the given IP address is banned.
+// The hosts inside the server wide allow list are never banned
+func IsBanned(ip string) bool {
+	if defenderMgr == nil || utils.IsIPAllowListed(ip) {
+		return false
+	}
+	return defenderMgr.isBanned(ip)
+}
+
+// AddDefenderEvent adds the score for the given event to the given IP address,
+// the host is banned if its score exceeds the configured threshold.
+// This method does nothing if the defender is disabled or the IP address is allow listed
+func AddDefenderEvent(ip string, event HostEvent) {
+	if defenderMgr == nil || utils.IsIPAllowListed(ip) {
+		return
+	}
+	defenderMgr.addEvent(ip, event)
+}
+
+// GetLoginFailedEvent returns the defender event matching the given authentication error
+func GetLoginFailedEvent(err error) HostEvent {
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		return HostEventUserNotFound
+	}
+	return HostEventLoginFailed
+}
+
+// UnbanHost removes the ban for the given IP address from the data provider and from the defender
+func UnbanHost(ban dataprovider.BannedIP) error {
+	err := dataprovider.DeleteBannedIP(dataProvider, ban)
+	if err != nil {
+		return err
+	}
+	if defenderMgr != nil {
+		defenderMgr.unban(ban.IP)
+	}
+	logger.Info(logSender, "", "ban removed for host %#v", ban.IP)
+	return nil
+}
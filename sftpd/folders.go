@@ -0,0 +1,167 @@
+package sftpd
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// folderFilesystems caches, for a connection, the filesystems for the virtual
+// folders not served by the user's filesystem. They are created on first use
+type folderFilesystems struct {
+	sync.Mutex
+	filesystems map[string]vfs.Fs
+}
+
+func newFolderFilesystems() *folderFilesystems {
+	return &folderFilesystems{
+		filesystems: make(map[string]vfs.Fs),
+	}
+}
+
+// getFolderFs returns the filesystem for the given virtual folder
+func (c Connection) getFolderFs(folder dataprovider.VirtualFolder) (vfs.Fs, error) {
+	if c.folders == nil {
+		return c.newFolderFs(folder)
+	}
+	c.folders.Lock()
+	defer c.folders.Unlock()
+
+	if fs, ok := c.folders.filesystems[folder.VirtualPath]; ok {
+		return fs, nil
+	}
+	fs, err := c.newFolderFs(folder)
+	if err == nil {
+		c.folders.filesystems[folder.VirtualPath] = fs
+	}
+	return fs, err
+}
+
+func (c Connection) newFolderFs(folder dataprovider.VirtualFolder) (vfs.Fs, error) {
+	fs, err := c.User.GetVirtualFolderFilesystem(c.ID, folder)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "unable to get the filesystem for virtual folder %#v: %v", folder.VirtualPath, err)
+		return nil, err
+	}
+	fs.CheckRootPath(c.User.Username, c.User.GetUID(), c.User.GetGID())
+	return fs, nil
+}
+
+// getFsKeyForPath returns the virtual path of the folder with its own filesystem
+// containing the given SFTP path. An empty string is returned for the paths served
+// by the user's filesystem
+func (c Connection) getFsKeyForPath(sftpPath string) string {
+	folder, err := c.User.GetVirtualFolderForPath(sftpPath)
+	if err != nil || c.User.IsMappedVirtualFolder(folder) {
+		return ""
+	}
+	return folder.VirtualPath
+}
+
+// getFsForPath returns the filesystem serving the given SFTP path and the path
+// to resolve inside it. For the virtual folders with their own filesystem the
+// returned path is relative to the folder
+func (c Connection) getFsForPath(sftpPath string) (vfs.Fs, string, error) {
+	folder, err := c.User.GetVirtualFolderForPath(sftpPath)
+	if err != nil || c.User.IsMappedVirtualFolder(folder) {
+		return c.fs, sftpPath, nil
+	}
+	fs, err := c.getFolderFs(folder)
+	if err != nil {
+		return c.fs, sftpPath, err
+	}
+	folderPath := strings.TrimPrefix(utils.CleanSFTPPath(sftpPath), folder.VirtualPath)
+	if len(folderPath) == 0 {
+		folderPath = "/"
+	}
+	return fs, folderPath, nil
+}
+
+// resolvePath returns the filesystem serving the given SFTP path and the matching
+// filesystem path. If the filesystem cannot be created the user's one is returned,
+// so the error can be converted as usual
+func (c Connection) resolvePath(sftpPath string) (vfs.Fs, string, error) {
+	fs, p, err := c.getFsForPath(sftpPath)
+	if err != nil {
+		return fs, "", err
+	}
+	fsPath, err := fs.ResolvePath(p)
+	return fs, fsPath, err
+}
+
+// createFoldersParentDirs creates, inside the user's filesystem, the missing parent
+// directories for the virtual folders with their own filesystem, so the folders are
+// reachable while browsing. For mapped folders they are created by the user's filesystem
+func (c Connection) createFoldersParentDirs() {
+	for _, folder := range c.User.VirtualFolders {
+		if c.User.IsMappedVirtualFolder(folder) {
+			continue
+		}
+		dirs := utils.GetDirsForSFTPPath(path.Dir(folder.VirtualPath))
+		// dirs are in reverse order and the last one is the root dir
+		for idx := len(dirs) - 2; idx >= 0; idx-- {
+			fsPath, err := c.fs.ResolvePath(dirs[idx])
+			if err != nil {
+				break
+			}
+			if _, err = c.fs.Stat(fsPath); c.fs.IsNotExist(err) {
+				if err = c.fs.Mkdir(fsPath); err != nil {
+					c.Log(logger.LevelWarn, logSender, "unable to create parent dir %#v for virtual folder %#v: %v",
+						dirs[idx], folder.VirtualPath, err)
+					break
+				}
+				vfs.SetPathPermissions(c.fs, fsPath, c.User.GetUID(), c.User.GetGID())
+			}
+		}
+	}
+}
+
+// getQuotaScope returns the virtual path of the folder containing the given SFTP path,
+// or an empty string if the path is tracked using the user's quota
+func getQuotaScope(user dataprovider.User, sftpPath string) string {
+	folder, err := user.GetVirtualFolderForPath(sftpPath)
+	if err != nil {
+		return ""
+	}
+	return folder.VirtualPath
+}
+
+// updateQuota updates the used quota for the virtual folder containing the given
+// SFTP path or for the user if the path is not inside a virtual folder
+func updateQuota(user dataprovider.User, sftpPath string, filesAdd int, sizeAdd int64) error {
+	folder, err := user.GetVirtualFolderForPath(sftpPath)
+	if err == nil {
+		return dataprovider.UpdateVirtualFolderQuota(dataProvider, user, folder, filesAdd, sizeAdd, false)
+	}
+	return dataprovider.UpdateUserQuota(dataProvider, user, filesAdd, sizeAdd, false)
+}
+
+// getDirContentsSize returns the number of files and their size for the given directory
+func getDirContentsSize(fs vfs.Fs, dirPath string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	files, err := fs.ReadDir(dirPath)
+	if err != nil {
+		return numFiles, size, err
+	}
+	for _, info := range files {
+		if info.IsDir() {
+			n, s, err := getDirContentsSize(fs, fs.Join(dirPath, info.Name()))
+			if err != nil {
+				return numFiles, size, err
+			}
+			numFiles += n
+			size += s
+		} else if info.Mode()&os.ModeSymlink != os.ModeSymlink {
+			numFiles++
+			size += info.Size()
+		}
+	}
+	return numFiles, size, nil
+}
@@ -1,6 +1,7 @@
 package sftpd
 
 import (
+	"fmt"
 	"io"
 	"net"
 	"os"
@@ -17,6 +18,14 @@ import (
 	"github.com/pkg/sftp"
 )
 
+// SFTP open flags as defined in draft-ietf-secsh-filexfer-02
+const (
+	sftpFlagWrite  = 0x00000002
+	sftpFlagAppend = 0x00000004
+	sftpFlagCreate = 0x00000008
+	sftpFlagTrunc  = 0x00000010
+)
+
 // Connection details for an authenticated user
 type Connection struct {
 	// Unique identifier for the connection
@@ -36,6 +45,32 @@ type Connection struct {
 	channel      ssh.Channel
 	command      string
 	fs           vfs.Fs
+	// filesystems for the virtual folders not served by fs
+	folders *folderFilesystems
+	// closer is used to disconnect clients connected using protocols other than SSH
+	closer io.Closer
+}
+
+// NewConnection returns a connection for a user authenticated using a protocol other than SSH,
+// for example FTP. Such connections share permissions, quota, file extensions filters and
+// custom actions with the SFTP ones. The closer will be used to disconnect the client, for example
+// if the connection is idle or if an administrator closes it
+func NewConnection(connectionID, protocol, clientVersion string, remoteAddr net.Addr, user dataprovider.User,
+	fs vfs.Fs, closer io.Closer) Connection {
+	c := Connection{
+		ID:            connectionID,
+		User:          user,
+		ClientVersion: clientVersion,
+		RemoteAddr:    remoteAddr,
+		StartTime:     time.Now(),
+		lastActivity:  time.Now(),
+		protocol:      protocol,
+		fs:            fs,
+		folders:       newFolderFilesystems(),
+		closer:        closer,
+	}
+	c.createFoldersParentDirs()
+	return c
 }
 
 // Log outputs a log entry to the configured logger
@@ -56,20 +91,20 @@ func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 		return nil, sftp.ErrSSHFxPermissionDenied
 	}
 
-	p, err := c.fs.ResolvePath(request.Filepath)
+	fs, p, err := c.resolvePath(request.Filepath)
 	if err != nil {
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
-	fi, err := c.fs.Stat(p)
+	fi, err := fs.Stat(p)
 	if err != nil {
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
-	file, r, cancelFn, err := c.fs.Open(p)
+	file, r, cancelFn, err := fs.Open(p)
 	if err != nil {
 		c.Log(logger.LevelWarn, logSender, "could not open file %#v for reading: %+v", p, err)
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
 	c.Log(logger.LevelDebug, logSender, "fileread requested for path: %#v", p)
@@ -80,6 +115,7 @@ func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 		writerAt:       nil,
 		cancelFn:       cancelFn,
 		path:           p,
+		sftpPath:       request.Filepath,
 		start:          time.Now(),
 		bytesSent:      0,
 		bytesReceived:  0,
@@ -108,27 +144,27 @@ func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 		return nil, sftp.ErrSSHFxPermissionDenied
 	}
 
-	p, err := c.fs.ResolvePath(request.Filepath)
+	fs, p, err := c.resolvePath(request.Filepath)
 	if err != nil {
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
 	filePath := p
-	if isAtomicUploadEnabled() && c.fs.IsAtomicUploadSupported() {
-		filePath = c.fs.GetAtomicUploadPath(p)
+	if isAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+		filePath = fs.GetAtomicUploadPath(p)
 	}
 
-	stat, statErr := c.fs.Stat(p)
-	if c.fs.IsNotExist(statErr) {
+	stat, statErr := fs.Stat(p)
+	if fs.IsNotExist(statErr) {
 		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(request.Filepath)) {
 			return nil, sftp.ErrSSHFxPermissionDenied
 		}
-		return c.handleSFTPUploadToNewFile(p, filePath)
+		return c.handleSFTPUploadToNewFile(fs, request.Filepath, p, filePath)
 	}
 
 	if statErr != nil {
 		c.Log(logger.LevelError, logSender, "error performing file stat %#v: %+v", p, statErr)
-		return nil, vfs.GetSFTPError(c.fs, statErr)
+		return nil, vfs.GetSFTPError(fs, statErr)
 	}
 
 	// This happen if we upload a file that has the same name of an existing directory
@@ -141,7 +177,7 @@ func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 		return nil, sftp.ErrSSHFxPermissionDenied
 	}
 
-	return c.handleSFTPUploadToExistingFile(request.Pflags(), p, filePath, stat.Size())
+	return c.handleSFTPUploadToExistingFile(fs, request.Pflags(), request.Filepath, p, filePath, stat.Size())
 }
 
 // Filecmd hander for basic SFTP system calls related to files, but not anything to do with reading
@@ -149,9 +185,9 @@ func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 func (c Connection) Filecmd(request *sftp.Request) error {
 	updateConnectionActivity(c.ID)
 
-	p, err := c.fs.ResolvePath(request.Filepath)
+	fs, p, err := c.resolvePath(request.Filepath)
 	if err != nil {
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
 	target, err := c.getSFTPCmdTargetPath(request.Target)
 	if err != nil {
@@ -163,28 +199,28 @@ func (c Connection) Filecmd(request *sftp.Request) error {
 
 	switch request.Method {
 	case "Setstat":
-		return c.handleSFTPSetstat(p, request)
+		return c.handleSFTPSetstat(fs, p, request)
 	case "Rename":
-		if err = c.handleSFTPRename(p, target, request); err != nil {
+		if err = c.handleSFTPRename(fs, p, target, request); err != nil {
 			return err
 		}
 		break
 	case "Rmdir":
-		return c.handleSFTPRmdir(p, request)
+		return c.handleSFTPRmdir(fs, p, request)
 
 	case "Mkdir":
-		err = c.handleSFTPMkdir(p, request)
+		err = c.handleSFTPMkdir(fs, p, request)
 		if err != nil {
 			return err
 		}
 		break
 	case "Symlink":
-		if err = c.handleSFTPSymlink(p, target, request); err != nil {
+		if err = c.handleSFTPSymlink(fs, p, target, request); err != nil {
 			return err
 		}
 		break
 	case "Remove":
-		return c.handleSFTPRemove(p, request)
+		return c.handleSFTPRemove(fs, p, request)
 
 	default:
 		return sftp.ErrSSHFxOpUnsupported
@@ -195,8 +231,9 @@ func (c Connection) Filecmd(request *sftp.Request) error {
 		fileLocation = target
 	}
 
-	// we return if we remove a file or a dir so source path or target path always exists here
-	vfs.SetPathPermissions(c.fs, fileLocation, c.User.GetUID(), c.User.GetGID())
+	// we return if we remove a file or a dir so source path or target path always exists here.
+	// Renames and symlinks between different filesystems are not allowed
+	vfs.SetPathPermissions(fs, fileLocation, c.User.GetUID(), c.User.GetGID())
 
 	return sftp.ErrSSHFxOk
 }
@@ -205,9 +242,9 @@ func (c Connection) Filecmd(request *sftp.Request) error {
 // a directory as well as perform file/folder stat calls.
 func (c Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 	updateConnectionActivity(c.ID)
-	p, err := c.fs.ResolvePath(request.Filepath)
+	fs, p, err := c.resolvePath(request.Filepath)
 	if err != nil {
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
 	switch request.Method {
@@ -217,10 +254,10 @@ func (c Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 		}
 
 		c.Log(logger.LevelDebug, logSender, "requested list file for dir: %#v", p)
-		files, err := c.fs.ReadDir(p)
+		files, err := fs.ReadDir(p)
 		if err != nil {
 			c.Log(logger.LevelWarn, logSender, "error listing directory: %+v", err)
-			return nil, vfs.GetSFTPError(c.fs, err)
+			return nil, vfs.GetSFTPError(fs, err)
 		}
 
 		return listerAt(c.User.AddVirtualDirs(files, request.Filepath)), nil
@@ -230,10 +267,10 @@ func (c Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 		}
 
 		c.Log(logger.LevelDebug, logSender, "requested stat for path: %#v", p)
-		s, err := c.fs.Stat(p)
+		s, err := fs.Stat(p)
 		if err != nil {
 			c.Log(logger.LevelWarn, logSender, "error running stat on path: %+v", err)
-			return nil, vfs.GetSFTPError(c.fs, err)
+			return nil, vfs.GetSFTPError(fs, err)
 		}
 
 		return listerAt([]os.FileInfo{s}), nil
@@ -242,77 +279,157 @@ func (c Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 	}
 }
 
+// NewUploadRequest returns an SFTP request to upload a file to the given path.
+// If resume is true an existing file is not truncated and the client must write
+// starting from its current size, this requires a filesystem that supports upload resume.
+// It is used by protocols that cannot send an SFTP open request, for example FTP
+func NewUploadRequest(sftpPath string, resume bool) *sftp.Request {
+	request := sftp.NewRequest("Put", sftpPath)
+	request.Flags = sftpFlagWrite | sftpFlagCreate
+	if resume {
+		request.Flags |= sftpFlagAppend
+	} else {
+		request.Flags |= sftpFlagTrunc
+	}
+	return request
+}
+
+// ReadDir returns the contents of the directory identified by the given SFTP path,
+// virtual folders are included.
+// It is used by protocols, such as FTP, that cannot send an SFTP list request
+func (c Connection) ReadDir(sftpPath string) ([]os.FileInfo, error) {
+	lister, err := c.Filelist(sftp.NewRequest("List", sftpPath))
+	if err != nil {
+		return nil, err
+	}
+	return lister.(listerAt), nil
+}
+
+// Stat returns a FileInfo describing the file or directory identified by the given SFTP path.
+// It is used by protocols, such as FTP, that cannot send an SFTP stat request
+func (c Connection) Stat(sftpPath string) (os.FileInfo, error) {
+	lister, err := c.Filelist(sftp.NewRequest("Stat", sftpPath))
+	if err != nil {
+		return nil, err
+	}
+	return lister.(listerAt)[0], nil
+}
+
 func (c Connection) getSFTPCmdTargetPath(requestTarget string) (string, error) {
 	var target string
 	// If a target is provided in this request validate that it is going to the correct
 	// location for the server. If it is not, return an error
 	if len(requestTarget) > 0 {
 		var err error
-		target, err = c.fs.ResolvePath(requestTarget)
+		var fs vfs.Fs
+		fs, target, err = c.resolvePath(requestTarget)
 		if err != nil {
-			return target, vfs.GetSFTPError(c.fs, err)
+			return target, vfs.GetSFTPError(fs, err)
 		}
 	}
 	return target, nil
 }
 
-func (c Connection) handleSFTPSetstat(filePath string, request *sftp.Request) error {
+// Chmod changes the mode of the file or directory identified by the given SFTP path.
+// It is used by protocols, such as FTP, that cannot send an SFTP setstat request
+func (c Connection) Chmod(sftpPath string, fileMode os.FileMode) error {
+	updateConnectionActivity(c.ID)
+	if setstatMode == 1 {
+		return nil
+	}
+	fs, p, err := c.resolvePath(sftpPath)
+	if err != nil {
+		return vfs.GetSFTPError(fs, err)
+	}
+	return c.handleChmod(fs, p, c.getPathForSetstatPerms(fs, p, sftpPath), fileMode)
+}
+
+// Chtimes changes the access and modification times of the file or directory identified
+// by the given SFTP path.
+// It is used by protocols, such as FTP, that cannot send an SFTP setstat request
+func (c Connection) Chtimes(sftpPath string, accessTime, modificationTime time.Time) error {
+	updateConnectionActivity(c.ID)
 	if setstatMode == 1 {
 		return nil
 	}
-	pathForPerms := request.Filepath
-	if fi, err := c.fs.Lstat(filePath); err == nil {
+	fs, p, err := c.resolvePath(sftpPath)
+	if err != nil {
+		return vfs.GetSFTPError(fs, err)
+	}
+	return c.handleChtimes(fs, p, c.getPathForSetstatPerms(fs, p, sftpPath), accessTime, modificationTime)
+}
+
+func (c Connection) getPathForSetstatPerms(fs vfs.Fs, filePath, sftpPath string) string {
+	pathForPerms := sftpPath
+	if fi, err := fs.Lstat(filePath); err == nil {
 		if fi.IsDir() {
-			pathForPerms = path.Dir(request.Filepath)
+			pathForPerms = path.Dir(sftpPath)
 		}
 	}
+	return pathForPerms
+}
+
+func (c Connection) handleSFTPSetstat(fs vfs.Fs, filePath string, request *sftp.Request) error {
+	if setstatMode == 1 {
+		return nil
+	}
+	pathForPerms := c.getPathForSetstatPerms(fs, filePath, request.Filepath)
 	attrFlags := request.AttrFlags()
 	if attrFlags.Permissions {
-		if !c.User.HasPerm(dataprovider.PermChmod, pathForPerms) {
-			return sftp.ErrSSHFxPermissionDenied
-		}
-		fileMode := request.Attributes().FileMode()
-		if err := c.fs.Chmod(filePath, fileMode); err != nil {
-			c.Log(logger.LevelWarn, logSender, "failed to chmod path %#v, mode: %v, err: %+v", filePath, fileMode.String(), err)
-			return vfs.GetSFTPError(c.fs, err)
-		}
-		logger.CommandLog(chmodLogSender, filePath, "", c.User.Username, fileMode.String(), c.ID, c.protocol, -1, -1, "", "", "")
-		return nil
+		return c.handleChmod(fs, filePath, pathForPerms, request.Attributes().FileMode())
 	} else if attrFlags.UidGid {
-		if !c.User.HasPerm(dataprovider.PermChown, pathForPerms) {
-			return sftp.ErrSSHFxPermissionDenied
-		}
-		uid := int(request.Attributes().UID)
-		gid := int(request.Attributes().GID)
-		if err := c.fs.Chown(filePath, uid, gid); err != nil {
-			c.Log(logger.LevelWarn, logSender, "failed to chown path %#v, uid: %v, gid: %v, err: %+v", filePath, uid, gid, err)
-			return vfs.GetSFTPError(c.fs, err)
-		}
-		logger.CommandLog(chownLogSender, filePath, "", c.User.Username, "", c.ID, c.protocol, uid, gid, "", "", "")
-		return nil
+		return c.handleChown(fs, filePath, pathForPerms, int(request.Attributes().UID), int(request.Attributes().GID))
 	} else if attrFlags.Acmodtime {
-		if !c.User.HasPerm(dataprovider.PermChtimes, pathForPerms) {
-			return sftp.ErrSSHFxPermissionDenied
-		}
-		dateFormat := "2006-01-02T15:04:05" // YYYY-MM-DDTHH:MM:SS
 		accessTime := time.Unix(int64(request.Attributes().Atime), 0)
 		modificationTime := time.Unix(int64(request.Attributes().Mtime), 0)
-		accessTimeString := accessTime.Format(dateFormat)
-		modificationTimeString := modificationTime.Format(dateFormat)
-		if err := c.fs.Chtimes(filePath, accessTime, modificationTime); err != nil {
-			c.Log(logger.LevelWarn, logSender, "failed to chtimes for path %#v, access time: %v, modification time: %v, err: %+v",
-				filePath, accessTime, modificationTime, err)
-			return vfs.GetSFTPError(c.fs, err)
-		}
-		logger.CommandLog(chtimesLogSender, filePath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, accessTimeString,
-			modificationTimeString, "")
-		return nil
+		return c.handleChtimes(fs, filePath, pathForPerms, accessTime, modificationTime)
+	}
+	return nil
+}
+
+func (c Connection) handleChmod(fs vfs.Fs, filePath, pathForPerms string, fileMode os.FileMode) error {
+	if !c.User.HasPerm(dataprovider.PermChmod, pathForPerms) {
+		return sftp.ErrSSHFxPermissionDenied
 	}
+	if err := fs.Chmod(filePath, fileMode); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to chmod path %#v, mode: %v, err: %+v", filePath, fileMode.String(), err)
+		return vfs.GetSFTPError(fs, err)
+	}
+	logger.CommandLog(chmodLogSender, filePath, "", c.User.Username, fileMode.String(), c.ID, c.protocol, -1, -1, "", "", "")
 	return nil
 }
 
-func (c Connection) handleSFTPRename(sourcePath string, targetPath string, request *sftp.Request) error {
-	if c.fs.GetRelativePath(sourcePath) == "/" {
+func (c Connection) handleChown(fs vfs.Fs, filePath, pathForPerms string, uid, gid int) error {
+	if !c.User.HasPerm(dataprovider.PermChown, pathForPerms) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if err := fs.Chown(filePath, uid, gid); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to chown path %#v, uid: %v, gid: %v, err: %+v", filePath, uid, gid, err)
+		return vfs.GetSFTPError(fs, err)
+	}
+	logger.CommandLog(chownLogSender, filePath, "", c.User.Username, "", c.ID, c.protocol, uid, gid, "", "", "")
+	return nil
+}
+
+func (c Connection) handleChtimes(fs vfs.Fs, filePath, pathForPerms string, accessTime, modificationTime time.Time) error {
+	if !c.User.HasPerm(dataprovider.PermChtimes, pathForPerms) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	dateFormat := "2006-01-02T15:04:05" // YYYY-MM-DDTHH:MM:SS
+	accessTimeString := accessTime.Format(dateFormat)
+	modificationTimeString := modificationTime.Format(dateFormat)
+	if err := fs.Chtimes(filePath, accessTime, modificationTime); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to chtimes for path %#v, access time: %v, modification time: %v, err: %+v",
+			filePath, accessTime, modificationTime, err)
+		return vfs.GetSFTPError(fs, err)
+	}
+	logger.CommandLog(chtimesLogSender, filePath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, accessTimeString,
+		modificationTimeString, "")
+	return nil
+}
+
+func (c Connection) handleSFTPRename(fs vfs.Fs, sourcePath string, targetPath string, request *sftp.Request) error {
+	if fs.GetRelativePath(sourcePath) == "/" {
 		c.Log(logger.LevelWarn, logSender, "renaming root dir is not allowed")
 		return sftp.ErrSSHFxPermissionDenied
 	}
@@ -320,8 +437,13 @@ func (c Connection) handleSFTPRename(sourcePath string, targetPath string, reque
 		c.Log(logger.LevelWarn, logSender, "renaming a virtual folder is not allowed")
 		return sftp.ErrSSHFxPermissionDenied
 	}
+	if c.getFsKeyForPath(request.Filepath) != c.getFsKeyForPath(request.Target) {
+		c.Log(logger.LevelWarn, logSender, "renaming between different storage backends is not supported, source: %#v "+
+			"target: %#v", request.Filepath, request.Target)
+		return sftp.ErrSSHFxOpUnsupported
+	}
 	if !c.User.IsFileAllowed(request.Filepath) || !c.User.IsFileAllowed(request.Target) {
-		if fi, err := c.fs.Lstat(sourcePath); err == nil && fi.Mode().IsRegular() {
+		if fi, err := fs.Lstat(sourcePath); err == nil && fi.Mode().IsRegular() {
 			c.Log(logger.LevelDebug, logSender, "renaming file is not allowed, source: %#v target: %#v", request.Filepath,
 				request.Target)
 			return sftp.ErrSSHFxPermissionDenied
@@ -330,17 +452,53 @@ func (c Connection) handleSFTPRename(sourcePath string, targetPath string, reque
 	if !c.User.HasPerm(dataprovider.PermRename, path.Dir(request.Target)) {
 		return sftp.ErrSSHFxPermissionDenied
 	}
-	if err := c.fs.Rename(sourcePath, targetPath); err != nil {
+	// the mapped folders are served by the user's filesystem but they have their own quota
+	moveQuota := getQuotaScope(c.User, request.Filepath) != getQuotaScope(c.User, request.Target)
+	var numFiles int
+	var size int64
+	if moveQuota {
+		var err error
+		numFiles, size, err = c.getSizeForRename(fs, sourcePath)
+		if err != nil {
+			c.Log(logger.LevelWarn, logSender, "failed to compute the size for %#v: %+v", sourcePath, err)
+			return vfs.GetSFTPError(fs, err)
+		}
+		if !c.hasSpaceForRename(request.Target, numFiles, size) {
+			c.Log(logger.LevelInfo, logSender, "denying rename due to space limit, source: %#v target: %#v",
+				request.Filepath, request.Target)
+			return sftp.ErrSSHFxFailure
+		}
+	}
+	if err := fs.Rename(sourcePath, targetPath); err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to rename file, source: %#v target: %#v: %+v", sourcePath, targetPath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
+	}
+	if moveQuota && (numFiles != 0 || size != 0) {
+		updateQuota(c.User, request.Filepath, -numFiles, -size)
+		updateQuota(c.User, request.Target, numFiles, size)
 	}
 	logger.CommandLog(renameLogSender, sourcePath, targetPath, c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
-	go executeAction(operationRename, c.User.Username, sourcePath, targetPath, "", 0, vfs.IsLocalOsFs(c.fs))
+	go executeAction(operationRename, c.User.Username, sourcePath, targetPath, "", 0, vfs.IsLocalOsFs(fs))
 	return nil
 }
 
-func (c Connection) handleSFTPRmdir(dirPath string, request *sftp.Request) error {
-	if c.fs.GetRelativePath(dirPath) == "/" {
+// getSizeForRename returns the number of files and their size for the given file or directory
+func (c Connection) getSizeForRename(fs vfs.Fs, fsPath string) (int, int64, error) {
+	fi, err := fs.Lstat(fsPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		return 0, 0, nil
+	}
+	if fi.IsDir() {
+		return getDirContentsSize(fs, fsPath)
+	}
+	return 1, fi.Size(), nil
+}
+
+func (c Connection) handleSFTPRmdir(fs vfs.Fs, dirPath string, request *sftp.Request) error {
+	if fs.GetRelativePath(dirPath) == "/" {
 		c.Log(logger.LevelWarn, logSender, "removing root dir is not allowed")
 		return sftp.ErrSSHFxPermissionDenied
 	}
@@ -354,26 +512,26 @@ func (c Connection) handleSFTPRmdir(dirPath string, request *sftp.Request) error
 
 	var fi os.FileInfo
 	var err error
-	if fi, err = c.fs.Lstat(dirPath); err != nil {
+	if fi, err = fs.Lstat(dirPath); err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to remove a dir %#v: stat error: %+v", dirPath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
 	if !fi.IsDir() || fi.Mode()&os.ModeSymlink == os.ModeSymlink {
 		c.Log(logger.LevelDebug, logSender, "cannot remove %#v is not a directory", dirPath)
 		return sftp.ErrSSHFxFailure
 	}
 
-	if err = c.fs.Remove(dirPath, true); err != nil {
+	if err = fs.Remove(dirPath, true); err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to remove directory %#v: %+v", dirPath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
 
 	logger.CommandLog(rmdirLogSender, dirPath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
 	return sftp.ErrSSHFxOk
 }
 
-func (c Connection) handleSFTPSymlink(sourcePath string, targetPath string, request *sftp.Request) error {
-	if c.fs.GetRelativePath(sourcePath) == "/" {
+func (c Connection) handleSFTPSymlink(fs vfs.Fs, sourcePath string, targetPath string, request *sftp.Request) error {
+	if fs.GetRelativePath(sourcePath) == "/" {
 		c.Log(logger.LevelWarn, logSender, "symlinking root dir is not allowed")
 		return sftp.ErrSSHFxPermissionDenied
 	}
@@ -381,19 +539,24 @@ func (c Connection) handleSFTPSymlink(sourcePath string, targetPath string, requ
 		c.Log(logger.LevelWarn, logSender, "symlinking a virtual folder is not allowed")
 		return sftp.ErrSSHFxPermissionDenied
 	}
+	if c.getFsKeyForPath(request.Filepath) != c.getFsKeyForPath(request.Target) {
+		c.Log(logger.LevelWarn, logSender, "symlinking between different storage backends is not supported, source: %#v "+
+			"target: %#v", request.Filepath, request.Target)
+		return sftp.ErrSSHFxOpUnsupported
+	}
 	if !c.User.HasPerm(dataprovider.PermCreateSymlinks, path.Dir(request.Target)) {
 		return sftp.ErrSSHFxPermissionDenied
 	}
-	if err := c.fs.Symlink(sourcePath, targetPath); err != nil {
+	if err := fs.Symlink(sourcePath, targetPath); err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to create symlink %#v -> %#v: %+v", sourcePath, targetPath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
 
 	logger.CommandLog(symlinkLogSender, sourcePath, targetPath, c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
 	return nil
 }
 
-func (c Connection) handleSFTPMkdir(dirPath string, request *sftp.Request) error {
+func (c Connection) handleSFTPMkdir(fs vfs.Fs, dirPath string, request *sftp.Request) error {
 	if !c.User.HasPerm(dataprovider.PermCreateDirs, path.Dir(request.Filepath)) {
 		return sftp.ErrSSHFxPermissionDenied
 	}
@@ -401,17 +564,17 @@ func (c Connection) handleSFTPMkdir(dirPath string, request *sftp.Request) error
 		c.Log(logger.LevelWarn, logSender, "mkdir not allowed %#v is virtual folder is not allowed", request.Filepath)
 		return sftp.ErrSSHFxPermissionDenied
 	}
-	if err := c.fs.Mkdir(dirPath); err != nil {
+	if err := fs.Mkdir(dirPath); err != nil {
 		c.Log(logger.LevelWarn, logSender, "error creating missing dir: %#v error: %+v", dirPath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
-	vfs.SetPathPermissions(c.fs, dirPath, c.User.GetUID(), c.User.GetGID())
+	vfs.SetPathPermissions(fs, dirPath, c.User.GetUID(), c.User.GetGID())
 
 	logger.CommandLog(mkdirLogSender, dirPath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
 	return nil
 }
 
-func (c Connection) handleSFTPRemove(filePath string, request *sftp.Request) error {
+func (c Connection) handleSFTPRemove(fs vfs.Fs, filePath string, request *sftp.Request) error {
 	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(request.Filepath)) {
 		return sftp.ErrSSHFxPermissionDenied
 	}
@@ -419,9 +582,9 @@ func (c Connection) handleSFTPRemove(filePath string, request *sftp.Request) err
 	var size int64
 	var fi os.FileInfo
 	var err error
-	if fi, err = c.fs.Lstat(filePath); err != nil {
+	if fi, err = fs.Lstat(filePath); err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to remove a file %#v: stat error: %+v", filePath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
 	if fi.IsDir() && fi.Mode()&os.ModeSymlink != os.ModeSymlink {
 		c.Log(logger.LevelDebug, logSender, "cannot remove %#v is not a file/symlink", filePath)
@@ -434,33 +597,33 @@ func (c Connection) handleSFTPRemove(filePath string, request *sftp.Request) err
 	}
 
 	size = fi.Size()
-	if err := c.fs.Remove(filePath, false); err != nil {
+	if err := fs.Remove(filePath, false); err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to remove a file/symlink %#v: %+v", filePath, err)
-		return vfs.GetSFTPError(c.fs, err)
+		return vfs.GetSFTPError(fs, err)
 	}
 
 	logger.CommandLog(removeLogSender, filePath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
 	if fi.Mode()&os.ModeSymlink != os.ModeSymlink {
-		dataprovider.UpdateUserQuota(dataProvider, c.User, -1, -size, false)
+		updateQuota(c.User, request.Filepath, -1, -size)
 	}
-	go executeAction(operationDelete, c.User.Username, filePath, "", "", fi.Size(), vfs.IsLocalOsFs(c.fs))
+	go executeAction(operationDelete, c.User.Username, filePath, "", "", fi.Size(), vfs.IsLocalOsFs(fs))
 
 	return sftp.ErrSSHFxOk
 }
 
-func (c Connection) handleSFTPUploadToNewFile(requestPath, filePath string) (io.WriterAt, error) {
-	if !c.hasSpace(true) {
+func (c Connection) handleSFTPUploadToNewFile(fs vfs.Fs, sftpPath, requestPath, filePath string) (io.WriterAt, error) {
+	if !c.hasSpace(true, sftpPath) {
 		c.Log(logger.LevelInfo, logSender, "denying file write due to space limit")
 		return nil, sftp.ErrSSHFxFailure
 	}
 
-	file, w, cancelFn, err := c.fs.Create(filePath, 0)
+	file, w, cancelFn, err := fs.Create(filePath, 0)
 	if err != nil {
 		c.Log(logger.LevelWarn, logSender, "error creating file %#v: %+v", requestPath, err)
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
-	vfs.SetPathPermissions(c.fs, filePath, c.User.GetUID(), c.User.GetGID())
+	vfs.SetPathPermissions(fs, filePath, c.User.GetUID(), c.User.GetGID())
 
 	transfer := Transfer{
 		file:           file,
@@ -468,6 +631,7 @@ func (c Connection) handleSFTPUploadToNewFile(requestPath, filePath string) (io.
 		readerAt:       nil,
 		cancelFn:       cancelFn,
 		path:           requestPath,
+		sftpPath:       sftpPath,
 		start:          time.Now(),
 		bytesSent:      0,
 		bytesReceived:  0,
@@ -486,10 +650,10 @@ func (c Connection) handleSFTPUploadToNewFile(requestPath, filePath string) (io.
 	return &transfer, nil
 }
 
-func (c Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, requestPath, filePath string,
-	fileSize int64) (io.WriterAt, error) {
+func (c Connection) handleSFTPUploadToExistingFile(fs vfs.Fs, pflags sftp.FileOpenFlags, sftpPath, requestPath,
+	filePath string, fileSize int64) (io.WriterAt, error) {
 	var err error
-	if !c.hasSpace(false) {
+	if !c.hasSpace(false, sftpPath) {
 		c.Log(logger.LevelInfo, logSender, "denying file write due to space limit")
 		return nil, sftp.ErrSSHFxFailure
 	}
@@ -497,25 +661,31 @@ func (c Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, re
 	minWriteOffset := int64(0)
 	osFlags := getOSOpenFlags(pflags)
 
-	if pflags.Append && osFlags&os.O_TRUNC == 0 && !c.fs.IsUploadResumeSupported() {
+	if pflags.Append && osFlags&os.O_TRUNC == 0 && !fs.IsUploadResumeSupported() {
 		c.Log(logger.LevelInfo, logSender, "upload resume requested for path: %#v but not supported in fs implementation",
 			requestPath)
 		return nil, sftp.ErrSSHFxOpUnsupported
 	}
 
-	if isAtomicUploadEnabled() && c.fs.IsAtomicUploadSupported() {
-		err = c.fs.Rename(requestPath, filePath)
+	if isAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+		err = fs.Rename(requestPath, filePath)
 		if err != nil {
 			c.Log(logger.LevelWarn, logSender, "error renaming existing file for atomic upload, source: %#v, dest: %#v, err: %+v",
 				requestPath, filePath, err)
-			return nil, vfs.GetSFTPError(c.fs, err)
+			return nil, vfs.GetSFTPError(fs, err)
 		}
 	}
 
-	file, w, cancelFn, err := c.fs.Create(filePath, osFlags)
+	if pflags.Append && osFlags&os.O_TRUNC == 0 && !vfs.IsLocalOsFs(fs) {
+		// remote backends receive the data sequentially from a pipe so,
+		// for upload resume, they need to append to the existing file
+		osFlags |= os.O_APPEND
+	}
+
+	file, w, cancelFn, err := fs.Create(filePath, osFlags)
 	if err != nil {
 		c.Log(logger.LevelWarn, logSender, "error opening existing file, flags: %v, source: %#v, err: %+v", pflags, filePath, err)
-		return nil, vfs.GetSFTPError(c.fs, err)
+		return nil, vfs.GetSFTPError(fs, err)
 	}
 
 	initialSize := int64(0)
@@ -523,14 +693,14 @@ func (c Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, re
 		c.Log(logger.LevelDebug, logSender, "upload resume requested, file path: %#v initial size: %v", filePath, fileSize)
 		minWriteOffset = fileSize
 	} else {
-		if vfs.IsLocalOsFs(c.fs) {
-			dataprovider.UpdateUserQuota(dataProvider, c.User, 0, -fileSize, false)
+		if vfs.IsLocalOsFs(fs) {
+			updateQuota(c.User, sftpPath, 0, -fileSize)
 		} else {
 			initialSize = fileSize
 		}
 	}
 
-	vfs.SetPathPermissions(c.fs, filePath, c.User.GetUID(), c.User.GetGID())
+	vfs.SetPathPermissions(fs, filePath, c.User.GetUID(), c.User.GetGID())
 
 	transfer := Transfer{
 		file:           file,
@@ -538,6 +708,7 @@ func (c Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, re
 		readerAt:       nil,
 		cancelFn:       cancelFn,
 		path:           requestPath,
+		sftpPath:       sftpPath,
 		start:          time.Now(),
 		bytesSent:      0,
 		bytesReceived:  0,
@@ -557,32 +728,79 @@ func (c Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, re
 	return &transfer, nil
 }
 
-func (c Connection) hasSpace(checkFiles bool) bool {
-	if (checkFiles && c.User.QuotaFiles > 0) || c.User.QuotaSize > 0 {
-		numFile, size, err := dataprovider.GetUsedQuota(dataProvider, c.User.Username)
+// hasSpace returns true if the quota for the given SFTP path is not exceeded.
+// The paths inside a virtual folder are checked against the folder's quota
+func (c Connection) hasSpace(checkFiles bool, sftpPath string) bool {
+	quotaFiles, quotaSize, target, getUsedQuota := c.getQuotaForPath(sftpPath)
+	if (checkFiles && quotaFiles > 0) || quotaSize > 0 {
+		numFile, size, err := getUsedQuota()
 		if err != nil {
 			if _, ok := err.(*dataprovider.MethodDisabledError); ok {
-				c.Log(logger.LevelWarn, logSender, "quota enforcement not possible for user %#v: %v", c.User.Username, err)
+				c.Log(logger.LevelWarn, logSender, "quota enforcement not possible for %v: %v", target, err)
 				return true
 			}
-			c.Log(logger.LevelWarn, logSender, "error getting used quota for %#v: %v", c.User.Username, err)
+			c.Log(logger.LevelWarn, logSender, "error getting used quota for %v: %v", target, err)
 			return false
 		}
-		if (checkFiles && c.User.QuotaFiles > 0 && numFile >= c.User.QuotaFiles) ||
-			(c.User.QuotaSize > 0 && size >= c.User.QuotaSize) {
-			c.Log(logger.LevelDebug, logSender, "quota exceed for user %#v, num files: %v/%v, size: %v/%v check files: %v",
-				c.User.Username, numFile, c.User.QuotaFiles, size, c.User.QuotaSize, checkFiles)
+		if (checkFiles && quotaFiles > 0 && numFile >= quotaFiles) ||
+			(quotaSize > 0 && size >= quotaSize) {
+			c.Log(logger.LevelDebug, logSender, "quota exceed for %v, num files: %v/%v, size: %v/%v check files: %v",
+				target, numFile, quotaFiles, size, quotaSize, checkFiles)
 			return false
 		}
 	}
 	return true
 }
 
+// hasSpaceForRename returns true if the given number of files and size can be moved to
+// the quota scope, the user or a virtual folder, for the given SFTP path
+func (c Connection) hasSpaceForRename(sftpPath string, numFiles int, size int64) bool {
+	quotaFiles, quotaSize, target, getUsedQuota := c.getQuotaForPath(sftpPath)
+	if quotaFiles <= 0 && quotaSize <= 0 {
+		return true
+	}
+	usedFiles, usedSize, err := getUsedQuota()
+	if err != nil {
+		if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+			c.Log(logger.LevelWarn, logSender, "quota enforcement not possible for %v: %v", target, err)
+			return true
+		}
+		c.Log(logger.LevelWarn, logSender, "error getting used quota for %v: %v", target, err)
+		return false
+	}
+	if (quotaFiles > 0 && usedFiles+numFiles > quotaFiles) || (quotaSize > 0 && usedSize+size > quotaSize) {
+		c.Log(logger.LevelDebug, logSender, "quota exceed for %v, num files: %v+%v/%v, size: %v+%v/%v", target,
+			usedFiles, numFiles, quotaFiles, usedSize, size, quotaSize)
+		return false
+	}
+	return true
+}
+
+// getQuotaForPath returns the quota limits, a description and a function to read the used quota
+// for the user or for the virtual folder containing the given SFTP path
+func (c Connection) getQuotaForPath(sftpPath string) (int, int64, string, func() (int, int64, error)) {
+	if folder, err := c.User.GetVirtualFolderForPath(sftpPath); err == nil {
+		target := fmt.Sprintf("virtual folder %#v, user %#v", folder.VirtualPath, c.User.Username)
+		getUsedQuota := func() (int, int64, error) {
+			return dataprovider.GetUsedVirtualFolderQuota(dataProvider, c.User.Username, folder.VirtualPath)
+		}
+		return folder.QuotaFiles, folder.QuotaSize, target, getUsedQuota
+	}
+	target := fmt.Sprintf("user %#v", c.User.Username)
+	getUsedQuota := func() (int, int64, error) {
+		return dataprovider.GetUsedQuota(dataProvider, c.User.Username)
+	}
+	return c.User.QuotaFiles, c.User.QuotaSize, target, getUsedQuota
+}
+
 func (c Connection) close() error {
 	if c.channel != nil {
 		err := c.channel.Close()
 		c.Log(logger.LevelInfo, logSender, "channel close, err: %v", err)
 	}
+	if c.netConn == nil {
+		return c.closer.Close()
+	}
 	return c.netConn.Close()
 }
 
@@ -2,6 +2,11 @@ package sftpd
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -20,6 +25,7 @@ import (
 	"github.com/drakkan/sftpgo/vfs"
 	"github.com/eikenb/pipeat"
 	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
 )
 
 type MockChannel struct {
@@ -365,7 +371,7 @@ func TestMockFsErrors(t *testing.T) {
 	testfile := filepath.Join(u.HomeDir, "testfile")
 	request := sftp.NewRequest("Remove", testfile)
 	ioutil.WriteFile(testfile, []byte("test"), 0666)
-	err := c.handleSFTPRemove(testfile, request)
+	err := c.handleSFTPRemove(fs, testfile, request)
 	if err != sftp.ErrSSHFxFailure {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -377,7 +383,7 @@ func TestMockFsErrors(t *testing.T) {
 	flags.Write = true
 	flags.Trunc = false
 	flags.Append = true
-	_, err = c.handleSFTPUploadToExistingFile(flags, testfile, testfile, 0)
+	_, err = c.handleSFTPUploadToExistingFile(fs, flags, "/testfile", testfile, testfile, 0)
 	if err != sftp.ErrSSHFxOpUnsupported {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -393,12 +399,12 @@ func TestUploadFiles(t *testing.T) {
 	var flags sftp.FileOpenFlags
 	flags.Write = true
 	flags.Trunc = true
-	_, err := c.handleSFTPUploadToExistingFile(flags, "missing_path", "other_missing_path", 0)
+	_, err := c.handleSFTPUploadToExistingFile(c.fs, flags, "/missing_path", "missing_path", "other_missing_path", 0)
 	if err == nil {
 		t.Errorf("upload to existing file must fail if one or both paths are invalid")
 	}
 	uploadMode = uploadModeStandard
-	_, err = c.handleSFTPUploadToExistingFile(flags, "missing_path", "other_missing_path", 0)
+	_, err = c.handleSFTPUploadToExistingFile(c.fs, flags, "/missing_path", "missing_path", "other_missing_path", 0)
 	if err == nil {
 		t.Errorf("upload to existing file must fail if one or both paths are invalid")
 	}
@@ -406,14 +412,14 @@ func TestUploadFiles(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		missingFile = "missing\\relative\\file.txt"
 	}
-	_, err = c.handleSFTPUploadToNewFile(".", missingFile)
+	_, err = c.handleSFTPUploadToNewFile(c.fs, "/missing/relative/file.txt", ".", missingFile)
 	if err == nil {
 		t.Errorf("upload new file in missing path must fail")
 	}
 	c.fs = newMockOsFs(nil, nil, false, "123", os.TempDir())
 	f, _ := ioutil.TempFile("", "temp")
 	f.Close()
-	_, err = c.handleSFTPUploadToExistingFile(flags, f.Name(), f.Name(), 123)
+	_, err = c.handleSFTPUploadToExistingFile(c.fs, flags, "/"+filepath.Base(f.Name()), f.Name(), f.Name(), 123)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -497,7 +503,7 @@ func TestSetstatModeIgnore(t *testing.T) {
 	originalMode := setstatMode
 	setstatMode = 1
 	connection := Connection{}
-	err := connection.handleSFTPSetstat("invalid", nil)
+	err := connection.handleSFTPSetstat(nil, "invalid", nil)
 	if err != nil {
 		t.Errorf("unexpected error: %v setstat should be silently ignore in mode 1", err)
 	}
@@ -515,7 +521,7 @@ func TestSFTPGetUsedQuota(t *testing.T) {
 	connection := Connection{
 		User: u,
 	}
-	res := connection.hasSpace(false)
+	res := connection.hasSpace(false, "/")
 	if res != false {
 		t.Errorf("has space must return false if the user is invalid")
 	}
@@ -893,18 +899,22 @@ func TestGitVirtualFolders(t *testing.T) {
 		connection: conn,
 		args:       []string{"/vdir"},
 	}
-	cmd.connection.User.VirtualFolders = append(cmd.connection.User.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir",
-		MappedPath:  os.TempDir(),
+	cmd.connection.User.VirtualFolders = append(cmd.connection.User.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir",
+			MappedPath:  os.TempDir(),
+		},
 	})
 	_, err := cmd.getSystemCommand()
 	if err != errUnsupportedConfig {
 		t.Errorf("unexpected error: %v", err)
 	}
 	cmd.connection.User.VirtualFolders = nil
-	cmd.connection.User.VirtualFolders = append(cmd.connection.User.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir",
-		MappedPath:  os.TempDir(),
+	cmd.connection.User.VirtualFolders = append(cmd.connection.User.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir",
+			MappedPath:  os.TempDir(),
+		},
 	})
 	cmd.args = []string{"/vdir/subdir"}
 	_, err = cmd.getSystemCommand()
@@ -962,9 +972,11 @@ func TestRsyncOptions(t *testing.T) {
 	if !utils.IsStringInSlice("--munge-links", cmd.cmd.Args) {
 		t.Errorf("--munge-links must be added if the user has the create symlinks permission")
 	}
-	sshCmd.connection.User.VirtualFolders = append(sshCmd.connection.User.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: "/vdir",
-		MappedPath:  os.TempDir(),
+	sshCmd.connection.User.VirtualFolders = append(sshCmd.connection.User.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir",
+			MappedPath:  os.TempDir(),
+		},
 	})
 	_, err = sshCmd.getSystemCommand()
 	if err != errUnsupportedConfig {
@@ -1264,7 +1276,7 @@ func TestSCPTestDownloadProtocolMessages(t *testing.T) {
 	path := "testDir"
 	os.Mkdir(path, 0777)
 	stat, _ := os.Stat(path)
-	err := scpCommand.sendDownloadProtocolMessages(path, stat)
+	err := scpCommand.sendDownloadProtocolMessages(path, "/", stat)
 	if err != writeErr {
 		t.Errorf("sendDownloadProtocolMessages must return the expected error: %v", err)
 	}
@@ -1276,7 +1288,7 @@ func TestSCPTestDownloadProtocolMessages(t *testing.T) {
 		WriteError:   nil,
 	}
 
-	err = scpCommand.sendDownloadProtocolMessages(path, stat)
+	err = scpCommand.sendDownloadProtocolMessages(path, "/", stat)
 	if err != readErr {
 		t.Errorf("sendDownloadProtocolMessages must return the expected error: %v", err)
 	}
@@ -1289,7 +1301,7 @@ func TestSCPTestDownloadProtocolMessages(t *testing.T) {
 	}
 	scpCommand.args = []string{"-f", "/tmp"}
 	scpCommand.connection.channel = &mockSSHChannel
-	err = scpCommand.sendDownloadProtocolMessages(path, stat)
+	err = scpCommand.sendDownloadProtocolMessages(path, "/", stat)
 	if err != writeErr {
 		t.Errorf("sendDownloadProtocolMessages must return the expected error: %v", err)
 	}
@@ -1301,7 +1313,7 @@ func TestSCPTestDownloadProtocolMessages(t *testing.T) {
 		WriteError:   nil,
 	}
 	scpCommand.connection.channel = &mockSSHChannel
-	err = scpCommand.sendDownloadProtocolMessages(path, stat)
+	err = scpCommand.sendDownloadProtocolMessages(path, "/", stat)
 	if err != readErr {
 		t.Errorf("sendDownloadProtocolMessages must return the expected error: %v", err)
 	}
@@ -1381,7 +1393,7 @@ func TestSCPErrorsMockFs(t *testing.T) {
 	testfile := filepath.Join(u.HomeDir, "testfile")
 	ioutil.WriteFile(testfile, []byte("test"), 0666)
 	stat, _ := os.Stat(u.HomeDir)
-	err = scpCommand.handleRecursiveDownload(u.HomeDir, stat)
+	err = scpCommand.handleRecursiveDownload(connection.fs, u.HomeDir, "/", stat)
 	if err != errFake {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -1390,7 +1402,7 @@ func TestSCPErrorsMockFs(t *testing.T) {
 	if err != errFake {
 		t.Errorf("unexpected error: %v", err)
 	}
-	err = scpCommand.handleUploadFile(testfile, testfile, 0, false, 4)
+	err = scpCommand.handleUploadFile(scpCommand.connection.fs, "/testfile", testfile, testfile, 0, false, 4)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -1426,7 +1438,7 @@ func TestSCPRecursiveDownloadErrors(t *testing.T) {
 	path := "testDir"
 	os.Mkdir(path, 0777)
 	stat, _ := os.Stat(path)
-	err := scpCommand.handleRecursiveDownload("invalid_dir", stat)
+	err := scpCommand.handleRecursiveDownload(connection.fs, "invalid_dir", "/invalid_dir", stat)
 	if err != writeErr {
 		t.Errorf("recursive upload download must fail with the expected error: %v", err)
 	}
@@ -1437,7 +1449,7 @@ func TestSCPRecursiveDownloadErrors(t *testing.T) {
 		WriteError:   nil,
 	}
 	scpCommand.connection.channel = &mockSSHChannel
-	err = scpCommand.handleRecursiveDownload("invalid_dir", stat)
+	err = scpCommand.handleRecursiveDownload(connection.fs, "invalid_dir", "/invalid_dir", stat)
 	if err == nil {
 		t.Errorf("recursive upload download must fail for a non existing dir")
 	}
@@ -1812,3 +1824,547 @@ func TestProxyProtocolVersion(t *testing.T) {
 		t.Error("get proxy listener with invalid IP must fail")
 	}
 }
+
+func getTestDefenderConfig() DefenderConfig {
+	return DefenderConfig{
+		Enabled:          true,
+		BanTime:          10,
+		BanTimeIncrement: 50,
+		Threshold:        5,
+		ScoreValid:       1,
+		ScoreInvalid:     2,
+		ScoreNoAuth:      2,
+		ObservationTime:  15,
+		EntriesLimit:     2,
+	}
+}
+
+func TestDefenderConfigValidation(t *testing.T) {
+	c := getTestDefenderConfig()
+	if err := c.validate(); err != nil {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+	c.BanTime = 0
+	if err := c.validate(); err == nil {
+		t.Error("invalid ban time must fail validation")
+	}
+	c = getTestDefenderConfig()
+	c.BanTimeIncrement = -1
+	if err := c.validate(); err == nil {
+		t.Error("invalid ban time increment must fail validation")
+	}
+	c = getTestDefenderConfig()
+	c.Threshold = 0
+	if err := c.validate(); err == nil {
+		t.Error("invalid threshold must fail validation")
+	}
+	c = getTestDefenderConfig()
+	c.ScoreNoAuth = -1
+	if err := c.validate(); err == nil {
+		t.Error("negative score must fail validation")
+	}
+	c = getTestDefenderConfig()
+	c.ObservationTime = 0
+	if err := c.validate(); err == nil {
+		t.Error("invalid observation time must fail validation")
+	}
+	c = getTestDefenderConfig()
+	c.EntriesLimit = 0
+	if err := c.validate(); err == nil {
+		t.Error("invalid entries limit must fail validation")
+	}
+	_, err := newDefender(c)
+	if err == nil {
+		t.Error("creating a defender with an invalid configuration must fail")
+	}
+}
+
+func TestDefenderBanAndUnban(t *testing.T) {
+	d, err := newDefender(getTestDefenderConfig())
+	if err != nil {
+		t.Fatalf("unable to create defender: %v", err)
+	}
+	ip := "192.168.100.1"
+	d.addEvent("invalid IP", HostEventUserNotFound)
+	if len(d.hosts) != 0 {
+		t.Errorf("events for invalid IP addresses must be ignored")
+	}
+	d.addEvent(ip, HostEventLoginFailed)
+	d.addEvent(ip, HostEventUserNotFound)
+	if d.isBanned(ip) {
+		t.Errorf("host %#v must not be banned yet", ip)
+	}
+	if d.hosts[ip].totalScore != 3 {
+		t.Errorf("unexpected score: %v", d.hosts[ip].totalScore)
+	}
+	d.addEvent(ip, HostEventNoLoginTried)
+	if !d.isBanned(ip) {
+		t.Errorf("host %#v must be banned", ip)
+	}
+	ban, err := dataprovider.BannedIPExists(dataProvider, ip)
+	if err != nil {
+		t.Errorf("the ban must be persisted: %v", err)
+	}
+	if ban.BanCount != 1 || !ban.IsActive() {
+		t.Errorf("unexpected ban: %+v", ban)
+	}
+	firstBanUntil := ban.BannedUntil
+	// a new defender must load the active bans
+	d1, err := newDefender(getTestDefenderConfig())
+	if err != nil {
+		t.Errorf("unable to create defender: %v", err)
+	} else if !d1.isBanned(ip) {
+		t.Errorf("host %#v must be banned after reloading the bans", ip)
+	}
+	// simulate an expired ban, the next ban must last longer
+	d.banned[ip] = time.Now().Add(-1 * time.Minute)
+	if d.isBanned(ip) {
+		t.Errorf("host %#v must not be banned after the ban expiration", ip)
+	}
+	for i := 0; i < 3; i++ {
+		d.addEvent(ip, HostEventUserNotFound)
+	}
+	if !d.isBanned(ip) {
+		t.Errorf("host %#v must be banned", ip)
+	}
+	ban, err = dataprovider.BannedIPExists(dataProvider, ip)
+	if err != nil {
+		t.Errorf("unable to get ban: %v", err)
+	}
+	if ban.BanCount != 2 {
+		t.Errorf("unexpected ban count: %v", ban.BanCount)
+	}
+	// first ban 10 minutes, second ban 15 minutes
+	if ban.BannedUntil-firstBanUntil < 4*60*1000 {
+		t.Errorf("the ban time must be increased for repeat offenders")
+	}
+	defenderMgr = d
+	if !IsBanned(ip) {
+		t.Errorf("host %#v must be banned", ip)
+	}
+	err = UnbanHost(ban)
+	if err != nil {
+		t.Errorf("unable to unban host: %v", err)
+	}
+	if IsBanned(ip) {
+		t.Errorf("host %#v must not be banned after unban", ip)
+	}
+	defenderMgr = nil
+	_, err = dataprovider.BannedIPExists(dataProvider, ip)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); !ok {
+		t.Errorf("the ban must be removed from the data provider, err: %v", err)
+	}
+	if GetLoginFailedEvent(err) != HostEventUserNotFound {
+		t.Errorf("unexpected event for record not found error")
+	}
+	if GetLoginFailedEvent(errors.New("auth error")) != HostEventLoginFailed {
+		t.Errorf("unexpected event for authentication error")
+	}
+}
+
+func TestDefenderCleanup(t *testing.T) {
+	d, err := newDefender(getTestDefenderConfig())
+	if err != nil {
+		t.Fatalf("unable to create defender: %v", err)
+	}
+	d.addEvent("10.8.0.1", HostEventLoginFailed)
+	d.addEvent("10.8.0.2", HostEventLoginFailed)
+	d.addEvent("10.8.0.3", HostEventLoginFailed)
+	if len(d.hosts) != d.config.EntriesLimit {
+		t.Errorf("tracked hosts mismatch, expected: %v actual: %v", d.config.EntriesLimit, len(d.hosts))
+	}
+	if _, ok := d.hosts["10.8.0.3"]; !ok {
+		t.Errorf("the most recent host must be tracked")
+	}
+	ip := "10.8.0.4"
+	ban := dataprovider.BannedIP{
+		IP:          ip,
+		BannedUntil: utils.GetTimeAsMsSinceEpoch(time.Now().Add(-2 * defenderBanRetention)),
+		BanCount:    1,
+	}
+	err = dataprovider.AddBannedIP(dataProvider, ban)
+	if err != nil {
+		t.Errorf("unable to add ban: %v", err)
+	}
+	d.banned[ip] = time.Now().Add(-1 * time.Minute)
+	d.cleanupBans()
+	if _, ok := d.banned[ip]; ok {
+		t.Errorf("expired bans must be removed")
+	}
+	_, err = dataprovider.BannedIPExists(dataProvider, ip)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); !ok {
+		t.Errorf("bans expired before the retention time must be removed, err: %v", err)
+	}
+}
+
+func TestNetConnectionsLimits(t *testing.T) {
+	tracker := &netConnectionsTracker{
+		hosts: make(map[string]int),
+	}
+	tracker.setLimits(3, 2)
+	ip1 := "192.168.1.1"
+	ip2 := "192.168.1.2"
+	if err := tracker.add(ip1); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := tracker.add(ip1); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := tracker.add(ip1); err != errMaxPerHostConnections {
+		t.Errorf("max per host connections must be enforced, err: %v", err)
+	}
+	if err := tracker.add(ip2); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := tracker.add(ip2); err != errMaxTotalConnections {
+		t.Errorf("max total connections must be enforced, err: %v", err)
+	}
+	status := tracker.getStatus()
+	if status.Active != 3 || status.ActivePerHost[ip1] != 2 || status.ActivePerHost[ip2] != 1 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if status.RejectedMaxTotal != 1 || status.RejectedMaxPerHost != 1 {
+		t.Errorf("unexpected rejected connections: %+v", status)
+	}
+	if status.MaxTotal != 3 || status.MaxPerHost != 2 {
+		t.Errorf("unexpected limits: %+v", status)
+	}
+	tracker.remove(ip1)
+	tracker.remove(ip2)
+	// removing an untracked host must not change the counters
+	tracker.remove("192.168.1.3")
+	status = tracker.getStatus()
+	if status.Active != 1 || len(status.ActivePerHost) != 1 {
+		t.Errorf("unexpected status after removing connections: %+v", status)
+	}
+	if err := tracker.add(ip2); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	tracker.setLimits(0, 0)
+	for i := 0; i < 5; i++ {
+		if err := tracker.add(ip1); err != nil {
+			t.Errorf("unexpected error without limits: %v", err)
+		}
+	}
+}
+
+func TestAllowListExemptions(t *testing.T) {
+	ip := "172.20.1.1"
+	err := utils.InitializeIPLists(utils.IPListsConfig{
+		AllowList: []string{"172.20.0.0/16"},
+	}, "")
+	if err != nil {
+		t.Fatalf("unable to initialize IP lists: %v", err)
+	}
+	d, err := newDefender(getTestDefenderConfig())
+	if err != nil {
+		t.Fatalf("unable to create defender: %v", err)
+	}
+	defenderMgr = d
+	for i := 0; i < 5; i++ {
+		AddDefenderEvent(ip, HostEventUserNotFound)
+	}
+	if len(d.hosts) != 0 || IsBanned(ip) {
+		t.Errorf("allow listed hosts must be exempted from the defender")
+	}
+	defenderMgr = nil
+	tracker := &netConnectionsTracker{
+		hosts: make(map[string]int),
+	}
+	tracker.setLimits(1, 1)
+	for i := 0; i < 3; i++ {
+		if err := tracker.add(ip); err != nil {
+			t.Errorf("allow listed hosts must be exempted from the connection limits: %v", err)
+		}
+	}
+	if err := tracker.add("172.21.1.1"); err != errMaxTotalConnections {
+		t.Errorf("max total connections must be enforced for other hosts, err: %v", err)
+	}
+	err = utils.InitializeIPLists(utils.IPListsConfig{}, "")
+	if err != nil {
+		t.Errorf("unable to reset IP lists: %v", err)
+	}
+}
+
+func appendKRLString(buf []byte, s []byte) []byte {
+	buf = appendKRLUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+func appendKRLUint32(buf []byte, v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return append(buf, b...)
+}
+
+func appendKRLUint64(buf []byte, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return append(buf, b...)
+}
+
+func appendKRLSection(buf []byte, sectionType byte, data []byte) []byte {
+	buf = append(buf, sectionType)
+	return appendKRLString(buf, data)
+}
+
+func getTestKRLHeader() []byte {
+	krl := []byte(krlMagic)
+	krl = appendKRLUint32(krl, krlFormatVersion)
+	krl = appendKRLUint64(krl, 1)
+	krl = appendKRLUint64(krl, uint64(time.Now().Unix()))
+	krl = appendKRLUint64(krl, 0)
+	krl = appendKRLString(krl, nil)
+	return appendKRLString(krl, []byte("test krl"))
+}
+
+func getTestSigner() (ssh.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+func getTestCert(caSigner, userSigner ssh.Signer, serial uint64, keyID string) (*ssh.Certificate, error) {
+	cert := &ssh.Certificate{
+		Key:             userSigner.PublicKey(),
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: []string{"user"},
+		ValidAfter:      uint64(time.Now().Add(-1 * time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(1 * time.Hour).Unix()),
+	}
+	err := cert.SignCert(rand.Reader, caSigner)
+	return cert, err
+}
+
+func TestParseKRL(t *testing.T) {
+	caSigner, err := getTestSigner()
+	if err != nil {
+		t.Fatalf("unable to generate CA key: %v", err)
+	}
+	otherCASigner, err := getTestSigner()
+	if err != nil {
+		t.Fatalf("unable to generate CA key: %v", err)
+	}
+	userSigner, err := getTestSigner()
+	if err != nil {
+		t.Fatalf("unable to generate user key: %v", err)
+	}
+	revokedKeySigner, err := getTestSigner()
+	if err != nil {
+		t.Fatalf("unable to generate user key: %v", err)
+	}
+	hashedKeySigner, err := getTestSigner()
+	if err != nil {
+		t.Fatalf("unable to generate user key: %v", err)
+	}
+	var certSection []byte
+	certSection = appendKRLString(certSection, caSigner.PublicKey().Marshal())
+	certSection = appendKRLString(certSection, nil)
+	var serials []byte
+	serials = appendKRLUint64(serials, 5)
+	serials = appendKRLUint64(serials, 7)
+	certSection = appendKRLSection(certSection, krlCertSectionSerialList, serials)
+	var serialRange []byte
+	serialRange = appendKRLUint64(serialRange, 100)
+	serialRange = appendKRLUint64(serialRange, 200)
+	certSection = appendKRLSection(certSection, krlCertSectionSerialRange, serialRange)
+	var bitmap []byte
+	bitmap = appendKRLUint64(bitmap, 1000)
+	// bits 0 and 3 are set, so serials 1000 and 1003 are revoked
+	bitmap = appendKRLString(bitmap, []byte{0x09})
+	certSection = appendKRLSection(certSection, krlCertSectionSerialBitmap, bitmap)
+	keyIDs := appendKRLString(nil, []byte("revoked id"))
+	certSection = appendKRLSection(certSection, krlCertSectionKeyID, keyIDs)
+
+	krl := getTestKRLHeader()
+	krl = appendKRLSection(krl, krlSectionCertificates, certSection)
+	krl = appendKRLSection(krl, krlSectionExplicitKey, appendKRLString(nil, revokedKeySigner.PublicKey().Marshal()))
+	hash := sha256.Sum256(hashedKeySigner.PublicKey().Marshal())
+	krl = appendKRLSection(krl, krlSectionFingerprintSHA256, appendKRLString(nil, hash[:]))
+	krl = appendKRLSection(krl, krlSectionSignature, []byte("ignored"))
+
+	data, err := parseKRL(krl)
+	if err != nil {
+		t.Fatalf("unable to parse KRL: %v", err)
+	}
+	testCases := []struct {
+		ca      ssh.Signer
+		user    ssh.Signer
+		serial  uint64
+		keyID   string
+		revoked bool
+	}{
+		{caSigner, userSigner, 1, "id", false},
+		{caSigner, userSigner, 5, "id", true},
+		{caSigner, userSigner, 6, "id", false},
+		{caSigner, userSigner, 7, "id", true},
+		{caSigner, userSigner, 150, "id", true},
+		{caSigner, userSigner, 201, "id", false},
+		{caSigner, userSigner, 1000, "id", true},
+		{caSigner, userSigner, 1001, "id", false},
+		{caSigner, userSigner, 1003, "id", true},
+		{caSigner, userSigner, 1, "revoked id", true},
+		{otherCASigner, userSigner, 5, "revoked id", false},
+		{otherCASigner, revokedKeySigner, 1, "id", true},
+		{otherCASigner, hashedKeySigner, 1, "id", true},
+	}
+	for _, tc := range testCases {
+		cert, err := getTestCert(tc.ca, tc.user, tc.serial, tc.keyID)
+		if err != nil {
+			t.Fatalf("unable to create certificate: %v", err)
+		}
+		if data.isCertRevoked(cert) != tc.revoked {
+			t.Errorf("unexpected revocation status for serial %v key id %#v, expected revoked: %v", tc.serial,
+				tc.keyID, tc.revoked)
+		}
+	}
+	// a revoked CA key revokes all the certificates it signed
+	krl = getTestKRLHeader()
+	krl = appendKRLSection(krl, krlSectionExplicitKey, appendKRLString(nil, otherCASigner.PublicKey().Marshal()))
+	data, err = parseKRL(krl)
+	if err != nil {
+		t.Fatalf("unable to parse KRL: %v", err)
+	}
+	cert, _ := getTestCert(otherCASigner, userSigner, 1, "id")
+	if !data.isCertRevoked(cert) {
+		t.Error("a certificate signed by a revoked CA must be revoked")
+	}
+	cert, _ = getTestCert(caSigner, userSigner, 1, "id")
+	if data.isCertRevoked(cert) {
+		t.Error("a certificate signed by a valid CA must not be revoked")
+	}
+
+	_, err = parseKRL([]byte("invalid"))
+	if err == nil {
+		t.Error("parsing a KRL with an invalid magic must fail")
+	}
+	_, err = parseKRL(krl[:len(krl)-3])
+	if err == nil {
+		t.Error("parsing a truncated KRL must fail")
+	}
+	krl = getTestKRLHeader()
+	krl = appendKRLSection(krl, 99, nil)
+	_, err = parseKRL(krl)
+	if err == nil {
+		t.Error("parsing a KRL with an unsupported section must fail")
+	}
+	krl = []byte(krlMagic)
+	krl = appendKRLUint32(krl, 2)
+	_, err = parseKRL(krl)
+	if err == nil {
+		t.Error("parsing a KRL with an unsupported version must fail")
+	}
+}
+
+func TestRevokedKeysFile(t *testing.T) {
+	userSigner, err := getTestSigner()
+	if err != nil {
+		t.Fatalf("unable to generate user key: %v", err)
+	}
+	caSigner, err := getTestSigner()
+	if err != nil {
+		t.Fatalf("unable to generate CA key: %v", err)
+	}
+	revokedFile := filepath.Join(os.TempDir(), "revoked_keys")
+	content := "# revoked keys\n\n" + string(ssh.MarshalAuthorizedKey(userSigner.PublicKey()))
+	err = ioutil.WriteFile(revokedFile, []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("unable to write revoked keys file: %v", err)
+	}
+	m := &revokedCertsManager{
+		filePath: revokedFile,
+		lock:     new(sync.RWMutex),
+	}
+	err = m.load()
+	if err != nil {
+		t.Errorf("unable to load revoked keys: %v", err)
+	}
+	cert, err := getTestCert(caSigner, userSigner, 1, "id")
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	if !m.isRevoked(cert) {
+		t.Error("the certificate must be revoked")
+	}
+	err = ioutil.WriteFile(revokedFile, []byte("invalid key"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write revoked keys file: %v", err)
+	}
+	err = m.load()
+	if err == nil {
+		t.Error("loading an invalid revoked keys file must fail")
+	}
+	// the previous revocation data must be kept
+	if !m.isRevoked(cert) {
+		t.Error("the certificate must be still revoked")
+	}
+	os.Remove(revokedFile)
+	err = m.load()
+	if err == nil {
+		t.Error("loading a missing revoked keys file must fail")
+	}
+}
+
+func TestCertSourceAddress(t *testing.T) {
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("192.168.1.5"), Port: 2222}
+	err := checkCertSourceAddress("10.0.0.1, 192.168.1.0/24", remoteAddr)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = checkCertSourceAddress("192.168.1.5", remoteAddr)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = checkCertSourceAddress("10.0.0.0/8,192.168.2.5", remoteAddr)
+	if err == nil {
+		t.Error("the remote address must not be allowed")
+	}
+	err = checkCertSourceAddress("192.168.1.0/240", remoteAddr)
+	if err == nil {
+		t.Error("an invalid network must fail")
+	}
+	err = checkCertSourceAddress("192.168.1.256", remoteAddr)
+	if err == nil {
+		t.Error("an invalid IP address must fail")
+	}
+}
+
+func TestCertificateAuthConfig(t *testing.T) {
+	c := Configuration{
+		TrustedUserCAKeys: []string{"missing_ca_file.pub"},
+	}
+	err := c.configureCertificateAuth(os.TempDir())
+	if err == nil {
+		t.Error("configuring a missing CA keys file must fail")
+	}
+	caFile := filepath.Join(os.TempDir(), "test_ca.pub")
+	err = ioutil.WriteFile(caFile, []byte("invalid CA key"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write CA keys file: %v", err)
+	}
+	c.TrustedUserCAKeys = []string{caFile}
+	err = c.configureCertificateAuth(os.TempDir())
+	if err == nil {
+		t.Error("configuring an invalid CA keys file must fail")
+	}
+	err = ioutil.WriteFile(caFile, []byte("# no keys\n"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write CA keys file: %v", err)
+	}
+	err = c.configureCertificateAuth(os.TempDir())
+	if err == nil {
+		t.Error("configuring a CA keys file without keys must fail")
+	}
+	os.Remove(caFile)
+	cert := &ssh.Certificate{
+		CertType: ssh.HostCert,
+	}
+	err = checkCertificate(cert, "user", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2222})
+	if err == nil {
+		t.Error("a host certificate must be rejected")
+	}
+}
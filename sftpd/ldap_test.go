@@ -0,0 +1,219 @@
+package sftpd_test
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// LDAP protocol operations and result codes used by the test server
+const (
+	ldapOpBindRequest          = 0
+	ldapOpBindResponse         = 1
+	ldapOpUnbindRequest        = 2
+	ldapOpSearchRequest        = 3
+	ldapOpSearchResultEntry    = 4
+	ldapOpSearchResultDone     = 5
+	ldapResultSuccess          = 0
+	ldapResultProtocolError    = 2
+	ldapResultInsufficientAuth = 50
+	ldapResultInvalidCreds     = 49
+)
+
+type ldapTestEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// ldapTestServer is a minimal in-process LDAP server supporting simple bind and
+// search requests with equality, presence, and, or, not filters
+type ldapTestServer struct {
+	listener net.Listener
+	entries  []ldapTestEntry
+	wg       sync.WaitGroup
+}
+
+func newLDAPTestServer(entries []ldapTestEntry) (*ldapTestServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &ldapTestServer{
+		listener: listener,
+		entries:  entries,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *ldapTestServer) getURL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *ldapTestServer) close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *ldapTestServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *ldapTestServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	bound := false
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID, _ := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+		switch request.Tag {
+		case ldapOpBindRequest:
+			resultCode := s.bind(request)
+			bound = resultCode == ldapResultSuccess
+			conn.Write(getLDAPTestResponse(messageID, ldapOpBindResponse, resultCode).Bytes()) //nolint:errcheck
+		case ldapOpSearchRequest:
+			if !bound {
+				conn.Write(getLDAPTestResponse(messageID, ldapOpSearchResultDone, //nolint:errcheck
+					ldapResultInsufficientAuth).Bytes())
+				continue
+			}
+			for _, e := range s.search(request) {
+				conn.Write(getLDAPTestSearchEntry(messageID, e, request).Bytes()) //nolint:errcheck
+			}
+			conn.Write(getLDAPTestResponse(messageID, ldapOpSearchResultDone, ldapResultSuccess).Bytes()) //nolint:errcheck
+		case ldapOpUnbindRequest:
+			return
+		default:
+			conn.Write(getLDAPTestResponse(messageID, ldapOpBindResponse, ldapResultProtocolError).Bytes()) //nolint:errcheck
+			return
+		}
+	}
+}
+
+func (s *ldapTestServer) bind(request *ber.Packet) int {
+	if len(request.Children) < 3 {
+		return ldapResultProtocolError
+	}
+	dn, _ := request.Children[1].Value.(string)
+	password := request.Children[2].Data.String()
+	if len(dn) == 0 && len(password) == 0 {
+		// anonymous bind
+		return ldapResultSuccess
+	}
+	for _, e := range s.entries {
+		if strings.EqualFold(e.dn, dn) && len(password) > 0 && e.password == password {
+			return ldapResultSuccess
+		}
+	}
+	return ldapResultInvalidCreds
+}
+
+func (s *ldapTestServer) search(request *ber.Packet) []ldapTestEntry {
+	var result []ldapTestEntry
+	if len(request.Children) < 8 {
+		return result
+	}
+	baseDN, _ := request.Children[0].Value.(string)
+	for _, e := range s.entries {
+		if strings.HasSuffix(strings.ToLower(e.dn), strings.ToLower(baseDN)) && e.matchFilter(request.Children[6]) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func (e *ldapTestEntry) getAttributeValues(name string) []string {
+	for k, v := range e.attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+func (e *ldapTestEntry) matchFilter(filter *ber.Packet) bool {
+	switch filter.Tag {
+	case 0: // and
+		for _, child := range filter.Children {
+			if !e.matchFilter(child) {
+				return false
+			}
+		}
+		return true
+	case 1: // or
+		for _, child := range filter.Children {
+			if e.matchFilter(child) {
+				return true
+			}
+		}
+		return false
+	case 2: // not
+		return len(filter.Children) == 1 && !e.matchFilter(filter.Children[0])
+	case 3: // equality match
+		if len(filter.Children) != 2 {
+			return false
+		}
+		name, _ := filter.Children[0].Value.(string)
+		value, _ := filter.Children[1].Value.(string)
+		for _, v := range e.getAttributeValues(name) {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+	case 7: // present
+		return len(e.getAttributeValues(filter.Data.String())) > 0
+	}
+	return false
+}
+
+func getLDAPTestResponse(messageID int64, op ber.Tag, resultCode int) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, op, nil, "Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, resultCode, "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	packet.AppendChild(response)
+	return packet
+}
+
+func getLDAPTestSearchEntry(messageID int64, e ldapTestEntry, request *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapOpSearchResultEntry, nil, "Search Result Entry")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "Object Name"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, a := range request.Children[7].Children {
+		name, _ := a.Value.(string)
+		values := e.getAttributeValues(name)
+		if len(values) == 0 {
+			continue
+		}
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attribute.AppendChild(vals)
+		attributes.AppendChild(attribute)
+	}
+	entry.AppendChild(attributes)
+	packet.AppendChild(entry)
+	return packet
+}
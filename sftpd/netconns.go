@@ -0,0 +1,111 @@
+package sftpd
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+var (
+	netConnections = &netConnectionsTracker{
+		hosts: make(map[string]int),
+	}
+	errMaxTotalConnections   = errors.New("too many open connections")
+	errMaxPerHostConnections = errors.New("too many open connections from the same host")
+)
+
+// NetConnectionsStatus reports the network connections accepted by the SFTP server,
+// both authenticated and not yet authenticated, and the connections rejected
+// because the configured limits were exceeded
+type NetConnectionsStatus struct {
+	// Number of open network connections
+	Active int `json:"active"`
+	// Number of open network connections for each remote IP address
+	ActivePerHost map[string]int `json:"active_per_host"`
+	// Configured maximum number of open connections, 0 means unlimited
+	MaxTotal int `json:"max_total_connections"`
+	// Configured maximum number of open connections from the same host, 0 means unlimited
+	MaxPerHost int `json:"max_per_host_connections"`
+	// Number of connections rejected because the max total connections limit was exceeded
+	RejectedMaxTotal int64 `json:"rejected_max_total"`
+	// Number of connections rejected because the max per host connections limit was exceeded
+	RejectedMaxPerHost int64 `json:"rejected_max_per_host"`
+}
+
+// netConnectionsTracker tracks the network connections before the SSH handshake,
+// so the limits protect against unauthenticated floods too
+type netConnectionsTracker struct {
+	sync.Mutex
+	maxTotal           int
+	maxPerHost         int
+	total              int
+	hosts              map[string]int
+	rejectedMaxTotal   int64
+	rejectedMaxPerHost int64
+}
+
+func (t *netConnectionsTracker) setLimits(maxTotal, maxPerHost int) {
+	t.Lock()
+	defer t.Unlock()
+	t.maxTotal = maxTotal
+	t.maxPerHost = maxPerHost
+}
+
+// add tracks a new connection from the given IP address or returns
+// an error if a limit is exceeded, rejected connections are not tracked.
+// The limits are not enforced for allow listed hosts
+func (t *netConnectionsTracker) add(ip string) error {
+	isAllowListed := utils.IsIPAllowListed(ip)
+	t.Lock()
+	defer t.Unlock()
+	if !isAllowListed && t.maxTotal > 0 && t.total >= t.maxTotal {
+		t.rejectedMaxTotal++
+		metrics.AddRejectedConnection(false)
+		return errMaxTotalConnections
+	}
+	if !isAllowListed && t.maxPerHost > 0 && t.hosts[ip] >= t.maxPerHost {
+		t.rejectedMaxPerHost++
+		metrics.AddRejectedConnection(true)
+		return errMaxPerHostConnections
+	}
+	t.total++
+	t.hosts[ip]++
+	return nil
+}
+
+func (t *netConnectionsTracker) remove(ip string) {
+	t.Lock()
+	defer t.Unlock()
+	if count, ok := t.hosts[ip]; ok {
+		t.total--
+		if count > 1 {
+			t.hosts[ip] = count - 1
+		} else {
+			delete(t.hosts, ip)
+		}
+	}
+}
+
+func (t *netConnectionsTracker) getStatus() NetConnectionsStatus {
+	t.Lock()
+	defer t.Unlock()
+	status := NetConnectionsStatus{
+		Active:             t.total,
+		ActivePerHost:      make(map[string]int),
+		MaxTotal:           t.maxTotal,
+		MaxPerHost:         t.maxPerHost,
+		RejectedMaxTotal:   t.rejectedMaxTotal,
+		RejectedMaxPerHost: t.rejectedMaxPerHost,
+	}
+	for ip, count := range t.hosts {
+		status.ActivePerHost[ip] = count
+	}
+	return status
+}
+
+// GetNetConnectionsStatus returns the status for the network connections accepted by the SFTP server
+func GetNetConnectionsStatus() NetConnectionsStatus {
+	return netConnections.getStatus()
+}
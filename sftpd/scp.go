@@ -119,7 +119,7 @@ func (c *scpCommand) handleRecursiveUpload() error {
 
 func (c *scpCommand) handleCreateDir(dirPath string) error {
 	updateConnectionActivity(c.connection.ID)
-	p, err := c.connection.fs.ResolvePath(dirPath)
+	fs, p, err := c.connection.resolvePath(dirPath)
 	if err != nil {
 		c.connection.Log(logger.LevelWarn, logSenderSCP, "error creating dir: %#v, invalid file path, err: %v", dirPath, err)
 		c.sendErrorMessage(err.Error())
@@ -131,7 +131,7 @@ func (c *scpCommand) handleCreateDir(dirPath string) error {
 		return errPermission
 	}
 
-	err = c.createDir(p)
+	err = c.createDir(fs, p)
 	if err != nil {
 		return err
 	}
@@ -188,8 +188,9 @@ func (c *scpCommand) getUploadFileData(sizeToRead int64, transfer *Transfer) err
 	return c.sendConfirmationMessage()
 }
 
-func (c *scpCommand) handleUploadFile(requestPath, filePath string, sizeToRead int64, isNewFile bool, fileSize int64) error {
-	if !c.connection.hasSpace(true) {
+func (c *scpCommand) handleUploadFile(fs vfs.Fs, sftpPath, requestPath, filePath string, sizeToRead int64, isNewFile bool,
+	fileSize int64) error {
+	if !c.connection.hasSpace(true, sftpPath) {
 		err := fmt.Errorf("denying file write due to space limit")
 		c.connection.Log(logger.LevelWarn, logSenderSCP, "error uploading file: %#v, err: %v", filePath, err)
 		c.sendErrorMessage(err.Error())
@@ -198,20 +199,20 @@ func (c *scpCommand) handleUploadFile(requestPath, filePath string, sizeToRead i
 
 	initialSize := int64(0)
 	if !isNewFile {
-		if vfs.IsLocalOsFs(c.connection.fs) {
-			dataprovider.UpdateUserQuota(dataProvider, c.connection.User, 0, -fileSize, false)
+		if vfs.IsLocalOsFs(fs) {
+			updateQuota(c.connection.User, sftpPath, 0, -fileSize)
 		} else {
 			initialSize = fileSize
 		}
 	}
-	file, w, cancelFn, err := c.connection.fs.Create(filePath, 0)
+	file, w, cancelFn, err := fs.Create(filePath, 0)
 	if err != nil {
 		c.connection.Log(logger.LevelError, logSenderSCP, "error creating file %#v: %v", requestPath, err)
 		c.sendErrorMessage(err.Error())
 		return err
 	}
 
-	vfs.SetPathPermissions(c.connection.fs, filePath, c.connection.User.GetUID(), c.connection.User.GetGID())
+	vfs.SetPathPermissions(fs, filePath, c.connection.User.GetUID(), c.connection.User.GetGID())
 
 	transfer := Transfer{
 		file:           file,
@@ -219,6 +220,7 @@ func (c *scpCommand) handleUploadFile(requestPath, filePath string, sizeToRead i
 		writerAt:       w,
 		cancelFn:       cancelFn,
 		path:           requestPath,
+		sftpPath:       sftpPath,
 		start:          time.Now(),
 		bytesSent:      0,
 		bytesReceived:  0,
@@ -249,24 +251,24 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		c.sendErrorMessage(errPermission.Error())
 	}
 
-	p, err := c.connection.fs.ResolvePath(uploadFilePath)
+	fs, p, err := c.connection.resolvePath(uploadFilePath)
 	if err != nil {
 		c.connection.Log(logger.LevelWarn, logSenderSCP, "error uploading file: %#v, err: %v", uploadFilePath, err)
 		c.sendErrorMessage(err.Error())
 		return err
 	}
 	filePath := p
-	if isAtomicUploadEnabled() && c.connection.fs.IsAtomicUploadSupported() {
-		filePath = c.connection.fs.GetAtomicUploadPath(p)
+	if isAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+		filePath = fs.GetAtomicUploadPath(p)
 	}
-	stat, statErr := c.connection.fs.Stat(p)
-	if c.connection.fs.IsNotExist(statErr) {
+	stat, statErr := fs.Stat(p)
+	if fs.IsNotExist(statErr) {
 		if !c.connection.User.HasPerm(dataprovider.PermUpload, path.Dir(uploadFilePath)) {
 			c.connection.Log(logger.LevelWarn, logSenderSCP, "cannot upload file: %#v, permission denied", uploadFilePath)
 			c.sendErrorMessage(errPermission.Error())
 			return errPermission
 		}
-		return c.handleUploadFile(p, filePath, sizeToRead, true, 0)
+		return c.handleUploadFile(fs, uploadFilePath, p, filePath, sizeToRead, true, 0)
 	}
 
 	if statErr != nil {
@@ -288,8 +290,8 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		return errPermission
 	}
 
-	if isAtomicUploadEnabled() && c.connection.fs.IsAtomicUploadSupported() {
-		err = c.connection.fs.Rename(p, filePath)
+	if isAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+		err = fs.Rename(p, filePath)
 		if err != nil {
 			c.connection.Log(logger.LevelError, logSenderSCP, "error renaming existing file for atomic upload, source: %#v, dest: %#v, err: %v",
 				p, filePath, err)
@@ -298,10 +300,10 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		}
 	}
 
-	return c.handleUploadFile(p, filePath, sizeToRead, false, stat.Size())
+	return c.handleUploadFile(fs, uploadFilePath, p, filePath, sizeToRead, false, stat.Size())
 }
 
-func (c *scpCommand) sendDownloadProtocolMessages(dirPath string, stat os.FileInfo) error {
+func (c *scpCommand) sendDownloadProtocolMessages(dirPath, sftpPath string, stat os.FileInfo) error {
 	var err error
 	if c.sendFileTime() {
 		modTime := stat.ModTime().UnixNano() / 1000000000
@@ -316,12 +318,11 @@ func (c *scpCommand) sendDownloadProtocolMessages(dirPath string, stat os.FileIn
 		}
 	}
 
+	// the filesystem path is relative to the virtual folder root for folders
+	// with their own filesystem, so the name is taken from the SFTP path
 	dirName := filepath.Base(dirPath)
-	for _, v := range c.connection.User.VirtualFolders {
-		if v.MappedPath == dirPath {
-			dirName = path.Base(v.VirtualPath)
-			break
-		}
+	if sftpPath != "/" {
+		dirName = path.Base(sftpPath)
 	}
 
 	fileMode := fmt.Sprintf("D%v 0 %v\n", getFileModeAsString(stat.Mode(), stat.IsDir()), dirName)
@@ -335,23 +336,23 @@ func (c *scpCommand) sendDownloadProtocolMessages(dirPath string, stat os.FileIn
 
 // we send first all the files in the root directory and then the directories
 // for each directory we recursively call this method again
-func (c *scpCommand) handleRecursiveDownload(dirPath string, stat os.FileInfo) error {
+func (c *scpCommand) handleRecursiveDownload(fs vfs.Fs, dirPath, sftpPath string, stat os.FileInfo) error {
 	var err error
 	if c.isRecursive() {
 		c.connection.Log(logger.LevelDebug, logSenderSCP, "recursive download, dir path: %#v", dirPath)
-		err = c.sendDownloadProtocolMessages(dirPath, stat)
+		err = c.sendDownloadProtocolMessages(dirPath, sftpPath, stat)
 		if err != nil {
 			return err
 		}
-		files, err := c.connection.fs.ReadDir(dirPath)
-		files = c.connection.User.AddVirtualDirs(files, c.connection.fs.GetRelativePath(dirPath))
+		files, err := fs.ReadDir(dirPath)
+		files = c.connection.User.AddVirtualDirs(files, sftpPath)
 		if err != nil {
 			c.sendErrorMessage(err.Error())
 			return err
 		}
 		var dirs []string
 		for _, file := range files {
-			filePath := c.connection.fs.GetRelativePath(c.connection.fs.Join(dirPath, file.Name()))
+			filePath := path.Join(sftpPath, file.Name())
 			if file.Mode().IsRegular() || file.Mode()&os.ModeSymlink == os.ModeSymlink {
 				err = c.handleDownload(filePath)
 				if err != nil {
@@ -448,7 +449,7 @@ func (c *scpCommand) handleDownload(filePath string) error {
 
 	updateConnectionActivity(c.connection.ID)
 
-	p, err := c.connection.fs.ResolvePath(filePath)
+	fs, p, err := c.connection.resolvePath(filePath)
 	if err != nil {
 		err := fmt.Errorf("Invalid file path")
 		c.connection.Log(logger.LevelWarn, logSenderSCP, "error downloading file: %#v, invalid file path", filePath)
@@ -457,7 +458,7 @@ func (c *scpCommand) handleDownload(filePath string) error {
 	}
 
 	var stat os.FileInfo
-	if stat, err = c.connection.fs.Stat(p); err != nil {
+	if stat, err = fs.Stat(p); err != nil {
 		c.connection.Log(logger.LevelWarn, logSenderSCP, "error downloading file: %#v, err: %v", p, err)
 		c.sendErrorMessage(err.Error())
 		return err
@@ -469,7 +470,7 @@ func (c *scpCommand) handleDownload(filePath string) error {
 			c.sendErrorMessage(errPermission.Error())
 			return errPermission
 		}
-		err = c.handleRecursiveDownload(p, stat)
+		err = c.handleRecursiveDownload(fs, p, filePath, stat)
 		return err
 	}
 
@@ -484,7 +485,7 @@ func (c *scpCommand) handleDownload(filePath string) error {
 		c.sendErrorMessage(errPermission.Error())
 	}
 
-	file, r, cancelFn, err := c.connection.fs.Open(p)
+	file, r, cancelFn, err := fs.Open(p)
 	if err != nil {
 		c.connection.Log(logger.LevelError, logSenderSCP, "could not open file %#v for reading: %v", p, err)
 		c.sendErrorMessage(err.Error())
@@ -497,6 +498,7 @@ func (c *scpCommand) handleDownload(filePath string) error {
 		writerAt:       nil,
 		cancelFn:       cancelFn,
 		path:           p,
+		sftpPath:       filePath,
 		start:          time.Now(),
 		bytesSent:      0,
 		bytesReceived:  0,
@@ -641,20 +643,20 @@ func (c *scpCommand) getNextUploadProtocolMessage() (string, error) {
 	return command, err
 }
 
-func (c *scpCommand) createDir(dirPath string) error {
+func (c *scpCommand) createDir(fs vfs.Fs, dirPath string) error {
 	var err error
 	var isDir bool
-	isDir, err = vfs.IsDirectory(c.connection.fs, dirPath)
+	isDir, err = vfs.IsDirectory(fs, dirPath)
 	if err == nil && isDir {
 		c.connection.Log(logger.LevelDebug, logSenderSCP, "directory %#v already exists", dirPath)
 		return nil
 	}
-	if err = c.connection.fs.Mkdir(dirPath); err != nil {
+	if err = fs.Mkdir(dirPath); err != nil {
 		c.connection.Log(logger.LevelError, logSenderSCP, "error creating dir %#v: %v", dirPath, err)
 		c.sendErrorMessage(err.Error())
 		return err
 	}
-	vfs.SetPathPermissions(c.connection.fs, dirPath, c.connection.User.GetUID(), c.connection.User.GetGID())
+	vfs.SetPathPermissions(fs, dirPath, c.connection.User.GetUID(), c.connection.User.GetGID())
 	return err
 }
 
@@ -709,8 +711,8 @@ func (c *scpCommand) getFileUploadDestPath(scpDestPath, fileName string) string
 			// but if scpDestPath is an existing directory then we put the uploaded file
 			// inside that directory this is as scp command works, for example:
 			// scp fileName.txt user@127.0.0.1:/existing_dir
-			if p, err := c.connection.fs.ResolvePath(scpDestPath); err == nil {
-				if stat, err := c.connection.fs.Stat(p); err == nil {
+			if fs, p, err := c.connection.resolvePath(scpDestPath); err == nil {
+				if stat, err := fs.Stat(p); err == nil {
 					if stat.IsDir() {
 						return path.Join(scpDestPath, fileName)
 					}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -102,7 +103,7 @@ type Configuration struct {
 	// The following SSH commands are enabled by default: "md5sum", "sha1sum", "cd", "pwd".
 	// "*" enables all supported SSH commands.
 	EnabledSSHCommands []string `json:"enabled_ssh_commands" mapstructure:"enabled_ssh_commands"`
-	// Absolute path to an external program to use for keyboard interactive authentication.
+	// Absolute path to an external program or an HTTP URL to use for keyboard interactive authentication.
 	// Leave empty to disable this authentication mode.
 	KeyboardInteractiveProgram string `json:"keyboard_interactive_auth_program" mapstructure:"keyboard_interactive_auth_program"`
 	// Support for HAProxy PROXY protocol.
@@ -122,6 +123,24 @@ type Configuration struct {
 	// If proxy protocol is set to 2 and we receive a proxy header from an IP that is not in the list then the
 	// connection will be rejected.
 	ProxyAllowed []string `json:"proxy_allowed" mapstructure:"proxy_allowed"`
+	// Defender configuration. The defender bans the hosts that repeatedly fail
+	// to authenticate, the banned hosts are rejected before the SSH handshake
+	Defender DefenderConfig `json:"defender" mapstructure:"defender"`
+	// Maximum number of open network connections, authenticated or not. New connections are
+	// rejected before the SSH handshake if this limit is reached. 0 means unlimited
+	MaxTotalConnections int `json:"max_total_connections" mapstructure:"max_total_connections"`
+	// Maximum number of open network connections from the same remote IP address, authenticated or not.
+	// New connections are rejected before the SSH handshake if this limit is reached. 0 means unlimited
+	MaxPerHostConnections int `json:"max_per_host_connections" mapstructure:"max_per_host_connections"`
+	// Paths to files containing the public keys of the certification authorities trusted to sign
+	// user certificates, one or more keys per file in authorized keys format. A user can login
+	// using a certificate signed by one of these authorities if the certificate principals
+	// include the username. Leave empty to disable certificate authentication
+	TrustedUserCAKeys []string `json:"trusted_user_ca_keys" mapstructure:"trusted_user_ca_keys"`
+	// Path to a file containing the revoked user certificates and keys. Both OpenSSH key
+	// revocation lists (KRL) and plain text files with one public key per line are supported.
+	// The file can be reloaded on demand
+	RevokedUserCertsFile string `json:"revoked_user_certs_file" mapstructure:"revoked_user_certs_file"`
 }
 
 // Key contains information about host keys
@@ -151,7 +170,7 @@ func (c Configuration) Initialize(configDir string) error {
 		NoClientAuth: false,
 		MaxAuthTries: c.MaxAuthTries,
 		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			sp, err := c.validatePasswordCredentials(conn, pass)
+			sp, err := c.validatePasswordCredentials(conn, pass, dataprovider.SSHLoginMethodPassword, "")
 			if err != nil {
 				return nil, &authenticationError{err: fmt.Sprintf("could not validate password credentials: %v", err)}
 			}
@@ -159,7 +178,18 @@ func (c Configuration) Initialize(configDir string) error {
 			return sp, nil
 		},
 		PublicKeyCallback: func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			if cert, ok := pubKey.(*ssh.Certificate); ok && certChecker != nil {
+				sp, err := c.validateCertificateCredentials(conn, cert)
+				if err != nil {
+					return nil, &authenticationError{err: fmt.Sprintf("could not validate certificate credentials: %v", err)}
+				}
+
+				return sp, nil
+			}
 			sp, err := c.validatePublicKeyCredentials(conn, string(pubKey.Marshal()))
+			if _, ok := err.(*ssh.PartialSuccessError); ok {
+				return nil, err
+			}
 			if err != nil {
 				return nil, &authenticationError{err: fmt.Sprintf("could not validate public key credentials: %v", err)}
 			}
@@ -195,6 +225,12 @@ func (c Configuration) Initialize(configDir string) error {
 		serverConfig.AddHostKey(private)
 	}
 
+	if err = c.configureDefender(); err != nil {
+		return err
+	}
+	if err = c.configureCertificateAuth(configDir); err != nil {
+		return err
+	}
 	c.configureSecurityOptions(serverConfig)
 	c.configureKeyboardInteractiveAuth(serverConfig)
 	c.configureLoginBanner(serverConfig, configDir)
@@ -213,6 +249,7 @@ func (c Configuration) Initialize(configDir string) error {
 	}
 	actions = c.Actions
 	uploadMode = c.UploadMode
+	netConnections.setLimits(c.MaxTotalConnections, c.MaxPerHostConnections)
 	setstatMode = c.SetstatMode
 	logger.Info(logSender, "", "server listener registered address: %v", listener.Addr().String())
 	c.checkIdleTimer()
@@ -261,6 +298,19 @@ func (c *Configuration) getProxyListener(listener net.Listener) (*proxyproto.Lis
 	return proxyListener, nil
 }
 
+func (c Configuration) configureDefender() error {
+	if !c.Defender.Enabled {
+		return nil
+	}
+	if err := InitializeDefender(c.Defender); err != nil {
+		logger.WarnToConsole("unable to initialize the defender: %v", err)
+		logger.Warn(logSender, "", "unable to initialize the defender: %v", err)
+		return err
+	}
+	startDefenderCleanup()
+	return nil
+}
+
 func (c Configuration) checkIdleTimer() {
 	if c.IdleTimeout > 0 {
 		startIdleTimer(time.Duration(c.IdleTimeout) * time.Minute)
@@ -300,25 +350,30 @@ func (c Configuration) configureLoginBanner(serverConfig *ssh.ServerConfig, conf
 	return err
 }
 
+// configureKeyboardInteractiveAuth enables keyboard interactive authentication. It is always enabled
+// for users with TOTP enabled, the configured program, if valid, authenticates the other users
 func (c Configuration) configureKeyboardInteractiveAuth(serverConfig *ssh.ServerConfig) {
-	if len(c.KeyboardInteractiveProgram) == 0 {
-		return
-	}
-	if !filepath.IsAbs(c.KeyboardInteractiveProgram) {
-		logger.WarnToConsole("invalid keyboard interactive authentication program: %#v must be an absolute path",
-			c.KeyboardInteractiveProgram)
-		logger.Warn(logSender, "", "invalid keyboard interactive authentication program: %#v must be an absolute path",
-			c.KeyboardInteractiveProgram)
-		return
-	}
-	_, err := os.Stat(c.KeyboardInteractiveProgram)
-	if err != nil {
-		logger.WarnToConsole("invalid keyboard interactive authentication program:: %v", err)
-		logger.Warn(logSender, "", "invalid keyboard interactive authentication program:: %v", err)
-		return
+	if utils.IsHTTPURL(c.KeyboardInteractiveProgram) {
+		if _, err := url.Parse(c.KeyboardInteractiveProgram); err != nil {
+			logger.WarnToConsole("invalid keyboard interactive authentication hook: %v", err)
+			logger.Warn(logSender, "", "invalid keyboard interactive authentication hook: %v", err)
+			c.KeyboardInteractiveProgram = ""
+		}
+	} else if len(c.KeyboardInteractiveProgram) > 0 {
+		if !filepath.IsAbs(c.KeyboardInteractiveProgram) {
+			logger.WarnToConsole("invalid keyboard interactive authentication program: %#v must be an absolute path",
+				c.KeyboardInteractiveProgram)
+			logger.Warn(logSender, "", "invalid keyboard interactive authentication program: %#v must be an absolute path",
+				c.KeyboardInteractiveProgram)
+			c.KeyboardInteractiveProgram = ""
+		} else if _, err := os.Stat(c.KeyboardInteractiveProgram); err != nil {
+			logger.WarnToConsole("invalid keyboard interactive authentication program:: %v", err)
+			logger.Warn(logSender, "", "invalid keyboard interactive authentication program:: %v", err)
+			c.KeyboardInteractiveProgram = ""
+		}
 	}
 	serverConfig.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
-		sp, err := c.validateKeyboardInteractiveCredentials(conn, client)
+		sp, err := c.validateKeyboardInteractiveCredentials(conn, client, dataprovider.SSHLoginMethodKeyboardInteractive, "")
 		if err != nil {
 			return nil, &authenticationError{err: fmt.Sprintf("could not validate keyboard interactive credentials: %v", err)}
 		}
@@ -343,11 +398,29 @@ func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Server
 	// we'll set a Deadline for handshake to complete, the default is 2 minutes as OpenSSH
 	conn.SetDeadline(time.Now().Add(handshakeTimeout))
 	remoteAddr := conn.RemoteAddr()
+	ipAddr := utils.GetIPFromRemoteAddress(remoteAddr.String())
+	if utils.IsIPDenyListed(ipAddr) {
+		logger.Debug(logSender, "", "connection refused, the remote host %#v is deny listed", ipAddr)
+		conn.Close()
+		return
+	}
+	if IsBanned(ipAddr) {
+		logger.Debug(logSender, "", "connection refused, the remote host %#v is banned", ipAddr)
+		conn.Close()
+		return
+	}
+	if err := netConnections.add(ipAddr); err != nil {
+		logger.Debug(logSender, "", "connection refused for remote host %#v: %v", ipAddr, err)
+		conn.Close()
+		return
+	}
+	defer netConnections.remove(ipAddr)
 	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
 	if err != nil {
 		logger.Warn(logSender, "", "failed to accept an incoming connection: %v", err)
 		if _, ok := err.(*ssh.ServerAuthError); !ok {
-			logger.ConnectionFailedLog("", utils.GetIPFromRemoteAddress(remoteAddr.String()), "no_auth_tryed", err.Error())
+			logger.ConnectionFailedLog("", ipAddr, "no_auth_tryed", err.Error())
+			AddDefenderEvent(ipAddr, HostEventNoLoginTried)
 		}
 		return
 	}
@@ -380,9 +453,11 @@ func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Server
 		netConn:       conn,
 		channel:       nil,
 		fs:            fs,
+		folders:       newFolderFilesystems(),
 	}
 
 	connection.fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+	connection.createFoldersParentDirs()
 
 	connection.Log(logger.LevelInfo, logSender, "User id: %d, logged in with: %#v, username: %#v, home_dir: %#v remote addr: %#v",
 		user.ID, loginType, user.Username, user.HomeDir, remoteAddr.String())
@@ -459,41 +534,51 @@ func (c Configuration) createHandler(connection Connection) sftp.Handlers {
 }
 
 func loginUser(user dataprovider.User, loginMethod, remoteAddr, publicKey string) (*ssh.Permissions, error) {
+	if err := CheckLoginConditions(user, loginMethod, remoteAddr); err != nil {
+		return nil, err
+	}
+
+	json, err := json.Marshal(user)
+	if err != nil {
+		logger.Warn(logSender, "", "error serializing user info: %v, authentication rejected", err)
+		return nil, err
+	}
+	if len(publicKey) > 0 {
+		loginMethod = fmt.Sprintf("%v: %v", loginMethod, publicKey)
+	}
+	p := &ssh.Permissions{}
+	p.Extensions = make(map[string]string)
+	p.Extensions["user"] = string(json)
+	p.Extensions["login_method"] = loginMethod
+	return p, nil
+}
+
+// CheckLoginConditions checks if the given user can login using the specified login method
+// from the given remote address. The number of active sessions is checked too.
+// It is exported so protocols other than SFTP can share the same login restrictions
+func CheckLoginConditions(user dataprovider.User, loginMethod, remoteAddr string) error {
 	if !filepath.IsAbs(user.HomeDir) {
 		logger.Warn(logSender, "", "user %#v has an invalid home dir: %#v. Home dir must be an absolute path, login not allowed",
 			user.Username, user.HomeDir)
-		return nil, fmt.Errorf("cannot login user with invalid home dir: %#v", user.HomeDir)
+		return fmt.Errorf("cannot login user with invalid home dir: %#v", user.HomeDir)
 	}
 	if user.MaxSessions > 0 {
 		activeSessions := getActiveSessions(user.Username)
 		if activeSessions >= user.MaxSessions {
 			logger.Debug(logSender, "", "authentication refused for user: %#v, too many open sessions: %v/%v", user.Username,
 				activeSessions, user.MaxSessions)
-			return nil, fmt.Errorf("too many open sessions: %v", activeSessions)
+			return fmt.Errorf("too many open sessions: %v", activeSessions)
 		}
 	}
 	if !user.IsLoginMethodAllowed(loginMethod) {
 		logger.Debug(logSender, "", "cannot login user %#v, login method %#v is not allowed", user.Username, loginMethod)
-		return nil, fmt.Errorf("Login method %#v is not allowed for user %#v", loginMethod, user.Username)
+		return fmt.Errorf("Login method %#v is not allowed for user %#v", loginMethod, user.Username)
 	}
 	if !user.IsLoginFromAddrAllowed(remoteAddr) {
 		logger.Debug(logSender, "", "cannot login user %#v, remote address is not allowed: %v", user.Username, remoteAddr)
-		return nil, fmt.Errorf("Login for user %#v is not allowed from this address: %v", user.Username, remoteAddr)
+		return fmt.Errorf("Login for user %#v is not allowed from this address: %v", user.Username, remoteAddr)
 	}
-
-	json, err := json.Marshal(user)
-	if err != nil {
-		logger.Warn(logSender, "", "error serializing user info: %v, authentication rejected", err)
-		return nil, err
-	}
-	if len(publicKey) > 0 {
-		loginMethod = fmt.Sprintf("%v: %v", loginMethod, publicKey)
-	}
-	p := &ssh.Permissions{}
-	p.Extensions = make(map[string]string)
-	p.Extensions["user"] = string(json)
-	p.Extensions["login_method"] = loginMethod
-	return p, nil
+	return nil
 }
 
 func (c *Configuration) checkSSHCommands() {
@@ -546,47 +631,133 @@ func (c Configuration) validatePublicKeyCredentials(conn ssh.ConnMetadata, pubKe
 	var keyID string
 	var sshPerm *ssh.Permissions
 
+	ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
 	method := dataprovider.SSHLoginMethodPublicKey
-	metrics.AddLoginAttempt(method)
-	if user, keyID, err = dataprovider.CheckUserAndPubKey(dataProvider, conn.User(), pubKey); err == nil {
+	if user, keyID, err = dataprovider.CheckUserAndPubKey(dataProvider, conn.User(), pubKey, ipAddr,
+		protocolSSH); err == nil {
+		if user.IsPartialAuth(method) {
+			// the metrics are updated for the combined login method after the next step
+			logger.Debug(logSender, "", "user %#v authenticated with partial success using the public key %v",
+				user.Username, keyID)
+			return nil, c.getPartialSuccessError(user, keyID)
+		}
 		sshPerm, err = loginUser(user, method, conn.RemoteAddr().String(), keyID)
 	}
 	if err != nil {
-		logger.ConnectionFailedLog(conn.User(), utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()), method, err.Error())
+		logger.ConnectionFailedLog(conn.User(), ipAddr, method, err.Error())
+		AddDefenderEvent(ipAddr, GetLoginFailedEvent(err))
 	}
+	metrics.AddLoginAttempt(method)
 	metrics.AddLoginResult(method, err)
 	return sshPerm, err
 }
 
-func (c Configuration) validatePasswordCredentials(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+// getPartialSuccessError returns the error that asks the client to complete the authentication,
+// after a successful public key authentication, using the methods allowed for the given user
+func (c Configuration) getPartialSuccessError(user dataprovider.User, keyID string) error {
+	nextMethods := user.GetNextAuthMethods()
+	keyboardIntMethod := dataprovider.SSHLoginMethodKeyAndKeyboardInt
+	if user.TOTPConfig.Enabled && utils.IsStringInSlice(dataprovider.SSHLoginMethodPassword, nextMethods) {
+		// the password alone is not accepted for users with TOTP enabled, the built-in keyboard
+		// interactive authentication asks for the password and then for the passcode
+		if !utils.IsStringInSlice(dataprovider.SSHLoginMethodKeyboardInteractive, nextMethods) {
+			keyboardIntMethod = dataprovider.SSHLoginMethodKeyAndPassword
+		}
+		nextMethods = []string{dataprovider.SSHLoginMethodKeyboardInteractive}
+	}
+	partialSuccess := &ssh.PartialSuccessError{}
+	if utils.IsStringInSlice(dataprovider.SSHLoginMethodPassword, nextMethods) {
+		partialSuccess.Next.PasswordCallback = func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if conn.User() != user.Username {
+				return nil, &authenticationError{err: fmt.Sprintf("username %#v does not match the public key user %#v",
+					conn.User(), user.Username)}
+			}
+			sp, err := c.validatePasswordCredentials(conn, pass, dataprovider.SSHLoginMethodKeyAndPassword, keyID)
+			if err != nil {
+				return nil, &authenticationError{err: fmt.Sprintf("could not validate password credentials: %v", err)}
+			}
+
+			return sp, nil
+		}
+	}
+	if utils.IsStringInSlice(dataprovider.SSHLoginMethodKeyboardInteractive, nextMethods) {
+		partialSuccess.Next.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			if conn.User() != user.Username {
+				return nil, &authenticationError{err: fmt.Sprintf("username %#v does not match the public key user %#v",
+					conn.User(), user.Username)}
+			}
+			sp, err := c.validateKeyboardInteractiveCredentials(conn, client, keyboardIntMethod, keyID)
+			if err != nil {
+				return nil, &authenticationError{err: fmt.Sprintf("could not validate keyboard interactive credentials: %v", err)}
+			}
+
+			return sp, nil
+		}
+	}
+	return partialSuccess
+}
+
+func (c Configuration) validateCertificateCredentials(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
 	var err error
 	var user dataprovider.User
 	var sshPerm *ssh.Permissions
 
-	method := dataprovider.SSHLoginMethodPassword
+	ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
+	method := dataprovider.SSHLoginMethodPublicKeyCert
 	metrics.AddLoginAttempt(method)
-	if user, err = dataprovider.CheckUserAndPass(dataProvider, conn.User(), string(pass)); err == nil {
-		sshPerm, err = loginUser(user, method, conn.RemoteAddr().String(), "")
+	certID := fmt.Sprintf("%v key id: %#v serial: %v CA: %v", ssh.FingerprintSHA256(cert.Key), cert.KeyId, cert.Serial,
+		ssh.FingerprintSHA256(cert.SignatureKey))
+	if err = checkCertificate(cert, conn.User(), conn.RemoteAddr()); err == nil {
+		if user, err = dataprovider.CheckUserForCertificate(dataProvider, conn.User(), ipAddr, protocolSSH); err == nil {
+			sshPerm, err = loginUser(user, method, conn.RemoteAddr().String(), certID)
+		}
 	}
 	if err != nil {
-		logger.ConnectionFailedLog(conn.User(), utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()), method, err.Error())
+		logger.ConnectionFailedLog(conn.User(), ipAddr, method, fmt.Sprintf("%v, certificate %v", err, certID))
+		AddDefenderEvent(ipAddr, GetLoginFailedEvent(err))
 	}
 	metrics.AddLoginResult(method, err)
 	return sshPerm, err
 }
 
-func (c Configuration) validateKeyboardInteractiveCredentials(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+// validatePasswordCredentials validates a password login. The login method is the password or, after
+// a successful public key authentication, the public key followed by a password, identified by keyID
+func (c Configuration) validatePasswordCredentials(conn ssh.ConnMetadata, pass []byte, method, keyID string) (*ssh.Permissions, error) {
 	var err error
 	var user dataprovider.User
 	var sshPerm *ssh.Permissions
 
-	method := dataprovider.SSHLoginMethodKeyboardInteractive
+	ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
 	metrics.AddLoginAttempt(method)
-	if user, err = dataprovider.CheckKeyboardInteractiveAuth(dataProvider, conn.User(), c.KeyboardInteractiveProgram, client); err == nil {
-		sshPerm, err = loginUser(user, method, conn.RemoteAddr().String(), "")
+	if user, err = dataprovider.CheckUserAndPass(dataProvider, conn.User(), string(pass), ipAddr,
+		protocolSSH); err == nil {
+		sshPerm, err = loginUser(user, method, conn.RemoteAddr().String(), keyID)
+	}
+	if err != nil {
+		logger.ConnectionFailedLog(conn.User(), ipAddr, method, err.Error())
+		AddDefenderEvent(ipAddr, GetLoginFailedEvent(err))
+	}
+	metrics.AddLoginResult(method, err)
+	return sshPerm, err
+}
+
+// validateKeyboardInteractiveCredentials validates a keyboard interactive login, alone or after a
+// successful public key authentication as for validatePasswordCredentials
+func (c Configuration) validateKeyboardInteractiveCredentials(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge,
+	method, keyID string) (*ssh.Permissions, error) {
+	var err error
+	var user dataprovider.User
+	var sshPerm *ssh.Permissions
+
+	ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
+	metrics.AddLoginAttempt(method)
+	if user, err = dataprovider.CheckKeyboardInteractiveAuth(dataProvider, conn.User(), c.KeyboardInteractiveProgram,
+		client, ipAddr, protocolSSH); err == nil {
+		sshPerm, err = loginUser(user, method, conn.RemoteAddr().String(), keyID)
 	}
 	if err != nil {
-		logger.ConnectionFailedLog(conn.User(), utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()), method, err.Error())
+		logger.ConnectionFailedLog(conn.User(), ipAddr, method, err.Error())
+		AddDefenderEvent(ipAddr, GetLoginFailedEvent(err))
 	}
 	metrics.AddLoginResult(method, err)
 	return sshPerm, err
@@ -111,7 +111,7 @@ type ConnectionStatus struct {
 	ConnectionTime int64 `json:"connection_time"`
 	// Last activity as unix timestamp in milliseconds
 	LastActivity int64 `json:"last_activity"`
-	// Protocol for this connection: SFTP, SCP, SSH
+	// Protocol for this connection: SFTP, SCP, SSH, FTP, DAV, HTTP, HTTPShare
 	Protocol string `json:"protocol"`
 	// active uploads/downloads
 	Transfers []connectionTransfer `json:"active_transfers"`
@@ -351,6 +351,23 @@ func CheckIdleConnections() {
 	logger.Debug(logSender, "", "check idle connections ended")
 }
 
+// AddConnection adds a connection created using NewConnection to the active ones.
+// Connections added this way are included in the connections stats, they are checked
+// for idle timeout and they can be closed using CloseActiveConnection
+func AddConnection(c Connection) {
+	addConnection(c)
+}
+
+// RemoveConnection removes the connection with the given ID previously added using AddConnection
+func RemoveConnection(connectionID string) {
+	mutex.RLock()
+	c, ok := openConnections[connectionID]
+	mutex.RUnlock()
+	if ok {
+		removeConnection(c)
+	}
+}
+
 func addConnection(c Connection) {
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -371,7 +388,9 @@ func removeConnection(c Connection) {
 	// We only need to ensure that a connection will not remain indefinitely open and so the
 	// underlying file descriptor is not released.
 	// This should protect us against buggy clients and edge cases.
-	c.netConn.SetDeadline(time.Now().Add(2 * time.Minute))
+	if c.netConn != nil {
+		c.netConn.SetDeadline(time.Now().Add(2 * time.Minute))
+	}
 	c.Log(logger.LevelDebug, logSender, "connection removed, num open connections: %v", len(openConnections))
 }
 
@@ -3,9 +3,15 @@ package sftpd_test
 import (
 	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"hash"
@@ -14,6 +20,7 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
@@ -32,6 +39,7 @@ import (
 	"github.com/drakkan/sftpgo/config"
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/httpd"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
@@ -101,6 +109,9 @@ var (
 	keyIntAuthPath string
 	preLoginPath   string
 	logFilePath    string
+	userCAPath     string
+	revokedPath    string
+	userCASigner   ssh.Signer
 )
 
 func TestMain(m *testing.M) {
@@ -111,8 +122,15 @@ func TestMain(m *testing.M) {
 	logger.InitLogger(logFilePath, 5, 1, 28, false, zerolog.DebugLevel)
 	config.LoadConfig(configDir, "")
 	providerConf := config.GetProviderConf()
+	kmsConf := config.GetKMSConfig()
+	kmsConf.MasterKeyPath = filepath.Join(os.TempDir(), "sftpgo_sftpd_test_master.key")
+	err := kmsConf.Initialize(configDir)
+	if err != nil {
+		logger.Warn(logSender, "", "error initializing secrets encryption: %v", err)
+		os.Exit(1)
+	}
 
-	err := dataprovider.Initialize(providerConf, configDir)
+	err = dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
 		logger.Warn(logSender, "", "error initializing data provider: %v", err)
 		os.Exit(1)
@@ -186,6 +204,26 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		logger.WarnToConsole("unable to save gitwrap shell script: %v", err)
 	}
+	userCAPath = filepath.Join(homeBasePath, "user_ca.pub")
+	revokedPath = filepath.Join(homeBasePath, "revoked_certs")
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err == nil {
+		userCASigner, err = ssh.NewSignerFromKey(caKey)
+	}
+	if err != nil {
+		logger.WarnToConsole("unable to generate user CA key: %v", err)
+		os.Exit(1)
+	}
+	err = ioutil.WriteFile(userCAPath, ssh.MarshalAuthorizedKey(userCASigner.PublicKey()), 0600)
+	if err != nil {
+		logger.WarnToConsole("unable to save user CA public key to file: %v", err)
+	}
+	err = ioutil.WriteFile(revokedPath, []byte("# no revoked keys\n"), 0600)
+	if err != nil {
+		logger.WarnToConsole("unable to save revoked certificates file: %v", err)
+	}
+	sftpdConf.TrustedUserCAKeys = []string{userCAPath}
+	sftpdConf.RevokedUserCertsFile = revokedPath
 	sftpd.SetDataProvider(dataProvider)
 	httpd.SetDataProvider(dataProvider)
 
@@ -236,6 +274,8 @@ func TestMain(m *testing.M) {
 	os.Remove(extAuthPath)
 	os.Remove(preLoginPath)
 	os.Remove(keyIntAuthPath)
+	os.Remove(userCAPath)
+	os.Remove(revokedPath)
 	os.Exit(exitCode)
 }
 
@@ -1000,6 +1040,251 @@ func TestLogin(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
+func TestLoginWithTOTP(t *testing.T) {
+	usePubKey := false
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	enrollment, _, err := httpd.GenerateUserTOTPSecret(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to generate TOTP secret: %v", err)
+	}
+	// TOTP is not enabled until the first passcode is verified
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		client.Close()
+	}
+	codes, _, err := httpd.EnableUserTOTP(user, getTOTPPasscode(enrollment.Secret, time.Now()), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to enable TOTP: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Error("password only login must fail if TOTP is enabled")
+		client.Close()
+	}
+	// the passcode used to enable TOTP cannot be reused, the next one is accepted to allow for clock drift
+	passcode := getTOTPPasscode(enrollment.Secret, time.Now().Add(30*time.Second))
+	client, err = getTOTPSftpClient(user, defaultPassword, passcode)
+	if err != nil {
+		t.Errorf("unable to login with password and passcode: %v", err)
+	} else {
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("sftp client with password and passcode must work")
+		}
+		client.Close()
+	}
+	client, err = getTOTPSftpClient(user, defaultPassword, passcode)
+	if err == nil {
+		t.Error("login reusing a passcode must fail")
+		client.Close()
+	}
+	client, err = getTOTPSftpClient(user, "wrong password", getTOTPPasscode(enrollment.Secret, time.Now().Add(60*time.Second)))
+	if err == nil {
+		t.Error("login with a wrong password must fail")
+		client.Close()
+	}
+	client, err = getTOTPSftpClient(user, defaultPassword, "000000")
+	if err == nil {
+		t.Error("login with a wrong passcode must fail")
+		client.Close()
+	}
+	client, err = getTOTPSftpClient(user, defaultPassword, codes.RecoveryCodes[0])
+	if err != nil {
+		t.Errorf("unable to login with a recovery code: %v", err)
+	} else {
+		client.Close()
+	}
+	client, err = getTOTPSftpClient(user, defaultPassword, codes.RecoveryCodes[0])
+	if err == nil {
+		t.Error("login reusing a recovery code must fail")
+		client.Close()
+	}
+	_, err = httpd.DisableUserTOTP(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to disable TOTP: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		client.Close()
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestLoginMultiStepWithTOTP(t *testing.T) {
+	u := getTestUser(true)
+	u.Password = defaultPassword
+	u.Filters.RequiredLoginMethods = []string{dataprovider.SSHLoginMethodKeyAndPassword}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	enrollment, _, err := httpd.GenerateUserTOTPSecret(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to generate TOTP secret: %v", err)
+	}
+	_, _, err = httpd.EnableUserTOTP(user, getTOTPPasscode(enrollment.Secret, time.Now()), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to enable TOTP: %v", err)
+	}
+	client, err := getMultiStepSftpClient(user, ssh.Password(defaultPassword))
+	if err == nil {
+		t.Error("login using a public key and only the password must fail if TOTP is enabled")
+		client.Close()
+	}
+	// the password and the passcode are asked using keyboard interactive authentication
+	passcode := getTOTPPasscode(enrollment.Secret, time.Now().Add(30*time.Second))
+	client, err = getMultiStepSftpClient(user, ssh.KeyboardInteractive(func(user, instruction string, questions []string,
+		echos []bool) ([]string, error) {
+		if len(questions) == 1 && questions[0] == "Passcode: " {
+			return []string{passcode}, nil
+		}
+		return []string{defaultPassword}, nil
+	}))
+	if err != nil {
+		t.Errorf("unable to login using a public key, the password and the passcode: %v", err)
+	} else {
+		if _, err = client.ReadDir("."); err != nil {
+			t.Errorf("unable to read remote dir: %v", err)
+		}
+		client.Close()
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestLoginWithCertificate(t *testing.T) {
+	// the user has no public keys, the certificate signed by the trusted CA is enough
+	user, _, err := httpd.AddUser(getTestUser(false), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	cert, key, err := getTestCertificate(user.Username)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	cert.CriticalOptions = map[string]string{"source-address": "127.0.0.1/32,::1"}
+	client, err := getCertSftpClient(user, cert, key)
+	if err != nil {
+		t.Errorf("unable to create sftp client using a certificate: %v", err)
+	} else {
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("sftp client with a valid certificate must work")
+		}
+		client.Close()
+	}
+	cert, key, _ = getTestCertificate("other user")
+	client, err = getCertSftpClient(user, cert, key)
+	if err == nil {
+		t.Errorf("login with a certificate not valid for the user must fail")
+		client.Close()
+	}
+	cert, key, _ = getTestCertificate(user.Username)
+	cert.ValidPrincipals = nil
+	client, err = getCertSftpClient(user, cert, key)
+	if err == nil {
+		t.Errorf("login with a certificate without principals must fail")
+		client.Close()
+	}
+	cert, key, _ = getTestCertificate(user.Username)
+	cert.ValidBefore = uint64(time.Now().Add(-1 * time.Minute).Unix())
+	client, err = getCertSftpClient(user, cert, key)
+	if err == nil {
+		t.Errorf("login with an expired certificate must fail")
+		client.Close()
+	}
+	cert, key, _ = getTestCertificate(user.Username)
+	cert.CriticalOptions = map[string]string{"source-address": "10.8.0.0/16"}
+	client, err = getCertSftpClient(user, cert, key)
+	if err == nil {
+		t.Errorf("login from an address not allowed by the certificate must fail")
+		client.Close()
+	}
+	cert, key, _ = getTestCertificate(user.Username)
+	cert.CriticalOptions = map[string]string{"force-command": "/bin/true"}
+	client, err = getCertSftpClient(user, cert, key)
+	if err == nil {
+		t.Errorf("login with an unsupported critical option must fail")
+		client.Close()
+	}
+	// the certificate login method can be denied
+	user.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodPublicKeyCert}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	cert, key, _ = getTestCertificate(user.Username)
+	client, err = getCertSftpClient(user, cert, key)
+	if err == nil {
+		t.Errorf("login with a denied login method must fail")
+		client.Close()
+	}
+	// denying public keys denies certificates too
+	user.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodPublicKey}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	cert, key, _ = getTestCertificate(user.Username)
+	client, err = getCertSftpClient(user, cert, key)
+	if err == nil {
+		t.Errorf("login with a certificate must fail if public keys are denied")
+		client.Close()
+	}
+	user.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodPassword}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	// revoke the certified key
+	err = ioutil.WriteFile(revokedPath, []byte(testPubKey+"\n"), 0600)
+	if err != nil {
+		t.Errorf("unable to write revoked keys: %v", err)
+	}
+	err = sftpd.ReloadRevokedCertificates()
+	if err != nil {
+		t.Errorf("unable to reload revoked certificates: %v", err)
+	}
+	cert, key, _ = getTestCertificate(user.Username)
+	client, err = getCertSftpClient(user, cert, key)
+	if err == nil {
+		t.Errorf("login with a revoked key must fail")
+		client.Close()
+	}
+	err = ioutil.WriteFile(revokedPath, []byte("# no revoked keys\n"), 0600)
+	if err != nil {
+		t.Errorf("unable to write revoked keys: %v", err)
+	}
+	err = sftpd.ReloadRevokedCertificates()
+	if err != nil {
+		t.Errorf("unable to reload revoked certificates: %v", err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	client, err = getCertSftpClient(user, cert, key)
+	if err == nil {
+		t.Errorf("login with a certificate for a missing user must fail")
+		client.Close()
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
 func TestLoginUserStatus(t *testing.T) {
 	usePubKey := true
 	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
@@ -1301,6 +1586,82 @@ func TestLoginAfterUserUpdateEmptyPubKey(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
+func TestLoginMultiStep(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	u := getTestUser(true)
+	u.Password = defaultPassword
+	u.Filters.RequiredLoginMethods = []string{dataprovider.SSHLoginMethodKeyAndPassword}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	user.Password = defaultPassword
+	client, err := getSftpClient(user, true)
+	if err == nil {
+		client.Close()
+		t.Error("login using only a public key must fail")
+	}
+	client, err = getSftpClient(user, false)
+	if err == nil {
+		client.Close()
+		t.Error("login using only a password must fail")
+	}
+	client, err = getMultiStepSftpClient(user, ssh.Password(defaultPassword+"1"))
+	if err == nil {
+		client.Close()
+		t.Error("login using a public key and a wrong password must fail")
+	}
+	client, err = getMultiStepSftpClient(user, ssh.Password(defaultPassword))
+	if err != nil {
+		t.Errorf("unable to login using a public key and a password: %v", err)
+	} else {
+		if _, err = client.ReadDir("."); err != nil {
+			t.Errorf("unable to read remote dir: %v", err)
+		}
+		client.Close()
+	}
+	keyIntAnswers := ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return []string{"1", "2"}, nil
+	})
+	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, 1), 0755)
+	client, err = getMultiStepSftpClient(user, keyIntAnswers)
+	if err == nil {
+		client.Close()
+		t.Error("login using a public key and keyboard interactive authentication must fail")
+	}
+	user.Filters.RequiredLoginMethods = []string{dataprovider.SSHLoginMethodKeyAndKeyboardInt}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Fatalf("unable to update user: %v", err)
+	}
+	client, err = getMultiStepSftpClient(user, keyIntAnswers)
+	if err != nil {
+		t.Errorf("unable to login using a public key and keyboard interactive authentication: %v", err)
+	} else {
+		if _, err = client.ReadDir("."); err != nil {
+			t.Errorf("unable to read remote dir: %v", err)
+		}
+		client.Close()
+	}
+	client, err = getKeyboardInteractiveSftpClient(user, []string{"1", "2"})
+	if err == nil {
+		client.Close()
+		t.Error("login using only keyboard interactive authentication must fail")
+	}
+	client, err = getMultiStepSftpClient(user, ssh.Password(defaultPassword))
+	if err == nil {
+		client.Close()
+		t.Error("login using a public key and a password must fail")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
 func TestLoginKeyboardInteractiveAuth(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip("this test is not available on Windows")
@@ -1422,20 +1783,25 @@ func TestPreLoginScript(t *testing.T) {
 	os.Remove(preLoginPath)
 }
 
-func TestLoginExternalAuthPwdAndPubKey(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
-	}
+func TestPreLoginHTTPHook(t *testing.T) {
 	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.QuotaFiles = 1000
+	var hookRequests []map[string]interface{}
+	disableUser := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req) //nolint:errcheck
+		hookRequests = append(hookRequests, req)
+		if disableUser {
+			w.Write([]byte(`{"status":0}`)) //nolint:errcheck
+		}
+	}))
+	defer server.Close()
 	dataProvider := dataprovider.GetProvider()
 	dataprovider.Close(dataProvider)
 	config.LoadConfig(configDir, "")
 	providerConf := config.GetProviderConf()
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
-	providerConf.ExternalAuthProgram = extAuthPath
-	providerConf.ExternalAuthScope = 0
+	providerConf.PreLoginProgram = server.URL
 	err := dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
 		t.Errorf("error initializing data provider")
@@ -1443,39 +1809,113 @@ func TestLoginExternalAuthPwdAndPubKey(t *testing.T) {
 	httpd.SetDataProvider(dataprovider.GetProvider())
 	sftpd.SetDataProvider(dataprovider.GetProvider())
 
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
 	client, err := getSftpClient(u, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
+		_, err = client.Getwd()
 		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+			t.Errorf("unable to get working dir: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err != nil {
-			t.Errorf("file upload error: %v", err)
+	}
+	if len(hookRequests) != 1 {
+		t.Errorf("unexpected number of hook requests: %v", len(hookRequests))
+	} else {
+		req := hookRequests[0]
+		if req["username"] != defaultUsername || req["method"] != dataprovider.SSHLoginMethodPublicKey ||
+			req["ip"] != "127.0.0.1" || req["protocol"] != "SSH" {
+			t.Errorf("unexpected hook request: %+v", req)
+		}
+		if _, ok := req["user"]; !ok {
+			t.Error("the hook request must include the user")
 		}
-		os.Remove(testFilePath)
 	}
-	u.Username = defaultUsername + "1"
-	client, err = getSftpClient(u, usePubKey)
+	disableUser = true
+	_, err = getSftpClient(u, usePubKey)
 	if err == nil {
-		t.Error("external auth login with invalid user must fail")
+		t.Error("pre login hook returned a disabled user, login must fail")
 	}
-	usePubKey = false
-	u = getTestUser(usePubKey)
-	u.PublicKeys = []string{}
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
-	client, err = getSftpClient(u, usePubKey)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		_, err := client.Getwd()
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	server.Close()
+	_, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("login must fail if the pre login hook is not reachable")
+	}
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+}
+
+func TestLoginExternalAuthPwdAndPubKey(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 1000
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
+	providerConf.ExternalAuthProgram = extAuthPath
+	providerConf.ExternalAuthScope = 0
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	client, err := getSftpClient(u, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	u.Username = defaultUsername + "1"
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with invalid user must fail")
+	}
+	usePubKey = false
+	u = getTestUser(usePubKey)
+	u.PublicKeys = []string{}
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
+	client, err = getSftpClient(u, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err := client.Getwd()
 		if err != nil {
 			t.Errorf("unable to get working dir: %v", err)
 		}
@@ -1769,48 +2209,105 @@ func TestLoginExternalAuthErrors(t *testing.T) {
 	os.Remove(extAuthPath)
 }
 
-func TestQuotaDisabledError(t *testing.T) {
+func TestLoginExternalAuthHTTPHook(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	var hookRequests []map[string]interface{}
+	failures := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req) //nolint:errcheck
+		hookRequests = append(hookRequests, req)
+		if req["username"] == defaultUsername && req["password"] == defaultPassword {
+			json.NewEncoder(w).Encode(u) //nolint:errcheck
+		} else {
+			w.Write([]byte(`{"username":""}`)) //nolint:errcheck
+		}
+	}))
+	defer server.Close()
 	dataProvider := dataprovider.GetProvider()
 	dataprovider.Close(dataProvider)
 	config.LoadConfig(configDir, "")
 	providerConf := config.GetProviderConf()
-	providerConf.TrackQuota = 0
+	providerConf.ExternalAuthProgram = server.URL
+	providerConf.ExternalAuthScope = 1
 	err := dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
 		t.Errorf("error initializing data provider")
 	}
 	httpd.SetDataProvider(dataprovider.GetProvider())
 	sftpd.SetDataProvider(dataprovider.GetProvider())
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.QuotaFiles = 10
-	user, _, err := httpd.AddUser(u, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
-	}
-	client, err := getSftpClient(user, usePubKey)
+
+	client, err := getSftpClient(u, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
+		_, err = client.Getwd()
 		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+			t.Errorf("unable to get working dir: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err != nil {
-			t.Errorf("file upload error: %v", err)
+	}
+	if len(hookRequests) != 1 {
+		t.Errorf("unexpected number of hook requests: %v", len(hookRequests))
+	} else {
+		req := hookRequests[0]
+		if req["method"] != dataprovider.SSHLoginMethodPassword || req["ip"] != "127.0.0.1" ||
+			req["protocol"] != "SSH" {
+			t.Errorf("unexpected hook request: %+v", req)
+		}
+		if _, ok := req["public_key"]; ok {
+			t.Errorf("unexpected public key in hook request: %+v", req)
 		}
-		os.Remove(testFilePath)
 	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
+	u.Password = defaultPassword + "1"
+	_, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with invalid password must fail")
+	}
+	u.Password = defaultPassword
+	// a failed request is not retried by default
+	failures = 1
+	_, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login must fail if the hook returns an error")
+	}
+	httpConfig := config.GetHTTPConfig()
+	httpConfig.RetryMax = 1
+	err = httpConfig.Initialize(configDir)
 	if err != nil {
-		t.Errorf("unable to remove: %v", err)
+		t.Errorf("unable to initialize the HTTP client: %v", err)
+	}
+	failures = 1
+	client, err = getSftpClient(u, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client, the failed hook request must be retried: %v", err)
+	} else {
+		client.Close()
+	}
+	err = config.GetHTTPConfig().Initialize(configDir)
+	if err != nil {
+		t.Errorf("unable to initialize the HTTP client: %v", err)
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 1 {
+		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
+	} else {
+		user := users[0]
+		_, err = httpd.RemoveUser(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to remove: %v", err)
+		}
+		os.RemoveAll(user.GetHomeDir())
 	}
-	os.RemoveAll(user.GetHomeDir())
 
 	dataProvider = dataprovider.GetProvider()
 	dataprovider.Close(dataProvider)
@@ -1824,33 +2321,74 @@ func TestQuotaDisabledError(t *testing.T) {
 	sftpd.SetDataProvider(dataprovider.GetProvider())
 }
 
-func TestMaxSessions(t *testing.T) {
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.Username += "1"
-	u.MaxSessions = 1
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+func TestKeyboardInteractiveHTTPHook(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(false), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	client, err := getSftpClient(user, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		_, err := client.Getwd()
-		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
-		}
-		_, err = client.ReadDir(".")
-		if err != nil {
-			t.Errorf("unable to read remote dir: %v", err)
+	var requestIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			RequestID string   `json:"request_id"`
+			Username  string   `json:"username"`
+			Answers   []string `json:"answers"`
+		}
+		json.NewDecoder(r.Body).Decode(&req) //nolint:errcheck
+		requestIDs = append(requestIDs, req.RequestID)
+		switch len(req.Answers) {
+		case 0:
+			w.Write([]byte(`{"questions":["Password: "],"echos":[false],"check_password":1}`)) //nolint:errcheck
+		case 1:
+			if req.Answers[0] != "OK" {
+				w.Write([]byte(`{"auth_result":-1}`)) //nolint:errcheck
+				return
+			}
+			w.Write([]byte(`{"questions":["Token: ","Code: "],"echos":[true,false]}`)) //nolint:errcheck
+		default:
+			if req.Answers[0] == "token" && req.Answers[1] == "code" {
+				w.Write([]byte(`{"auth_result":1}`)) //nolint:errcheck
+			} else {
+				w.Write([]byte(`{"auth_result":-1}`)) //nolint:errcheck
+			}
 		}
-		_, err = getSftpClient(user, usePubKey)
-		if err == nil {
-			t.Errorf("max sessions exceeded, new login should not succeed")
+	}))
+	defer server.Close()
+	getChallenge := func(answers [][]string) ssh.KeyboardInteractiveChallenge {
+		step := 0
+		return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			if step >= len(answers) {
+				return nil, fmt.Errorf("unexpected questions: %v", questions)
+			}
+			step++
+			return answers[step-1], nil
 		}
 	}
+	authUser, err := dataprovider.CheckKeyboardInteractiveAuth(dataprovider.GetProvider(), user.Username, server.URL,
+		getChallenge([][]string{{defaultPassword}, {"token", "code"}}), "127.0.0.1", "SSH")
+	if err != nil {
+		t.Errorf("keyboard interactive hook auth failed: %v", err)
+	} else if authUser.Username != user.Username {
+		t.Errorf("unexpected user: %v", authUser.Username)
+	}
+	if len(requestIDs) != 3 || requestIDs[0] == "" || requestIDs[0] != requestIDs[2] {
+		t.Errorf("unexpected request ids: %v", requestIDs)
+	}
+	_, err = dataprovider.CheckKeyboardInteractiveAuth(dataprovider.GetProvider(), user.Username, server.URL,
+		getChallenge([][]string{{defaultPassword}, {"token", "wrong"}}), "127.0.0.1", "SSH")
+	if err == nil {
+		t.Error("keyboard interactive hook auth must fail with a wrong code")
+	}
+	_, err = dataprovider.CheckKeyboardInteractiveAuth(dataprovider.GetProvider(), user.Username, server.URL,
+		getChallenge([][]string{{"wrong password"}}), "127.0.0.1", "SSH")
+	if err == nil {
+		t.Error("keyboard interactive hook auth must fail with a wrong password")
+	}
+	server.Close()
+	_, err = dataprovider.CheckKeyboardInteractiveAuth(dataprovider.GetProvider(), user.Username, server.URL,
+		getChallenge([][]string{{defaultPassword}, {"token", "code"}}), "127.0.0.1", "SSH")
+	if err == nil {
+		t.Error("keyboard interactive hook auth must fail if the hook is not reachable")
+	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
@@ -1858,160 +2396,286 @@ func TestMaxSessions(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestQuotaFileReplace(t *testing.T) {
+func TestLoginWithUsersCache(t *testing.T) {
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.UsersCache.TTL = 3600
+	providerConf.UsersCache.MaxSize = 10
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider: %v", err)
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
 	usePubKey := false
 	u := getTestUser(usePubKey)
-	u.QuotaFiles = 1000
+	u.PublicKeys = []string{testPubKey}
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	os.RemoveAll(user.GetHomeDir())
-	testFileSize := int64(65535)
-	testFileName := "test_file.dat"
-	testFilePath := filepath.Join(homeBasePath, testFileName)
-	client, err := getSftpClient(user, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		expectedQuotaSize := user.UsedQuotaSize + testFileSize
-		expectedQuotaFiles := user.UsedQuotaFiles + 1
-		err = createTestFile(testFilePath, testFileSize)
-		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
-		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+	for i := 0; i < 2; i++ {
+		client, err := getSftpClient(user, usePubKey)
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
-		}
-		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
-		if err != nil {
-			t.Errorf("error getting user: %v", err)
-		}
-		// now replace the same file, the quota must not change
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err != nil {
-			t.Errorf("file upload error: %v", err)
-		}
-		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
-		if err != nil {
-			t.Errorf("error getting user: %v", err)
-		}
-		if expectedQuotaFiles != user.UsedQuotaFiles {
-			t.Errorf("quota files does not match, expected: %v, actual: %v", expectedQuotaFiles, user.UsedQuotaFiles)
-		}
-		if expectedQuotaSize != user.UsedQuotaSize {
-			t.Errorf("quota size does not match, expected: %v, actual: %v", expectedQuotaSize, user.UsedQuotaSize)
+			t.Errorf("unable to create sftp client: %v", err)
+		} else {
+			_, err = client.Getwd()
+			if err != nil {
+				t.Errorf("unable to get working dir: %v", err)
+			}
+			client.Close()
 		}
 	}
-	// now set a quota size restriction and upload the same file, upload should fail for space limit exceeded
-	user.QuotaSize = testFileSize - 1
+	client, err := getSftpClient(user, true)
+	if err != nil {
+		t.Errorf("unable to create sftp client using a public key: %v", err)
+	} else {
+		client.Close()
+	}
+	// the cached user must be invalidated on update
+	user.Password = defaultPassword + "_mod"
 	user, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("error updating user: %v", err)
+		t.Errorf("unable to update user: %v", err)
+	}
+	user.Password = defaultPassword
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Error("login with the old password must fail")
 	}
+	user.Password = defaultPassword + "_mod"
 	client, err = getSftpClient(user, usePubKey)
 	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
+		t.Errorf("unable to create sftp client with the updated password: %v", err)
 	} else {
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err == nil {
-			t.Errorf("quota size exceeded, file upload must fail")
-		}
-		err = client.Remove(testFileName)
-		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
-		}
+		client.Close()
+	}
+	user.PublicKeys = []string{testPubKey1}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	_, err = getSftpClient(user, true)
+	if err == nil {
+		t.Error("login with a removed public key must fail")
 	}
+	// and on delete
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
-	os.Remove(testFilePath)
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Error("login for a deleted user must fail")
+	}
 	os.RemoveAll(user.GetHomeDir())
-}
 
-func TestQuotaScan(t *testing.T) {
-	usePubKey := false
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
-	}
-	testFileSize := int64(65535)
-	expectedQuotaSize := user.UsedQuotaSize + testFileSize
-	expectedQuotaFiles := user.UsedQuotaFiles + 1
-	client, err := getSftpClient(user, usePubKey)
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	providerConf.UsersCache.TTL = -1
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err == nil {
+		t.Error("a negative users cache ttl must fail")
+	}
+	providerConf.UsersCache.TTL = 0
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider: %v", err)
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+}
+
+func TestLoginWithLDAP(t *testing.T) {
+	ldapServer, err := newLDAPTestServer([]ldapTestEntry{
+		{
+			dn:       "cn=admin,dc=example,dc=com",
+			password: "admin_password",
+		},
+		{
+			dn:       "uid=ldap_user,ou=people,dc=example,dc=com",
+			password: "ldap_password",
+			attributes: map[string][]string{
+				"uid":      {"ldap_user"},
+				"memberOf": {"cn=other,ou=groups,dc=example,dc=com", "CN=SFTP,ou=groups,dc=example,dc=com"},
+			},
+		},
+		{
+			dn:       "uid=ldap_user1,ou=people,dc=example,dc=com",
+			password: "ldap_password1",
+			attributes: map[string][]string{
+				"uid": {"ldap_user1"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to start LDAP server: %v", err)
+	}
+	defer ldapServer.close()
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Username = "ldap_template"
+	u.HomeDir = filepath.Join(homeBasePath, "ldap")
+	u.Status = 0
+	u.QuotaFiles = 100
+	template, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.LDAP.URL = ldapServer.getURL()
+	providerConf.LDAP.SearchBindDN = "cn=admin,dc=example,dc=com"
+	providerConf.LDAP.SearchBindPassword = "admin_password"
+	providerConf.LDAP.BaseDN = "ou=people,dc=example,dc=com"
+	providerConf.LDAP.SearchFilter = "(&(uid=%s)(!(uid=admin)))"
+	providerConf.LDAP.GroupMappings = []dataprovider.LDAPGroupMapping{
+		{
+			Group:        "cn=sftp,ou=groups,dc=example,dc=com",
+			TemplateUser: template.Username,
+		},
+	}
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider: %v", err)
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	ldapUser := dataprovider.User{
+		Username: "ldap_user",
+		Password: "ldap_password",
+	}
+	client, err := getSftpClient(ldapUser, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		err = createTestFile(testFilePath, testFileSize)
-		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
-		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		_, err = client.Getwd()
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
+			t.Errorf("unable to get working dir: %v", err)
 		}
-		os.Remove(testFilePath)
 	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+	ldapUser.Password = "wrong_password"
+	_, err = getSftpClient(ldapUser, usePubKey)
+	if err == nil {
+		t.Error("LDAP login with a wrong password must fail")
 	}
-	// create user with the same home dir, so there is at least an untracked file
-	user, _, err = httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+	// ldap_user1 does not belong to any mapped group and no default template user is defined
+	_, err = getSftpClient(dataprovider.User{Username: "ldap_user1", Password: "ldap_password1"}, usePubKey)
+	if err == nil {
+		t.Error("LDAP login without a template user must fail")
 	}
-	_, err = httpd.StartQuotaScan(user, http.StatusCreated)
-	if err != nil {
-		t.Errorf("error starting quota scan: %v", err)
+	_, err = getSftpClient(dataprovider.User{Username: "missing_user", Password: "ldap_password"}, usePubKey)
+	if err == nil {
+		t.Error("LDAP login for a missing user must fail")
 	}
-	err = waitQuotaScans()
+	// template users cannot login
+	_, err = getSftpClient(dataprovider.User{Username: template.Username, Password: defaultPassword}, usePubKey)
+	if err == nil {
+		t.Error("LDAP login for a template user must fail")
+	}
+	users, out, err := httpd.GetUsers(0, 0, "ldap_user", http.StatusOK)
 	if err != nil {
-		t.Errorf("error waiting for active quota scans: %v", err)
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
 	}
-	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if len(users) != 1 {
+		t.Fatalf("number of users mismatch, expected: 1, actual: %v", len(users))
+	}
+	user := users[0]
+	if user.Status != 1 {
+		t.Errorf("LDAP user must be enabled")
+	}
+	if user.HomeDir != filepath.Join(template.HomeDir, user.Username) {
+		t.Errorf("home dir mismatch: %#v", user.HomeDir)
+	}
+	if user.QuotaFiles != template.QuotaFiles {
+		t.Errorf("quota files mismatch, expected: %v, actual: %v", template.QuotaFiles, user.QuotaFiles)
+	}
+	users, _, err = httpd.GetUsers(0, 0, "ldap_user1", http.StatusOK)
+	if err != nil || len(users) != 0 {
+		t.Errorf("LDAP user without a template must not be added, users: %+v, err: %v", users, err)
+	}
+	// bind directly as the user, with a default template
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	providerConf.LDAP.BindDNTemplate = "uid=%s,ou=people,dc=example,dc=com"
+	providerConf.LDAP.SearchBindDN = ""
+	providerConf.LDAP.SearchBindPassword = ""
+	providerConf.LDAP.DefaultTemplateUser = template.Username
+	err = dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
-		t.Errorf("error getting user: %v", err)
+		t.Errorf("error initializing data provider: %v", err)
 	}
-	if expectedQuotaFiles != user.UsedQuotaFiles {
-		t.Errorf("quota files does not match after scan, expected: %v, actual: %v", expectedQuotaFiles, user.UsedQuotaFiles)
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	client, err = getSftpClient(dataprovider.User{Username: "ldap_user1", Password: "ldap_password1"}, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir: %v", err)
+		}
 	}
-	if expectedQuotaSize != user.UsedQuotaSize {
-		t.Errorf("quota size does not match after scan, expected: %v, actual: %v", expectedQuotaSize, user.UsedQuotaSize)
+	_, err = getSftpClient(dataprovider.User{Username: "ldap_user1,ou=people", Password: "ldap_password1"}, usePubKey)
+	if err == nil {
+		t.Error("LDAP login with an invalid username must fail")
+	}
+	users, _, err = httpd.GetUsers(0, 0, "ldap_user1", http.StatusOK)
+	if err != nil || len(users) != 1 {
+		t.Errorf("LDAP user must be added, users: %+v, err: %v", users, err)
+	}
+	for _, username := range []string{"ldap_user", "ldap_user1"} {
+		users, _, err = httpd.GetUsers(0, 0, username, http.StatusOK)
+		if err == nil && len(users) == 1 {
+			_, err = httpd.RemoveUser(users[0], http.StatusOK)
+			if err != nil {
+				t.Errorf("unable to remove user: %v", err)
+			}
+		}
 	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
+	_, err = httpd.RemoveUser(template, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
-	os.RemoveAll(user.GetHomeDir())
-}
+	os.RemoveAll(template.GetHomeDir())
 
-func TestMultipleQuotaScans(t *testing.T) {
-	if !sftpd.AddQuotaScan(defaultUsername) {
-		t.Errorf("add quota failed")
-	}
-	if sftpd.AddQuotaScan(defaultUsername) {
-		t.Errorf("add quota must fail if another scan is already active")
-	}
-	sftpd.RemoveQuotaScan(defaultUsername)
-	activeScans := sftpd.GetQuotaScans()
-	if len(activeScans) > 0 {
-		t.Errorf("no quota scan must be active: %v", len(activeScans))
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
 	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
 }
 
-func TestQuotaSize(t *testing.T) {
+func TestQuotaDisabledError(t *testing.T) {
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.TrackQuota = 0
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
 	usePubKey := false
-	testFileSize := int64(65535)
 	u := getTestUser(usePubKey)
-	u.QuotaFiles = 1
-	u.QuotaSize = testFileSize - 1
+	u.QuotaFiles = 10
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
@@ -2023,42 +2687,40 @@ func TestQuotaSize(t *testing.T) {
 		defer client.Close()
 		testFileName := "test_file.dat"
 		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName+".quota", testFileSize, client)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName+".quota.1", testFileSize, client)
-		if err == nil {
-			t.Errorf("user is over quota file upload must fail")
-		}
-		err = client.Remove(testFileName + ".quota")
-		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
-		}
 		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+		t.Errorf("unable to remove: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
 }
 
-func TestBandwidthAndConnections(t *testing.T) {
+func TestMaxSessions(t *testing.T) {
 	usePubKey := false
-	testFileSize := int64(131072)
 	u := getTestUser(usePubKey)
-	u.UploadBandwidth = 30
-	u.DownloadBandwidth = 25
-	wantedUploadElapsed := 1000 * (testFileSize / 1000) / u.UploadBandwidth
-	wantedDownloadElapsed := 1000 * (testFileSize / 1000) / u.DownloadBandwidth
-	// 100 ms tolerance
-	wantedUploadElapsed -= 100
-	wantedDownloadElapsed -= 100
+	u.Username += "1"
+	u.MaxSessions = 1
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
@@ -2068,52 +2730,18 @@ func TestBandwidthAndConnections(t *testing.T) {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		err = createTestFile(testFilePath, testFileSize)
-		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
-		}
-		startTime := time.Now()
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		_, err := client.Getwd()
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
-		}
-		elapsed := time.Since(startTime).Nanoseconds() / 1000000
-		if elapsed < (wantedUploadElapsed) {
-			t.Errorf("upload bandwidth throttling not respected, elapsed: %v, wanted: %v", elapsed, wantedUploadElapsed)
+			t.Errorf("unable to get working dir: %v", err)
 		}
-		startTime = time.Now()
-		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
-		c := sftpDownloadNonBlocking(testFileName, localDownloadPath, testFileSize, client)
-		waitForActiveTransfer()
-		// wait some additional arbitrary time to wait for transfer activity to happen
-		// it is need to reach all the code in CheckIdleConnections
-		time.Sleep(100 * time.Millisecond)
-		sftpd.CheckIdleConnections()
-		err = <-c
+		_, err = client.ReadDir(".")
 		if err != nil {
-			t.Errorf("file download error: %v", err)
-		}
-		elapsed = time.Since(startTime).Nanoseconds() / 1000000
-		if elapsed < (wantedDownloadElapsed) {
-			t.Errorf("download bandwidth throttling not respected, elapsed: %v, wanted: %v", elapsed, wantedDownloadElapsed)
-		}
-		// test disconnection
-		c = sftpUploadNonBlocking(testFilePath, testFileName+"_partial", testFileSize, client)
-		waitForActiveTransfer()
-		time.Sleep(100 * time.Millisecond)
-		sftpd.CheckIdleConnections()
-		stats := sftpd.GetConnectionsStats()
-		for _, stat := range stats {
-			sftpd.CloseActiveConnection(stat.ConnectionID)
+			t.Errorf("unable to read remote dir: %v", err)
 		}
-		err = <-c
+		_, err = getSftpClient(user, usePubKey)
 		if err == nil {
-			t.Errorf("connection closed upload must fail")
+			t.Errorf("max sessions exceeded, new login should not succeed")
 		}
-		os.Remove(testFilePath)
-		os.Remove(localDownloadPath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -2122,17 +2750,281 @@ func TestBandwidthAndConnections(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestExtensionsFilters(t *testing.T) {
-	usePubKey := true
+func TestQuotaFileReplace(t *testing.T) {
+	usePubKey := false
 	u := getTestUser(usePubKey)
+	u.QuotaFiles = 1000
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	testFileSize := int64(131072)
+	os.RemoveAll(user.GetHomeDir())
+	testFileSize := int64(65535)
 	testFileName := "test_file.dat"
 	testFilePath := filepath.Join(homeBasePath, testFileName)
-	localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		expectedQuotaSize := user.UsedQuotaSize + testFileSize
+		expectedQuotaFiles := user.UsedQuotaFiles + 1
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		// now replace the same file, the quota must not change
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if expectedQuotaFiles != user.UsedQuotaFiles {
+			t.Errorf("quota files does not match, expected: %v, actual: %v", expectedQuotaFiles, user.UsedQuotaFiles)
+		}
+		if expectedQuotaSize != user.UsedQuotaSize {
+			t.Errorf("quota size does not match, expected: %v, actual: %v", expectedQuotaSize, user.UsedQuotaSize)
+		}
+	}
+	// now set a quota size restriction and upload the same file, upload should fail for space limit exceeded
+	user.QuotaSize = testFileSize - 1
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("error updating user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err == nil {
+			t.Errorf("quota size exceeded, file upload must fail")
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.Remove(testFilePath)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestQuotaScan(t *testing.T) {
+	usePubKey := false
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileSize := int64(65535)
+	expectedQuotaSize := user.UsedQuotaSize + testFileSize
+	expectedQuotaFiles := user.UsedQuotaFiles + 1
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	// create user with the same home dir, so there is at least an untracked file
+	user, _, err = httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	_, err = httpd.StartQuotaScan(user, http.StatusCreated)
+	if err != nil {
+		t.Errorf("error starting quota scan: %v", err)
+	}
+	err = waitQuotaScans()
+	if err != nil {
+		t.Errorf("error waiting for active quota scans: %v", err)
+	}
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("error getting user: %v", err)
+	}
+	if expectedQuotaFiles != user.UsedQuotaFiles {
+		t.Errorf("quota files does not match after scan, expected: %v, actual: %v", expectedQuotaFiles, user.UsedQuotaFiles)
+	}
+	if expectedQuotaSize != user.UsedQuotaSize {
+		t.Errorf("quota size does not match after scan, expected: %v, actual: %v", expectedQuotaSize, user.UsedQuotaSize)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestMultipleQuotaScans(t *testing.T) {
+	if !sftpd.AddQuotaScan(defaultUsername) {
+		t.Errorf("add quota failed")
+	}
+	if sftpd.AddQuotaScan(defaultUsername) {
+		t.Errorf("add quota must fail if another scan is already active")
+	}
+	sftpd.RemoveQuotaScan(defaultUsername)
+	activeScans := sftpd.GetQuotaScans()
+	if len(activeScans) > 0 {
+		t.Errorf("no quota scan must be active: %v", len(activeScans))
+	}
+}
+
+func TestQuotaSize(t *testing.T) {
+	usePubKey := false
+	testFileSize := int64(65535)
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 1
+	u.QuotaSize = testFileSize - 1
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+".quota", testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+".quota.1", testFileSize, client)
+		if err == nil {
+			t.Errorf("user is over quota file upload must fail")
+		}
+		err = client.Remove(testFileName + ".quota")
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestBandwidthAndConnections(t *testing.T) {
+	usePubKey := false
+	testFileSize := int64(131072)
+	u := getTestUser(usePubKey)
+	u.UploadBandwidth = 30
+	u.DownloadBandwidth = 25
+	wantedUploadElapsed := 1000 * (testFileSize / 1000) / u.UploadBandwidth
+	wantedDownloadElapsed := 1000 * (testFileSize / 1000) / u.DownloadBandwidth
+	// 100 ms tolerance
+	wantedUploadElapsed -= 100
+	wantedDownloadElapsed -= 100
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		startTime := time.Now()
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		elapsed := time.Since(startTime).Nanoseconds() / 1000000
+		if elapsed < (wantedUploadElapsed) {
+			t.Errorf("upload bandwidth throttling not respected, elapsed: %v, wanted: %v", elapsed, wantedUploadElapsed)
+		}
+		startTime = time.Now()
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		c := sftpDownloadNonBlocking(testFileName, localDownloadPath, testFileSize, client)
+		waitForActiveTransfer()
+		// wait some additional arbitrary time to wait for transfer activity to happen
+		// it is need to reach all the code in CheckIdleConnections
+		time.Sleep(100 * time.Millisecond)
+		sftpd.CheckIdleConnections()
+		err = <-c
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		elapsed = time.Since(startTime).Nanoseconds() / 1000000
+		if elapsed < (wantedDownloadElapsed) {
+			t.Errorf("download bandwidth throttling not respected, elapsed: %v, wanted: %v", elapsed, wantedDownloadElapsed)
+		}
+		// test disconnection
+		c = sftpUploadNonBlocking(testFilePath, testFileName+"_partial", testFileSize, client)
+		waitForActiveTransfer()
+		time.Sleep(100 * time.Millisecond)
+		sftpd.CheckIdleConnections()
+		stats := sftpd.GetConnectionsStats()
+		for _, stat := range stats {
+			sftpd.CloseActiveConnection(stat.ConnectionID)
+		}
+		err = <-c
+		if err == nil {
+			t.Errorf("connection closed upload must fail")
+		}
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestExtensionsFilters(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileSize := int64(131072)
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
@@ -2202,9 +3094,11 @@ func TestVirtualFolders(t *testing.T) {
 	u := getTestUser(usePubKey)
 	mappedPath := filepath.Join(os.TempDir(), "vdir")
 	vdirPath := "/vdir"
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: vdirPath,
-		MappedPath:  mappedPath,
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: vdirPath,
+			MappedPath:  mappedPath,
+		},
 	})
 	os.MkdirAll(mappedPath, 0777)
 	user, _, err := httpd.AddUser(u, http.StatusOK)
@@ -3263,131 +4157,770 @@ func TestPermsSubDirsSetstat(t *testing.T) {
 		testFileSize := int64(65535)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Chtimes("/subdir/", time.Now(), time.Now())
+		if !strings.Contains(err.Error(), "Permission Denied") {
+			t.Errorf("unexpected chtimes error: %v", err)
+		}
+		err = client.Chtimes("subdir/", time.Now(), time.Now())
+		if !strings.Contains(err.Error(), "Permission Denied") {
+			t.Errorf("unexpected chtimes error: %v", err)
+		}
+		err = client.Chtimes(testFileName, time.Now(), time.Now())
+		if err != nil {
+			t.Errorf("unexpected chtimes error: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	httpd.RemoveUser(user, http.StatusOK)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPermsSubDirsCommands(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	u.Permissions["/subdir"] = []string{dataprovider.PermDownload, dataprovider.PermUpload}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		client.Mkdir("subdir")
+		acmodTime := time.Now()
+		err = client.Chtimes("/subdir", acmodTime, acmodTime)
+		if err != nil {
+			t.Errorf("unexpected chtimes error: %v", err)
+		}
+		_, err = client.Stat("/subdir")
+		if err != nil {
+			t.Errorf("unexpected stat error: %v", err)
+		}
+		_, err = client.ReadDir("/")
+		if err != nil {
+			t.Errorf("unexpected readdir error: %v", err)
+		}
+		_, err = client.ReadDir("/subdir")
+		if !strings.Contains(err.Error(), "Permission Denied") {
+			t.Errorf("unexpected error: %v", err)
+		}
+		err = client.RemoveDirectory("/subdir/dir")
+		if !strings.Contains(err.Error(), "Permission Denied") {
+			t.Errorf("unexpected error: %v", err)
+		}
+		err = client.Mkdir("/subdir/dir")
+		if !strings.Contains(err.Error(), "Permission Denied") {
+			t.Errorf("unexpected error: %v", err)
+		}
+		client.Mkdir("/otherdir")
+		err = client.Rename("/otherdir", "/subdir/otherdir")
+		if !strings.Contains(err.Error(), "Permission Denied") {
+			t.Errorf("unexpected error: %v", err)
+		}
+		err = client.Symlink("/otherdir", "/subdir/otherdir")
+		if !strings.Contains(err.Error(), "Permission Denied") {
+			t.Errorf("unexpected error: %v", err)
+		}
+		err = client.Symlink("/otherdir", "/otherdir_link")
+		if err != nil {
+			t.Errorf("unexpected rename dir error: %v", err)
+		}
+		err = client.Rename("/otherdir", "/otherdir1")
+		if err != nil {
+			t.Errorf("unexpected rename dir error: %v", err)
+		}
+		err = client.RemoveDirectory("/subdir")
+		if err != nil {
+			t.Errorf("unexpected remove dir error: %v", err)
+		}
+	}
+	httpd.RemoveUser(user, http.StatusOK)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestRootDirCommands(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	u.Permissions["/subdir"] = []string{dataprovider.PermDownload, dataprovider.PermUpload}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		err = client.Rename("/", "rootdir")
+		if !strings.Contains(err.Error(), "Permission Denied") {
+			t.Errorf("unexpected error renaming root dir: %v", err)
+		}
+		err = client.Symlink("/", "rootdir")
+		if !strings.Contains(err.Error(), "Permission Denied") {
+			t.Errorf("unexpected error symlinking root dir: %v", err)
+		}
+		err = client.RemoveDirectory("/")
+		if !strings.Contains(err.Error(), "Permission Denied") {
+			t.Errorf("unexpected error removing root dir: %v", err)
+		}
+	}
+	httpd.RemoveUser(user, http.StatusOK)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestSFTPFsBackend(t *testing.T) {
+	usePubKey := false
+	baseUser, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	fingerprint, err := getServerHostKeyFingerprint()
+	if err != nil {
+		t.Errorf("unable to get the server host key fingerprint: %v", err)
+	}
+	u := getTestUser(usePubKey)
+	u.Username = defaultUsername + "_sftpfs"
+	u.HomeDir = filepath.Join(homeBasePath, u.Username)
+	u.FsConfig.Provider = 4
+	u.FsConfig.SFTPConfig = vfs.SFTPFsConfig{
+		Endpoint:     sftpServerAddr,
+		Username:     baseUser.Username,
+		Password:     kms.NewPlainSecret(defaultPassword),
+		Fingerprints: []string{fingerprint},
+		Prefix:       "/sftpfs",
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		appendDataSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		// the file must be stored inside the prefix of the remote account
+		fi, err := os.Stat(filepath.Join(baseUser.GetHomeDir(), "sftpfs", testFileName))
+		if err != nil || fi.Size() != testFileSize {
+			t.Errorf("unexpected remote file, err: %v", err)
+		}
+		err = appendToTestFile(testFilePath, appendDataSize)
+		if err != nil {
+			t.Errorf("unable to append to test file: %v", err)
+		}
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize+appendDataSize, false, client)
+		if err != nil {
+			t.Errorf("file upload resume error: %v", err)
+		}
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize+appendDataSize, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		initialHash, err := computeHashForFile(sha256.New(), testFilePath)
+		if err != nil {
+			t.Errorf("error computing file hash: %v", err)
+		}
+		downloadedFileHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		if err != nil {
+			t.Errorf("error computing downloaded file hash: %v", err)
+		}
+		if initialHash != downloadedFileHash {
+			t.Errorf("resumed upload does not match the original file")
+		}
+		err = client.Mkdir("subdir")
+		if err != nil {
+			t.Errorf("unable to create dir: %v", err)
+		}
+		err = client.Rename(testFileName, path.Join("subdir", testFileName))
+		if err != nil {
+			t.Errorf("unable to rename file: %v", err)
+		}
+		testFileName = path.Join("subdir", testFileName)
+		err = client.Chmod(testFileName, 0640)
+		if err != nil {
+			t.Errorf("unable to chmod file: %v", err)
+		}
+		acmodTime := time.Now().Add(-1 * time.Hour)
+		err = client.Chtimes(testFileName, acmodTime, acmodTime)
+		if err != nil {
+			t.Errorf("unable to change file times: %v", err)
+		}
+		fi, err = client.Stat(testFileName)
+		if err != nil {
+			t.Errorf("file stat error: %v", err)
+		} else {
+			if fi.Mode().Perm() != 0640 {
+				t.Errorf("unexpected file mode: %v", fi.Mode())
+			}
+			if math.Abs(fi.ModTime().Sub(acmodTime).Seconds()) > 1 {
+				t.Errorf("unexpected modification time: %v", fi.ModTime())
+			}
+		}
+		_, err = client.Stat(path.Join("..", "..", baseUser.Username))
+		if !os.IsNotExist(err) {
+			t.Errorf("the paths outside the prefix must not be accessible, err: %v", err)
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("unable to remove file: %v", err)
+		}
+		err = client.RemoveDirectory("subdir")
+		if err != nil {
+			t.Errorf("unable to remove dir: %v", err)
+		}
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
+	}
+	// an unexpected host key must be rejected
+	user.FsConfig.SFTPConfig.Fingerprints = []string{"SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4"}
+	user.FsConfig.SFTPConfig.Password = kms.NewPlainSecret(defaultPassword)
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.ReadDir("/")
+		if err == nil {
+			t.Error("the remote server must be rejected for an invalid host key")
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	_, err = httpd.RemoveUser(baseUser, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	os.RemoveAll(baseUser.GetHomeDir())
+}
+
+func TestCryptFsBackend(t *testing.T) {
+	usePubKey := true
+	baseUser, _, err := httpd.AddUser(getTestUser(false), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	fingerprint, err := getServerHostKeyFingerprint()
+	if err != nil {
+		t.Errorf("unable to get the server host key fingerprint: %v", err)
+	}
+	u := getTestUser(usePubKey)
+	u.Username = defaultUsername + "_cryptfs"
+	u.HomeDir = filepath.Join(homeBasePath, u.Username)
+	u.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("crypt passphrase")
+	u.QuotaSize = 10485760
+	localUser, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	if !localUser.FsConfig.CryptConfig.Passphrase.IsRedacted() {
+		t.Errorf("the passphrase must be returned redacted: %#v", localUser.FsConfig.CryptConfig.Passphrase)
+	}
+	u = getTestUser(usePubKey)
+	u.Username = defaultUsername + "_cryptsftpfs"
+	u.HomeDir = filepath.Join(homeBasePath, u.Username)
+	u.FsConfig.Provider = 4
+	u.FsConfig.SFTPConfig = vfs.SFTPFsConfig{
+		Endpoint:     sftpServerAddr,
+		Username:     baseUser.Username,
+		Password:     kms.NewPlainSecret(defaultPassword),
+		Fingerprints: []string{fingerprint},
+		Prefix:       "/cryptfs",
+	}
+	u.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("another passphrase")
+	u.QuotaSize = 10485760
+	sftpUser, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	// the encrypted files, as seen on the local filesystem
+	storedPaths := map[string]string{
+		localUser.Username: localUser.GetHomeDir(),
+		sftpUser.Username:  filepath.Join(baseUser.GetHomeDir(), "cryptfs"),
+	}
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	// more than one DARE package
+	testFileSize := int64(131172)
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+	for _, user := range []dataprovider.User{localUser, sftpUser} {
+		client, err := getSftpClient(user, usePubKey)
+		if err != nil {
+			t.Errorf("unable to create sftp client: %v", err)
+			continue
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error for user %#v: %v", user.Username, err)
+		}
+		storedFile := filepath.Join(storedPaths[user.Username], testFileName)
+		fi, err := os.Stat(storedFile)
+		if err != nil || fi.Size() <= testFileSize {
+			t.Errorf("unexpected stored file for user %#v, err: %v", user.Username, err)
+		}
+		initialHash, err := computeHashForFile(sha256.New(), testFilePath)
+		if err != nil {
+			t.Errorf("error computing file hash: %v", err)
+		}
+		storedHash, err := computeHashForFile(sha256.New(), storedFile)
+		if err != nil || storedHash == initialHash {
+			t.Errorf("the stored file must be encrypted, err: %v", err)
+		}
+		files, err := client.ReadDir(".")
+		if err != nil || len(files) != 1 || files[0].Size() != testFileSize {
+			t.Errorf("unexpected directory listing, files: %v err: %v", files, err)
+		}
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		downloadedFileHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		if err != nil || initialHash != downloadedFileHash {
+			t.Errorf("downloaded file does not match the original file, err: %v", err)
+		}
+		// download starting from an offset inside the second package
+		offset := int64(65536 + 100)
+		content, err := ioutil.ReadFile(testFilePath)
+		if err != nil {
+			t.Errorf("unable to read the test file: %v", err)
+		}
+		f, err := client.Open(testFileName)
+		if err != nil {
+			t.Errorf("unable to open file: %v", err)
+		} else {
+			buf := make([]byte, 1000)
+			_, err = f.Seek(offset, io.SeekStart)
+			if err != nil {
+				t.Errorf("unable to seek: %v", err)
+			}
+			n, err := io.ReadFull(f, buf)
+			if err != nil || !bytes.Equal(buf, content[offset:offset+int64(n)]) {
+				t.Errorf("unexpected data read at offset %v, read bytes: %v, err: %v", offset, n, err)
+			}
+			f.Close()
+		}
+		// upload resume is not supported
+		err = appendToTestFile(testFilePath, 100)
+		if err != nil {
+			t.Errorf("unable to append to test file: %v", err)
+		}
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize+100, false, client)
+		if err == nil {
+			t.Error("upload resume must fail for encrypted filesystems")
+		}
+		// overwrite with a smaller file, the existing file must be truncated
+		err = createTestFile(testFilePath, 100)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, 100, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpDownloadFile(testFileName, localDownloadPath, 100, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		// empty files are supported too
+		err = createTestFile(testFilePath, 0)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, "empty", 0, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpDownloadFile("empty", localDownloadPath, 0, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		err = client.Remove("empty")
+		if err != nil {
+			t.Errorf("unable to remove file: %v", err)
+		}
+		client.Close()
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get user: %v", err)
+		}
+		// the quota is tracked using the plain text sizes
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != 100 {
+			t.Errorf("unexpected quota for user %#v, files: %v size: %v", user.Username, user.UsedQuotaFiles,
+				user.UsedQuotaSize)
+		}
+		_, err = httpd.StartQuotaScan(user, http.StatusCreated)
+		if err != nil {
+			t.Errorf("error starting quota scan: %v", err)
+		}
+		err = waitQuotaScans()
+		if err != nil {
+			t.Errorf("error waiting for active quota scans: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
+			t.Errorf("unable to get user: %v", err)
 		}
-		err = client.Chtimes("/subdir/", time.Now(), time.Now())
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected chtimes error: %v", err)
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != 100 {
+			t.Errorf("unexpected quota after scan for user %#v, files: %v size: %v", user.Username,
+				user.UsedQuotaFiles, user.UsedQuotaSize)
 		}
-		err = client.Chtimes("subdir/", time.Now(), time.Now())
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected chtimes error: %v", err)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
 		}
-		err = client.Chtimes(testFileName, time.Now(), time.Now())
+	}
+	// a wrong passphrase cannot decrypt the existing files
+	localUser.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("wrong passphrase")
+	localUser, _, err = httpd.UpdateUser(localUser, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err := getSftpClient(localUser, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		err = sftpDownloadFile(testFileName, localDownloadPath, 100, client)
+		if err == nil {
+			t.Error("download with a wrong passphrase must fail")
+		}
+	}
+	for _, user := range []dataprovider.User{localUser, sftpUser, baseUser} {
+		_, err = httpd.RemoveUser(user, http.StatusOK)
 		if err != nil {
-			t.Errorf("unexpected chtimes error: %v", err)
+			t.Errorf("unable to remove user: %v", err)
 		}
-		os.Remove(testFilePath)
+		os.RemoveAll(user.GetHomeDir())
 	}
-	httpd.RemoveUser(user, http.StatusOK)
-	os.RemoveAll(user.GetHomeDir())
+	os.Remove(testFilePath)
+	os.Remove(localDownloadPath)
 }
 
-func TestPermsSubDirsCommands(t *testing.T) {
+func TestVirtualFoldersStorageBackends(t *testing.T) {
 	usePubKey := true
+	baseUser, _, err := httpd.AddUser(getTestUser(false), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	fingerprint, err := getServerHostKeyFingerprint()
+	if err != nil {
+		t.Errorf("unable to get the server host key fingerprint: %v", err)
+	}
+	mappedPath := filepath.Join(os.TempDir(), "vdir_mapped")
+	cryptMappedPath := filepath.Join(os.TempDir(), "vdir_crypt")
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermAny}
-	u.Permissions["/subdir"] = []string{dataprovider.PermDownload, dataprovider.PermUpload}
+	u.Username = defaultUsername + "_vfolders"
+	u.HomeDir = filepath.Join(homeBasePath, u.Username)
+	u.QuotaFiles = 100
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir_mapped",
+			MappedPath:  mappedPath,
+		},
+		QuotaFiles: 100,
+	})
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir_crypt",
+			MappedPath:  cryptMappedPath,
+		},
+		QuotaFiles: 100,
+		FsConfig: dataprovider.Filesystem{
+			CryptConfig: vfs.CryptFsConfig{
+				Passphrase: kms.NewPlainSecret("folder passphrase"),
+			},
+		},
+	})
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/sub/vdir_sftp",
+		},
+		QuotaFiles: 100,
+		FsConfig: dataprovider.Filesystem{
+			Provider: 4,
+			SFTPConfig: vfs.SFTPFsConfig{
+				Endpoint:     sftpServerAddr,
+				Username:     baseUser.Username,
+				Password:     kms.NewPlainSecret(defaultPassword),
+				Fingerprints: []string{fingerprint},
+				Prefix:       "/vfolder",
+			},
+		},
+	})
+	os.MkdirAll(mappedPath, 0777)
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
+	for _, folder := range user.VirtualFolders {
+		if folder.FsConfig.Provider == 4 && !folder.FsConfig.SFTPConfig.Password.IsRedacted() {
+			t.Errorf("the folder password must be returned redacted: %#v", folder.FsConfig.SFTPConfig.Password)
+		}
+	}
+	// the stored secrets must be preserved if the redacted values are sent back
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		client.Mkdir("subdir")
-		acmodTime := time.Now()
-		err = client.Chtimes("/subdir", acmodTime, acmodTime)
+		initialHash, err := computeHashForFile(sha256.New(), testFilePath)
 		if err != nil {
-			t.Errorf("unexpected chtimes error: %v", err)
+			t.Errorf("error computing file hash: %v", err)
 		}
-		_, err = client.Stat("/subdir")
+		for _, dir := range []string{"/", "/vdir_mapped", "/vdir_crypt", "/sub/vdir_sftp"} {
+			err = sftpUploadFile(testFilePath, path.Join(dir, testFileName), testFileSize, client)
+			if err != nil {
+				t.Errorf("file upload error for dir %#v: %v", dir, err)
+			}
+			err = sftpDownloadFile(path.Join(dir, testFileName), localDownloadPath, testFileSize, client)
+			if err != nil {
+				t.Errorf("file download error for dir %#v: %v", dir, err)
+			}
+			downloadedFileHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+			if err != nil || initialHash != downloadedFileHash {
+				t.Errorf("downloaded file does not match the original file for dir %#v, err: %v", dir, err)
+			}
+		}
+		// the files must be stored using the folder backends
+		fi, err := os.Stat(filepath.Join(baseUser.GetHomeDir(), "vfolder", testFileName))
+		if err != nil || fi.Size() != testFileSize {
+			t.Errorf("unexpected file inside the sftp folder, err: %v", err)
+		}
+		fi, err = os.Stat(filepath.Join(mappedPath, testFileName))
+		if err != nil || fi.Size() != testFileSize {
+			t.Errorf("unexpected file inside the mapped folder, err: %v", err)
+		}
+		fi, err = os.Stat(filepath.Join(cryptMappedPath, testFileName))
+		if err != nil || fi.Size() <= testFileSize {
+			t.Errorf("unexpected file inside the encrypted folder, err: %v", err)
+		}
+		files, err := client.ReadDir("/sub")
+		if err != nil || len(files) != 1 || files[0].Name() != "vdir_sftp" {
+			t.Errorf("unexpected directory listing, files: %v err: %v", files, err)
+		}
+		files, err = client.ReadDir("/sub/vdir_sftp")
+		if err != nil || len(files) != 1 || files[0].Size() != testFileSize {
+			t.Errorf("unexpected directory listing, files: %v err: %v", files, err)
+		}
+		// renames between different storage backends are not supported
+		err = client.Rename(path.Join("/sub/vdir_sftp", testFileName), "/renamed_file")
+		if err == nil {
+			t.Error("rename from the sftp folder to the home dir must fail")
+		}
+		err = client.Rename(path.Join("/vdir_crypt", testFileName), path.Join("/vdir_mapped", "renamed_file"))
+		if err == nil {
+			t.Error("rename from the encrypted folder to the mapped folder must fail")
+		}
+		err = client.Symlink(path.Join("/sub/vdir_sftp", testFileName), "/link")
+		if err == nil {
+			t.Error("symlink from the sftp folder to the home dir must fail")
+		}
+		err = client.Rename(path.Join("/sub/vdir_sftp", testFileName), path.Join("/sub/vdir_sftp", "renamed_file"))
 		if err != nil {
-			t.Errorf("unexpected stat error: %v", err)
+			t.Errorf("rename inside the sftp folder must succeed: %v", err)
 		}
-		_, err = client.ReadDir("/")
+		// the mapped folder is served by the user's filesystem, the quota is moved between the scopes
+		err = client.Rename(testFileName, path.Join("/vdir_mapped", "renamed_file"))
 		if err != nil {
-			t.Errorf("unexpected readdir error: %v", err)
+			t.Errorf("rename from the home dir to the mapped folder must succeed: %v", err)
 		}
-		_, err = client.ReadDir("/subdir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error: %v", err)
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get user: %v", err)
 		}
-		err = client.RemoveDirectory("/subdir/dir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error: %v", err)
+		if user.UsedQuotaFiles != 0 || user.UsedQuotaSize != 0 {
+			t.Errorf("unexpected user quota, files: %v size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
 		}
-		err = client.Mkdir("/subdir/dir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error: %v", err)
+		expectedQuota := map[string]int{
+			"/vdir_mapped":   2,
+			"/vdir_crypt":    1,
+			"/sub/vdir_sftp": 1,
 		}
-		client.Mkdir("/otherdir")
-		err = client.Rename("/otherdir", "/subdir/otherdir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error: %v", err)
+		for vpath, numFiles := range expectedQuota {
+			quota := user.FoldersQuota[vpath]
+			if quota.UsedQuotaFiles != numFiles || quota.UsedQuotaSize != int64(numFiles)*testFileSize {
+				t.Errorf("unexpected quota for folder %#v: %+v", vpath, quota)
+			}
 		}
-		err = client.Symlink("/otherdir", "/subdir/otherdir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error: %v", err)
+		err = client.Remove(path.Join("/sub/vdir_sftp", "renamed_file"))
+		if err != nil {
+			t.Errorf("unable to remove file: %v", err)
 		}
-		err = client.Symlink("/otherdir", "/otherdir_link")
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
 		if err != nil {
-			t.Errorf("unexpected rename dir error: %v", err)
+			t.Errorf("unable to get user: %v", err)
 		}
-		err = client.Rename("/otherdir", "/otherdir1")
+		quota := user.FoldersQuota["/sub/vdir_sftp"]
+		if quota.UsedQuotaFiles != 0 || quota.UsedQuotaSize != 0 {
+			t.Errorf("unexpected quota for the sftp folder after remove: %+v", quota)
+		}
+		// the quota scan updates the folders quota too, encrypted files are counted using their plain size
+		_, err = httpd.StartQuotaScan(user, http.StatusCreated)
 		if err != nil {
-			t.Errorf("unexpected rename dir error: %v", err)
+			t.Errorf("error starting quota scan: %v", err)
 		}
-		err = client.RemoveDirectory("/subdir")
+		err = waitQuotaScans()
 		if err != nil {
-			t.Errorf("unexpected remove dir error: %v", err)
+			t.Errorf("error waiting for active quota scans: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get user: %v", err)
+		}
+		expectedQuota["/sub/vdir_sftp"] = 0
+		for vpath, numFiles := range expectedQuota {
+			quota := user.FoldersQuota[vpath]
+			if quota.UsedQuotaFiles != numFiles || quota.UsedQuotaSize != int64(numFiles)*testFileSize {
+				t.Errorf("unexpected quota after scan for folder %#v: %+v", vpath, quota)
+			}
 		}
 	}
-	httpd.RemoveUser(user, http.StatusOK)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	_, err = httpd.RemoveUser(baseUser, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.Remove(testFilePath)
+	os.Remove(localDownloadPath)
+	os.RemoveAll(mappedPath)
+	os.RemoveAll(cryptMappedPath)
 	os.RemoveAll(user.GetHomeDir())
+	os.RemoveAll(baseUser.GetHomeDir())
 }
 
-func TestRootDirCommands(t *testing.T) {
-	usePubKey := true
+func TestRenameQuotaScopes(t *testing.T) {
+	usePubKey := false
+	mappedPath := filepath.Join(os.TempDir(), "vdir_quota")
 	u := getTestUser(usePubKey)
-	u.Permissions["/"] = []string{dataprovider.PermAny}
-	u.Permissions["/subdir"] = []string{dataprovider.PermDownload, dataprovider.PermUpload}
+	u.QuotaFiles = 2
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: "/vdir_quota",
+			MappedPath:  mappedPath,
+		},
+		QuotaFiles: 1,
+	})
+	os.MkdirAll(mappedPath, 0777)
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		err = client.Rename("/", "rootdir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error renaming root dir: %v", err)
+		for _, name := range []string{testFileName, "/vdir_quota/" + testFileName} {
+			err = sftpUploadFile(testFilePath, name, testFileSize, client)
+			if err != nil {
+				t.Errorf("file upload error: %v", err)
+			}
 		}
-		err = client.Symlink("/", "rootdir")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error symlinking root dir: %v", err)
+		// the folder quota is exhausted, the file cannot be moved inside the folder
+		err = client.Rename(testFileName, "/vdir_quota/renamed_file")
+		if err == nil {
+			t.Error("rename exceeding the folder quota must fail")
 		}
-		err = client.RemoveDirectory("/")
-		if !strings.Contains(err.Error(), "Permission Denied") {
-			t.Errorf("unexpected error removing root dir: %v", err)
+		if _, err = client.Stat(testFileName); err != nil {
+			t.Errorf("the source file must be preserved: %v", err)
+		}
+		err = client.Rename("/vdir_quota/"+testFileName, "renamed_file")
+		if err != nil {
+			t.Errorf("rename from the folder to the home dir must succeed: %v", err)
+		}
+		err = client.Rename(testFileName, "/vdir_quota/renamed_file")
+		if err != nil {
+			t.Errorf("rename from the home dir to the folder must succeed: %v", err)
+		}
+		err = client.Rename("/vdir_quota/renamed_file", "other_file")
+		if err != nil {
+			t.Errorf("rename inside the home dir quota limit must succeed: %v", err)
+		}
+		// the home dir quota is now exhausted
+		err = sftpUploadFile(testFilePath, "/vdir_quota/"+testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Rename("/vdir_quota/"+testFileName, "third_file")
+		if err == nil {
+			t.Error("rename exceeding the user quota must fail")
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get user: %v", err)
+		}
+		quota := user.FoldersQuota["/vdir_quota"]
+		if user.UsedQuotaFiles != 2 || quota.UsedQuotaFiles != 1 {
+			t.Errorf("unexpected quota, user files: %v folder files: %v", user.UsedQuotaFiles, quota.UsedQuotaFiles)
 		}
 	}
-	httpd.RemoveUser(user, http.StatusOK)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.Remove(testFilePath)
+	os.RemoveAll(mappedPath)
 	os.RemoveAll(user.GetHomeDir())
 }
 
 func TestRelativePaths(t *testing.T) {
 	user := getTestUser(true)
 	var path, rel string
-	filesystems := []vfs.Fs{vfs.NewOsFs("", user.GetHomeDir(), user.VirtualFolders)}
+	filesystems := []vfs.Fs{vfs.NewOsFs("", user.GetHomeDir(), nil)}
 	keyPrefix := strings.TrimPrefix(user.GetHomeDir(), "/") + "/"
 	s3config := vfs.S3FsConfig{
 		KeyPrefix: keyPrefix,
@@ -3397,8 +4930,19 @@ func TestRelativePaths(t *testing.T) {
 		KeyPrefix: keyPrefix,
 	}
 	gcsfs, _ := vfs.NewGCSFs("", user.GetHomeDir(), gcsConfig)
+	azBlobConfig := vfs.AzBlobFsConfig{
+		KeyPrefix: keyPrefix,
+	}
+	azBlobFs, _ := vfs.NewAzBlobFs("", user.GetHomeDir(), azBlobConfig)
+	sftpConfig := vfs.SFTPFsConfig{
+		Endpoint: sftpServerAddr,
+		Username: defaultUsername,
+		Password: kms.NewPlainSecret(defaultPassword),
+		Prefix:   user.GetHomeDir(),
+	}
+	sftpFs, _ := vfs.NewSFTPFs("", user.GetHomeDir(), sftpConfig)
 	if runtime.GOOS != "windows" {
-		filesystems = append(filesystems, s3fs, gcsfs)
+		filesystems = append(filesystems, s3fs, gcsfs, azBlobFs, sftpFs)
 	}
 	for _, fs := range filesystems {
 		path = filepath.Join(user.HomeDir, "/")
@@ -3458,7 +5002,7 @@ func TestResolvePaths(t *testing.T) {
 	user := getTestUser(true)
 	var path, resolved string
 	var err error
-	filesystems := []vfs.Fs{vfs.NewOsFs("", user.GetHomeDir(), user.VirtualFolders)}
+	filesystems := []vfs.Fs{vfs.NewOsFs("", user.GetHomeDir(), nil)}
 	keyPrefix := strings.TrimPrefix(user.GetHomeDir(), "/") + "/"
 	s3config := vfs.S3FsConfig{
 		KeyPrefix: keyPrefix,
@@ -3469,8 +5013,19 @@ func TestResolvePaths(t *testing.T) {
 		KeyPrefix: keyPrefix,
 	}
 	gcsfs, _ := vfs.NewGCSFs("", user.GetHomeDir(), gcsConfig)
+	azBlobConfig := vfs.AzBlobFsConfig{
+		KeyPrefix: keyPrefix,
+	}
+	azBlobFs, _ := vfs.NewAzBlobFs("", user.GetHomeDir(), azBlobConfig)
+	sftpConfig := vfs.SFTPFsConfig{
+		Endpoint: sftpServerAddr,
+		Username: defaultUsername,
+		Password: kms.NewPlainSecret(defaultPassword),
+		Prefix:   user.GetHomeDir(),
+	}
+	sftpFs, _ := vfs.NewSFTPFs("", user.GetHomeDir(), sftpConfig)
 	if runtime.GOOS != "windows" {
-		filesystems = append(filesystems, s3fs, gcsfs)
+		filesystems = append(filesystems, s3fs, gcsfs, azBlobFs, sftpFs)
 	}
 	for _, fs := range filesystems {
 		path = "/"
@@ -3518,12 +5073,14 @@ func TestVirtualRelativePaths(t *testing.T) {
 	user := getTestUser(true)
 	mappedPath := filepath.Join(os.TempDir(), "vdir")
 	vdirPath := "/vdir"
-	user.VirtualFolders = append(user.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: vdirPath,
-		MappedPath:  mappedPath,
-	})
+	virtualFolders := []vfs.VirtualFolder{
+		{
+			VirtualPath: vdirPath,
+			MappedPath:  mappedPath,
+		},
+	}
 	os.MkdirAll(mappedPath, 0777)
-	fs := vfs.NewOsFs("", user.GetHomeDir(), user.VirtualFolders)
+	fs := vfs.NewOsFs("", user.GetHomeDir(), virtualFolders)
 	rel := fs.GetRelativePath(mappedPath)
 	if rel != vdirPath {
 		t.Errorf("Unexpected relative path: %v", rel)
@@ -3551,12 +5108,14 @@ func TestResolveVirtualPaths(t *testing.T) {
 	user := getTestUser(true)
 	mappedPath := filepath.Join(os.TempDir(), "vdir")
 	vdirPath := "/vdir"
-	user.VirtualFolders = append(user.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: vdirPath,
-		MappedPath:  mappedPath,
-	})
+	virtualFolders := []vfs.VirtualFolder{
+		{
+			VirtualPath: vdirPath,
+			MappedPath:  mappedPath,
+		},
+	}
 	os.MkdirAll(mappedPath, 0777)
-	fs := vfs.NewOsFs("", user.GetHomeDir(), user.VirtualFolders)
+	fs := vfs.NewOsFs("", user.GetHomeDir(), virtualFolders)
 	osFs := fs.(*vfs.OsFs)
 	b, f := osFs.GetFsPaths("/vdir/a.txt")
 	if b != mappedPath {
@@ -4244,9 +5803,11 @@ func TestSCPVirtualFolders(t *testing.T) {
 	u := getTestUser(usePubKey)
 	mappedPath := filepath.Join(os.TempDir(), "vdir")
 	vdirPath := "/vdir"
-	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
-		VirtualPath: vdirPath,
-		MappedPath:  mappedPath,
+	u.VirtualFolders = append(u.VirtualFolders, dataprovider.VirtualFolder{
+		VirtualFolder: vfs.VirtualFolder{
+			VirtualPath: vdirPath,
+			MappedPath:  mappedPath,
+		},
 	})
 	os.MkdirAll(mappedPath, 0777)
 	user, _, err := httpd.AddUser(u, http.StatusOK)
@@ -4891,10 +6452,125 @@ func getSftpClientWithAddr(user dataprovider.User, usePubKey bool, addr string)
 	return sftpClient, err
 }
 
+func getServerHostKeyFingerprint() (string, error) {
+	var fingerprint string
+	config := &ssh.ClientConfig{
+		User: defaultUsername,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			fingerprint = ssh.FingerprintSHA256(key)
+			return nil
+		},
+		Auth: []ssh.AuthMethod{ssh.Password(defaultPassword)},
+	}
+	conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+	if err != nil {
+		return fingerprint, err
+	}
+	conn.Close()
+	return fingerprint, nil
+}
+
+func getTestCertificate(username string) (*ssh.Certificate, ssh.Signer, error) {
+	key, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		Serial:          1,
+		CertType:        ssh.UserCert,
+		KeyId:           "test cert",
+		ValidPrincipals: []string{username},
+		ValidAfter:      uint64(time.Now().Add(-1 * time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(1 * time.Hour).Unix()),
+	}
+	return cert, key, nil
+}
+
+// getCertSftpClient signs the given certificate with the trusted user CA and uses it to login
+func getCertSftpClient(user dataprovider.User, cert *ssh.Certificate, key ssh.Signer) (*sftp.Client, error) {
+	err := cert.SignCert(rand.Reader, userCASigner)
+	if err != nil {
+		return nil, err
+	}
+	certSigner, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User: user.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(certSigner)},
+	}
+	conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+	if err != nil {
+		return nil, err
+	}
+	return sftp.NewClient(conn)
+}
+
 func getSftpClient(user dataprovider.User, usePubKey bool) (*sftp.Client, error) {
 	return getSftpClientWithAddr(user, usePubKey, sftpServerAddr)
 }
 
+// getTOTPSftpClient answers to the password and passcode questions of the built-in keyboard interactive authentication
+func getTOTPSftpClient(user dataprovider.User, password, passcode string) (*sftp.Client, error) {
+	config := &ssh.ClientConfig{
+		User: user.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+		Auth: []ssh.AuthMethod{
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				if len(questions) == 1 && questions[0] == "Passcode: " {
+					return []string{passcode}, nil
+				}
+				return []string{password}, nil
+			}),
+		},
+	}
+	conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+	if err != nil {
+		return nil, err
+	}
+	return sftp.NewClient(conn)
+}
+
+// getTOTPPasscode returns the RFC 6238 passcode, with the default parameters, for the given time
+func getTOTPPasscode(secret string, t time.Time) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix())/30)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter) //nolint:errcheck
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// getMultiStepSftpClient logins using a public key followed by the given authentication method
+func getMultiStepSftpClient(user dataprovider.User, method ssh.AuthMethod) (*sftp.Client, error) {
+	key, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User: user.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(key), method},
+	}
+	conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+	if err != nil {
+		return nil, err
+	}
+	return sftp.NewClient(conn)
+}
+
 func getKeyboardInteractiveSftpClient(user dataprovider.User, answers []string) (*sftp.Client, error) {
 	var sftpClient *sftp.Client
 	config := &ssh.ClientConfig{
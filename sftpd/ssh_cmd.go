@@ -133,10 +133,14 @@ func (c *sshCommand) handleHashCommands() error {
 			c.connection.Log(logger.LevelInfo, logSenderSSH, "hash not allowed for file %#v", sshPath)
 			return c.sendErrorResponse(errPermissionDenied)
 		}
-		fsPath, err := c.connection.fs.ResolvePath(sshPath)
+		fs, fsPath, err := c.connection.resolvePath(sshPath)
 		if err != nil {
 			return c.sendErrorResponse(err)
 		}
+		// the file could be inside a virtual folder with its own filesystem
+		if !vfs.IsLocalOsFs(fs) {
+			return c.sendErrorResponse(errUnsupportedConfig)
+		}
 		if !c.connection.User.HasPerm(dataprovider.PermListItems, sshPath) {
 			return c.sendErrorResponse(errPermissionDenied)
 		}
@@ -448,13 +452,16 @@ func (c *sshCommand) sendExitStatus(err error) {
 	// for scp we notify single uploads/downloads
 	if err == nil && c.command != "scp" {
 		realPath := c.getDestPath()
+		fs := c.connection.fs
 		if len(realPath) > 0 {
-			p, err := c.connection.fs.ResolvePath(realPath)
+			var p string
+			var err error
+			fs, p, err = c.connection.resolvePath(realPath)
 			if err == nil {
 				realPath = p
 			}
 		}
-		go executeAction(operationSSHCmd, c.connection.User.Username, realPath, "", c.command, 0, vfs.IsLocalOsFs(c.connection.fs))
+		go executeAction(operationSSHCmd, c.connection.User.Username, realPath, "", c.command, 0, vfs.IsLocalOsFs(fs))
 	}
 }
 
@@ -31,6 +31,7 @@ type Transfer struct {
 	readerAt       *pipeat.PipeReaderAt
 	cancelFn       func()
 	path           string
+	sftpPath       string
 	start          time.Time
 	bytesSent      int64
 	bytesReceived  int64
@@ -99,7 +100,9 @@ func (t *Transfer) WriteAt(p []byte, off int64) (n int, err error) {
 	var written int
 	var e error
 	if t.writerAt != nil {
-		written, e = t.writerAt.WriteAt(p, off)
+		// the pipe is filled starting from offset 0, for resumed uploads the
+		// backend appends what it reads to the existing data
+		written, e = t.writerAt.WriteAt(p, off-t.minWriteOffset)
 	} else {
 		written, e = t.file.WriteAt(p, off)
 	}
@@ -185,7 +188,7 @@ func (t *Transfer) updateQuota(numFiles int) bool {
 		return false
 	}
 	if t.transferType == transferUpload && (numFiles != 0 || t.bytesReceived > 0) {
-		dataprovider.UpdateUserQuota(dataProvider, t.user, numFiles, t.bytesReceived-t.initialSize, false)
+		updateQuota(t.user, t.sftpPath, numFiles, t.bytesReceived-t.initialSize)
 		return true
 	}
 	return false
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+var ipLists = &ipListsManager{
+	lock: new(sync.RWMutex),
+}
+
+// IPListsConfig defines the server wide IP address lists.
+// Each entry can be a single IP address or a network in CIDR notation, for example "192.168.1.0/24".
+// The hosts in the deny list are rejected before authentication. The hosts in the allow list
+// are never rejected by the deny list and they are exempted from the defender and the connection limits
+type IPListsConfig struct {
+	// IP addresses and networks to allow
+	AllowList []string `json:"allow_list" mapstructure:"allow_list"`
+	// Path to a file containing additional IP addresses and networks to allow, one per line.
+	// The file is reloaded on SIGHUP
+	AllowListFile string `json:"allow_list_file" mapstructure:"allow_list_file"`
+	// IP addresses and networks to deny
+	DenyList []string `json:"deny_list" mapstructure:"deny_list"`
+	// Path to a file containing additional IP addresses and networks to deny, one per line.
+	// The file is reloaded on SIGHUP
+	DenyListFile string `json:"deny_list_file" mapstructure:"deny_list_file"`
+}
+
+type ipListsManager struct {
+	config    IPListsConfig
+	configDir string
+	allowList []*net.IPNet
+	denyList  []*net.IPNet
+	lock      *sync.RWMutex
+}
+
+func (m *ipListsManager) load() error {
+	allowList, err := parseIPList(m.config.AllowList, getIPListFilePath(m.config.AllowListFile, m.configDir))
+	if err != nil {
+		return err
+	}
+	denyList, err := parseIPList(m.config.DenyList, getIPListFilePath(m.config.DenyListFile, m.configDir))
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.allowList = allowList
+	m.denyList = denyList
+	logger.Debug(logSender, "", "IP lists loaded, allow list entries: %v deny list entries: %v", len(allowList),
+		len(denyList))
+	return nil
+}
+
+func (m *ipListsManager) isAllowListed(ip net.IP) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return isIPInNetworks(ip, m.allowList)
+}
+
+func (m *ipListsManager) isDenyListed(ip net.IP) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if isIPInNetworks(ip, m.allowList) {
+		return false
+	}
+	return isIPInNetworks(ip, m.denyList)
+}
+
+func isIPInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func getIPListFilePath(name, configDir string) string {
+	if len(name) == 0 {
+		return ""
+	}
+	if !filepath.IsAbs(name) {
+		return filepath.Join(configDir, name)
+	}
+	return name
+}
+
+// parseIPList parses the given entries and the entries inside the given file, if any.
+// Empty lines and lines starting with "#" are ignored inside the file
+func parseIPList(entries []string, filePath string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, entry := range entries {
+		n, err := parseIPListEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	if len(filePath) == 0 {
+		return result, nil
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to open IP list file %#v: %v", filePath, err)
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		n, err := parseIPListEntry(line)
+		if err != nil {
+			logger.Warn(logSender, "", "invalid entry in IP list file %#v: %v", filePath, err)
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, scanner.Err()
+}
+
+func parseIPListEntry(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %#v: %v", entry, err)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %#v", entry)
+	}
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// InitializeIPLists loads the server wide IP lists.
+// Relative file paths are resolved against the given configuration directory
+func InitializeIPLists(config IPListsConfig, configDir string) error {
+	m := &ipListsManager{
+		config:    config,
+		configDir: configDir,
+		lock:      new(sync.RWMutex),
+	}
+	if err := m.load(); err != nil {
+		return err
+	}
+	ipLists = m
+	return nil
+}
+
+// ReloadIPLists reloads the IP lists files, the configured lists are kept.
+// The new lists apply to new connections only, the existing sessions are not affected.
+// If the files cannot be loaded the current lists are kept
+func ReloadIPLists() error {
+	return ipLists.load()
+}
+
+// IsIPAllowListed returns true if the given IP address is inside the server wide allow list
+func IsIPAllowListed(ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	return ipLists.isAllowListed(parsedIP)
+}
+
+// IsIPDenyListed returns true if the given IP address is inside the server wide deny list
+// and not inside the allow list
+func IsIPDenyListed(ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	return ipLists.isDenyListed(parsedIP)
+}
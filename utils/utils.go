@@ -14,7 +14,6 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
-	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -117,6 +116,11 @@ func GetIPFromRemoteAddress(remoteAddress string) string {
 	return remoteAddress
 }
 
+// IsHTTPURL returns true if the given hook is an HTTP or HTTPS URL instead of a program path
+func IsHTTPURL(hook string) bool {
+	return strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://")
+}
+
 // NilIfEmpty returns nil if the input string is empty
 func NilIfEmpty(s string) *string {
 	if len(s) == 0 {
@@ -125,32 +129,7 @@ func NilIfEmpty(s string) *string {
 	return &s
 }
 
-// EncryptData encrypts data using the given key
-func EncryptData(data string) (string, error) {
-	var result string
-	key := make([]byte, 16)
-	if _, err := io.ReadFull(rand.Reader, key); err != nil {
-		return result, err
-	}
-	keyHex := hex.EncodeToString(key)
-	block, err := aes.NewCipher([]byte(keyHex))
-	if err != nil {
-		return result, err
-	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return result, err
-	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return result, err
-	}
-	ciphertext := gcm.Seal(nonce, nonce, []byte(data), nil)
-	result = fmt.Sprintf("$aes$%s$%x", keyHex, ciphertext)
-	return result, err
-}
-
-// RemoveDecryptionKey returns encrypted data without the decryption key
+// RemoveDecryptionKey returns data encrypted using the legacy format without the decryption key
 func RemoveDecryptionKey(encryptData string) string {
 	vals := strings.Split(encryptData, "$")
 	if len(vals) == 4 {
@@ -159,7 +138,9 @@ func RemoveDecryptionKey(encryptData string) string {
 	return encryptData
 }
 
-// DecryptData decrypts data encrypted using EncryptData
+// DecryptData decrypts data encrypted using the legacy format, the decryption key is stored
+// together with the encrypted data. It is only used to decrypt the secrets stored by
+// older SFTPGo versions, new secrets are encrypted using the kms package
 func DecryptData(data string) (string, error) {
 	var result string
 	vals := strings.Split(data, "$")
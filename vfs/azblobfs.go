@@ -0,0 +1,606 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/eikenb/pipeat"
+)
+
+const (
+	azureDefaultEndpoint  = "blob.core.windows.net"
+	azureEmulatorEndpoint = "127.0.0.1:10000"
+	azureCopyPollInterval = 100 * time.Millisecond
+)
+
+var (
+	azureAccessTiers = []string{"", string(azblob.AccessTierHot), string(azblob.AccessTierCool),
+		string(azblob.AccessTierArchive)}
+)
+
+// AzBlobFsConfig defines the configuration for Azure Blob Storage based filesystem
+type AzBlobFsConfig struct {
+	Container string `json:"container,omitempty"`
+	// Storage Account Name, leave blank to use SAS URL
+	AccountName string `json:"account_name,omitempty"`
+	// Storage Account Key leave blank to use SAS URL.
+	// The access key is stored encrypted inside the data provider
+	AccountKey kms.Secret `json:"account_key,omitempty"`
+	// Optional endpoint. Default is "blob.core.windows.net".
+	// If you use the emulator the endpoint must include the protocol,
+	// for example "http://127.0.0.1:10000"
+	Endpoint string `json:"endpoint,omitempty"`
+	// Shared access signature URL, leave blank if using account/key.
+	// The container name can be included in the URL or set using the container field
+	SASURL string `json:"sas_url,omitempty"`
+	// KeyPrefix is similar to a chroot directory for local filesystem.
+	// If specified the SFTP user will only see objects that starts with
+	// this prefix and so you can restrict access to a specific virtual
+	// folder. The prefix, if not empty, must not start with "/" and must
+	// end with "/".
+	// If empty the whole container contents will be available
+	KeyPrefix string `json:"key_prefix,omitempty"`
+	// The buffer size (in MB) to use for multipart uploads.
+	// If this value is set to zero, the default value (4MB) will be used.
+	// Please note that if the upload bandwidth between the SFTP client and SFTPGo is greater than
+	// the upload bandwidth between SFTPGo and Azure then the SFTP client have to wait for the upload
+	// of the last parts to Azure after it ends the file upload to SFTPGo, and it may time out.
+	// Keep this in mind if you customize these parameters.
+	UploadPartSize int64 `json:"upload_part_size,omitempty"`
+	// How many parts are uploaded in parallel
+	UploadConcurrency int `json:"upload_concurrency,omitempty"`
+	// Set to true if you use an Azure emulator such as Azurite
+	UseEmulator bool `json:"use_emulator,omitempty"`
+	// Blob Access Tier, leave blank to use the default account tier
+	AccessTier string `json:"access_tier,omitempty"`
+}
+
+// AzBlobFs is a Fs implementation for Azure Blob Storage.
+type AzBlobFs struct {
+	connectionID   string
+	localTempDir   string
+	config         AzBlobFsConfig
+	containerURL   azblob.ContainerURL
+	ctxTimeout     time.Duration
+	ctxLongTimeout time.Duration
+}
+
+// NewAzBlobFs returns an AzBlobFs object that allows to interact with Azure Blob Storage
+func NewAzBlobFs(connectionID, localTempDir string, config AzBlobFsConfig) (Fs, error) {
+	fs := AzBlobFs{
+		connectionID:   connectionID,
+		localTempDir:   localTempDir,
+		config:         config,
+		ctxTimeout:     30 * time.Second,
+		ctxLongTimeout: 300 * time.Second,
+	}
+	if err := ValidateAzBlobFsConfig(&fs.config); err != nil {
+		return fs, err
+	}
+	if fs.config.UploadPartSize == 0 {
+		fs.config.UploadPartSize = 4
+	}
+	fs.config.UploadPartSize *= 1024 * 1024
+	if fs.config.UploadConcurrency == 0 {
+		fs.config.UploadConcurrency = 2
+	}
+
+	if len(fs.config.SASURL) > 0 {
+		u, err := url.Parse(fs.config.SASURL)
+		if err != nil {
+			return fs, fmt.Errorf("invalid SAS URL: %v", err)
+		}
+		pipeline := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{})
+		parts := azblob.NewBlobURLParts(*u)
+		if len(parts.ContainerName) > 0 {
+			// the SAS URL is restricted to a single container
+			fs.config.Container = parts.ContainerName
+			fs.containerURL = azblob.NewContainerURL(*u, pipeline)
+		} else {
+			serviceURL := azblob.NewServiceURL(*u, pipeline)
+			fs.containerURL = serviceURL.NewContainerURL(fs.config.Container)
+		}
+		return fs, nil
+	}
+
+	if fs.config.AccountKey.IsEncrypted() {
+		if err := fs.config.AccountKey.Decrypt(); err != nil {
+			return fs, err
+		}
+	}
+	credential, err := azblob.NewSharedKeyCredential(fs.config.AccountName, fs.config.AccountKey.Payload)
+	if err != nil {
+		return fs, fmt.Errorf("invalid credentials: %v", err)
+	}
+	var u *url.URL
+	if fs.config.UseEmulator {
+		// for the emulator the account name is included in the path
+		endpoint := fs.config.Endpoint
+		if len(endpoint) == 0 {
+			endpoint = "http://" + azureEmulatorEndpoint
+		}
+		u, err = url.Parse(fmt.Sprintf("%s/%s", strings.TrimSuffix(endpoint, "/"), fs.config.AccountName))
+	} else {
+		endpoint := fs.config.Endpoint
+		if len(endpoint) == 0 {
+			endpoint = azureDefaultEndpoint
+		}
+		u, err = url.Parse(fmt.Sprintf("https://%s.%s", fs.config.AccountName, endpoint))
+	}
+	if err != nil {
+		return fs, fmt.Errorf("invalid endpoint: %v", err)
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	serviceURL := azblob.NewServiceURL(*u, pipeline)
+	fs.containerURL = serviceURL.NewContainerURL(fs.config.Container)
+	return fs, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs AzBlobFs) Name() string {
+	if len(fs.config.SASURL) > 0 {
+		return fmt.Sprintf("AzBlobFs SAS URL, container: %#v", fs.config.Container)
+	}
+	return fmt.Sprintf("AzBlobFs account: %#v, container: %#v", fs.config.AccountName, fs.config.Container)
+}
+
+// ConnectionID returns the SSH connection ID associated to this Fs implementation
+func (fs AzBlobFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs AzBlobFs) Stat(name string) (os.FileInfo, error) {
+	var result FileInfo
+	if len(name) == 0 || name == "." {
+		err := fs.checkIfContainerExists()
+		if err != nil {
+			return result, err
+		}
+		return NewFileInfo(name, true, 0, time.Time{}), nil
+	}
+	if fs.config.KeyPrefix == name+"/" {
+		return NewFileInfo(name, true, 0, time.Time{}), nil
+	}
+	prefix := fs.getPrefixForStat(name)
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listBlob, err := fs.containerURL.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{
+			Prefix: prefix,
+		})
+		if err != nil {
+			metrics.AzListObjectsCompleted(err)
+			return result, err
+		}
+		marker = listBlob.NextMarker
+		for _, blobPrefix := range listBlob.Segment.BlobPrefixes {
+			if fs.isEqual(blobPrefix.Name, name) {
+				metrics.AzListObjectsCompleted(nil)
+				return NewFileInfo(name, true, 0, time.Time{}), nil
+			}
+		}
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			if fs.isEqual(blobInfo.Name, name) {
+				isDir := strings.HasSuffix(blobInfo.Name, "/")
+				size := int64(0)
+				if blobInfo.Properties.ContentLength != nil {
+					size = *blobInfo.Properties.ContentLength
+				}
+				metrics.AzListObjectsCompleted(nil)
+				return NewFileInfo(name, isDir, size, blobInfo.Properties.LastModified), nil
+			}
+		}
+	}
+	metrics.AzListObjectsCompleted(nil)
+	return result, errors.New("404 no such file or directory")
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs AzBlobFs) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+// Open opens the named file for reading
+func (fs AzBlobFs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error) {
+	r, w, err := pipeat.AsyncWriterPipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	blobURL := fs.containerURL.NewBlobURL(name)
+	ctx, cancelFn := context.WithCancel(context.Background())
+	blobDownloadResponse, err := blobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false,
+		azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		r.Close()
+		w.Close()
+		cancelFn()
+		return nil, nil, nil, err
+	}
+	body := blobDownloadResponse.Body(azblob.RetryReaderOptions{
+		MaxRetryRequests: 3,
+	})
+	go func() {
+		defer cancelFn()
+		defer body.Close()
+		n, err := io.Copy(w, body)
+		w.CloseWithError(err)
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
+		metrics.AzTransferCompleted(n, 1, err)
+	}()
+	return nil, r, cancelFn, nil
+}
+
+// Create creates or opens the named file for writing
+func (fs AzBlobFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	blobURL := fs.containerURL.NewBlockBlobURL(name)
+	ctx, cancelFn := context.WithCancel(context.Background())
+	go func() {
+		defer cancelFn()
+		_, err := azblob.UploadStreamToBlockBlob(ctx, r, blobURL, azblob.UploadStreamToBlockBlobOptions{
+			BufferSize:     int(fs.config.UploadPartSize),
+			MaxBuffers:     fs.config.UploadConcurrency,
+			BlobAccessTier: azblob.AccessTierType(fs.config.AccessTier),
+		})
+		r.CloseWithError(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name,
+			r.GetReadedBytes(), err)
+		metrics.AzTransferCompleted(r.GetReadedBytes(), 0, err)
+	}()
+	return nil, w, cancelFn, nil
+}
+
+// Rename renames (moves) source to target.
+// We don't support renaming non empty directories since we should
+// rename all the contents too and this could take long time: think
+// about directories with thousands of files, for each file we should
+// execute a StartCopyFromURL call.
+func (fs AzBlobFs) Rename(source, target string) error {
+	if source == target {
+		return nil
+	}
+	fi, err := fs.Stat(source)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		contents, err := fs.ReadDir(source)
+		if err != nil {
+			return err
+		}
+		if len(contents) > 0 {
+			return fmt.Errorf("Cannot rename non empty directory: %#v", source)
+		}
+		if !strings.HasSuffix(source, "/") {
+			source += "/"
+		}
+		if !strings.HasSuffix(target, "/") {
+			target += "/"
+		}
+	}
+	dstBlobURL := fs.containerURL.NewBlobURL(target)
+	srcURL := fs.containerURL.NewBlobURL(source).URL()
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxLongTimeout))
+	defer cancelFn()
+
+	resp, err := dstBlobURL.StartCopyFromURL(ctx, srcURL, azblob.Metadata{}, azblob.ModifiedAccessConditions{},
+		azblob.BlobAccessConditions{}, azblob.AccessTierType(fs.config.AccessTier), nil)
+	if err != nil {
+		metrics.AzCopyObjectCompleted(err)
+		return err
+	}
+	// the copy is asynchronous, we need to wait for its completion before removing the source
+	copyStatus := resp.CopyStatus()
+	for copyStatus == azblob.CopyStatusPending {
+		select {
+		case <-ctx.Done():
+			metrics.AzCopyObjectCompleted(ctx.Err())
+			return ctx.Err()
+		case <-time.After(azureCopyPollInterval):
+		}
+		props, err := dstBlobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			metrics.AzCopyObjectCompleted(err)
+			return err
+		}
+		copyStatus = props.CopyStatus()
+	}
+	if copyStatus != azblob.CopyStatusSuccess {
+		err = fmt.Errorf("copy failed with status: %s", copyStatus)
+		metrics.AzCopyObjectCompleted(err)
+		return err
+	}
+	metrics.AzCopyObjectCompleted(nil)
+	return fs.Remove(source, fi.IsDir())
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs AzBlobFs) Remove(name string, isDir bool) error {
+	if isDir {
+		contents, err := fs.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(contents) > 0 {
+			return fmt.Errorf("Cannot remove non empty directory: %#v", name)
+		}
+		if !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+	}
+	blobBlockURL := fs.containerURL.NewBlockBlobURL(name)
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+	_, err := blobBlockURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	metrics.AzDeleteObjectCompleted(err)
+	return err
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs AzBlobFs) Mkdir(name string) error {
+	_, err := fs.Stat(name)
+	if !fs.IsNotExist(err) {
+		return err
+	}
+	if !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	_, w, _, err := fs.Create(name, 0)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// Symlink creates source as a symbolic link to target.
+func (AzBlobFs) Symlink(source, target string) error {
+	return errors.New("403 symlinks are not supported")
+}
+
+// Chown changes the numeric uid and gid of the named file.
+// Silently ignored.
+func (AzBlobFs) Chown(name string, uid int, gid int) error {
+	return nil
+}
+
+// Chmod changes the mode of the named file to mode.
+// Silently ignored.
+func (AzBlobFs) Chmod(name string, mode os.FileMode) error {
+	return nil
+}
+
+// Chtimes changes the access and modification times of the named file.
+// Silently ignored.
+func (AzBlobFs) Chtimes(name string, atime, mtime time.Time) error {
+	return errors.New("403 chtimes is not supported")
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs AzBlobFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	var result []os.FileInfo
+	// dirname must be already cleaned
+	prefix := ""
+	if len(dirname) > 0 && dirname != "." {
+		prefix = strings.TrimPrefix(dirname, "/")
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listBlob, err := fs.containerURL.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{
+			Prefix: prefix,
+		})
+		if err != nil {
+			metrics.AzListObjectsCompleted(err)
+			return result, err
+		}
+		marker = listBlob.NextMarker
+		for _, blobPrefix := range listBlob.Segment.BlobPrefixes {
+			name, _ := fs.resolve(blobPrefix.Name, prefix)
+			result = append(result, NewFileInfo(name, true, 0, time.Time{}))
+		}
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			name, isDir := fs.resolve(blobInfo.Name, prefix)
+			if len(name) == 0 {
+				continue
+			}
+			size := int64(0)
+			if blobInfo.Properties.ContentLength != nil {
+				size = *blobInfo.Properties.ContentLength
+			}
+			result = append(result, NewFileInfo(name, isDir, size, blobInfo.Properties.LastModified))
+		}
+	}
+	metrics.AzListObjectsCompleted(nil)
+	return result, nil
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported.
+// SFTP Resume is not supported on Azure Blob
+func (AzBlobFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// Azure Blob uploads are already atomic, we don't need to upload to a temporary
+// file
+func (AzBlobFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (AzBlobFs) IsNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		if storageErr.ServiceCode() == azblob.ServiceCodeBlobNotFound ||
+			storageErr.ServiceCode() == azblob.ServiceCodeContainerNotFound {
+			return true
+		}
+		if storageErr.Response() != nil && storageErr.Response().StatusCode == http.StatusNotFound {
+			return true
+		}
+	}
+	return strings.Contains(err.Error(), "404")
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (AzBlobFs) IsPermission(err error) bool {
+	if err == nil {
+		return false
+	}
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		if storageErr.Response() != nil {
+			code := storageErr.Response().StatusCode
+			if code == http.StatusForbidden || code == http.StatusUnauthorized {
+				return true
+			}
+		}
+	}
+	return strings.Contains(err.Error(), "403")
+}
+
+// CheckRootPath creates the specified root directory if it does not exists
+func (fs AzBlobFs) CheckRootPath(username string, uid int, gid int) bool {
+	// we need a local directory for temporary files
+	osFs := NewOsFs(fs.ConnectionID(), fs.localTempDir, nil)
+	osFs.CheckRootPath(username, uid, gid)
+	return fs.checkIfContainerExists() != nil
+}
+
+// ScanRootDirContents returns the number of files contained in the container,
+// and their size
+func (fs AzBlobFs) ScanRootDirContents() (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxLongTimeout))
+	defer cancelFn()
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listBlob, err := fs.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix: fs.config.KeyPrefix,
+		})
+		if err != nil {
+			metrics.AzListObjectsCompleted(err)
+			return numFiles, size, err
+		}
+		marker = listBlob.NextMarker
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			if strings.HasSuffix(blobInfo.Name, "/") {
+				// directory placeholder
+				continue
+			}
+			numFiles++
+			if blobInfo.Properties.ContentLength != nil {
+				size += *blobInfo.Properties.ContentLength
+			}
+		}
+	}
+	metrics.AzListObjectsCompleted(nil)
+	return numFiles, size, nil
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload.
+// Azure Blob uploads are already atomic, we never call this method
+func (AzBlobFs) GetAtomicUploadPath(name string) string {
+	return ""
+}
+
+// GetRelativePath returns the path for a file relative to the user's home dir.
+// This is the path as seen by SFTP users
+func (fs AzBlobFs) GetRelativePath(name string) string {
+	rel := path.Clean(name)
+	if rel == "." {
+		rel = ""
+	}
+	if !path.IsAbs(rel) {
+		rel = "/" + rel
+	}
+	if len(fs.config.KeyPrefix) > 0 {
+		if !strings.HasPrefix(rel, "/"+fs.config.KeyPrefix) {
+			rel = "/"
+		}
+		rel = path.Clean("/" + strings.TrimPrefix(rel, "/"+fs.config.KeyPrefix))
+	}
+	return rel
+}
+
+// Join joins any number of path elements into a single path
+func (AzBlobFs) Join(elem ...string) string {
+	return strings.TrimPrefix(path.Join(elem...), "/")
+}
+
+// ResolvePath returns the matching filesystem path for the specified sftp path
+func (fs AzBlobFs) ResolvePath(sftpPath string) (string, error) {
+	if !path.IsAbs(sftpPath) {
+		sftpPath = path.Clean("/" + sftpPath)
+	}
+	return fs.Join(fs.config.KeyPrefix, strings.TrimPrefix(sftpPath, "/")), nil
+}
+
+func (fs *AzBlobFs) resolve(name string, prefix string) (string, bool) {
+	result := strings.TrimPrefix(name, prefix)
+	isDir := strings.HasSuffix(result, "/")
+	if isDir {
+		result = strings.TrimSuffix(result, "/")
+	}
+	return result, isDir
+}
+
+func (fs *AzBlobFs) isEqual(key string, sftpName string) bool {
+	if key == sftpName {
+		return true
+	}
+	if key == sftpName+"/" {
+		return true
+	}
+	if key+"/" == sftpName {
+		return true
+	}
+	return false
+}
+
+func (fs *AzBlobFs) checkIfContainerExists() error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+	_, err := fs.containerURL.GetProperties(ctx, azblob.LeaseAccessConditions{})
+	metrics.AzHeadContainerCompleted(err)
+	return err
+}
+
+func (fs *AzBlobFs) getPrefixForStat(name string) string {
+	prefix := path.Dir(name)
+	if prefix == "/" || prefix == "." || len(prefix) == 0 {
+		prefix = ""
+	} else {
+		prefix = strings.TrimPrefix(prefix, "/")
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+	}
+	return prefix
+}
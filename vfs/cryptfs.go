@@ -0,0 +1,327 @@
+package vfs
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/eikenb/pipeat"
+	"github.com/minio/sio"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	cryptFsName = "cryptfs"
+	// each encrypted file starts with a version byte followed by a random nonce,
+	// the nonce is used to derive a per file key from the passphrase
+	cryptFsVersion   = 1
+	cryptFsNonceLen  = 32
+	cryptFsHeaderLen = 1 + cryptFsNonceLen
+)
+
+var errInvalidCryptFsHeader = errors.New("invalid encrypted file header")
+
+// CryptFsConfig defines the configuration for the client side encryption.
+// If the passphrase is not empty the files are encrypted before sending them
+// to the configured storage backend
+type CryptFsConfig struct {
+	// Passphrase used to derive the encryption keys. It is stored encrypted inside the
+	// data provider. If you change or lose it the existing files cannot be decrypted
+	Passphrase kms.Secret `json:"passphrase,omitempty"`
+}
+
+// CryptFs is a Fs decorator that encrypts the file contents using the DARE
+// streaming format before storing them inside the wrapped Fs.
+// File names and directory structure are not encrypted
+type CryptFs struct {
+	Fs
+	localTempDir string
+	passphrase   []byte
+}
+
+// NewCryptFs returns a CryptFs that transparently encrypts the files stored
+// inside the given Fs
+func NewCryptFs(fs Fs, localTempDir string, config CryptFsConfig) (Fs, error) {
+	passphrase := config.Passphrase
+	if passphrase.IsEncrypted() {
+		if err := passphrase.Decrypt(); err != nil {
+			return nil, err
+		}
+	}
+	if !passphrase.IsPlain() {
+		return nil, errors.New("the passphrase cannot be empty")
+	}
+	return CryptFs{
+		Fs:           fs,
+		localTempDir: localTempDir,
+		passphrase:   []byte(passphrase.Payload),
+	}, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs CryptFs) Name() string {
+	return fmt.Sprintf("%v %v", cryptFsName, fs.Fs.Name())
+}
+
+// Stat returns a FileInfo describing the named file, the size is the plain text one
+func (fs CryptFs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return newCryptedFileInfo(info), nil
+}
+
+// Lstat returns a FileInfo describing the named file, the size is the plain text one
+func (fs CryptFs) Lstat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return newCryptedFileInfo(info), nil
+}
+
+// Open opens the named file for reading.
+// The file is decrypted in background and the plain text is written to a pipe,
+// so a reader can access any offset once it is decrypted
+func (fs CryptFs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error) {
+	file, reader, cancelFn, err := fs.Fs.Open(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var src io.ReadCloser
+	if file != nil {
+		src = file
+	} else {
+		src = reader
+	}
+	r, w, err := pipeat.AsyncWriterPipeInDir(fs.localTempDir)
+	if err != nil {
+		if cancelFn != nil {
+			cancelFn()
+		}
+		src.Close()
+		return nil, nil, nil, err
+	}
+	go func() {
+		var n int64
+		var err error
+		if file != nil {
+			n, err = fs.decrypt(w, file)
+		} else {
+			n, err = fs.decrypt(w, newPipeReader(reader))
+		}
+		w.CloseWithError(err)
+		src.Close()
+		fsLog(fs, logger.LevelDebug, "decryption completed, path: %#v size: %v, err: %v", name, n, err)
+	}()
+	return nil, r, cancelFn, nil
+}
+
+// Create creates or truncates the named file for writing.
+// The data written to the returned pipe are encrypted in background and
+// stored inside the wrapped Fs. The flag is ignored: the whole file is always
+// written again since an encrypted stream cannot be modified in place
+func (fs CryptFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+	file, writer, cancelFn, err := fs.Fs.Create(name, 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		if cancelFn != nil {
+			cancelFn()
+		}
+		if file != nil {
+			file.Close()
+		} else {
+			writer.CloseWithError(err)
+		}
+		return nil, nil, nil, err
+	}
+	go func() {
+		var n int64
+		var err error
+		if file != nil {
+			n, err = fs.encrypt(file, newPipeReader(r))
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		} else {
+			n, err = fs.encrypt(writer, newPipeReader(r))
+			// for a synchronous pipe this waits until the wrapped Fs reads all the data
+			writer.CloseWithError(err) //nolint:errcheck
+			if readErr := writer.WaitForReader(); err == nil && readErr != io.EOF {
+				err = readErr
+			}
+		}
+		r.CloseWithError(err)
+		fsLog(fs, logger.LevelDebug, "encryption completed, path: %#v, written bytes: %v, err: %v", name, n, err)
+	}()
+	return nil, w, cancelFn, nil
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries with their plain text sizes
+func (fs CryptFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	files, err := fs.Fs.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]os.FileInfo, 0, len(files))
+	for _, info := range files {
+		result = append(result, newCryptedFileInfo(info))
+	}
+	return result, nil
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported.
+// A DARE stream cannot be extended without decrypting it, so resume is
+// not supported for any wrapped Fs
+func (CryptFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// Atomic uploads rename the uploaded *os.File, CryptFs never returns one.
+// An interrupted upload leaves a truncated DARE stream that cannot be decrypted
+func (CryptFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their plain text size
+func (fs CryptFs) ScanRootDirContents() (int, int64, error) {
+	rootPath, err := fs.ResolvePath("/")
+	if err != nil {
+		return 0, 0, err
+	}
+	return fs.scanDirContents(rootPath)
+}
+
+func (fs CryptFs) scanDirContents(dirPath string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	files, err := fs.ReadDir(dirPath)
+	if err != nil {
+		return numFiles, size, err
+	}
+	for _, info := range files {
+		if info.IsDir() {
+			n, s, err := fs.scanDirContents(fs.Join(dirPath, info.Name()))
+			if err != nil {
+				return numFiles, size, err
+			}
+			numFiles += n
+			size += s
+		} else if info.Mode().IsRegular() {
+			numFiles++
+			size += info.Size()
+		}
+	}
+	return numFiles, size, nil
+}
+
+func (fs CryptFs) getSIOConfig(nonce []byte) (sio.Config, error) {
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, fs.passphrase, nonce, nil)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return sio.Config{}, err
+	}
+	return sio.Config{
+		MinVersion: sio.Version20,
+		MaxVersion: sio.Version20,
+		Key:        key,
+	}, nil
+}
+
+// encrypt writes the file header and the encrypted data read from src to dst
+func (fs CryptFs) encrypt(dst io.Writer, src io.Reader) (int64, error) {
+	header := make([]byte, cryptFsHeaderLen)
+	header[0] = cryptFsVersion
+	if _, err := io.ReadFull(rand.Reader, header[1:]); err != nil {
+		return 0, err
+	}
+	config, err := fs.getSIOConfig(header[1:])
+	if err != nil {
+		return 0, err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return 0, err
+	}
+	n, err := sio.Encrypt(dst, src, config)
+	return n + cryptFsHeaderLen, err
+}
+
+// decrypt reads the file header from src and writes the decrypted data to dst
+func (fs CryptFs) decrypt(dst io.Writer, src io.Reader) (int64, error) {
+	header := make([]byte, cryptFsHeaderLen)
+	if _, err := io.ReadFull(src, header); err != nil {
+		if err == io.EOF {
+			// an empty file, for example a file created and never written
+			return 0, nil
+		}
+		return 0, err
+	}
+	if header[0] != cryptFsVersion {
+		return 0, errInvalidCryptFsHeader
+	}
+	config, err := fs.getSIOConfig(header[1:])
+	if err != nil {
+		return 0, err
+	}
+	// an empty plain text produces an empty DARE stream
+	reader := bufio.NewReader(src)
+	if _, err = reader.Peek(1); err == io.EOF {
+		return 0, nil
+	}
+	return sio.Decrypt(dst, reader, config)
+}
+
+// newPipeReader returns a reader that reads the pipe sequentially using ReadAt.
+// PipeReaderAt.Read does not advance the read offset if it returns data together
+// with io.EOF, the data would be read again after an io.ReadFull
+func newPipeReader(r *pipeat.PipeReaderAt) io.Reader {
+	return io.NewSectionReader(r, 0, math.MaxInt64)
+}
+
+// cryptedFileInfo reports the plain text size for a file stored encrypted
+type cryptedFileInfo struct {
+	os.FileInfo
+	plainSize int64
+}
+
+func newCryptedFileInfo(info os.FileInfo) os.FileInfo {
+	if !info.Mode().IsRegular() {
+		return info
+	}
+	return cryptedFileInfo{
+		FileInfo:  info,
+		plainSize: getCryptFsPlainSize(info.Size()),
+	}
+}
+
+// Size returns the plain text size
+func (fi cryptedFileInfo) Size() int64 {
+	return fi.plainSize
+}
+
+// getCryptFsPlainSize returns the plain text size for the given encrypted size.
+// Files still being written can have an invalid size, 0 is returned in this case
+func getCryptFsPlainSize(size int64) int64 {
+	if size <= cryptFsHeaderLen {
+		return 0
+	}
+	plainSize, err := sio.DecryptedSize(uint64(size - cryptFsHeaderLen))
+	if err != nil {
+		return 0
+	}
+	return int64(plainSize)
+}
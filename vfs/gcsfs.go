@@ -2,6 +2,7 @@ package vfs
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/metrics"
 	"github.com/eikenb/pipeat"
@@ -35,11 +37,13 @@ type GCSFsConfig struct {
 	// folder. The prefix, if not empty, must not start with "/" and must
 	// end with "/".
 	// If empty the whole bucket contents will be available
-	KeyPrefix            string `json:"key_prefix,omitempty"`
-	CredentialFile       string `json:"-"`
-	Credentials          string `json:"credentials,omitempty"`
-	AutomaticCredentials int    `json:"automatic_credentials,omitempty"`
-	StorageClass         string `json:"storage_class,omitempty"`
+	KeyPrefix      string `json:"key_prefix,omitempty"`
+	CredentialFile string `json:"-"`
+	// Base64 encoded JSON credentials, if empty the credentials are read from CredentialFile.
+	// The credentials included in the dumps are encrypted
+	Credentials          kms.Secret `json:"credentials,omitempty"`
+	AutomaticCredentials int        `json:"automatic_credentials,omitempty"`
+	StorageClass         string     `json:"storage_class,omitempty"`
 }
 
 // GCSFs is a Fs implementation for Google Cloud Storage.
@@ -68,6 +72,18 @@ func NewGCSFs(connectionID, localTempDir string, config GCSFsConfig) (Fs, error)
 	ctx := context.Background()
 	if fs.config.AutomaticCredentials > 0 {
 		fs.svc, err = storage.NewClient(ctx)
+	} else if !fs.config.Credentials.IsEmpty() {
+		if fs.config.Credentials.IsEncrypted() {
+			if err = fs.config.Credentials.Decrypt(); err != nil {
+				return fs, err
+			}
+		}
+		var credentials []byte
+		credentials, err = base64.StdEncoding.DecodeString(fs.config.Credentials.Payload)
+		if err != nil {
+			return fs, fmt.Errorf("invalid credentials: %v", err)
+		}
+		fs.svc, err = storage.NewClient(ctx, option.WithCredentialsJSON(credentials))
 	} else {
 		fs.svc, err = storage.NewClient(ctx, option.WithCredentialsFile(fs.config.CredentialFile))
 	}
@@ -170,23 +170,11 @@ func (fs OsFs) CheckRootPath(username string, uid int, gid int) bool {
 	return (err == nil)
 }
 
-// ScanRootDirContents returns the number of files contained in a directory and
-// their size
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their size. The mapped paths are not included, the virtual
+// folders have their own quota
 func (fs OsFs) ScanRootDirContents() (int, int64, error) {
-	numFiles, size, err := fs.getDirSize(fs.rootDir)
-	for _, v := range fs.virtualFolders {
-		num, s, err := fs.getDirSize(v.MappedPath)
-		if err != nil {
-			if fs.IsNotExist(err) {
-				fsLog(fs, logger.LevelWarn, "unable to scan contents for not existent mapped path: %#v", v.MappedPath)
-				continue
-			}
-			return numFiles, size, err
-		}
-		numFiles += num
-		size += s
-	}
-	return numFiles, size, err
+	return fs.getDirSize(fs.rootDir)
 }
 
 // GetAtomicUploadPath returns the path to use for an atomic upload
@@ -0,0 +1,553 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/eikenb/pipeat"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sftpFsName = "sftpfs"
+	// idle connections without active transfers are closed after this timeout
+	sftpConnectionIdleTimeout    = 5 * time.Minute
+	sftpConnectionsCheckInterval = time.Minute
+)
+
+var (
+	sftpConnections     = sftpConnectionsCache{items: make(map[string]*sftpConnection)}
+	sftpIdleCheckerOnce sync.Once
+)
+
+// SFTPFsConfig defines the configuration for SFTP based filesystem
+type SFTPFsConfig struct {
+	// Endpoint is the remote SFTP server address as host:port
+	Endpoint string `json:"endpoint,omitempty"`
+	Username string `json:"username,omitempty"`
+	// Password and PrivateKey are stored encrypted inside the data provider.
+	// At least one of them is required
+	Password   kms.Secret `json:"password,omitempty"`
+	PrivateKey kms.Secret `json:"private_key,omitempty"`
+	// SHA256 fingerprints, in the format printed by ssh-keygen -l, allowed for the
+	// remote host key. If empty any host key is accepted
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	// Prefix is similar to a chroot directory for local filesystem.
+	// If specified the SFTP user will only see contents inside this
+	// remote absolute path. If empty "/" is assumed
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// SFTPFs is a Fs implementation for SFTP backends.
+// The connections to the remote server are shared between the sessions
+// using the same configuration
+type SFTPFs struct {
+	connectionID string
+	localTempDir string
+	config       SFTPFsConfig
+	conn         *sftpConnection
+}
+
+// NewSFTPFs returns an SFTPFs object that allows to interact with a remote SFTP server.
+// The connection is established when needed
+func NewSFTPFs(connectionID, localTempDir string, config SFTPFsConfig) (Fs, error) {
+	fs := SFTPFs{
+		connectionID: connectionID,
+		localTempDir: localTempDir,
+		config:       config,
+	}
+	if err := ValidateSFTPFsConfig(&fs.config); err != nil {
+		return fs, err
+	}
+	if fs.config.Password.IsEncrypted() {
+		if err := fs.config.Password.Decrypt(); err != nil {
+			return fs, err
+		}
+	}
+	if fs.config.PrivateKey.IsEncrypted() {
+		if err := fs.config.PrivateKey.Decrypt(); err != nil {
+			return fs, err
+		}
+	}
+	fs.conn = sftpConnections.get(fs.config)
+	return fs, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs SFTPFs) Name() string {
+	return fmt.Sprintf("%v %#v@%#v", sftpFsName, fs.config.Username, fs.config.Endpoint)
+}
+
+// ConnectionID returns the SSH connection ID associated to this Fs implementation
+func (fs SFTPFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs SFTPFs) Stat(name string) (os.FileInfo, error) {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Stat(name)
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs SFTPFs) Lstat(name string) (os.FileInfo, error) {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Lstat(name)
+}
+
+// Open opens the named file for reading
+func (fs SFTPFs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error) {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f, err := client.Open(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.AsyncWriterPipeInDir(fs.localTempDir)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	fs.conn.addTransfer()
+	go func() {
+		defer fs.conn.removeTransfer()
+		n, err := io.Copy(w, f)
+		w.CloseWithError(err)
+		f.Close()
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
+	}()
+	return nil, r, func() {
+		// closing the remote file stops the copy
+		f.Close()
+	}, nil
+}
+
+// Create creates or opens the named file for writing.
+// If flag includes os.O_APPEND the data are appended to the existing
+// remote file, this is used to resume uploads
+func (fs SFTPFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if flag == 0 {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	var initialSize int64
+	if flag&os.O_APPEND != 0 {
+		// not all servers honor the append flag so we explicitly start writing
+		// at the end of the file. We stat the path before opening it: some
+		// servers, for example SFTPGo itself with atomic uploads, cannot stat
+		// the open handle
+		info, err := client.Stat(name)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		initialSize = info.Size()
+	}
+	f, err := client.OpenFile(name, flag)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err = f.Seek(initialSize, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	fs.conn.addTransfer()
+	go func() {
+		defer fs.conn.removeTransfer()
+		n, err := io.Copy(f, r)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		r.CloseWithError(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
+	}()
+	return nil, w, func() {
+		f.Close()
+	}, nil
+}
+
+// Rename renames (moves) source to target.
+// The posix-rename@openssh.com extension is used if supported, so an
+// existing target file is replaced as for local filesystem
+func (fs SFTPFs) Rename(source, target string) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	if err = client.PosixRename(source, target); err != nil {
+		fsLog(fs, logger.LevelDebug, "posix rename failed, source: %#v target: %#v, err: %v, trying a standard rename",
+			source, target, err)
+		return client.Rename(source, target)
+	}
+	return nil
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs SFTPFs) Remove(name string, isDir bool) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	if isDir {
+		return client.RemoveDirectory(name)
+	}
+	return client.Remove(name)
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs SFTPFs) Mkdir(name string) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	return client.Mkdir(name)
+}
+
+// Symlink creates source as a symbolic link to target.
+func (fs SFTPFs) Symlink(source, target string) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	return client.Symlink(source, target)
+}
+
+// Chown changes the numeric uid and gid of the named file.
+func (fs SFTPFs) Chown(name string, uid int, gid int) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	return client.Chown(name, uid, gid)
+}
+
+// Chmod changes the mode of the named file to mode.
+func (fs SFTPFs) Chmod(name string, mode os.FileMode) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	return client.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (fs SFTPFs) Chtimes(name string, atime, mtime time.Time) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	return client.Chtimes(name, atime, mtime)
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs SFTPFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.ReadDir(dirname)
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported.
+func (SFTPFs) IsUploadResumeSupported() bool {
+	return true
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// The uploads are streamed to the remote server and the temporary
+// file cannot be renamed from the local side
+func (SFTPFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (SFTPFs) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (SFTPFs) IsPermission(err error) bool {
+	if os.IsPermission(err) {
+		return true
+	}
+	if statusErr, ok := err.(*sftp.StatusError); ok {
+		// SSH_FX_PERMISSION_DENIED
+		return statusErr.Code == 3
+	}
+	return false
+}
+
+// CheckRootPath creates the specified root directory if it does not exists
+func (fs SFTPFs) CheckRootPath(username string, uid int, gid int) bool {
+	// we need a local directory for temporary files
+	osFs := NewOsFs(fs.ConnectionID(), fs.localTempDir, nil)
+	osFs.CheckRootPath(username, uid, gid)
+	if fs.config.Prefix == "/" {
+		return true
+	}
+	client, err := fs.conn.getClient()
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to check the root path %#v: %v", fs.config.Prefix, err)
+		return false
+	}
+	if err = client.MkdirAll(fs.config.Prefix); err != nil {
+		fsLog(fs, logger.LevelWarn, "error creating root directory %#v for user %#v: %v", fs.config.Prefix, username, err)
+		return false
+	}
+	return true
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their size
+func (fs SFTPFs) ScanRootDirContents() (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return numFiles, size, err
+	}
+	walker := client.Walk(fs.config.Prefix)
+	for walker.Step() {
+		if err = walker.Err(); err != nil {
+			return numFiles, size, err
+		}
+		if walker.Stat().Mode().IsRegular() {
+			size += walker.Stat().Size()
+			numFiles++
+		}
+	}
+	return numFiles, size, nil
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload.
+// SFTPFs does not support atomic uploads, we never call this method
+func (SFTPFs) GetAtomicUploadPath(name string) string {
+	return ""
+}
+
+// GetRelativePath returns the path for a file relative to the user's home dir.
+// This is the path as seen by SFTP users
+func (fs SFTPFs) GetRelativePath(name string) string {
+	rel := path.Clean(name)
+	if rel == "." {
+		rel = ""
+	}
+	if !path.IsAbs(rel) {
+		rel = "/" + rel
+	}
+	if fs.config.Prefix != "/" {
+		if rel != fs.config.Prefix && !strings.HasPrefix(rel, fs.config.Prefix+"/") {
+			rel = "/"
+		}
+		rel = path.Clean("/" + strings.TrimPrefix(rel, fs.config.Prefix))
+	}
+	return rel
+}
+
+// Join joins any number of path elements into a single path
+func (SFTPFs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// ResolvePath returns the matching filesystem path for the specified sftp path
+func (fs SFTPFs) ResolvePath(sftpPath string) (string, error) {
+	if !path.IsAbs(sftpPath) {
+		sftpPath = path.Clean("/" + sftpPath)
+	}
+	return path.Join(fs.config.Prefix, sftpPath), nil
+}
+
+// sftpConnection is a connection to a remote SFTP server shared between
+// all the SFTPFs instances with the same configuration
+type sftpConnection struct {
+	sync.Mutex
+	config          SFTPFsConfig
+	sshClient       *ssh.Client
+	sftpClient      *sftp.Client
+	activeTransfers int
+	lastActivity    time.Time
+}
+
+func (c *sftpConnection) getClient() (*sftp.Client, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.lastActivity = time.Now()
+	if c.sftpClient != nil {
+		return c.sftpClient, nil
+	}
+	if err := c.openConnection(); err != nil {
+		logger.Warn(sftpFsName, "", "unable to connect to %#v as user %#v: %v", c.config.Endpoint, c.config.Username, err)
+		return nil, err
+	}
+	return c.sftpClient, nil
+}
+
+func (c *sftpConnection) openConnection() error {
+	clientConfig := &ssh.ClientConfig{
+		User: c.config.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if len(c.config.Fingerprints) == 0 {
+				return nil
+			}
+			fp := ssh.FingerprintSHA256(key)
+			if utils.IsStringInSlice(fp, c.config.Fingerprints) {
+				return nil
+			}
+			return fmt.Errorf("invalid host key fingerprint %#v", fp)
+		},
+		Timeout: 10 * time.Second,
+	}
+	if !c.config.PrivateKey.IsEmpty() {
+		signer, err := ssh.ParsePrivateKey([]byte(c.config.PrivateKey.Payload))
+		if err != nil {
+			return fmt.Errorf("invalid private key: %v", err)
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signer))
+	}
+	if !c.config.Password.IsEmpty() {
+		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(c.config.Password.Payload))
+	}
+	sshClient, err := ssh.Dial("tcp", c.config.Endpoint, clientConfig)
+	if err != nil {
+		return err
+	}
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return err
+	}
+	c.sshClient = sshClient
+	c.sftpClient = sftpClient
+	go c.wait(sshClient)
+	logger.Debug(sftpFsName, "", "connected to %#v as user %#v", c.config.Endpoint, c.config.Username)
+	return nil
+}
+
+// wait resets the connection when the remote server closes it,
+// the next request will open a new one
+func (c *sftpConnection) wait(sshClient *ssh.Client) {
+	err := sshClient.Wait()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.sshClient == sshClient {
+		logger.Debug(sftpFsName, "", "connection to %#v closed: %v", c.config.Endpoint, err)
+		c.sftpClient.Close()
+		c.sftpClient = nil
+		c.sshClient = nil
+	}
+}
+
+func (c *sftpConnection) addTransfer() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.activeTransfers++
+	c.lastActivity = time.Now()
+}
+
+func (c *sftpConnection) removeTransfer() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.activeTransfers--
+	c.lastActivity = time.Now()
+}
+
+// closeIfIdle closes the connection if there are no active transfers and
+// no requests were done in the last idleTimeout
+func (c *sftpConnection) closeIfIdle(idleTimeout time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.sshClient == nil || c.activeTransfers > 0 || time.Since(c.lastActivity) < idleTimeout {
+		return
+	}
+	logger.Debug(sftpFsName, "", "closing idle connection to %#v", c.config.Endpoint)
+	c.sftpClient.Close()
+	c.sshClient.Close()
+	c.sftpClient = nil
+	c.sshClient = nil
+}
+
+type sftpConnectionsCache struct {
+	sync.Mutex
+	items map[string]*sftpConnection
+}
+
+// get returns the shared connection for the given config, a new connection
+// is added to the cache if needed
+func (c *sftpConnectionsCache) get(config SFTPFsConfig) *sftpConnection {
+	sftpIdleCheckerOnce.Do(func() {
+		go c.checkIdleConnections()
+	})
+	key := getSFTPConnectionKey(config)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if conn, ok := c.items[key]; ok {
+		return conn
+	}
+	conn := &sftpConnection{
+		config:       config,
+		lastActivity: time.Now(),
+	}
+	c.items[key] = conn
+	return conn
+}
+
+func (c *sftpConnectionsCache) checkIdleConnections() {
+	for range time.Tick(sftpConnectionsCheckInterval) {
+		c.Lock()
+		for _, conn := range c.items {
+			conn.closeIfIdle(sftpConnectionIdleTimeout)
+		}
+		c.Unlock()
+	}
+}
+
+// getSFTPConnectionKey returns a key that identifies the remote account,
+// the prefix is not included so users with different prefixes on the same
+// account share the connection
+func getSFTPConnectionKey(config SFTPFsConfig) string {
+	h := sha256.New()
+	for _, v := range []string{config.Endpoint, config.Username, config.Password.Payload, config.PrivateKey.Payload,
+		strings.Join(config.Fingerprints, ",")} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -4,6 +4,8 @@ package vfs
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path"
 	"runtime"
@@ -11,6 +13,7 @@ import (
 	"time"
 
 	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
 	"github.com/eikenb/pipeat"
 	"github.com/pkg/sftp"
 )
@@ -88,12 +91,15 @@ func ValidateS3FsConfig(config *S3FsConfig) error {
 	if len(config.Region) == 0 {
 		return errors.New("region cannot be empty")
 	}
-	if len(config.AccessKey) == 0 && len(config.AccessSecret) > 0 {
+	if len(config.AccessKey) == 0 && !config.AccessSecret.IsEmpty() {
 		return errors.New("access_key cannot be empty with access_secret not empty")
 	}
-	if len(config.AccessSecret) == 0 && len(config.AccessKey) > 0 {
+	if config.AccessSecret.IsEmpty() && len(config.AccessKey) > 0 {
 		return errors.New("access_secret cannot be empty with access_key not empty")
 	}
+	if err := config.AccessSecret.Validate(); err != nil {
+		return fmt.Errorf("invalid access_secret: %v", err)
+	}
 	if len(config.KeyPrefix) > 0 {
 		if strings.HasPrefix(config.KeyPrefix, "/") {
 			return errors.New("key_prefix cannot start with /")
@@ -126,7 +132,10 @@ func ValidateGCSFsConfig(config *GCSFsConfig, credentialsFilePath string) error
 			config.KeyPrefix += "/"
 		}
 	}
-	if len(config.Credentials) == 0 && config.AutomaticCredentials == 0 {
+	if err := config.Credentials.Validate(); err != nil {
+		return fmt.Errorf("invalid credentials: %v", err)
+	}
+	if config.Credentials.IsEmpty() && config.AutomaticCredentials == 0 {
 		fi, err := os.Stat(credentialsFilePath)
 		if err != nil {
 			return fmt.Errorf("invalid credentials %v", err)
@@ -138,14 +147,109 @@ func ValidateGCSFsConfig(config *GCSFsConfig, credentialsFilePath string) error
 	return nil
 }
 
+// ValidateAzBlobFsConfig returns nil if the specified Azure Blob config is valid, otherwise an error
+func ValidateAzBlobFsConfig(config *AzBlobFsConfig) error {
+	if len(config.SASURL) > 0 {
+		u, err := url.Parse(config.SASURL)
+		if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return fmt.Errorf("invalid sas_url %#v", config.SASURL)
+		}
+		if len(config.Container) == 0 && len(strings.Trim(u.Path, "/")) == 0 {
+			return errors.New("container cannot be empty if the sas_url does not include a container")
+		}
+	} else {
+		if len(config.Container) == 0 {
+			return errors.New("container cannot be empty")
+		}
+		if len(config.AccountName) == 0 {
+			return errors.New("account_name cannot be empty with sas_url empty")
+		}
+		if config.AccountKey.IsEmpty() {
+			return errors.New("account_key cannot be empty with sas_url empty")
+		}
+		if err := config.AccountKey.Validate(); err != nil {
+			return fmt.Errorf("invalid account_key: %v", err)
+		}
+	}
+	if len(config.KeyPrefix) > 0 {
+		if strings.HasPrefix(config.KeyPrefix, "/") {
+			return errors.New("key_prefix cannot start with /")
+		}
+		config.KeyPrefix = path.Clean(config.KeyPrefix)
+		if !strings.HasSuffix(config.KeyPrefix, "/") {
+			config.KeyPrefix += "/"
+		}
+	}
+	if config.UploadPartSize < 0 || config.UploadPartSize > 100 {
+		return fmt.Errorf("invalid upload part size: %v, it must be between 0 and 100 (MB)", config.UploadPartSize)
+	}
+	if config.UploadConcurrency < 0 || config.UploadConcurrency > 64 {
+		return fmt.Errorf("invalid upload concurrency: %v, it must be between 0 and 64", config.UploadConcurrency)
+	}
+	if !utils.IsStringInSlice(config.AccessTier, azureAccessTiers) {
+		return fmt.Errorf("invalid access tier %#v, valid values: Hot, Cool, Archive or empty", config.AccessTier)
+	}
+	return nil
+}
+
+// ValidateSFTPFsConfig returns nil if the specified SFTP config is valid, otherwise an error
+func ValidateSFTPFsConfig(config *SFTPFsConfig) error {
+	if len(config.Endpoint) == 0 {
+		return errors.New("endpoint cannot be empty")
+	}
+	if _, _, err := net.SplitHostPort(config.Endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint %#v, it must be in the form host:port", config.Endpoint)
+	}
+	if len(config.Username) == 0 {
+		return errors.New("username cannot be empty")
+	}
+	if config.Password.IsEmpty() && config.PrivateKey.IsEmpty() {
+		return errors.New("a password or a private key is required")
+	}
+	if err := config.Password.Validate(); err != nil {
+		return fmt.Errorf("invalid password: %v", err)
+	}
+	if err := config.PrivateKey.Validate(); err != nil {
+		return fmt.Errorf("invalid private_key: %v", err)
+	}
+	fingerprints := make([]string, 0, len(config.Fingerprints))
+	for _, fp := range config.Fingerprints {
+		fp = strings.TrimSpace(fp)
+		if len(fp) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(fp, "SHA256:") {
+			return fmt.Errorf("invalid fingerprint %#v, only SHA256 fingerprints are supported", fp)
+		}
+		fingerprints = append(fingerprints, fp)
+	}
+	config.Fingerprints = fingerprints
+	if len(config.Prefix) == 0 {
+		config.Prefix = "/"
+	}
+	if !path.IsAbs(config.Prefix) {
+		return fmt.Errorf("invalid prefix %#v, it must be an absolute path", config.Prefix)
+	}
+	config.Prefix = path.Clean(config.Prefix)
+	return nil
+}
+
 // SetPathPermissions calls fs.Chown.
-// It does nothing for local filesystem on windows
+// It does nothing for local filesystem on windows and for SFTP filesystems,
+// the local uid/gid have no meaning on the remote server.
+// For a CryptFs the wrapped filesystem is checked
 func SetPathPermissions(fs Fs, path string, uid int, gid int) {
+	if cryptFs, ok := fs.(CryptFs); ok {
+		fs = cryptFs.Fs
+	}
 	if IsLocalOsFs(fs) {
 		if runtime.GOOS == "windows" {
 			return
 		}
 	}
+	if _, ok := fs.(SFTPFs); ok {
+		return
+	}
 	if err := fs.Chown(path, uid, gid); err != nil {
 		fsLog(fs, logger.LevelWarn, "error chowning path %v: %v", path, err)
 	}
@@ -0,0 +1,158 @@
+package webdavd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+var (
+	errTransferClosed   = errors.New("transfer already closed")
+	errInvalidOperation = errors.New("operation not supported for this file")
+	errInvalidSeek      = errors.New("invalid seek offset")
+)
+
+// webDavFile implements webdav.File.
+// Reads and writes are delegated to the SFTP transfers that handle quota,
+// bandwidth throttling, logs, metrics and actions
+type webDavFile struct {
+	connection  *Connection
+	sftpPath    string
+	info        os.FileInfo
+	reader      io.ReaderAt
+	writer      io.WriterAt
+	offset      int64
+	dirPosition int
+	isClosed    bool
+}
+
+func newWebDavFile(connection *Connection, sftpPath string, info os.FileInfo, writer io.WriterAt) *webDavFile {
+	return &webDavFile{
+		connection:  connection,
+		sftpPath:    sftpPath,
+		info:        info,
+		reader:      nil,
+		writer:      writer,
+		offset:      0,
+		dirPosition: 0,
+		isClosed:    false,
+	}
+}
+
+// Read reads the contents to downloads.
+func (f *webDavFile) Read(p []byte) (int, error) {
+	if f.isClosed {
+		return 0, errTransferClosed
+	}
+	if f.writer != nil || f.info.IsDir() {
+		return 0, errInvalidOperation
+	}
+	if f.reader == nil {
+		r, err := f.connection.Fileread(sftp.NewRequest("Get", f.sftpPath))
+		if err != nil {
+			return 0, getWebDavError(err)
+		}
+		f.reader = r
+	}
+	n, err := f.reader.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// Write writes the uploaded contents.
+func (f *webDavFile) Write(p []byte) (int, error) {
+	if f.isClosed {
+		return 0, errTransferClosed
+	}
+	if f.writer == nil {
+		return 0, errInvalidOperation
+	}
+	n, err := f.writer.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset for the next Read or Write.
+// Seeking relative to the end is supported for downloads only since the size of an
+// upload in progress could be unknown, for example for cloud storage backends
+func (f *webDavFile) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = f.offset + offset
+	case io.SeekEnd:
+		if f.writer != nil {
+			return f.offset, errInvalidOperation
+		}
+		newOffset = f.info.Size() + offset
+	default:
+		return f.offset, errInvalidSeek
+	}
+	if newOffset < 0 {
+		return f.offset, errInvalidSeek
+	}
+	f.offset = newOffset
+	return f.offset, nil
+}
+
+// Readdir reads the contents of the directory.
+// If count > 0 at most count entries are returned and io.EOF is returned at the end of the directory
+func (f *webDavFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.info == nil || !f.info.IsDir() {
+		return nil, errInvalidOperation
+	}
+	files, err := f.connection.Connection.ReadDir(f.sftpPath)
+	if err != nil {
+		return nil, getWebDavError(err)
+	}
+	if count <= 0 {
+		f.dirPosition = len(files)
+		return files, nil
+	}
+	if f.dirPosition >= len(files) {
+		return nil, io.EOF
+	}
+	end := f.dirPosition + count
+	if end > len(files) {
+		end = len(files)
+	}
+	result := files[f.dirPosition:end]
+	f.dirPosition = end
+	return result, nil
+}
+
+// Stat returns a FileInfo describing the file.
+// For uploads the FileInfo reflects the bytes written so far
+func (f *webDavFile) Stat() (os.FileInfo, error) {
+	if f.writer != nil {
+		return vfs.NewFileInfo(path.Base(f.sftpPath), false, f.offset, time.Now()), nil
+	}
+	return f.info, nil
+}
+
+// Close closes the underlying transfer, if any
+func (f *webDavFile) Close() error {
+	if f.isClosed {
+		return errTransferClosed
+	}
+	f.isClosed = true
+	if f.reader != nil {
+		if c, ok := f.reader.(io.Closer); ok {
+			return c.Close()
+		}
+	}
+	if f.writer != nil {
+		if c, ok := f.writer.(io.Closer); ok {
+			return c.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package webdavd
+
+import (
+	"context"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/net/webdav"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/sftpd"
+)
+
+// Connection details for a WebDAV request.
+// WebDAV requests are translated to SFTP requests so permissions, quotas
+// and actions are handled by the SFTP connection.
+// It implements the webdav.FileSystem interface
+type Connection struct {
+	sftpd.Connection
+}
+
+// Mkdir creates a directory using the connection filesystem
+func (c *Connection) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return c.handleCmd(sftp.NewRequest("Mkdir", name))
+}
+
+// Rename renames a file or a directory
+func (c *Connection) Rename(ctx context.Context, oldName, newName string) error {
+	request := sftp.NewRequest("Rename", oldName)
+	request.Target = newName
+	return c.handleCmd(request)
+}
+
+// Stat returns a FileInfo describing the named file/directory, or an error,
+// if any happens
+func (c *Connection) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := c.Connection.Stat(name)
+	return fi, getWebDavError(err)
+}
+
+// RemoveAll removes path and any children it contains.
+// Each file is removed on its own so permissions, quota and actions
+// are handled exactly as if the client removes every file
+func (c *Connection) RemoveAll(ctx context.Context, name string) error {
+	fi, err := c.Connection.Stat(name)
+	if err != nil {
+		return getWebDavError(err)
+	}
+	if !fi.IsDir() || fi.Mode()&os.ModeSymlink != 0 {
+		return c.handleCmd(sftp.NewRequest("Remove", name))
+	}
+	files, err := c.Connection.ReadDir(name)
+	if err != nil {
+		return getWebDavError(err)
+	}
+	for _, f := range files {
+		if err := c.RemoveAll(ctx, path.Join(name, f.Name())); err != nil {
+			return err
+		}
+	}
+	return c.handleCmd(sftp.NewRequest("Rmdir", name))
+}
+
+// OpenFile opens the named file for reading or writing
+func (c *Connection) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		w, err := c.Filewrite(sftpd.NewUploadRequest(name, false))
+		if err != nil {
+			return nil, getWebDavError(err)
+		}
+		return newWebDavFile(c, name, nil, w), nil
+	}
+	fi, err := c.Connection.Stat(name)
+	if err != nil {
+		return nil, getWebDavError(err)
+	}
+	// the download transfer is started on the first read, clients open files for many
+	// other reasons, for example to read their properties
+	return newWebDavFile(c, name, fi, nil), nil
+}
+
+func (c *Connection) handleCmd(request *sftp.Request) error {
+	err := c.Filecmd(request)
+	if err == sftp.ErrSSHFxOk {
+		return nil
+	}
+	if err != nil {
+		c.Log(logger.LevelDebug, logSender, "WebDAV command %v for path %#v failed: %v", request.Method,
+			request.Filepath, err)
+	}
+	return getWebDavError(err)
+}
+
+// getWebDavError converts the SFTP errors to the errors expected by the WebDAV handler
+// so, for example, a missing file is reported as 404 and not as 500
+func getWebDavError(err error) error {
+	switch err {
+	case sftp.ErrSSHFxNoSuchFile:
+		return os.ErrNotExist
+	case sftp.ErrSSHFxPermissionDenied:
+		return os.ErrPermission
+	}
+	return err
+}
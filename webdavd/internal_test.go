@@ -0,0 +1,135 @@
+package webdavd
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+type mockWriterAt struct {
+	buf      bytes.Buffer
+	isClosed bool
+}
+
+func (w *mockWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *mockWriterAt) Close() error {
+	w.isClosed = true
+	return nil
+}
+
+func TestWebDavErrors(t *testing.T) {
+	if !os.IsNotExist(getWebDavError(sftp.ErrSSHFxNoSuchFile)) {
+		t.Errorf("unexpected error conversion for missing files")
+	}
+	if !os.IsPermission(getWebDavError(sftp.ErrSSHFxPermissionDenied)) {
+		t.Errorf("unexpected error conversion for permission denied")
+	}
+	if getWebDavError(sftp.ErrSSHFxFailure) != sftp.ErrSSHFxFailure {
+		t.Errorf("unexpected error conversion for generic failures")
+	}
+	if getWebDavError(nil) != nil {
+		t.Errorf("nil error must not be converted")
+	}
+}
+
+func TestFileSeek(t *testing.T) {
+	info := vfs.NewFileInfo("file", false, 100, time.Now())
+	f := newWebDavFile(nil, "/file", info, nil)
+	offset, err := f.Seek(-10, io.SeekEnd)
+	if err != nil || offset != 90 {
+		t.Errorf("unexpected seek result offset: %v err: %v", offset, err)
+	}
+	offset, err = f.Seek(5, io.SeekCurrent)
+	if err != nil || offset != 95 {
+		t.Errorf("unexpected seek result offset: %v err: %v", offset, err)
+	}
+	_, err = f.Seek(-1, io.SeekStart)
+	if err != errInvalidSeek {
+		t.Errorf("seek to a negative offset must fail")
+	}
+	_, err = f.Seek(0, 10)
+	if err != errInvalidSeek {
+		t.Errorf("seek with an invalid whence must fail")
+	}
+	_, err = f.Write([]byte("data"))
+	if err != errInvalidOperation {
+		t.Errorf("write on a download must fail")
+	}
+	_, err = f.Readdir(0)
+	if err != errInvalidOperation {
+		t.Errorf("readdir on a file must fail")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Errorf("unexpected close error: %v", err)
+	}
+	_, err = f.Read(make([]byte, 10))
+	if err != errTransferClosed {
+		t.Errorf("read on a closed file must fail")
+	}
+}
+
+func TestFileUpload(t *testing.T) {
+	writer := &mockWriterAt{}
+	f := newWebDavFile(nil, "/dir/upload", nil, writer)
+	n, err := f.Write([]byte("data"))
+	if err != nil || n != 4 {
+		t.Errorf("unexpected write result n: %v err: %v", n, err)
+	}
+	_, err = f.Seek(0, io.SeekEnd)
+	if err != errInvalidOperation {
+		t.Errorf("seek from the end must fail for uploads")
+	}
+	_, err = f.Read(make([]byte, 10))
+	if err != errInvalidOperation {
+		t.Errorf("read on an upload must fail")
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Size() != 4 || fi.Name() != "upload" {
+		t.Errorf("unexpected stat result: %+v, err: %v", fi, err)
+	}
+	err = f.Close()
+	if err != nil || !writer.isClosed {
+		t.Errorf("unexpected close result: %v", err)
+	}
+	err = f.Close()
+	if err != errTransferClosed {
+		t.Errorf("closing a file twice must fail")
+	}
+}
+
+func TestMissingCredentials(t *testing.T) {
+	s := &webDavServer{}
+	req, _ := http.NewRequest("PROPFIND", "/", nil)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status code: %v", rr.Code)
+	}
+	if len(rr.Header().Get("WWW-Authenticate")) == 0 {
+		t.Errorf("authentication challenge not sent")
+	}
+}
+
+func TestRemoteAddress(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	if getRemoteAddress(req).String() != req.RemoteAddr {
+		t.Errorf("unexpected remote address: %v", getRemoteAddress(req).String())
+	}
+	req.RemoteAddr = "invalid"
+	if getRemoteAddress(req) == nil {
+		t.Errorf("remote address cannot be nil")
+	}
+}
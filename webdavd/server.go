@@ -0,0 +1,114 @@
+package webdavd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/rs/xid"
+	"golang.org/x/net/webdav"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const authRealm = "SFTPGo WebDAV"
+
+type webDavServer struct {
+	config     Configuration
+	lockSystem webdav.LockSystem
+}
+
+// ServeHTTP authenticates the user and serves the WebDAV request.
+// WebDAV is stateless so each request is authenticated and it is tracked as a new connection
+func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ipAddr := utils.GetIPFromRemoteAddress(r.RemoteAddr); sftpd.IsBanned(ipAddr) {
+		logger.Debug(logSender, "", "request refused, the remote host %#v is banned", ipAddr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=\"%v\"", authRealm))
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	connectionID := fmt.Sprintf("%v_%v", protocolWebDAV, xid.New().String())
+	user, err := s.authenticate(username, password, r.RemoteAddr)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=\"%v\"", authRealm))
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	fs, err := user.GetFilesystem(connectionID)
+	if err != nil {
+		logger.Warn(logSender, connectionID, "could create filesystem for user %#v err: %v", user.Username, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	connection := &Connection{
+		Connection: sftpd.NewConnection(connectionID, protocolWebDAV, r.UserAgent(), getRemoteAddress(r), user, fs,
+			&requestCanceler{cancel: cancel}),
+	}
+	sftpd.AddConnection(connection.Connection)
+	defer sftpd.RemoveConnection(connectionID)
+	dataprovider.UpdateLastLogin(dataProvider, user)
+
+	connection.Log(logger.LevelDebug, logSender, "new WebDAV request, method: %v path: %#v user: %#v", r.Method,
+		r.URL.Path, user.Username)
+	handler := &webdav.Handler{
+		FileSystem: connection,
+		LockSystem: s.lockSystem,
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				connection.Log(logger.LevelDebug, logSender, "WebDAV request %v %#v completed with error: %v",
+					r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (s *webDavServer) authenticate(username, password, remoteAddr string) (dataprovider.User, error) {
+	method := dataprovider.SSHLoginMethodPassword
+	metrics.AddLoginAttempt(method)
+	user, err := dataprovider.CheckUserAndPass(dataProvider, username, password,
+		utils.GetIPFromRemoteAddress(remoteAddr), protocolWebDAV)
+	if err == nil {
+		err = sftpd.CheckLoginConditions(user, method, remoteAddr)
+	}
+	if err != nil {
+		ipAddr := utils.GetIPFromRemoteAddress(remoteAddr)
+		logger.ConnectionFailedLog(username, ipAddr, method, err.Error())
+		sftpd.AddDefenderEvent(ipAddr, sftpd.GetLoginFailedEvent(err))
+	}
+	metrics.AddLoginResult(method, err)
+	return user, err
+}
+
+// requestCanceler allows to abort a WebDAV request, for example if it is idle
+// or if the connection is closed using the REST API
+type requestCanceler struct {
+	cancel context.CancelFunc
+}
+
+func (c *requestCanceler) Close() error {
+	c.cancel()
+	return nil
+}
+
+func getRemoteAddress(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}